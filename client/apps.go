@@ -5,8 +5,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/cozy/cozy-stack/client/request"
 	"github.com/cozy/cozy-stack/pkg/permissions"
@@ -42,13 +45,23 @@ type AppManifest struct {
 			Index  string `json:"index"`
 			Public bool   `json:"public"`
 		} `json:"routes"`
+		Databases   []string `json:"databases,omitempty"`
+		DataRemoval *struct {
+			Doctypes []string  `json:"doctypes"`
+			At       time.Time `json:"at"`
+		} `json:"data_removal,omitempty"`
 	} `json:"attributes"`
 }
 
-// AppOptions holds the options to install an application.
+// AppOptions holds the options to install an application. Username and
+// Password are the credentials of a private git repository. RemoveData is used
+// for an uninstallation, to remove the data used only by the application.
 type AppOptions struct {
-	Slug      string
-	SourceURL string
+	Slug       string
+	SourceURL  string
+	Username   string
+	Password   string
+	RemoveData bool
 }
 
 // InstallApp is used to install an application.
@@ -58,9 +71,8 @@ func (c *Client) InstallApp(opts *AppOptions) (*AppManifest, error) {
 		// TODO replace QueryEscape with PathEscape when we will no longer support go 1.7
 		Path:    "/apps/" + url.QueryEscape(opts.Slug),
 		Queries: url.Values{"Source": {opts.SourceURL}},
-		Headers: request.Headers{
-			"Accept": "text/event-stream",
-		},
+		Headers: appCredentialsHeaders(opts),
+		Body:    appCredentialsBody(opts),
 	})
 	if err != nil {
 		return nil, err
@@ -71,11 +83,10 @@ func (c *Client) InstallApp(opts *AppOptions) (*AppManifest, error) {
 // UpdateApp is used to update an application.
 func (c *Client) UpdateApp(opts *AppOptions) (*AppManifest, error) {
 	res, err := c.Req(&request.Options{
-		Method: "PUT",
-		Path:   "/apps/" + url.QueryEscape(opts.Slug),
-		Headers: request.Headers{
-			"Accept": "text/event-stream",
-		},
+		Method:  "PUT",
+		Path:    "/apps/" + url.QueryEscape(opts.Slug),
+		Headers: appCredentialsHeaders(opts),
+		Body:    appCredentialsBody(opts),
 	})
 	if err != nil {
 		return nil, err
@@ -83,11 +94,36 @@ func (c *Client) UpdateApp(opts *AppOptions) (*AppManifest, error) {
 	return readAppManifestStream(res)
 }
 
+// appCredentialsHeaders returns the headers of an installation or an update,
+// with the content-type of the form of the credentials if there are some.
+func appCredentialsHeaders(opts *AppOptions) request.Headers {
+	headers := request.Headers{"Accept": "text/event-stream"}
+	if opts.Username != "" || opts.Password != "" {
+		headers["Content-Type"] = "application/x-www-form-urlencoded"
+	}
+	return headers
+}
+
+// appCredentialsBody returns the form with the credentials of a private
+// repository, as they must not be put in the URL.
+func appCredentialsBody(opts *AppOptions) io.Reader {
+	if opts.Username == "" && opts.Password == "" {
+		return nil
+	}
+	form := url.Values{"Username": {opts.Username}, "Password": {opts.Password}}
+	return strings.NewReader(form.Encode())
+}
+
 // UninstallApp is used to uninstall an application.
 func (c *Client) UninstallApp(opts *AppOptions) (*AppManifest, error) {
+	data := "keep"
+	if opts.RemoveData {
+		data = "remove"
+	}
 	res, err := c.Req(&request.Options{
-		Method: "DELETE",
-		Path:   "/apps/" + url.QueryEscape(opts.Slug),
+		Method:  "DELETE",
+		Path:    "/apps/" + url.QueryEscape(opts.Slug),
+		Queries: url.Values{"Data": {data}},
 	})
 	if err != nil {
 		return nil, err
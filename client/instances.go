@@ -1,10 +1,12 @@
 package client
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -16,12 +18,15 @@ type Instance struct {
 	ID    string `json:"id"`
 	Rev   string `json:"rev"`
 	Attrs struct {
-		Domain         string `json:"domain"`
-		Locale         string `json:"locale"`
-		StorageURL     string `json:"storage"`
-		Dev            bool   `json:"dev"`
-		PassphraseHash []byte `json:"passphrase_hash,omitempty"`
-		RegisterToken  []byte `json:"register_token,omitempty"`
+		Domain         string          `json:"domain"`
+		Locale         string          `json:"locale"`
+		StorageURL     string          `json:"storage"`
+		Context        string          `json:"context,omitempty"`
+		EmailDomain    string          `json:"email_domain,omitempty"`
+		Apps           []string        `json:"apps,omitempty"`
+		DevOptions     map[string]bool `json:"dev_options"`
+		PassphraseHash []byte          `json:"passphrase_hash,omitempty"`
+		RegisterToken  []byte          `json:"register_token,omitempty"`
 	} `json:"attributes"`
 }
 
@@ -32,7 +37,9 @@ type InstanceOptions struct {
 	Timezone   string
 	Email      string
 	Apps       []string
+	Context    string
 	Dev        bool
+	DevOptions []string
 	Passphrase string
 }
 
@@ -75,7 +82,9 @@ func (c *Client) CreateInstance(opts *InstanceOptions) (*Instance, error) {
 			"Timezone":   {opts.Timezone},
 			"Email":      {opts.Email},
 			"Apps":       {strings.Join(opts.Apps, ",")},
+			"Context":    {opts.Context},
 			"Dev":        {dev},
+			"DevOptions": {strings.Join(opts.DevOptions, ",")},
 			"Passphrase": {opts.Passphrase},
 		},
 	})
@@ -101,6 +110,238 @@ func (c *Client) ListInstances() ([]*Instance, error) {
 	return list, nil
 }
 
+// SearchOptions are the criteria of a search of instances. The empty
+// criteria are ignored.
+type SearchOptions struct {
+	EmailDomain string
+	Locale      string
+	Context     string
+	App         string
+	Limit       int
+	Skip        int
+}
+
+// SearchInstances returns the instances matching all the given criteria.
+func (c *Client) SearchInstances(opts *SearchOptions) ([]*Instance, error) {
+	res, err := c.Req(&request.Options{
+		Method: "GET",
+		Path:   "/instances/search",
+		Queries: url.Values{
+			"EmailDomain": {opts.EmailDomain},
+			"Locale":      {opts.Locale},
+			"Context":     {opts.Context},
+			"App":         {opts.App},
+			"Limit":       {strconv.Itoa(opts.Limit)},
+			"Skip":        {strconv.Itoa(opts.Skip)},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var list []*Instance
+	if err = readJSONAPI(res.Body, &list, nil); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// ReindexInstance updates the attributes of an instance used by the search,
+// the domain of the email of its owner and its installed applications.
+func (c *Client) ReindexInstance(domain string) error {
+	if !validDomain(domain) {
+		return fmt.Errorf("Invalid domain: %s", domain)
+	}
+	_, err := c.Req(&request.Options{
+		Method:     "POST",
+		Path:       "/instances/" + domain + "/reindex",
+		NoResponse: true,
+	})
+	return err
+}
+
+// RotateSecrets generates new secrets for the session cookies and the tokens
+// of an instance. The previous ones are still accepted during a grace period.
+func (c *Client) RotateSecrets(domain string) error {
+	if !validDomain(domain) {
+		return fmt.Errorf("Invalid domain: %s", domain)
+	}
+	_, err := c.Req(&request.Options{
+		Method:     "POST",
+		Path:       "/instances/" + domain + "/rotate_secrets",
+		NoResponse: true,
+	})
+	return err
+}
+
+// MigrateDBs moves the databases of an instance to their CouchDB-safe names,
+// if they still have the legacy names.
+func (c *Client) MigrateDBs(domain string) error {
+	if !validDomain(domain) {
+		return fmt.Errorf("Invalid domain: %s", domain)
+	}
+	_, err := c.Req(&request.Options{
+		Method:     "POST",
+		Path:       "/instances/" + domain + "/migrate_dbs",
+		NoResponse: true,
+	})
+	return err
+}
+
+// RevokeToken adds a token to the revocation list of an instance, so that it
+// is refused before its expiration.
+func (c *Client) RevokeToken(domain, token string) error {
+	if !validDomain(domain) {
+		return fmt.Errorf("Invalid domain: %s", domain)
+	}
+	body := url.Values{"token": {token}}.Encode()
+	_, err := c.Req(&request.Options{
+		Method: "POST",
+		Path:   "/instances/" + domain + "/revoke_token",
+		Headers: request.Headers{
+			"Content-Type": "application/x-www-form-urlencoded",
+		},
+		Body:       strings.NewReader(body),
+		NoResponse: true,
+	})
+	return err
+}
+
+// SlugCollision is an application whose slug is reserved or collides with
+// the domain of another instance.
+type SlugCollision struct {
+	Domain string `json:"domain"`
+	Slug   string `json:"slug"`
+	Reason string `json:"reason"`
+}
+
+// AuditSlugs returns the applications installed on the instances of the
+// stack whose slug is reserved or collides with the domain of another
+// instance.
+func (c *Client) AuditSlugs() ([]*SlugCollision, error) {
+	res, err := c.Req(&request.Options{
+		Method: "GET",
+		Path:   "/instances/slug_collisions",
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var list []*SlugCollision
+	if err = json.NewDecoder(res.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// GCStats are the statistics of a run of the garbage collector of the VFS of
+// an instance.
+type GCStats struct {
+	Policy       string    `json:"policy"`
+	StartedAt    time.Time `json:"started_at"`
+	FinishedAt   time.Time `json:"finished_at"`
+	ScannedFiles int       `json:"scanned_files"`
+	ScannedBlobs int       `json:"scanned_blobs"`
+	OrphanBlobs  []string  `json:"orphan_blobs"`
+	MissingBlobs []string  `json:"missing_blobs"`
+	Quarantined  int       `json:"quarantined"`
+	Cleaned      int       `json:"cleaned"`
+}
+
+// CollectGarbage runs the garbage collector of the VFS of an instance, with
+// the given policy (report, quarantine or clean), and returns its statistics.
+func (c *Client) CollectGarbage(domain, policy string) (*GCStats, error) {
+	if !validDomain(domain) {
+		return nil, fmt.Errorf("Invalid domain: %s", domain)
+	}
+	res, err := c.Req(&request.Options{
+		Method:  "POST",
+		Path:    "/instances/" + domain + "/gc",
+		Queries: url.Values{"Policy": {policy}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	stats := &GCStats{}
+	if err = json.NewDecoder(res.Body).Decode(stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// SetDevOptions replaces the development toggles of an instance by the given
+// ones (allow_http, relax_csp, allow_unsigned_apps, verbose_errors,
+// proxy_apps), and returns them.
+func (c *Client) SetDevOptions(domain string, toggles []string) (map[string]bool, error) {
+	if !validDomain(domain) {
+		return nil, fmt.Errorf("Invalid domain: %s", domain)
+	}
+	res, err := c.Req(&request.Options{
+		Method:  "PUT",
+		Path:    "/instances/" + domain + "/dev_options",
+		Queries: url.Values{"DevOptions": {strings.Join(toggles, ",")}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var opts map[string]bool
+	if err = json.NewDecoder(res.Body).Decode(&opts); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+// SnapshotInstance takes a snapshot of the databases and files of an
+// instance, and returns its identifier. The snapshots are kept in the memory
+// of the stack, and are lost when it is restarted.
+func (c *Client) SnapshotInstance(domain string) (string, error) {
+	if !validDomain(domain) {
+		return "", fmt.Errorf("Invalid domain: %s", domain)
+	}
+	res, err := c.Req(&request.Options{
+		Method: "POST",
+		Path:   "/instances/" + domain + "/snapshots",
+	})
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	var snapshot struct {
+		ID string `json:"id"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&snapshot); err != nil {
+		return "", err
+	}
+	return snapshot.ID, nil
+}
+
+// RestoreSnapshot puts an instance back in the state of the given snapshot.
+func (c *Client) RestoreSnapshot(domain, id string) error {
+	if !validDomain(domain) {
+		return fmt.Errorf("Invalid domain: %s", domain)
+	}
+	_, err := c.Req(&request.Options{
+		Method:     "POST",
+		Path:       "/instances/" + domain + "/snapshots/" + url.QueryEscape(id) + "/restore",
+		NoResponse: true,
+	})
+	return err
+}
+
+// DeleteSnapshot removes a snapshot of an instance.
+func (c *Client) DeleteSnapshot(domain, id string) error {
+	if !validDomain(domain) {
+		return fmt.Errorf("Invalid domain: %s", domain)
+	}
+	_, err := c.Req(&request.Options{
+		Method:     "DELETE",
+		Path:       "/instances/" + domain + "/snapshots/" + url.QueryEscape(id),
+		NoResponse: true,
+	})
+	return err
+}
+
 // DestroyInstance is used to delete an instance and all its data.
 func (c *Client) DestroyInstance(domain string) (*Instance, error) {
 	if !validDomain(domain) {
@@ -16,6 +16,9 @@ var errAppsMissingDomain = errors.New("Missing --domain flag")
 
 var flagAppsDomain string
 var flagAllDomains bool
+var flagAppsRemoveData bool
+var flagAppsUsername string
+var flagAppsPassword string
 
 var appsCmdGroup = &cobra.Command{
 	Use:   "apps [command]",
@@ -33,21 +36,15 @@ a cozy.
 
 var installAppCmd = &cobra.Command{
 	Use:     "install [slug] [sourceurl]",
-	Short:   "Install an application with the specified slug name from the given source URL.",
+	Short:   "Install an application with the specified slug name from the given source URL (or from the registry if no source is given).",
 	Example: "$ cozy-stack apps install --domain cozy.local:8080 files 'git://github.com/cozy-files-v3.git#build'",
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if len(args) < 1 {
 			return cmd.Help()
 		}
 		slug := args[0]
-		var source string
-		if len(args) == 1 {
-			s, ok := consts.AppsRegistry[slug]
-			if !ok {
-				return cmd.Help()
-			}
-			source = s
-		} else {
+		source := "registry://" + slug
+		if len(args) > 1 {
 			source = args[1]
 		}
 		if flagAllDomains {
@@ -56,6 +53,8 @@ var installAppCmd = &cobra.Command{
 				_, err := c.InstallApp(&client.AppOptions{
 					Slug:      slug,
 					SourceURL: source,
+					Username:  flagAppsUsername,
+					Password:  flagAppsPassword,
 				})
 				return err
 			})
@@ -68,6 +67,8 @@ var installAppCmd = &cobra.Command{
 		app, err := c.InstallApp(&client.AppOptions{
 			Slug:      slug,
 			SourceURL: source,
+			Username:  flagAppsUsername,
+			Password:  flagAppsPassword,
 		})
 		if err != nil {
 			return err
@@ -92,7 +93,11 @@ var updateAppCmd = &cobra.Command{
 		if flagAllDomains {
 			return foreachDomains(func(in *client.Instance) error {
 				c := newClient(in.Attrs.Domain, consts.Apps)
-				_, err := c.UpdateApp(&client.AppOptions{Slug: args[0]})
+				_, err := c.UpdateApp(&client.AppOptions{
+					Slug:     args[0],
+					Username: flagAppsUsername,
+					Password: flagAppsPassword,
+				})
 				return err
 			})
 		}
@@ -101,7 +106,11 @@ var updateAppCmd = &cobra.Command{
 			return cmd.Help()
 		}
 		c := newClient(flagAppsDomain, consts.Apps)
-		app, err := c.UpdateApp(&client.AppOptions{Slug: args[0]})
+		app, err := c.UpdateApp(&client.AppOptions{
+			Slug:     args[0],
+			Username: flagAppsUsername,
+			Password: flagAppsPassword,
+		})
 		if err != nil {
 			return err
 		}
@@ -118,6 +127,16 @@ var uninstallAppCmd = &cobra.Command{
 	Use:     "uninstall [slug]",
 	Short:   "Uninstall the application with the specified slug name.",
 	Aliases: []string{"rm"},
+	Long: `
+cozy-stack apps uninstall removes the application with the specified slug
+name. The databases of the doctypes owned by the application, listed in the
+databases field of its manifest, are destroyed, if no other application uses
+them. Its other data are kept by default.
+
+With --remove-data, the databases of the doctypes on which the application
+had a permission to write, and that no other application uses, are also
+destroyed, after a grace period of 7 days.
+`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if len(args) != 1 {
 			return cmd.Help()
@@ -127,7 +146,10 @@ var uninstallAppCmd = &cobra.Command{
 			return cmd.Help()
 		}
 		c := newClient(flagAppsDomain, consts.Apps)
-		app, err := c.UninstallApp(&client.AppOptions{Slug: args[0]})
+		app, err := c.UninstallApp(&client.AppOptions{
+			Slug:       args[0],
+			RemoveData: flagAppsRemoveData,
+		})
 		if err != nil {
 			return err
 		}
@@ -164,6 +186,12 @@ func init() {
 	appsCmdGroup.PersistentFlags().StringVar(&flagAppsDomain, "domain", "", "specify the domain name of the instance")
 	appsCmdGroup.PersistentFlags().BoolVar(&flagAllDomains, "all-domains", false, "work on all domains iterativelly")
 
+	for _, cmd := range []*cobra.Command{installAppCmd, updateAppCmd} {
+		cmd.Flags().StringVar(&flagAppsUsername, "git-username", "", "the username for a private git repository")
+		cmd.Flags().StringVar(&flagAppsPassword, "git-password", "", "the password or the token for a private git repository")
+	}
+	uninstallAppCmd.Flags().BoolVar(&flagAppsRemoveData, "remove-data", false, "Remove the data used only by the application")
+
 	appsCmdGroup.AddCommand(installAppCmd)
 	appsCmdGroup.AddCommand(updateAppCmd)
 	appsCmdGroup.AddCommand(uninstallAppCmd)
@@ -1,6 +1,15 @@
 package cmd
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"text/tabwriter"
+
+	"github.com/cozy/cozy-stack/web"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/labstack/echo"
 	"github.com/spf13/cobra"
 	"github.com/spf13/cobra/doc"
 )
@@ -49,8 +58,68 @@ var markdownDocCmd = &cobra.Command{
 	},
 }
 
+var openapiDocCmd = &cobra.Command{
+	Use:   "openapi [file]",
+	Short: "Print the OpenAPI description of the HTTP API",
+	Long: `Print the description of the routes of the HTTP API in the OpenAPI format.
+It is the same document as the one served by the stack on /openapi.json, and
+it can be used to generate the client SDKs.`,
+	Example: `$ cozy-stack doc openapi openapi.json`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		router := echo.New()
+		if err := web.SetupRoutes(router); err != nil {
+			return err
+		}
+		document := web.APISpec().Build(router.Routes())
+		data, err := json.MarshalIndent(document, "", "  ")
+		if err != nil {
+			return err
+		}
+		if len(args) == 1 {
+			return ioutil.WriteFile(args[0], data, 0644)
+		}
+		_, err = os.Stdout.Write(data)
+		return err
+	},
+}
+
+var flagRoutesUnprotected bool
+
+var routesDocCmd = &cobra.Command{
+	Use:   "routes",
+	Short: "Print the routes of the HTTP API with their permissions",
+	Long: `Print the routes of the HTTP API, with the permission that is declared for
+them and enforced before calling their handlers. The routes without a declared
+permission are marked with "-": their handlers must check the permissions
+themselves.`,
+	Example: `$ cozy-stack doc routes --unprotected`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		router := echo.New()
+		if err := web.SetupRoutes(router); err != nil {
+			return err
+		}
+		list := permissions.Audit(router.Routes())
+		if flagRoutesUnprotected {
+			list = permissions.Unprotected(router.Routes())
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		for _, r := range list {
+			rule := "-"
+			if r.Rule != nil {
+				rule = r.Rule.Name
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", r.Method, r.Path, rule)
+		}
+		return w.Flush()
+	},
+}
+
 func init() {
+	routesDocCmd.Flags().BoolVar(&flagRoutesUnprotected, "unprotected", false, "Only print the routes without a declared permission")
+
 	docCmdGroup.AddCommand(manDocCmd)
 	docCmdGroup.AddCommand(markdownDocCmd)
+	docCmdGroup.AddCommand(openapiDocCmd)
+	docCmdGroup.AddCommand(routesDocCmd)
 	RootCmd.AddCommand(docCmdGroup)
 }
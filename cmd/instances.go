@@ -5,6 +5,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
@@ -18,9 +19,13 @@ var flagLocale string
 var flagTimezone string
 var flagEmail string
 var flagApps []string
+var flagContext string
 var flagDev bool
+var flagDevOptions []string
 var flagPassphrase string
 var flagExpire time.Duration
+var flagGCPolicy string
+var flagSearch client.SearchOptions
 
 // instanceCmdGroup represents the instances command
 var instanceCmdGroup = &cobra.Command{
@@ -59,10 +64,12 @@ given domain.
 		in, err := c.CreateInstance(&client.InstanceOptions{
 			Domain:     domain,
 			Apps:       flagApps,
+			Context:    flagContext,
 			Locale:     flagLocale,
 			Timezone:   flagTimezone,
 			Email:      flagEmail,
 			Dev:        flagDev,
+			DevOptions: flagDevOptions,
 			Passphrase: flagPassphrase,
 		})
 		if err != nil {
@@ -94,19 +101,305 @@ by this server.
 		}
 
 		for _, i := range list {
-			var dev string
-			if i.Attrs.Dev {
-				dev = "dev"
-			} else {
-				dev = "prod"
+			fmt.Printf("%s\t%s\t%s\n", i.Attrs.Domain, i.Attrs.StorageURL, devOptionsString(i.Attrs.DevOptions))
+		}
+
+		return nil
+	},
+}
+
+var devOptionsInstanceCmd = &cobra.Command{
+	Use:   "dev-options [domain] [toggles]",
+	Short: "Change the development toggles of an instance",
+	Long: `
+cozy-stack instances dev-options replaces the development toggles of an
+instance by the given comma-separated list. The toggles are:
+
+- allow_http: use http for the URLs of the instance, without HSTS and secure
+  cookies
+- relax_csp: send the Content-Security-Policy in report-only mode
+- allow_unsigned_apps: install applications from sources that are not in the
+  installs.allowed_sources of the configuration
+- verbose_errors: log the errors of the HTTP requests on the instance
+- proxy_apps: install applications with a dev:// source, served by proxying
+  the requests to a development server
+
+Without toggles, they are all disabled.
+`,
+	Example: "$ cozy-stack instances dev-options cozy.local:8080 allow_http,verbose_errors",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return cmd.Help()
+		}
+		var toggles []string
+		if len(args) > 1 {
+			toggles = strings.Split(args[1], ",")
+		}
+		c := newAdminClient()
+		opts, err := c.SetDevOptions(args[0], toggles)
+		if err != nil {
+			return err
+		}
+		fmt.Println(devOptionsString(opts))
+		return nil
+	},
+}
+
+// devOptionsString returns the enabled development toggles, or prod if there
+// are none.
+func devOptionsString(opts map[string]bool) string {
+	var toggles []string
+	for name, enabled := range opts {
+		if enabled {
+			toggles = append(toggles, name)
+		}
+	}
+	if len(toggles) == 0 {
+		return "prod"
+	}
+	sort.Strings(toggles)
+	return strings.Join(toggles, ",")
+}
+
+var searchInstanceCmd = &cobra.Command{
+	Use:   "search",
+	Short: "Search the instances by email domain, locale, context or app",
+	Long: `
+cozy-stack instances search lists the instances matching all the given
+criteria: the domain of the email of their owner, their locale, their context
+and an application installed on them. The default context also matches the
+instances created without context.
+
+The email domains and the applications of the instances created before the
+search was added are known only after a reindex.
+`,
+	Example: "$ cozy-stack instances search --locale fr --app bank",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c := newAdminClient()
+		list, err := c.SearchInstances(&flagSearch)
+		if err != nil {
+			return err
+		}
+		for _, i := range list {
+			fmt.Printf("%s\t%s\t%s\t%s\t%s\n", i.Attrs.Domain, i.Attrs.Locale,
+				i.Attrs.Context, i.Attrs.EmailDomain, strings.Join(i.Attrs.Apps, ","))
+		}
+		return nil
+	},
+}
+
+var reindexInstanceCmd = &cobra.Command{
+	Use:   "reindex [domain]",
+	Short: "Update the attributes of the instances used by the search",
+	Long: `
+cozy-stack instances reindex copies the domain of the email of the owner and
+the list of the installed applications in the document of an instance, where
+they are used by the search. They are kept up-to-date by the stack, so it is
+only needed for the instances created before the search was added.
+
+Without domain, all the instances are reindexed.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c := newAdminClient()
+		domains := args
+		if len(domains) == 0 {
+			list, err := c.ListInstances()
+			if err != nil {
+				return err
+			}
+			for _, i := range list {
+				domains = append(domains, i.Attrs.Domain)
+			}
+		}
+		for _, domain := range domains {
+			if err := c.ReindexInstance(domain); err != nil {
+				return fmt.Errorf("Could not reindex %s: %s", domain, err)
 			}
-			fmt.Printf("%s\t%s\t%s\n", i.Attrs.Domain, i.Attrs.StorageURL, dev)
 		}
+		return nil
+	},
+}
 
+var migrateDBsInstanceCmd = &cobra.Command{
+	Use:   "migrate-dbs [domain]",
+	Short: "Rename the databases of the instances with the CouchDB-safe names",
+	Long: `
+cozy-stack instances migrate-dbs moves the databases of an instance created
+before the CouchDB-safe names of the databases, like alice-cozy-tools/io-cozy-files,
+to these names, like alice-cozy-tools_io-cozy-files. The documents are copied
+with their revisions, and the old databases are deleted.
+
+The instance must not be used during the migration, as the documents written
+in the meantime could be lost. Without domain, all the instances are migrated.
+`,
+	Example: "$ cozy-stack instances migrate-dbs cozy.tools:8080",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c := newAdminClient()
+		domains := args
+		if len(domains) == 0 {
+			list, err := c.ListInstances()
+			if err != nil {
+				return err
+			}
+			for _, i := range list {
+				domains = append(domains, i.Attrs.Domain)
+			}
+		}
+		for _, domain := range domains {
+			if err := c.MigrateDBs(domain); err != nil {
+				return fmt.Errorf("Could not migrate the databases of %s: %s", domain, err)
+			}
+		}
 		return nil
 	},
 }
 
+var rotateSecretsInstanceCmd = &cobra.Command{
+	Use:   "rotate-secrets [domain]",
+	Short: "Generate new secrets for the cookies and the tokens of an instance",
+	Long: `
+cozy-stack instances rotate-secrets generates new secrets for the session
+cookies and the tokens of an instance. The new tokens are signed with them,
+but the cookies and the tokens signed with the previous secrets are still
+accepted during a grace period of 7 days.
+
+After this period, the tokens that were not renewed are refused: the OAuth
+clients get a new refresh token when they use the old one, but the share
+codes and the registration tokens of the OAuth clients must be created again.
+`,
+	Example: "$ cozy-stack instances rotate-secrets cozy.tools:8080",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return cmd.Help()
+		}
+		c := newAdminClient()
+		return c.RotateSecrets(args[0])
+	},
+}
+
+var revokeTokenInstanceCmd = &cobra.Command{
+	Use:   "revoke-token [domain] [token]",
+	Short: "Revoke a token of an instance",
+	Long: `
+cozy-stack instances revoke-token adds a token to the revocation list of an
+instance. It is refused from now on, even if it has not expired, and the other
+tokens are still accepted.
+
+The tokens issued before they had a unique id can't be revoked this way: the
+secrets of the instance must be rotated instead.
+`,
+	Example: "$ cozy-stack instances revoke-token cozy.tools:8080 eyJhbGciOiJIUzUxMiIsInR5cCI6IkpXVCJ9...",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 2 {
+			return cmd.Help()
+		}
+		c := newAdminClient()
+		return c.RevokeToken(args[0], args[1])
+	},
+}
+
+var auditSlugsInstanceCmd = &cobra.Command{
+	Use:   "audit-slugs",
+	Short: "List the applications with a reserved or colliding slug",
+	Long: `
+cozy-stack instances audit-slugs lists the applications installed on the
+instances of this stack whose slug is reserved, or whose subdomain is the
+domain of another instance. Such applications can't be installed anymore, but
+they may have been installed before these checks were added.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c := newAdminClient()
+		list, err := c.AuditSlugs()
+		if err != nil {
+			return err
+		}
+		for _, collision := range list {
+			fmt.Printf("%s\t%s\t%s\n", collision.Domain, collision.Slug, collision.Reason)
+		}
+		return nil
+	},
+}
+
+var gcInstanceCmd = &cobra.Command{
+	Use:   "gc [domain]",
+	Short: "Collect the garbage of the VFS of an instance",
+	Long: `
+cozy-stack instances gc looks for the files of the storage that have no
+document in CouchDB, like the leftovers of failed uploads, and for the file
+documents whose content is missing from the storage.
+
+With the report policy, they are only listed. With the quarantine policy, the
+files without document are moved to the .cozy_quarantine directory of the
+storage. With the clean policy, they are removed, and the documents without
+content are deleted.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return cmd.Help()
+		}
+		c := newAdminClient()
+		stats, err := c.CollectGarbage(args[0], flagGCPolicy)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Scanned %d files and %d blobs\n", stats.ScannedFiles, stats.ScannedBlobs)
+		for _, name := range stats.OrphanBlobs {
+			fmt.Printf("orphan\t%s\n", name)
+		}
+		for _, id := range stats.MissingBlobs {
+			fmt.Printf("missing\t%s\n", id)
+		}
+		fmt.Printf("Quarantined: %d, cleaned: %d\n", stats.Quarantined, stats.Cleaned)
+		return nil
+	},
+}
+
+var snapshotInstanceCmd = &cobra.Command{
+	Use:   "snapshot [domain]",
+	Short: "Take a snapshot of the databases and files of an instance",
+	Long: `
+cozy-stack instances snapshot copies the databases and the files of an
+instance, and prints the identifier of the snapshot. The instance can be put
+back in this state with cozy-stack instances restore, which is a lot faster
+than recreating it between the test cases of an integration test suite.
+
+The snapshots are kept in the memory of the stack, and are lost when it is
+restarted.
+`,
+	Example: "$ cozy-stack instances snapshot cozy.local:8080",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return cmd.Help()
+		}
+		c := newAdminClient()
+		id, err := c.SnapshotInstance(args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Println(id)
+		return nil
+	},
+}
+
+var restoreInstanceCmd = &cobra.Command{
+	Use:   "restore [domain] [snapshot]",
+	Short: "Restore an instance from one of its snapshots",
+	Long: `
+cozy-stack instances restore puts an instance back in the state of a snapshot
+taken with cozy-stack instances snapshot. The documents and files created
+since the snapshot are removed. The snapshot is kept, and can be restored
+again.
+`,
+	Example: "$ cozy-stack instances restore cozy.local:8080 <snapshot>",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 2 {
+			return cmd.Help()
+		}
+		c := newAdminClient()
+		return c.RestoreSnapshot(args[0], args[1])
+	},
+}
+
 var destroyInstanceCmd = &cobra.Command{
 	Use:   "destroy [domain]",
 	Short: "Remove instance",
@@ -222,7 +515,17 @@ var oauthClientInstanceCmd = &cobra.Command{
 func init() {
 	instanceCmdGroup.AddCommand(addInstanceCmd)
 	instanceCmdGroup.AddCommand(lsInstanceCmd)
+	instanceCmdGroup.AddCommand(searchInstanceCmd)
+	instanceCmdGroup.AddCommand(reindexInstanceCmd)
+	instanceCmdGroup.AddCommand(migrateDBsInstanceCmd)
+	instanceCmdGroup.AddCommand(rotateSecretsInstanceCmd)
+	instanceCmdGroup.AddCommand(revokeTokenInstanceCmd)
 	instanceCmdGroup.AddCommand(destroyInstanceCmd)
+	instanceCmdGroup.AddCommand(auditSlugsInstanceCmd)
+	instanceCmdGroup.AddCommand(gcInstanceCmd)
+	instanceCmdGroup.AddCommand(devOptionsInstanceCmd)
+	instanceCmdGroup.AddCommand(snapshotInstanceCmd)
+	instanceCmdGroup.AddCommand(restoreInstanceCmd)
 	instanceCmdGroup.AddCommand(appTokenInstanceCmd)
 	instanceCmdGroup.AddCommand(oauthTokenInstanceCmd)
 	instanceCmdGroup.AddCommand(oauthClientInstanceCmd)
@@ -230,8 +533,17 @@ func init() {
 	addInstanceCmd.Flags().StringVar(&flagTimezone, "tz", "", "The timezone for the user")
 	addInstanceCmd.Flags().StringVar(&flagEmail, "email", "", "The email of the owner")
 	addInstanceCmd.Flags().StringSliceVar(&flagApps, "apps", nil, "Apps to be preinstalled")
-	addInstanceCmd.Flags().BoolVar(&flagDev, "dev", false, "To create a development instance")
+	addInstanceCmd.Flags().StringVar(&flagContext, "context", "", "Context of the instance, for its default apps")
+	addInstanceCmd.Flags().BoolVar(&flagDev, "dev", false, "To create a development instance, with all the development toggles")
+	addInstanceCmd.Flags().StringSliceVar(&flagDevOptions, "dev-options", nil, "Development toggles to enable (allow_http, relax_csp, allow_unsigned_apps, verbose_errors, proxy_apps)")
 	addInstanceCmd.Flags().StringVar(&flagPassphrase, "passphrase", "", "Register the instance with this passphrase (useful for tests)")
+	searchInstanceCmd.Flags().StringVar(&flagSearch.EmailDomain, "email-domain", "", "Domain of the email of the owner")
+	searchInstanceCmd.Flags().StringVar(&flagSearch.Locale, "locale", "", "Locale of the instances")
+	searchInstanceCmd.Flags().StringVar(&flagSearch.Context, "context", "", "Context of the instances")
+	searchInstanceCmd.Flags().StringVar(&flagSearch.App, "app", "", "Slug of an application installed on the instances")
+	searchInstanceCmd.Flags().IntVar(&flagSearch.Limit, "limit", instance.DefaultSearchLimit, "Maximal number of instances to list")
+	searchInstanceCmd.Flags().IntVar(&flagSearch.Skip, "skip", 0, "Number of instances to skip, for pagination")
+	gcInstanceCmd.Flags().StringVar(&flagGCPolicy, "policy", "report", "What to do with the garbage: report, quarantine or clean")
 	appTokenInstanceCmd.Flags().DurationVar(&flagExpire, "expire", 0, "Make the token expires in this amount of time")
 	oauthTokenInstanceCmd.Flags().DurationVar(&flagExpire, "expire", 0, "Make the token expires in this amount of time")
 	RootCmd.AddCommand(instanceCmdGroup)
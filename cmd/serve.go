@@ -8,6 +8,9 @@ import (
 	"strings"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/cozy/cozy-stack/pkg/calendar"
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/web"
 	"github.com/spf13/cobra"
@@ -28,6 +31,11 @@ Use the --port and --host flags to change the listening option.
 
 If you are the developer of a client-side app, you can use --appdir
 to mount a directory as the application with the 'app' slug.
+
+With --dev-certs, the stack serves HTTPS with certificates generated for the
+development domains (cozy.tools and localhost by default), signed by a local
+certificate authority. Its certificate, in $HOME/.cozy/certs/ca.crt by
+default, can be imported in the browser to trust them.
 `,
 	Example: `The most often, this command is used in its simple form:
 
@@ -43,9 +51,22 @@ example), you can use the --appdir flag like this:
 			log.Errorf("Use --allow-root if you really want to start with the root user")
 			return errors.New("Starting cozy-stack serve as root not allowed")
 		}
+		if err := instance.MigrateGlobalDesignDocs(); err != nil {
+			return err
+		}
 		if err := instance.StartJobs(); err != nil {
 			return err
 		}
+		if err := instance.RecoverInstallers(); err != nil {
+			return err
+		}
+		instance.StartGC()
+		instance.StartCompaction()
+		instance.WatchApps()
+		calendar.WatchEvents()
+		if config.GetConfig().CouchDB.ListenChanges {
+			couchdb.StartChangesListener()
+		}
 		if len(flagAppdirs) > 0 {
 			apps := make(map[string]string)
 			for _, app := range flagAppdirs {
@@ -84,6 +105,12 @@ func init() {
 	flags.String("couchdb-url", "http://localhost:5984/", "CouchDB URL")
 	checkNoErr(viper.BindPFlag("couchdb.url", flags.Lookup("couchdb-url")))
 
+	flags.String("registry-url", "https://registry.cozycloud.cc/", "applications registry URL")
+	checkNoErr(viper.BindPFlag("registry.url", flags.Lookup("registry-url")))
+
+	flags.Bool("dev-certs", false, "serve HTTPS with certificates generated for the development domains")
+	checkNoErr(viper.BindPFlag("dev_certs.enabled", flags.Lookup("dev-certs")))
+
 	flags.String("mail-host", "localhost", "mail smtp host")
 	checkNoErr(viper.BindPFlag("mail.host", flags.Lookup("mail-host")))
 
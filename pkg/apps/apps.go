@@ -4,9 +4,11 @@ import (
 	"net/url"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
 	"github.com/cozy/cozy-stack/pkg/permissions"
 	"github.com/cozy/cozy-stack/web/jsonapi"
 )
@@ -17,8 +19,18 @@ const (
 	// ManifestFilename is the name of the manifest at the root of the
 	// application directory
 	ManifestFilename = "manifest.webapp"
+	// DefaultListLimit is the number of applications in a page of the list
+	DefaultListLimit = 100
+	// MaxListLimit is the maximal number of applications in a page of the
+	// list
+	MaxListLimit = 1000
 )
 
+// The manifests are read on every request to an application
+func init() {
+	couchdb.CacheDoctypes(consts.Apps)
+}
+
 // State is the state of the application
 type State string
 
@@ -35,6 +47,9 @@ const (
 	Errored = "errored"
 	// Ready state
 	Ready = "ready"
+	// AwaitingConsent state, when an update requests broader permissions
+	// that the user has to accept
+	AwaitingConsent = "awaiting-consent"
 )
 
 // Access is a string representing the access permission level. It can
@@ -69,24 +84,68 @@ type SubDomainer interface {
 type Manifest struct {
 	ManRev string `json:"_rev,omitempty"` // Manifest revision
 
-	Name        string     `json:"name"`
-	Slug        string     `json:"slug"`
-	Source      string     `json:"source"`
-	State       State      `json:"state"`
-	Error       string     `json:"error,omitempty"`
-	Icon        string     `json:"icon"`
-	Description string     `json:"description"`
-	Developer   *Developer `json:"developer"`
-
-	DefaultLocale string `json:"default_locale"`
-	Locales       map[string]struct {
-		Description string `json:"description"`
-	} `json:"locales"`
+	Name             string     `json:"name"`
+	Slug             string     `json:"slug"`
+	Source           string     `json:"source"`
+	State            State      `json:"state"`
+	Error            string     `json:"error,omitempty"`
+	Icon             string     `json:"icon"`
+	ShortDescription string     `json:"short_description,omitempty"`
+	Description      string     `json:"description"`
+	Developer        *Developer `json:"developer"`
+
+	// DefaultLocale is the locale of the name and descriptions, and Locales
+	// are their translations in other locales (see Localize)
+	DefaultLocale string             `json:"default_locale"`
+	Locales       map[string]*Locale `json:"locales"`
 
 	Version     string           `json:"version"`
 	License     string           `json:"license"`
 	Permissions *permissions.Set `json:"permissions"`
 	Routes      Routes           `json:"routes"`
+	// Databases are the doctypes owned by the application, whose databases
+	// are destroyed with its data when it is uninstalled
+	Databases []string `json:"databases,omitempty"`
+	// Intents are the actions that the application can do for the other
+	// applications
+	Intents []Intent `json:"intents,omitempty"`
+	// Hooks are the jobs pushed when the application is ready after its
+	// installation or its update
+	Hooks *Hooks `json:"hooks,omitempty"`
+
+	InstalledAt *time.Time `json:"installed_at,omitempty"`
+
+	// Commit is the SHA-1 of the commit installed from a git source. Pinned
+	// is true if it was selected by a tag or a commit in the fragment of the
+	// source, and not by a branch: it can't change while the source is the
+	// same.
+	Commit string `json:"commit,omitempty"`
+	Pinned bool   `json:"pinned,omitempty"`
+
+	// Retriable is true when the installation or the update of the
+	// application was interrupted: it can be installed again, even if it
+	// already has a manifest.
+	Retriable bool `json:"retriable,omitempty"`
+
+	// HooksResults are the outcomes of the jobs of the hooks pushed at the
+	// end of the last installation or update.
+	HooksResults []*HookResult `json:"hooks_results,omitempty"`
+
+	// Progress is the percentage of the download of the files, while the
+	// application is installed or upgraded. It is only sent by Poll, and is
+	// not saved in CouchDB.
+	Progress int `json:"progress,omitempty"`
+
+	// DataRemoval is the removal of the data scheduled when the application
+	// is uninstalled. It is only sent in the response of the uninstall.
+	DataRemoval *DataRemoval `json:"data_removal,omitempty"`
+
+	PendingUpdate *PendingUpdate `json:"pending_update,omitempty"`
+
+	// Assets are the files of the application, indexed by their path in the
+	// application directory, with the informations recorded when they are
+	// fetched for serving them efficiently.
+	Assets map[string]*Asset `json:"assets,omitempty"`
 
 	Instance SubDomainer `json:"-"` // Used for JSON-API links
 }
@@ -110,6 +169,19 @@ func (m *Manifest) SetID(id string) {}
 // interface
 func (m *Manifest) SetRev(rev string) { m.ManRev = rev }
 
+// IsServable returns true if the files of the application can be served. It
+// is the case when an update is waiting for the user consent, as the
+// previous version is still installed.
+func (m *Manifest) IsServable() bool {
+	return m.State == Ready || m.State == AwaitingConsent
+}
+
+// isPinnedTo returns true if the installed commit of the application is
+// pinned by the given source, and an update would fetch the same files.
+func (m *Manifest) isPinnedTo(src *url.URL) bool {
+	return m.Pinned && m.Commit != "" && src != nil && m.Source == src.String()
+}
+
 // Links is used to generate a JSON-API link for the file - see
 // jsonapi.Object interface
 func (m *Manifest) Links() *jsonapi.LinksList {
@@ -117,9 +189,14 @@ func (m *Manifest) Links() *jsonapi.LinksList {
 		Self: "/apps/" + m.Slug,
 	}
 	if m.Icon != "" {
+		// The version is added to the URL so that the icon can be cached by
+		// the browsers until the application is updated
 		links.Icon = "/apps/" + m.Slug + "/icon"
+		if m.Version != "" {
+			links.Icon += "?v=" + url.QueryEscape(m.Version)
+		}
 	}
-	if m.State == Ready && m.Instance != nil {
+	if m.IsServable() && m.Instance != nil {
 		links.Related = m.Instance.SubDomain(m.Slug).String()
 	}
 	return &links
@@ -152,9 +229,8 @@ var (
 	_ permissions.Validable = (*Manifest)(nil)
 )
 
-// List returns the list of installed applications.
-//
-// TODO: pagination
+// List returns the list of installed applications, limited to the first
+// 100. ListPage can be used to paginate them.
 func List(db couchdb.Database) ([]*Manifest, error) {
 	var docs []*Manifest
 	req := &couchdb.AllDocsRequest{Limit: 100}
@@ -165,6 +241,62 @@ func List(db couchdb.Database) ([]*Manifest, error) {
 	return docs, nil
 }
 
+// ListPage returns a page of the installed applications, sorted by slug. The
+// cursor is the slug of the last application of the previous page, and an
+// empty state means all the states. It also returns the cursor of the next
+// page, or an empty string for the last page.
+func ListPage(db couchdb.Database, state State, cursor string, limit int) ([]*Manifest, string, error) {
+	if limit <= 0 || limit > MaxListLimit {
+		limit = DefaultListLimit
+	}
+	selector := mango.Gt("_id", consts.Apps+"/"+cursor)
+	if state != "" {
+		selector = mango.And(selector, mango.Equal("state", state))
+	}
+	var docs []*Manifest
+	req := &couchdb.FindRequest{
+		Selector: selector,
+		Sort:     mango.SortBys{mango.Ascending("_id")},
+		Limit:    limit + 1,
+	}
+	err := couchdb.FindDocs(db, consts.Apps, req, &docs)
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return nil, "", err
+	}
+	var next string
+	if len(docs) > limit {
+		docs = docs[:limit]
+		next = docs[limit-1].Slug
+	}
+	return docs, next, nil
+}
+
+// IsValidState returns true if the state is one of the states of an
+// installed application
+func IsValidState(state string) bool {
+	switch State(state) {
+	case Installing, Upgrading, Uninstalling, Errored, Ready, AwaitingConsent:
+		return true
+	}
+	return false
+}
+
+// findDocs makes a mango query on the given index. The index is defined if
+// the query fails, as it may not exist on the instances created before it.
+func findDocs(db couchdb.Database, index *mango.Index, req map[string]interface{}, results interface{}) error {
+	err := couchdb.FindDocsRaw(db, index.Doctype, req, results)
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		if err = couchdb.DefineIndex(db, index); err != nil {
+			return err
+		}
+		err = couchdb.FindDocsRaw(db, index.Doctype, req, results)
+	}
+	if couchdb.IsNoDatabaseError(err) {
+		return nil
+	}
+	return err
+}
+
 // GetBySlug returns an app identified by its slug
 func GetBySlug(db couchdb.Database, slug string) (*Manifest, error) {
 	man := &Manifest{}
@@ -73,3 +73,14 @@ func TestNoRegression217(t *testing.T) {
 	assert.Equal(t, "/", ctx.Folder)
 	assert.Equal(t, "any/path", rest)
 }
+
+func TestIconLink(t *testing.T) {
+	manifest := &Manifest{Slug: "mini"}
+	assert.Empty(t, manifest.Links().Icon)
+
+	manifest.Icon = "icon.svg"
+	assert.Equal(t, "/apps/mini/icon", manifest.Links().Icon)
+
+	manifest.Version = "1.0.0-beta+1"
+	assert.Equal(t, "/apps/mini/icon?v=1.0.0-beta%2B1", manifest.Links().Icon)
+}
@@ -0,0 +1,105 @@
+package apps
+
+import (
+	"compress/gzip"
+	"encoding/hex"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// Asset is a file of an application, with the informations recorded when it
+// is fetched, so that the serving layer does not have to compute them on
+// each request.
+type Asset struct {
+	// Hash is the hex-encoded md5sum of the content of the file
+	Hash string `json:"hash"`
+	// Gzip is true if the file has a gzip-compressed version, with the same
+	// name and the .gz extension
+	Gzip bool `json:"gzip,omitempty"`
+}
+
+// minCompressSize is the minimal size of a file to be pre-compressed: the
+// gzip headers are not worth it for the smaller ones.
+const minCompressSize = 1024
+
+// compressedExts are the extensions of the text files that are
+// pre-compressed. The images and fonts are already compressed.
+var compressedExts = map[string]bool{
+	".css":  true,
+	".html": true,
+	".js":   true,
+	".json": true,
+	".map":  true,
+	".svg":  true,
+	".txt":  true,
+	".xml":  true,
+}
+
+// indexAssets walks the files of an application after they have been
+// fetched, pre-compresses the text ones with gzip, and returns them indexed
+// by their path in the application directory. A .gz file shipped with the
+// application is used instead of compressing the file again.
+func indexAssets(ctx vfs.Context, appdir string) (map[string]*Asset, error) {
+	gitdir := path.Join(appdir, ".git")
+	files := make(map[string]*vfs.FileDoc)
+	err := vfs.Walk(ctx, appdir, func(name string, dir *vfs.DirDoc, file *vfs.FileDoc, err error) error {
+		if err != nil {
+			return err
+		}
+		if name == gitdir {
+			return vfs.ErrSkipDir
+		}
+		if file != nil {
+			files[name] = file
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	assets := make(map[string]*Asset, len(files))
+	for name, doc := range files {
+		asset := &Asset{Hash: hex.EncodeToString(doc.MD5Sum)}
+		if doc.Size >= minCompressSize && compressedExts[path.Ext(name)] {
+			if _, ok := files[name+".gz"]; !ok {
+				if err = compressAsset(ctx, name); err != nil {
+					return nil, err
+				}
+			}
+			asset.Gzip = true
+		}
+		assets[strings.TrimPrefix(name, appdir)] = asset
+	}
+	return assets, nil
+}
+
+func compressAsset(ctx vfs.Context, name string) (err error) {
+	src, err := ctx.FS().Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := vfs.Create(ctx, name+".gz")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := dst.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+
+	gz, err := gzip.NewWriterLevel(dst, gzip.BestCompression)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(gz, src); err != nil {
+		return err
+	}
+	return gz.Close()
+}
@@ -0,0 +1,66 @@
+package apps
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIndexAssets(t *testing.T) {
+	appdir := path.Join(vfs.AppsDirName, "assets")
+	_, err := vfs.MkdirAll(c, path.Join(appdir, ".git"), nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	script := strings.Repeat("console.log('hello world');\n", 100)
+	files := map[string]string{
+		"app.js":     script,
+		"small.css":  "body { margin: 0 }",
+		"logo.png":   strings.Repeat("x", 2048),
+		".git/HEAD":  strings.Repeat("ref: refs/heads/master\n", 100),
+		"index.html": "<html></html>",
+	}
+	for name, content := range files {
+		f, err := vfs.Create(c, path.Join(appdir, name))
+		if !assert.NoError(t, err) {
+			return
+		}
+		f.Write([]byte(content))
+		assert.NoError(t, f.Close())
+	}
+
+	assets, err := indexAssets(c, appdir)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, assets, 4)
+	assert.NotContains(t, assets, "/.git/HEAD")
+	if assert.Contains(t, assets, "/app.js") {
+		assert.Len(t, assets["/app.js"].Hash, 32)
+		assert.True(t, assets["/app.js"].Gzip)
+	}
+	assert.False(t, assets["/small.css"].Gzip)
+	assert.False(t, assets["/logo.png"].Gzip)
+
+	gz, err := c.FS().Open(path.Join(appdir, "app.js.gz"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer gz.Close()
+	r, err := gzip.NewReader(gz)
+	if assert.NoError(t, err) {
+		content, _ := ioutil.ReadAll(r)
+		assert.Equal(t, script, string(content))
+	}
+
+	// The compressed files are kept when the files are indexed again
+	assets, err = indexAssets(c, appdir)
+	assert.NoError(t, err)
+	assert.Len(t, assets, 5)
+	assert.True(t, assets["/app.js"].Gzip)
+}
@@ -0,0 +1,31 @@
+package apps
+
+import "github.com/cozy/cozy-stack/pkg/permissions"
+
+// PendingUpdate is an update of an application that requests broader
+// permissions than the installed version. It is kept in the manifest, with
+// the AwaitingConsent state, until the user accepts or refuses the new
+// permissions.
+type PendingUpdate struct {
+	Version     string           `json:"version"`
+	Source      string           `json:"source"`
+	Permissions *permissions.Set `json:"permissions"`
+	// PreviousState is the state of the application before the update, to
+	// go back to it if the update is refused.
+	PreviousState State `json:"previous_state"`
+}
+
+// needsConsent returns true if the new manifest requests permissions that
+// are not in the granted sets.
+func needsConsent(man *Manifest, granted ...*permissions.Set) bool {
+	if man.Permissions == nil {
+		return false
+	}
+	var set permissions.Set
+	for _, g := range granted {
+		if g != nil {
+			set = append(set, *g...)
+		}
+	}
+	return !man.Permissions.IsSubSetOf(set)
+}
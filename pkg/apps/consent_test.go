@@ -0,0 +1,40 @@
+package apps
+
+import (
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNeedsConsent(t *testing.T) {
+	contacts := permissions.Rule{
+		Type:  "io.cozy.contacts",
+		Verbs: permissions.Verbs(permissions.GET),
+	}
+	allContacts := permissions.Rule{
+		Type: "io.cozy.contacts",
+	}
+	files := permissions.Rule{
+		Type:     "io.cozy.files",
+		Selector: "type",
+		Values:   []string{"directory"},
+	}
+
+	installed := &permissions.Set{contacts}
+	same := &Manifest{Permissions: &permissions.Set{contacts}}
+	assert.False(t, needsConsent(same, installed))
+	fewer := &Manifest{Permissions: &permissions.Set{}}
+	assert.False(t, needsConsent(fewer, installed))
+
+	moreVerbs := &Manifest{Permissions: &permissions.Set{allContacts}}
+	assert.True(t, needsConsent(moreVerbs, installed))
+	moreTypes := &Manifest{Permissions: &permissions.Set{contacts, files}}
+	assert.True(t, needsConsent(moreTypes, installed))
+
+	// The permissions accepted for a pending update are granted too
+	accepted := &permissions.Set{files}
+	assert.False(t, needsConsent(moreTypes, installed, accepted))
+	assert.True(t, needsConsent(moreVerbs, installed, accepted))
+	assert.False(t, needsConsent(moreTypes, nil, &permissions.Set{contacts, files}))
+}
@@ -0,0 +1,156 @@
+package apps
+
+import (
+	"context"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+)
+
+// DataRemovalWorkerType is the type of the worker that removes the data of
+// an uninstalled application
+const DataRemovalWorkerType = "apps-data-removal"
+
+// DataRemovalDelay is the grace period between the uninstallation of an
+// application and the removal of its data. If the application is installed
+// again in the meantime, the data are kept.
+var DataRemovalDelay = 7 * 24 * time.Hour
+
+func init() {
+	jobs.AddWorker(DataRemovalWorkerType, &jobs.WorkerConfig{
+		Concurrency:  1,
+		MaxExecCount: 3,
+		Timeout:      5 * time.Minute,
+		WorkerFunc:   removeData,
+	})
+}
+
+// DataRemoval is the removal of the data of an uninstalled application,
+// scheduled after a grace period.
+type DataRemoval struct {
+	Slug     string    `json:"slug"`
+	Doctypes []string  `json:"doctypes"`
+	At       time.Time `json:"at"`
+}
+
+// UnusedDoctypes returns the doctypes whose data can be removed with the
+// application: the doctypes on which it has a permission to write that are
+// used by no other application or sharing. The doctypes of the stack are never
+// returned, and neither are the ones listed in the databases field of the
+// manifest, as their databases are destroyed with the application.
+func UnusedDoctypes(db couchdb.Database, man *Manifest) ([]string, error) {
+	doctypes := []string{}
+	if man.Permissions == nil {
+		return doctypes, nil
+	}
+	used, err := permissions.UsedDoctypes(db, man.Slug)
+	if err != nil {
+		return nil, err
+	}
+	// The databases of the owned doctypes are already destroyed
+	for _, doctype := range ownedDoctypes(man) {
+		used[doctype] = true
+	}
+	var candidates []string
+	for _, rule := range *man.Permissions {
+		// The doctypes of a wildcard are not known, their data are kept
+		if permissions.IsWildcardType(rule.Type) || !canWrite(rule) {
+			continue
+		}
+		candidates = append(candidates, rule.Type)
+	}
+	for _, doctype := range candidates {
+		if IsReservedDoctype(doctype) || used[doctype] || usedByWildcard(used, doctype) {
+			continue
+		}
+		used[doctype] = true
+		doctypes = append(doctypes, doctype)
+	}
+	return doctypes, nil
+}
+
+// usedByWildcard returns true if one of the used types is a wildcard that
+// matches the doctype.
+func usedByWildcard(used map[string]bool, doctype string) bool {
+	for t := range used {
+		if permissions.IsWildcardType(t) && permissions.MatchDoctype(t, doctype) {
+			return true
+		}
+	}
+	return false
+}
+
+// ScheduleDataRemoval schedules the removal of the databases of the given
+// doctypes, after the grace period, for an application that has been
+// uninstalled.
+func ScheduleDataRemoval(scheduler jobs.Scheduler, slug string, doctypes []string) (*DataRemoval, error) {
+	removal := &DataRemoval{
+		Slug:     slug,
+		Doctypes: doctypes,
+		At:       time.Now().Add(DataRemovalDelay),
+	}
+	if len(doctypes) == 0 {
+		return removal, nil
+	}
+	msg, err := jobs.NewMessage(jobs.JSONEncoding, removal)
+	if err != nil {
+		return nil, err
+	}
+	// An @at trigger is used, and not @in, so that the grace period is not
+	// restarted when the stack is
+	t, err := jobs.NewTrigger(&jobs.TriggerInfos{
+		Type:       "@at",
+		WorkerType: DataRemovalWorkerType,
+		Arguments:  removal.At.Format(time.RFC3339),
+		Message:    msg,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = scheduler.Add(t); err != nil {
+		return nil, err
+	}
+	return removal, nil
+}
+
+func removeData(ctx context.Context, m *jobs.Message) error {
+	removal := &DataRemoval{}
+	if err := m.Unmarshal(&removal); err != nil {
+		return err
+	}
+	domain := ctx.Value(jobs.ContextDomainKey).(string)
+	db, err := couchdb.DatabaseOf(domain)
+	if err != nil {
+		return err
+	}
+
+	_, err = GetBySlug(db, removal.Slug)
+	if err == nil {
+		log.Infof("[apps] %s has been installed again on %s, its data are kept",
+			removal.Slug, domain)
+		return nil
+	}
+	if !couchdb.IsNotFoundError(err) {
+		return err
+	}
+
+	// Another application may have been installed with a permission on
+	// these doctypes during the grace period
+	used, err := permissions.UsedDoctypes(db, removal.Slug)
+	if err != nil {
+		return err
+	}
+	for _, doctype := range removal.Doctypes {
+		if IsReservedDoctype(doctype) || used[doctype] || usedByWildcard(used, doctype) {
+			continue
+		}
+		err = couchdb.DeleteDB(db, doctype)
+		if err != nil && !couchdb.IsNoDatabaseError(err) {
+			return err
+		}
+	}
+	return nil
+}
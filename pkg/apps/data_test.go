@@ -0,0 +1,64 @@
+package apps
+
+import (
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnusedDoctypesAndRemoveData(t *testing.T) {
+	set := permissions.Set{
+		{Type: "io.cozy.tests.data-only"},
+		{Type: "io.cozy.tests.data-shared"},
+		{Type: "io.cozy.tests.data-read", Verbs: permissions.Verbs(permissions.GET)},
+		{Type: "io.cozy.tests.family.*"},
+		{Type: "io.cozy.tests.family.shared"},
+		{Type: "io.cozy.tests.owned.*"},
+		{Type: consts.Files},
+	}
+	_, err := permissions.CreateAppSet(c, "data-only", set)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = permissions.CreateAppSet(c, "data-other", permissions.Set{
+		{Type: "io.cozy.tests.data-shared"},
+		{Type: "io.cozy.tests.family.*"},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	man := &Manifest{
+		Slug:        "data-only",
+		Permissions: &set,
+		Databases:   []string{"io.cozy.tests.owned.notes", "io.cozy.tests.family.notes"},
+	}
+	doctypes, err := UnusedDoctypes(c, man)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"io.cozy.tests.data-only"}, doctypes)
+	}
+
+	for _, doctype := range []string{"io.cozy.tests.data-only", "io.cozy.tests.data-shared"} {
+		if !assert.NoError(t, couchdb.ResetDB(c, doctype)) {
+			return
+		}
+	}
+	msg, err := jobs.NewMessage(jobs.JSONEncoding, &DataRemoval{
+		Slug:     "data-only",
+		Doctypes: []string{"io.cozy.tests.data-only", "io.cozy.tests.data-shared"},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	err = removeData(jobs.NewWorkerContext("apps-test"), msg)
+	assert.NoError(t, err)
+
+	_, err = couchdb.DBStatus(c, "io.cozy.tests.data-only")
+	assert.True(t, couchdb.IsNoDatabaseError(err))
+	_, err = couchdb.DBStatus(c, "io.cozy.tests.data-shared")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,136 @@
+package apps
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// DevScheme is the scheme of the sources of the applications served by
+// proxying the requests to a development server, like dev://localhost:8080
+const DevScheme = "dev"
+
+// DevTransport is the transport of the requests to the development servers:
+// it connects only to the loopback addresses, even if the name of the host
+// is resolved to another address.
+var DevTransport = &http.Transport{
+	DialContext: dialLoopback,
+}
+
+var devClient = &http.Client{
+	Timeout:   10 * time.Second,
+	Transport: DevTransport,
+}
+
+// dialLoopback connects to the given address, if it is a loopback address.
+func dialLoopback(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if !ip.IsLoopback() {
+			return nil, ErrDevServerNotLocal
+		}
+	}
+	if len(ips) == 0 {
+		return nil, ErrDevServerNotLocal
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, network, net.JoinHostPort(ips[0].String(), port))
+}
+
+// isLoopbackHost returns true if the host is localhost or a loopback address.
+func isLoopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// proxyAppsAllower is implemented by the instances that accept the
+// applications with a dev:// source, for development.
+type proxyAppsAllower interface {
+	AllowProxyApps() bool
+}
+
+// allowsProxyApps returns true if the context accepts the applications with a
+// dev:// source.
+func allowsProxyApps(ctx interface{}) bool {
+	a, ok := ctx.(proxyAppsAllower)
+	return ok && a.AllowProxyApps()
+}
+
+// IsDevSource returns true if the given source is the one of an application
+// served by a development server.
+func IsDevSource(source string) bool {
+	src, err := url.Parse(source)
+	return err == nil && src.Scheme == DevScheme && src.Host != ""
+}
+
+// DevServerURL returns the URL of the development server for the given
+// dev:// source. The path of the source, if any, is kept as the root of the
+// application on this server, which must be on localhost or a loopback
+// address.
+func DevServerURL(source string) (*url.URL, error) {
+	src, err := url.Parse(source)
+	if err != nil || src.Scheme != DevScheme || src.Host == "" {
+		return nil, ErrNotSupportedSource
+	}
+	if !isLoopbackHost(src.Host) {
+		return nil, ErrDevServerNotLocal
+	}
+	return &url.URL{
+		Scheme: "http",
+		Host:   src.Host,
+		Path:   src.Path,
+	}, nil
+}
+
+// devFetcher is the fetcher of the applications with a dev:// source. Only
+// the manifest is fetched from the development server: the files are not
+// copied in the VFS, they are proxied when the application is served.
+type devFetcher struct {
+	ctx vfs.Context
+}
+
+func newDevFetcher(ctx vfs.Context) *devFetcher {
+	return &devFetcher{ctx: ctx}
+}
+
+// FetchManifest downloads the manifest from the root of the development
+// server.
+func (d *devFetcher) FetchManifest(src *url.URL) (io.ReadCloser, error) {
+	u, err := DevServerURL(src.String())
+	if err != nil {
+		return nil, err
+	}
+	u.Path = u.Path + "/" + ManifestFilename
+	res, err := devClient.Get(u.String())
+	if err != nil {
+		return nil, ErrManifestNotReachable
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, ErrManifestNotReachable
+	}
+	return res.Body, nil
+}
+
+// Fetch does nothing, the files stay on the development server.
+func (d *devFetcher) Fetch(src *url.URL, appdir string, progress ProgressFunc) error {
+	return nil
+}
@@ -0,0 +1,88 @@
+package apps
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/stretchr/testify/assert"
+)
+
+type proxyContext struct {
+	TestContext
+}
+
+func (c proxyContext) AllowProxyApps() bool { return true }
+
+func TestDevSource(t *testing.T) {
+	assert.True(t, IsDevSource("dev://localhost:8080"))
+	assert.False(t, IsDevSource("dev://"))
+	assert.False(t, IsDevSource("git://localhost:8080"))
+
+	u, err := DevServerURL("dev://localhost:8080/app")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "http://localhost:8080/app", u.String())
+	}
+	_, err = DevServerURL("https://localhost:8080")
+	assert.Equal(t, ErrNotSupportedSource, err)
+
+	// Only a development server on a loopback address can be used
+	_, err = DevServerURL("dev://127.0.0.1:8080")
+	assert.NoError(t, err)
+	_, err = DevServerURL("dev://[::1]:8080")
+	assert.NoError(t, err)
+	_, err = DevServerURL("dev://192.168.1.10:8080")
+	assert.Equal(t, ErrDevServerNotLocal, err)
+	_, err = DevServerURL("dev://example.org")
+	assert.Equal(t, ErrDevServerNotLocal, err)
+	_, err = dialLoopback(context.Background(), "tcp", "10.0.0.1:80")
+	assert.Equal(t, ErrDevServerNotLocal, err)
+
+	src, _ := url.Parse("dev://localhost:8080")
+	assert.Equal(t, "dev://localhost:8080", pinSource(src, "1.2.3"))
+}
+
+func TestInstallDevApp(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/"+ManifestFilename {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, manifest())
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	source := "dev://" + u.Host
+
+	_, err := NewInstaller(c, &InstallerOptions{
+		Slug:      "dev-mini",
+		SourceURL: source,
+	})
+	assert.Equal(t, ErrSourceNotAllowed, err)
+
+	ctx := proxyContext{TestContext: *c}
+	inst, err := NewInstaller(ctx, &InstallerOptions{
+		Slug:      "dev-mini",
+		SourceURL: source,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() {
+		if man, err := GetBySlug(c, "dev-mini"); err == nil {
+			couchdb.DeleteDoc(c, man)
+		}
+	}()
+	go inst.Install()
+	man, ok := waitInstaller(t, inst)
+	if !ok {
+		return
+	}
+	assert.EqualValues(t, Ready, man.State)
+	assert.Equal(t, source, man.Source)
+	assert.Equal(t, localVersion, man.Version)
+}
@@ -5,6 +5,12 @@ import "errors"
 var (
 	// ErrInvalidSlugName is used when the given slug name is not valid
 	ErrInvalidSlugName = errors.New("Invalid slug name")
+	// ErrReservedSlug is used when the given slug name is reserved for the
+	// stack
+	ErrReservedSlug = errors.New("Slug name is reserved")
+	// ErrSlugCollision is used when the subdomain of the application, with the
+	// given slug name, would be the domain of another instance
+	ErrSlugCollision = errors.New("Slug name collides with the domain of another instance")
 	// ErrAlreadyExists is used when an application with the specified slug name
 	// is already installed.
 	ErrAlreadyExists = errors.New("Application with same slug already exists")
@@ -14,14 +20,38 @@ var (
 	// ErrNotSupportedSource is used when the source transport or
 	// protocol is not supported
 	ErrNotSupportedSource = errors.New("Invalid or not supported source scheme")
+	// ErrSourceNotAllowed is used when the source of the application is not
+	// in the list of the sources allowed by the configuration
+	ErrSourceNotAllowed = errors.New("Application source is not allowed on this stack")
 	// ErrManifestNotReachable is used when the manifest of the
 	// application is not reachable
 	ErrManifestNotReachable = errors.New("Application manifest " + ManifestFilename + " is not reachable")
 	// ErrSourceNotReachable is used when the given source for
 	// application is not reachable
 	ErrSourceNotReachable = errors.New("Application source is not reachable")
+	// ErrNotFoundInRegistry is used when the application or its version is
+	// not published on the registry
+	ErrNotFoundInRegistry = errors.New("Application is not available on the registry")
+	// ErrBadTarball is used when the archive given as source of the
+	// application is not a valid tarball
+	ErrBadTarball = errors.New("Application tarball is invalid or malformed")
 	// ErrBadManifest when the manifest is not valid or malformed
 	ErrBadManifest = errors.New("Application manifest is invalid or malformed")
+	// ErrNoPreviousVersion is used when trying to rollback an application
+	// that has no previous version
+	ErrNoPreviousVersion = errors.New("Application has no previous version")
+	// ErrInterrupted is used for the applications whose installation or
+	// update was interrupted by a stop of the stack
+	ErrInterrupted = errors.New("Application installation was interrupted")
+	// ErrHookNotAllowed is used when the application has no permission to
+	// push a job for the worker of one of its hooks
+	ErrHookNotAllowed = errors.New("Application is not allowed to push a job for this worker")
+	// ErrCommitNotFound is used when the commit of a git source is not in the
+	// last CommitCloneDepth commits of a branch of the repository
+	ErrCommitNotFound = errors.New("Application commit is not in the last commits of the repository")
+	// ErrDevServerNotLocal is used when the development server of a dev://
+	// source is not on a loopback address
+	ErrDevServerNotLocal = errors.New("Application development server must be on a loopback address")
 	// ErrBadState is used when trying to use the application while in a
 	// state that is not appropriate for the given operation.
 	ErrBadState = errors.New("Application is not in valid state to perform this operation")
@@ -10,6 +10,7 @@ import (
 	"path"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -18,7 +19,11 @@ import (
 	git "gopkg.in/src-d/go-git.v4"
 	gitPl "gopkg.in/src-d/go-git.v4/plumbing"
 	gitObj "gopkg.in/src-d/go-git.v4/plumbing/object"
+	gitTransport "gopkg.in/src-d/go-git.v4/plumbing/transport"
+	gitHttp "gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+	gitStorage "gopkg.in/src-d/go-git.v4/storage"
 	gitSt "gopkg.in/src-d/go-git.v4/storage/filesystem"
+	gitMem "gopkg.in/src-d/go-git.v4/storage/memory"
 )
 
 const ghRawManifestURL = "https://raw.githubusercontent.com/%s/%s/%s/%s"
@@ -26,12 +31,81 @@ const ghRawManifestURL = "https://raw.githubusercontent.com/%s/%s/%s/%s"
 // ghURLRegex is used to identify github
 var ghURLRegex = regexp.MustCompile(`/([^/]+)/([^/]+).git`)
 
+// commitReg matches the fragments of the sources that pin an application to a
+// commit, with its full SHA-1.
+var commitReg = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// tokenUsername is the username used when only a token is given. GitHub and
+// GitLab accept any username with a token.
+const tokenUsername = "x-access-token"
+
+// CommitCloneDepth is the number of commits of each branch that are fetched
+// to find a commit given by its SHA-1: an older commit can't be installed.
+const CommitCloneDepth = 100
+
 type gitFetcher struct {
-	ctx vfs.Context
+	ctx   vfs.Context
+	creds *credentials
+
+	// commit is the SHA-1 of the commit whose files have been fetched, and
+	// pinned is true if it was selected by a tag or a commit, not a branch.
+	commit string
+	pinned bool
+
+	// memCommit is the commit of a tag or a commit cloned in memory to read
+	// the manifest, kept to copy its files without cloning it again.
+	memCommit *gitObj.Commit
+	memSource string
+}
+
+// credentials are used to fetch an application from a private repository.
+// They are only kept in memory, for the time of the installation.
+type credentials struct {
+	username string
+	password string
+}
+
+func newGitFetcher(ctx vfs.Context, creds *credentials) *gitFetcher {
+	return &gitFetcher{ctx: ctx, creds: creds}
+}
+
+// extractCredentials returns the credentials given in the options, or else in
+// the source URL. The credentials are removed from the URL, so that they are
+// not saved in the manifest.
+func extractCredentials(src *url.URL, username, password string) *credentials {
+	if src.User != nil {
+		if username == "" && password == "" {
+			username = src.User.Username()
+			password, _ = src.User.Password()
+		}
+		src.User = nil
+	}
+	if username == "" && password == "" {
+		return nil
+	}
+	if username == "" {
+		username = tokenUsername
+	}
+	return &credentials{username: username, password: password}
 }
 
-func newGitFetcher(ctx vfs.Context) *gitFetcher {
-	return &gitFetcher{ctx: ctx}
+func (g *gitFetcher) auth() gitTransport.AuthMethod {
+	if g.creds == nil {
+		return nil
+	}
+	return gitHttp.NewBasicAuth(g.creds.username, g.creds.password)
+}
+
+// gitURL returns the URL of the repository for go-git: a git+https:// source
+// is cloned with https, and without the fragment used for the branch.
+func gitURL(src *url.URL) string {
+	if src.Scheme != "git+https" {
+		return src.String()
+	}
+	u := *src
+	u.Scheme = "https"
+	u.Fragment = ""
+	return u.String()
 }
 
 var manifestClient = &http.Client{
@@ -41,6 +115,12 @@ var manifestClient = &http.Client{
 func (g *gitFetcher) FetchManifest(src *url.URL) (io.ReadCloser, error) {
 	var err error
 
+	// The raw files of a private repository can't be fetched without the
+	// API of the forge: the manifest is read from a clone in memory.
+	if src.Scheme == "git+https" {
+		return g.fetchManifestFromClone(src)
+	}
+
 	var u string
 	if src.Host == "github.com" {
 		u, err = resolveGithubURL(src)
@@ -59,23 +139,66 @@ func (g *gitFetcher) FetchManifest(src *url.URL) (io.ReadCloser, error) {
 	return res.Body, nil
 }
 
-func (g *gitFetcher) Fetch(src *url.URL, appdir string) error {
+func (g *gitFetcher) fetchManifestFromClone(src *url.URL) (io.ReadCloser, error) {
+	commit, pinned, err := g.cloneRevision(src, func() (gitStorage.Storer, error) {
+		return gitMem.NewStorage(), nil
+	})
+	if err != nil {
+		log.Debugf("[git] Clone %s in memory: %s", src.String(), err)
+		return nil, ErrManifestNotReachable
+	}
+	// A branch is cloned again in the application directory, so that it can
+	// be pulled by the updates, but a tag or a commit is never pulled
+	if pinned {
+		g.memCommit, g.memSource = commit, src.String()
+	}
+	f, err := commit.File(ManifestFilename)
+	if err != nil {
+		return nil, ErrManifestNotReachable
+	}
+	return f.Reader()
+}
+
+// Fetch clones or pulls the repository, and copies the files of the commit
+// selected by the fragment of the source in the application directory: the
+// last commit of a branch, a tag or a commit given by its full SHA-1. The
+// progress is the number of files copied.
+func (g *gitFetcher) Fetch(src *url.URL, appdir string, progress ProgressFunc) error {
 	log.Debugf("[git] Fetch %s", src.String())
 	ctx := g.ctx
 
 	gitdir := path.Join(appdir, ".git")
 	_, err := vfs.Mkdir(ctx, gitdir, nil)
 	if os.IsExist(err) {
-		return g.pull(appdir, gitdir, src)
+		if !IsVersionTag(src.Fragment) && !IsCommitSHA(src.Fragment) {
+			err = g.pull(appdir, gitdir, src, progress)
+			if err != errOtherBranch {
+				return err
+			}
+		}
+		// A tag or a commit can't be pulled, and the checkout has only the
+		// branch that was cloned: the repository is cloned again
+		if err = cleanAppDir(ctx, appdir); err != nil {
+			return err
+		}
+		_, err = vfs.Mkdir(ctx, gitdir, nil)
 	}
 	if err != nil {
 		return err
 	}
 
-	return g.clone(appdir, gitdir, src)
+	return g.clone(appdir, gitdir, src, progress)
+}
+
+// IsCommitSHA returns true if the fragment of a source pins it to a commit
+func IsCommitSHA(fragment string) bool {
+	return commitReg.MatchString(fragment)
 }
 
 func getBranch(src *url.URL) string {
+	if IsVersionTag(src.Fragment) {
+		return "refs/tags/" + src.Fragment
+	}
 	if src.Fragment != "" {
 		return "refs/heads/" + src.Fragment
 	}
@@ -83,34 +206,114 @@ func getBranch(src *url.URL) string {
 }
 
 // clone creates a new bare git repository and install all the files of the
-// last commit in the application tree.
-func (g *gitFetcher) clone(appdir, gitdir string, src *url.URL) error {
+// selected commit in the application tree.
+func (g *gitFetcher) clone(appdir, gitdir string, src *url.URL, progress ProgressFunc) error {
 	ctx := g.ctx
 
-	storage, err := gitSt.NewStorage(newGFS(ctx, gitdir))
-	if err != nil {
-		return err
+	if g.memCommit != nil && g.memSource == src.String() {
+		g.pinned = true
+		return g.copyFiles(appdir, g.memCommit, progress)
 	}
 
-	branch := getBranch(src)
-	log.Debugf("[git] Clone %s %s", src.String(), branch)
-
-	rep, err := git.Clone(storage, nil, &git.CloneOptions{
-		URL:           src.String(),
-		Depth:         1,
-		SingleBranch:  true,
-		ReferenceName: gitPl.ReferenceName(branch),
+	retry := false
+	commit, pinned, err := g.cloneRevision(src, func() (gitStorage.Storer, error) {
+		// The clone of a branch that doesn't exist may have left some files
+		if retry {
+			if err := cleanAppDir(ctx, appdir); err != nil {
+				return nil, err
+			}
+			if _, err := vfs.Mkdir(ctx, gitdir, nil); err != nil {
+				return nil, err
+			}
+		}
+		retry = true
+		return gitSt.NewStorage(newGFS(ctx, gitdir))
 	})
 	if err != nil {
 		return err
 	}
 
-	return g.copyFiles(appdir, rep)
+	g.pinned = pinned
+	return g.copyFiles(appdir, commit, progress)
 }
 
+// cloneRevision clones the repository, and returns the commit selected by the
+// fragment of the source. For a commit given by its SHA-1, the last
+// CommitCloneDepth commits of each branch are fetched, and for a branch or a
+// tag, only the last commit. As a fragment can be the name of a branch or of a
+// tag, it is looked for in the tags if there is no such branch, with a new
+// storage.
+func (g *gitFetcher) cloneRevision(src *url.URL, newStorage func() (gitStorage.Storer, error)) (*gitObj.Commit, bool, error) {
+	if IsCommitSHA(src.Fragment) {
+		log.Debugf("[git] Clone %s", src.String())
+		storage, err := newStorage()
+		if err != nil {
+			return nil, false, err
+		}
+		rep, err := git.Clone(storage, nil, &git.CloneOptions{
+			URL:   gitURL(src),
+			Auth:  g.auth(),
+			Depth: CommitCloneDepth,
+		})
+		if err != nil {
+			return nil, false, err
+		}
+		commit, err := rep.Commit(gitPl.NewHash(src.Fragment))
+		if err != nil {
+			return nil, false, ErrCommitNotFound
+		}
+		return commit, true, nil
+	}
+
+	refs := []string{getBranch(src)}
+	if src.Fragment != "" && !IsVersionTag(src.Fragment) {
+		refs = append(refs, "refs/tags/"+src.Fragment)
+	}
+	var firstErr error
+	for _, ref := range refs {
+		log.Debugf("[git] Clone %s %s", src.String(), ref)
+		storage, err := newStorage()
+		if err != nil {
+			return nil, false, err
+		}
+		rep, err := git.Clone(storage, nil, &git.CloneOptions{
+			URL:           gitURL(src),
+			Auth:          g.auth(),
+			Depth:         1,
+			SingleBranch:  true,
+			ReferenceName: gitPl.ReferenceName(ref),
+		})
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		commit, err := headCommit(rep)
+		if err != nil {
+			return nil, false, err
+		}
+		return commit, strings.HasPrefix(ref, "refs/tags/"), nil
+	}
+	return nil, false, firstErr
+}
+
+func headCommit(rep *git.Repository) (*gitObj.Commit, error) {
+	ref, err := rep.Head()
+	if err != nil {
+		return nil, err
+	}
+	return rep.Commit(ref.Hash())
+}
+
+// errOtherBranch is used when the existing checkout is not for the branch of
+// the source, and can't be pulled.
+var errOtherBranch = errors.New("The checkout is for another branch")
+
 // pull will fetch the latest objects from the default remote and if updates
-// are available, it will update the application tree files.
-func (g *gitFetcher) pull(appdir, gitdir string, src *url.URL) error {
+// are available, it will update the application tree files. Only the last
+// commit is fetched, like for the clone.
+func (g *gitFetcher) pull(appdir, gitdir string, src *url.URL, progress ProgressFunc) error {
 	ctx := g.ctx
 
 	storage, err := gitSt.NewStorage(newGFS(ctx, gitdir))
@@ -124,67 +327,56 @@ func (g *gitFetcher) pull(appdir, gitdir string, src *url.URL) error {
 	}
 
 	branch := getBranch(src)
+	if _, err = rep.Reference(gitPl.ReferenceName(branch), false); err != nil {
+		return errOtherBranch
+	}
 	log.Debugf("[git] Pull %s %s", src.String(), branch)
 
 	err = rep.Pull(&git.PullOptions{
+		Auth:          g.auth(),
+		Depth:         1,
 		SingleBranch:  true,
 		ReferenceName: gitPl.ReferenceName(branch),
 	})
-	if err == git.NoErrAlreadyUpToDate {
-		return nil
+	upToDate := err == git.NoErrAlreadyUpToDate
+	if err != nil && !upToDate {
+		return err
 	}
+
+	commit, err := headCommit(rep)
 	if err != nil {
 		return err
 	}
-
-	// TODO: permanently remove application files instead of moving them to the
-	// trash
-	err = vfs.Walk(ctx, appdir, func(name string, dir *vfs.DirDoc, file *vfs.FileDoc, err error) error {
-		if err != nil {
-			return err
-		}
-
-		if name == appdir {
-			return nil
-		}
-		if name == gitdir {
-			return vfs.ErrSkipDir
-		}
-
-		if dir != nil {
-			_, err = vfs.TrashDir(ctx, dir)
-		} else {
-			_, err = vfs.TrashFile(ctx, file)
-		}
-		if err != nil {
-			return err
-		}
-		if dir != nil {
-			return vfs.ErrSkipDir
-		}
+	if upToDate {
+		g.commit = commit.Hash.String()
 		return nil
-	})
-	if err != nil {
+	}
+	if err = cleanAppDir(ctx, appdir, gitdir); err != nil {
 		return err
 	}
 
-	return g.copyFiles(appdir, rep)
+	return g.copyFiles(appdir, commit, progress)
 }
 
-func (g *gitFetcher) copyFiles(appdir string, rep *git.Repository) error {
+func (g *gitFetcher) copyFiles(appdir string, commit *gitObj.Commit, progress ProgressFunc) error {
 	ctx := g.ctx
+	g.commit = commit.Hash.String()
 
-	ref, err := rep.Head()
+	// The files are counted first, for the progress
+	files, err := commit.Files()
 	if err != nil {
 		return err
 	}
-
-	commit, err := rep.Commit(ref.Hash())
+	var done, total int64
+	err = files.ForEach(func(f *gitObj.File) error {
+		total++
+		return nil
+	})
 	if err != nil {
 		return err
 	}
 
-	files, err := commit.Files()
+	files, err = commit.Files()
 	if err != nil {
 		return err
 	}
@@ -215,9 +407,15 @@ func (g *gitFetcher) copyFiles(appdir string, rep *git.Repository) error {
 		}
 
 		defer r.Close()
-		_, err = io.Copy(file, r)
+		if _, err = io.Copy(file, r); err != nil {
+			return err
+		}
 
-		return err
+		done++
+		if progress != nil {
+			progress(done, total)
+		}
+		return nil
 	})
 }
 
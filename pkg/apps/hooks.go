@@ -0,0 +1,149 @@
+package apps
+
+import (
+	"encoding/json"
+	"errors"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/realtime"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// errHookOutdated is used when the result of a hook is not saved, as the
+// application has been installed or updated again since it was pushed
+var errHookOutdated = errors.New("The hook is outdated")
+
+// Hook is a job pushed by the installer when the application is ready after
+// its installation or its update, for example to create its default documents
+// or to register its triggers. The application must have the permission to
+// push jobs for the worker, like for POST /jobs/queue/:worker-type.
+type Hook struct {
+	Worker    string          `json:"worker"`
+	Arguments json.RawMessage `json:"arguments,omitempty"`
+}
+
+// Hooks are the jobs declared in the hooks section of the manifest
+type Hooks struct {
+	PostInstall []*Hook `json:"post_install,omitempty"`
+	PostUpdate  []*Hook `json:"post_update,omitempty"`
+}
+
+// HookResult is the outcome of the job pushed for a hook. The results of the
+// last installation or update are saved in the manifest, and updated when
+// their jobs end.
+type HookResult struct {
+	Worker string     `json:"worker"`
+	JobID  string     `json:"job_id,omitempty"`
+	State  jobs.State `json:"state"`
+	Error  string     `json:"error,omitempty"`
+}
+
+// jobsBrokerer is implemented by the instances, to push the jobs of the hooks
+type jobsBrokerer interface {
+	JobsBroker() jobs.Broker
+}
+
+// hooksFor returns the hooks to run at the end of the installation or of the
+// update of the application, depending on the state it was in.
+func hooksFor(man *Manifest, state State) []*Hook {
+	if man.Hooks == nil {
+		return nil
+	}
+	switch state {
+	case Installing:
+		return man.Hooks.PostInstall
+	case Upgrading:
+		return man.Hooks.PostUpdate
+	}
+	return nil
+}
+
+// runHooks pushes the jobs of the hooks, and saves their results in the
+// manifest. The results are updated in background when the jobs end.
+func runHooks(ctx vfs.Context, man *Manifest, hooks []*Hook) {
+	if len(hooks) == 0 {
+		return
+	}
+	b, ok := ctx.(jobsBrokerer)
+	if !ok {
+		log.Warnf("[apps] No job system to run the hooks of %s", man.Slug)
+		return
+	}
+	results := make([]*HookResult, len(hooks))
+	chans := make([]<-chan *jobs.JobInfos, len(hooks))
+	for idx, hook := range hooks {
+		res := &HookResult{Worker: hook.Worker, State: jobs.Queued}
+		results[idx] = res
+		job, ch, err := pushHook(b.JobsBroker(), man, hook)
+		if err != nil {
+			res.State = jobs.Errored
+			res.Error = err.Error()
+			continue
+		}
+		res.JobID = job.ID
+		chans[idx] = ch
+	}
+
+	man.HooksResults = results
+	if err := couchdb.UpdateDoc(ctx, man); err != nil {
+		log.Warnf("[apps] Could not save the hooks of %s: %s", man.Slug, err)
+		return
+	}
+	publishManifest(ctx, realtime.EventUpdate, man)
+	for idx, ch := range chans {
+		if ch != nil {
+			go watchHook(ctx, man.Slug, idx, results[idx].JobID, ch)
+		}
+	}
+}
+
+func pushHook(broker jobs.Broker, man *Manifest, hook *Hook) (*jobs.JobInfos, <-chan *jobs.JobInfos, error) {
+	req := &jobs.JobRequest{
+		WorkerType: hook.Worker,
+		Message: &jobs.Message{
+			Type: jobs.JSONEncoding,
+			Data: hook.Arguments,
+		},
+	}
+	if man.Permissions == nil || !man.Permissions.Allow(permissions.GET, req) {
+		return nil, nil, ErrHookNotAllowed
+	}
+	return broker.PushJob(req)
+}
+
+// watchHook waits for the end of the job of a hook, and saves its outcome in
+// the manifest. The manifest is reloaded, as it may have been modified since
+// the job was pushed, and the result is dropped if the application has been
+// installed or updated again.
+func watchHook(db couchdb.Database, slug string, idx int, jobID string, ch <-chan *jobs.JobInfos) {
+	var last *jobs.JobInfos
+	for infos := range ch {
+		last = infos
+	}
+	if last == nil || (last.State != jobs.Done && last.State != jobs.Errored) {
+		return
+	}
+	man, err := GetBySlug(db, slug)
+	if err != nil {
+		return
+	}
+	err = couchdb.UpdateDocWithRetry(db, man, func(couchdb.Doc) error {
+		if idx >= len(man.HooksResults) || man.HooksResults[idx].JobID != jobID {
+			return errHookOutdated
+		}
+		res := man.HooksResults[idx]
+		res.State = last.State
+		if last.Error != nil {
+			res.Error = last.Error.Error()
+		}
+		return nil
+	})
+	if err == nil {
+		publishManifest(db, realtime.EventUpdate, man)
+	} else if err != errHookOutdated {
+		log.Warnf("[apps] Could not save the result of a hook of %s: %s", slug, err)
+	}
+}
@@ -0,0 +1,91 @@
+package apps
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/stretchr/testify/assert"
+)
+
+type hooksContext struct {
+	TestContext
+	broker jobs.Broker
+}
+
+func (c hooksContext) JobsBroker() jobs.Broker { return c.broker }
+
+func TestRunHooks(t *testing.T) {
+	ctx := hooksContext{
+		TestContext: *c,
+		broker: jobs.NewMemBroker("apps-hooks-test", jobs.WorkersList{
+			"hook-test": {
+				Concurrency:  1,
+				MaxExecCount: 1,
+				WorkerFunc: func(_ context.Context, m *jobs.Message) error {
+					var msg string
+					if err := m.Unmarshal(&msg); err != nil {
+						return err
+					}
+					if msg == "fail" {
+						return errors.New("Hook failed")
+					}
+					return nil
+				},
+			},
+		}),
+	}
+
+	man := &Manifest{
+		Slug:  "cozy-hooks",
+		State: Ready,
+		Permissions: &permissions.Set{
+			permissions.Rule{
+				Type:     consts.Jobs,
+				Selector: jobs.WorkerType,
+				Values:   []string{"hook-test"},
+			},
+		},
+	}
+	assert.NoError(t, couchdb.CreateNamedDoc(c, man))
+	defer func() {
+		if doc, err := GetBySlug(c, "cozy-hooks"); err == nil {
+			couchdb.DeleteDoc(c, doc)
+		}
+	}()
+
+	runHooks(ctx, man, []*Hook{
+		{Worker: "hook-test", Arguments: json.RawMessage(`"ok"`)},
+		{Worker: "hook-test", Arguments: json.RawMessage(`"fail"`)},
+		{Worker: "sendmail"},
+	})
+	if !assert.Len(t, man.HooksResults, 3) {
+		return
+	}
+	assert.NotEmpty(t, man.HooksResults[0].JobID)
+	assert.EqualValues(t, jobs.Errored, man.HooksResults[2].State)
+	assert.Equal(t, ErrHookNotAllowed.Error(), man.HooksResults[2].Error)
+
+	var results []*HookResult
+	for i := 0; i < 100; i++ {
+		doc, err := GetBySlug(c, "cozy-hooks")
+		if !assert.NoError(t, err) {
+			return
+		}
+		results = doc.HooksResults
+		if results[0].State == jobs.Done && results[1].State == jobs.Errored {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.EqualValues(t, jobs.Done, results[0].State)
+	assert.Empty(t, results[0].Error)
+	assert.EqualValues(t, jobs.Errored, results[1].State)
+	assert.Equal(t, "Hook failed", results[1].Error)
+}
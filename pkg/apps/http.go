@@ -0,0 +1,193 @@
+package apps
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// tarballClient is the http client used to download the tarballs of the
+// applications. The timeout is larger than for the manifest, since the
+// archive can be big.
+var tarballClient = &http.Client{
+	Timeout: 5 * time.Minute,
+}
+
+type httpFetcher struct {
+	ctx    vfs.Context
+	prefix string
+}
+
+func newHTTPFetcher(ctx vfs.Context) *httpFetcher {
+	return &httpFetcher{ctx: ctx}
+}
+
+// FetchManifest downloads the tarball and extracts the manifest from it.
+func (h *httpFetcher) FetchManifest(src *url.URL) (io.ReadCloser, error) {
+	var manifest []byte
+	err := h.walkTarball(src, nil, func(name string, hdr *tar.Header, r io.Reader) error {
+		if path.Base(name) != ManifestFilename || strings.Count(name, "/") > 1 {
+			return nil
+		}
+		// The archive can have all its files in a top-level directory (like
+		// with `npm pack`). In this case, this directory is the root of the
+		// application.
+		if dir := path.Dir(name); dir != "." {
+			h.prefix = dir + "/"
+		}
+		var err error
+		manifest, err = ioutil.ReadAll(io.LimitReader(r, ManifestMaxSize))
+		if err != nil {
+			return err
+		}
+		return io.EOF
+	})
+	if err != nil {
+		return nil, err
+	}
+	if manifest == nil {
+		return nil, ErrManifestNotReachable
+	}
+	return ioutil.NopCloser(bytes.NewReader(manifest)), nil
+}
+
+// Fetch downloads the tarball and extracts its files in the application
+// directory. The files of a previous version are removed before. It must be
+// called after FetchManifest, which detects the root of the application in
+// the archive. The progress is the number of bytes of the tarball downloaded.
+func (h *httpFetcher) Fetch(src *url.URL, appdir string, progress ProgressFunc) error {
+	log.Debugf("[http] Fetch %s", src.String())
+	ctx := h.ctx
+
+	if err := cleanAppDir(ctx, appdir); err != nil {
+		return err
+	}
+
+	hasManifest := false
+	err := h.walkTarball(src, progress, func(name string, hdr *tar.Header, r io.Reader) (err error) {
+		if h.prefix != "" {
+			if !strings.HasPrefix(name, h.prefix) {
+				return nil
+			}
+			name = strings.TrimPrefix(name, h.prefix)
+		}
+		if name == ManifestFilename {
+			hasManifest = true
+		}
+		abs := path.Join(appdir, name)
+		if hdr.Typeflag == tar.TypeDir {
+			_, err = vfs.MkdirAll(ctx, abs, nil)
+			return err
+		}
+		if _, err = vfs.MkdirAll(ctx, path.Dir(abs), nil); err != nil {
+			return err
+		}
+		file, err := vfs.Create(ctx, abs)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if cerr := file.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}()
+		_, err = io.Copy(file, r)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if !hasManifest {
+		return ErrManifestNotReachable
+	}
+	return nil
+}
+
+// walkTarball downloads the tarball and calls fn for each directory and
+// regular file of the archive, with its cleaned relative name. fn can return
+// io.EOF to stop the walk without error. progress, if not nil, is called with
+// the number of bytes downloaded.
+func (h *httpFetcher) walkTarball(src *url.URL, progress ProgressFunc, fn func(name string, hdr *tar.Header, r io.Reader) error) error {
+	res, err := tarballClient.Get(src.String())
+	if err != nil {
+		return ErrSourceNotReachable
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return ErrSourceNotReachable
+	}
+
+	var body io.Reader = res.Body
+	if progress != nil {
+		body = &progressReader{r: res.Body, total: res.ContentLength, progress: progress}
+	}
+	br := bufio.NewReader(body)
+	var r io.Reader = br
+	if isGzip(br) {
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return ErrBadTarball
+		}
+		defer gr.Close()
+		r = gr
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return ErrBadTarball
+		}
+		if hdr.Typeflag != tar.TypeDir && hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		name := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		if name == "" {
+			continue
+		}
+		if err = fn(name, hdr, tr); err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// progressReader reports the number of bytes read
+type progressReader struct {
+	r        io.Reader
+	done     int64
+	total    int64
+	progress ProgressFunc
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.done += int64(n)
+		p.progress(p.done, p.total)
+	}
+	return n, err
+}
+
+func isGzip(r *bufio.Reader) bool {
+	magic, err := r.Peek(2)
+	return err == nil && magic[0] == 0x1f && magic[1] == 0x8b
+}
+
+var _ Fetcher = &httpFetcher{}
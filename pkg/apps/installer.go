@@ -3,12 +3,18 @@ package apps
 import (
 	"encoding/json"
 	"io"
+	"io/ioutil"
 	"net/url"
 	"path"
 	"regexp"
+	"strings"
+	"time"
 
+	log "github.com/Sirupsen/logrus"
+	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/realtime"
 	"github.com/cozy/cozy-stack/pkg/vfs"
 )
 
@@ -19,9 +25,15 @@ type Installer struct {
 	fetcher Fetcher
 	ctx     vfs.Context
 
-	man  *Manifest
-	src  *url.URL
-	slug string
+	man   *Manifest
+	src   *url.URL
+	slug  string
+	raw   []byte
+	creds *credentials
+
+	// consented are the permissions accepted by the user for a pending
+	// update
+	consented *permissions.Set
 
 	err  error
 	errc chan error
@@ -29,10 +41,19 @@ type Installer struct {
 }
 
 // InstallerOptions provides the slug name of the application along with the
-// source URL.
+// source URL. For an update, the source URL can be given to change the source
+// of the application, for example to pin it to a version with
+// `SourceURL#v1.2.3`.
+//
+// Username and Password are the credentials for a private git repository,
+// fetched with a git+https:// source. For a token, the username can be left
+// empty and the token given as the password. The credentials are never saved
+// in the manifest, and the ones in the source URL are removed from it.
 type InstallerOptions struct {
 	Slug      string
 	SourceURL string
+	Username  string
+	Password  string
 }
 
 // Fetcher interface should be implemented by the underlying transport
@@ -42,10 +63,15 @@ type Fetcher interface {
 	// manifest data
 	FetchManifest(src *url.URL) (io.ReadCloser, error)
 	// Fetch should download the application and install it in the given
-	// directory.
-	Fetch(src *url.URL, appDir string) error
+	// directory. It reports its progress with the given function.
+	Fetch(src *url.URL, appDir string, progress ProgressFunc) error
 }
 
+// ProgressFunc is used by the fetchers to report the progress of the
+// download of an application, as a number of units (bytes or files) done out
+// of a total. The total is zero or negative if it is not known.
+type ProgressFunc func(done, total int64)
+
 // NewInstaller creates a new Installer
 func NewInstaller(ctx vfs.Context, opts *InstallerOptions) (*Installer, error) {
 	slug := opts.Slug
@@ -59,10 +85,10 @@ func NewInstaller(ctx vfs.Context, opts *InstallerOptions) (*Installer, error) {
 	}
 
 	var src *url.URL
-	if man != nil {
-		src, err = url.Parse(man.Source)
-	} else if opts.SourceURL != "" {
+	if opts.SourceURL != "" {
 		src, err = url.Parse(opts.SourceURL)
+	} else if man != nil {
+		src, err = url.Parse(man.Source)
 	} else {
 		err = nil
 	}
@@ -71,12 +97,11 @@ func NewInstaller(ctx vfs.Context, opts *InstallerOptions) (*Installer, error) {
 	}
 
 	var fetcher Fetcher
+	var creds *credentials
 	if src != nil {
-		switch src.Scheme {
-		case "git":
-			fetcher = newGitFetcher(ctx)
-		default:
-			return nil, ErrNotSupportedSource
+		creds = extractCredentials(src, opts.Username, opts.Password)
+		if fetcher, err = newFetcher(ctx, src, creds); err != nil {
+			return nil, err
 		}
 	}
 
@@ -86,6 +111,7 @@ func NewInstaller(ctx vfs.Context, opts *InstallerOptions) (*Installer, error) {
 		src:     src,
 		slug:    slug,
 		man:     man,
+		creds:   creds,
 		errc:    make(chan error),
 		manc:    make(chan *Manifest, 1),
 	}
@@ -93,12 +119,44 @@ func NewInstaller(ctx vfs.Context, opts *InstallerOptions) (*Installer, error) {
 	return inst, nil
 }
 
+func newFetcher(ctx vfs.Context, src *url.URL, creds *credentials) (Fetcher, error) {
+	if src.Scheme == DevScheme {
+		if !allowsProxyApps(ctx) {
+			return nil, ErrSourceNotAllowed
+		}
+		return newDevFetcher(ctx), nil
+	}
+	if !allowsUnsignedApps(ctx) && !isAllowedSource(src, configAllowedSources()) {
+		return nil, ErrSourceNotAllowed
+	}
+	switch src.Scheme {
+	case "git":
+		return newGitFetcher(ctx, nil), nil
+	case "git+https":
+		return newGitFetcher(ctx, creds), nil
+	case "http", "https":
+		return newHTTPFetcher(ctx), nil
+	case "registry":
+		return newRegistryFetcher(ctx), nil
+	}
+	return nil, ErrNotSupportedSource
+}
+
 // Install will install the application linked to the installer. It will
-// report its progress or error (see Poll method).
+// report its progress or error (see Poll method). An application that is
+// already installed can be installed again only if its previous installation
+// was interrupted (see RecoverInterrupted).
+//
+// The number of installations and updates running at the same time is
+// limited, for each instance and for the stack: Install, Update,
+// AcceptUpdate and Rollback wait for their turn in a queue if needed.
 func (i *Installer) Install() {
+	installs.acquire(i.ctx.Prefix())
 	defer i.endOfProc()
-	if i.man != nil {
+	if i.man != nil && !i.man.Retriable {
 		i.man, i.err = nil, ErrAlreadyExists
+	} else if err := CheckSlug(i.ctx, i.slug); err != nil {
+		i.man, i.err = nil, err
 	} else {
 		i.man, i.err = i.install()
 	}
@@ -106,14 +164,20 @@ func (i *Installer) Install() {
 }
 
 // Update will update the application linked to the installer. It will
-// report its progress or error (see Poll method).
+// report its progress or error (see Poll method). Nothing is done if the
+// application is pinned to a tag or a commit, and the source has not changed.
 func (i *Installer) Update() {
+	if i.man != nil && i.man.State == Ready && i.man.isPinnedTo(i.src) {
+		i.manc <- i.man
+		return
+	}
+	installs.acquire(i.ctx.Prefix())
 	defer i.endOfProc()
 	if i.man == nil {
 		i.err = ErrNotFound
 		return
 	}
-	if state := i.man.State; state != Ready && state != Errored {
+	if state := i.man.State; state != Ready && state != Errored && state != AwaitingConsent {
 		i.man, i.err = nil, ErrBadState
 	} else {
 		i.man, i.err = i.update()
@@ -121,17 +185,101 @@ func (i *Installer) Update() {
 	return
 }
 
+// AcceptUpdate will perform the update that was waiting for the user to
+// accept its new permissions. It will report its progress or error (see Poll
+// method).
+func (i *Installer) AcceptUpdate() {
+	installs.acquire(i.ctx.Prefix())
+	defer i.endOfProc()
+	if i.man == nil {
+		i.err = ErrNotFound
+		return
+	}
+	pending := i.man.PendingUpdate
+	if i.man.State != AwaitingConsent || pending == nil {
+		i.man, i.err = nil, ErrBadState
+		return
+	}
+	src, err := url.Parse(pending.Source)
+	if err == nil {
+		i.fetcher, err = newFetcher(i.ctx, src, i.creds)
+	}
+	if err != nil {
+		i.man, i.err = nil, err
+		return
+	}
+	i.src = src
+	i.consented = pending.Permissions
+	i.man, i.err = i.update()
+}
+
+// RefuseUpdate will drop the update that was waiting for the user to accept
+// its new permissions. The installed version of the application is kept.
+func (i *Installer) RefuseUpdate() (*Manifest, error) {
+	if i.man == nil {
+		return nil, ErrNotFound
+	}
+	pending := i.man.PendingUpdate
+	if i.man.State != AwaitingConsent || pending == nil {
+		return nil, ErrBadState
+	}
+	i.man.State = pending.PreviousState
+	if i.man.State == "" {
+		i.man.State = Ready
+	}
+	i.man.PendingUpdate = nil
+	if err := couchdb.UpdateDoc(i.ctx, i.man); err != nil {
+		return nil, err
+	}
+	publishManifest(i.ctx, realtime.EventUpdate, i.man)
+	return i.man, nil
+}
+
+// Rollback will install again the version of the application that was
+// installed before the current one, from a source pinned to this version. It
+// will report its progress or error (see Poll method).
+func (i *Installer) Rollback() {
+	installs.acquire(i.ctx.Prefix())
+	defer i.endOfProc()
+	if i.man == nil {
+		i.err = ErrNotFound
+		return
+	}
+	if state := i.man.State; state != Ready && state != Errored {
+		i.man, i.err = nil, ErrBadState
+		return
+	}
+	prev, err := previousVersion(i.ctx, i.slug)
+	if err == nil {
+		i.src, err = url.Parse(prev.Source)
+	}
+	if err == nil {
+		i.fetcher, err = newFetcher(i.ctx, i.src, i.creds)
+	}
+	if err != nil {
+		i.man, i.err = nil, err
+		return
+	}
+	i.man, i.err = i.update()
+}
+
 // Delete will remove the application linked to the installer.
 func (i *Installer) Delete() (*Manifest, error) {
 	if i.man == nil {
 		return nil, ErrNotFound
 	}
-	if state := i.man.State; state != Ready && state != Errored {
+	if state := i.man.State; state != Ready && state != Errored && state != AwaitingConsent {
 		return nil, ErrBadState
 	}
+	if err := deleteDatabases(i.ctx, i.man); err != nil {
+		return nil, err
+	}
 	if err := deleteManifest(i.ctx, i.man); err != nil {
 		return nil, err
 	}
+	if err := deleteVersions(i.ctx, i.slug); err != nil {
+		return nil, err
+	}
 	if err := vfs.RemoveAll(i.ctx, i.appDir()); err != nil {
 		return nil, err
 	}
@@ -139,6 +287,7 @@ func (i *Installer) Delete() (*Manifest, error) {
 }
 
 func (i *Installer) endOfProc() {
+	installs.release(i.ctx.Prefix())
 	man, err := i.man, i.err
 	if man == nil || err == ErrBadState {
 		i.errc <- err
@@ -151,8 +300,23 @@ func (i *Installer) endOfProc() {
 		i.errc <- err
 		return
 	}
+	if man.State == AwaitingConsent {
+		// The permissions of the installed version are kept
+		if err = couchdb.UpdateDoc(i.ctx, man); err != nil {
+			i.errc <- err
+			return
+		}
+		publishManifest(i.ctx, realtime.EventUpdate, man)
+		i.manc <- man
+		return
+	}
+	hooks := hooksFor(man, man.State)
 	man.State = Ready
 	updateManifest(i.ctx, man)
+	if err = saveVersion(i.ctx, man, i.src, i.raw); err != nil {
+		log.Warnf("[apps] Could not save the version of %s: %s", man.Slug, err)
+	}
+	runHooks(i.ctx, man, hooks)
 	i.manc <- i.man
 }
 
@@ -167,8 +331,16 @@ func (i *Installer) install() (*Manifest, error) {
 	if err := i.ReadManifest(Installing, man); err != nil {
 		return nil, err
 	}
-
-	if err := createManifest(i.ctx, man); err != nil {
+	now := time.Now()
+	man.InstalledAt = &now
+
+	if old := i.man; old != nil {
+		// The manifest of the interrupted installation is replaced
+		man.ManRev = old.ManRev
+		if err := updateManifest(i.ctx, man); err != nil {
+			return man, err
+		}
+	} else if err := createManifest(i.ctx, man); err != nil {
 		return man, err
 	}
 
@@ -179,7 +351,12 @@ func (i *Installer) install() (*Manifest, error) {
 		return man, err
 	}
 
-	err := i.fetcher.Fetch(i.src, appdir)
+	if err := i.fetcher.Fetch(i.src, appdir, i.progress(man)); err != nil {
+		return man, err
+	}
+	i.recordCommit(man)
+	assets, err := indexAssets(i.ctx, appdir)
+	man.Assets = assets
 	return man, err
 }
 
@@ -187,13 +364,36 @@ func (i *Installer) install() (*Manifest, error) {
 // returns the freshly fetched manifest from the source along with a possible
 // error in case the update went wrong.
 //
+// If the new version requests permissions that were not granted to the
+// application, the update is not done and the installed manifest is returned
+// in the AwaitingConsent state.
+//
 // Note that the fetched manifest is returned even if an error occurred while
 // upgrading.
 func (i *Installer) update() (*Manifest, error) {
-	man := i.man
+	old := i.man
+	man := &Manifest{
+		ManRev:      old.ManRev,
+		InstalledAt: old.InstalledAt,
+	}
 
 	if err := i.ReadManifest(Upgrading, man); err != nil {
-		return man, err
+		return old, err
+	}
+
+	if needsConsent(man, old.Permissions, i.consented) {
+		state := old.State
+		if pending := old.PendingUpdate; state == AwaitingConsent && pending != nil {
+			state = pending.PreviousState
+		}
+		old.State = AwaitingConsent
+		old.PendingUpdate = &PendingUpdate{
+			Version:       man.Version,
+			Source:        man.Source,
+			Permissions:   man.Permissions,
+			PreviousState: state,
+		}
+		return old, nil
 	}
 
 	if err := updateManifest(i.ctx, man); err != nil {
@@ -202,7 +402,13 @@ func (i *Installer) update() (*Manifest, error) {
 
 	i.manc <- man
 
-	err := i.fetcher.Fetch(i.src, i.appDir())
+	appdir := i.appDir()
+	if err := i.fetcher.Fetch(i.src, appdir, i.progress(man)); err != nil {
+		return man, err
+	}
+	i.recordCommit(man)
+	assets, err := indexAssets(i.ctx, appdir)
+	man.Assets = assets
 	return man, err
 }
 
@@ -217,28 +423,76 @@ func (i *Installer) ReadManifest(state State, man *Manifest) error {
 	}
 	defer r.Close()
 
-	err = json.NewDecoder(io.LimitReader(r, ManifestMaxSize)).Decode(man)
+	raw, err := ioutil.ReadAll(io.LimitReader(r, ManifestMaxSize))
 	if err != nil {
+		return ErrManifestNotReachable
+	}
+	if err = ValidateManifest(raw); err != nil {
+		return err
+	}
+	if err = json.Unmarshal(raw, man); err != nil {
 		return ErrBadManifest
 	}
+	i.raw = raw
 
 	man.Slug = i.slug
 	man.Source = i.src.String()
 	man.State = state
+	// The results of the hooks and the commit are only set by the stack
+	man.HooksResults = nil
+	man.Commit = ""
+	man.Pinned = false
 	man.CreateDefaultRoute()
 
 	return nil
 }
 
+// recordCommit saves in the manifest the commit fetched from a git source
+func (i *Installer) recordCommit(man *Manifest) {
+	if g, ok := i.fetcher.(*gitFetcher); ok {
+		man.Commit = g.commit
+		man.Pinned = g.pinned
+	}
+}
+
 func (i *Installer) appDir() string {
 	return path.Join(vfs.AppsDirName, i.slug)
 }
 
-// Poll should be used to monitor the progress of the Installer.
+// progress returns the function given to the fetcher to report the progress
+// of the download. It sends to Poll a copy of the manifest with the
+// percentage, each time it changes. The copy is dropped if the previous one
+// has not been polled yet, as the next one will be more accurate.
+func (i *Installer) progress(man *Manifest) ProgressFunc {
+	last := -1
+	return func(done, total int64) {
+		if total <= 0 {
+			return
+		}
+		percent := int(done * 100 / total)
+		if percent > 100 {
+			percent = 100
+		}
+		if percent == last {
+			return
+		}
+		last = percent
+		m := *man
+		m.Progress = percent
+		select {
+		case i.manc <- &m:
+		default:
+		}
+	}
+}
+
+// Poll should be used to monitor the progress of the Installer. While the
+// files of the application are fetched, it returns the manifest with its
+// Progress field set to the percentage of the download.
 func (i *Installer) Poll() (*Manifest, bool, error) {
 	select {
 	case man := <-i.manc:
-		done := man.State == Ready
+		done := man.State == Ready || man.State == AwaitingConsent
 		return man, done, nil
 	case err := <-i.errc:
 		return nil, false, err
@@ -254,6 +508,7 @@ func updateManifest(db couchdb.Database, man *Manifest) error {
 	if err != nil {
 		return err
 	}
+	publishManifest(db, realtime.EventUpdate, man)
 	_, err = permissions.CreateAppSet(db, man.Slug, *man.Permissions)
 	return err
 }
@@ -262,6 +517,7 @@ func createManifest(db couchdb.Database, man *Manifest) error {
 	if err := couchdb.CreateNamedDoc(db, man); err != nil {
 		return err
 	}
+	publishManifest(db, realtime.EventCreate, man)
 	_, err := permissions.CreateAppSet(db, man.Slug, *man.Permissions)
 	return err
 }
@@ -271,5 +527,115 @@ func deleteManifest(db couchdb.Database, man *Manifest) error {
 	if err != nil && !couchdb.IsNotFoundError(err) {
 		return err
 	}
-	return couchdb.DeleteDoc(db, man)
+	if err = couchdb.DeleteDoc(db, man); err != nil {
+		return err
+	}
+	publishManifest(db, realtime.EventDelete, man)
+	return nil
+}
+
+// publishManifest sends the state transitions of an application on the
+// realtime hub of its instance, so that the home application can follow them
+// without polling. A copy of the manifest is sent, as the installer may
+// change it afterwards.
+func publishManifest(db couchdb.Database, eventType string, man *Manifest) {
+	doc := *man
+	domain := strings.TrimSuffix(db.Prefix(), "/")
+	realtime.InstanceHub(domain).Publish(&realtime.Event{
+		Type:    eventType,
+		DocType: consts.Apps,
+		DocID:   doc.ID(),
+		DocRev:  doc.Rev(),
+		Doc:     &doc,
+	})
+}
+
+// deleteDatabases destroys the databases of the doctypes owned by the
+// application. A doctype on which another application or a sharing has a
+// permission is kept, even if the manifest lists it.
+func deleteDatabases(db couchdb.Database, man *Manifest) error {
+	doctypes := ownedDoctypes(man)
+	if len(doctypes) == 0 {
+		return nil
+	}
+	used, err := permissions.UsedDoctypes(db, man.Slug)
+	if err != nil {
+		return err
+	}
+	for _, doctype := range doctypes {
+		if used[doctype] || usedByWildcard(used, doctype) {
+			continue
+		}
+		err = couchdb.DeleteDB(db, doctype)
+		if err != nil && !couchdb.IsNoDatabaseError(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// ownedDoctypes returns the doctypes listed in the databases field of the
+// manifest that the application can write. The doctypes of the stack are
+// skipped, even if the manifest lists them.
+func ownedDoctypes(man *Manifest) []string {
+	var doctypes []string
+	for _, doctype := range man.Databases {
+		if IsReservedDoctype(doctype) || man.Permissions == nil {
+			continue
+		}
+		for _, rule := range *man.Permissions {
+			if rule.MatchType(doctype) && canWrite(rule) {
+				doctypes = append(doctypes, doctype)
+				break
+			}
+		}
+	}
+	return doctypes
+}
+
+// canWrite returns true if the rule allows to create, modify or delete
+// documents: an application that can only read a doctype does not own its
+// data.
+func canWrite(rule permissions.Rule) bool {
+	for _, verb := range []permissions.Verb{permissions.POST, permissions.PUT, permissions.PATCH, permissions.DELETE} {
+		if rule.Verbs.Contains(verb) {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanAppDir removes the files of the application directory, except the
+// ones given in skip, before a new version is fetched.
+//
+// TODO: permanently remove application files instead of moving them to the
+// trash
+func cleanAppDir(ctx vfs.Context, appdir string, skip ...string) error {
+	return vfs.Walk(ctx, appdir, func(name string, dir *vfs.DirDoc, file *vfs.FileDoc, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if name == appdir {
+			return nil
+		}
+		for _, s := range skip {
+			if name == s {
+				return vfs.ErrSkipDir
+			}
+		}
+
+		if dir != nil {
+			_, err = vfs.TrashDir(ctx, dir)
+		} else {
+			_, err = vfs.TrashFile(ctx, file)
+		}
+		if err != nil {
+			return err
+		}
+		if dir != nil {
+			return vfs.ErrSkipDir
+		}
+		return nil
+	})
 }
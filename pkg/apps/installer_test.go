@@ -1,6 +1,9 @@
 package apps
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -17,6 +20,8 @@ import (
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/realtime"
 	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
@@ -168,6 +173,9 @@ func TestInstallSuccessful(t *testing.T) {
 				return
 			}
 		} else if state == Installing {
+			if man.State == Installing {
+				continue // progress of the download
+			}
 			if !assert.EqualValues(t, Ready, man.State) {
 				return
 			}
@@ -278,6 +286,9 @@ func TestInstallWithUpgrade(t *testing.T) {
 				return
 			}
 		} else if state == Upgrading {
+			if man.State == Upgrading {
+				continue // progress of the download
+			}
 			if !assert.EqualValues(t, Ready, man.State) {
 				return
 			}
@@ -324,6 +335,9 @@ func TestInstallAndUpgradeWithBranch(t *testing.T) {
 				return
 			}
 		} else if state == Installing {
+			if man.State == Installing {
+				continue // progress of the download
+			}
 			if !assert.EqualValues(t, Ready, man.State) {
 				return
 			}
@@ -371,6 +385,9 @@ func TestInstallAndUpgradeWithBranch(t *testing.T) {
 				return
 			}
 		} else if state == Upgrading {
+			if man.State == Upgrading {
+				continue // progress of the download
+			}
 			if !assert.EqualValues(t, Ready, man.State) {
 				return
 			}
@@ -396,6 +413,125 @@ func TestInstallAndUpgradeWithBranch(t *testing.T) {
 	assert.True(t, ok, "The good branch was checked out")
 }
 
+func TestInstallPinnedRevisions(t *testing.T) {
+	doUpgrade(6)
+	gitCmd := func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = localGitDir
+		out, err := cmd.Output()
+		assert.NoError(t, err)
+		return strings.TrimSpace(string(out))
+	}
+	gitCmd("tag", "pinned")
+	sha := gitCmd("rev-parse", "HEAD")
+
+	inst, err := NewInstaller(c, &InstallerOptions{
+		Slug:      "local-cozy-mini-tag",
+		SourceURL: "git://localhost/#pinned",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	go inst.Install()
+	man, ok := waitInstaller(t, inst)
+	if !ok {
+		return
+	}
+	assert.Equal(t, sha, man.Commit)
+	assert.True(t, man.Pinned)
+
+	doUpgrade(7)
+	inst, err = NewInstaller(c, &InstallerOptions{Slug: "local-cozy-mini-tag"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	go inst.Update()
+	man, ok = waitInstaller(t, inst)
+	if !ok {
+		return
+	}
+	assert.Equal(t, sha, man.Commit)
+	assert.Equal(t, "6.0.0", man.Version)
+	ok, err = afero.FileContainsBytes(c.FS(), "/.cozy_apps/local-cozy-mini-tag/manifest.webapp", []byte("6.0.0"))
+	assert.NoError(t, err)
+	assert.True(t, ok, "The tagged version is kept")
+
+	inst, err = NewInstaller(c, &InstallerOptions{
+		Slug:      "local-cozy-mini-sha",
+		SourceURL: "git://localhost/#" + sha,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	go inst.Install()
+	man, ok = waitInstaller(t, inst)
+	if !ok {
+		return
+	}
+	assert.Equal(t, sha, man.Commit)
+	assert.True(t, man.Pinned)
+	ok, err = afero.FileContainsBytes(c.FS(), "/.cozy_apps/local-cozy-mini-sha/manifest.webapp", []byte("6.0.0"))
+	assert.NoError(t, err)
+	assert.True(t, ok, "The pinned commit is checked out")
+}
+
+func TestUpgradeToAnotherBranch(t *testing.T) {
+	inst, err := NewInstaller(c, &InstallerOptions{
+		Slug:      "local-cozy-mini-switch",
+		SourceURL: "git://localhost/",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	go inst.Install()
+
+	for {
+		var done bool
+		_, done, err = inst.Poll()
+		if !assert.NoError(t, err) {
+			return
+		}
+		if done {
+			break
+		}
+	}
+
+	ok, err := afero.Exists(c.FS(), "/.cozy_apps/local-cozy-mini-switch/branch")
+	assert.NoError(t, err)
+	assert.False(t, ok, "The default branch was checked out")
+
+	doUpgrade(5)
+
+	inst, err = NewInstaller(c, &InstallerOptions{
+		Slug:      "local-cozy-mini-switch",
+		SourceURL: "git://localhost/#branch",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	go inst.Update()
+
+	for {
+		var done bool
+		_, done, err = inst.Poll()
+		if !assert.NoError(t, err) {
+			return
+		}
+		if done {
+			break
+		}
+	}
+
+	ok, err = afero.FileContainsBytes(c.FS(), "/.cozy_apps/local-cozy-mini-switch/manifest.webapp", []byte("5.0.0"))
+	assert.NoError(t, err)
+	assert.True(t, ok, "The manifest has the right version")
+	ok, err = afero.Exists(c.FS(), "/.cozy_apps/local-cozy-mini-switch/branch")
+	assert.NoError(t, err)
+	assert.True(t, ok, "The other branch was checked out")
+}
+
 func TestInstallFromGithub(t *testing.T) {
 	inst, err := NewInstaller(c, &InstallerOptions{
 		Slug:      "github-cozy-mini",
@@ -418,6 +554,9 @@ func TestInstallFromGithub(t *testing.T) {
 				return
 			}
 		} else if state == Installing {
+			if man.State == Installing {
+				continue // progress of the download
+			}
 			if !assert.EqualValues(t, Ready, man.State) {
 				return
 			}
@@ -433,6 +572,129 @@ func TestInstallFromGithub(t *testing.T) {
 	}
 }
 
+func makeTarball() []byte {
+	buf := new(bytes.Buffer)
+	gw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gw)
+	files := map[string]string{
+		"package/manifest.webapp": manifest(),
+		"package/index.html":      "<html><body>mini</body></html>",
+	}
+	for name, content := range files {
+		hdr := &tar.Header{
+			Name: name,
+			Mode: 0644,
+			Size: int64(len(content)),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			panic(err)
+		}
+		if _, err := io.WriteString(tw, content); err != nil {
+			panic(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		panic(err)
+	}
+	if err := gw.Close(); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+func TestInstallFromHTTP(t *testing.T) {
+	tarball := makeTarball()
+	tts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Write(tarball)
+	}))
+	defer tts.Close()
+
+	inst, err := NewInstaller(c, &InstallerOptions{
+		Slug:      "http-cozy-mini",
+		SourceURL: tts.URL + "/mini.tar.gz",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	go inst.Install()
+
+	for {
+		man, done, err := inst.Poll()
+		if !assert.NoError(t, err) {
+			return
+		}
+		if done {
+			assert.EqualValues(t, Ready, man.State)
+			break
+		}
+	}
+
+	ok, err := afero.FileContainsBytes(c.FS(), "/.cozy_apps/http-cozy-mini/manifest.webapp", []byte("1.0.0"))
+	assert.NoError(t, err)
+	assert.True(t, ok, "The manifest is present")
+	ok, err = afero.Exists(c.FS(), "/.cozy_apps/http-cozy-mini/index.html")
+	assert.NoError(t, err)
+	assert.True(t, ok, "The top-level directory of the tarball is stripped")
+}
+
+func TestInstallFromRegistry(t *testing.T) {
+	tarball := makeTarball()
+	var tts *httptest.Server
+	tts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/registry/mini/stable/latest", "/registry/mini/1.0.0":
+			fmt.Fprintf(w, `{"slug": "mini", "version": "1.0.0", "url": "%s/mini-1.0.0.tar.gz"}`, tts.URL)
+		case "/mini-1.0.0.tar.gz":
+			w.Header().Set("Content-Type", "application/gzip")
+			w.Write(tarball)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer tts.Close()
+	config.GetConfig().Registry.URL = tts.URL + "/registry/"
+
+	src, _ := url.Parse("registry://mini#../../secret")
+	_, err := FetchRegistryVersion(src)
+	assert.Equal(t, ErrNotSupportedSource, err)
+	src, _ = url.Parse("registry://mini#beta")
+	_, err = FetchRegistryVersion(src)
+	assert.Equal(t, ErrNotFoundInRegistry, err)
+	src, _ = url.Parse("registry://mini#1.0.0")
+	v, err := FetchRegistryVersion(src)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "1.0.0", v.Version)
+	}
+
+	inst, err := NewInstaller(c, &InstallerOptions{
+		Slug:      "registry-cozy-mini",
+		SourceURL: "registry://mini",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	go inst.Install()
+
+	for {
+		man, done, err := inst.Poll()
+		if !assert.NoError(t, err) {
+			return
+		}
+		if done {
+			assert.EqualValues(t, Ready, man.State)
+			assert.Equal(t, "registry://mini", man.Source)
+			break
+		}
+	}
+
+	ok, err := afero.FileContainsBytes(c.FS(), "/.cozy_apps/registry-cozy-mini/manifest.webapp", []byte("1.0.0"))
+	assert.NoError(t, err)
+	assert.True(t, ok, "The manifest is present")
+}
+
 func TestUninstall(t *testing.T) {
 	inst1, err := NewInstaller(c, &InstallerOptions{
 		Slug:      "github-cozy-delete",
@@ -469,13 +731,172 @@ func TestUninstall(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestRecoverInterrupted(t *testing.T) {
+	interrupted := &Manifest{
+		Slug:        "cozy-interrupted",
+		Source:      "git://localhost/",
+		State:       Installing,
+		Permissions: &permissions.Set{},
+	}
+	assert.NoError(t, couchdb.CreateNamedDoc(c, interrupted))
+	ready := &Manifest{Slug: "cozy-not-interrupted", State: Ready}
+	assert.NoError(t, couchdb.CreateNamedDoc(c, ready))
+	defer couchdb.DeleteDoc(c, ready)
+
+	recovered, err := RecoverInterrupted(c, false)
+	assert.NoError(t, err)
+	if assert.Len(t, recovered, 1) {
+		assert.Equal(t, "cozy-interrupted", recovered[0].Slug)
+	}
+	man, err := GetBySlug(c, "cozy-interrupted")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.EqualValues(t, Errored, man.State)
+	assert.Equal(t, ErrInterrupted.Error(), man.Error)
+	assert.True(t, man.Retriable)
+	man, err = GetBySlug(c, "cozy-not-interrupted")
+	assert.NoError(t, err)
+	assert.EqualValues(t, Ready, man.State)
+
+	inst, err := NewInstaller(c, &InstallerOptions{Slug: "cozy-interrupted"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	go inst.Install()
+	for {
+		var done bool
+		man, done, err = inst.Poll()
+		if !assert.NoError(t, err) {
+			return
+		}
+		if done {
+			break
+		}
+	}
+	assert.EqualValues(t, Ready, man.State)
+	assert.False(t, man.Retriable)
+	assert.Empty(t, man.Error)
+}
+
+func TestInstallPublishesEvents(t *testing.T) {
+	sub := realtime.InstanceHub("apps-test").Subscribe(consts.Apps)
+	events := make(chan *realtime.Event, 10)
+	go func() {
+		for e := range sub.Read() {
+			events <- e
+			if e.Type == realtime.EventDelete {
+				return
+			}
+		}
+	}()
+
+	inst, err := NewInstaller(c, &InstallerOptions{
+		Slug:      "realtime-app",
+		SourceURL: "git://localhost/",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	go inst.Install()
+	for {
+		var done bool
+		_, done, err = inst.Poll()
+		if !assert.NoError(t, err) {
+			return
+		}
+		if done {
+			break
+		}
+	}
+	inst, err = NewInstaller(c, &InstallerOptions{Slug: "realtime-app"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = inst.Delete()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	expected := []struct {
+		Type  string
+		State State
+	}{
+		{realtime.EventCreate, Installing},
+		{realtime.EventUpdate, Ready},
+		{realtime.EventDelete, Ready},
+	}
+	for _, exp := range expected {
+		select {
+		case e := <-events:
+			assert.Equal(t, exp.Type, e.Type)
+			assert.Equal(t, consts.Apps+"/realtime-app", e.DocID)
+			if man, ok := e.Doc.(*Manifest); assert.True(t, ok) {
+				assert.Equal(t, exp.State, man.State)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("missing %s event", exp.Type)
+		}
+	}
+	assert.NoError(t, sub.Close())
+}
+
+func TestOwnedDoctypes(t *testing.T) {
+	man := &Manifest{
+		Slug: "todos",
+		Permissions: &permissions.Set{
+			{Type: "io.cozy.todos"},
+			{Type: "io.cozy.todos.labels", Verbs: permissions.Verbs(permissions.GET)},
+			{Type: "io.cozy.todos.lists.*", Verbs: permissions.Verbs(permissions.GET, permissions.POST)},
+			{Type: consts.Files},
+		},
+		Databases: []string{"io.cozy.todos", consts.Files, "io.cozy.notes",
+			"io.cozy.todos.labels", "io.cozy.todos.lists.done"},
+	}
+	assert.Equal(t, []string{"io.cozy.todos", "io.cozy.todos.lists.done"}, ownedDoctypes(man))
+	man.Permissions = nil
+	assert.Empty(t, ownedDoctypes(man))
+}
+
+func TestDeleteDatabases(t *testing.T) {
+	_, err := permissions.CreateAppSet(c, "databases-other", permissions.Set{
+		{Type: "io.cozy.tests.databases.shared"},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	man := &Manifest{
+		Slug: "databases",
+		Permissions: &permissions.Set{
+			{Type: "io.cozy.tests.databases.*"},
+		},
+		Databases: []string{"io.cozy.tests.databases.owned", "io.cozy.tests.databases.shared"},
+	}
+	for _, doctype := range man.Databases {
+		if !assert.NoError(t, couchdb.ResetDB(c, doctype)) {
+			return
+		}
+	}
+	assert.NoError(t, deleteDatabases(c, man))
+
+	_, err = couchdb.DBStatus(c, "io.cozy.tests.databases.owned")
+	assert.True(t, couchdb.IsNoDatabaseError(err))
+	_, err = couchdb.DBStatus(c, "io.cozy.tests.databases.shared")
+	assert.NoError(t, err)
+
+	// The databases can already be destroyed
+	assert.NoError(t, deleteDatabases(c, man))
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 
-	db, err := checkup.HTTPChecker{URL: config.CouchURL()}.Check()
-	if err != nil || db.Status() != checkup.Healthy {
-		fmt.Println("This test need couchdb to run.")
-		os.Exit(1)
+	if !couchdb.InMemory() {
+		db, err := checkup.HTTPChecker{URL: config.CouchURL()}.Check()
+		if err != nil || db.Status() != checkup.Healthy {
+			fmt.Println("This test need couchdb to run.")
+			os.Exit(1)
+		}
 	}
 
 	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -486,7 +907,7 @@ func TestMain(m *testing.M) {
 		Transport: &transport{},
 	}
 
-	err = couchdb.ResetDB(c, consts.Apps)
+	err := couchdb.ResetDB(c, consts.Apps)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
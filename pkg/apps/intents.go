@@ -0,0 +1,75 @@
+package apps
+
+import (
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// Intent is an action that an application can do for the other applications,
+// like picking a file or creating a contact. It is declared in the intents
+// section of the manifest, with the doctypes it can handle and the route of
+// the application that will do it.
+type Intent struct {
+	Action string   `json:"action"`
+	Types  []string `json:"type"`
+	Href   string   `json:"href"`
+}
+
+// Match returns true if the intent can handle the given action on the given
+// doctype. The action is case-insensitive, and the * doctype of an intent
+// matches all the doctypes.
+func (i *Intent) Match(action, doctype string) bool {
+	if !strings.EqualFold(i.Action, action) {
+		return false
+	}
+	for _, t := range i.Types {
+		if t == "*" || t == doctype {
+			return true
+		}
+	}
+	return false
+}
+
+// IntentService is an installed application that can handle an intent, with
+// the URL where the intent should be sent.
+type IntentService struct {
+	Slug   string `json:"slug"`
+	Action string `json:"action"`
+	Type   string `json:"type"`
+	Href   string `json:"href"`
+}
+
+// FindIntentServices returns the ready applications that can handle the
+// given action on the given doctype.
+func FindIntentServices(db couchdb.Database, instance SubDomainer, action, doctype string) ([]*IntentService, error) {
+	mans, err := List(db)
+	if err != nil {
+		return nil, err
+	}
+	services := []*IntentService{}
+	for _, man := range mans {
+		if man.State != Ready {
+			continue
+		}
+		for _, intent := range man.Intents {
+			if !intent.Match(action, doctype) {
+				continue
+			}
+			href := intent.Href
+			if instance != nil {
+				u := instance.SubDomain(man.Slug)
+				u.Path = intent.Href
+				href = u.String()
+			}
+			services = append(services, &IntentService{
+				Slug:   man.Slug,
+				Action: strings.ToUpper(action),
+				Type:   doctype,
+				Href:   href,
+			})
+			break
+		}
+	}
+	return services, nil
+}
@@ -0,0 +1,23 @@
+package apps
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIntentMatch(t *testing.T) {
+	intent := &Intent{
+		Action: "PICK",
+		Types:  []string{"io.cozy.files", "io.cozy.photos.albums"},
+		Href:   "/pick",
+	}
+	assert.True(t, intent.Match("PICK", "io.cozy.files"))
+	assert.True(t, intent.Match("pick", "io.cozy.photos.albums"))
+	assert.False(t, intent.Match("EDIT", "io.cozy.files"))
+	assert.False(t, intent.Match("PICK", "io.cozy.contacts"))
+
+	intent = &Intent{Action: "OPEN", Types: []string{"*"}, Href: "/"}
+	assert.True(t, intent.Match("OPEN", "io.cozy.contacts"))
+	assert.False(t, intent.Match("PICK", "io.cozy.contacts"))
+}
@@ -0,0 +1,43 @@
+package apps
+
+import "strings"
+
+// Locale is the translation of the texts of a manifest in a locale, from its
+// locales section.
+type Locale struct {
+	Name             string `json:"name,omitempty"`
+	ShortDescription string `json:"short_description,omitempty"`
+	Description      string `json:"description,omitempty"`
+}
+
+// Localize replaces the name and the descriptions of the manifest by their
+// translations in the given locale, like fr or fr-FR. The translations of the
+// language are used when there are none for its region, and the texts of the
+// default locale are kept for the missing translations.
+//
+// It is used for the responses of the API, and the localized manifest must
+// not be saved.
+func (m *Manifest) Localize(locale string) {
+	if locale == "" || locale == m.DefaultLocale {
+		return
+	}
+	loc, ok := m.Locales[locale]
+	if !ok || loc == nil {
+		lang := strings.SplitN(strings.Replace(locale, "_", "-", 1), "-", 2)[0]
+		if lang == m.DefaultLocale {
+			return
+		}
+		if loc, ok = m.Locales[lang]; !ok || loc == nil {
+			return
+		}
+	}
+	if loc.Name != "" {
+		m.Name = loc.Name
+	}
+	if loc.ShortDescription != "" {
+		m.ShortDescription = loc.ShortDescription
+	}
+	if loc.Description != "" {
+		m.Description = loc.Description
+	}
+}
@@ -0,0 +1,82 @@
+package apps
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalize(t *testing.T) {
+	manifest := func() *Manifest {
+		man := &Manifest{}
+		err := json.Unmarshal([]byte(`{
+  "name": "Bank",
+  "short_description": "Your accounts",
+  "description": "All your bank accounts in your Cozy",
+  "default_locale": "en",
+  "locales": {
+    "fr": {
+      "name": "Banque",
+      "short_description": "Vos comptes"
+    },
+    "fr-CA": {
+      "name": "Banque (Québec)"
+    }
+  }
+}`), man)
+		assert.NoError(t, err)
+		return man
+	}
+
+	man := manifest()
+	man.Localize("fr")
+	assert.Equal(t, "Banque", man.Name)
+	assert.Equal(t, "Vos comptes", man.ShortDescription)
+	assert.Equal(t, "All your bank accounts in your Cozy", man.Description)
+
+	man = manifest()
+	man.Localize("fr-CA")
+	assert.Equal(t, "Banque (Québec)", man.Name)
+	assert.Equal(t, "Your accounts", man.ShortDescription)
+
+	man = manifest()
+	man.Localize("fr_FR")
+	assert.Equal(t, "Banque", man.Name)
+
+	man = manifest()
+	man.Localize("de")
+	assert.Equal(t, "Bank", man.Name)
+	assert.Equal(t, "Your accounts", man.ShortDescription)
+}
+
+func TestValidateLocales(t *testing.T) {
+	err := ValidateManifest([]byte(`{
+  "name": "bank",
+  "version": "1.0.0",
+  "permissions": {},
+  "locales": {
+    "fr": {"name": "banque", "short_description": "Vos comptes"}
+  }
+}`))
+	assert.NoError(t, err)
+
+	err = ValidateManifest([]byte(`{
+  "name": "bank",
+  "version": "1.0.0",
+  "permissions": {},
+  "locales": {
+    "de": "Bank",
+    "fr": {"name": 42}
+  }
+}`))
+	errs, ok := err.(ManifestErrors)
+	if !assert.True(t, ok, "ManifestErrors expected") {
+		return
+	}
+	fields := make([]string, len(errs))
+	for i, e := range errs {
+		fields[i] = e.Field
+	}
+	assert.Equal(t, []string{"/locales/de", "/locales/fr/name"}, fields)
+}
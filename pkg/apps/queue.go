@@ -0,0 +1,87 @@
+package apps
+
+import (
+	"sync"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+)
+
+// installQueue limits the number of installations and updates running at the
+// same time, for each instance and for the whole stack, since each of them
+// can use a lot of memory and file descriptors. The installers over the
+// limits wait for their turn in FIFO order.
+type installQueue struct {
+	mu      sync.Mutex
+	running int
+	byDB    map[string]int
+	waiting []*installTicket
+	// limits returns the global limit and the limit per instance
+	limits func() (int, int)
+}
+
+type installTicket struct {
+	prefix string
+	ready  chan struct{}
+}
+
+var installs = newInstallQueue(configInstallLimits)
+
+func newInstallQueue(limits func() (int, int)) *installQueue {
+	return &installQueue{
+		byDB:   make(map[string]int),
+		limits: limits,
+	}
+}
+
+func configInstallLimits() (int, int) {
+	conf := config.GetConfig()
+	if conf == nil {
+		return config.DefaultInstallsConcurrency, config.DefaultInstallsPerInstance
+	}
+	return conf.Installs.Concurrency, conf.Installs.PerInstance
+}
+
+// acquire waits until an installation can be run for the instance with the
+// given database prefix.
+func (q *installQueue) acquire(prefix string) {
+	t := &installTicket{prefix: prefix, ready: make(chan struct{})}
+	q.mu.Lock()
+	q.waiting = append(q.waiting, t)
+	q.dispatch()
+	q.mu.Unlock()
+	<-t.ready
+}
+
+// release must be called when an installation acquired for the instance with
+// the given database prefix has finished.
+func (q *installQueue) release(prefix string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.running--
+	if q.byDB[prefix]--; q.byDB[prefix] <= 0 {
+		delete(q.byDB, prefix)
+	}
+	q.dispatch()
+}
+
+// dispatch starts the waiting installations that are under the limits, in
+// FIFO order. An installation that waits for the other ones of its instance
+// does not block the ones of the other instances.
+func (q *installQueue) dispatch() {
+	global, perInstance := q.limits()
+	kept := q.waiting[:0]
+	for _, t := range q.waiting {
+		if (global > 0 && q.running >= global) ||
+			(perInstance > 0 && q.byDB[t.prefix] >= perInstance) {
+			kept = append(kept, t)
+			continue
+		}
+		q.running++
+		q.byDB[t.prefix]++
+		close(t.ready)
+	}
+	for i := len(kept); i < len(q.waiting); i++ {
+		q.waiting[i] = nil
+	}
+	q.waiting = kept
+}
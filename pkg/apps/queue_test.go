@@ -0,0 +1,60 @@
+package apps
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInstallQueue(t *testing.T) {
+	q := newInstallQueue(func() (int, int) { return 3, 2 })
+
+	started := make(chan string, 10)
+	run := func(prefix, name string) {
+		q.acquire(prefix)
+		started <- name
+	}
+
+	go run("alice/", "a1")
+	assert.Equal(t, "a1", <-started)
+	go run("alice/", "a2")
+	assert.Equal(t, "a2", <-started)
+
+	// The third installation of alice waits for the limit of the instance,
+	// but not the ones of bob
+	go run("alice/", "a3")
+	time.Sleep(10 * time.Millisecond)
+	go run("bob/", "b1")
+	assert.Equal(t, "b1", <-started)
+
+	// The global limit is reached
+	go run("bob/", "b2")
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case name := <-started:
+		t.Fatalf("%s should wait", name)
+	default:
+	}
+
+	// a3 was queued first
+	q.release("alice/")
+	assert.Equal(t, "a3", <-started)
+	q.release("bob/")
+	assert.Equal(t, "b2", <-started)
+
+	q.release("alice/")
+	q.release("alice/")
+	q.release("bob/")
+	assert.Equal(t, 0, q.running)
+	assert.Empty(t, q.byDB)
+	assert.Empty(t, q.waiting)
+}
+
+func TestInstallQueueNoLimit(t *testing.T) {
+	q := newInstallQueue(func() (int, int) { return 0, 0 })
+	for i := 0; i < 20; i++ {
+		q.acquire("alice/")
+	}
+	assert.Equal(t, 20, q.running)
+}
@@ -0,0 +1,76 @@
+package apps
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/realtime"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// RecoverInterrupted looks for the applications of an instance whose
+// installation or update was interrupted, by a crash or a restart of the
+// stack. Their manifests are put in the errored state, with the Retriable
+// flag, so that they can be installed or updated again. If resume is true,
+// their installations and updates are also started again in background.
+//
+// It is meant to be called when the stack starts: the applications in the
+// installing and upgrading states are expected to have a running installer
+// otherwise.
+func RecoverInterrupted(ctx vfs.Context, resume bool) ([]*Manifest, error) {
+	var recovered []*Manifest
+	for _, state := range []State{Installing, Upgrading} {
+		cursor := ""
+		for {
+			docs, next, err := ListPage(ctx, state, cursor, MaxListLimit)
+			if err != nil {
+				return recovered, err
+			}
+			for _, man := range docs {
+				man.State = Errored
+				man.Error = ErrInterrupted.Error()
+				man.Retriable = true
+				if err = couchdb.UpdateDoc(ctx, man); err != nil {
+					return recovered, err
+				}
+				publishManifest(ctx, realtime.EventUpdate, man)
+				recovered = append(recovered, man)
+				if resume {
+					resumeInstaller(ctx, man.Slug, state)
+				}
+			}
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+	}
+	return recovered, nil
+}
+
+// resumeInstaller starts again the installation or the update of an
+// application that was interrupted.
+func resumeInstaller(ctx vfs.Context, slug string, state State) {
+	inst, err := NewInstaller(ctx, &InstallerOptions{Slug: slug})
+	if err != nil {
+		log.Warnf("[apps] %s could not be resumed: %s", slug, err)
+		return
+	}
+	if state == Installing {
+		go inst.Install()
+	} else {
+		go inst.Update()
+	}
+	go func() {
+		for {
+			_, done, err := inst.Poll()
+			if err != nil {
+				log.Warnf("[apps] %s could not be resumed: %s", slug, err)
+				return
+			}
+			if done {
+				log.Infof("[apps] %s has been resumed", slug)
+				return
+			}
+		}
+	}()
+}
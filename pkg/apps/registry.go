@@ -0,0 +1,141 @@
+package apps
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// The channels of the registry. An application is installed from the stable
+// channel if no channel is given in its source.
+const (
+	StableChannel = "stable"
+	BetaChannel   = "beta"
+	DevChannel    = "dev"
+)
+
+// refReg is used to validate the channel or version of a registry source
+var refReg = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9.\-+_]*$`)
+
+var registryClient = &http.Client{
+	Timeout: 20 * time.Second,
+}
+
+// RegistryVersion is a version of an application published on the registry.
+// The files of the application are in a tarball, with the manifest at its
+// root.
+type RegistryVersion struct {
+	Slug    string `json:"slug"`
+	Version string `json:"version"`
+	URL     string `json:"url"`
+}
+
+// registryFetcher installs the applications with a `registry://slug` source.
+// The fragment of the URL can be a channel (like `registry://files#beta`),
+// or a version. The version is resolved on the registry, and its tarball is
+// then fetched like for a http source.
+type registryFetcher struct {
+	http    *httpFetcher
+	tarball *url.URL
+}
+
+func newRegistryFetcher(ctx vfs.Context) *registryFetcher {
+	return &registryFetcher{http: newHTTPFetcher(ctx)}
+}
+
+// IsChannel returns true if the given string is a channel of the registry
+func IsChannel(s string) bool {
+	return s == StableChannel || s == BetaChannel || s == DevChannel
+}
+
+// FetchRegistryVersion asks the registry for the version of an application
+// referenced by a registry source.
+func FetchRegistryVersion(src *url.URL) (*RegistryVersion, error) {
+	slug := src.Host
+	if slug == "" || !slugReg.MatchString(slug) {
+		return nil, ErrNotSupportedSource
+	}
+	base := config.RegistryURL()
+	if base == "" {
+		return nil, ErrSourceNotReachable
+	}
+
+	ref := src.Fragment
+	if ref == "" {
+		ref = StableChannel
+	}
+	if IsVersionTag(ref) {
+		ref = strings.TrimPrefix(ref, "v")
+	}
+	if !refReg.MatchString(ref) {
+		return nil, ErrNotSupportedSource
+	}
+	u := strings.TrimSuffix(base, "/") + "/" + slug + "/" + ref
+	if IsChannel(ref) {
+		u += "/latest"
+	}
+
+	res, err := registryClient.Get(u)
+	if err != nil {
+		return nil, ErrSourceNotReachable
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFoundInRegistry
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, ErrSourceNotReachable
+	}
+	v := &RegistryVersion{}
+	if err = json.NewDecoder(io.LimitReader(res.Body, ManifestMaxSize)).Decode(v); err != nil {
+		return nil, ErrSourceNotReachable
+	}
+	if v.URL == "" {
+		return nil, ErrSourceNotReachable
+	}
+	return v, nil
+}
+
+func (r *registryFetcher) resolve(src *url.URL) error {
+	v, err := FetchRegistryVersion(src)
+	if err != nil {
+		return err
+	}
+	log.Debugf("[registry] %s resolved to version %s", src.String(), v.Version)
+	tarball, err := url.Parse(v.URL)
+	if err != nil || (tarball.Scheme != "http" && tarball.Scheme != "https") {
+		return ErrSourceNotReachable
+	}
+	r.tarball = tarball
+	return nil
+}
+
+// FetchManifest resolves the version of the application on the registry and
+// extracts the manifest from its tarball.
+func (r *registryFetcher) FetchManifest(src *url.URL) (io.ReadCloser, error) {
+	if err := r.resolve(src); err != nil {
+		return nil, err
+	}
+	return r.http.FetchManifest(r.tarball)
+}
+
+// Fetch installs the files from the tarball of the version resolved by
+// FetchManifest.
+func (r *registryFetcher) Fetch(src *url.URL, appdir string, progress ProgressFunc) error {
+	if r.tarball == nil {
+		if err := r.resolve(src); err != nil {
+			return err
+		}
+	}
+	return r.http.Fetch(r.tarball, appdir, progress)
+}
+
+var _ Fetcher = &registryFetcher{}
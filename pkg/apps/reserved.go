@@ -0,0 +1,124 @@
+package apps
+
+import (
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// ReservedSlugs are the slugs that can't be used for an application, as they
+// are the names of the routes of the stack or of usual subdomains. The slugs
+// of the official applications, like files or settings, are not reserved.
+var ReservedSlugs = []string{
+	"admin",
+	"api",
+	"apps",
+	"assets",
+	"auth",
+	"data",
+	"feeds",
+	"instances",
+	"intents",
+	"jobs",
+	"mail",
+	"permissions",
+	"registry",
+	"sharings",
+	"status",
+	"timeline",
+	"update",
+	"version",
+	"www",
+}
+
+// IsReservedSlug returns true if the slug can't be used for an application
+func IsReservedSlug(slug string) bool {
+	slug = strings.ToLower(slug)
+	for _, reserved := range ReservedSlugs {
+		if slug == reserved {
+			return true
+		}
+	}
+	return false
+}
+
+// ReservedDoctypes are the doctypes used by the stack. Their databases can't
+// be listed in the databases of a manifest, as they are not owned by an
+// application and must not be destroyed when it is uninstalled.
+var ReservedDoctypes = []string{
+	consts.Accounts,
+	consts.Apps,
+	consts.AppsUsage,
+	consts.AppsVersions,
+	consts.Archives,
+	consts.BankOperations,
+	consts.Bills,
+	consts.Contacts,
+	consts.Doctypes,
+	consts.Emails,
+	consts.EmailsFolders,
+	consts.Events,
+	consts.EventsSchedulings,
+	consts.Files,
+	consts.Instances,
+	consts.Jobs,
+	consts.OAuthAccessCodes,
+	consts.OAuthClients,
+	consts.Permissions,
+	consts.Queues,
+	consts.Recipients,
+	consts.Sessions,
+	consts.Settings,
+	consts.Sharings,
+	consts.Triggers,
+}
+
+// IsReservedDoctype returns true if the doctype is used by the stack
+func IsReservedDoctype(doctype string) bool {
+	for _, reserved := range ReservedDoctypes {
+		if doctype == reserved {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckSlug returns an error if a new application can't be installed with the
+// given slug on this instance: the slug is reserved, or the subdomain of the
+// application would be the domain of another instance (and the application
+// would shadow it).
+func CheckSlug(ctx vfs.Context, slug string) error {
+	if IsReservedSlug(slug) {
+		return ErrReservedSlug
+	}
+	sd, ok := ctx.(SubDomainer)
+	if !ok {
+		return nil
+	}
+	exists, err := instanceExists(strings.ToLower(sd.SubDomain(slug).Host))
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrSlugCollision
+	}
+	return nil
+}
+
+func instanceExists(domain string) (bool, error) {
+	var docs []struct {
+		Domain string `json:"domain"`
+	}
+	req := &couchdb.FindRequest{
+		Selector: mango.Equal("domain", domain),
+		Limit:    1,
+	}
+	err := couchdb.FindDocs(couchdb.GlobalDB, consts.Instances, req, &docs)
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return false, err
+	}
+	return len(docs) > 0, nil
+}
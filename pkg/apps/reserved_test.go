@@ -0,0 +1,25 @@
+package apps
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReservedSlugs(t *testing.T) {
+	assert.True(t, IsReservedSlug("auth"))
+	assert.True(t, IsReservedSlug("Admin"))
+	assert.False(t, IsReservedSlug("files"))
+	assert.False(t, IsReservedSlug("authenticator"))
+
+	inst, err := NewInstaller(c, &InstallerOptions{
+		Slug:      "auth",
+		SourceURL: "git://localhost/",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	go inst.Install()
+	_, _, err = inst.Poll()
+	assert.Equal(t, ErrReservedSlug, err)
+}
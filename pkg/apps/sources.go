@@ -0,0 +1,80 @@
+package apps
+
+import (
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+)
+
+func configAllowedSources() []string {
+	conf := config.GetConfig()
+	if conf == nil {
+		return nil
+	}
+	return conf.Installs.AllowedSources
+}
+
+// unsignedAppsAllower is implemented by the instances that accept the
+// applications from any source, for development.
+type unsignedAppsAllower interface {
+	AllowUnsignedApps() bool
+}
+
+// allowsUnsignedApps returns true if the context accepts the applications
+// that are not from an allowed source.
+func allowsUnsignedApps(ctx interface{}) bool {
+	a, ok := ctx.(unsignedAppsAllower)
+	return ok && a.AllowUnsignedApps()
+}
+
+// isAllowedSource returns true if the given source matches one of the
+// patterns, or if there is no pattern. The credentials, query and fragment of
+// the source are ignored, the scheme and host are compared in lowercase, and
+// the path is cleaned. A source with a .. in its path is refused, and a
+// trailing * in a pattern matches only whole segments of the path.
+func isAllowedSource(src *url.URL, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, segment := range strings.Split(src.Path, "/") {
+		if segment == ".." {
+			return false
+		}
+	}
+	s := strings.ToLower(src.Scheme) + "://" + strings.ToLower(src.Host)
+	if src.Path != "" {
+		s += path.Clean("/" + src.Path)
+	}
+	for _, pattern := range patterns {
+		pattern = normalizePattern(pattern)
+		if strings.HasSuffix(pattern, "*") {
+			prefix := strings.TrimSuffix(pattern, "*")
+			if strings.HasSuffix(prefix, "/") {
+				if strings.HasPrefix(s, prefix) {
+					return true
+				}
+			} else if s == prefix || strings.HasPrefix(s, prefix+"/") {
+				return true
+			}
+		} else if s == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizePattern puts the scheme and the host of a pattern in lowercase, so
+// that it can be compared to a normalized source.
+func normalizePattern(pattern string) string {
+	parts := strings.SplitN(pattern, "://", 2)
+	if len(parts) != 2 {
+		return pattern
+	}
+	host, rest := parts[1], ""
+	if idx := strings.Index(host, "/"); idx >= 0 {
+		host, rest = host[:idx], host[idx:]
+	}
+	return strings.ToLower(parts[0]) + "://" + strings.ToLower(host) + rest
+}
@@ -0,0 +1,253 @@
+package apps
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+)
+
+const (
+	// UnusedDays is the number of days without being opened nor making API
+	// calls after which an application is suggested for uninstallation.
+	UnusedDays = 30
+
+	dayFormat          = "2006-01-02"
+	usageFlushInterval = time.Minute
+	usageMaxDocs       = 10000
+)
+
+// Usage is the usage of an application for a day: the number of times it has
+// been opened, and the number of API calls made with its token. It is only
+// kept locally, in the database of the instance.
+type Usage struct {
+	DocID  string `json:"_id,omitempty"`
+	DocRev string `json:"_rev,omitempty"`
+	Slug   string `json:"slug"`
+	Day    string `json:"day"`
+	Opens  int    `json:"opens"`
+	Calls  int    `json:"calls"`
+}
+
+// ID is used to implement the couchdb.Doc interface
+func (u *Usage) ID() string { return u.DocID }
+
+// Rev is used to implement the couchdb.Doc interface
+func (u *Usage) Rev() string { return u.DocRev }
+
+// DocType is used to implement the couchdb.Doc interface
+func (u *Usage) DocType() string { return consts.AppsUsage }
+
+// SetID is used to implement the couchdb.Doc interface
+func (u *Usage) SetID(id string) { u.DocID = id }
+
+// SetRev is used to implement the couchdb.Doc interface
+func (u *Usage) SetRev(rev string) { u.DocRev = rev }
+
+type usageKey struct {
+	prefix string
+	slug   string
+	day    string
+}
+
+type usageCounter struct {
+	db    couchdb.Database
+	opens int
+	calls int
+}
+
+// The usages are counted in memory, and regularly flushed to CouchDB, to
+// avoid writing a document for each request.
+var (
+	usageMu       sync.Mutex
+	usageCounters = make(map[usageKey]*usageCounter)
+	usageFlusher  sync.Once
+)
+
+// RecordOpen increments the number of times the application has been opened
+// today.
+func RecordOpen(db couchdb.Database, slug string) {
+	record(db, slug, 1, 0)
+}
+
+// RecordCall increments the number of API calls made today by the
+// application.
+func RecordCall(db couchdb.Database, slug string) {
+	record(db, slug, 0, 1)
+}
+
+func record(db couchdb.Database, slug string, opens, calls int) {
+	usageFlusher.Do(func() {
+		go func() {
+			for range time.Tick(usageFlushInterval) {
+				FlushUsages()
+			}
+		}()
+	})
+	key := usageKey{
+		prefix: db.Prefix(),
+		slug:   slug,
+		day:    time.Now().UTC().Format(dayFormat),
+	}
+	usageMu.Lock()
+	defer usageMu.Unlock()
+	counter, ok := usageCounters[key]
+	if !ok {
+		counter = &usageCounter{db: db}
+		usageCounters[key] = counter
+	}
+	counter.opens += opens
+	counter.calls += calls
+}
+
+// FlushUsages saves in CouchDB the usages counted in memory.
+func FlushUsages() {
+	usageMu.Lock()
+	counters := usageCounters
+	usageCounters = make(map[usageKey]*usageCounter)
+	usageMu.Unlock()
+
+	for key, counter := range counters {
+		err := saveUsage(counter.db, key.slug, key.day, counter.opens, counter.calls)
+		if err != nil {
+			log.Warnf("[apps] Could not save the usage of %s for %s: %s",
+				key.slug, key.prefix, err)
+		}
+	}
+}
+
+func saveUsage(db couchdb.Database, slug, day string, opens, calls int) error {
+	id := slug + "/" + day
+	var err error
+	// Several stacks can save the usage of the same day: retry on conflicts
+	for try := 0; try < 3; try++ {
+		u := &Usage{}
+		err = couchdb.GetDoc(db, consts.AppsUsage, id, u)
+		if err == nil {
+			u.Opens += opens
+			u.Calls += calls
+			err = couchdb.UpdateDoc(db, u)
+		} else if couchdb.IsNotFoundError(err) {
+			u = &Usage{DocID: id, Slug: slug, Day: day, Opens: opens, Calls: calls}
+			err = couchdb.CreateNamedDocWithDB(db, u)
+		}
+		if !couchdb.IsConflictError(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// DayUsage is the usage of an application for a day, as returned by
+// GetUsages.
+type DayUsage struct {
+	Day   string `json:"day"`
+	Opens int    `json:"opens"`
+	Calls int    `json:"calls"`
+}
+
+// AppUsage is the usage of an installed application for the last days.
+type AppUsage struct {
+	Slug     string      `json:"slug"`
+	Opens    int         `json:"opens"`
+	Calls    int         `json:"calls"`
+	LastUsed string      `json:"last_used,omitempty"`
+	Days     []*DayUsage `json:"days"`
+	// SuggestUninstall is true if the application has not been used for
+	// UnusedDays days.
+	SuggestUninstall bool `json:"suggest_uninstall"`
+}
+
+// GetUsages returns the usage of the installed applications for the given
+// number of days, including today.
+func GetUsages(db couchdb.Database, days int) ([]*AppUsage, error) {
+	FlushUsages()
+
+	mans, err := List(db)
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	from := now.AddDate(0, 0, 1-days).Format(dayFormat)
+	unusedSince := now.AddDate(0, 0, -UnusedDays).Format(dayFormat)
+	since := from
+	if unusedSince < since {
+		since = unusedSince
+	}
+	var usages []*Usage
+	err = findUsages(db, map[string]interface{}{
+		"selector": mango.Gte("day", since),
+		"limit":    usageMaxDocs,
+	}, &usages)
+	if err != nil {
+		return nil, err
+	}
+
+	// The usage is only recorded since this feature has been deployed: the
+	// applications can't be said to be unused before UnusedDays days of
+	// records.
+	var first []*Usage
+	err = findUsages(db, map[string]interface{}{
+		"selector": mango.Gt("day", nil),
+		"sort":     []map[string]string{{"day": "asc"}},
+		"limit":    1,
+	}, &first)
+	if err != nil {
+		return nil, err
+	}
+	recorded := len(first) > 0 && first[0].Day <= unusedSince
+
+	bySlug := make(map[string]*AppUsage, len(mans))
+	list := make([]*AppUsage, 0, len(mans))
+	for _, man := range mans {
+		au := &AppUsage{Slug: man.Slug, Days: []*DayUsage{}}
+		bySlug[man.Slug] = au
+		list = append(list, au)
+	}
+	lastUsed := make(map[string]string)
+	for _, u := range usages {
+		au, ok := bySlug[u.Slug]
+		if !ok {
+			continue
+		}
+		if u.Day > lastUsed[u.Slug] {
+			lastUsed[u.Slug] = u.Day
+		}
+		if u.Day < from {
+			continue
+		}
+		au.Opens += u.Opens
+		au.Calls += u.Calls
+		au.Days = append(au.Days, &DayUsage{Day: u.Day, Opens: u.Opens, Calls: u.Calls})
+	}
+	for _, man := range mans {
+		au := bySlug[man.Slug]
+		au.LastUsed = lastUsed[man.Slug]
+		au.SuggestUninstall = recorded && au.LastUsed == "" && installedBefore(man, unusedSince)
+		sort.Sort(usagesByDay(au.Days))
+	}
+	return list, nil
+}
+
+func installedBefore(man *Manifest, day string) bool {
+	if man.InstalledAt == nil {
+		return true
+	}
+	return man.InstalledAt.UTC().Format(dayFormat) <= day
+}
+
+func findUsages(db couchdb.Database, req map[string]interface{}, results interface{}) error {
+	index := mango.IndexOnFields(consts.AppsUsage, "day")
+	return findDocs(db, index, req, results)
+}
+
+type usagesByDay []*DayUsage
+
+func (s usagesByDay) Len() int           { return len(s) }
+func (s usagesByDay) Less(i, j int) bool { return s[i].Day < s[j].Day }
+func (s usagesByDay) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,61 @@
+package apps
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAppsUsage(t *testing.T) {
+	assert.NoError(t, couchdb.ResetDB(c, consts.AppsUsage))
+	for _, slug := range []string{"usage-used", "usage-unused"} {
+		err := createManifest(c, &Manifest{
+			Slug:        slug,
+			State:       Ready,
+			Permissions: &permissions.Set{},
+		})
+		if !assert.NoError(t, err) {
+			return
+		}
+	}
+
+	RecordOpen(c, "usage-used")
+	RecordOpen(c, "usage-used")
+	RecordCall(c, "usage-used")
+	FlushUsages()
+	RecordCall(c, "usage-used")
+
+	// An old usage, to have enough days of records to suggest uninstalls
+	old := time.Now().UTC().AddDate(0, 0, -2*UnusedDays).Format(dayFormat)
+	err := saveUsage(c, "usage-old", old, 1, 0)
+	assert.NoError(t, err)
+
+	usages, err := GetUsages(c, 7)
+	if !assert.NoError(t, err) {
+		return
+	}
+	bySlug := make(map[string]*AppUsage)
+	for _, u := range usages {
+		bySlug[u.Slug] = u
+	}
+
+	used := bySlug["usage-used"]
+	if assert.NotNil(t, used) {
+		assert.Equal(t, 2, used.Opens)
+		assert.Equal(t, 2, used.Calls)
+		assert.Len(t, used.Days, 1)
+		assert.Equal(t, time.Now().UTC().Format(dayFormat), used.LastUsed)
+		assert.False(t, used.SuggestUninstall)
+	}
+	unused := bySlug["usage-unused"]
+	if assert.NotNil(t, unused) {
+		assert.Equal(t, 0, unused.Opens)
+		assert.Len(t, unused.Days, 0)
+		assert.True(t, unused.SuggestUninstall)
+	}
+	assert.Nil(t, bySlug["usage-old"])
+}
@@ -0,0 +1,380 @@
+package apps
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/permissions"
+)
+
+// semverReg is used to check that the version of an application follows the
+// semantic versioning (http://semver.org/)
+var semverReg = regexp.MustCompile(`^(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)(-[0-9A-Za-z\-]+(\.[0-9A-Za-z\-]+)*)?(\+[0-9A-Za-z\-]+(\.[0-9A-Za-z\-]+)*)?$`)
+
+// validVerbs are the verbs accepted in the permissions of a manifest
+var validVerbs = map[string]bool{
+	"GET":    true,
+	"POST":   true,
+	"PUT":    true,
+	"PATCH":  true,
+	"DELETE": true,
+	"ALL":    true,
+}
+
+// validVerb returns true for a verb of a manifest, or for an excluded verb,
+// like -DELETE.
+func validVerb(verb string) bool {
+	if strings.HasPrefix(verb, "-") {
+		verb = strings.TrimPrefix(verb, "-")
+		return verb != "ALL" && validVerbs[verb]
+	}
+	return validVerbs[verb]
+}
+
+// ManifestError is a violation of the schema of the manifest.
+type ManifestError struct {
+	// Field is the path of the invalid field in the manifest, like a JSON
+	// pointer (for example /permissions/contacts/verbs)
+	Field   string
+	Message string
+}
+
+func (e *ManifestError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// ManifestErrors is the list of the violations of the schema of a manifest.
+type ManifestErrors []*ManifestError
+
+func (errs ManifestErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = e.Error()
+	}
+	return "Invalid manifest: " + strings.Join(msgs, ", ")
+}
+
+type manifestValidator struct {
+	errs ManifestErrors
+}
+
+func (v *manifestValidator) add(field, format string, args ...interface{}) {
+	v.errs = append(v.errs, &ManifestError{
+		Field:   field,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// ValidateManifest checks the content of a manifest.webapp against its
+// schema. It returns ErrBadManifest if it is not a valid JSON object, or the
+// list of all the violations as ManifestErrors.
+func ValidateManifest(raw []byte) error {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil || doc == nil {
+		return ErrBadManifest
+	}
+	v := &manifestValidator{}
+
+	v.requiredString(doc, "name")
+	if v.requiredString(doc, "version") {
+		if version := doc["version"].(string); !semverReg.MatchString(version) {
+			v.add("/version", "%q is not a semantic version (like 1.2.3)", version)
+		}
+	}
+	if v.optionalString(doc, "slug") {
+		if slug := doc["slug"].(string); !slugReg.MatchString(slug) {
+			v.add("/slug", "%q can only contain letters, digits and dashes", slug)
+		}
+	}
+	for _, key := range []string{"icon", "short_description", "description", "license", "default_locale"} {
+		v.optionalString(doc, key)
+	}
+	if dev, ok := doc["developer"]; ok {
+		if m, ok := dev.(map[string]interface{}); ok {
+			v.requiredString(m, "developer", "name")
+			v.optionalString(m, "developer", "url")
+		} else {
+			v.add("/developer", "must be an object")
+		}
+	}
+
+	if perms, ok := doc["permissions"]; !ok {
+		v.add("/permissions", "is required")
+	} else {
+		v.permissions(perms)
+	}
+	if routes, ok := doc["routes"]; ok {
+		v.routes(routes)
+	}
+	if dbs, ok := doc["databases"]; ok {
+		v.databases(dbs, doc["permissions"])
+	}
+	if intents, ok := doc["intents"]; ok {
+		v.intents(intents)
+	}
+	if hooks, ok := doc["hooks"]; ok {
+		v.hooks(hooks)
+	}
+	if locales, ok := doc["locales"]; ok {
+		v.locales(locales)
+	}
+
+	if len(v.errs) > 0 {
+		return v.errs
+	}
+	return nil
+}
+
+func pointer(keys ...string) string {
+	escaped := make([]string, len(keys))
+	for i, key := range keys {
+		key = strings.Replace(key, "~", "~0", -1)
+		escaped[i] = strings.Replace(key, "/", "~1", -1)
+	}
+	return "/" + strings.Join(escaped, "/")
+}
+
+// requiredString checks that the last key is a non-empty string in m. The
+// other keys are the path of m in the manifest.
+func (v *manifestValidator) requiredString(m map[string]interface{}, keys ...string) bool {
+	key := keys[len(keys)-1]
+	if _, ok := m[key]; !ok {
+		v.add(pointer(keys...), "is required")
+		return false
+	}
+	if !v.optionalString(m, keys...) {
+		return false
+	}
+	if m[key].(string) == "" {
+		v.add(pointer(keys...), "must not be empty")
+		return false
+	}
+	return true
+}
+
+// optionalString checks that the last key, if present, is a string in m.
+func (v *manifestValidator) optionalString(m map[string]interface{}, keys ...string) bool {
+	val, ok := m[keys[len(keys)-1]]
+	if !ok {
+		return false
+	}
+	if _, ok = val.(string); !ok {
+		v.add(pointer(keys...), "must be a string")
+		return false
+	}
+	return true
+}
+
+func (v *manifestValidator) permissions(perms interface{}) {
+	m, ok := perms.(map[string]interface{})
+	if !ok {
+		v.add("/permissions", "must be an object")
+		return
+	}
+	for _, title := range sortedKeys(m) {
+		rule, ok := m[title].(map[string]interface{})
+		if !ok {
+			v.add(pointer("permissions", title), "must be an object")
+			continue
+		}
+		if v.requiredString(rule, "permissions", title, "type") {
+			if err := permissions.ValidateType(rule["type"].(string)); err != nil {
+				v.add(pointer("permissions", title, "type"), "%s", err)
+			}
+		}
+		v.optionalString(rule, "permissions", title, "description")
+		v.optionalString(rule, "permissions", title, "selector")
+		if verbs, ok := rule["verbs"]; ok {
+			field := pointer("permissions", title, "verbs")
+			list, ok := verbs.([]interface{})
+			if !ok {
+				v.add(field, "must be an array of verbs")
+			}
+			for _, verb := range list {
+				if s, ok := verb.(string); !ok || !validVerb(s) {
+					v.add(field, "%v is not a valid verb (GET, POST, PUT, PATCH, DELETE or ALL, or an exclusion like -DELETE)", verb)
+				}
+			}
+		}
+		if values, ok := rule["values"]; ok {
+			field := pointer("permissions", title, "values")
+			list, ok := values.([]interface{})
+			if !ok {
+				v.add(field, "must be an array of strings")
+			}
+			for _, value := range list {
+				if _, ok := value.(string); !ok {
+					v.add(field, "%v is not a string", value)
+				}
+			}
+		}
+		if _, ok := rule["selector"]; ok {
+			if _, ok := rule["values"]; !ok {
+				v.add(pointer("permissions", title, "values"), "is required with a selector")
+			}
+		}
+	}
+}
+
+func (v *manifestValidator) routes(routes interface{}) {
+	m, ok := routes.(map[string]interface{})
+	if !ok {
+		v.add("/routes", "must be an object")
+		return
+	}
+	for _, route := range sortedKeys(m) {
+		if !strings.HasPrefix(route, "/") {
+			v.add(pointer("routes", route), "the route must start with a /")
+		}
+		r, ok := m[route].(map[string]interface{})
+		if !ok {
+			v.add(pointer("routes", route), "must be an object")
+			continue
+		}
+		v.requiredString(r, "routes", route, "folder")
+		v.optionalString(r, "routes", route, "index")
+		if public, ok := r["public"]; ok {
+			if _, ok = public.(bool); !ok {
+				v.add(pointer("routes", route, "public"), "must be a boolean")
+			}
+		}
+	}
+}
+
+// databases checks that the doctypes owned by the application are not used by
+// the stack, and that the application has a permission on them.
+func (v *manifestValidator) databases(dbs, perms interface{}) {
+	list, ok := dbs.([]interface{})
+	if !ok {
+		v.add("/databases", "must be an array of doctypes")
+		return
+	}
+	var types []string
+	if m, ok := perms.(map[string]interface{}); ok {
+		for _, p := range m {
+			if rule, ok := p.(map[string]interface{}); ok {
+				if t, ok := rule["type"].(string); ok {
+					types = append(types, t)
+				}
+			}
+		}
+	}
+	for _, db := range list {
+		doctype, ok := db.(string)
+		switch {
+		case !ok:
+			v.add("/databases", "%v is not a string", db)
+		case IsReservedDoctype(doctype):
+			v.add("/databases", "%s is a doctype of the stack", doctype)
+		case !matchAnyDoctype(types, doctype):
+			v.add("/databases", "%s is not in the permissions", doctype)
+		}
+	}
+}
+
+// intents checks that each intent has an action, a list of doctypes and the
+// route of the application that handles it.
+func (v *manifestValidator) intents(intents interface{}) {
+	list, ok := intents.([]interface{})
+	if !ok {
+		v.add("/intents", "must be an array of intents")
+		return
+	}
+	for i, item := range list {
+		index := strconv.Itoa(i)
+		intent, ok := item.(map[string]interface{})
+		if !ok {
+			v.add(pointer("intents", index), "must be an object")
+			continue
+		}
+		v.requiredString(intent, "intents", index, "action")
+		if v.requiredString(intent, "intents", index, "href") {
+			if href := intent["href"].(string); !strings.HasPrefix(href, "/") {
+				v.add(pointer("intents", index, "href"), "the route must start with a /")
+			}
+		}
+		field := pointer("intents", index, "type")
+		types, ok := intent["type"].([]interface{})
+		if !ok || len(types) == 0 {
+			v.add(field, "must be a non-empty array of doctypes")
+			continue
+		}
+		for _, t := range types {
+			if s, ok := t.(string); !ok || s == "" {
+				v.add(field, "%v is not a doctype", t)
+			}
+		}
+	}
+}
+
+// hooks checks that the hooks are lists of jobs, with the worker that will
+// run them.
+func (v *manifestValidator) hooks(hooks interface{}) {
+	m, ok := hooks.(map[string]interface{})
+	if !ok {
+		v.add("/hooks", "must be an object")
+		return
+	}
+	for _, name := range sortedKeys(m) {
+		if name != "post_install" && name != "post_update" {
+			v.add(pointer("hooks", name), "is not a hook (post_install or post_update)")
+			continue
+		}
+		list, ok := m[name].([]interface{})
+		if !ok {
+			v.add(pointer("hooks", name), "must be an array of jobs")
+			continue
+		}
+		for i, item := range list {
+			index := strconv.Itoa(i)
+			job, ok := item.(map[string]interface{})
+			if !ok {
+				v.add(pointer("hooks", name, index), "must be an object")
+				continue
+			}
+			v.requiredString(job, "hooks", name, index, "worker")
+		}
+	}
+}
+
+func (v *manifestValidator) locales(locales interface{}) {
+	m, ok := locales.(map[string]interface{})
+	if !ok {
+		v.add("/locales", "must be an object")
+		return
+	}
+	for _, locale := range sortedKeys(m) {
+		texts, ok := m[locale].(map[string]interface{})
+		if !ok {
+			v.add(pointer("locales", locale), "must be an object")
+			continue
+		}
+		for _, key := range []string{"name", "short_description", "description"} {
+			v.optionalString(texts, "locales", locale, key)
+		}
+	}
+}
+
+// matchAnyDoctype returns true if one of the types of the permissions, that
+// can be wildcards, matches the doctype.
+func matchAnyDoctype(types []string, doctype string) bool {
+	for _, t := range types {
+		if permissions.MatchDoctype(t, doctype) {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,203 @@
+package apps
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateManifest(t *testing.T) {
+	err := ValidateManifest([]byte(manifest()))
+	assert.NoError(t, err)
+
+	err = ValidateManifest([]byte(`not json`))
+	assert.Equal(t, ErrBadManifest, err)
+	err = ValidateManifest([]byte(`["an", "array"]`))
+	assert.Equal(t, ErrBadManifest, err)
+
+	err = ValidateManifest([]byte(`{
+  "name": "",
+  "slug": "not a slug",
+  "version": "1.0",
+  "developer": {"url": "https://cozy.io/"},
+  "permissions": {
+    "contacts": {"type": "io.cozy.contacts", "verbs": ["GET", "FETCH"]},
+    "files": {"verbs": "GET", "selector": "dir_id"},
+    "bad": true
+  },
+  "routes": {
+    "admin": {"folder": "/", "public": "yes"},
+    "/": {"index": "index.html"}
+  }
+}`))
+	errs, ok := err.(ManifestErrors)
+	if !assert.True(t, ok, "ManifestErrors expected") {
+		return
+	}
+	fields := make([]string, len(errs))
+	for i, e := range errs {
+		fields[i] = e.Field
+	}
+	assert.Equal(t, []string{
+		"/name",
+		"/version",
+		"/slug",
+		"/developer/name",
+		"/permissions/bad",
+		"/permissions/contacts/verbs",
+		"/permissions/files/type",
+		"/permissions/files/verbs",
+		"/permissions/files/values",
+		"/routes/~1/folder",
+		"/routes/admin",
+		"/routes/admin/public",
+	}, fields)
+	assert.Contains(t, err.Error(), "FETCH is not a valid verb")
+
+	assert.True(t, validVerb("ALL"))
+	assert.True(t, validVerb("-DELETE"))
+	assert.False(t, validVerb("-ALL"))
+	assert.False(t, validVerb("-FETCH"))
+
+	err = ValidateManifest([]byte(`{"name": "mini", "version": "1.2.3-beta.1"}`))
+	errs, ok = err.(ManifestErrors)
+	if assert.True(t, ok) && assert.Len(t, errs, 1) {
+		assert.Equal(t, "/permissions", errs[0].Field)
+	}
+}
+
+func TestValidateDatabases(t *testing.T) {
+	err := ValidateManifest([]byte(`{
+  "name": "todos",
+  "version": "1.0.0",
+  "permissions": {
+    "todos": {"type": "io.cozy.todos"},
+    "files": {"type": "io.cozy.files"}
+  },
+  "databases": ["io.cozy.todos"]
+}`))
+	assert.NoError(t, err)
+
+	err = ValidateManifest([]byte(`{
+  "name": "todos",
+  "version": "1.0.0",
+  "permissions": {
+    "files": {"type": "io.cozy.files"}
+  },
+  "databases": ["io.cozy.files", "io.cozy.todos", 42]
+}`))
+	errs, ok := err.(ManifestErrors)
+	if assert.True(t, ok) && assert.Len(t, errs, 3) {
+		assert.Equal(t, "/databases", errs[0].Field)
+		assert.Contains(t, errs[0].Message, "doctype of the stack")
+		assert.Contains(t, errs[1].Message, "not in the permissions")
+		assert.Contains(t, errs[2].Message, "not a string")
+	}
+}
+
+func TestValidateWildcardType(t *testing.T) {
+	err := ValidateManifest([]byte(`{
+  "name": "bank",
+  "version": "1.0.0",
+  "permissions": {
+    "bank": {"type": "io.cozy.bank.*"}
+  },
+  "databases": ["io.cozy.bank.accounts"]
+}`))
+	assert.NoError(t, err)
+
+	err = ValidateManifest([]byte(`{
+  "name": "bank",
+  "version": "1.0.0",
+  "permissions": {
+    "all": {"type": "io.cozy.*"}
+  }
+}`))
+	errs, ok := err.(ManifestErrors)
+	if assert.True(t, ok) && assert.Len(t, errs, 1) {
+		assert.Equal(t, "/permissions/all/type", errs[0].Field)
+		assert.Contains(t, errs[0].Message, "too broad")
+	}
+}
+
+func TestValidateIntents(t *testing.T) {
+	err := ValidateManifest([]byte(`{
+  "name": "files",
+  "version": "1.0.0",
+  "permissions": {},
+  "intents": [
+    {"action": "PICK", "type": ["io.cozy.files"], "href": "/pick"}
+  ]
+}`))
+	assert.NoError(t, err)
+
+	err = ValidateManifest([]byte(`{
+  "name": "files",
+  "version": "1.0.0",
+  "permissions": {},
+  "intents": [
+    {"action": "PICK", "type": [], "href": "/pick"},
+    {"type": ["io.cozy.files", 42], "href": "pick"},
+    "EDIT"
+  ]
+}`))
+	errs, ok := err.(ManifestErrors)
+	if !assert.True(t, ok, "ManifestErrors expected") {
+		return
+	}
+	fields := make([]string, len(errs))
+	for i, e := range errs {
+		fields[i] = e.Field
+	}
+	assert.Equal(t, []string{
+		"/intents/0/type",
+		"/intents/1/action",
+		"/intents/1/href",
+		"/intents/1/type",
+		"/intents/2",
+	}, fields)
+
+	err = ValidateManifest([]byte(`{"name": "files", "version": "1.0.0", "permissions": {}, "intents": {}}`))
+	errs, ok = err.(ManifestErrors)
+	if assert.True(t, ok) && assert.Len(t, errs, 1) {
+		assert.Equal(t, "/intents", errs[0].Field)
+	}
+}
+
+func TestValidateHooks(t *testing.T) {
+	err := ValidateManifest([]byte(`{
+  "name": "todo",
+  "version": "1.0.0",
+  "permissions": {},
+  "hooks": {
+    "post_install": [{"worker": "log", "arguments": {"message": "installed"}}],
+    "post_update": []
+  }
+}`))
+	assert.NoError(t, err)
+
+	err = ValidateManifest([]byte(`{
+  "name": "todo",
+  "version": "1.0.0",
+  "permissions": {},
+  "hooks": {
+    "post_install": [{"arguments": {}}, "log"],
+    "post_update": {"worker": "log"},
+    "pre_install": []
+  }
+}`))
+	errs, ok := err.(ManifestErrors)
+	if !assert.True(t, ok, "ManifestErrors expected") {
+		return
+	}
+	fields := make([]string, len(errs))
+	for i, e := range errs {
+		fields[i] = e.Field
+	}
+	assert.Equal(t, []string{
+		"/hooks/post_install/0/worker",
+		"/hooks/post_install/1",
+		"/hooks/post_update",
+		"/hooks/pre_install",
+	}, fields)
+}
@@ -0,0 +1,203 @@
+package apps
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// versionTagReg matches the fragments of the sources that pin an application
+// to a version, like `git://github.com/cozy/cozy-emails#v1.2.3`.
+var versionTagReg = regexp.MustCompile(`^v[0-9]+(\.[0-9]+)*([\-+][0-9A-Za-z.\-]+)?$`)
+
+// maxVersions is the maximal number of versions kept for an application
+const maxVersions = 10
+
+// Version is a version of an application that has been installed. It keeps
+// the manifest, a hash of the files, and a source pinned to this version, to
+// be able to come back to it with a rollback.
+type Version struct {
+	DocID       string          `json:"_id,omitempty"`
+	DocRev      string          `json:"_rev,omitempty"`
+	Slug        string          `json:"slug"`
+	Version     string          `json:"version"`
+	Source      string          `json:"source"`
+	Hash        string          `json:"hash"`
+	Manifest    json.RawMessage `json:"manifest"`
+	InstalledAt time.Time       `json:"installed_at"`
+}
+
+// ID is used to implement the couchdb.Doc interface
+func (v *Version) ID() string { return v.DocID }
+
+// Rev is used to implement the couchdb.Doc interface
+func (v *Version) Rev() string { return v.DocRev }
+
+// DocType is used to implement the couchdb.Doc interface
+func (v *Version) DocType() string { return consts.AppsVersions }
+
+// SetID is used to implement the couchdb.Doc interface
+func (v *Version) SetID(id string) { v.DocID = id }
+
+// SetRev is used to implement the couchdb.Doc interface
+func (v *Version) SetRev(rev string) { v.DocRev = rev }
+
+// IsVersionTag returns true if the fragment of a source pins it to a version
+func IsVersionTag(fragment string) bool {
+	return versionTagReg.MatchString(fragment)
+}
+
+// pinSource returns the source to use for installing again the given version
+// of an application.
+func pinSource(src *url.URL, version string) string {
+	pinned, _ := url.Parse(src.String())
+	switch pinned.Scheme {
+	case "http", "https":
+		// The tarball is already the content of a version
+		return pinned.String()
+	case DevScheme:
+		// A development server has no versions
+		return pinned.String()
+	case "registry":
+		if IsChannel(pinned.Fragment) || pinned.Fragment == "" {
+			pinned.Fragment = version
+		}
+	default:
+		if !IsVersionTag(pinned.Fragment) && !IsCommitSHA(pinned.Fragment) {
+			pinned.Fragment = "v" + version
+		}
+	}
+	return pinned.String()
+}
+
+// ListVersions returns the versions of an application, from the most
+// recently installed to the oldest one.
+func ListVersions(db couchdb.Database, slug string) ([]*Version, error) {
+	var versions []*Version
+	req := map[string]interface{}{
+		"selector": mango.Equal("slug", slug),
+		"limit":    maxVersions * 2,
+	}
+	index := mango.IndexOnFields(consts.AppsVersions, "slug")
+	if err := findDocs(db, index, req, &versions); err != nil {
+		return nil, err
+	}
+	sort.Sort(versionsByDate(versions))
+	return versions, nil
+}
+
+// previousVersion returns the version that was installed before the current
+// one.
+func previousVersion(db couchdb.Database, slug string) (*Version, error) {
+	versions, err := ListVersions(db, slug)
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) < 2 {
+		return nil, ErrNoPreviousVersion
+	}
+	return versions[1], nil
+}
+
+// saveVersion records the version of the application that has just been
+// installed. The oldest versions are removed.
+func saveVersion(ctx vfs.Context, man *Manifest, src *url.URL, raw []byte) error {
+	hash, err := contentHash(ctx, path.Join(vfs.AppsDirName, man.Slug))
+	if err != nil {
+		return err
+	}
+	v := &Version{}
+	id := man.Slug + "/" + hash
+	err = couchdb.GetDoc(ctx, consts.AppsVersions, id, v)
+	if err != nil && !couchdb.IsNotFoundError(err) {
+		return err
+	}
+	v.Slug = man.Slug
+	v.Version = man.Version
+	v.Source = pinSource(src, man.Version)
+	v.Hash = hash
+	v.Manifest = raw
+	v.InstalledAt = time.Now()
+	if v.Rev() == "" {
+		v.SetID(id)
+		err = couchdb.CreateNamedDocWithDB(ctx, v)
+	} else {
+		err = couchdb.UpdateDoc(ctx, v)
+	}
+	if err != nil {
+		return err
+	}
+
+	versions, err := ListVersions(ctx, man.Slug)
+	if err != nil {
+		return err
+	}
+	for j := maxVersions; j < len(versions); j++ {
+		if err = couchdb.DeleteDoc(ctx, versions[j]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteVersions removes the versions of an uninstalled application.
+func deleteVersions(db couchdb.Database, slug string) error {
+	versions, err := ListVersions(db, slug)
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		if err = couchdb.DeleteDoc(db, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// contentHash computes a hash of the files of an application, from their
+// names and checksums. The git directory is not part of it.
+func contentHash(ctx vfs.Context, appdir string) (string, error) {
+	var lines []string
+	gitdir := path.Join(appdir, ".git")
+	err := vfs.Walk(ctx, appdir, func(name string, dir *vfs.DirDoc, file *vfs.FileDoc, err error) error {
+		if err != nil {
+			return err
+		}
+		if name == gitdir {
+			return vfs.ErrSkipDir
+		}
+		if file != nil {
+			rel := strings.TrimPrefix(name, appdir+"/")
+			lines = append(lines, fmt.Sprintf("%s %x\n", rel, file.MD5Sum))
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(lines)
+	h := sha256.New()
+	for _, line := range lines {
+		io.WriteString(h, line)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+type versionsByDate []*Version
+
+func (s versionsByDate) Len() int           { return len(s) }
+func (s versionsByDate) Less(i, j int) bool { return s[i].InstalledAt.After(s[j].InstalledAt) }
+func (s versionsByDate) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,131 @@
+package apps
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPinSource(t *testing.T) {
+	pin := func(source, version string) string {
+		src, err := url.Parse(source)
+		if !assert.NoError(t, err) {
+			return ""
+		}
+		return pinSource(src, version)
+	}
+	assert.Equal(t, "git://github.com/cozy/cozy-emails.git#v1.2.3",
+		pin("git://github.com/cozy/cozy-emails.git#build", "1.2.3"))
+	assert.Equal(t, "git://github.com/cozy/cozy-emails.git#v1.0.0",
+		pin("git://github.com/cozy/cozy-emails.git#v1.0.0", "1.2.3"))
+	assert.Equal(t, "git://github.com/cozy/cozy-emails.git#0123456789abcdef0123456789abcdef01234567",
+		pin("git://github.com/cozy/cozy-emails.git#0123456789abcdef0123456789abcdef01234567", "1.2.3"))
+	assert.Equal(t, "registry://emails#1.2.3", pin("registry://emails#beta", "1.2.3"))
+	assert.Equal(t, "registry://emails#1.2.3", pin("registry://emails", "1.2.3"))
+	assert.Equal(t, "https://example.com/emails.tar.gz",
+		pin("https://example.com/emails.tar.gz", "1.2.3"))
+
+	assert.True(t, IsVersionTag("v1.2.3"))
+	assert.True(t, IsVersionTag("v2.0.0-beta.1"))
+	assert.False(t, IsVersionTag("build"))
+	assert.False(t, IsVersionTag("1.2.3"))
+}
+
+func waitInstaller(t *testing.T, inst *Installer) (*Manifest, bool) {
+	for {
+		man, done, err := inst.Poll()
+		if !assert.NoError(t, err) {
+			return nil, false
+		}
+		if done {
+			return man, true
+		}
+	}
+}
+
+func TestRollback(t *testing.T) {
+	defer func(v string) { localVersion = v }(localVersion)
+	localVersion = "1.0.0"
+	tarball1 := makeTarball()
+	localVersion = "2.0.0"
+	tarball2 := makeTarball()
+	tts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/gzip")
+		if r.URL.Path == "/mini-2.0.0.tar.gz" {
+			w.Write(tarball2)
+		} else {
+			w.Write(tarball1)
+		}
+	}))
+	defer tts.Close()
+
+	inst, err := NewInstaller(c, &InstallerOptions{Slug: "rollback-mini"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	go inst.Rollback()
+	_, _, err = inst.Poll()
+	assert.Equal(t, ErrNotFound, err)
+
+	inst, err = NewInstaller(c, &InstallerOptions{
+		Slug:      "rollback-mini",
+		SourceURL: tts.URL + "/mini-1.0.0.tar.gz",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	go inst.Install()
+	if _, ok := waitInstaller(t, inst); !ok {
+		return
+	}
+
+	inst, err = NewInstaller(c, &InstallerOptions{Slug: "rollback-mini"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	go inst.Rollback()
+	_, _, err = inst.Poll()
+	assert.Equal(t, ErrNoPreviousVersion, err)
+
+	inst, err = NewInstaller(c, &InstallerOptions{
+		Slug:      "rollback-mini",
+		SourceURL: tts.URL + "/mini-2.0.0.tar.gz",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	go inst.Update()
+	man, ok := waitInstaller(t, inst)
+	if !ok {
+		return
+	}
+	assert.Equal(t, "2.0.0", man.Version)
+
+	versions, err := ListVersions(c, "rollback-mini")
+	assert.NoError(t, err)
+	if assert.Len(t, versions, 2) {
+		assert.Equal(t, "2.0.0", versions[0].Version)
+		assert.Equal(t, "1.0.0", versions[1].Version)
+		assert.NotEqual(t, versions[0].Hash, versions[1].Hash)
+		assert.Contains(t, string(versions[1].Manifest), `"version": "1.0.0"`)
+	}
+
+	inst, err = NewInstaller(c, &InstallerOptions{Slug: "rollback-mini"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	go inst.Rollback()
+	man, ok = waitInstaller(t, inst)
+	if !ok {
+		return
+	}
+	assert.Equal(t, "1.0.0", man.Version)
+	assert.Equal(t, tts.URL+"/mini-1.0.0.tar.gz", man.Source)
+	exists, err := afero.FileContainsBytes(c.FS(), "/.cozy_apps/rollback-mini/manifest.webapp", []byte("1.0.0"))
+	assert.NoError(t, err)
+	assert.True(t, exists)
+}
@@ -0,0 +1,197 @@
+// Package calendar is for the scheduling of the events with attendees: the
+// invitations are sent by mail with iMIP (RFC 6047), and the replies of the
+// attendees update their participation status.
+package calendar
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/realtime"
+)
+
+func init() {
+	jobs.AddWorker("imip", &jobs.WorkerConfig{
+		Concurrency:  1,
+		MaxExecCount: 3,
+		Timeout:      60 * time.Second,
+		WorkerFunc:   SendInvitations,
+	})
+}
+
+// The iTIP methods (RFC 5546) used by the stack
+const (
+	MethodRequest = "REQUEST"
+	MethodCancel  = "CANCEL"
+	MethodReply   = "REPLY"
+)
+
+// The participation statuses of an attendee
+const (
+	NeedsAction = "NEEDS-ACTION"
+	Accepted    = "ACCEPTED"
+	Declined    = "DECLINED"
+	Tentative   = "TENTATIVE"
+	Delegated   = "DELEGATED"
+)
+
+var (
+	// ErrNotAReply is used when an iCalendar content is not an iMIP reply
+	ErrNotAReply = errors.New("The calendar is not a reply")
+	// ErrUnknownEvent is used when a reply is for an event that is not an
+	// event of this instance
+	ErrUnknownEvent = errors.New("The reply is for an unknown event")
+	// ErrUnknownAttendee is used when the sender of a reply is not one of
+	// the attendees in this reply
+	ErrUnknownAttendee = errors.New("The reply is not sent by an attendee")
+	// ErrInvalidPartStat is used when the participation status of a reply
+	// is not one of the statuses of RFC 5545 for an event
+	ErrInvalidPartStat = errors.New("The participation status is invalid")
+)
+
+// Attendee is an attendee of an event, as in the attendees field of the
+// io.cozy.events documents.
+type Attendee struct {
+	Name     string `json:"name,omitempty"`
+	Email    string `json:"email"`
+	PartStat string `json:"partstat,omitempty"`
+}
+
+// Scheduling is the state of the invitations sent for an event. It has the
+// same identifier as the event, and is kept when the event is deleted, in
+// order to send the cancellation to the attendees.
+type Scheduling struct {
+	DocID     string   `json:"_id,omitempty"`
+	DocRev    string   `json:"_rev,omitempty"`
+	Sequence  int      `json:"sequence"`
+	Hash      string   `json:"hash"`
+	Summary   string   `json:"summary"`
+	Attendees []string `json:"attendees"`
+	Cancelled bool     `json:"cancelled,omitempty"`
+}
+
+// ID is used to implement the couchdb.Doc interface
+func (s *Scheduling) ID() string { return s.DocID }
+
+// Rev is used to implement the couchdb.Doc interface
+func (s *Scheduling) Rev() string { return s.DocRev }
+
+// DocType is used to implement the couchdb.Doc interface
+func (s *Scheduling) DocType() string { return consts.EventsSchedulings }
+
+// SetID is used to implement the couchdb.Doc interface
+func (s *Scheduling) SetID(id string) { s.DocID = id }
+
+// SetRev is used to implement the couchdb.Doc interface
+func (s *Scheduling) SetRev(rev string) { s.DocRev = rev }
+
+func getScheduling(db couchdb.Database, eventID string) (*Scheduling, error) {
+	sched := &Scheduling{}
+	err := couchdb.GetDoc(db, consts.EventsSchedulings, eventID, sched)
+	if couchdb.IsNotFoundError(err) {
+		return &Scheduling{DocID: eventID}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sched, nil
+}
+
+func saveScheduling(db couchdb.Database, sched *Scheduling) error {
+	if sched.Rev() == "" {
+		return couchdb.CreateNamedDocWithDB(db, sched)
+	}
+	return couchdb.UpdateDoc(db, sched)
+}
+
+// getAttendees returns the attendees of an io.cozy.events document, with a
+// normalized email address.
+func getAttendees(doc couchdb.JSONDoc) []*Attendee {
+	list, _ := doc.Get("attendees").([]interface{})
+	var attendees []*Attendee
+	for _, item := range list {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		email, _ := m["email"].(string)
+		email = strings.ToLower(strings.TrimSpace(email))
+		if email == "" {
+			continue
+		}
+		name, _ := m["name"].(string)
+		partstat, _ := m["partstat"].(string)
+		attendees = append(attendees, &Attendee{
+			Name:     name,
+			Email:    email,
+			PartStat: partstat,
+		})
+	}
+	return attendees
+}
+
+// InvitationsOptions are the options of the "imip" worker.
+type InvitationsOptions struct {
+	EventID string `json:"event_id"`
+}
+
+// SendInvitations is the "imip" worker function. It sends the invitations,
+// updates and cancellations for the given event, or for all the events if
+// no event is given.
+func SendInvitations(ctx context.Context, m *jobs.Message) error {
+	opts := &InvitationsOptions{}
+	if m != nil && len(m.Data) > 0 {
+		if err := m.Unmarshal(opts); err != nil {
+			return err
+		}
+	}
+	domain := ctx.Value(jobs.ContextDomainKey).(string)
+	i, err := instance.Get(domain)
+	if err != nil {
+		return err
+	}
+	if opts.EventID != "" {
+		return ScheduleEvent(i, opts.EventID)
+	}
+	return ScheduleAll(i)
+}
+
+// WatchEvents pushes an "imip" job for each change of an event, on all the
+// instances, so that the attendees are notified of the changes. It is meant to
+// be started once by the server.
+func WatchEvents() {
+	sub := realtime.MainHub().Subscribe(consts.Events)
+	go func() {
+		for e := range sub.Read() {
+			if e.DocID == "" {
+				continue
+			}
+			i, err := instance.Get(e.Instance)
+			if err != nil {
+				continue
+			}
+			if err = pushInvitationsJob(i, e.DocID); err != nil {
+				log.Warnf("[calendar] Could not push the imip job for %s: %s", i.Domain, err)
+			}
+		}
+	}()
+}
+
+func pushInvitationsJob(i *instance.Instance, eventID string) error {
+	msg, err := jobs.NewMessage(jobs.JSONEncoding, &InvitationsOptions{EventID: eventID})
+	if err != nil {
+		return err
+	}
+	_, _, err = i.JobsBroker().PushJob(&jobs.JobRequest{
+		WorkerType: "imip",
+		Message:    msg,
+	})
+	return err
+}
@@ -0,0 +1,110 @@
+package calendar
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/jobs/workers"
+	"github.com/stretchr/testify/assert"
+)
+
+func makeEvent(t *testing.T, raw string) *couchdb.JSONDoc {
+	doc := &couchdb.JSONDoc{Type: consts.Events}
+	err := json.Unmarshal([]byte(raw), &doc.M)
+	assert.NoError(t, err)
+	return doc
+}
+
+func TestGetAttendees(t *testing.T) {
+	event := makeEvent(t, `{
+		"_id": "event1",
+		"attendees": [
+			{ "name": "Bob", "email": " Bob@Example.com " },
+			{ "name": "No email" },
+			{ "email": "alice@example.com", "partstat": "ACCEPTED" }
+		]
+	}`)
+	attendees := getAttendees(*event)
+	if assert.Len(t, attendees, 2) {
+		assert.Equal(t, "bob@example.com", attendees[0].Email)
+		assert.Equal(t, "Bob", attendees[0].Name)
+		assert.Equal(t, Accepted, attendees[1].PartStat)
+	}
+}
+
+func TestEventHashIgnoresPartStat(t *testing.T) {
+	e1 := makeEvent(t, `{"_id": "event1", "start": "2017-03-21T10:00:00Z", "summary": "Lunch"}`)
+	e2 := makeEvent(t, `{"_id": "event1", "start": "2017-03-21T10:00:00Z", "summary": "Lunch",
+		"attendees": [{ "email": "bob@example.com", "partstat": "DECLINED" }]}`)
+	e3 := makeEvent(t, `{"_id": "event1", "start": "2017-03-21T11:00:00Z", "summary": "Lunch"}`)
+	emails := []string{"bob@example.com"}
+	assert.Equal(t, eventHash(*e1, emails), eventHash(*e2, emails))
+	assert.NotEqual(t, eventHash(*e1, emails), eventHash(*e3, emails))
+	assert.NotEqual(t, eventHash(*e1, emails), eventHash(*e1, nil))
+}
+
+func TestWriteIMIP(t *testing.T) {
+	event := makeEvent(t, `{
+		"_id": "event1",
+		"start": "2017-03-21T10:00:00+01:00",
+		"end": "2017-03-21T11:00:00+01:00",
+		"summary": "Lunch"
+	}`)
+	organizer := &workers.MailAddress{Name: "Jane Doe", Email: "jane@example.com"}
+	sched := &Scheduling{DocID: "event1", Sequence: 2, Summary: "Lunch"}
+	attendees := []*Attendee{{Name: `Bob "the builder"`, Email: "bob@example.com"}}
+
+	buf := new(bytes.Buffer)
+	err := WriteIMIP(buf, "jane.cozy.tools", MethodRequest, organizer, sched, event, attendees)
+	assert.NoError(t, err)
+	out := buf.String()
+	assert.Contains(t, out, "METHOD:REQUEST\r\n")
+	assert.Contains(t, out, "UID:event1@jane.cozy.tools\r\n")
+	assert.Contains(t, out, "DTSTART:20170321T090000Z\r\n")
+	assert.Contains(t, out, "SEQUENCE:2\r\n")
+	assert.Contains(t, out, `ORGANIZER;CN="Jane Doe":mailto:jane@example.com`)
+	assert.Contains(t, strings.Replace(out, "\r\n ", "", -1),
+		`ATTENDEE;CN="Bob the builder";ROLE=REQ-PARTICIPANT;PARTSTAT=NEEDS-ACTION;RSVP=TRUE:mailto:bob@example.com`)
+
+	buf.Reset()
+	err = WriteIMIP(buf, "jane.cozy.tools", MethodCancel, organizer, sched, nil, attendees)
+	assert.NoError(t, err)
+	out = buf.String()
+	assert.Contains(t, out, "METHOD:CANCEL\r\n")
+	assert.Contains(t, out, "UID:event1@jane.cozy.tools\r\n")
+	assert.Contains(t, out, "SUMMARY:Lunch\r\n")
+	assert.Contains(t, out, "STATUS:CANCELLED\r\n")
+	assert.NotContains(t, out, "RSVP")
+}
+
+func TestParseReply(t *testing.T) {
+	reply := "BEGIN:VCALENDAR\r\nMETHOD:REPLY\r\nBEGIN:VEVENT\r\n" +
+		"UID:event1@jane.cozy.tools\r\n" +
+		"ATTENDEE;PARTSTAT=ACCEPTED:mailto:Bob@example.com\r\n" +
+		"ATTENDEE;PARTSTAT=DECLINED:mailto:alice@example.com\r\n" +
+		"END:VEVENT\r\nEND:VCALENDAR\r\n"
+
+	uid, partstat, err := parseReply(strings.NewReader(reply), "bob@example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "event1@jane.cozy.tools", uid)
+	assert.Equal(t, Accepted, partstat)
+
+	_, partstat, err = parseReply(strings.NewReader(reply), "alice@example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, Declined, partstat)
+
+	_, _, err = parseReply(strings.NewReader(reply), "mallory@example.com")
+	assert.Equal(t, ErrUnknownAttendee, err)
+
+	invalid := strings.Replace(reply, "PARTSTAT=ACCEPTED", "PARTSTAT=X-MAYBE", 1)
+	_, _, err = parseReply(strings.NewReader(invalid), "bob@example.com")
+	assert.Equal(t, ErrInvalidPartStat, err)
+
+	request := strings.Replace(reply, "METHOD:REPLY", "METHOD:REQUEST", 1)
+	_, _, err = parseReply(strings.NewReader(request), "bob@example.com")
+	assert.Equal(t, ErrNotAReply, err)
+}
@@ -0,0 +1,294 @@
+package calendar
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/ical"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/jobs/workers"
+)
+
+// ScheduleEvent sends the invitations, updates or cancellations for the
+// event with the given identifier, if the attendees have not been notified of
+// its last version.
+func ScheduleEvent(i *instance.Instance, eventID string) error {
+	sched, err := getScheduling(i, eventID)
+	if err != nil {
+		return err
+	}
+	event := &couchdb.JSONDoc{Type: consts.Events}
+	err = couchdb.GetDoc(i, consts.Events, eventID, event)
+	if couchdb.IsNotFoundError(err) {
+		return schedule(i, sched, nil)
+	}
+	if err != nil {
+		return err
+	}
+	return schedule(i, sched, event)
+}
+
+// ScheduleAll does the same thing as ScheduleEvent, but for all the events
+// of the instance, including the deleted ones.
+func ScheduleAll(i *instance.Instance) error {
+	var events []couchdb.JSONDoc
+	err := couchdb.GetAllDocs(i, consts.Events, &couchdb.AllDocsRequest{}, &events)
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return err
+	}
+	var scheds []*Scheduling
+	err = couchdb.GetAllDocs(i, consts.EventsSchedulings, &couchdb.AllDocsRequest{}, &scheds)
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return err
+	}
+	byID := make(map[string]*Scheduling, len(scheds))
+	for _, sched := range scheds {
+		byID[sched.ID()] = sched
+	}
+
+	for j := range events {
+		event := &events[j]
+		event.Type = consts.Events
+		sched, ok := byID[event.ID()]
+		if !ok {
+			if len(getAttendees(*event)) == 0 {
+				continue
+			}
+			sched = &Scheduling{DocID: event.ID()}
+		}
+		delete(byID, event.ID())
+		if err = schedule(i, sched, event); err != nil {
+			return err
+		}
+	}
+	// The remaining schedulings are for deleted events
+	for _, sched := range byID {
+		if err = schedule(i, sched, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func schedule(i *instance.Instance, sched *Scheduling, event *couchdb.JSONDoc) error {
+	organizer, err := getOrganizer(i)
+	if err != nil {
+		return err
+	}
+
+	if event == nil || ical.GetString(*event, "status") == "cancelled" {
+		if sched.Cancelled || len(sched.Attendees) == 0 {
+			return nil
+		}
+		sched.Sequence++
+		sched.Cancelled = true
+		err = sendToAttendees(i, MethodCancel, organizer, sched, event, attendeesFromEmails(sched.Attendees))
+		if err != nil {
+			return err
+		}
+		return saveScheduling(i, sched)
+	}
+
+	var attendees []*Attendee
+	current := make(map[string]bool)
+	for _, a := range getAttendees(*event) {
+		if a.Email != strings.ToLower(organizer.Email) && !current[a.Email] {
+			attendees = append(attendees, a)
+			current[a.Email] = true
+		}
+	}
+	if sched.Rev() == "" && len(attendees) == 0 {
+		return nil
+	}
+	emails := make([]string, 0, len(attendees))
+	for _, a := range attendees {
+		emails = append(emails, a.Email)
+	}
+	sort.Strings(emails)
+	var removed []string
+	for _, email := range sched.Attendees {
+		if !current[email] {
+			removed = append(removed, email)
+		}
+	}
+
+	hash := eventHash(*event, emails)
+	if hash == sched.Hash && len(removed) == 0 && !sched.Cancelled {
+		return nil
+	}
+	if sched.Rev() != "" {
+		sched.Sequence++
+	}
+	sched.Hash = hash
+	sched.Summary = ical.GetString(*event, "summary")
+	sched.Attendees = emails
+	sched.Cancelled = false
+
+	if len(removed) > 0 {
+		err = sendToAttendees(i, MethodCancel, organizer, sched, event, attendeesFromEmails(removed))
+		if err != nil {
+			return err
+		}
+	}
+	if len(attendees) > 0 {
+		err = sendToAttendees(i, MethodRequest, organizer, sched, event, attendees)
+		if err != nil {
+			return err
+		}
+	}
+	return saveScheduling(i, sched)
+}
+
+// eventHash is a hash of the fields of an event that the attendees know. The
+// participation statuses are not part of it: they are updated by the
+// replies, and should not send a new version of the invitation.
+func eventHash(event couchdb.JSONDoc, emails []string) string {
+	h := sha256.New()
+	for _, key := range []string{"start", "end", "summary", "description", "location"} {
+		io.WriteString(h, ical.GetString(event, key))
+		h.Write([]byte{0})
+	}
+	allday, _ := event.Get("allday").(bool)
+	fmt.Fprintf(h, "%t", allday)
+	for _, email := range emails {
+		h.Write([]byte{0})
+		io.WriteString(h, email)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+func attendeesFromEmails(emails []string) []*Attendee {
+	attendees := make([]*Attendee, len(emails))
+	for j, email := range emails {
+		attendees[j] = &Attendee{Email: email}
+	}
+	return attendees
+}
+
+// getOrganizer returns the address of the owner of the instance, who is the
+// organizer of the events.
+func getOrganizer(db couchdb.Database) (*workers.MailAddress, error) {
+	doc := &couchdb.JSONDoc{}
+	err := couchdb.GetDoc(db, consts.Settings, consts.InstanceSettingsID, doc)
+	if err != nil {
+		return nil, err
+	}
+	email, _ := doc.M["email"].(string)
+	if email == "" {
+		return nil, fmt.Errorf("The instance has no email in its settings")
+	}
+	name, _ := doc.M["public_name"].(string)
+	return &workers.MailAddress{Name: name, Email: email}, nil
+}
+
+// sendToAttendees pushes a job to the sendmail worker, for a mail with the
+// iMIP message to the given attendees.
+func sendToAttendees(i *instance.Instance, method string, organizer *workers.MailAddress, sched *Scheduling, event *couchdb.JSONDoc, attendees []*Attendee) error {
+	buf := new(bytes.Buffer)
+	err := WriteIMIP(buf, i.Domain, method, organizer, sched, event, attendees)
+	if err != nil {
+		return err
+	}
+
+	to := make([]*workers.MailAddress, len(attendees))
+	for j, a := range attendees {
+		to[j] = &workers.MailAddress{Name: a.Name, Email: a.Email}
+	}
+	var subject, text string
+	switch method {
+	case MethodCancel:
+		subject = "Cancelled: " + sched.Summary
+		text = fmt.Sprintf("%s has cancelled the event \"%s\".", organizerName(organizer), sched.Summary)
+	default:
+		subject = "Invitation: " + sched.Summary
+		if sched.Sequence > 0 {
+			subject = "Updated invitation: " + sched.Summary
+		}
+		text = fmt.Sprintf("%s has invited you to the event \"%s\".", organizerName(organizer), sched.Summary)
+		if start, ok := ical.ParseTime(ical.GetString(*event, "start")); ok {
+			text += "\n\nWhen: " + start.Format(time.RFC1123)
+		}
+		if location := ical.GetString(*event, "location"); location != "" {
+			text += "\nWhere: " + location
+		}
+	}
+
+	msg, err := jobs.NewMessage(jobs.JSONEncoding, workers.MailOptions{
+		Mode:    workers.MailModeFrom,
+		To:      to,
+		Subject: subject,
+		Parts: []*workers.MailPart{
+			{Type: "text/plain", Body: text},
+			{Type: "text/calendar; method=" + method, Body: buf.String()},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, _, err = i.JobsBroker().PushJob(&jobs.JobRequest{
+		WorkerType: "sendmail",
+		Message:    msg,
+	})
+	return err
+}
+
+func organizerName(organizer *workers.MailAddress) string {
+	if organizer.Name != "" {
+		return organizer.Name
+	}
+	return organizer.Email
+}
+
+// WriteIMIP writes the iCalendar object of an iMIP message for an event. The
+// event can be nil for the cancellation of a deleted event.
+func WriteIMIP(w io.Writer, domain, method string, organizer *workers.MailAddress, sched *Scheduling, event *couchdb.JSONDoc, attendees []*Attendee) error {
+	lw := ical.NewWriter(w)
+	lw.Line("BEGIN", "VCALENDAR")
+	lw.Line("VERSION", "2.0")
+	lw.Line("PRODID", ical.ProdID)
+	lw.Line("METHOD", method)
+	lw.Line("BEGIN", "VEVENT")
+	if event == nil || !lw.EventProperties(domain, *event) {
+		lw.Line("UID", ical.EventUID(sched.ID(), domain))
+		lw.Line("DTSTAMP", time.Now().UTC().Format(ical.DateTimeFormat))
+		lw.Text("SUMMARY", sched.Summary)
+	}
+	lw.Line("SEQUENCE", fmt.Sprintf("%d", sched.Sequence))
+	lw.Line("ORGANIZER"+cnParam(organizer.Name), "mailto:"+organizer.Email)
+	for _, a := range attendees {
+		name := "ATTENDEE" + cnParam(a.Name) + ";ROLE=REQ-PARTICIPANT"
+		if method == MethodRequest {
+			name += ";PARTSTAT=" + NeedsAction + ";RSVP=TRUE"
+		}
+		lw.Line(name, "mailto:"+a.Email)
+	}
+	if method == MethodCancel {
+		lw.Line("STATUS", "CANCELLED")
+	}
+	lw.Line("END", "VEVENT")
+	lw.Line("END", "VCALENDAR")
+	return lw.Flush()
+}
+
+// cnParam returns the CN parameter for a name, quoted since it can contain
+// special characters.
+func cnParam(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '"' || r < ' ' {
+			return -1
+		}
+		return r
+	}, name)
+	if name == "" {
+		return ""
+	}
+	return `;CN="` + name + `"`
+}
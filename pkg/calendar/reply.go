@@ -0,0 +1,111 @@
+package calendar
+
+import (
+	"io"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/ical"
+)
+
+// ProcessReply reads the iCalendar object of an iMIP reply, received by mail
+// from an attendee, and updates the participation status of this attendee in
+// the event. The from address is the sender of the mail: only the attendee
+// with this address is updated, as a reply can only be sent by an attendee
+// for themself.
+func ProcessReply(db couchdb.Database, domain, from string, r io.Reader) error {
+	uid, partstat, err := parseReply(r, from)
+	if err != nil {
+		return err
+	}
+	suffix := "@" + domain
+	if !strings.HasSuffix(uid, suffix) {
+		return ErrUnknownEvent
+	}
+	eventID := strings.TrimSuffix(uid, suffix)
+
+	event := &couchdb.JSONDoc{Type: consts.Events}
+	err = couchdb.GetDoc(db, consts.Events, eventID, event)
+	if couchdb.IsNotFoundError(err) {
+		return ErrUnknownEvent
+	}
+	if err != nil {
+		return err
+	}
+	event.Type = consts.Events
+
+	sender := normalizeEmail(from)
+	list, _ := event.Get("attendees").([]interface{})
+	changed := false
+	for _, item := range list {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		email, _ := m["email"].(string)
+		if normalizeEmail(email) != sender || m["partstat"] == partstat {
+			continue
+		}
+		m["partstat"] = partstat
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return couchdb.UpdateDoc(db, event)
+}
+
+// parseReply returns the UID of the event of an iMIP reply, and the
+// participation status of the attendee with the from address. The statuses
+// of the other attendees in the reply are ignored.
+func parseReply(r io.Reader, from string) (string, string, error) {
+	props, err := ical.Parse(r)
+	if err != nil {
+		return "", "", err
+	}
+	sender := normalizeEmail(from)
+	var method, uid, partstat string
+	inEvent := false
+	for _, p := range props {
+		switch {
+		case p.Name == "METHOD" && !inEvent:
+			method = strings.ToUpper(p.Value)
+		case p.Name == "BEGIN" && strings.ToUpper(p.Value) == "VEVENT":
+			inEvent = true
+		case p.Name == "END" && strings.ToUpper(p.Value) == "VEVENT":
+			inEvent = false
+		case p.Name == "UID" && inEvent:
+			uid = p.Value
+		case p.Name == "ATTENDEE" && inEvent:
+			email := normalizeEmail(strings.TrimPrefix(strings.ToLower(p.Value), "mailto:"))
+			if email == sender && sender != "" {
+				partstat = strings.ToUpper(p.Params["PARTSTAT"])
+			}
+		}
+	}
+	if method != MethodReply {
+		return "", "", ErrNotAReply
+	}
+	if partstat == "" {
+		return "", "", ErrUnknownAttendee
+	}
+	if !validPartStat(partstat) {
+		return "", "", ErrInvalidPartStat
+	}
+	return uid, partstat, nil
+}
+
+// validPartStat returns true if the participation status is one of the
+// statuses allowed by RFC 5545 for an attendee of an event.
+func validPartStat(partstat string) bool {
+	switch partstat {
+	case NeedsAction, Accepted, Declined, Tentative, Delegated:
+		return true
+	}
+	return false
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/url"
@@ -8,6 +9,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/cozy/cozy-stack/pkg/utils"
@@ -68,25 +70,309 @@ type Config struct {
 	AdminPort  int
 	Fs         Fs
 	CouchDB    CouchDB
+	Registry   Registry
+	Installs   Installs
+	Contexts   map[string]Context
+	Lifecycle  Lifecycle
+	I18n       I18n
+	DevCerts   DevCerts
 	Mail       *gomail.DialerOptions
 	Logger     Logger
+	Security   Security
+	Doctypes   map[string]DoctypesPolicy
+	// PermissionsWebhooks are the URLs called with a POST request when a
+	// permission set is created, updated or revoked
+	PermissionsWebhooks []string
 }
 
+// DefaultGCInterval is the interval between two runs of the garbage collector
+// of the file-system when it is not configured.
+const DefaultGCInterval = 24 * time.Hour
+
 // Fs contains the configuration values of the file-system
 type Fs struct {
 	URL string
+	// GCInterval is the interval between two runs of the garbage collector,
+	// that looks for the blobs without file document and the file documents
+	// without blob. It is disabled if it is 0.
+	GCInterval time.Duration
+	// GCPolicy is what the garbage collector does with them: report,
+	// quarantine or clean
+	GCPolicy string
+	// VersionsMax is the maximal number of previous versions kept for a file
+	// when its content is overwritten. The versioning is disabled if it is 0.
+	VersionsMax int
+	// VersionsRetention is the duration after which a previous version is
+	// removed, on the next overwrite of the file. They are kept until there
+	// are more than VersionsMax if it is 0.
+	VersionsRetention time.Duration
+	// Dedup enables the deduplication of the identical files of an instance,
+	// as hard links on the local storage.
+	Dedup bool
 }
 
-// CouchDB contains the configuration values of the database
+const (
+	// DefaultCouchMaxIdleConns is the number of idle connections to CouchDB
+	// kept open for the next requests, when it is not configured.
+	DefaultCouchMaxIdleConns = 64
+	// DefaultCouchIdleConnTimeout is the duration after which an idle
+	// connection to CouchDB is closed, when it is not configured.
+	DefaultCouchIdleConnTimeout = 90 * time.Second
+	// DefaultCouchDialTimeout is the maximal duration to open a connection to
+	// CouchDB, when it is not configured.
+	DefaultCouchDialTimeout = 5 * time.Second
+	// DefaultCouchRequestTimeout is the maximal duration of a request to
+	// CouchDB, including the read of the response, when it is not configured.
+	DefaultCouchRequestTimeout = 5 * time.Second
+	// DefaultCouchMaxRetries is the number of times a request to CouchDB is
+	// tried again after a transient error, when it is not configured.
+	DefaultCouchMaxRetries = 3
+	// DefaultCouchRetryDelay is the delay before the first retry of a request
+	// to CouchDB, when it is not configured. It is doubled for each retry, up
+	// to DefaultCouchRetryMaxDelay.
+	DefaultCouchRetryDelay = 100 * time.Millisecond
+	// DefaultCouchRetryMaxDelay is the maximal delay between two tries of a
+	// request to CouchDB, when it is not configured.
+	DefaultCouchRetryMaxDelay = 2 * time.Second
+	// DefaultCouchRetryBudget is the maximal duration spent waiting for the
+	// retries of a request to CouchDB, when it is not configured.
+	DefaultCouchRetryBudget = 5 * time.Second
+	// DefaultCompactionInterval is the interval between two checks of the
+	// databases of the instances for compaction, when it is not configured.
+	DefaultCompactionInterval = 24 * time.Hour
+	// DefaultCompactionRatio is the part of the file of a database that can
+	// be unused before it is compacted, when it is not configured.
+	DefaultCompactionRatio = 0.5
+	// DefaultCompactionDeletes is the number of documents of a database
+	// deleted by the stack after which it is compacted, when it is not
+	// configured.
+	DefaultCompactionDeletes = 10000
+)
+
+// CouchDB contains the configuration values of the database, of the pool of
+// connections to it, and of the retries after transient errors. The changes
+// feeds are not limited by RequestTimeout, as they can stay open for a long
+// time.
 type CouchDB struct {
+	URL             string
+	MaxIdleConns    int
+	IdleConnTimeout time.Duration
+	DialTimeout     time.Duration
+	RequestTimeout  time.Duration
+	MaxRetries      int
+	RetryDelay      time.Duration
+	RetryMaxDelay   time.Duration
+	RetryBudget     time.Duration
+	CacheTTL        time.Duration
+	ListenChanges   bool
+	ExplainQueries  bool
+	// SecurityNames and SecurityRoles are the CouchDB users and roles put in
+	// the _security object of the databases created by the stack
+	SecurityNames []string
+	SecurityRoles []string
+	// CompactionInterval is the interval between two checks of the databases
+	// of the instances, that compacts the ones whose unused part of the file
+	// is more than CompactionRatio. It is disabled if it is 0.
+	CompactionInterval time.Duration
+	CompactionRatio    float64
+	// CompactionDeletes is the number of documents of a database deleted by
+	// the stack after which it is compacted without waiting. It is disabled
+	// if it is 0.
+	CompactionDeletes int
+}
+
+// Registry contains the configuration values of the applications registry
+type Registry struct {
 	URL string
 }
 
+const (
+	// DefaultInstallsConcurrency is the maximal number of installations and
+	// updates of applications running at the same time on the stack, when it
+	// is not configured.
+	DefaultInstallsConcurrency = 8
+	// DefaultInstallsPerInstance is the maximal number of installations and
+	// updates of applications running at the same time for an instance, when
+	// it is not configured.
+	DefaultInstallsPerInstance = 2
+)
+
+// Installs contains the configuration values of the limits on the
+// installations and updates of applications. The ones over the limits wait
+// in a queue. A limit of 0 disables it.
+//
+// AllowedSources is the list of the sources from which the applications can
+// be installed, like "registry://*" or "git://github.com/cozy/*". A trailing
+// * matches anything. When the list is empty, all the sources are allowed.
+//
+// ResumeInterrupted tells if the installations and updates interrupted by a
+// stop of the stack are started again when it restarts. Else, the
+// applications are only put in the errored state.
+type Installs struct {
+	Concurrency       int
+	PerInstance       int
+	AllowedSources    []string
+	ResumeInterrupted bool
+}
+
+// DefaultContext is the name of the context of the instances created without
+// an explicit one.
+const DefaultContext = "default"
+
+// Context contains the configuration values of a context, ie a class of
+// instances, like the ones of a partner. DefaultApps are the slugs of the
+// applications installed from the registry on the first login of the user.
+// PermissionTemplates are the named sets of permissions that the applications
+// can use to create a share set, in the JSON format of the permissions.
+type Context struct {
+	DefaultApps         []string
+	PermissionTemplates map[string]json.RawMessage
+}
+
+const (
+	// LifecycleCreated is the event of the lifecycle of an instance sent
+	// when it has been created
+	LifecycleCreated = "created"
+	// LifecycleDestroyed is the event of the lifecycle of an instance sent
+	// when it has been destroyed
+	LifecycleDestroyed = "destroyed"
+)
+
+const (
+	// DefaultLifecycleRetries is the number of times a failed lifecycle hook
+	// is tried again, when it is not configured.
+	DefaultLifecycleRetries = 3
+	// DefaultLifecycleRetryDelay is the delay before the first retry of a
+	// failed lifecycle hook, when it is not configured. It is doubled for
+	// each retry.
+	DefaultLifecycleRetryDelay = 10 * time.Second
+	// DefaultLifecycleTimeout is the maximal duration of a command or of a
+	// request of a lifecycle hook, when it is not configured.
+	DefaultLifecycleTimeout = 30 * time.Second
+)
+
+// Lifecycle contains the configuration values of the hooks run on the events
+// of the lifecycle of the instances, to integrate the stack with the
+// provisioning systems of the hosters (DNS, billing, monitoring...). The
+// hooks are indexed by event. A hook that takes longer than the Timeout is
+// stopped and counted as failed, and a hook that still fails after the
+// retries is appended to the DeadLetters file, if any.
+type Lifecycle struct {
+	Hooks       map[string][]LifecycleHook
+	Retries     int
+	RetryDelay  time.Duration
+	Timeout     time.Duration
+	DeadLetters string
+}
+
+// LifecycleHook is a command to run, or an URL to call with a POST request,
+// on an event of the lifecycle of the instances.
+type LifecycleHook struct {
+	Command string
+	URL     string
+}
+
+const (
+	// DefaultI18nResource is the name of the resource of the stack strings on
+	// the translations service, when it is not configured.
+	DefaultI18nResource = "stack"
+	// DefaultI18nInterval is the interval between two downloads of the
+	// translations, when it is not configured.
+	DefaultI18nInterval = 24 * time.Hour
+)
+
+// I18n contains the configuration values of the translations service. The .po
+// files of the stack strings are downloaded from URL, the base URL of a
+// project on a Transifex-compatible API, and cached in CacheDir. The service
+// is not used if URL is empty, and the embedded .po files are used when it is
+// not reachable.
+type I18n struct {
+	URL      string
+	Token    string
+	Resource string
+	Interval time.Duration
+	CacheDir string
+}
+
+// DefaultDevCertsDir is the directory of the local certificate authority for
+// the development domains, when it is not configured.
+const DefaultDevCertsDir = "$HOME/.cozy/certs"
+
+// DefaultDevCertsDomains are the development domains, when they are not
+// configured. They resolve to 127.0.0.1, with all their subdomains.
+var DefaultDevCertsDomains = []string{"cozy.tools", "localhost"}
+
+// DevCerts contains the configuration values of the certificates for the
+// local development domains. When it is enabled, the stack serves HTTPS with
+// certificates generated on the fly for the Domains and their subdomains,
+// signed by a local certificate authority saved in Dir.
+type DevCerts struct {
+	Enabled bool
+	Dir     string
+	Domains []string
+}
+
+// DoctypesPolicy contains the doctypes that the tokens of a type (app, share,
+// oauth or cli) can't use with the data API, in addition to the doctypes
+// reserved by the stack. The doctypes in Read can't be read nor written, and
+// the ones in Write can only be read.
+type DoctypesPolicy struct {
+	Read  []string
+	Write []string
+}
+
 // Logger contains the configuration values of the logger system
 type Logger struct {
 	Level string
 }
 
+const (
+	// SecurityAPI is the security context of the routes of the API
+	SecurityAPI = "api"
+	// SecurityApps is the security context of the routes serving the
+	// applications
+	SecurityApps = "apps"
+)
+
+const (
+	// DefaultHSTSMaxAge is the max-age of the Strict-Transport-Security
+	// header when it is not configured.
+	DefaultHSTSMaxAge = 365 * 24 * time.Hour // 1 year
+	// DefaultReferrerPolicy is the value of the Referrer-Policy header when
+	// it is not configured.
+	DefaultReferrerPolicy = "strict-origin-when-cross-origin"
+)
+
+// Security contains the configuration values of the security headers
+type Security struct {
+	// HSTSMaxAge is the max-age of the Strict-Transport-Security header. The
+	// header is not sent if it is 0.
+	HSTSMaxAge  time.Duration
+	HSTSPreload bool
+	// ReferrerPolicy is the value of the Referrer-Policy header
+	ReferrerPolicy string
+	// CSPReportOnly is used to rollout the Content-Security-Policy: the
+	// violations are only reported, not blocked.
+	CSPReportOnly bool
+	CSPReportURI  string
+	// Contexts are the options for each class of routes (api and apps)
+	Contexts map[string]SecurityContext
+	// TrustedProxies are the IP addresses or CIDR ranges of the reverse
+	// proxies in front of the stack. The address of the client is read in
+	// the X-Forwarded-For header only for the connections from them.
+	TrustedProxies []string
+}
+
+// SecurityContext contains the configuration values of the security headers
+// for a class of routes
+type SecurityContext struct {
+	// FrameOptions is the value of the X-Frame-Options header (DENY,
+	// SAMEORIGIN or ALLOW-FROM)
+	FrameOptions string
+	// FrameAllowed is the origin allowed with ALLOW-FROM
+	FrameAllowed string
+}
+
 // FsURL returns a copy of the filesystem URL
 func FsURL() *url.URL {
 	u, err := url.Parse(config.Fs.URL)
@@ -130,6 +416,11 @@ func CouchURL() string {
 	return config.CouchDB.URL
 }
 
+// RegistryURL returns the URL of the applications registry
+func RegistryURL() string {
+	return config.Registry.URL
+}
+
 // IsDevRelease returns whether or not the binary is a development
 // release
 func IsDevRelease() bool {
@@ -163,12 +454,16 @@ func UseViper(v *viper.Viper) error {
 		AdminHost:  v.GetString("admin.host"),
 		AdminPort:  v.GetInt("admin.port"),
 		Assets:     v.GetString("assets"),
-		Fs: Fs{
-			URL: fsURL.String(),
-		},
-		CouchDB: CouchDB{
-			URL: couchURL.String(),
+		Fs:         makeFs(v, fsURL),
+		CouchDB:    makeCouchDB(v, couchURL),
+		Registry: Registry{
+			URL: v.GetString("registry.url"),
 		},
+		Installs:  makeInstalls(v),
+		Contexts:  makeContexts(v),
+		Lifecycle: makeLifecycle(v),
+		I18n:      makeI18n(v),
+		DevCerts:  makeDevCerts(v),
 		Mail: &gomail.DialerOptions{
 			Host:                      v.GetString("mail.host"),
 			Port:                      v.GetInt("mail.port"),
@@ -180,6 +475,10 @@ func UseViper(v *viper.Viper) error {
 		Logger: Logger{
 			Level: v.GetString("log.level"),
 		},
+		Security: makeSecurity(v),
+		Doctypes: makeDoctypesPolicies(v),
+
+		PermissionsWebhooks: v.GetStringSlice("permissions.webhooks"),
 	}
 
 	return configureLogger()
@@ -201,20 +500,312 @@ log:
     level: info
 `
 
+func makeFs(v *viper.Viper, fsURL *url.URL) Fs {
+	gcInterval := DefaultGCInterval
+	if v.IsSet("fs.gc.interval") {
+		gcInterval = v.GetDuration("fs.gc.interval")
+	}
+	gcPolicy := "report"
+	if v.IsSet("fs.gc.policy") {
+		gcPolicy = v.GetString("fs.gc.policy")
+	}
+	return Fs{
+		URL:               fsURL.String(),
+		GCInterval:        gcInterval,
+		GCPolicy:          gcPolicy,
+		VersionsMax:       v.GetInt("fs.versions.max"),
+		VersionsRetention: v.GetDuration("fs.versions.retention"),
+		Dedup:             v.GetBool("fs.dedup"),
+	}
+}
+
+func makeCouchDB(v *viper.Viper, couchURL *url.URL) CouchDB {
+	maxIdleConns := DefaultCouchMaxIdleConns
+	if v.IsSet("couchdb.max_idle_conns") {
+		maxIdleConns = v.GetInt("couchdb.max_idle_conns")
+	}
+	idleConnTimeout := DefaultCouchIdleConnTimeout
+	if v.IsSet("couchdb.idle_conn_timeout") {
+		idleConnTimeout = v.GetDuration("couchdb.idle_conn_timeout")
+	}
+	dialTimeout := DefaultCouchDialTimeout
+	if v.IsSet("couchdb.dial_timeout") {
+		dialTimeout = v.GetDuration("couchdb.dial_timeout")
+	}
+	requestTimeout := DefaultCouchRequestTimeout
+	if v.IsSet("couchdb.request_timeout") {
+		requestTimeout = v.GetDuration("couchdb.request_timeout")
+	}
+	maxRetries := DefaultCouchMaxRetries
+	if v.IsSet("couchdb.retry.max") {
+		maxRetries = v.GetInt("couchdb.retry.max")
+	}
+	retryDelay := DefaultCouchRetryDelay
+	if v.IsSet("couchdb.retry.delay") {
+		retryDelay = v.GetDuration("couchdb.retry.delay")
+	}
+	retryMaxDelay := DefaultCouchRetryMaxDelay
+	if v.IsSet("couchdb.retry.max_delay") {
+		retryMaxDelay = v.GetDuration("couchdb.retry.max_delay")
+	}
+	retryBudget := DefaultCouchRetryBudget
+	if v.IsSet("couchdb.retry.budget") {
+		retryBudget = v.GetDuration("couchdb.retry.budget")
+	}
+	compactionInterval := DefaultCompactionInterval
+	if v.IsSet("couchdb.compaction.interval") {
+		compactionInterval = v.GetDuration("couchdb.compaction.interval")
+	}
+	compactionRatio := DefaultCompactionRatio
+	if v.IsSet("couchdb.compaction.ratio") {
+		compactionRatio = v.GetFloat64("couchdb.compaction.ratio")
+	}
+	compactionDeletes := DefaultCompactionDeletes
+	if v.IsSet("couchdb.compaction.deletes") {
+		compactionDeletes = v.GetInt("couchdb.compaction.deletes")
+	}
+	securityNames := v.GetStringSlice("couchdb.security.names")
+	if len(securityNames) == 0 && couchURL.User != nil && couchURL.User.Username() != "" {
+		securityNames = []string{couchURL.User.Username()}
+	}
+	return CouchDB{
+		URL:             couchURL.String(),
+		MaxIdleConns:    maxIdleConns,
+		IdleConnTimeout: idleConnTimeout,
+		DialTimeout:     dialTimeout,
+		RequestTimeout:  requestTimeout,
+		MaxRetries:      maxRetries,
+		RetryDelay:      retryDelay,
+		RetryMaxDelay:   retryMaxDelay,
+		RetryBudget:     retryBudget,
+		CacheTTL:        v.GetDuration("couchdb.cache_ttl"),
+		ListenChanges:   v.GetBool("couchdb.listen_changes"),
+		ExplainQueries:  v.GetBool("couchdb.explain_queries"),
+		SecurityNames:   securityNames,
+		SecurityRoles:   v.GetStringSlice("couchdb.security.roles"),
+
+		CompactionInterval: compactionInterval,
+		CompactionRatio:    compactionRatio,
+		CompactionDeletes:  compactionDeletes,
+	}
+}
+
+func makeInstalls(v *viper.Viper) Installs {
+	concurrency := DefaultInstallsConcurrency
+	if v.IsSet("installs.concurrency") {
+		concurrency = v.GetInt("installs.concurrency")
+	}
+	perInstance := DefaultInstallsPerInstance
+	if v.IsSet("installs.per_instance") {
+		perInstance = v.GetInt("installs.per_instance")
+	}
+	return Installs{
+		Concurrency:       concurrency,
+		PerInstance:       perInstance,
+		AllowedSources:    v.GetStringSlice("installs.allowed_sources"),
+		ResumeInterrupted: v.GetBool("installs.resume_interrupted"),
+	}
+}
+
+func makeContexts(v *viper.Viper) map[string]Context {
+	contexts := make(map[string]Context)
+	for name := range v.GetStringMap("contexts") {
+		key := "contexts." + name
+		templates := make(map[string]json.RawMessage)
+		for tmpl, rules := range v.GetStringMap(key + ".permission_templates") {
+			raw, err := json.Marshal(jsonValue(rules))
+			if err != nil {
+				continue
+			}
+			templates[tmpl] = raw
+		}
+		contexts[name] = Context{
+			DefaultApps:         v.GetStringSlice(key + ".default_apps"),
+			PermissionTemplates: templates,
+		}
+	}
+	return contexts
+}
+
+// jsonValue converts a value of the configuration to a value that can be
+// marshaled to JSON: the maps from a YAML file have interface{} keys.
+func jsonValue(val interface{}) interface{} {
+	switch val := val.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(val))
+		for k, v := range val {
+			m[fmt.Sprintf("%v", k)] = jsonValue(v)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(val))
+		for k, v := range val {
+			m[k] = jsonValue(v)
+		}
+		return m
+	case []interface{}:
+		list := make([]interface{}, len(val))
+		for i, v := range val {
+			list[i] = jsonValue(v)
+		}
+		return list
+	}
+	return val
+}
+
+func makeDoctypesPolicies(v *viper.Viper) map[string]DoctypesPolicy {
+	policies := make(map[string]DoctypesPolicy)
+	for typ := range v.GetStringMap("permissions.forbidden_doctypes") {
+		key := "permissions.forbidden_doctypes." + typ
+		policies[typ] = DoctypesPolicy{
+			Read:  v.GetStringSlice(key + ".read"),
+			Write: v.GetStringSlice(key + ".write"),
+		}
+	}
+	return policies
+}
+
+func makeLifecycle(v *viper.Viper) Lifecycle {
+	retries := DefaultLifecycleRetries
+	if v.IsSet("lifecycle.retries") {
+		retries = v.GetInt("lifecycle.retries")
+	}
+	delay := DefaultLifecycleRetryDelay
+	if v.IsSet("lifecycle.retry_delay") {
+		delay = v.GetDuration("lifecycle.retry_delay")
+	}
+	timeout := DefaultLifecycleTimeout
+	if v.IsSet("lifecycle.timeout") {
+		timeout = v.GetDuration("lifecycle.timeout")
+	}
+	hooks := make(map[string][]LifecycleHook)
+	for event, list := range v.GetStringMap("lifecycle.hooks") {
+		if event != LifecycleCreated && event != LifecycleDestroyed {
+			log.Warnf("[config] Unknown event for the lifecycle hooks: %s", event)
+			continue
+		}
+		items, _ := list.([]interface{})
+		for _, item := range items {
+			hook := LifecycleHook{
+				Command: mapString(item, "command"),
+				URL:     mapString(item, "url"),
+			}
+			if hook.Command == "" && hook.URL == "" {
+				log.Warnf("[config] A lifecycle hook for %s has no command or url", event)
+				continue
+			}
+			hooks[event] = append(hooks[event], hook)
+		}
+	}
+	return Lifecycle{
+		Hooks:       hooks,
+		Retries:     retries,
+		RetryDelay:  delay,
+		Timeout:     timeout,
+		DeadLetters: v.GetString("lifecycle.dead_letters"),
+	}
+}
+
+// mapString returns the string value of the key in a map of the
+// configuration. The maps are map[interface{}]interface{} when they come
+// from a YAML file.
+func mapString(m interface{}, key string) string {
+	var val interface{}
+	switch m := m.(type) {
+	case map[string]interface{}:
+		val = m[key]
+	case map[interface{}]interface{}:
+		val = m[key]
+	}
+	s, _ := val.(string)
+	return s
+}
+
+func makeDevCerts(v *viper.Viper) DevCerts {
+	dir := DefaultDevCertsDir
+	if v.IsSet("dev_certs.dir") {
+		dir = v.GetString("dev_certs.dir")
+	}
+	domains := DefaultDevCertsDomains
+	if v.IsSet("dev_certs.domains") {
+		domains = v.GetStringSlice("dev_certs.domains")
+	}
+	return DevCerts{
+		Enabled: v.GetBool("dev_certs.enabled"),
+		Dir:     utils.AbsPath(dir),
+		Domains: domains,
+	}
+}
+
+func makeI18n(v *viper.Viper) I18n {
+	resource := DefaultI18nResource
+	if v.IsSet("i18n.resource") {
+		resource = v.GetString("i18n.resource")
+	}
+	interval := DefaultI18nInterval
+	if v.IsSet("i18n.interval") {
+		interval = v.GetDuration("i18n.interval")
+	}
+	return I18n{
+		URL:      strings.TrimSuffix(v.GetString("i18n.url"), "/"),
+		Token:    v.GetString("i18n.token"),
+		Resource: resource,
+		Interval: interval,
+		CacheDir: v.GetString("i18n.cache_dir"),
+	}
+}
+
+func makeSecurity(v *viper.Viper) Security {
+	hstsMaxAge := DefaultHSTSMaxAge
+	if v.IsSet("security.hsts.max_age") {
+		hstsMaxAge = v.GetDuration("security.hsts.max_age")
+	}
+	referrerPolicy := DefaultReferrerPolicy
+	if v.IsSet("security.referrer_policy") {
+		referrerPolicy = v.GetString("security.referrer_policy")
+	}
+	contexts := make(map[string]SecurityContext)
+	for _, name := range []string{SecurityAPI, SecurityApps} {
+		key := "security.contexts." + name
+		contexts[name] = SecurityContext{
+			FrameOptions: strings.ToUpper(v.GetString(key + ".frame_options")),
+			FrameAllowed: v.GetString(key + ".frame_allowed"),
+		}
+	}
+	return Security{
+		HSTSMaxAge:     hstsMaxAge,
+		HSTSPreload:    v.GetBool("security.hsts.preload"),
+		ReferrerPolicy: referrerPolicy,
+		CSPReportOnly:  v.GetBool("security.csp.report_only"),
+		CSPReportURI:   v.GetString("security.csp.report_uri"),
+		Contexts:       contexts,
+		TrustedProxies: v.GetStringSlice("security.trusted_proxies"),
+	}
+}
+
 // UseTestFile can be used in a test file to inject a configuration
 // from a cozy.test.* file. If it can not find this file in your
 // $HOME/.cozy directory it will use the default one.
+//
+// The values can be overridden by the environment variables, like
+// COZY_COUCHDB_URL=mem:// to run the tests with the in-memory backend instead
+// of a CouchDB server.
 func UseTestFile() {
 	v := viper.New()
 	v.SetConfigName("cozy.test")
 	v.AddConfigPath("$HOME/.cozy")
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.SetEnvPrefix("cozy")
+	v.AutomaticEnv()
 
 	if err := v.ReadInConfig(); err != nil {
 		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
 			panic(fmt.Errorf("fatal error test config file: %s", err))
 		}
-		UseTestYAML(defaultTestConfig)
-		return
+		v.SetConfigType("yaml")
+		if err = v.ReadConfig(strings.NewReader(defaultTestConfig)); err != nil {
+			panic(fmt.Errorf("fatal error test config file: %s", err))
+		}
 	}
 
 	if err := UseViper(v); err != nil {
@@ -1,8 +1,11 @@
 package config
 
 import (
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/cozy/cozy-stack/pkg/utils"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 )
@@ -13,3 +16,212 @@ func TestUseViper(t *testing.T) {
 	UseViper(cfg)
 	assert.Equal(t, "http://db:1234/", CouchURL())
 }
+
+func TestCouchDB(t *testing.T) {
+	cfg := viper.New()
+	UseViper(cfg)
+	couch := GetConfig().CouchDB
+	assert.Equal(t, DefaultCouchMaxIdleConns, couch.MaxIdleConns)
+	assert.Equal(t, DefaultCouchIdleConnTimeout, couch.IdleConnTimeout)
+	assert.Equal(t, DefaultCouchDialTimeout, couch.DialTimeout)
+	assert.Equal(t, DefaultCouchRequestTimeout, couch.RequestTimeout)
+
+	cfg.Set("couchdb.max_idle_conns", 200)
+	cfg.Set("couchdb.request_timeout", "30s")
+	UseViper(cfg)
+	couch = GetConfig().CouchDB
+	assert.Equal(t, 200, couch.MaxIdleConns)
+	assert.Equal(t, 30*time.Second, couch.RequestTimeout)
+	assert.Equal(t, DefaultCouchDialTimeout, couch.DialTimeout)
+	assert.Equal(t, DefaultCouchMaxRetries, couch.MaxRetries)
+	assert.Equal(t, DefaultCouchRetryBudget, couch.RetryBudget)
+
+	cfg.Set("couchdb.retry.max", 0)
+	cfg.Set("couchdb.retry.delay", "1s")
+	UseViper(cfg)
+	couch = GetConfig().CouchDB
+	assert.Equal(t, 0, couch.MaxRetries)
+	assert.Equal(t, time.Second, couch.RetryDelay)
+}
+
+func TestSecurity(t *testing.T) {
+	cfg := viper.New()
+	UseViper(cfg)
+	sec := GetConfig().Security
+	assert.Equal(t, DefaultHSTSMaxAge, sec.HSTSMaxAge)
+	assert.Equal(t, DefaultReferrerPolicy, sec.ReferrerPolicy)
+	assert.False(t, sec.CSPReportOnly)
+
+	cfg.Set("security.hsts.max_age", "0s")
+	cfg.Set("security.csp.report_only", true)
+	cfg.Set("security.contexts.apps.frame_options", "sameorigin")
+	UseViper(cfg)
+	sec = GetConfig().Security
+	assert.Equal(t, time.Duration(0), sec.HSTSMaxAge)
+	assert.True(t, sec.CSPReportOnly)
+	assert.Equal(t, "SAMEORIGIN", sec.Contexts[SecurityApps].FrameOptions)
+	assert.Equal(t, "", sec.Contexts[SecurityAPI].FrameOptions)
+}
+
+func TestFsGC(t *testing.T) {
+	cfg := viper.New()
+	UseViper(cfg)
+	fs := GetConfig().Fs
+	assert.Equal(t, DefaultGCInterval, fs.GCInterval)
+	assert.Equal(t, "report", fs.GCPolicy)
+
+	cfg.Set("fs.gc.interval", "0s")
+	cfg.Set("fs.gc.policy", "quarantine")
+	UseViper(cfg)
+	fs = GetConfig().Fs
+	assert.Equal(t, time.Duration(0), fs.GCInterval)
+	assert.Equal(t, "quarantine", fs.GCPolicy)
+}
+
+func TestI18n(t *testing.T) {
+	cfg := viper.New()
+	UseViper(cfg)
+	i18n := GetConfig().I18n
+	assert.Empty(t, i18n.URL)
+	assert.Equal(t, DefaultI18nResource, i18n.Resource)
+	assert.Equal(t, DefaultI18nInterval, i18n.Interval)
+
+	cfg.Set("i18n.url", "https://www.transifex.com/api/2/project/cozy-stack/")
+	cfg.Set("i18n.resource", "messages")
+	cfg.Set("i18n.interval", "1h")
+	cfg.Set("i18n.cache_dir", "/var/cache/cozy/locales")
+	UseViper(cfg)
+	i18n = GetConfig().I18n
+	assert.Equal(t, "https://www.transifex.com/api/2/project/cozy-stack", i18n.URL)
+	assert.Equal(t, "messages", i18n.Resource)
+	assert.Equal(t, 1*time.Hour, i18n.Interval)
+	assert.Equal(t, "/var/cache/cozy/locales", i18n.CacheDir)
+}
+
+func TestDevCerts(t *testing.T) {
+	cfg := viper.New()
+	UseViper(cfg)
+	certs := GetConfig().DevCerts
+	assert.False(t, certs.Enabled)
+	assert.Equal(t, utils.AbsPath(DefaultDevCertsDir), certs.Dir)
+	assert.Equal(t, DefaultDevCertsDomains, certs.Domains)
+
+	cfg.Set("dev_certs.enabled", true)
+	cfg.Set("dev_certs.dir", "/tmp/cozy-certs")
+	cfg.Set("dev_certs.domains", []string{"cozy.local"})
+	UseViper(cfg)
+	certs = GetConfig().DevCerts
+	assert.True(t, certs.Enabled)
+	assert.Equal(t, "/tmp/cozy-certs", certs.Dir)
+	assert.Equal(t, []string{"cozy.local"}, certs.Domains)
+}
+
+func TestInstalls(t *testing.T) {
+	cfg := viper.New()
+	UseViper(cfg)
+	installs := GetConfig().Installs
+	assert.Equal(t, DefaultInstallsConcurrency, installs.Concurrency)
+	assert.Equal(t, DefaultInstallsPerInstance, installs.PerInstance)
+	assert.Empty(t, installs.AllowedSources)
+	assert.False(t, installs.ResumeInterrupted)
+
+	cfg.Set("installs.concurrency", 0)
+	cfg.Set("installs.per_instance", 1)
+	cfg.Set("installs.allowed_sources", []string{"registry://*", "git://github.com/cozy/*"})
+	cfg.Set("installs.resume_interrupted", true)
+	UseViper(cfg)
+	installs = GetConfig().Installs
+	assert.Equal(t, 0, installs.Concurrency)
+	assert.Equal(t, 1, installs.PerInstance)
+	assert.Equal(t, []string{"registry://*", "git://github.com/cozy/*"}, installs.AllowedSources)
+	assert.True(t, installs.ResumeInterrupted)
+}
+
+func TestContexts(t *testing.T) {
+	cfg := viper.New()
+	UseViper(cfg)
+	assert.Empty(t, GetConfig().Contexts)
+
+	cfg.SetConfigType("yaml")
+	err := cfg.ReadConfig(strings.NewReader(`
+contexts:
+  default:
+    default_apps: [drive, photos]
+    permission_templates:
+      contacts-sharing:
+        contacts:
+          type: io.cozy.contacts
+          verbs: [GET]
+  partner:
+    default_apps: []
+`))
+	assert.NoError(t, err)
+	UseViper(cfg)
+	contexts := GetConfig().Contexts
+	assert.Len(t, contexts, 2)
+	assert.Equal(t, []string{"drive", "photos"}, contexts[DefaultContext].DefaultApps)
+	assert.Empty(t, contexts["partner"].DefaultApps)
+	tmpl := contexts[DefaultContext].PermissionTemplates["contacts-sharing"]
+	assert.JSONEq(t, `{"contacts":{"type":"io.cozy.contacts","verbs":["GET"]}}`, string(tmpl))
+	assert.Empty(t, contexts["partner"].PermissionTemplates)
+}
+
+func TestDoctypesPolicies(t *testing.T) {
+	cfg := viper.New()
+	UseViper(cfg)
+	assert.Empty(t, GetConfig().Doctypes)
+
+	cfg.SetConfigType("yaml")
+	err := cfg.ReadConfig(strings.NewReader(`
+permissions:
+  forbidden_doctypes:
+    share:
+      read: [io.cozy.settings, io.cozy.oauth.clients]
+    app:
+      write: [io.cozy.contacts]
+`))
+	assert.NoError(t, err)
+	UseViper(cfg)
+	policies := GetConfig().Doctypes
+	assert.Len(t, policies, 2)
+	assert.Equal(t, []string{"io.cozy.settings", "io.cozy.oauth.clients"}, policies["share"].Read)
+	assert.Empty(t, policies["share"].Write)
+	assert.Equal(t, []string{"io.cozy.contacts"}, policies["app"].Write)
+}
+
+func TestLifecycle(t *testing.T) {
+	cfg := viper.New()
+	UseViper(cfg)
+	lc := GetConfig().Lifecycle
+	assert.Empty(t, lc.Hooks)
+	assert.Equal(t, DefaultLifecycleRetries, lc.Retries)
+	assert.Equal(t, DefaultLifecycleRetryDelay, lc.RetryDelay)
+	assert.Equal(t, DefaultLifecycleTimeout, lc.Timeout)
+
+	cfg.SetConfigType("yaml")
+	err := cfg.ReadConfig(strings.NewReader(`
+lifecycle:
+  retries: 5
+  timeout: 1m
+  dead_letters: /var/log/cozy/lifecycle.log
+  hooks:
+    created:
+      - command: /usr/local/bin/provision-dns
+      - url: https://billing.example.com/cozy
+    archived:
+      - command: /usr/local/bin/archive
+`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	UseViper(cfg)
+	lc = GetConfig().Lifecycle
+	assert.Equal(t, 5, lc.Retries)
+	assert.Equal(t, time.Minute, lc.Timeout)
+	assert.Equal(t, "/var/log/cozy/lifecycle.log", lc.DeadLetters)
+	assert.Equal(t, []LifecycleHook{
+		{Command: "/usr/local/bin/provision-dns"},
+		{URL: "https://billing.example.com/cozy"},
+	}, lc.Hooks[LifecycleCreated])
+	assert.NotContains(t, lc.Hooks, "archived")
+}
@@ -4,14 +4,41 @@ package consts
 const Instances = "instances"
 
 const (
+	// Accounts doc type for the external accounts of the user (mail, bank...)
+	Accounts = "io.cozy.accounts"
 	// Apps doc type for application manifests
 	Apps = "io.cozy.apps"
+	// AppsUsage doc type for the daily usage of the applications
+	AppsUsage = "io.cozy.apps.usage"
+	// AppsVersions doc type for the versions of the applications that have
+	// been installed
+	AppsVersions = "io.cozy.apps.versions"
+	// AppsIntents doc type for the applications that can handle an intent
+	AppsIntents = "io.cozy.apps.intents"
 	// Archives doc type for zip archives with files and directories
 	Archives = "io.cozy.files.archives"
+	// BankOperations doc type for the operations of the bank accounts
+	BankOperations = "io.cozy.bank.operations"
+	// Bills doc type for the bills fetched by the konnectors
+	Bills = "io.cozy.bills"
+	// Contacts doc type for the contacts of the user
+	Contacts = "io.cozy.contacts"
 	// Doctypes doc type for doctype list
 	Doctypes = "io.cozy.doctypes"
+	// Emails doc type for the emails imported from the mail accounts
+	Emails = "io.cozy.emails"
+	// EmailsFolders doc type for the synchronization state of the mail folders
+	EmailsFolders = "io.cozy.emails.folders"
+	// Events doc type for the calendar events
+	Events = "io.cozy.events"
+	// EventsSchedulings doc type for the state of the invitations sent for the
+	// events
+	EventsSchedulings = "io.cozy.events.schedulings"
 	// Files doc type for type for files and directories
 	Files = "io.cozy.files"
+	// FilesVersions doc type for the previous versions of the content of the
+	// files
+	FilesVersions = "io.cozy.files.versions"
 	// Jobs doc type for queued jobs
 	Jobs = "io.cozy.jobs"
 	// OAuthAccessCodes doc type for OAuth2 access codes
@@ -60,8 +87,14 @@ const (
 const (
 	// DiskUsageID is the id of the settings JSON-API response for disk-usage
 	DiskUsageID = "io.cozy.settings.disk-usage"
+	// LocaleID is the id of the settings JSON-API response for the metadata
+	// of the locale
+	LocaleID = "io.cozy.settings.locale"
 	// InstanceSettingsID is the id of settings document for the instance
 	InstanceSettingsID = "io.cozy.settings.instance"
+	// VFSGCStatsID is the id of the settings document with the statistics of
+	// the last run of the garbage collector of the VFS
+	VFSGCStatsID = "io.cozy.settings.vfs-gc"
 )
 
 const (
@@ -83,12 +116,3 @@ const (
 	// ErrorSharingStatus is when the request could not be sent
 	ErrorSharingStatus = "error"
 )
-
-// AppsRegistry is an hard-coded list of known apps, with their source URLs
-// TODO remove it when we will have a true registry
-var AppsRegistry = map[string]string{
-	"onboarding": "git://github.com/cozy/cozy-onboarding-v3.git#build",
-	"files":      "git://github.com/cozy/cozy-files-v3.git#build",
-	"photos":     "git://github.com/cozy/cozy-photos-v3.git#build",
-	"settings":   "git://github.com/cozy/cozy-settings.git#build",
-}
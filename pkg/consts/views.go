@@ -1,6 +1,8 @@
 package consts
 
 import (
+	"strconv"
+
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
 )
@@ -9,19 +11,30 @@ import (
 // properly.
 var GlobalIndexes = []*mango.Index{
 	mango.IndexOnFields(Instances, "domain"),
+	// Used to search the instances, see instance.Search
+	mango.IndexOnFields(Instances, "locale"),
+	mango.IndexOnFields(Instances, "context"),
+	mango.IndexOnFields(Instances, "email_domain"),
 }
 
 // Indexes is the index list required by an instance to run properly.
 var Indexes = []*mango.Index{
+	// Apps usage and versions
+	mango.IndexOnFields(AppsUsage, "day"),
+	mango.IndexOnFields(AppsVersions, "slug"),
 	// Permissions
 	mango.IndexOnFields(Permissions, "source_id", "type"),
 	// Sharings
 	mango.IndexOnFields(Sharings, "sharing_id"),
+	// Used to remove the emails of a folder after a change of UIDVALIDITY
+	mango.IndexOnFields(Emails, "account", "folder", "uidvalidity"),
 
 	// Used to lookup a file given its parent, and the children of a directory
 	mango.IndexOnFields(Files, "dir_id", "name"),
 	// Used to lookup a directory given its path
 	mango.IndexOnFields(Files, "path"),
+	// Used to lookup the files with the same content, see fs.dedup
+	mango.IndexOnFields(Files, "sha256sum"),
 }
 
 // DiskUsageView is the view used for computing the disk usage
@@ -36,6 +49,31 @@ function(doc) {
 }
 `,
 	Reduce: "_sum",
+	MemoryMap: func(doc map[string]interface{}, emit func(key, value interface{})) {
+		if doc["type"] == "file" {
+			emit(doc["_id"], toNumber(doc["size"]))
+		}
+	},
+}
+
+// DirSizesView is the view used for computing the size of the files in each
+// directory, without the sub-directories. The key is the id of the directory.
+var DirSizesView = &couchdb.View{
+	Name:    "dir-sizes",
+	Doctype: Files,
+	Map: `
+function(doc) {
+  if (doc.type === 'file') {
+    emit(doc.dir_id, +doc.size);
+  }
+}
+`,
+	Reduce: "_sum",
+	MemoryMap: func(doc map[string]interface{}, emit func(key, value interface{})) {
+		if doc["type"] == "file" {
+			emit(doc["dir_id"], toNumber(doc["size"]))
+		}
+	},
 }
 
 // FilesReferencedByView is the view used for fetching files referenced by a
@@ -51,6 +89,17 @@ function(doc) {
     }
   }
 }`,
+	MemoryMap: func(doc map[string]interface{}, emit func(key, value interface{})) {
+		refs, ok := doc["referenced_by"].([]interface{})
+		if doc["type"] != "file" || !ok {
+			return
+		}
+		for _, ref := range refs {
+			if r, ok := ref.(map[string]interface{}); ok {
+				emit([]interface{}{r["type"], r["id"]}, nil)
+			}
+		}
+	},
 }
 
 // PermissionsShareByCView is the view for fetching the permissions associated
@@ -66,6 +115,15 @@ function(doc) {
     })
   }
 }`,
+	MemoryMap: func(doc map[string]interface{}, emit func(key, value interface{})) {
+		codes, ok := doc["codes"].(map[string]interface{})
+		if doc["type"] != "share" || !ok {
+			return
+		}
+		for _, code := range codes {
+			emit(code, nil)
+		}
+	},
 }
 
 // PermissionsShareByDocView is the view for fetching a list of permissions
@@ -85,14 +143,89 @@ function(doc){
     });
   }
 }`,
+	MemoryMap: func(doc map[string]interface{}, emit func(key, value interface{})) {
+		perms, ok := doc["permissions"].(map[string]interface{})
+		if doc["type"] != "share" || !ok {
+			return
+		}
+		for _, perm := range perms {
+			p, ok := perm.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			selector, _ := p["selector"].(string)
+			if selector == "" {
+				selector = "_id"
+			}
+			values, _ := p["values"].([]interface{})
+			for _, value := range values {
+				emit([]interface{}{p["type"], selector, value}, p["verbs"])
+			}
+		}
+	},
+}
+
+// PermissionsShareByDoctypeView is the view for paginating the share
+// permissions docs with a rule on a doctype. The key is the doctype and the id
+// of the permissions doc.
+var PermissionsShareByDoctypeView = &couchdb.View{
+	Name:    "byDoctype",
+	Doctype: Permissions,
+	Map: `
+function(doc) {
+  if (doc.type === "share" && doc.permissions) {
+    var seen = {};
+    Object.keys(doc.permissions).forEach(function(k) {
+      var t = doc.permissions[k].type;
+      if (t && !seen[t]) {
+        seen[t] = true;
+        emit([t, doc._id]);
+      }
+    });
+  }
+}`,
+	MemoryMap: func(doc map[string]interface{}, emit func(key, value interface{})) {
+		perms, ok := doc["permissions"].(map[string]interface{})
+		if doc["type"] != "share" || !ok {
+			return
+		}
+		seen := make(map[string]bool)
+		for _, perm := range perms {
+			p, ok := perm.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			doctype, _ := p["type"].(string)
+			if doctype != "" && !seen[doctype] {
+				seen[doctype] = true
+				emit([]interface{}{doctype, doc["_id"]}, nil)
+			}
+		}
+	},
 }
 
 // Views is the list of all views that are created by the stack.
 var Views = []*couchdb.View{
 	DiskUsageView,
+	DirSizesView,
 	FilesReferencedByView,
 	PermissionsShareByCView,
 	PermissionsShareByDocView,
+	PermissionsShareByDoctypeView,
+}
+
+// DesignMigrations is the registry of the versions of the indexes and the
+// views of the databases of an instance. Indexes and Views are the state of
+// the last version: a new index or view must be added to them, and to a new
+// version here, to be defined on the existing instances.
+var DesignMigrations = couchdb.DesignMigrations{
+	{Version: 1, Indexes: Indexes, Views: Views},
+}
+
+// GlobalDesignMigrations is the registry of the versions of the indexes of
+// the global databases.
+var GlobalDesignMigrations = couchdb.DesignMigrations{
+	{Version: 1, Indexes: GlobalIndexes},
 }
 
 // ViewsByDoctype returns the list of views for a specified doc type.
@@ -106,6 +239,19 @@ func ViewsByDoctype(doctype string) []*couchdb.View {
 	return views
 }
 
+// toNumber converts a value to a number, like the unary + in javascript,
+// for the views of the in-memory backend.
+func toNumber(v interface{}) float64 {
+	switch v := v.(type) {
+	case float64:
+		return v
+	case string:
+		f, _ := strconv.ParseFloat(v, 64)
+		return f
+	}
+	return 0
+}
+
 // IndexesByDoctype returns the list of indexes for a specified doc type.
 func IndexesByDoctype(doctype string) []*mango.Index {
 	var indexes []*mango.Index
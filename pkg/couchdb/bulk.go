@@ -0,0 +1,164 @@
+package couchdb
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// BulkDocError is the error for one of the documents of a bulk operation
+type BulkDocError struct {
+	Doc Doc
+	Err *Error
+}
+
+// BulkError is returned by the bulk operations when some documents could not
+// be saved. The other documents have been saved, and their SetID and SetRev
+// functions have been called.
+type BulkError []*BulkDocError
+
+func (e BulkError) Error() string {
+	msgs := make([]string, len(e))
+	for i, docErr := range e {
+		msgs[i] = fmt.Sprintf("%s: %s", docErr.Doc.ID(), docErr.Err.Error())
+	}
+	return "Bulk operation failed for " + strings.Join(msgs, ", ")
+}
+
+// IsBulkError returns whether or not the given error is a BulkError
+func IsBulkError(err error) (BulkError, bool) {
+	bulkErr, ok := err.(BulkError)
+	return bulkErr, ok
+}
+
+// bulkErrorsStatus are the HTTP status of the errors that CouchDB can give
+// for a document in the response of _bulk_docs
+var bulkErrorsStatus = map[string]int{
+	"bad_request":  http.StatusBadRequest,
+	"unauthorized": http.StatusUnauthorized,
+	"forbidden":    http.StatusForbidden,
+	"not_found":    http.StatusNotFound,
+	"conflict":     http.StatusConflict,
+}
+
+type bulkDeletion struct {
+	ID      string `json:"_id"`
+	Rev     string `json:"_rev"`
+	Deleted bool   `json:"_deleted"`
+}
+
+// BulkCreateDocs persists several documents of a doctype in one request. The
+// documents can have an ID, else CouchDB gives them one, but no rev. The
+// database is created if it does not exist.
+func BulkCreateDocs(db Database, doctype string, docs []Doc) error {
+	body := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		if err := checkBulkDoc(doctype, doc); err != nil {
+			return err
+		}
+		if doc.Rev() != "" {
+			return fmt.Errorf("BulkCreateDocs docs should have no rev")
+		}
+		body[i] = doc
+	}
+	err := bulkDocs(db, doctype, docs, body)
+	if IsNoDatabaseError(err) {
+		if err = CreateDB(db, doctype); err == nil {
+			err = bulkDocs(db, doctype, docs, body)
+		}
+	}
+	return err
+}
+
+// BulkUpdateDocs updates several documents of a doctype in one request. The
+// documents should have an ID and a rev.
+func BulkUpdateDocs(db Database, doctype string, docs []Doc) error {
+	body := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		if err := checkBulkDoc(doctype, doc); err != nil {
+			return err
+		}
+		if doc.ID() == "" || doc.Rev() == "" {
+			return fmt.Errorf("BulkUpdateDocs docs should have id and rev")
+		}
+		body[i] = doc
+	}
+	return fixErrorNoDatabaseIsWrongDoctype(bulkDocs(db, doctype, docs, body))
+}
+
+// BulkDeleteDocs deletes several documents of a doctype in one request. The
+// documents should have an ID and a rev. Their SetRev functions are called
+// with the tombstone revisions.
+func BulkDeleteDocs(db Database, doctype string, docs []Doc) error {
+	body := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		if err := checkBulkDoc(doctype, doc); err != nil {
+			return err
+		}
+		if doc.ID() == "" || doc.Rev() == "" {
+			return fmt.Errorf("BulkDeleteDocs docs should have id and rev")
+		}
+		body[i] = &bulkDeletion{ID: doc.ID(), Rev: doc.Rev(), Deleted: true}
+	}
+	err := bulkDocs(db, doctype, docs, body)
+	deleted := len(docs)
+	if bulkErr, ok := IsBulkError(err); ok {
+		deleted -= len(bulkErr)
+	} else if err != nil {
+		deleted = 0
+	}
+	countDeletes(db, doctype, deleted)
+	return fixErrorNoDatabaseIsWrongDoctype(err)
+}
+
+func checkBulkDoc(doctype string, doc Doc) error {
+	if doc.DocType() != doctype {
+		return fmt.Errorf("Bulk operation on %s with a %s doc", doctype, doc.DocType())
+	}
+	_, err := validateDocID(doc.ID())
+	return err
+}
+
+// bulkDocs sends the body of the documents to _bulk_docs, and reports the
+// result of each of them, in the same order, on the documents.
+func bulkDocs(db Database, doctype string, docs []Doc, body []interface{}) error {
+	if len(docs) == 0 {
+		return nil
+	}
+	req := struct {
+		Docs []interface{} `json:"docs"`
+	}{
+		Docs: body,
+	}
+	var res []*bulkResponse
+	url := makeDBName(db, doctype) + "/_bulk_docs"
+	if err := makeRequest("POST", url, &req, &res); err != nil {
+		return err
+	}
+	if len(res) != len(docs) {
+		return fmt.Errorf("CouchDB replied with %d results for %d docs", len(res), len(docs))
+	}
+	var errs BulkError
+	for i, r := range res {
+		if r.Error != "" {
+			status, ok := bulkErrorsStatus[r.Error]
+			if !ok {
+				status = http.StatusInternalServerError
+			}
+			errs = append(errs, &BulkDocError{Doc: docs[i], Err: &Error{
+				StatusCode: status,
+				Name:       r.Error,
+				Reason:     r.Reason,
+			}})
+			continue
+		}
+		if docs[i].ID() == "" {
+			docs[i].SetID(r.ID)
+		}
+		docs[i].SetRev(r.Rev)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package couchdb
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+)
+
+// cacheMaxEntries is the maximal number of documents kept in the cache
+const cacheMaxEntries = 10000
+
+// cachedDoctypes are the doctypes whose documents are kept in the cache
+var cachedDoctypes = make(map[string]bool)
+
+// CacheDoctypes enables the read-through cache of GetDoc for the documents
+// of some doctypes. It is meant for the documents that are read on most
+// requests and rarely written, like the settings, the manifests of the
+// applications and the permissions. The cache is used only if the
+// couchdb.cache_ttl option of the configuration is set.
+func CacheDoctypes(doctypes ...string) {
+	docCache.mu.Lock()
+	defer docCache.mu.Unlock()
+	for _, doctype := range doctypes {
+		cachedDoctypes[doctype] = true
+	}
+}
+
+// cachedDoc is a document kept in the cache, with its revision and the last
+// time it was known to be the current version.
+type cachedDoc struct {
+	raw       json.RawMessage
+	rev       string
+	checkedAt time.Time
+}
+
+// documentsCache keeps the documents by database name, and by path. The
+// writes made with this package invalidate the documents, and the writes
+// made by another process are detected when a document is older than the
+// TTL: its revision is checked with a HEAD request.
+type documentsCache struct {
+	mu    sync.Mutex
+	dbs   map[string]map[string]*cachedDoc
+	count int
+	// gen is incremented on every write, so that a document fetched during
+	// a write is not put in the cache
+	gen uint64
+}
+
+var docCache = &documentsCache{dbs: make(map[string]map[string]*cachedDoc)}
+
+// isCached returns true if the documents of the doctype are cached, and the
+// TTL of the cache, from the configuration.
+func isCached(doctype string) (time.Duration, bool) {
+	ttl := config.GetConfig().CouchDB.CacheTTL
+	if ttl <= 0 {
+		return 0, false
+	}
+	docCache.mu.Lock()
+	defer docCache.mu.Unlock()
+	return ttl, cachedDoctypes[doctype]
+}
+
+// getCachedDoc is GetDoc for the cached doctypes
+func getCachedDoc(db Database, doctype, id string, ttl time.Duration, out Doc) error {
+	dbname := makeDBName(db, doctype)
+	path := docURL(db, doctype, id)
+	if raw, ok := docCache.get(dbname, path, ttl); ok {
+		return json.Unmarshal(raw, out)
+	}
+	gen := docCache.generation()
+	var raw json.RawMessage
+	if err := makeRequest("GET", path, nil, &raw); err != nil {
+		return fixErrorNoDatabaseIsWrongDoctype(err)
+	}
+	docCache.put(dbname, path, raw, gen)
+	return json.Unmarshal(raw, out)
+}
+
+func (c *documentsCache) generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// get returns a cached document. If it has not been checked for the TTL,
+// its revision is compared to the current one in CouchDB.
+func (c *documentsCache) get(dbname, path string, ttl time.Duration) (json.RawMessage, bool) {
+	c.mu.Lock()
+	doc, ok := c.dbs[dbname][path]
+	if !ok {
+		c.mu.Unlock()
+		return nil, false
+	}
+	raw, rev, fresh := doc.raw, doc.rev, time.Since(doc.checkedAt) < ttl
+	gen := c.gen
+	c.mu.Unlock()
+	if fresh {
+		return raw, true
+	}
+
+	current, ok := headRev(path)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !ok || current != rev {
+		c.remove(dbname, path)
+		return nil, false
+	}
+	if c.gen == gen {
+		doc.checkedAt = time.Now()
+	}
+	return raw, true
+}
+
+// put adds a document to the cache, unless a write has been made since the
+// generation gen.
+func (c *documentsCache) put(dbname, path string, raw json.RawMessage, gen uint64) {
+	var doc struct {
+		Rev string `json:"_rev"`
+	}
+	if err := json.Unmarshal(raw, &doc); err != nil || doc.Rev == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gen != gen {
+		return
+	}
+	if c.count >= cacheMaxEntries {
+		c.dbs = make(map[string]map[string]*cachedDoc)
+		c.count = 0
+	}
+	docs, ok := c.dbs[dbname]
+	if !ok {
+		docs = make(map[string]*cachedDoc)
+		c.dbs[dbname] = docs
+	}
+	if _, ok = docs[path]; !ok {
+		c.count++
+	}
+	docs[path] = &cachedDoc{raw: raw, rev: doc.Rev, checkedAt: time.Now()}
+}
+
+// invalidate removes from the cache the documents that can be modified by
+// a write request on path: a document, or all the documents of a database
+// for a bulk request or a request on the database itself.
+func (c *documentsCache) invalidate(path string) {
+	if pos := strings.IndexByte(path, '?'); pos >= 0 {
+		path = path[:pos]
+	}
+	dbname, rest := path, ""
+	if pos := strings.IndexByte(path, '/'); pos >= 0 {
+		dbname, rest = path[:pos], path[pos+1:]
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	docs, ok := c.dbs[dbname]
+	if !ok {
+		return
+	}
+	switch {
+	case rest == "" || strings.HasPrefix(rest, "_bulk_docs"):
+		c.count -= len(docs)
+		delete(c.dbs, dbname)
+	case !strings.HasPrefix(rest, "_"):
+		c.remove(dbname, path)
+	}
+}
+
+// remove deletes a document from the cache. The lock must be held.
+func (c *documentsCache) remove(dbname, path string) {
+	docs := c.dbs[dbname]
+	if _, ok := docs[path]; ok {
+		delete(docs, path)
+		c.count--
+	}
+}
+
+// headRev returns the current revision of a document, from the ETag header
+// of a HEAD request, or false if it can't be fetched.
+func headRev(path string) (string, bool) {
+	req, err := http.NewRequest(http.MethodHead, config.CouchURL()+path, nil)
+	if err != nil {
+		return "", false
+	}
+	res, err := doHTTP(httpClient(), req, path)
+	if err != nil {
+		return "", false
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", false
+	}
+	return strings.Trim(res.Header.Get("ETag"), `"`), true
+}
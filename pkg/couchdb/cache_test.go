@@ -0,0 +1,78 @@
+package couchdb
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDocCache(t *testing.T) {
+	doctype := "io.cozy.tests.cache"
+	defer DeleteDB(TestPrefix, doctype)
+	CacheDoctypes(doctype)
+	cfg := config.GetConfig()
+	cfg.CouchDB.CacheTTL = time.Hour
+	defer func() {
+		cfg.CouchDB.CacheTTL = 0
+		docCache.mu.Lock()
+		delete(cachedDoctypes, doctype)
+		docCache.mu.Unlock()
+	}()
+
+	doc := &JSONDoc{Type: doctype, M: map[string]interface{}{"value": "one"}}
+	if !assert.NoError(t, CreateDoc(TestPrefix, doc)) {
+		return
+	}
+	get := func() string {
+		out := &JSONDoc{Type: doctype}
+		if !assert.NoError(t, GetDoc(TestPrefix, doctype, doc.ID(), out)) {
+			return ""
+		}
+		return out.M["value"].(string)
+	}
+	assert.Equal(t, "one", get())
+
+	// A write made by another stack is not seen before the end of the TTL
+	path := docURL(TestPrefix, doctype, doc.ID())
+	body, _ := json.Marshal(map[string]interface{}{"_rev": doc.Rev(), "value": "two"})
+	var res updateResponse
+	if !assert.NoError(t, doRequest(httpClient(), "PUT", path, body, true, &res)) {
+		return
+	}
+	assert.Equal(t, "one", get())
+	cfg.CouchDB.CacheTTL = time.Nanosecond
+	assert.Equal(t, "two", get())
+
+	// A write made with this package invalidates the cache
+	cfg.CouchDB.CacheTTL = time.Hour
+	doc.SetRev(res.Rev)
+	doc.M["value"] = "three"
+	assert.NoError(t, UpdateDoc(TestPrefix, doc))
+	assert.Equal(t, "three", get())
+	assert.NoError(t, DeleteDoc(TestPrefix, doc))
+	err := GetDoc(TestPrefix, doctype, doc.ID(), &JSONDoc{Type: doctype})
+	assert.True(t, IsNotFoundError(err))
+}
+
+func TestDocCacheInvalidate(t *testing.T) {
+	c := &documentsCache{dbs: make(map[string]map[string]*cachedDoc)}
+	c.put("db", "db/a", json.RawMessage(`{"_rev":"1-a"}`), 0)
+	c.put("db", "db/b", json.RawMessage(`{"_rev":"1-b"}`), 0)
+	c.put("other", "other/a", json.RawMessage(`{"_rev":"1-a"}`), 0)
+	assert.Equal(t, 3, c.count)
+
+	c.invalidate("db/_index")
+	assert.Equal(t, 3, c.count)
+	c.put("db", "db/c", json.RawMessage(`{"_rev":"1-c"}`), 0)
+	assert.Equal(t, 3, c.count, "a document fetched before a write is not cached")
+
+	c.invalidate("db/a?rev=1-a")
+	assert.Equal(t, 2, c.count)
+	c.invalidate("db/_bulk_docs")
+	assert.Equal(t, 1, c.count)
+	c.invalidate("other")
+	assert.Equal(t, 0, c.count)
+}
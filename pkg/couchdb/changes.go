@@ -14,8 +14,13 @@ type ChangesFeedMode string
 type ChangesFeedStyle string
 
 const (
-	// ChangesModeNormal is the only mode supported by cozy-stack
+	// ChangesModeNormal is the only mode supported by the changes route of
+	// the data API
 	ChangesModeNormal ChangesFeedMode = "normal"
+	// ChangesModeLongpoll waits for a change before sending the response
+	ChangesModeLongpoll ChangesFeedMode = "longpoll"
+	// ChangesModeContinuous sends the changes as they happen
+	ChangesModeContinuous ChangesFeedMode = "continuous"
 	// ChangesStyleAllDocs pass all revisions including conflicts
 	ChangesStyleAllDocs ChangesFeedStyle = "all_docs"
 	// ChangesStyleMainOnly only pass the winning revision
@@ -115,6 +120,7 @@ type Change struct {
 	DocID   string  `json:"id"`
 	Seq     string  `json:"seq"`
 	Doc     JSONDoc `json:"doc"`
+	Deleted bool    `json:"deleted,omitempty"`
 	Changes []struct {
 		Rev string `json:"rev"`
 	} `json:"changes"`
@@ -0,0 +1,75 @@
+package couchdb
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+)
+
+// The clients for CouchDB share a pool of connections. They are built from
+// the configuration on the first request, and built again if it changes.
+var (
+	clientsMu       sync.Mutex
+	clientsSettings clientSettings
+	requestClient   *http.Client
+	feedClient      *http.Client
+)
+
+// clientSettings are the values of the configuration of CouchDB used to
+// build the clients. The other values, like the _security object, can change
+// without closing the connections.
+type clientSettings struct {
+	MaxIdleConns    int
+	IdleConnTimeout time.Duration
+	DialTimeout     time.Duration
+	RequestTimeout  time.Duration
+}
+
+// couchClients returns the HTTP client for the requests to CouchDB, and the
+// one for the changes feeds, that has no timeout.
+func couchClients() (*http.Client, *http.Client) {
+	couch := config.GetConfig().CouchDB
+	cfg := clientSettings{
+		MaxIdleConns:    couch.MaxIdleConns,
+		IdleConnTimeout: couch.IdleConnTimeout,
+		DialTimeout:     couch.DialTimeout,
+		RequestTimeout:  couch.RequestTimeout,
+	}
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	if requestClient != nil && cfg == clientsSettings {
+		return requestClient, feedClient
+	}
+	if requestClient != nil {
+		requestClient.Transport.(*http.Transport).CloseIdleConnections()
+	}
+	transport := newTransport(cfg)
+	requestClient = &http.Client{
+		Transport: transport,
+		Timeout:   cfg.RequestTimeout,
+	}
+	feedClient = &http.Client{
+		Transport: transport,
+	}
+	clientsSettings = cfg
+	return requestClient, feedClient
+}
+
+func newTransport(cfg clientSettings) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   cfg.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		MaxIdleConns:          cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConns,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
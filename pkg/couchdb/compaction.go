@@ -0,0 +1,109 @@
+package couchdb
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+)
+
+// compactionBody is sent with the requests of compaction, as CouchDB only
+// accepts them with a JSON content-type
+var compactionBody = struct{}{}
+
+// deletesCounter counts the documents deleted by this stack in each
+// database since its last compaction, to compact it after heavy deletes.
+var deletesCounter = struct {
+	sync.Mutex
+	dbs map[string]int
+}{dbs: make(map[string]int)}
+
+var (
+	heavyDeletesMu      sync.RWMutex
+	heavyDeletesHandler func(db Database, doctype string)
+)
+
+// OnHeavyDeletes registers the function called when the number of documents
+// of a database deleted by this stack since its last compaction reaches
+// couchdb.compaction.deletes. It is used to push a compaction job.
+func OnHeavyDeletes(fn func(db Database, doctype string)) {
+	heavyDeletesMu.Lock()
+	heavyDeletesHandler = fn
+	heavyDeletesMu.Unlock()
+}
+
+// countDeletes adds n deleted documents to the counter of the database of a
+// doctype, and calls the handler of OnHeavyDeletes when it reaches the
+// threshold of the configuration.
+func countDeletes(db Database, doctype string, n int) {
+	threshold := config.GetConfig().CouchDB.CompactionDeletes
+	if n <= 0 || threshold <= 0 {
+		return
+	}
+	dbname := makeDBName(db, doctype)
+	deletesCounter.Lock()
+	before := deletesCounter.dbs[dbname]
+	deletesCounter.dbs[dbname] = before + n
+	deletesCounter.Unlock()
+	if before >= threshold || before+n < threshold {
+		return
+	}
+	heavyDeletesMu.RLock()
+	fn := heavyDeletesHandler
+	heavyDeletesMu.RUnlock()
+	if fn != nil {
+		go fn(db, doctype)
+	}
+}
+
+// Fragmentation returns the part of the file of a database that is not used
+// by its documents, and that is recovered by a compaction.
+func (s *DBStatusResponse) Fragmentation() float64 {
+	if s.Sizes.File <= 0 || s.Sizes.Active >= s.Sizes.File {
+		return 0
+	}
+	return float64(s.Sizes.File-s.Sizes.Active) / float64(s.Sizes.File)
+}
+
+// CompactDB starts the compaction of the database of a doctype and of its
+// view indexes, and removes the indexes of the views that no longer exist.
+// The compactions are run by CouchDB in the background.
+func CompactDB(db Database, doctype string) error {
+	dbname := makeDBName(db, doctype)
+	if err := makeRequest("POST", dbname+"/_compact", &compactionBody, nil); err != nil {
+		return err
+	}
+	deletesCounter.Lock()
+	delete(deletesCounter.dbs, dbname)
+	deletesCounter.Unlock()
+
+	ddocs, err := designDocs(db, doctype)
+	if err != nil {
+		return err
+	}
+	for _, ddoc := range ddocs {
+		path := dbname + "/_compact/" + strings.TrimPrefix(ddoc, "_design/")
+		if err = makeRequest("POST", path, &compactionBody, nil); err != nil {
+			return err
+		}
+	}
+	return makeRequest("POST", dbname+"/_view_cleanup", &compactionBody, nil)
+}
+
+// designDocs returns the ids of the design docs of the database of a doctype
+func designDocs(db Database, doctype string) ([]string, error) {
+	v := url.Values{}
+	v.Set("startkey", `"_design/"`)
+	v.Set("endkey", `"_design0"`)
+	var res AllDocsResponse
+	path := makeDBName(db, doctype) + "/_all_docs?" + v.Encode()
+	if err := makeRequest("GET", path, nil, &res); err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(res.Rows))
+	for i, row := range res.Rows {
+		ids[i] = row.ID
+	}
+	return ids, nil
+}
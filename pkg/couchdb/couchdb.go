@@ -14,6 +14,7 @@ import (
 	log "github.com/Sirupsen/logrus"
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	"github.com/cozy/cozy-stack/pkg/couchdb/memdb"
 	"github.com/google/go-querystring/query"
 	"github.com/labstack/echo"
 )
@@ -56,6 +57,9 @@ type View struct {
 	Doctype string `json:"-"`
 	Map     string `json:"map"`
 	Reduce  string `json:"reduce,omitempty"`
+	// MemoryMap is the Go equivalent of the Map function, used by the
+	// in-memory backend. The views without it can't be queried in memory.
+	MemoryMap memdb.MapFunc `json:"-"`
 }
 
 // JSONDoc is a map representing a simple json object that implements
@@ -145,8 +149,36 @@ func (j JSONDoc) Valid(field, value string) bool {
 	return fmt.Sprintf("%v", j.Get(field)) == value
 }
 
-var couchdbClient = &http.Client{
-	Timeout: 5 * time.Second,
+// memServer is the in-memory backend, used instead of a CouchDB server when
+// the configured URL has the mem:// scheme. It is only meant for the tests.
+var memServer = memdb.NewServer()
+
+var memClient = &http.Client{
+	Transport: memServer,
+}
+
+// InMemory returns true if the documents are kept in memory instead of a
+// CouchDB server
+func InMemory() bool {
+	return strings.HasPrefix(config.CouchURL(), "mem:")
+}
+
+func httpClient() *http.Client {
+	if InMemory() {
+		return memClient
+	}
+	client, _ := couchClients()
+	return client
+}
+
+// longHTTPClient is like httpClient, but without timeout, for the requests
+// that can last a long time, like the changes feeds and the replications.
+func longHTTPClient() *http.Client {
+	if InMemory() {
+		return memClient
+	}
+	_, client := couchClients()
+	return client
 }
 
 func unescapeCouchdbName(name string) string {
@@ -159,20 +191,16 @@ func escapeCouchdbName(name string) string {
 	return strings.ToLower(name)
 }
 
+// makeDBName returns the name of the database of db for a doctype, escaped
+// for an URL. See EncodeDBPrefix for the CouchDB-safe names.
 func makeDBName(db Database, doctype string) string {
-	// @TODO This should be better analysed
+	if prefix := dbPrefixOf(db); prefix != "" {
+		return url.QueryEscape(prefix + dbNameSeparator + encodeDBName(doctype))
+	}
 	dbname := escapeCouchdbName(db.Prefix() + doctype)
 	return url.QueryEscape(dbname)
 }
 
-func dbNameHasPrefix(dbname, dbprefix string) (bool, string) {
-	dbprefix = escapeCouchdbName(dbprefix)
-	if !strings.HasPrefix(dbname, dbprefix) {
-		return false, ""
-	}
-	return true, strings.Replace(dbname, dbprefix, "", 1)
-}
-
 func docURL(db Database, doctype, id string) string {
 	return makeDBName(db, doctype) + "/" + url.QueryEscape(id)
 }
@@ -192,16 +220,38 @@ func makeRequest(method, path string, reqbody interface{}, resbody interface{})
 		log.Debugf("[couchdb] request: %s %s %s", method, path, string(bytes.TrimSpace(reqjson)))
 	}
 
+	if !isReadRequest(method, path) {
+		defer docCache.invalidate(path)
+	}
+
+	retry := newRetrier()
+	for {
+		err = doRequest(httpClient(), method, path, reqjson, reqbody != nil, resbody)
+		if err == nil {
+			return nil
+		}
+		delay, ok := retry.next(method, path, err)
+		if !ok {
+			return err
+		}
+		log.Debugf("[couchdb] retry %s %s in %s after: %s", method, path, delay, err)
+		time.Sleep(delay)
+	}
+}
+
+// doRequest sends a request to CouchDB with the given client, and decodes its
+// response in resbody
+func doRequest(client *http.Client, method, path string, reqjson []byte, hasBody bool, resbody interface{}) error {
 	req, err := http.NewRequest(method, config.CouchURL()+path, bytes.NewReader(reqjson))
 	// Possible err = wrong method, unparsable url
 	if err != nil {
 		return newRequestError(err)
 	}
-	if reqbody != nil {
+	if hasBody {
 		req.Header.Add("Content-Type", "application/json")
 	}
 	req.Header.Add("Accept", "application/json")
-	resp, err := couchdbClient.Do(req)
+	resp, err := doHTTP(client, req, path)
 	// Possible err = mostly connection failure
 	if err != nil {
 		return newConnectionError(err)
@@ -241,7 +291,7 @@ func makeRequest(method, path string, reqbody interface{}, resbody interface{})
 
 func fixErrorNoDatabaseIsWrongDoctype(err error) error {
 	if IsNoDatabaseError(err) {
-		err.(*Error).Reason = "wrong_doctype"
+		err.(*Error).Reason = reasonWrongDoctype
 	}
 	return err
 }
@@ -260,12 +310,9 @@ func AllDoctypes(db Database) ([]string, error) {
 	if err := makeRequest("GET", "/_all_dbs", nil, &dbs); err != nil {
 		return nil, err
 	}
-	prefix := escapeCouchdbName(db.Prefix())
 	var doctypes []string
 	for _, dbname := range dbs {
-		parts := strings.SplitAfter(dbname, "/")
-		if len(parts) == 2 && parts[0] == prefix {
-			doctype := unescapeCouchdbName(parts[1])
+		if doctype, ok := doctypeOfDBName(db, dbname); ok {
 			doctypes = append(doctypes, doctype)
 		}
 	}
@@ -280,6 +327,9 @@ func GetDoc(db Database, doctype, id string, out Doc) error {
 	if err != nil {
 		return err
 	}
+	if ttl, ok := isCached(doctype); ok {
+		return getCachedDoc(db, doctype, id, ttl, out)
+	}
 	err = makeRequest("GET", docURL(db, doctype, id), nil, out)
 	if err != nil {
 		return fixErrorNoDatabaseIsWrongDoctype(err)
@@ -287,9 +337,21 @@ func GetDoc(db Database, doctype, id string, out Doc) error {
 	return nil
 }
 
-// CreateDB creates the necessary database for a doctype
+// CreateDB creates the necessary database for a doctype. It is a
+// partitioned database for the doctypes given to PartitionDoctypes, and its
+// _security object is the one of DefaultSecurity.
 func CreateDB(db Database, doctype string) error {
-	return makeRequest("PUT", makeDBName(db, doctype), nil, nil)
+	path := makeDBName(db, doctype)
+	if IsPartitioned(doctype) {
+		path += "?partitioned=true"
+	}
+	if err := makeRequest("PUT", path, nil, nil); err != nil {
+		return err
+	}
+	if sec := DefaultSecurity(); sec != nil {
+		return SetSecurity(db, doctype, sec)
+	}
+	return nil
 }
 
 // DeleteDB destroy the database for a doctype
@@ -314,8 +376,8 @@ func DeleteAllDBs(db Database) error {
 	}
 
 	for _, doctypedb := range dbsList {
-		hasPrefix, doctype := dbNameHasPrefix(doctypedb, dbprefix)
-		if !hasPrefix {
+		doctype, ok := doctypeOfDBName(db, doctypedb)
+		if !ok {
 			continue
 		}
 		if err = DeleteDB(db, doctype); err != nil {
@@ -335,6 +397,51 @@ func ResetDB(db Database, doctype string) error {
 	return CreateDB(db, doctype)
 }
 
+// DumpDB returns all the documents of the database for a doctype, including
+// the design documents, with their revisions. They can be given to LoadDB to
+// put the database back in the same state.
+func DumpDB(db Database, doctype string) ([]json.RawMessage, error) {
+	var response AllDocsResponse
+	url := makeDBName(db, doctype) + "/_all_docs?include_docs=true"
+	if err := makeRequest("GET", url, nil, &response); err != nil {
+		return nil, err
+	}
+	docs := make([]json.RawMessage, len(response.Rows))
+	for i, row := range response.Rows {
+		docs[i] = row.Doc
+	}
+	return docs, nil
+}
+
+// LoadDB destroy and recreate the database for a doctype, with the given
+// documents. The documents keep their revisions.
+func LoadDB(db Database, doctype string, docs []json.RawMessage) error {
+	if err := ResetDB(db, doctype); err != nil {
+		return err
+	}
+	if len(docs) == 0 {
+		return nil
+	}
+	req := struct {
+		Docs     []json.RawMessage `json:"docs"`
+		NewEdits bool              `json:"new_edits"`
+	}{
+		Docs:     docs,
+		NewEdits: false,
+	}
+	var res []*bulkResponse
+	url := makeDBName(db, doctype) + "/_bulk_docs"
+	if err := makeRequest("POST", url, &req, &res); err != nil {
+		return err
+	}
+	for _, r := range res {
+		if r.Error != "" {
+			return fmt.Errorf("Could not load the document %s: %s", r.ID, r.Reason)
+		}
+	}
+	return nil
+}
+
 // Delete destroy a document by its doctype and ID .
 // If the document's current rev does not match the one passed,
 // a CouchdbError(409 conflict) will be returned.
@@ -352,6 +459,7 @@ func Delete(db Database, doctype, id, rev string) (string, error) {
 	if err != nil {
 		return "", fixErrorNoDatabaseIsWrongDoctype(err)
 	}
+	countDeletes(db, doctype, 1)
 	return res.Rev, nil
 }
 
@@ -418,7 +526,7 @@ func CreateNamedDoc(db Database, doc Doc) error {
 // if it does not exist
 func CreateNamedDocWithDB(db Database, doc Doc) error {
 	err := CreateNamedDoc(db, doc)
-	if coucherr, ok := err.(*Error); ok && coucherr.Reason == "wrong_doctype" {
+	if IsNoDatabaseError(err) {
 		err = CreateDB(db, doc.DocType())
 		if err != nil {
 			return err
@@ -453,6 +561,15 @@ func CreateDoc(db Database, doc Doc) error {
 		return newDefinedIDError()
 	}
 
+	if IsPartitioned(doc.DocType()) {
+		doc.SetID(newPartitionedID(doc))
+		err := CreateNamedDocWithDB(db, doc)
+		if err != nil {
+			doc.SetID("")
+		}
+		return err
+	}
+
 	err := createDocOrDb(db, doc, &res)
 	if err != nil {
 		return err
@@ -465,7 +582,9 @@ func CreateDoc(db Database, doc Doc) error {
 	return nil
 }
 
-// DefineViews creates a design doc with some views
+// DefineViews creates a design doc with some views. If the design doc already
+// exists, its views are replaced. Like DefineIndexRaw, it creates the database
+// if it doesn't exist yet.
 func DefineViews(db Database, views []*View) error {
 	// group views by doctype
 	grouped := make(map[string]map[string]*View)
@@ -478,15 +597,38 @@ func DefineViews(db Database, views []*View) error {
 		g[v.Name] = v
 	}
 	for doctype, views := range grouped {
+		if InMemory() {
+			for _, v := range views {
+				if v.MemoryMap != nil {
+					memServer.DefineView(doctype, v.Name, v.MemoryMap, v.Reduce)
+				}
+			}
+		}
 		url := makeDBName(db, doctype) + "/_design/" + doctype
 		doc := struct {
+			Rev   string           `json:"_rev,omitempty"`
 			Lang  string           `json:"language"`
 			Views map[string]*View `json:"views"`
 		}{
+			"",
 			"javascript",
 			views,
 		}
 		err := makeRequest("PUT", url, &doc, nil)
+		if IsNoDatabaseError(err) {
+			if err = CreateDB(db, doctype); err == nil {
+				err = makeRequest("PUT", url, &doc, nil)
+			}
+		}
+		if IsConflictError(err) {
+			var old struct {
+				Rev string `json:"_rev"`
+			}
+			if err = makeRequest("GET", url, nil, &old); err == nil {
+				doc.Rev = old.Rev
+				err = makeRequest("PUT", url, &doc, nil)
+			}
+		}
 		if err != nil {
 			return err
 		}
@@ -509,6 +651,30 @@ func ExecView(db Database, view *View, req *ViewRequest, results interface{}) er
 	return makeRequest("GET", viewurl, nil, &results)
 }
 
+// ReduceViewQuery executes the reduce function of a view, and returns its
+// rows. The rows can be grouped by key, or by the first elements of the keys
+// that are arrays with the GroupLevel of the request, and be limited to a
+// range of keys. Without grouping, there is a single row for all the keys,
+// or no row if the view is empty.
+func ReduceViewQuery(db Database, view *View, req *ViewRequest) ([]ReduceRow, error) {
+	if view.Reduce == "" {
+		return nil, fmt.Errorf("The view %s has no reduce function", view.Name)
+	}
+	var reduceReq ViewRequest
+	if req != nil {
+		reduceReq = *req
+	}
+	reduceReq.Reduce = true
+	reduceReq.IncludeDocs = false
+	var response struct {
+		Rows []ReduceRow `json:"rows"`
+	}
+	if err := ExecView(db, view, &reduceReq, &response); err != nil {
+		return nil, err
+	}
+	return response.Rows, nil
+}
+
 // DefineIndex define the index on the doctype database
 // see query package on how to define an index
 func DefineIndex(db Database, index *mango.Index) error {
@@ -516,11 +682,18 @@ func DefineIndex(db Database, index *mango.Index) error {
 	return err
 }
 
-// DefineIndexRaw defines a index
+// DefineIndexRaw defines a index. The database of the doctype is created if
+// it does not exist yet, as CouchDB refuses to define an index on it.
 func DefineIndexRaw(db Database, doctype string, index interface{}) (*IndexCreationResponse, error) {
 	url := makeDBName(db, doctype) + "/_index"
 	var response IndexCreationResponse
-	return &response, makeRequest("POST", url, &index, &response)
+	err := makeRequest("POST", url, &index, &response)
+	if IsNoDatabaseError(err) {
+		if err = CreateDB(db, doctype); err == nil {
+			err = makeRequest("POST", url, &index, &response)
+		}
+	}
+	return &response, err
 }
 
 // DefineIndexes defines a list of indexes
@@ -539,42 +712,120 @@ func FindDocs(db Database, doctype string, req *FindRequest, results interface{}
 	return FindDocsRaw(db, doctype, req, results)
 }
 
+// FindDocsPage is like FindDocs, but it also returns the bookmark of the next
+// page, to put in the Bookmark field of the next request. It is empty for the
+// last page.
+func FindDocsPage(db Database, doctype string, req *FindRequest, results interface{}) (string, error) {
+	response, err := findDocs(db, doctype, req)
+	if err != nil {
+		return "", err
+	}
+	var docs []json.RawMessage
+	if err = json.Unmarshal(response.Docs, &docs); err != nil {
+		return "", err
+	}
+	limit := req.Limit
+	if limit <= 0 {
+		limit = defaultFindLimit
+	}
+	var next string
+	if len(docs) >= limit {
+		next = response.Bookmark
+	}
+	return next, json.Unmarshal(response.Docs, results)
+}
+
 // FindDocsRaw find documents
-// TODO: pagination
 func FindDocsRaw(db Database, doctype string, req interface{}, results interface{}) error {
-	url := makeDBName(db, doctype) + "/_find"
+	response, err := findDocs(db, doctype, req)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(response.Docs, results)
+}
+
+func findDocs(db Database, doctype string, req interface{}) (*findResponse, error) {
+	path := makeDBName(db, doctype) + "/_find"
+	if r, ok := req.(*FindRequest); ok && r.Partition != "" {
+		path = makeDBName(db, doctype) + "/_partition/" + url.QueryEscape(r.Partition) + "/_find"
+	}
+	if explainQueries() {
+		explainFind(db, doctype, path, req)
+	}
 	// prepare a structure to receive the results
 	var response findResponse
-	err := makeRequest("POST", url, &req, &response)
+	err := makeRequest("POST", path, &req, &response)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if response.Warning != "" {
 		// Developer should not rely on unoptimized index.
-		return unoptimalError()
+		return nil, unoptimalError()
 	}
-	return json.Unmarshal(response.Docs, results)
+	return &response, nil
 }
 
 // GetAllDocs returns all documents of a specified doctype. It filters
 // out the possible _design document.
-// TODO: pagination
 func GetAllDocs(db Database, doctype string, req *AllDocsRequest, results interface{}) error {
-	v, err := query.Values(req)
+	response, err := allDocs(db, doctype, req)
 	if err != nil {
 		return err
 	}
+	return unmarshalRows(response.Rows, results)
+}
+
+// GetAllDocsPage is like GetAllDocs, but it also returns the identifier of
+// the first document of the next page, to put in the StartKey field of the
+// next request. It is empty for the last page, and when there is no limit.
+func GetAllDocsPage(db Database, doctype string, req *AllDocsRequest, results interface{}) (string, error) {
+	if req.Limit <= 0 {
+		return "", GetAllDocs(db, doctype, req, results)
+	}
+	paged := *req
+	paged.Limit = req.Limit + 1
+	response, err := allDocs(db, doctype, &paged)
+	if err != nil {
+		return "", err
+	}
+	rows := response.Rows
+	var next string
+	if len(rows) > req.Limit {
+		next = rows[req.Limit].ID
+		rows = rows[:req.Limit]
+	}
+	return next, unmarshalRows(rows, results)
+}
+
+func allDocs(db Database, doctype string, req *AllDocsRequest) (*AllDocsResponse, error) {
+	v, err := query.Values(req)
+	if err != nil {
+		return nil, err
+	}
 	v.Add("include_docs", "true")
+	// the keys are JSON values for CouchDB
+	for _, key := range []string{"start_key", "end_key"} {
+		if val := v.Get(key); val != "" {
+			data, err := json.Marshal(val)
+			if err != nil {
+				return nil, err
+			}
+			v.Set(key, string(data))
+		}
+	}
 
 	var response AllDocsResponse
 	url := makeDBName(db, doctype) + "/_all_docs?" + v.Encode()
 	err = makeRequest("POST", url, &req, &response)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return &response, nil
+}
 
+func unmarshalRows(rows []AllDocsRow, results interface{}) error {
 	var docs []json.RawMessage
-	for _, row := range response.Rows {
+	for _, row := range rows {
 		if !strings.HasPrefix(row.ID, "_design") {
 			docs = append(docs, row.Doc)
 		}
@@ -604,7 +855,8 @@ func Proxy(db Database, doctype, path string) *httputil.ReverseProxy {
 	}
 
 	return &httputil.ReverseProxy{
-		Director: director,
+		Director:  director,
+		Transport: httpClient().Transport,
 	}
 }
 
@@ -630,19 +882,36 @@ type updateResponse struct {
 	Ok  bool   `json:"ok"`
 }
 
+type bulkResponse struct {
+	ID     string `json:"id"`
+	Rev    string `json:"rev,omitempty"`
+	Error  string `json:"error,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
 type findResponse struct {
-	Warning string          `json:"warning"`
-	Docs    json.RawMessage `json:"docs"`
+	Warning  string          `json:"warning"`
+	Docs     json.RawMessage `json:"docs"`
+	Bookmark string          `json:"bookmark,omitempty"`
 }
 
-// FindRequest is used to build a find request
+// defaultFindLimit is the number of documents returned by CouchDB for a find
+// request without limit
+const defaultFindLimit = 25
+
+// FindRequest is used to build a find request. The Bookmark is the one
+// returned by FindDocsPage for the previous page.
 type FindRequest struct {
 	Selector mango.Filter  `json:"selector"`
 	UseIndex string        `json:"use_index,omitempty"`
 	Limit    int           `json:"limit,omitempty"`
 	Skip     int           `json:"skip,omitempty"`
-	Sort     *mango.SortBy `json:"sort,omitempty"`
-	Fields   []string      `json:"fields,omitempty"`
+	Bookmark string        `json:"bookmark,omitempty"`
+	Sort     mango.SortBys `json:"sort,omitempty"`
+	Fields   mango.Fields  `json:"fields,omitempty"`
+	// Partition restricts the query to a partition of a partitioned
+	// database (see PartitionDoctypes)
+	Partition string `json:"-"`
 }
 
 // AllDocsRequest is used to build a _all_docs request
@@ -657,12 +926,15 @@ type AllDocsRequest struct {
 
 // AllDocsResponse is the response we receive from an _all_docs request
 type AllDocsResponse struct {
-	Offset    int `json:"offset"`
-	TotalRows int `json:"total_rows"`
-	Rows      []struct {
-		ID  string          `json:"id"`
-		Doc json.RawMessage `json:"doc"`
-	} `json:"rows"`
+	Offset    int          `json:"offset"`
+	TotalRows int          `json:"total_rows"`
+	Rows      []AllDocsRow `json:"rows"`
+}
+
+// AllDocsRow is a row of the response of an _all_docs request
+type AllDocsRow struct {
+	ID  string          `json:"id"`
+	Doc json.RawMessage `json:"doc"`
 }
 
 // ViewRequest are all params that can be passed to a view
@@ -683,9 +955,17 @@ type ViewRequest struct {
 	InclusiveEnd bool `json:"inclusive_end,omitempty" url:"inclusive_end,omitempty"`
 
 	Reduce     bool `json:"reduce" url:"reduce"`
+	Group      bool `json:"group,omitempty" url:"group,omitempty"`
 	GroupLevel int  `json:"group_level,omitempty" url:"group_level,omitempty"`
 }
 
+// ReduceRow is a row of the response of a reduced view. The value is a
+// number for the _count and _sum reduce functions.
+type ReduceRow struct {
+	Key   interface{} `json:"key"`
+	Value interface{} `json:"value"`
+}
+
 // ViewResponse is the response we receive when executing a view
 type ViewResponse struct {
 	Rows []struct {
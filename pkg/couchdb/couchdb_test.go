@@ -1,9 +1,12 @@
 package couchdb
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/cozy/checkup"
 	"github.com/cozy/cozy-stack/pkg/config"
@@ -123,6 +126,418 @@ func TestGetAllDocs(t *testing.T) {
 	}
 }
 
+func TestDumpAndLoadDB(t *testing.T) {
+	doctype := "io.cozy.tests.dump"
+	defer DeleteDB(TestPrefix, doctype)
+	doc := JSONDoc{Type: doctype, M: map[string]interface{}{"test": "dump"}}
+	assert.NoError(t, CreateDoc(TestPrefix, doc))
+
+	docs, err := DumpDB(TestPrefix, doctype)
+	assert.NoError(t, err)
+	assert.Len(t, docs, 1)
+
+	doc.M["test"] = "changed"
+	assert.NoError(t, UpdateDoc(TestPrefix, doc))
+	other := JSONDoc{Type: doctype, M: map[string]interface{}{"test": "other"}}
+	assert.NoError(t, CreateDoc(TestPrefix, other))
+
+	assert.NoError(t, LoadDB(TestPrefix, doctype, docs))
+	var results []*JSONDoc
+	err = GetAllDocs(TestPrefix, doctype, &AllDocsRequest{}, &results)
+	assert.NoError(t, err)
+	if assert.Len(t, results, 1) {
+		assert.Equal(t, doc.ID(), results[0].ID())
+		assert.Equal(t, "dump", results[0].M["test"])
+		assert.Equal(t, "1-", results[0].Rev()[:2])
+	}
+}
+
+func TestBulkDocs(t *testing.T) {
+	doctype := "io.cozy.tests.bulk"
+	defer DeleteDB(TestPrefix, doctype)
+
+	one := JSONDoc{Type: doctype, M: map[string]interface{}{"_id": "one", "n": 1}}
+	two := JSONDoc{Type: doctype, M: map[string]interface{}{"n": 2}}
+	err := BulkCreateDocs(TestPrefix, doctype, []Doc{one, two})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "one", one.ID())
+	assert.NotEmpty(t, one.Rev())
+	assert.NotEmpty(t, two.ID())
+	assert.NotEmpty(t, two.Rev())
+
+	err = BulkCreateDocs(TestPrefix, doctype, []Doc{&testDoc{Test: "wrong"}})
+	assert.Error(t, err)
+
+	stale := JSONDoc{Type: doctype, M: map[string]interface{}{
+		"_id":  two.ID(),
+		"_rev": "1-123",
+		"n":    4,
+	}}
+	one.M["n"] = 3
+	err = BulkUpdateDocs(TestPrefix, doctype, []Doc{one, stale})
+	bulkErr, ok := IsBulkError(err)
+	if assert.True(t, ok) && assert.Len(t, bulkErr, 1) {
+		assert.Equal(t, stale.ID(), bulkErr[0].Doc.ID())
+		assert.True(t, IsConflictError(bulkErr[0].Err))
+	}
+	fetched := &JSONDoc{}
+	assert.NoError(t, GetDoc(TestPrefix, doctype, "one", fetched))
+	assert.Equal(t, one.Rev(), fetched.Rev())
+	assert.Equal(t, float64(3), fetched.M["n"])
+
+	err = BulkDeleteDocs(TestPrefix, doctype, []Doc{one, two})
+	assert.NoError(t, err)
+	err = GetDoc(TestPrefix, doctype, "one", fetched)
+	assert.True(t, IsNotFoundError(err))
+}
+
+func TestPagination(t *testing.T) {
+	doctype := "io.cozy.tests.pages"
+	defer DeleteDB(TestPrefix, doctype)
+
+	docs := make([]Doc, 5)
+	for i := range docs {
+		docs[i] = JSONDoc{Type: doctype, M: map[string]interface{}{
+			"_id": fmt.Sprintf("doc%d", i),
+			"n":   i,
+		}}
+	}
+	if !assert.NoError(t, BulkCreateDocs(TestPrefix, doctype, docs)) {
+		return
+	}
+
+	var ids []string
+	cursor := ""
+	for i := 0; i < 3; i++ {
+		var page []JSONDoc
+		req := &AllDocsRequest{StartKey: cursor, Limit: 2}
+		next, err := GetAllDocsPage(TestPrefix, doctype, req, &page)
+		if !assert.NoError(t, err) {
+			return
+		}
+		for _, doc := range page {
+			ids = append(ids, doc.ID())
+		}
+		cursor = next
+	}
+	assert.Empty(t, cursor)
+	assert.Equal(t, []string{"doc0", "doc1", "doc2", "doc3", "doc4"}, ids)
+
+	ids = nil
+	bookmark := ""
+	for i := 0; i < 3; i++ {
+		var page []JSONDoc
+		req := &FindRequest{
+			Selector: mango.Gt("_id", ""),
+			Limit:    2,
+			Bookmark: bookmark,
+		}
+		next, err := FindDocsPage(TestPrefix, doctype, req, &page)
+		if !assert.NoError(t, err) {
+			return
+		}
+		for _, doc := range page {
+			ids = append(ids, doc.ID())
+		}
+		bookmark = next
+	}
+	assert.Empty(t, bookmark)
+	assert.Len(t, ids, 5)
+}
+
+func TestForeachDoc(t *testing.T) {
+	doctype := "io.cozy.tests.foreach"
+	defer DeleteDB(TestPrefix, doctype)
+
+	docs := make([]Doc, foreachPageSize*2+5)
+	for i := range docs {
+		docs[i] = JSONDoc{Type: doctype, M: map[string]interface{}{
+			"_id": fmt.Sprintf("doc%03d", i),
+			"n":   i,
+		}}
+	}
+	if !assert.NoError(t, BulkCreateDocs(TestPrefix, doctype, docs)) {
+		return
+	}
+
+	seen := make(map[string]bool)
+	err := ForeachDoc(TestPrefix, doctype, func(doc json.RawMessage) error {
+		var d JSONDoc
+		if err := json.Unmarshal(doc, &d.M); err != nil {
+			return err
+		}
+		seen[d.ID()] = true
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Len(t, seen, len(docs))
+
+	stop := errors.New("stop")
+	count := 0
+	err = ForeachDoc(TestPrefix, doctype, func(doc json.RawMessage) error {
+		count++
+		if count == 3 {
+			return stop
+		}
+		return nil
+	})
+	assert.Equal(t, stop, err)
+	assert.Equal(t, 3, count)
+
+	count = 0
+	req := &FindRequest{Selector: mango.Gte("_id", "doc100"), Limit: 30}
+	err = ForeachFindDoc(TestPrefix, doctype, req, func(doc json.RawMessage) error {
+		count++
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, len(docs)-100, count)
+}
+
+func TestLocalDocs(t *testing.T) {
+	doctype := "io.cozy.tests.local"
+	defer DeleteDB(TestPrefix, doctype)
+	if !assert.NoError(t, CreateDB(TestPrefix, doctype)) {
+		return
+	}
+
+	_, err := GetLocal(TestPrefix, doctype, "device")
+	assert.True(t, IsNotFoundError(err))
+
+	doc := map[string]interface{}{"seq": "1-abc"}
+	if !assert.NoError(t, PutLocal(TestPrefix, doctype, "device", doc)) {
+		return
+	}
+	assert.NotEmpty(t, doc["_rev"])
+	fetched, err := GetLocal(TestPrefix, doctype, "device")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "1-abc", fetched["seq"])
+	}
+
+	fetched["seq"] = "2-def"
+	assert.NoError(t, PutLocal(TestPrefix, doctype, "device", fetched))
+	stale := map[string]interface{}{"_rev": doc["_rev"], "seq": "3-ghi"}
+	assert.True(t, IsConflictError(PutLocal(TestPrefix, doctype, "device", stale)))
+
+	var all []JSONDoc
+	assert.NoError(t, GetAllDocs(TestPrefix, doctype, &AllDocsRequest{}, &all))
+	assert.Len(t, all, 0)
+
+	assert.NoError(t, DeleteLocal(TestPrefix, doctype, "device"))
+	_, err = GetLocal(TestPrefix, doctype, "device")
+	assert.True(t, IsNotFoundError(err))
+}
+
+func TestSecurity(t *testing.T) {
+	doctype := "io.cozy.tests.security"
+	defer DeleteDB(TestPrefix, doctype)
+	if !assert.NoError(t, CreateDB(TestPrefix, doctype)) {
+		return
+	}
+
+	sec := &Security{
+		Admins:  SecurityMembers{Names: []string{}, Roles: []string{"_admin"}},
+		Members: SecurityMembers{Names: []string{}, Roles: []string{"_admin"}},
+	}
+	if !assert.NoError(t, SetSecurity(TestPrefix, doctype, sec)) {
+		return
+	}
+	fetched, err := GetSecurity(TestPrefix, doctype)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"_admin"}, fetched.Members.Roles)
+		assert.Empty(t, fetched.Members.Names)
+	}
+
+	_, err = GetSecurity(TestPrefix, "io.cozy.tests.nosecurity")
+	assert.True(t, IsNotFoundError(err))
+}
+
+func TestCompactDB(t *testing.T) {
+	doctype := "io.cozy.tests.compact"
+	defer DeleteDB(TestPrefix, doctype)
+	view := &View{
+		Name:    "by-n",
+		Doctype: doctype,
+		Map:     "function(doc) { emit(doc.n); }",
+	}
+	if !assert.NoError(t, DefineViews(TestPrefix, []*View{view})) {
+		return
+	}
+	doc := JSONDoc{Type: doctype, M: map[string]interface{}{"n": 1}}
+	assert.NoError(t, CreateDoc(TestPrefix, doc))
+	assert.NoError(t, DeleteDoc(TestPrefix, doc))
+
+	ddocs, err := designDocs(TestPrefix, doctype)
+	if assert.NoError(t, err) {
+		assert.Len(t, ddocs, 1)
+	}
+	assert.NoError(t, CompactDB(TestPrefix, doctype))
+	err = CompactDB(TestPrefix, "io.cozy.tests.nocompact")
+	assert.True(t, IsNoDatabaseError(err))
+
+	status := &DBStatusResponse{}
+	assert.Equal(t, 0.0, status.Fragmentation())
+	status.Sizes.File = 400
+	status.Sizes.Active = 100
+	assert.Equal(t, 0.75, status.Fragmentation())
+}
+
+func TestDesignMigrations(t *testing.T) {
+	doctype := "io.cozy.tests.design"
+	defer DeleteDB(TestPrefix, doctype)
+	if !assert.NoError(t, CreateDB(TestPrefix, doctype)) {
+		return
+	}
+
+	count := func(name string) *View {
+		return &View{
+			Name:    name,
+			Doctype: doctype,
+			Map:     `function(doc) { emit(doc._id, 1); }`,
+			Reduce:  "_count",
+			MemoryMap: func(doc map[string]interface{}, emit func(key, value interface{})) {
+				emit(doc["_id"], 1)
+			},
+		}
+	}
+	first, second := count("first"), count("second")
+	migrations := DesignMigrations{
+		{Version: 1, Views: []*View{first}},
+		{Version: 2, Views: []*View{second}},
+	}
+	assert.Equal(t, 2, migrations.Version())
+
+	version, err := migrations[:1].Apply(TestPrefix, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, version)
+	_, err = ReduceViewQuery(TestPrefix, first, nil)
+	assert.NoError(t, err)
+
+	version, err = migrations.Apply(TestPrefix, version)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, version)
+	_, err = ReduceViewQuery(TestPrefix, first, nil)
+	assert.NoError(t, err)
+	_, err = ReduceViewQuery(TestPrefix, second, nil)
+	assert.NoError(t, err)
+
+	unsorted := DesignMigrations{migrations[1], migrations[0]}
+	version, err = unsorted.Apply(TestPrefix, 0)
+	assert.Error(t, err)
+	assert.Equal(t, 0, version)
+}
+
+func TestReduceViewQuery(t *testing.T) {
+	doctype := "io.cozy.tests.reduce"
+	defer DeleteDB(TestPrefix, doctype)
+
+	view := &View{
+		Name:    "by-kind",
+		Doctype: doctype,
+		Map:     `function(doc) { emit([doc.kind, doc.sub], 1); }`,
+		Reduce:  "_count",
+		MemoryMap: func(doc map[string]interface{}, emit func(key, value interface{})) {
+			emit([]interface{}{doc["kind"], doc["sub"]}, 1)
+		},
+	}
+	docs := []Doc{
+		JSONDoc{Type: doctype, M: map[string]interface{}{"kind": "a", "sub": "x"}},
+		JSONDoc{Type: doctype, M: map[string]interface{}{"kind": "a", "sub": "y"}},
+		JSONDoc{Type: doctype, M: map[string]interface{}{"kind": "b", "sub": "x"}},
+	}
+	if !assert.NoError(t, BulkCreateDocs(TestPrefix, doctype, docs)) {
+		return
+	}
+	if !assert.NoError(t, DefineViews(TestPrefix, []*View{view})) {
+		return
+	}
+
+	rows, err := ReduceViewQuery(TestPrefix, view, nil)
+	if assert.NoError(t, err) && assert.Len(t, rows, 1) {
+		assert.EqualValues(t, 3, rows[0].Value)
+	}
+
+	rows, err = ReduceViewQuery(TestPrefix, view, &ViewRequest{GroupLevel: 1})
+	if assert.NoError(t, err) && assert.Len(t, rows, 2) {
+		assert.Equal(t, []interface{}{"a"}, rows[0].Key)
+		assert.EqualValues(t, 2, rows[0].Value)
+		assert.Equal(t, []interface{}{"b"}, rows[1].Key)
+		assert.EqualValues(t, 1, rows[1].Value)
+	}
+
+	rows, err = ReduceViewQuery(TestPrefix, view, &ViewRequest{
+		Group:    true,
+		StartKey: []interface{}{"a", "y"},
+		EndKey:   []interface{}{"b"},
+	})
+	if assert.NoError(t, err) && assert.Len(t, rows, 1) {
+		assert.Equal(t, []interface{}{"a", "y"}, rows[0].Key)
+	}
+
+	_, err = ReduceViewQuery(TestPrefix, &View{Name: "noreduce", Doctype: doctype}, nil)
+	assert.Error(t, err)
+}
+
+func TestDBNames(t *testing.T) {
+	assert.Equal(t, "alice-cozy-tools", EncodeDBPrefix("alice.cozy.tools"))
+	assert.Equal(t, "alice-cozy-tools+3a8080", EncodeDBPrefix("Alice.cozy.tools:8080"))
+	assert.Equal(t, "my+2dcozy-example-net", EncodeDBPrefix("my-cozy.example.net"))
+	assert.Equal(t, "x+3127-0-0-1+3a8080", EncodeDBPrefix("127.0.0.1:8080"))
+
+	db := NewDatabase("alice.cozy.tools/", "alice-cozy-tools")
+	// makeDBName escapes the name for the URL of the database
+	assert.Equal(t, "alice-cozy-tools_io-cozy-foo%2B2dbar", makeDBName(db, "io.cozy.foo-bar"))
+	doctype, ok := doctypeOfDBName(db, "alice-cozy-tools_io-cozy-foo+2dbar")
+	assert.True(t, ok)
+	assert.Equal(t, "io.cozy.foo-bar", doctype)
+	_, ok = doctypeOfDBName(db, "alice-cozy-tools/io-cozy-files")
+	assert.False(t, ok)
+
+	legacy := NewDatabase("alice.cozy.tools/", "")
+	assert.Equal(t, "alice-cozy-tools%2Fio-cozy-files", makeDBName(legacy, "io.cozy.files"))
+	doctype, ok = doctypeOfDBName(legacy, "alice-cozy-tools/io-cozy-files")
+	assert.True(t, ok)
+	assert.Equal(t, "io.cozy.files", doctype)
+
+	domain, doctype, ok := instanceOfDBName("x+3127-0-0-1+3a8080_io-cozy-files")
+	assert.True(t, ok)
+	assert.Equal(t, "127.0.0.1:8080", domain)
+	assert.Equal(t, "io.cozy.files", doctype)
+	_, _, ok = instanceOfDBName("alice-cozy-tools/io-cozy-files")
+	assert.False(t, ok)
+	_, _, ok = instanceOfDBName("global")
+	assert.False(t, ok)
+}
+
+func TestMoveDBs(t *testing.T) {
+	from := NewDatabase("couchdb-tests-move/", "")
+	to := NewDatabase("couchdb-tests-move/", EncodeDBPrefix("couchdb-tests-move"))
+	doctype := "io.cozy.tests.move"
+	defer DeleteDB(to, doctype)
+
+	doc := &JSONDoc{Type: doctype, M: map[string]interface{}{"foo": "bar"}}
+	if !assert.NoError(t, CreateDoc(from, doc)) {
+		return
+	}
+	if !assert.NoError(t, MoveDBs(from, to)) {
+		return
+	}
+
+	fetched := &JSONDoc{}
+	err := GetDoc(to, doctype, doc.ID(), fetched)
+	if assert.NoError(t, err) {
+		assert.Equal(t, doc.Rev(), fetched.Rev())
+		assert.Equal(t, "bar", fetched.M["foo"])
+	}
+	_, err = DBStatus(from, doctype)
+	assert.True(t, IsNoDatabaseError(err))
+	doctypes, err := AllDoctypes(to)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{doctype}, doctypes)
+}
+
 func TestDefineIndex(t *testing.T) {
 	err := DefineIndex(TestPrefix, mango.IndexOnFields(TestDoctype, "fieldA", "fieldB"))
 	assert.NoError(t, err)
@@ -229,6 +644,64 @@ func TestChangesSuccess(t *testing.T) {
 	assert.Len(t, response.Results, 2)
 }
 
+func TestChangesFeed(t *testing.T) {
+	doctype := "io.cozy.tests.feed"
+	defer DeleteDB(TestPrefix, doctype)
+	one := JSONDoc{Type: doctype, M: map[string]interface{}{"_id": "one", "n": 1}}
+	two := JSONDoc{Type: doctype, M: map[string]interface{}{"_id": "two", "n": 2}}
+	three := JSONDoc{Type: doctype, M: map[string]interface{}{"_id": "three", "n": 3}}
+	assert.NoError(t, BulkCreateDocs(TestPrefix, doctype, []Doc{one, two, three}))
+
+	feed, err := Changes(TestPrefix, doctype, &ChangesOptions{
+		DocIDs:      []string{"one", "three"},
+		IncludeDocs: true,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	var ids []string
+	for feed.Next() {
+		ids = append(ids, feed.Change().DocID)
+		assert.NotNil(t, feed.Change().Doc.M)
+	}
+	assert.NoError(t, feed.Err())
+	assert.Equal(t, []string{"one", "three"}, ids)
+	assert.NotEmpty(t, feed.LastSeq())
+
+	feed, err = Changes(TestPrefix, doctype, &ChangesOptions{
+		Feed:     ChangesModeContinuous,
+		Selector: mango.Gt("n", 1),
+		Limit:    2,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	ids = nil
+	for feed.Next() {
+		ids = append(ids, feed.Change().DocID)
+	}
+	feed.Close()
+	assert.NoError(t, feed.Err())
+	assert.Equal(t, []string{"two", "three"}, ids)
+
+	feed, err = Changes(TestPrefix, doctype, &ChangesOptions{
+		Feed:  ChangesModeContinuous,
+		Since: "now",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		feed.Close()
+	}()
+	assert.False(t, feed.Next())
+	assert.NoError(t, feed.Err())
+
+	_, err = Changes(TestPrefix, "io.cozy.tests.nofeed", nil)
+	assert.True(t, IsNoDatabaseError(err))
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 
@@ -0,0 +1,206 @@
+package couchdb
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+)
+
+// DBPrefixer is implemented by the databases whose names start with a
+// CouchDB-safe prefix, as given by EncodeDBPrefix. When DBPrefix returns an
+// empty string, the legacy names are used: the escaped Prefix followed by the
+// doctype, like alice-cozy-tools/io-cozy-files.
+type DBPrefixer interface {
+	DBPrefix() string
+}
+
+// dbNameSeparator is put between the prefix and the doctype in the names of
+// the databases. It is never produced by encodeDBName.
+const dbNameSeparator = "_"
+
+// instancesDoctype is the doctype of the instances in the global database
+// (consts.Instances, that can't be imported here)
+const instancesDoctype = "io.cozy.instances"
+
+// EncodeDBPrefix returns a deterministic prefix for the names of the
+// databases of a domain, that can be used in a CouchDB URL without escaping.
+// The lowercase letters and the digits are kept, the dots become dashes, and
+// the other characters are replaced by a + and their hexadecimal code. A
+// database name must start with a letter, so an x is put before an escaped
+// first character.
+func EncodeDBPrefix(domain string) string {
+	prefix := encodeDBName(strings.ToLower(domain))
+	if !strings.HasPrefix(prefix, "+") {
+		return prefix
+	}
+	return "x" + prefix
+}
+
+// encodeDBName encodes a domain or a doctype for a database name. The first
+// character is escaped if it is not a letter.
+func encodeDBName(name string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c >= 'a' && c <= 'z':
+			buf.WriteByte(c)
+		case c >= '0' && c <= '9' && i > 0:
+			buf.WriteByte(c)
+		case c == '.' && i > 0:
+			buf.WriteByte('-')
+		default:
+			fmt.Fprintf(&buf, "+%02x", c)
+		}
+	}
+	return buf.String()
+}
+
+// decodeDBName is the reverse of encodeDBName
+func decodeDBName(name string) (string, bool) {
+	var buf bytes.Buffer
+	for i := 0; i < len(name); i++ {
+		switch c := name[i]; c {
+		case '-':
+			buf.WriteByte('.')
+		case '+':
+			if i+2 >= len(name) {
+				return "", false
+			}
+			code, err := strconv.ParseUint(name[i+1:i+3], 16, 8)
+			if err != nil {
+				return "", false
+			}
+			buf.WriteByte(byte(code))
+			i += 2
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	return buf.String(), true
+}
+
+// dbPrefixOf returns the CouchDB-safe prefix of a database, or an empty
+// string if it uses the legacy names.
+func dbPrefixOf(db Database) string {
+	if p, ok := db.(DBPrefixer); ok {
+		return p.DBPrefix()
+	}
+	return ""
+}
+
+// dbNamesPrefix returns the start of the names of the databases of db
+func dbNamesPrefix(db Database) string {
+	if prefix := dbPrefixOf(db); prefix != "" {
+		return prefix + dbNameSeparator
+	}
+	return escapeCouchdbName(db.Prefix())
+}
+
+// doctypeOfDBName returns the doctype of a database of db from its name, and
+// false if the database is not one of db.
+func doctypeOfDBName(db Database, dbname string) (string, bool) {
+	prefix := dbNamesPrefix(db)
+	if !strings.HasPrefix(dbname, prefix) || len(dbname) == len(prefix) {
+		return "", false
+	}
+	if dbPrefixOf(db) == "" {
+		doctype := dbname[len(prefix):]
+		if strings.Contains(doctype, "/") {
+			return "", false
+		}
+		return unescapeCouchdbName(doctype), true
+	}
+	return decodeDBName(dbname[len(prefix):])
+}
+
+// instanceOfDBName returns the domain and the doctype of a database of an
+// instance, from its name. It returns false for the legacy names, where the
+// domain can't be decoded, and for the global databases.
+func instanceOfDBName(dbname string) (string, string, bool) {
+	pos := strings.Index(dbname, dbNameSeparator)
+	if pos <= 0 || strings.Contains(dbname, "/") {
+		return "", "", false
+	}
+	prefix := dbname[:pos]
+	doctype, ok := decodeDBName(dbname[pos+1:])
+	if !ok {
+		return "", "", false
+	}
+	// the x put before an escaped first character is ambiguous, so the
+	// domain is checked by encoding it again
+	for _, candidate := range []string{prefix, strings.TrimPrefix(prefix, "x")} {
+		if domain, ok := decodeDBName(candidate); ok && EncodeDBPrefix(domain) == prefix {
+			return domain, doctype, true
+		}
+	}
+	return "", "", false
+}
+
+type prefixedDB struct {
+	prefix   string
+	dbPrefix string
+}
+
+func (p *prefixedDB) Prefix() string   { return p.prefix }
+func (p *prefixedDB) DBPrefix() string { return p.dbPrefix }
+
+// NewDatabase returns a Database for the given prefix, whose databases are
+// named with the CouchDB-safe dbPrefix, or with the legacy names if it is
+// empty.
+func NewDatabase(prefix, dbPrefix string) Database {
+	return &prefixedDB{prefix, dbPrefix}
+}
+
+// DatabaseOf returns the Database of the instance with the given domain. It
+// is for the workers that can't load the instance, as the instance package
+// imports them. The legacy names are used if there is no such instance.
+func DatabaseOf(domain string) (Database, error) {
+	var docs []struct {
+		DBPrefix string `json:"db_prefix"`
+	}
+	req := &FindRequest{
+		Selector: mango.Equal("domain", domain),
+		Fields:   mango.Fields{"db_prefix"},
+		Limit:    1,
+	}
+	err := FindDocs(GlobalDB, instancesDoctype, req, &docs)
+	if err != nil && !IsNoDatabaseError(err) {
+		return nil, err
+	}
+	var dbPrefix string
+	if len(docs) > 0 {
+		dbPrefix = docs[0].DBPrefix
+	}
+	return NewDatabase(domain+"/", dbPrefix), nil
+}
+
+// MoveDBs copies all the databases of from to the databases of to, for the
+// same doctypes, and deletes them. It is used to rename the databases of an
+// instance, that must not be used during the move, as the documents written
+// in the meantime could be lost. If it fails, it can be called again. The
+// legacy names don't keep the dashes of the doctypes, so they become dots.
+func MoveDBs(from, to Database) error {
+	doctypes, err := AllDoctypes(from)
+	if err != nil {
+		return err
+	}
+	for _, doctype := range doctypes {
+		docs, err := DumpDB(from, doctype)
+		if err != nil {
+			return err
+		}
+		if err = LoadDB(to, doctype, docs); err != nil {
+			return err
+		}
+	}
+	for _, doctype := range doctypes {
+		if err = DeleteDB(from, doctype); err != nil && !IsNoDatabaseError(err) {
+			return err
+		}
+	}
+	return nil
+}
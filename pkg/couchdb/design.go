@@ -0,0 +1,98 @@
+package couchdb
+
+import (
+	"fmt"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+)
+
+// DesignMigration is a version of the indexes and the views of some
+// databases: it has the indexes and the views added or changed since the
+// previous version.
+type DesignMigration struct {
+	Version int
+	Indexes []*mango.Index
+	Views   []*View
+}
+
+// DesignMigrations is a registry of the versions of the indexes and the
+// views, sorted by version. A released version must not be modified: a new
+// index or view, or a change of a view, goes in a new version, so that it is
+// applied to the existing databases after an upgrade of the stack. The
+// applied version is recorded by the caller, for example in the document of
+// the instance.
+type DesignMigrations []*DesignMigration
+
+// Version returns the last version of the registry
+func (ms DesignMigrations) Version() int {
+	if len(ms) == 0 {
+		return 0
+	}
+	return ms[len(ms)-1].Version
+}
+
+// Apply defines the indexes and the views of the versions after from, in
+// order, and returns the last version that has been fully applied. A design
+// doc has all the views of its doctype, so it is written with the views of
+// the doctype in their last version. The indexes and the views can be
+// defined several times, so Apply can be called again after an error. Nothing
+// is applied if the versions are not sorted.
+func (ms DesignMigrations) Apply(db Database, from int) (int, error) {
+	if err := ms.validate(); err != nil {
+		return from, err
+	}
+	views := ms.lastViews()
+	version := from
+	for _, m := range ms {
+		if m.Version <= from {
+			continue
+		}
+		if err := DefineIndexes(db, m.Indexes); err != nil {
+			return version, err
+		}
+		defined := make(map[string]bool)
+		for _, v := range m.Views {
+			if defined[v.Doctype] {
+				continue
+			}
+			defined[v.Doctype] = true
+			if err := DefineViews(db, views[v.Doctype]); err != nil {
+				return version, err
+			}
+		}
+		version = m.Version
+	}
+	return version, nil
+}
+
+// validate checks that the versions of the registry are sorted
+func (ms DesignMigrations) validate() error {
+	for i := 1; i < len(ms); i++ {
+		if ms[i].Version <= ms[i-1].Version {
+			return fmt.Errorf("Design migrations are not sorted: %d after %d",
+				ms[i].Version, ms[i-1].Version)
+		}
+	}
+	return nil
+}
+
+// lastViews returns the views of each doctype in their last version
+func (ms DesignMigrations) lastViews() map[string][]*View {
+	byName := make(map[string]*View)
+	var names []string
+	for _, m := range ms {
+		for _, v := range m.Views {
+			name := v.Doctype + "/" + v.Name
+			if _, ok := byName[name]; !ok {
+				names = append(names, name)
+			}
+			byName[name] = v
+		}
+	}
+	views := make(map[string][]*View)
+	for _, name := range names {
+		v := byName[name]
+		views[v.Doctype] = append(views[v.Doctype], v)
+	}
+	return views
+}
@@ -88,50 +88,98 @@ func IsCouchError(err error) (*Error, bool) {
 	return couchErr, isCouchErr
 }
 
-// IsNoDatabaseError checks if the given error is a couch no_db_file
-// error
+// The reasons of the errors for a database that does not exist. The first
+// two are given by CouchDB 1 and 2, and the last one replaces them for the
+// requests on a document, as the database of a doctype is only created with
+// its first document.
+const (
+	reasonNoDBFile     = "no_db_file"
+	reasonDBNotExist   = "Database does not exist."
+	reasonWrongDoctype = "wrong_doctype"
+)
+
+// The names of the errors made by the stack, in addition to the ones of
+// CouchDB
+const (
+	errorNameNoCouch   = "no_couch"
+	errorNameNoIndex   = "no_index"
+	errorNameWrongJSON = "wrong_json"
+	errorNameDefinedID = "defined_id"
+	errorNameBadID     = "bad_id"
+)
+
+// IsNoDatabaseError checks if the given error is caused by a database that
+// does not exist
 func IsNoDatabaseError(err error) bool {
 	couchErr, isCouchErr := IsCouchError(err)
-	if !isCouchErr {
+	if !isCouchErr || couchErr.StatusCode != http.StatusNotFound {
 		return false
 	}
-	return couchErr.Reason == "no_db_file" ||
-		couchErr.Reason == "Database does not exist."
+	switch couchErr.Reason {
+	case reasonNoDBFile, reasonDBNotExist, reasonWrongDoctype:
+		return true
+	}
+	return false
 }
 
-// IsNotFoundError checks if the given error is a couch not_found
-// error
+// IsNotFoundError checks if the given error is a couch not_found error: a
+// document, or a database, that does not exist
 func IsNotFoundError(err error) bool {
-	couchErr, isCouchErr := IsCouchError(err)
-	if !isCouchErr {
-		return false
-	}
-	return couchErr.Name == "not_found"
+	return hasStatus(err, http.StatusNotFound)
 }
 
 // IsConflictError checks if the given error is a couch conflict error
 func IsConflictError(err error) bool {
+	return hasStatus(err, http.StatusConflict)
+}
+
+// IsUnauthorizedError checks if the given error is caused by a request
+// without credentials, or with wrong credentials, for CouchDB
+func IsUnauthorizedError(err error) bool {
+	return hasStatus(err, http.StatusUnauthorized)
+}
+
+// IsForbiddenError checks if the given error is caused by a request that the
+// user of the stack is not allowed to make, like a write rejected by a
+// validation function, or a database restricted by its _security object.
+func IsForbiddenError(err error) bool {
+	return hasStatus(err, http.StatusForbidden)
+}
+
+// hasStatus returns true if err is a couch error with the given status code
+func hasStatus(err error, status int) bool {
+	couchErr, isCouchErr := IsCouchError(err)
+	return isCouchErr && couchErr.StatusCode == status
+}
+
+// IsUnavailableError checks if the given error is caused by CouchDB being
+// unreachable
+func IsUnavailableError(err error) bool {
 	couchErr, isCouchErr := IsCouchError(err)
 	if !isCouchErr {
 		return false
 	}
-	return couchErr.StatusCode == http.StatusConflict
+	return couchErr.Name == errorNameNoCouch
 }
 
 func newRequestError(originalError error) error {
 	return &Error{
 		StatusCode: http.StatusServiceUnavailable,
-		Name:       "no_couch",
+		Name:       errorNameNoCouch,
 		Reason:     "could not create a request to the server",
 		Original:   originalError,
 	}
 }
 
+// connectionErrorReason is the reason of the errors for the requests that
+// could not be sent, or whose response was not received
+const connectionErrorReason = "could not create connection with the server"
+
 func newConnectionError(originalError error) error {
 	return &Error{
 		StatusCode: http.StatusServiceUnavailable,
-		Name:       "no_couch",
-		Reason:     "could not create connection with the server",
+		Name:       errorNameNoCouch,
+		Reason:     connectionErrorReason,
 		Original:   originalError,
 	}
 }
@@ -139,16 +187,24 @@ func newConnectionError(originalError error) error {
 func newIOReadError(originalError error) error {
 	return &Error{
 		StatusCode: http.StatusServiceUnavailable,
-		Name:       "no_couch",
+		Name:       errorNameNoCouch,
 		Reason:     "could not read data from the server",
 		Original:   originalError,
 	}
 }
 
+func newQueueFullError() error {
+	return &Error{
+		StatusCode: http.StatusServiceUnavailable,
+		Name:       errorNameNoCouch,
+		Reason:     "too many writes are waiting for the server",
+	}
+}
+
 func newDefinedIDError() error {
 	return &Error{
 		StatusCode: http.StatusBadRequest,
-		Name:       "defined_id",
+		Name:       errorNameDefinedID,
 		Reason:     "document _id should be empty",
 	}
 }
@@ -156,7 +212,7 @@ func newDefinedIDError() error {
 func newBadIDError(id string) error {
 	return &Error{
 		StatusCode: http.StatusBadRequest,
-		Name:       "bad_id",
+		Name:       errorNameBadID,
 		Reason:     fmt.Sprintf("Unsuported couchdb operation %s", id),
 	}
 }
@@ -164,7 +220,7 @@ func newBadIDError(id string) error {
 func unoptimalError() error {
 	return &Error{
 		StatusCode: http.StatusBadRequest,
-		Name:       "no_index",
+		Name:       errorNameNoIndex,
 		Reason:     "no matching index found, create an index",
 	}
 }
@@ -175,7 +231,7 @@ func newCouchdbError(statusCode int, couchdbJSON []byte) error {
 	}
 	parseErr := json.Unmarshal(couchdbJSON, err)
 	if parseErr != nil {
-		err.Name = "wrong_json"
+		err.Name = errorNameWrongJSON
 		err.Reason = parseErr.Error()
 	}
 	err.StatusCode = statusCode
@@ -1,7 +1,9 @@
 package couchdb
 
 import (
+	"errors"
 	"fmt"
+	"net/http"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -30,3 +32,28 @@ func TestError_JSON(t *testing.T) {
 
 	assert.EqualValues(t, expectedMap, asJSON)
 }
+
+func TestErrorPredicates(t *testing.T) {
+	noDB := newCouchdbError(http.StatusNotFound, []byte(`{"error":"not_found","reason":"Database does not exist."}`))
+	assert.True(t, IsNoDatabaseError(noDB))
+	assert.True(t, IsNotFoundError(noDB))
+	assert.True(t, IsNoDatabaseError(fixErrorNoDatabaseIsWrongDoctype(noDB)))
+
+	missing := newCouchdbError(http.StatusNotFound, []byte(`{"error":"not_found","reason":"missing"}`))
+	assert.False(t, IsNoDatabaseError(missing))
+	assert.True(t, IsNotFoundError(missing))
+
+	conflict := newCouchdbError(http.StatusConflict, []byte(`{"error":"conflict","reason":"Document update conflict."}`))
+	assert.True(t, IsConflictError(conflict))
+	assert.False(t, IsNotFoundError(conflict))
+
+	unauthorized := newCouchdbError(http.StatusUnauthorized, []byte(`{"error":"unauthorized","reason":"You are not a server admin."}`))
+	assert.True(t, IsUnauthorizedError(unauthorized))
+	assert.False(t, IsForbiddenError(unauthorized))
+	forbidden := newCouchdbError(http.StatusForbidden, []byte(`{"error":"forbidden","reason":"no access"}`))
+	assert.True(t, IsForbiddenError(forbidden))
+
+	assert.False(t, IsNotFoundError(errors.New("not_found")))
+	assert.False(t, IsConflictError(nil))
+	assert.True(t, IsUnavailableError(newConnectionError(errors.New("refused"))))
+}
@@ -0,0 +1,141 @@
+package couchdb
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cozy/cozy-stack/pkg/config"
+)
+
+// explainResponse is the part of the response of _explain that tells which
+// index is used by a mango query
+type explainResponse struct {
+	Index struct {
+		Name string `json:"name"`
+		Type string `json:"type"`
+	} `json:"index"`
+}
+
+// MissingIndex is a mango query that was made on a database without an index
+// for it, and that CouchDB has answered with a full scan of the database.
+type MissingIndex struct {
+	Doctype  string          `json:"doctype"`
+	Fields   []string        `json:"fields"`
+	Selector json.RawMessage `json:"selector"`
+	Count    int             `json:"count"`
+	LastSeen time.Time       `json:"last_seen"`
+}
+
+// missingIndexes keeps the queries without index seen by this stack, by
+// prefix of the databases and by doctype and fields of the queries.
+var missingIndexes = struct {
+	sync.Mutex
+	dbs map[string]map[string]*MissingIndex
+}{dbs: make(map[string]map[string]*MissingIndex)}
+
+// explainQueries returns true if the mango queries must be explained before
+// being run (see couchdb.explain_queries)
+func explainQueries() bool {
+	cfg := config.GetConfig()
+	return cfg != nil && cfg.CouchDB.ExplainQueries && !InMemory()
+}
+
+// explainFind asks CouchDB how it would run a find request, and keeps it in
+// the missing indexes if it needs a full scan of the database. The errors
+// are only logged, as the diagnostics must not break the queries.
+func explainFind(db Database, doctype, path string, req interface{}) {
+	path = strings.TrimSuffix(path, "/_find") + "/_explain"
+	var res explainResponse
+	if err := makeRequest("POST", path, &req, &res); err != nil {
+		log.Debugf("[couchdb] Could not explain the query on %s: %s", path, err)
+		return
+	}
+	if res.Index.Type != "special" {
+		return
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return
+	}
+	var query struct {
+		Selector json.RawMessage `json:"selector"`
+	}
+	if err = json.Unmarshal(data, &query); err != nil {
+		return
+	}
+	fields := selectorFields(query.Selector)
+	log.Warnf("[couchdb] Full scan of %s for a query on %s", makeDBName(db, doctype), strings.Join(fields, ", "))
+
+	key := doctype + " " + strings.Join(fields, ",")
+	missingIndexes.Lock()
+	defer missingIndexes.Unlock()
+	indexes, ok := missingIndexes.dbs[db.Prefix()]
+	if !ok {
+		indexes = make(map[string]*MissingIndex)
+		missingIndexes.dbs[db.Prefix()] = indexes
+	}
+	missing, ok := indexes[key]
+	if !ok {
+		missing = &MissingIndex{Doctype: doctype, Fields: fields}
+		indexes[key] = missing
+	}
+	missing.Selector = query.Selector
+	missing.Count++
+	missing.LastSeen = time.Now()
+}
+
+// selectorFields returns the sorted list of the fields used by a mango
+// selector, including the ones in its combination operators.
+func selectorFields(selector json.RawMessage) []string {
+	seen := make(map[string]bool)
+	var walk func(value interface{})
+	walk = func(value interface{}) {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			for key, val := range v {
+				if !strings.HasPrefix(key, "$") {
+					seen[key] = true
+				}
+				walk(val)
+			}
+		case []interface{}:
+			for _, val := range v {
+				walk(val)
+			}
+		}
+	}
+	var value interface{}
+	if err := json.Unmarshal(selector, &value); err == nil {
+		walk(value)
+	}
+	fields := make([]string, 0, len(seen))
+	for field := range seen {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// MissingIndexes returns the mango queries made on the databases of db that
+// have needed a full scan, since this stack has started. They are only
+// collected when couchdb.explain_queries is enabled.
+func MissingIndexes(db Database) []*MissingIndex {
+	missingIndexes.Lock()
+	defer missingIndexes.Unlock()
+	indexes := missingIndexes.dbs[db.Prefix()]
+	keys := make([]string, 0, len(indexes))
+	for key := range indexes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	list := make([]*MissingIndex, len(keys))
+	for i, key := range keys {
+		missing := *indexes[key]
+		list[i] = &missing
+	}
+	return list
+}
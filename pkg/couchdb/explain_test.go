@@ -0,0 +1,21 @@
+package couchdb
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelectorFields(t *testing.T) {
+	selector, err := json.Marshal(mango.And(
+		mango.Equal("type", "file"),
+		mango.Or(mango.Gt("size", 10), mango.Exists("tags")),
+	))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"size", "tags", "type"}, selectorFields(selector))
+	assert.Empty(t, selectorFields(json.RawMessage(`{}`)))
+}
@@ -0,0 +1,289 @@
+package couchdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+)
+
+// feedRetryDelay is the delay before reconnecting a continuous feed that
+// has been closed by CouchDB without any change.
+var feedRetryDelay = 1 * time.Second
+
+// ChangesOptions are the options of a changes feed opened with Changes. A
+// feed can be filtered by a filter function of a design doc, by a view, by a
+// list of document identifiers, or by a mango selector.
+type ChangesOptions struct {
+	Feed        ChangesFeedMode
+	Since       string
+	IncludeDocs bool
+	// Limit is the maximal number of changes sent by the feed
+	Limit int
+	// Heartbeat is the period of the empty lines sent by CouchDB to keep a
+	// continuous feed alive
+	Heartbeat time.Duration
+	// Timeout is the duration after which CouchDB ends a longpoll or
+	// continuous feed without changes
+	Timeout  time.Duration
+	Filter   string
+	View     string
+	DocIDs   []string
+	Selector mango.Filter
+}
+
+// ChangesFeed is an iterator on the changes of a database. In the normal and
+// longpoll modes, it gives the changes of a single response of CouchDB. In
+// the continuous mode, it reconnects when CouchDB closes the feed, and Next
+// blocks until the next change, or until the feed is closed. The changes are
+// read with a loop on Next and Change, and Err must be checked after it.
+type ChangesFeed struct {
+	db      Database
+	doctype string
+	opts    ChangesOptions
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	lastSeq string
+	count   int
+	current *Change
+	err     error
+
+	// normal and longpoll modes
+	results []Change
+
+	// continuous mode
+	body    io.ReadCloser
+	decoder *json.Decoder
+	changed bool
+}
+
+// continuousLine is a line of a continuous feed: a change, or the last
+// sequence when CouchDB closes the feed.
+type continuousLine struct {
+	Change
+	LastSeq string `json:"last_seq"`
+}
+
+// Changes opens a changes feed on the database of a doctype. The first
+// request is made before returning, so that its errors are returned.
+func Changes(db Database, doctype string, opts *ChangesOptions) (*ChangesFeed, error) {
+	if doctype == "" {
+		return nil, errors.New("Empty doctype in Changes")
+	}
+	f := &ChangesFeed{db: db, doctype: doctype}
+	if opts != nil {
+		f.opts = *opts
+	}
+	if f.opts.Feed == "" {
+		f.opts.Feed = ChangesModeNormal
+	}
+	f.lastSeq = f.opts.Since
+	f.ctx, f.cancel = context.WithCancel(context.Background())
+
+	res, err := f.request()
+	if err != nil {
+		f.cancel()
+		return nil, err
+	}
+	if f.opts.Feed == ChangesModeContinuous {
+		f.body = res.Body
+		f.decoder = json.NewDecoder(res.Body)
+		return f, nil
+	}
+	defer res.Body.Close()
+	var response ChangesResponse
+	if err = json.NewDecoder(res.Body).Decode(&response); err != nil {
+		f.cancel()
+		return nil, newIOReadError(err)
+	}
+	f.results = response.Results
+	f.lastSeq = response.LastSeq
+	return f, nil
+}
+
+// Next moves the feed to the next change. It returns false when there are
+// no more changes, or on error.
+func (f *ChangesFeed) Next() bool {
+	f.current = nil
+	if f.err != nil || f.ctx.Err() != nil {
+		return false
+	}
+	if f.opts.Limit > 0 && f.count >= f.opts.Limit {
+		return false
+	}
+	if f.opts.Feed != ChangesModeContinuous {
+		if len(f.results) == 0 {
+			return false
+		}
+		f.current = &f.results[0]
+		f.results = f.results[1:]
+		f.count++
+		return true
+	}
+
+	for {
+		if f.decoder == nil && !f.reconnect() {
+			return false
+		}
+		var line continuousLine
+		err := f.decoder.Decode(&line)
+		if err != nil && err != io.EOF {
+			f.closeBody()
+			if f.ctx.Err() == nil {
+				f.err = newIOReadError(err)
+			}
+			return false
+		}
+		if err == io.EOF || line.LastSeq != "" {
+			if line.LastSeq != "" {
+				f.lastSeq = line.LastSeq
+			}
+			f.closeBody()
+			continue
+		}
+		change := line.Change
+		f.current = &change
+		f.lastSeq = change.Seq
+		f.changed = true
+		f.count++
+		return true
+	}
+}
+
+// Change returns the current change of the feed
+func (f *ChangesFeed) Change() *Change {
+	return f.current
+}
+
+// LastSeq returns the sequence of the last change given by the feed. It can
+// be used as the Since option of the next feed.
+func (f *ChangesFeed) LastSeq() string {
+	return f.lastSeq
+}
+
+// Err returns the error that has stopped the feed, if any
+func (f *ChangesFeed) Err() error {
+	return f.err
+}
+
+// Close stops the feed. It can be called from another goroutine to unblock
+// a call to Next on a continuous feed.
+func (f *ChangesFeed) Close() error {
+	f.cancel()
+	return nil
+}
+
+func (f *ChangesFeed) closeBody() {
+	if f.body != nil {
+		f.body.Close()
+	}
+	f.body = nil
+	f.decoder = nil
+}
+
+// reconnect opens the continuous feed again, from the last sequence. It
+// waits before if the previous connection was closed without any change,
+// to not flood CouchDB with requests.
+func (f *ChangesFeed) reconnect() bool {
+	if !f.changed {
+		select {
+		case <-f.ctx.Done():
+			return false
+		case <-time.After(feedRetryDelay):
+		}
+	}
+	f.changed = false
+	res, err := f.request()
+	if err != nil {
+		if f.ctx.Err() == nil {
+			f.err = err
+		}
+		return false
+	}
+	f.body = res.Body
+	f.decoder = json.NewDecoder(res.Body)
+	return true
+}
+
+// request sends the request for the feed to CouchDB
+func (f *ChangesFeed) request() (*http.Response, error) {
+	v := url.Values{}
+	v.Set("feed", string(f.opts.Feed))
+	if f.lastSeq != "" {
+		v.Set("since", f.lastSeq)
+	}
+	if f.opts.IncludeDocs {
+		v.Set("include_docs", "true")
+	}
+	if f.opts.Limit > 0 {
+		v.Set("limit", strconv.Itoa(f.opts.Limit-f.count))
+	}
+	if f.opts.Heartbeat > 0 {
+		v.Set("heartbeat", strconv.FormatInt(int64(f.opts.Heartbeat/time.Millisecond), 10))
+	}
+	if f.opts.Timeout > 0 {
+		v.Set("timeout", strconv.FormatInt(int64(f.opts.Timeout/time.Millisecond), 10))
+	}
+
+	method := "GET"
+	var body interface{}
+	switch {
+	case len(f.opts.DocIDs) > 0:
+		v.Set("filter", "_doc_ids")
+		method = "POST"
+		body = map[string]interface{}{"doc_ids": f.opts.DocIDs}
+	case f.opts.Selector != nil:
+		v.Set("filter", "_selector")
+		method = "POST"
+		body = map[string]interface{}{"selector": f.opts.Selector}
+	case f.opts.View != "":
+		v.Set("filter", "_view")
+		v.Set("view", f.opts.View)
+	case f.opts.Filter != "":
+		v.Set("filter", f.opts.Filter)
+	}
+
+	var reqjson []byte
+	if body != nil {
+		var err error
+		if reqjson, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+	path := makeDBName(f.db, f.doctype) + "/_changes?" + v.Encode()
+	req, err := http.NewRequest(method, config.CouchURL()+path, bytes.NewReader(reqjson))
+	if err != nil {
+		return nil, newRequestError(err)
+	}
+	req = req.WithContext(f.ctx)
+	if body != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
+	req.Header.Add("Accept", "application/json")
+
+	// the longpoll and continuous feeds can stay open for a long time, so
+	// they are made without the timeout of the other requests
+	res, err := doHTTP(longHTTPClient(), req, path)
+	if err != nil {
+		return nil, newConnectionError(err)
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		defer res.Body.Close()
+		resbody, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return nil, newIOReadError(err)
+		}
+		return nil, newCouchdbError(res.StatusCode, resbody)
+	}
+	return res, nil
+}
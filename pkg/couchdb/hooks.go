@@ -0,0 +1,91 @@
+package couchdb
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RequestEvent describes a request made to CouchDB, for the hooks. The
+// status and the duration are set at the end of the request, when the
+// response headers have been received: the time spent reading the body of a
+// changes feed is not counted.
+type RequestEvent struct {
+	Method string
+	// Path is the path of the request, without the query string
+	Path string
+	// DBName is the name of the database of the request, or an empty string
+	// for the requests on the server, like _all_dbs
+	DBName   string
+	Start    time.Time
+	Status   int
+	Duration time.Duration
+	// Err is the error when no response has been received
+	Err error
+}
+
+// A Hook is called at the start of every request made to CouchDB, including
+// the retries. The function it returns, if not nil, is called at the end of
+// the request, so that metrics and tracing can be recorded in one place.
+type Hook func(ev *RequestEvent) func(ev *RequestEvent)
+
+var (
+	hooksMu sync.RWMutex
+	hooks   []Hook
+)
+
+// AddHook registers a hook for the requests to CouchDB
+func AddHook(hook Hook) {
+	hooksMu.Lock()
+	hooks = append(hooks, hook)
+	hooksMu.Unlock()
+}
+
+// doHTTP sends a request to CouchDB with the given client, and calls the
+// hooks around it. The path is the one given to makeRequest, relative to the
+// URL of CouchDB.
+func doHTTP(client *http.Client, req *http.Request, path string) (*http.Response, error) {
+	hooksMu.RLock()
+	registered := hooks
+	hooksMu.RUnlock()
+	if len(registered) == 0 {
+		return client.Do(req)
+	}
+
+	if pos := strings.IndexByte(path, '?'); pos >= 0 {
+		path = path[:pos]
+	}
+	path = strings.TrimPrefix(path, "/")
+	ev := &RequestEvent{
+		Method: req.Method,
+		Path:   path,
+		Start:  time.Now(),
+	}
+	if pos := strings.IndexByte(path, '/'); pos >= 0 {
+		ev.DBName = path[:pos]
+	} else {
+		ev.DBName = path
+	}
+	if strings.HasPrefix(ev.DBName, "_") {
+		ev.DBName = ""
+	}
+	var ends []func(ev *RequestEvent)
+	for _, hook := range registered {
+		if end := hook(ev); end != nil {
+			ends = append(ends, end)
+		}
+	}
+
+	res, err := client.Do(req)
+	ev.Duration = time.Since(ev.Start)
+	if err != nil {
+		ev.Err = err
+	} else {
+		ev.Status = res.StatusCode
+	}
+	for _, end := range ends {
+		end(ev)
+	}
+	return res, err
+}
@@ -0,0 +1,56 @@
+package couchdb
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHooks(t *testing.T) {
+	hooksMu.Lock()
+	was := hooks
+	hooks = nil
+	hooksMu.Unlock()
+	defer func() {
+		hooksMu.Lock()
+		hooks = was
+		hooksMu.Unlock()
+	}()
+
+	var mu sync.Mutex
+	var started int
+	var ended []RequestEvent
+	AddHook(func(ev *RequestEvent) func(ev *RequestEvent) {
+		mu.Lock()
+		started++
+		mu.Unlock()
+		return func(ev *RequestEvent) {
+			mu.Lock()
+			ended = append(ended, *ev)
+			mu.Unlock()
+		}
+	})
+	AddHook(func(ev *RequestEvent) func(ev *RequestEvent) { return nil })
+
+	err := GetDoc(TestPrefix, TestDoctype, "no-such-doc", &JSONDoc{Type: TestDoctype})
+	assert.True(t, IsNotFoundError(err))
+	_, err = AllDoctypes(TestPrefix)
+	assert.NoError(t, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 2, started)
+	if assert.Len(t, ended, 2) {
+		dbname := makeDBName(TestPrefix, TestDoctype)
+		assert.Equal(t, "GET", ended[0].Method)
+		assert.Equal(t, dbname+"/no-such-doc", ended[0].Path)
+		assert.Equal(t, dbname, ended[0].DBName)
+		assert.Equal(t, http.StatusNotFound, ended[0].Status)
+		assert.True(t, ended[0].Duration > 0)
+		assert.Equal(t, "_all_dbs", ended[1].Path)
+		assert.Equal(t, "", ended[1].DBName)
+		assert.Equal(t, http.StatusOK, ended[1].Status)
+	}
+}
@@ -0,0 +1,59 @@
+package couchdb
+
+import "encoding/json"
+
+// foreachPageSize is the number of documents fetched by request by
+// ForeachDoc and ForeachFindDoc
+const foreachPageSize = 100
+
+// ForeachDoc calls fn for each document of a doctype, with its JSON, except
+// for the design docs. The documents are fetched page by page, in the order
+// of their identifiers, so that a large database is not loaded in memory.
+// The iteration stops on the first error returned by fn, and this error is
+// returned.
+func ForeachDoc(db Database, doctype string, fn func(doc json.RawMessage) error) error {
+	cursor := ""
+	for {
+		var docs []json.RawMessage
+		req := &AllDocsRequest{StartKey: cursor, Limit: foreachPageSize}
+		next, err := GetAllDocsPage(db, doctype, req, &docs)
+		if err != nil {
+			return err
+		}
+		for _, doc := range docs {
+			if err = fn(doc); err != nil {
+				return err
+			}
+		}
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// ForeachFindDoc is like ForeachDoc, for the documents matching a find
+// request. The limit of the request is the number of documents by page.
+func ForeachFindDoc(db Database, doctype string, req *FindRequest, fn func(doc json.RawMessage) error) error {
+	pageReq := *req
+	if pageReq.Limit <= 0 {
+		pageReq.Limit = foreachPageSize
+	}
+	for {
+		var docs []json.RawMessage
+		next, err := FindDocsPage(db, doctype, &pageReq, &docs)
+		if err != nil {
+			return err
+		}
+		for _, doc := range docs {
+			if err = fn(doc); err != nil {
+				return err
+			}
+		}
+		if next == "" {
+			return nil
+		}
+		pageReq.Bookmark = next
+		pageReq.Skip = 0
+	}
+}
@@ -0,0 +1,191 @@
+package couchdb
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/realtime"
+)
+
+// dbUpdate is a line of the _db_updates feed of CouchDB
+type dbUpdate struct {
+	DBName string `json:"db_name"`
+	Type   string `json:"type"`
+}
+
+// selfPublishedDoctypes are the doctypes whose changes are already published
+// on the realtime hub by the stack that writes them (pkg/permissions and
+// pkg/apps, that can't be imported here). The listener only invalidates the
+// cache for them, else the events would be received twice.
+var selfPublishedDoctypes = map[string]bool{
+	"io.cozy.permissions": true,
+	"io.cozy.apps":        true,
+}
+
+// ChangesListener follows the _db_updates feed of CouchDB, and the changes of
+// the databases of the instances that are updated. Each change is published
+// on the realtime hub of its instance, for its doctype, and the document is
+// removed from the cache. So the realtime subscribers and the event triggers
+// see the writes made by all the stacks, and by the replications, from a
+// single feed.
+//
+// The databases with the legacy names are not followed, as the domain of
+// their instance can't be known (see MoveDBs). For a database that has not
+// been seen before, only its last change is published. The changes of the
+// doctypes in selfPublishedDoctypes are not published.
+type ChangesListener struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu   sync.Mutex
+	seqs map[string]string // the last sequence of each database
+}
+
+// StartChangesListener starts to follow the changes of the databases of the
+// instances, until Stop is called. It needs the admin rights on CouchDB.
+func StartChangesListener() *ChangesListener {
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &ChangesListener{
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+		seqs:   make(map[string]string),
+	}
+	go l.loop()
+	return l
+}
+
+// Stop stops the listener, and waits for the end of its goroutine
+func (l *ChangesListener) Stop() {
+	l.cancel()
+	<-l.done
+}
+
+// loop follows the _db_updates feed, and reconnects when it is closed
+func (l *ChangesListener) loop() {
+	defer close(l.done)
+	for {
+		if err := l.follow(); err != nil && l.ctx.Err() == nil {
+			log.Warnf("[couchdb] Error on the _db_updates feed: %s", err)
+		}
+		select {
+		case <-l.ctx.Done():
+			return
+		case <-time.After(feedRetryDelay):
+		}
+	}
+}
+
+// follow reads the _db_updates feed until it is closed
+func (l *ChangesListener) follow() error {
+	path := "_db_updates?feed=continuous&since=now"
+	req, err := http.NewRequest(http.MethodGet, config.CouchURL()+path, nil)
+	if err != nil {
+		return newRequestError(err)
+	}
+	req = req.WithContext(l.ctx)
+	req.Header.Add("Accept", "application/json")
+	res, err := doHTTP(longHTTPClient(), req, path)
+	if err != nil {
+		return newConnectionError(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return newIOReadError(err)
+		}
+		return newCouchdbError(res.StatusCode, body)
+	}
+	decoder := json.NewDecoder(res.Body)
+	for {
+		var update dbUpdate
+		if err = decoder.Decode(&update); err != nil {
+			return newIOReadError(err)
+		}
+		switch update.Type {
+		case "updated":
+			if err = l.dbUpdated(update.DBName); err != nil {
+				log.Warnf("[couchdb] Could not read the changes of %s: %s", update.DBName, err)
+			}
+		case "deleted":
+			l.mu.Lock()
+			delete(l.seqs, update.DBName)
+			l.mu.Unlock()
+			docCache.invalidate(url.QueryEscape(update.DBName))
+		}
+	}
+}
+
+// dbUpdated publishes the changes of a database since the last time it was
+// updated.
+func (l *ChangesListener) dbUpdated(dbname string) error {
+	domain, doctype, ok := instanceOfDBName(dbname)
+	if !ok || strings.HasPrefix(doctype, "_") {
+		return nil
+	}
+	l.mu.Lock()
+	since, known := l.seqs[dbname]
+	l.mu.Unlock()
+
+	v := url.Values{}
+	v.Set("include_docs", "true")
+	if known {
+		v.Set("since", since)
+	} else {
+		v.Set("descending", "true")
+		v.Set("limit", "1")
+	}
+	escaped := url.QueryEscape(dbname)
+	var res ChangesResponse
+	if err := makeRequest("GET", escaped+"/_changes?"+v.Encode(), nil, &res); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.seqs[dbname] = res.LastSeq
+	l.mu.Unlock()
+
+	hub := realtime.InstanceHub(domain)
+	for _, change := range res.Results {
+		if strings.HasPrefix(change.DocID, "_design/") {
+			continue
+		}
+		docCache.invalidate(escaped + "/" + url.QueryEscape(change.DocID))
+		if !selfPublishedDoctypes[doctype] {
+			hub.Publish(changeEvent(doctype, &change))
+		}
+	}
+	return nil
+}
+
+// changeEvent returns the realtime event for a change of a document
+func changeEvent(doctype string, change *Change) *realtime.Event {
+	ev := &realtime.Event{
+		Type:    realtime.EventUpdate,
+		DocType: doctype,
+		DocID:   change.DocID,
+	}
+	if len(change.Changes) > 0 {
+		ev.DocRev = change.Changes[0].Rev
+	}
+	switch {
+	case change.Deleted:
+		ev.Type = realtime.EventDelete
+	case strings.HasPrefix(ev.DocRev, "1-"):
+		ev.Type = realtime.EventCreate
+	}
+	if !change.Deleted && change.Doc.M != nil {
+		change.Doc.Type = doctype
+		ev.Doc = change.Doc
+	}
+	return ev
+}
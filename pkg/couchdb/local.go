@@ -0,0 +1,52 @@
+package couchdb
+
+import (
+	"errors"
+	"net/url"
+)
+
+// localDocURL returns the path of a _local document
+func localDocURL(db Database, doctype, id string) string {
+	return makeDBName(db, doctype) + "/_local/" + url.QueryEscape(id)
+}
+
+// GetLocal fetches a _local document of the database of a doctype. The
+// _local documents are not replicated, and they are not listed by
+// _all_docs, the mango queries and the changes feed. They are useful for the
+// checkpoints of the replications and the state of a device.
+func GetLocal(db Database, doctype, id string) (map[string]interface{}, error) {
+	if id == "" {
+		return nil, errors.New("Missing id for the _local document")
+	}
+	var doc map[string]interface{}
+	if err := makeRequest("GET", localDocURL(db, doctype, id), nil, &doc); err != nil {
+		return nil, fixErrorNoDatabaseIsWrongDoctype(err)
+	}
+	return doc, nil
+}
+
+// PutLocal writes a _local document of the database of a doctype. To update
+// it, doc must have the _rev of the current version, as given by GetLocal.
+// The new _rev is set in doc.
+func PutLocal(db Database, doctype, id string, doc map[string]interface{}) error {
+	if id == "" {
+		return errors.New("Missing id for the _local document")
+	}
+	var res updateResponse
+	if err := makeRequest("PUT", localDocURL(db, doctype, id), doc, &res); err != nil {
+		return fixErrorNoDatabaseIsWrongDoctype(err)
+	}
+	doc["_rev"] = res.Rev
+	return nil
+}
+
+// DeleteLocal removes a _local document of the database of a doctype
+func DeleteLocal(db Database, doctype, id string) error {
+	doc, err := GetLocal(db, doctype, id)
+	if err != nil {
+		return err
+	}
+	rev, _ := doc["_rev"].(string)
+	u := localDocURL(db, doctype, id) + "?rev=" + url.QueryEscape(rev)
+	return makeRequest("DELETE", u, nil, nil)
+}
@@ -26,6 +26,21 @@ const lt ValueOperator = "$lt"
 // Lte ($lte) checks that field <= value
 const lte ValueOperator = "$lte"
 
+// Ne ($ne) checks that field != value
+const ne ValueOperator = "$ne"
+
+// In ($in) checks that the field value is one of the values of a list
+const in ValueOperator = "$in"
+
+// Nin ($nin) checks that the field value is none of the values of a list
+const nin ValueOperator = "$nin"
+
+// Exists ($exists) checks that the field exists, or not
+const exists ValueOperator = "$exists"
+
+// Regex ($regex) checks that the field is a string matching a regexp
+const regex ValueOperator = "$regex"
+
 // LogicOperator is an operator between two filters
 type LogicOperator string
 
@@ -152,6 +167,29 @@ func Between(field string, v1 interface{}, v2 interface{}) Filter {
 	}}
 }
 
+// NotEqual returns a filter that check if a field != value
+func NotEqual(field string, value interface{}) Filter { return &valueFilter{field, ne, value} }
+
+// In returns a filter that check if a field value is one of the values
+func In(field string, values ...interface{}) Filter {
+	return &valueFilter{field, in, nonNilList(values)}
+}
+
+// NotIn returns a filter that check if a field value is none of the values
+func NotIn(field string, values ...interface{}) Filter {
+	return &valueFilter{field, nin, nonNilList(values)}
+}
+
+// Exists returns a filter that check if a field exists
+func Exists(field string) Filter { return &valueFilter{field, exists, true} }
+
+// NotExists returns a filter that check if a field does not exist
+func NotExists(field string) Filter { return &valueFilter{field, exists, false} }
+
+// Regex returns a filter that check if a field's string value matches the
+// regular expression (with the Erlang syntax, close to the PCRE one)
+func Regex(field string, pattern string) Filter { return &valueFilter{field, regex, pattern} }
+
 const uFFFF = string(unicode.MaxRune)
 
 // StartWith returns a filter that check if field's string value start with prefix
@@ -186,6 +224,56 @@ func (s SortBy) MarshalJSON() ([]byte, error) {
 	return json.Marshal(asSlice)
 }
 
+// Ascending returns a rule to sort on a field in the ascending order
+func Ascending(field string) SortBy { return SortBy{field, Asc} }
+
+// Descending returns a rule to sort on a field in the descending order
+func Descending(field string) SortBy { return SortBy{field, Desc} }
+
+// SortBys is a list of sorting rules, to be used as the sort of a
+// couchdb.FindRequest when the documents are sorted on several fields. The
+// fields must be indexed together, and in the same direction.
+type SortBys []SortBy
+
+// MarshalJSON implements json.Marshaller on SortBys
+// it will returns a json array [{field: direction}, ...]
+func (s SortBys) MarshalJSON() ([]byte, error) {
+	rules := make([]Map, len(s))
+	for i, rule := range s {
+		rules[i] = makeMap(rule.Field, string(rule.Direction))
+	}
+	return json.Marshal(rules)
+}
+
+////////////////////////////////////////////////////////////////
+// Projection
+///////////////////////////////////////////////////////////////
+
+// Fields is the list of the fields to return for each document, to be used
+// as the fields of a couchdb.FindRequest. The dotted notation can be used for
+// the fields of the sub-objects. An empty list means the whole documents.
+type Fields []string
+
+// FieldsWithMeta returns the list of fields, plus the _id and _rev fields
+// that are needed to update the documents later.
+func FieldsWithMeta(fields ...string) Fields {
+	list := Fields{"_id", "_rev"}
+	for _, f := range fields {
+		if f != "_id" && f != "_rev" {
+			list = append(list, f)
+		}
+	}
+	return list
+}
+
+// nonNilList ensures that an empty list is serialized as [] and not null
+func nonNilList(values []interface{}) []interface{} {
+	if values == nil {
+		return []interface{}{}
+	}
+	return values
+}
+
 // utility function to create a map with a single key
 func makeMap(key string, value interface{}) Map {
 	out := make(Map)
@@ -42,3 +42,33 @@ func TestSortMarshaling(t *testing.T) {
 		assert.Equal(t, j1, []byte(`["dir_id","asc"]`))
 	}
 }
+
+func TestOperatorsMarshaling(t *testing.T) {
+	q1 := In("state", "ready", "installed")
+	DeepEqual(t, q1.ToMango(), M{"state": M{"$in": S{"ready", "installed"}}})
+	q2 := NotIn("state")
+	DeepEqual(t, q2.ToMango(), M{"state": M{"$nin": S{}}})
+	q3 := Or(Exists("trashed"), NotEqual("name", "foo"))
+	DeepEqual(t, q3.ToMango(),
+		M{"$or": S{
+			M{"trashed": M{"$exists": true}},
+			M{"name": M{"$ne": "foo"}},
+		}})
+	q4 := And(NotExists("trashed"), Regex("name", "^foo"), Lt("size", 10))
+	DeepEqual(t, q4.ToMango(),
+		M{"$and": S{
+			M{"trashed": M{"$exists": false}},
+			M{"name": M{"$regex": "^foo"}},
+			M{"size": M{"$lt": 10}},
+		}})
+}
+
+func TestSortsAndFieldsMarshaling(t *testing.T) {
+	s := SortBys{Ascending("dir_id"), Descending("name")}
+	j, err := json.Marshal(s)
+	if assert.NoError(t, err) {
+		assert.Equal(t, `[{"dir_id":"asc"},{"name":"desc"}]`, string(j))
+	}
+	f := FieldsWithMeta("name", "_id", "size")
+	assert.Equal(t, Fields{"_id", "_rev", "name", "size"}, f)
+}
@@ -0,0 +1,395 @@
+package memdb
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultFindLimit is the number of documents returned by _find when the
+// request has no limit, like CouchDB does.
+const defaultFindLimit = 25
+
+type sortField struct {
+	field string
+	desc  bool
+}
+
+// find runs a mango query on the documents of the database, or only on
+// those of a partition if it is not empty.
+func (db *database) find(w http.ResponseWriter, body map[string]interface{}, partition string) {
+	selector, ok := body["selector"].(map[string]interface{})
+	if !ok {
+		writeError(w, http.StatusBadRequest, "bad_request", "Missing required key: selector")
+		return
+	}
+	sorts := parseSort(body["sort"])
+	skip := toInt(body["skip"])
+	limit := toInt(body["limit"])
+	if limit <= 0 {
+		limit = defaultFindLimit
+	}
+	// the bookmark is the number of documents of the previous pages
+	if bookmark, ok := body["bookmark"].(string); ok && bookmark != "" {
+		offset, err := strconv.Atoi(bookmark)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "bad_request", "Invalid bookmark value")
+			return
+		}
+		skip += offset
+	}
+
+	var docs []*document
+	for _, doc := range db.sortedDocs() {
+		if doc.deleted || strings.HasPrefix(doc.id, "_design/") {
+			continue
+		}
+		if partition != "" && !strings.HasPrefix(doc.id, partition+":") {
+			continue
+		}
+		if matchSelector(doc.body, selector) {
+			docs = append(docs, doc)
+		}
+	}
+	if len(sorts) == 0 {
+		sorts = db.indexSort(selector)
+	}
+	if len(sorts) > 0 {
+		sort.Stable(&docsSorter{docs, sorts})
+	}
+	docs = paginate(docs, skip, limit)
+
+	fields, _ := body["fields"].([]interface{})
+	results := make([]map[string]interface{}, len(docs))
+	for i, doc := range docs {
+		results[i] = project(doc.body, fields)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"docs":     results,
+		"bookmark": strconv.Itoa(skip + len(results)),
+	})
+}
+
+// indexSort returns the order of the results of a query without sort: the
+// order of the first index on a field of the selector, as CouchDB uses it for
+// the query.
+func (db *database) indexSort(selector map[string]interface{}) []sortField {
+	for _, index := range db.indexes {
+		if !selectorHasField(selector, index[0]) {
+			continue
+		}
+		sorts := make([]sortField, len(index))
+		for i, field := range index {
+			sorts[i] = sortField{field: field}
+		}
+		return sorts
+	}
+	return nil
+}
+
+func selectorHasField(selector map[string]interface{}, field string) bool {
+	for key, cond := range selector {
+		if key == field {
+			return true
+		}
+		if key == "$and" {
+			list, _ := cond.([]interface{})
+			for _, sub := range list {
+				if s, ok := sub.(map[string]interface{}); ok && selectorHasField(s, field) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// parseSort accepts the sort of a mango query as a list of fields, a list of
+// {field: direction} objects, or the [field, direction] pair of mango.SortBy.
+func parseSort(raw interface{}) []sortField {
+	list, ok := raw.([]interface{})
+	if !ok {
+		return nil
+	}
+	if len(list) == 2 {
+		field, ok1 := list[0].(string)
+		dir, ok2 := list[1].(string)
+		if ok1 && ok2 && (dir == "asc" || dir == "desc") {
+			return []sortField{{field, dir == "desc"}}
+		}
+	}
+	var sorts []sortField
+	for _, item := range list {
+		switch item := item.(type) {
+		case string:
+			sorts = append(sorts, sortField{item, false})
+		case map[string]interface{}:
+			for field, dir := range item {
+				sorts = append(sorts, sortField{field, dir == "desc"})
+			}
+		}
+	}
+	return sorts
+}
+
+type docsSorter struct {
+	docs  []*document
+	sorts []sortField
+}
+
+func (s *docsSorter) Len() int      { return len(s.docs) }
+func (s *docsSorter) Swap(i, j int) { s.docs[i], s.docs[j] = s.docs[j], s.docs[i] }
+func (s *docsSorter) Less(i, j int) bool {
+	for _, f := range s.sorts {
+		a, _ := getField(s.docs[i].body, f.field)
+		b, _ := getField(s.docs[j].body, f.field)
+		c := collate(a, b)
+		if c == 0 {
+			continue
+		}
+		if f.desc {
+			return c > 0
+		}
+		return c < 0
+	}
+	return false
+}
+
+// project returns a copy of the document with only the given fields, or the
+// document itself if there is no fields.
+func project(doc map[string]interface{}, fields []interface{}) map[string]interface{} {
+	if len(fields) == 0 {
+		return doc
+	}
+	res := make(map[string]interface{})
+	for _, f := range fields {
+		field, ok := f.(string)
+		if !ok {
+			continue
+		}
+		val, ok := getField(doc, field)
+		if !ok {
+			continue
+		}
+		parts := strings.Split(field, ".")
+		m := res
+		for _, part := range parts[:len(parts)-1] {
+			sub, ok := m[part].(map[string]interface{})
+			if !ok {
+				sub = make(map[string]interface{})
+				m[part] = sub
+			}
+			m = sub
+		}
+		m[parts[len(parts)-1]] = val
+	}
+	return res
+}
+
+// getField returns the value of a field, with the dotted notation for the
+// fields of the sub-objects.
+func getField(doc map[string]interface{}, field string) (interface{}, bool) {
+	var val interface{} = doc
+	for _, part := range strings.Split(field, ".") {
+		m, ok := val.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		val, ok = m[part]
+		if !ok {
+			return nil, false
+		}
+	}
+	return val, true
+}
+
+func matchSelector(doc map[string]interface{}, selector map[string]interface{}) bool {
+	for key, cond := range selector {
+		switch key {
+		case "$and":
+			list, _ := cond.([]interface{})
+			for _, sub := range list {
+				if s, ok := sub.(map[string]interface{}); !ok || !matchSelector(doc, s) {
+					return false
+				}
+			}
+		case "$or":
+			list, _ := cond.([]interface{})
+			found := false
+			for _, sub := range list {
+				if s, ok := sub.(map[string]interface{}); ok && matchSelector(doc, s) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		case "$nor":
+			list, _ := cond.([]interface{})
+			for _, sub := range list {
+				if s, ok := sub.(map[string]interface{}); ok && matchSelector(doc, s) {
+					return false
+				}
+			}
+		case "$not":
+			if s, ok := cond.(map[string]interface{}); !ok || matchSelector(doc, s) {
+				return false
+			}
+		default:
+			val, exists := getField(doc, key)
+			if !matchCondition(val, exists, cond) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// matchCondition checks the value of a field against a condition, that can
+// be a value for an implicit equality, or an object of operators.
+func matchCondition(val interface{}, exists bool, cond interface{}) bool {
+	ops, ok := cond.(map[string]interface{})
+	if !ok || !hasOperators(ops) {
+		return exists && collate(val, cond) == 0
+	}
+	for op, arg := range ops {
+		if !matchOperator(val, exists, op, arg) {
+			return false
+		}
+	}
+	return true
+}
+
+func hasOperators(m map[string]interface{}) bool {
+	for k := range m {
+		if strings.HasPrefix(k, "$") {
+			return true
+		}
+	}
+	return false
+}
+
+func matchOperator(val interface{}, exists bool, op string, arg interface{}) bool {
+	switch op {
+	case "$exists":
+		want, _ := arg.(bool)
+		return exists == want
+	case "$not":
+		return !matchCondition(val, exists, arg)
+	}
+	if !exists {
+		return false
+	}
+	switch op {
+	case "$eq":
+		return collate(val, arg) == 0
+	case "$ne":
+		return collate(val, arg) != 0
+	case "$gt":
+		return sameType(val, arg) && collate(val, arg) > 0
+	case "$gte":
+		return sameType(val, arg) && collate(val, arg) >= 0
+	case "$lt":
+		return sameType(val, arg) && collate(val, arg) < 0
+	case "$lte":
+		return sameType(val, arg) && collate(val, arg) <= 0
+	case "$in":
+		list, _ := arg.([]interface{})
+		for _, item := range list {
+			if collate(val, item) == 0 {
+				return true
+			}
+		}
+		return false
+	case "$nin":
+		list, _ := arg.([]interface{})
+		for _, item := range list {
+			if collate(val, item) == 0 {
+				return false
+			}
+		}
+		return true
+	case "$size":
+		list, ok := val.([]interface{})
+		return ok && len(list) == toInt(arg)
+	case "$all":
+		list, ok := val.([]interface{})
+		wanted, _ := arg.([]interface{})
+		if !ok {
+			return false
+		}
+		for _, w := range wanted {
+			found := false
+			for _, item := range list {
+				if collate(item, w) == 0 {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
+	case "$elemMatch":
+		list, ok := val.([]interface{})
+		if !ok {
+			return false
+		}
+		for _, item := range list {
+			if sub, ok := item.(map[string]interface{}); ok {
+				if s, ok := arg.(map[string]interface{}); ok && !hasOperators(s) && matchSelector(sub, s) {
+					return true
+				}
+			}
+			if matchCondition(item, true, arg) {
+				return true
+			}
+		}
+		return false
+	case "$regex":
+		str, ok := val.(string)
+		pattern, _ := arg.(string)
+		if !ok {
+			return false
+		}
+		re, err := regexp.Compile(pattern)
+		return err == nil && re.MatchString(str)
+	case "$type":
+		name, _ := arg.(string)
+		return typeName(val) == name
+	}
+	return false
+}
+
+func sameType(a, b interface{}) bool {
+	return typeRank(a) == typeRank(b)
+}
+
+func typeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return ""
+}
+
+func toInt(v interface{}) int {
+	if f, ok := v.(float64); ok {
+		return int(f)
+	}
+	return 0
+}
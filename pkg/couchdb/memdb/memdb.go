@@ -0,0 +1,816 @@
+// Package memdb is an in-memory implementation of the subset of the CouchDB
+// HTTP API used by the stack: databases, documents, mango queries, views
+// and changes feeds. It is meant to run the tests without a CouchDB server,
+// and the documents are lost when the process exits.
+package memdb
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cozy/cozy-stack/pkg/utils"
+)
+
+type document struct {
+	id      string
+	rev     string
+	seq     int
+	deleted bool
+	body    map[string]interface{}
+}
+
+type database struct {
+	seq         int
+	docs        map[string]*document
+	partitioned bool
+	// the identifiers of the new documents are sequential, like with the
+	// default uuids algorithm of CouchDB
+	uuidPrefix string
+	uuidSeq    int
+	// the fields of the mango indexes, used to sort the results of the
+	// queries without sort, like CouchDB does
+	indexes [][]string
+	// the _local documents, by id, that are not listed with the others
+	locals map[string]map[string]interface{}
+	// the _security object of the database
+	security map[string]interface{}
+}
+
+// Server is an in-memory CouchDB. It can be used as an http.Handler, or as
+// the transport of an http.Client.
+type Server struct {
+	mu    sync.Mutex
+	dbs   map[string]*database
+	views map[string]*view
+}
+
+// NewServer returns a new server, without databases
+func NewServer() *Server {
+	return &Server{
+		dbs:   make(map[string]*database),
+		views: make(map[string]*view),
+	}
+}
+
+// Reset removes all the databases of the server
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dbs = make(map[string]*database)
+}
+
+// RoundTrip implements the http.RoundTripper interface
+func (s *Server) RoundTrip(req *http.Request) (*http.Response, error) {
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	res := rec.Result()
+	res.Request = req
+	return res, nil
+}
+
+// ServeHTTP implements the http.Handler interface
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	parts, err := splitPath(req.URL.EscapedPath())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	var body map[string]interface{}
+	if req.Body != nil {
+		defer req.Body.Close()
+		err = json.NewDecoder(req.Body).Decode(&body)
+		if err != nil && err != io.EOF {
+			writeError(w, http.StatusBadRequest, "bad_request", "invalid UTF-8 JSON")
+			return
+		}
+	}
+	q := req.URL.Query()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(parts) == 0 {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"couchdb": "Welcome",
+			"version": "2.0.0",
+		})
+		return
+	}
+	if parts[0] == "_all_dbs" {
+		s.allDbs(w)
+		return
+	}
+
+	name := parts[0]
+	if len(parts) == 1 {
+		switch req.Method {
+		case http.MethodPut:
+			s.createDB(w, name, q.Get("partitioned") == "true")
+		case http.MethodDelete:
+			s.deleteDB(w, name)
+		case http.MethodGet, http.MethodHead:
+			s.statusDB(w, name)
+		case http.MethodPost:
+			if db, ok := s.dbs[name]; ok {
+				db.createDoc(w, body)
+			} else {
+				writeNoDB(w)
+			}
+		default:
+			writeMethodNotAllowed(w)
+		}
+		return
+	}
+
+	db, ok := s.dbs[name]
+	if !ok {
+		writeNoDB(w)
+		return
+	}
+	switch parts[1] {
+	case "_find":
+		db.find(w, body, "")
+	case "_partition":
+		if len(parts) != 4 || parts[3] != "_find" {
+			writeError(w, http.StatusBadRequest, "bad_request", "Only _find is supported on a partition")
+			return
+		}
+		if !db.partitioned {
+			writeError(w, http.StatusBadRequest, "bad_request", "database is not partitioned")
+			return
+		}
+		db.find(w, body, parts[2])
+	case "_index":
+		db.index(w, body)
+	case "_all_docs":
+		db.allDocs(w, q, body)
+	case "_changes":
+		db.changes(w, q, body)
+	case "_bulk_docs":
+		db.bulkDocs(w, body)
+	case "_design":
+		if len(parts) < 3 {
+			writeError(w, http.StatusBadRequest, "illegal_docid", "Illegal document id `_design/`")
+			return
+		}
+		if len(parts) == 5 && parts[3] == "_view" {
+			s.queryView(w, db, parts[2], parts[4], q, body)
+			return
+		}
+		db.docRequest(w, req.Method, "_design/"+parts[2], q, body)
+	case "_local":
+		if len(parts) < 3 {
+			writeError(w, http.StatusBadRequest, "illegal_docid", "Illegal document id `_local/`")
+			return
+		}
+		db.localRequest(w, req.Method, "_local/"+parts[2], q, body)
+	case "_security":
+		db.securityRequest(w, req.Method, body)
+	case "_compact", "_view_cleanup":
+		// there is nothing to compact in memory
+		if req.Method != http.MethodPost {
+			writeMethodNotAllowed(w)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, map[string]interface{}{"ok": true})
+	default:
+		if strings.HasPrefix(parts[1], "_") {
+			writeError(w, http.StatusBadRequest, "illegal_docid", "Only reserved document ids may start with underscore.")
+			return
+		}
+		db.docRequest(w, req.Method, parts[1], q, body)
+	}
+}
+
+func (s *Server) allDbs(w http.ResponseWriter) {
+	names := make([]string, 0, len(s.dbs))
+	for name := range s.dbs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	writeJSON(w, http.StatusOK, names)
+}
+
+func (s *Server) createDB(w http.ResponseWriter, name string, partitioned bool) {
+	if _, ok := s.dbs[name]; ok {
+		writeError(w, http.StatusPreconditionFailed, "file_exists",
+			"The database could not be created, the file already exists.")
+		return
+	}
+	s.dbs[name] = &database{
+		docs:        make(map[string]*document),
+		partitioned: partitioned,
+		uuidPrefix:  strings.ToLower(utils.RandomString(26)),
+	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"ok": true})
+}
+
+func (s *Server) deleteDB(w http.ResponseWriter, name string) {
+	if _, ok := s.dbs[name]; !ok {
+		writeNoDB(w)
+		return
+	}
+	delete(s.dbs, name)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"ok": true})
+}
+
+func (s *Server) statusDB(w http.ResponseWriter, name string) {
+	db, ok := s.dbs[name]
+	if !ok {
+		writeNoDB(w)
+		return
+	}
+	props := make(map[string]interface{})
+	if db.partitioned {
+		props["partitioned"] = true
+	}
+	count, deleted := 0, 0
+	for _, doc := range db.docs {
+		if doc.deleted {
+			deleted++
+		} else {
+			count++
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"db_name":             name,
+		"update_seq":          strconv.Itoa(db.seq),
+		"doc_count":           count,
+		"doc_del_count":       deleted,
+		"purge_seq":           0,
+		"compact_running":     false,
+		"disk_format_version": 6,
+		"instance_start_time": "0",
+		"props":               props,
+		"sizes": map[string]interface{}{
+			"active":   0,
+			"external": 0,
+			"file":     0,
+		},
+	})
+}
+
+func (db *database) docRequest(w http.ResponseWriter, method, id string, q url.Values, body map[string]interface{}) {
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		doc, ok := db.docs[id]
+		if !ok {
+			writeError(w, http.StatusNotFound, "not_found", "missing")
+		} else if doc.deleted {
+			writeError(w, http.StatusNotFound, "not_found", "deleted")
+		} else {
+			w.Header().Set("ETag", strconv.Quote(doc.rev))
+			writeJSON(w, http.StatusOK, doc.body)
+		}
+	case http.MethodPut:
+		if db.partitioned && !strings.HasPrefix(id, "_design/") && !strings.Contains(id, ":") {
+			writeError(w, http.StatusBadRequest, "illegal_docid", "Doc id must be of form partition:id")
+			return
+		}
+		if body == nil {
+			body = make(map[string]interface{})
+		}
+		if _, ok := body["_rev"]; !ok && q.Get("rev") != "" {
+			body["_rev"] = q.Get("rev")
+		}
+		db.putDoc(w, id, body)
+	case http.MethodDelete:
+		db.putDoc(w, id, map[string]interface{}{
+			"_rev":     q.Get("rev"),
+			"_deleted": true,
+		})
+	default:
+		writeMethodNotAllowed(w)
+	}
+}
+
+// localRequest handles the requests on a _local document. Their revisions
+// are 0-1, 0-2, etc. and they have no history.
+func (db *database) localRequest(w http.ResponseWriter, method, id string, q url.Values, body map[string]interface{}) {
+	if db.locals == nil {
+		db.locals = make(map[string]map[string]interface{})
+	}
+	old, exists := db.locals[id]
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		if !exists {
+			writeError(w, http.StatusNotFound, "not_found", "missing")
+		} else {
+			writeJSON(w, http.StatusOK, old)
+		}
+		return
+	case http.MethodPut, http.MethodDelete:
+	default:
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	rev, _ := body["_rev"].(string)
+	if rev == "" {
+		rev = q.Get("rev")
+	}
+	if method == http.MethodDelete && !exists {
+		writeError(w, http.StatusNotFound, "not_found", "missing")
+		return
+	}
+	if exists && rev != old["_rev"] {
+		writeError(w, http.StatusConflict, "conflict", "Document update conflict.")
+		return
+	}
+	if method == http.MethodDelete {
+		delete(db.locals, id)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"ok": true, "id": id, "rev": "0-0"})
+		return
+	}
+
+	gen := 0
+	if exists {
+		gen, _ = strconv.Atoi(strings.TrimPrefix(rev, "0-"))
+	}
+	doc := make(map[string]interface{}, len(body)+2)
+	for k, v := range body {
+		doc[k] = v
+	}
+	doc["_id"] = id
+	doc["_rev"] = "0-" + strconv.Itoa(gen+1)
+	db.locals[id] = doc
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"ok": true, "id": id, "rev": doc["_rev"]})
+}
+
+// securityRequest reads or replaces the _security object of a database. It
+// is only kept, the accesses to the database are not checked.
+func (db *database) securityRequest(w http.ResponseWriter, method string, body map[string]interface{}) {
+	switch method {
+	case http.MethodGet:
+		security := db.security
+		if security == nil {
+			security = map[string]interface{}{}
+		}
+		writeJSON(w, http.StatusOK, security)
+	case http.MethodPut:
+		db.security = body
+		writeJSON(w, http.StatusOK, map[string]interface{}{"ok": true})
+	default:
+		writeMethodNotAllowed(w)
+	}
+}
+
+func (db *database) createDoc(w http.ResponseWriter, body map[string]interface{}) {
+	if body == nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "Document must be a JSON object")
+		return
+	}
+	id, _ := body["_id"].(string)
+	if id == "" {
+		id = db.nextUUID()
+	}
+	db.putDoc(w, id, body)
+}
+
+// nextUUID returns an identifier for a new document, greater than the
+// identifiers of the previous ones.
+func (db *database) nextUUID() string {
+	db.uuidSeq++
+	return fmt.Sprintf("%s%06x", db.uuidPrefix, db.uuidSeq)
+}
+
+func (db *database) putDoc(w http.ResponseWriter, id string, body map[string]interface{}) {
+	status, res := db.storeDoc(id, body)
+	writeJSON(w, status, res)
+}
+
+// storeDoc saves a new revision of a document, and returns the status and
+// the body of the response, or of the error.
+func (db *database) storeDoc(id string, body map[string]interface{}) (int, map[string]interface{}) {
+	rev, _ := body["_rev"].(string)
+	deleted, _ := body["_deleted"].(bool)
+	gen := 0
+	old, exists := db.docs[id]
+	switch {
+	case exists && !old.deleted && rev != old.rev:
+		return errorBody(http.StatusConflict, "conflict", "Document update conflict.")
+	case exists && old.deleted && rev != "" && rev != old.rev:
+		return errorBody(http.StatusConflict, "conflict", "Document update conflict.")
+	case !exists && (rev != "" || deleted):
+		if deleted {
+			return errorBody(http.StatusNotFound, "not_found", "missing")
+		}
+		return errorBody(http.StatusConflict, "conflict", "Document update conflict.")
+	}
+	if exists {
+		gen = revGeneration(old.rev)
+	}
+
+	doc := &document{id: id, deleted: deleted}
+	if deleted {
+		doc.body = map[string]interface{}{"_id": id, "_deleted": true}
+	} else {
+		doc.body = make(map[string]interface{}, len(body)+2)
+		for k, v := range body {
+			if k != "_rev" && k != "_deleted" {
+				doc.body[k] = v
+			}
+		}
+		doc.body["_id"] = id
+	}
+	data, _ := json.Marshal(doc.body)
+	sum := md5.Sum(append([]byte(rev), data...))
+	doc.rev = strconv.Itoa(gen+1) + "-" + hex.EncodeToString(sum[:])
+	doc.body["_rev"] = doc.rev
+	db.seq++
+	doc.seq = db.seq
+	db.docs[id] = doc
+
+	status := http.StatusCreated
+	if deleted {
+		status = http.StatusOK
+	}
+	return status, map[string]interface{}{
+		"ok":  true,
+		"id":  id,
+		"rev": doc.rev,
+	}
+}
+
+func errorBody(status int, name, reason string) (int, map[string]interface{}) {
+	return status, map[string]interface{}{
+		"error":  name,
+		"reason": reason,
+	}
+}
+
+// bulkDocs saves several documents. With new_edits=false, the documents are
+// stored with the revisions they already have, to restore the documents of a
+// database as they were. Else, each document is saved like with a PUT, and
+// the response tells for each of them its new revision or its error.
+func (db *database) bulkDocs(w http.ResponseWriter, body map[string]interface{}) {
+	newEdits := true
+	if ne, ok := body["new_edits"].(bool); ok {
+		newEdits = ne
+	}
+	list, _ := body["docs"].([]interface{})
+	docs := make([]map[string]interface{}, 0, len(list))
+	for _, d := range list {
+		doc, ok := d.(map[string]interface{})
+		if !ok {
+			writeError(w, http.StatusBadRequest, "bad_request", "Document must be a JSON object")
+			return
+		}
+		id, _ := doc["_id"].(string)
+		rev, _ := doc["_rev"].(string)
+		if !newEdits && (id == "" || rev == "") {
+			writeError(w, http.StatusBadRequest, "bad_request", "Document must have an _id and a _rev")
+			return
+		}
+		docs = append(docs, doc)
+	}
+	if newEdits {
+		results := make([]interface{}, len(docs))
+		for i, body := range docs {
+			id, _ := body["_id"].(string)
+			if id == "" {
+				id = db.nextUUID()
+			}
+			_, res := db.storeDoc(id, body)
+			res["id"] = id
+			results[i] = res
+		}
+		writeJSON(w, http.StatusCreated, results)
+		return
+	}
+	for _, body := range docs {
+		id := body["_id"].(string)
+		rev := body["_rev"].(string)
+		deleted, _ := body["_deleted"].(bool)
+		doc := &document{id: id, rev: rev, deleted: deleted}
+		if deleted {
+			doc.body = map[string]interface{}{"_id": id, "_rev": rev, "_deleted": true}
+		} else {
+			doc.body = make(map[string]interface{}, len(body))
+			for k, v := range body {
+				if k != "_deleted" {
+					doc.body[k] = v
+				}
+			}
+		}
+		db.seq++
+		doc.seq = db.seq
+		db.docs[id] = doc
+	}
+	writeJSON(w, http.StatusCreated, []interface{}{})
+}
+
+func (db *database) index(w http.ResponseWriter, body map[string]interface{}) {
+	if index, ok := body["index"].(map[string]interface{}); ok {
+		if fields := parseSort(index["fields"]); len(fields) > 0 {
+			names := make([]string, len(fields))
+			for i, f := range fields {
+				names[i] = f.field
+			}
+			db.addIndex(names)
+		}
+	}
+	name, _ := body["name"].(string)
+	ddoc, _ := body["ddoc"].(string)
+	if ddoc == "" {
+		ddoc = name
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"result": "created",
+		"id":     "_design/" + ddoc,
+		"name":   name,
+	})
+}
+
+func (db *database) addIndex(fields []string) {
+	for _, index := range db.indexes {
+		if strings.Join(index, ",") == strings.Join(fields, ",") {
+			return
+		}
+	}
+	db.indexes = append(db.indexes, fields)
+}
+
+func (db *database) allDocs(w http.ResponseWriter, q url.Values, body map[string]interface{}) {
+	includeDocs := q.Get("include_docs") == "true"
+	descending := q.Get("descending") == "true"
+	keys := q["keys"]
+	if list, ok := body["keys"].([]interface{}); ok {
+		keys = nil
+		for _, k := range list {
+			if id, ok := k.(string); ok {
+				keys = append(keys, id)
+			}
+		}
+	}
+
+	var docs []*document
+	if keys != nil {
+		for _, id := range keys {
+			if doc, ok := db.docs[id]; ok && !doc.deleted {
+				docs = append(docs, doc)
+			}
+		}
+	} else {
+		startKey := firstOf(q, "start_key", "startkey")
+		endKey := firstOf(q, "end_key", "endkey")
+		for _, doc := range db.sortedDocs() {
+			if doc.deleted {
+				continue
+			}
+			if descending {
+				if (startKey != "" && doc.id > startKey) || (endKey != "" && doc.id < endKey) {
+					continue
+				}
+			} else {
+				if (startKey != "" && doc.id < startKey) || (endKey != "" && doc.id > endKey) {
+					continue
+				}
+			}
+			docs = append(docs, doc)
+		}
+		if descending {
+			for i, j := 0, len(docs)-1; i < j; i, j = i+1, j-1 {
+				docs[i], docs[j] = docs[j], docs[i]
+			}
+		}
+	}
+
+	skip, _ := strconv.Atoi(q.Get("skip"))
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	docs = paginate(docs, skip, limit)
+	rows := make([]map[string]interface{}, len(docs))
+	for i, doc := range docs {
+		row := map[string]interface{}{
+			"id":    doc.id,
+			"key":   doc.id,
+			"value": map[string]interface{}{"rev": doc.rev},
+		}
+		if includeDocs {
+			row["doc"] = doc.body
+		}
+		rows[i] = row
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"total_rows": db.count(),
+		"offset":     skip,
+		"rows":       rows,
+	})
+}
+
+func (db *database) changes(w http.ResponseWriter, q url.Values, body map[string]interface{}) {
+	since := 0
+	if s := q.Get("since"); s == "now" {
+		since = db.seq
+	} else if s != "" {
+		since, _ = strconv.Atoi(strings.SplitN(s, "-", 2)[0])
+	}
+	includeDocs := q.Get("include_docs") == "true"
+	filter, err := changesFilter(q.Get("filter"), body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+
+	var docs []*document
+	for _, doc := range db.docs {
+		if doc.seq > since && filter(doc) {
+			docs = append(docs, doc)
+		}
+	}
+	sort.Sort(bySeq(docs))
+	if q.Get("descending") == "true" {
+		for i, j := 0, len(docs)-1; i < j; i, j = i+1, j-1 {
+			docs[i], docs[j] = docs[j], docs[i]
+		}
+	}
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	pending := 0
+	if limit > 0 && len(docs) > limit {
+		pending = len(docs) - limit
+		docs = docs[:limit]
+	}
+
+	lastSeq := since
+	results := make([]map[string]interface{}, len(docs))
+	for i, doc := range docs {
+		result := map[string]interface{}{
+			"seq":     strconv.Itoa(doc.seq),
+			"id":      doc.id,
+			"changes": []map[string]interface{}{{"rev": doc.rev}},
+		}
+		if doc.deleted {
+			result["deleted"] = true
+		}
+		if includeDocs {
+			result["doc"] = doc.body
+		}
+		if doc.seq > lastSeq {
+			lastSeq = doc.seq
+		}
+		results[i] = result
+	}
+
+	// The longpoll feed can't wait for a change, as the server is locked
+	// during a request: it is answered like a normal feed. The continuous feed
+	// sends the changes that are already there, and then ends like on a
+	// timeout.
+	if q.Get("feed") == "continuous" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		enc := json.NewEncoder(w)
+		for _, result := range results {
+			enc.Encode(result)
+		}
+		enc.Encode(map[string]interface{}{
+			"last_seq": strconv.Itoa(lastSeq),
+			"pending":  pending,
+		})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"last_seq": strconv.Itoa(lastSeq),
+		"pending":  pending,
+		"results":  results,
+	})
+}
+
+// changesFilter returns a function to filter the documents of a changes
+// feed. Only the _doc_ids and _selector built-in filters are supported.
+func changesFilter(name string, body map[string]interface{}) (func(*document) bool, error) {
+	switch name {
+	case "":
+		return func(*document) bool { return true }, nil
+	case "_doc_ids":
+		ids, _ := body["doc_ids"].([]interface{})
+		return func(doc *document) bool {
+			for _, id := range ids {
+				if id == doc.id {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case "_selector":
+		selector, ok := body["selector"].(map[string]interface{})
+		if !ok {
+			return nil, errors.New("Selector must be a JSON object")
+		}
+		return func(doc *document) bool {
+			return !doc.deleted && matchSelector(doc.body, selector)
+		}, nil
+	}
+	return nil, fmt.Errorf("Unsupported filter %s", name)
+}
+
+// sortedDocs returns the documents, including the deleted ones, sorted by
+// their identifiers.
+func (db *database) sortedDocs() []*document {
+	docs := make([]*document, 0, len(db.docs))
+	for _, doc := range db.docs {
+		docs = append(docs, doc)
+	}
+	sort.Sort(byID(docs))
+	return docs
+}
+
+func (db *database) count() int {
+	count := 0
+	for _, doc := range db.docs {
+		if !doc.deleted {
+			count++
+		}
+	}
+	return count
+}
+
+type byID []*document
+
+func (d byID) Len() int           { return len(d) }
+func (d byID) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d byID) Less(i, j int) bool { return d[i].id < d[j].id }
+
+type bySeq []*document
+
+func (d bySeq) Len() int           { return len(d) }
+func (d bySeq) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d bySeq) Less(i, j int) bool { return d[i].seq < d[j].seq }
+
+func paginate(docs []*document, skip, limit int) []*document {
+	if skip > len(docs) {
+		skip = len(docs)
+	}
+	docs = docs[skip:]
+	if limit > 0 && len(docs) > limit {
+		docs = docs[:limit]
+	}
+	return docs
+}
+
+func revGeneration(rev string) int {
+	gen, _ := strconv.Atoi(strings.SplitN(rev, "-", 2)[0])
+	return gen
+}
+
+func firstOf(q url.Values, keys ...string) string {
+	for _, k := range keys {
+		if v := q.Get(k); v != "" {
+			var str string
+			if err := json.Unmarshal([]byte(v), &str); err == nil {
+				return str
+			}
+			return v
+		}
+	}
+	return ""
+}
+
+// splitPath returns the unescaped segments of the path. The database names
+// can contain an escaped slash, so the path can't be unescaped before being
+// split.
+func splitPath(path string) ([]string, error) {
+	var parts []string
+	for _, part := range strings.Split(path, "/") {
+		if part == "" {
+			continue
+		}
+		p, err := url.QueryUnescape(part)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, p)
+	}
+	return parts, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, name, reason string) {
+	writeJSON(w, status, map[string]string{
+		"error":  name,
+		"reason": reason,
+	})
+}
+
+func writeNoDB(w http.ResponseWriter) {
+	writeError(w, http.StatusNotFound, "not_found", "Database does not exist.")
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter) {
+	writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Only GET,PUT,POST,DELETE allowed")
+}
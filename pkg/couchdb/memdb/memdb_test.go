@@ -0,0 +1,351 @@
+package memdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var client = &http.Client{Transport: NewServer()}
+
+func doRequest(t *testing.T, method, path string, body interface{}) (int, map[string]interface{}) {
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		assert.NoError(t, err)
+	}
+	req, err := http.NewRequest(method, "mem:///"+path, bytes.NewReader(data))
+	assert.NoError(t, err)
+	res, err := client.Do(req)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	var out map[string]interface{}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&out))
+	return res.StatusCode, out
+}
+
+func TestDatabases(t *testing.T) {
+	status, out := doRequest(t, "GET", "test%2Fdbs", nil)
+	assert.Equal(t, 404, status)
+	assert.Equal(t, "Database does not exist.", out["reason"])
+
+	status, _ = doRequest(t, "PUT", "test%2Fdbs", nil)
+	assert.Equal(t, 201, status)
+	status, out = doRequest(t, "PUT", "test%2Fdbs", nil)
+	assert.Equal(t, 412, status)
+	assert.Equal(t, "file_exists", out["error"])
+
+	status, out = doRequest(t, "GET", "test%2Fdbs", nil)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "test/dbs", out["db_name"])
+
+	status, _ = doRequest(t, "DELETE", "test%2Fdbs", nil)
+	assert.Equal(t, 200, status)
+	status, _ = doRequest(t, "GET", "test%2Fdbs", nil)
+	assert.Equal(t, 404, status)
+}
+
+func TestDocuments(t *testing.T) {
+	doRequest(t, "PUT", "test%2Fdocs", nil)
+
+	status, out := doRequest(t, "POST", "test%2Fdocs", map[string]interface{}{
+		"title": "foo",
+	})
+	assert.Equal(t, 201, status)
+	id := out["id"].(string)
+	rev := out["rev"].(string)
+	assert.NotEmpty(t, id)
+	assert.Equal(t, "1-", rev[:2])
+
+	status, out = doRequest(t, "GET", "test%2Fdocs/"+id, nil)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "foo", out["title"])
+	assert.Equal(t, rev, out["_rev"])
+
+	status, out = doRequest(t, "PUT", "test%2Fdocs/"+id, map[string]interface{}{
+		"title": "bar",
+	})
+	assert.Equal(t, 409, status)
+	assert.Equal(t, "conflict", out["error"])
+
+	status, out = doRequest(t, "PUT", "test%2Fdocs/"+id, map[string]interface{}{
+		"_rev":  rev,
+		"title": "bar",
+	})
+	assert.Equal(t, 201, status)
+	rev2 := out["rev"].(string)
+	assert.Equal(t, "2-", rev2[:2])
+
+	status, _ = doRequest(t, "DELETE", "test%2Fdocs/"+id+"?rev="+rev, nil)
+	assert.Equal(t, 409, status)
+	status, _ = doRequest(t, "DELETE", "test%2Fdocs/"+id+"?rev="+rev2, nil)
+	assert.Equal(t, 200, status)
+
+	status, out = doRequest(t, "GET", "test%2Fdocs/"+id, nil)
+	assert.Equal(t, 404, status)
+	assert.Equal(t, "deleted", out["reason"])
+	status, out = doRequest(t, "GET", "test%2Fdocs/unknown", nil)
+	assert.Equal(t, 404, status)
+	assert.Equal(t, "missing", out["reason"])
+}
+
+func TestFind(t *testing.T) {
+	doRequest(t, "PUT", "test%2Ffind", nil)
+	for i, name := range []string{"alice", "bob", "charlie", "dave"} {
+		doRequest(t, "POST", "test%2Ffind", map[string]interface{}{
+			"name": name,
+			"age":  20 + i,
+			"tags": []string{"friend"},
+			"address": map[string]interface{}{
+				"city": "Paris",
+			},
+		})
+	}
+
+	_, out := doRequest(t, "POST", "test%2Ffind/_find", map[string]interface{}{
+		"selector": map[string]interface{}{"name": "bob"},
+	})
+	docs := out["docs"].([]interface{})
+	if assert.Len(t, docs, 1) {
+		assert.Equal(t, 21.0, docs[0].(map[string]interface{})["age"])
+	}
+
+	_, out = doRequest(t, "POST", "test%2Ffind/_find", map[string]interface{}{
+		"selector": map[string]interface{}{
+			"age":          map[string]interface{}{"$gte": 21},
+			"address.city": "Paris",
+		},
+		"sort":   []string{"name", "desc"},
+		"fields": []string{"name"},
+		"limit":  2,
+	})
+	docs = out["docs"].([]interface{})
+	if assert.Len(t, docs, 2) {
+		assert.Equal(t, map[string]interface{}{"name": "dave"}, docs[0])
+		assert.Equal(t, map[string]interface{}{"name": "charlie"}, docs[1])
+	}
+
+	_, out = doRequest(t, "POST", "test%2Ffind/_find", map[string]interface{}{
+		"selector": map[string]interface{}{
+			"$or": []interface{}{
+				map[string]interface{}{"name": "alice"},
+				map[string]interface{}{"name": map[string]interface{}{"$in": []string{"dave"}}},
+			},
+			"tags": map[string]interface{}{"$all": []string{"friend"}},
+		},
+		"sort": []interface{}{map[string]string{"age": "asc"}},
+	})
+	docs = out["docs"].([]interface{})
+	if assert.Len(t, docs, 2) {
+		assert.Equal(t, "alice", docs[0].(map[string]interface{})["name"])
+		assert.Equal(t, "dave", docs[1].(map[string]interface{})["name"])
+	}
+}
+
+func TestFindWithIndex(t *testing.T) {
+	doRequest(t, "PUT", "test%2Findex", nil)
+	var ids []string
+	for _, age := range []int{30, 20, 30, 10} {
+		_, out := doRequest(t, "POST", "test%2Findex", map[string]interface{}{
+			"kind": "person",
+			"age":  age,
+		})
+		ids = append(ids, out["id"].(string))
+	}
+	// The identifiers of the new documents are sequential
+	for i := 1; i < len(ids); i++ {
+		assert.True(t, ids[i-1] < ids[i])
+	}
+
+	status, _ := doRequest(t, "POST", "test%2Findex/_index", map[string]interface{}{
+		"index": map[string]interface{}{"fields": []string{"kind", "age"}},
+	})
+	assert.Equal(t, 200, status)
+	_, out := doRequest(t, "POST", "test%2Findex/_find", map[string]interface{}{
+		"selector": map[string]interface{}{"kind": "person"},
+	})
+	docs := out["docs"].([]interface{})
+	if assert.Len(t, docs, 4) {
+		assert.Equal(t, ids[3], docs[0].(map[string]interface{})["_id"])
+		assert.Equal(t, ids[1], docs[1].(map[string]interface{})["_id"])
+		assert.Equal(t, ids[0], docs[2].(map[string]interface{})["_id"])
+		assert.Equal(t, ids[2], docs[3].(map[string]interface{})["_id"])
+	}
+}
+
+func TestChanges(t *testing.T) {
+	doRequest(t, "PUT", "test%2Fchanges", nil)
+	_, out := doRequest(t, "PUT", "test%2Fchanges/one", map[string]interface{}{"n": 1})
+	rev := out["rev"].(string)
+	doRequest(t, "PUT", "test%2Fchanges/two", map[string]interface{}{"n": 2})
+
+	_, out = doRequest(t, "GET", "test%2Fchanges/_changes", nil)
+	assert.Equal(t, "2", out["last_seq"])
+	assert.Len(t, out["results"], 2)
+
+	doRequest(t, "DELETE", "test%2Fchanges/one?rev="+rev, nil)
+	_, out = doRequest(t, "GET", "test%2Fchanges/_changes?since=2&include_docs=true", nil)
+	assert.Equal(t, "3", out["last_seq"])
+	results := out["results"].([]interface{})
+	if assert.Len(t, results, 1) {
+		result := results[0].(map[string]interface{})
+		assert.Equal(t, "one", result["id"])
+		assert.Equal(t, true, result["deleted"])
+	}
+}
+
+func TestBulkDocs(t *testing.T) {
+	doRequest(t, "PUT", "test%2Fbulk", nil)
+
+	status, out := doRequest(t, "POST", "test%2Fbulk/_bulk_docs", map[string]interface{}{
+		"new_edits": false,
+		"docs":      []interface{}{map[string]interface{}{"_id": "one"}},
+	})
+	assert.Equal(t, 400, status)
+	assert.Equal(t, "bad_request", out["error"])
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"new_edits": false,
+		"docs": []interface{}{
+			map[string]interface{}{"_id": "one", "_rev": "3-abc", "n": 1},
+			map[string]interface{}{"_id": "_design/foo", "_rev": "1-def"},
+		},
+	})
+	req, _ := http.NewRequest("POST", "mem:///test%2Fbulk/_bulk_docs", bytes.NewReader(body))
+	res, err := client.Do(req)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 201, res.StatusCode)
+
+	status, out = doRequest(t, "GET", "test%2Fbulk/one", nil)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "3-abc", out["_rev"])
+	assert.Equal(t, float64(1), out["n"])
+
+	_, out = doRequest(t, "GET", "test%2Fbulk/_all_docs", nil)
+	assert.Len(t, out["rows"], 2)
+
+	status, out = doRequest(t, "PUT", "test%2Fbulk/one", map[string]interface{}{
+		"_rev": "3-abc",
+		"n":    2,
+	})
+	assert.Equal(t, 201, status)
+	assert.Contains(t, out["rev"], "4-")
+}
+
+func TestBulkDocsNewEdits(t *testing.T) {
+	doRequest(t, "PUT", "test%2Fbulkedits", nil)
+	status, _ := doRequest(t, "PUT", "test%2Fbulkedits/two", map[string]interface{}{"n": 2})
+	assert.Equal(t, 201, status)
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"docs": []interface{}{
+			map[string]interface{}{"_id": "one", "n": 1},
+			map[string]interface{}{"_id": "two", "n": 3},
+			map[string]interface{}{"n": 4},
+		},
+	})
+	req, _ := http.NewRequest("POST", "mem:///test%2Fbulkedits/_bulk_docs", bytes.NewReader(body))
+	res, err := client.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res.Body.Close()
+	assert.Equal(t, 201, res.StatusCode)
+	var results []map[string]interface{}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&results))
+	if !assert.Len(t, results, 3) {
+		return
+	}
+	assert.Equal(t, "one", results[0]["id"])
+	assert.Equal(t, true, results[0]["ok"])
+	assert.Contains(t, results[0]["rev"], "1-")
+	assert.Equal(t, "two", results[1]["id"])
+	assert.Equal(t, "conflict", results[1]["error"])
+	assert.NotEmpty(t, results[2]["id"])
+	assert.Equal(t, true, results[2]["ok"])
+
+	status, out := doRequest(t, "GET", "test%2Fbulkedits/two", nil)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, float64(2), out["n"])
+}
+
+func TestViews(t *testing.T) {
+	server := NewServer()
+	c := &http.Client{Transport: server}
+	server.DefineView("io.cozy.files", "by-size", func(doc map[string]interface{}, emit func(key, value interface{})) {
+		if size, ok := doc["size"]; ok {
+			emit([]interface{}{doc["dir"], doc["_id"]}, size)
+		}
+	}, "_sum")
+
+	put := func(path string, body interface{}) {
+		data, _ := json.Marshal(body)
+		req, _ := http.NewRequest("PUT", "mem:///io-cozy-files/"+path, bytes.NewReader(data))
+		res, err := c.Do(req)
+		assert.NoError(t, err)
+		res.Body.Close()
+	}
+	get := func(path string) map[string]interface{} {
+		res, err := c.Get("mem:///io-cozy-files/_design/io.cozy.files/_view/by-size?" + path)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		var out map[string]interface{}
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&out))
+		return out
+	}
+	put("", nil)
+	put("_design/io.cozy.files", map[string]interface{}{"language": "javascript"})
+	put("a", map[string]interface{}{"dir": "x", "size": 10})
+	put("b", map[string]interface{}{"dir": "x", "size": 5})
+	put("c", map[string]interface{}{"dir": "y", "size": 1})
+	put("d", map[string]interface{}{"dir": "y"})
+
+	out := get("reduce=true")
+	rows := out["rows"].([]interface{})
+	if assert.Len(t, rows, 1) {
+		assert.Equal(t, 16.0, rows[0].(map[string]interface{})["value"])
+	}
+
+	out = get("reduce=true&group_level=1")
+	rows = out["rows"].([]interface{})
+	if assert.Len(t, rows, 2) {
+		assert.Equal(t, []interface{}{"x"}, rows[0].(map[string]interface{})["key"])
+		assert.Equal(t, 15.0, rows[0].(map[string]interface{})["value"])
+	}
+
+	out = get(`reduce=false&include_docs=true&start_key=["x","b"]&end_key=["y"]`)
+	rows = out["rows"].([]interface{})
+	if assert.Len(t, rows, 1) {
+		row := rows[0].(map[string]interface{})
+		assert.Equal(t, "b", row["id"])
+		assert.Equal(t, "x", row["doc"].(map[string]interface{})["dir"])
+	}
+}
+
+func TestSecurityAndCompaction(t *testing.T) {
+	doRequest(t, "PUT", "test%2Fsecurity", nil)
+
+	status, out := doRequest(t, "GET", "test%2Fsecurity/_security", nil)
+	assert.Equal(t, 200, status)
+	assert.Empty(t, out)
+	sec := map[string]interface{}{
+		"members": map[string]interface{}{"names": []string{"stack"}},
+	}
+	status, _ = doRequest(t, "PUT", "test%2Fsecurity/_security", sec)
+	assert.Equal(t, 200, status)
+	status, out = doRequest(t, "GET", "test%2Fsecurity/_security", nil)
+	assert.Equal(t, 200, status)
+	assert.Contains(t, out, "members")
+
+	status, _ = doRequest(t, "POST", "test%2Fsecurity/_compact", map[string]interface{}{})
+	assert.Equal(t, 202, status)
+	status, _ = doRequest(t, "POST", "test%2Fsecurity/_view_cleanup", map[string]interface{}{})
+	assert.Equal(t, 202, status)
+	status, _ = doRequest(t, "GET", "test%2Fsecurity/_compact", nil)
+	assert.Equal(t, 405, status)
+}
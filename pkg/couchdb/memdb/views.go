@@ -0,0 +1,361 @@
+package memdb
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MapFunc is the Go equivalent of the javascript map function of a view. It
+// is called for each document, that it can emit with zero, one or several
+// keys.
+type MapFunc func(doc map[string]interface{}, emit func(key, value interface{}))
+
+type view struct {
+	mapFn  MapFunc
+	reduce string
+}
+
+type row struct {
+	id    string
+	key   interface{}
+	value interface{}
+}
+
+// DefineView registers the map function and the reduce of a view, as the
+// server can't run the javascript of the design documents. The only reduce
+// functions supported are the _sum and _count builtins.
+func (s *Server) DefineView(ddoc, name string, fn MapFunc, reduce string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.views[ddoc+"/"+name] = &view{mapFn: fn, reduce: reduce}
+}
+
+// viewParams are the parameters of a view request. The keys are kept as raw
+// JSON to make the difference between a null key and no key.
+type viewParams struct {
+	Key          json.RawMessage   `json:"key"`
+	Keys         []json.RawMessage `json:"keys"`
+	StartKey     json.RawMessage   `json:"start_key"`
+	EndKey       json.RawMessage   `json:"end_key"`
+	Limit        int               `json:"limit"`
+	Skip         int               `json:"skip"`
+	Descending   bool              `json:"descending"`
+	IncludeDocs  bool              `json:"include_docs"`
+	InclusiveEnd *bool             `json:"inclusive_end"`
+	Reduce       *bool             `json:"reduce"`
+	Group        bool              `json:"group"`
+	GroupLevel   int               `json:"group_level"`
+}
+
+func parseViewParams(q url.Values, body map[string]interface{}) (*viewParams, error) {
+	params := make(map[string]json.RawMessage)
+	for k := range q {
+		v := q.Get(k)
+		var tmp interface{}
+		if err := json.Unmarshal([]byte(v), &tmp); err != nil {
+			v = strconv.Quote(v)
+		}
+		params[k] = json.RawMessage(v)
+	}
+	for k, v := range body {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		params[k] = data
+	}
+	if v, ok := params["startkey"]; ok {
+		params["start_key"] = v
+	}
+	if v, ok := params["endkey"]; ok {
+		params["end_key"] = v
+	}
+	data, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	var vp viewParams
+	if err = json.Unmarshal(data, &vp); err != nil {
+		return nil, err
+	}
+	return &vp, nil
+}
+
+func (s *Server) queryView(w http.ResponseWriter, db *database, ddoc, name string, q url.Values, body map[string]interface{}) {
+	if doc, ok := db.docs["_design/"+ddoc]; !ok || doc.deleted {
+		writeError(w, http.StatusNotFound, "not_found", "missing")
+		return
+	}
+	v, ok := s.views[ddoc+"/"+name]
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", "missing_named_view")
+		return
+	}
+	params, err := parseViewParams(q, body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "query_parse_error", err.Error())
+		return
+	}
+
+	var rows []*row
+	for _, doc := range db.sortedDocs() {
+		if doc.deleted || strings.HasPrefix(doc.id, "_design/") {
+			continue
+		}
+		id := doc.id
+		v.mapFn(doc.body, func(key, value interface{}) {
+			rows = append(rows, &row{id: id, key: normalize(key), value: normalize(value)})
+		})
+	}
+	sort.Stable(byKey(rows))
+	total := len(rows)
+	rows = filterRows(rows, params)
+
+	reduce := v.reduce != "" && (params.Reduce == nil || *params.Reduce)
+	if reduce {
+		rows = reduceRows(rows, v.reduce, params)
+	}
+
+	if params.Skip > len(rows) {
+		params.Skip = len(rows)
+	}
+	rows = rows[params.Skip:]
+	if params.Limit > 0 && len(rows) > params.Limit {
+		rows = rows[:params.Limit]
+	}
+
+	results := make([]map[string]interface{}, len(rows))
+	for i, r := range rows {
+		result := map[string]interface{}{
+			"key":   r.key,
+			"value": r.value,
+		}
+		if !reduce {
+			result["id"] = r.id
+			if params.IncludeDocs {
+				result["doc"] = db.docs[r.id].body
+			}
+		}
+		results[i] = result
+	}
+	if reduce {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"rows": results})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"total_rows": total,
+		"offset":     params.Skip,
+		"rows":       results,
+	})
+}
+
+// filterRows keeps the rows matching the key, keys, or start and end keys of
+// the request, in the requested order.
+func filterRows(rows []*row, params *viewParams) []*row {
+	var filtered []*row
+	if params.Keys != nil {
+		for _, raw := range params.Keys {
+			key := decode(raw)
+			for _, r := range rows {
+				if collate(r.key, key) == 0 {
+					filtered = append(filtered, r)
+				}
+			}
+		}
+		return filtered
+	}
+
+	if params.Descending {
+		for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+			rows[i], rows[j] = rows[j], rows[i]
+		}
+	}
+	inclusiveEnd := params.InclusiveEnd == nil || *params.InclusiveEnd
+	for _, r := range rows {
+		if params.Key != nil {
+			if collate(r.key, decode(params.Key)) != 0 {
+				continue
+			}
+		}
+		if params.StartKey != nil {
+			c := collate(r.key, decode(params.StartKey))
+			if (!params.Descending && c < 0) || (params.Descending && c > 0) {
+				continue
+			}
+		}
+		if params.EndKey != nil {
+			c := collate(r.key, decode(params.EndKey))
+			if params.Descending {
+				c = -c
+			}
+			if c > 0 || (c == 0 && !inclusiveEnd) {
+				continue
+			}
+		}
+		filtered = append(filtered, r)
+	}
+	return filtered
+}
+
+func reduceRows(rows []*row, reduce string, params *viewParams) []*row {
+	if !params.Group && params.GroupLevel == 0 {
+		if len(rows) == 0 {
+			return nil
+		}
+		return []*row{{key: nil, value: reduceValues(rows, reduce)}}
+	}
+	var groups [][]*row
+	var keys []interface{}
+	for _, r := range rows {
+		key := r.key
+		if list, ok := key.([]interface{}); ok && !params.Group && len(list) > params.GroupLevel {
+			key = list[:params.GroupLevel]
+		}
+		n := len(keys)
+		if n > 0 && collate(keys[n-1], key) == 0 {
+			groups[n-1] = append(groups[n-1], r)
+		} else {
+			keys = append(keys, key)
+			groups = append(groups, []*row{r})
+		}
+	}
+	reduced := make([]*row, len(groups))
+	for i, group := range groups {
+		reduced[i] = &row{key: keys[i], value: reduceValues(group, reduce)}
+	}
+	return reduced
+}
+
+func reduceValues(rows []*row, reduce string) interface{} {
+	if reduce == "_count" {
+		return float64(len(rows))
+	}
+	sum := 0.0
+	for _, r := range rows {
+		if f, ok := r.value.(float64); ok {
+			sum += f
+		}
+	}
+	return sum
+}
+
+type byKey []*row
+
+func (r byKey) Len() int      { return len(r) }
+func (r byKey) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r byKey) Less(i, j int) bool {
+	if c := collate(r[i].key, r[j].key); c != 0 {
+		return c < 0
+	}
+	return r[i].id < r[j].id
+}
+
+// normalize returns the value as it would be decoded from JSON, so that an
+// emitted []string or int can be compared with the keys of the requests.
+func normalize(v interface{}) interface{} {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return decode(data)
+}
+
+func decode(data json.RawMessage) interface{} {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil
+	}
+	return v
+}
+
+// typeRank gives the order of the JSON types in the CouchDB collation
+func typeRank(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 0
+	case bool:
+		return 1
+	case float64:
+		return 2
+	case string:
+		return 3
+	case []interface{}:
+		return 4
+	case map[string]interface{}:
+		return 5
+	}
+	return 6
+}
+
+// collate compares two JSON values, with an order close to the collation of
+// CouchDB (the strings are compared by their bytes, not with the ICU
+// algorithm).
+func collate(a, b interface{}) int {
+	ra, rb := typeRank(a), typeRank(b)
+	if ra != rb {
+		return compareInts(ra, rb)
+	}
+	switch a := a.(type) {
+	case bool:
+		b := b.(bool)
+		if a == b {
+			return 0
+		} else if !a {
+			return -1
+		}
+		return 1
+	case float64:
+		b := b.(float64)
+		if a < b {
+			return -1
+		} else if a > b {
+			return 1
+		}
+		return 0
+	case string:
+		return strings.Compare(a, b.(string))
+	case []interface{}:
+		b := b.([]interface{})
+		for i := 0; i < len(a) && i < len(b); i++ {
+			if c := collate(a[i], b[i]); c != 0 {
+				return c
+			}
+		}
+		return compareInts(len(a), len(b))
+	case map[string]interface{}:
+		b := b.(map[string]interface{})
+		ka, kb := sortedKeys(a), sortedKeys(b)
+		for i := 0; i < len(ka) && i < len(kb); i++ {
+			if c := strings.Compare(ka[i], kb[i]); c != 0 {
+				return c
+			}
+			if c := collate(a[ka[i]], b[kb[i]]); c != 0 {
+				return c
+			}
+		}
+		return compareInts(len(ka), len(kb))
+	}
+	return 0
+}
+
+func compareInts(a, b int) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
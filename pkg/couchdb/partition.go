@@ -0,0 +1,71 @@
+package couchdb
+
+import (
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/utils"
+)
+
+// partitionSeparator separates the partition key from the rest of the id of
+// a document in a partitioned database
+const partitionSeparator = ":"
+
+// partitionedDoctypes are the doctypes whose databases are created as
+// partitioned databases
+var partitionedDoctypes = make(map[string]bool)
+
+// Partitioner can be implemented by the documents of the partitioned
+// doctypes, to choose their partition, like the directory of a file. The
+// partition of the other documents is their doctype.
+type Partitioner interface {
+	Partition() string
+}
+
+// PartitionDoctypes makes the databases of some doctypes created as
+// partitioned databases, for the instances with a lot of documents. The
+// documents of a partition are stored together, and a query restricted to a
+// partition, with the Partition field of FindRequest, only reads them: its
+// cost does not grow with the size of the database. It needs CouchDB 3, and
+// it must be called before the creation of the databases, as an existing
+// database can't be partitioned.
+func PartitionDoctypes(doctypes ...string) {
+	for _, doctype := range doctypes {
+		partitionedDoctypes[doctype] = true
+	}
+}
+
+// IsPartitioned returns true if the databases of a doctype are partitioned
+func IsPartitioned(doctype string) bool {
+	return partitionedDoctypes[doctype]
+}
+
+// PartitionedID returns the id of a document in a partition. The documents
+// of a partitioned database must have such an id.
+func PartitionedID(partition, id string) string {
+	return partition + partitionSeparator + id
+}
+
+// PartitionOf returns the partition of the id of a document in a
+// partitioned database, or an empty string if it has none.
+func PartitionOf(id string) string {
+	if pos := strings.Index(id, partitionSeparator); pos > 0 {
+		return id[:pos]
+	}
+	return ""
+}
+
+// partitionOfDoc returns the partition of a new document
+func partitionOfDoc(doc Doc) string {
+	if p, ok := doc.(Partitioner); ok {
+		if partition := p.Partition(); partition != "" {
+			return partition
+		}
+	}
+	return doc.DocType()
+}
+
+// newPartitionedID returns a random id for a new document of a partitioned
+// database, as CouchDB can't generate it.
+func newPartitionedID(doc Doc) string {
+	return PartitionedID(partitionOfDoc(doc), utils.RandomString(32))
+}
@@ -0,0 +1,55 @@
+package couchdb
+
+import (
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPartitionedDB(t *testing.T) {
+	doctype := "io.cozy.tests.partition"
+	PartitionDoctypes(doctype)
+	defer delete(partitionedDoctypes, doctype)
+	defer DeleteDB(TestPrefix, doctype)
+	var status struct {
+		Props struct {
+			Partitioned bool `json:"partitioned"`
+		} `json:"props"`
+	}
+	err := CreateDB(TestPrefix, doctype)
+	if err == nil {
+		err = makeRequest("GET", makeDBName(TestPrefix, doctype), nil, &status)
+	}
+	if err != nil || !status.Props.Partitioned {
+		t.Skip("The partitioned databases need CouchDB 3")
+	}
+	assert.NoError(t, DefineIndex(TestPrefix, mango.IndexOnFields(doctype, "kind")))
+
+	doc := &JSONDoc{Type: doctype, M: map[string]interface{}{"kind": "a"}}
+	if !assert.NoError(t, CreateDoc(TestPrefix, doc)) {
+		return
+	}
+	assert.Equal(t, doctype, PartitionOf(doc.ID()))
+
+	for _, id := range []string{"one", "two"} {
+		named := &JSONDoc{Type: doctype, M: map[string]interface{}{
+			"_id":  PartitionedID("dir", id),
+			"kind": "a",
+		}}
+		assert.NoError(t, CreateNamedDoc(TestPrefix, named))
+	}
+	assert.Equal(t, "dir", PartitionOf(PartitionedID("dir", "one")))
+	assert.Equal(t, "", PartitionOf("one"))
+
+	var results []*JSONDoc
+	req := &FindRequest{Selector: mango.Equal("kind", "a"), Partition: "dir"}
+	if assert.NoError(t, FindDocs(TestPrefix, doctype, req, &results)) {
+		assert.Len(t, results, 2)
+	}
+	req.Partition = ""
+	results = nil
+	if assert.NoError(t, FindDocs(TestPrefix, doctype, req, &results)) {
+		assert.Len(t, results, 3)
+	}
+}
@@ -0,0 +1,167 @@
+package couchdb
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// MaxQueuedWrites is the maximal number of writes kept in memory while
+// CouchDB is unavailable. When the queue is full, the writes fail with an
+// unavailable error.
+const MaxQueuedWrites = 1000
+
+// The queued writes are replayed after queueRetryMin, and the delay is
+// doubled, up to queueRetryMax, while CouchDB is still unavailable.
+var (
+	queueRetryMin = 1 * time.Second
+	queueRetryMax = 30 * time.Second
+)
+
+// A queuedWrite is a deletion of a document that has been delayed because
+// CouchDB was unavailable.
+type queuedWrite struct {
+	db      Database
+	doctype string
+	id      string
+	rev     string
+}
+
+func (w *queuedWrite) key() string {
+	return w.db.Prefix() + w.doctype + "/" + w.id
+}
+
+// execWrite sends a queued write to CouchDB, and returns the new revision of
+// the document.
+func execWrite(w *queuedWrite) (string, error) {
+	return Delete(w.db, w.doctype, w.id, w.rev)
+}
+
+// writeQueue keeps the writes that have failed because CouchDB was
+// unavailable, and replays them in the same order when it is back. While the
+// queue is not empty, the new writes are queued after the others, even if
+// CouchDB is available, to keep the order.
+type writeQueue struct {
+	mu      sync.Mutex
+	writes  []*queuedWrite
+	running bool
+	exec    func(w *queuedWrite) (string, error)
+
+	// execMu serializes the writes that are not queued, so that a write
+	// can't be sent to CouchDB between the failure of a previous one and
+	// its queueing
+	execMu sync.Mutex
+}
+
+var queue = &writeQueue{exec: execWrite}
+
+func (q *writeQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.writes)
+}
+
+// do tries to execute the write, or queues it if CouchDB is unavailable.
+func (q *writeQueue) do(w *queuedWrite) (rev string, queued bool, err error) {
+	q.execMu.Lock()
+	defer q.execMu.Unlock()
+	q.mu.Lock()
+	pending := len(q.writes) > 0
+	q.mu.Unlock()
+	if !pending {
+		rev, err = q.exec(w)
+		if !IsUnavailableError(err) {
+			return rev, false, err
+		}
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.writes) >= MaxQueuedWrites {
+		return "", false, newQueueFullError()
+	}
+	q.writes = append(q.writes, w)
+	if !q.running {
+		q.running = true
+		go q.replay()
+	}
+	return "", true, nil
+}
+
+// replay sends the queued writes to CouchDB, in order, until the queue is
+// empty. A write that fails for another reason than the unavailability of
+// CouchDB, like a conflict, is logged and dropped.
+func (q *writeQueue) replay() {
+	delay := queueRetryMin
+	for {
+		time.Sleep(delay)
+		for {
+			q.mu.Lock()
+			if len(q.writes) == 0 {
+				q.running = false
+				q.mu.Unlock()
+				return
+			}
+			w := q.writes[0]
+			q.mu.Unlock()
+
+			_, err := q.exec(w)
+			if IsUnavailableError(err) {
+				break
+			}
+			q.mu.Lock()
+			q.writes = q.writes[1:]
+			q.mu.Unlock()
+			if err != nil {
+				log.Errorf("[couchdb] Queued write of %s could not be replayed: %s", w.key(), err)
+			}
+			delay = queueRetryMin
+		}
+		if delay *= 2; delay > queueRetryMax {
+			delay = queueRetryMax
+		}
+	}
+}
+
+// QueuedWrites returns the number of writes waiting for CouchDB to be
+// available.
+func QueuedWrites() int {
+	return queue.len()
+}
+
+// DeleteDocOrQueue deletes a document like DeleteDoc, but if CouchDB is
+// unavailable, the deletion is queued and replayed when CouchDB is back, and
+// no error is returned.
+func DeleteDocOrQueue(db Database, doc Doc) error {
+	w, err := newQueuedWrite(db, doc)
+	if err != nil {
+		return err
+	}
+	rev, queued, err := queue.do(w)
+	if err != nil {
+		return err
+	}
+	if queued {
+		log.Warnf("[couchdb] CouchDB is unavailable, the deletion of %s is queued", w.key())
+	} else {
+		doc.SetRev(rev)
+	}
+	return nil
+}
+
+func newQueuedWrite(db Database, doc Doc) (*queuedWrite, error) {
+	id, err := validateDocID(doc.ID())
+	if err != nil {
+		return nil, err
+	}
+	if id == "" || doc.Rev() == "" || doc.DocType() == "" {
+		return nil, fmt.Errorf("The queued document should have doctype, id and rev")
+	}
+	return &queuedWrite{
+		db:      db,
+		doctype: doc.DocType(),
+		id:      id,
+		rev:     doc.Rev(),
+	}, nil
+}
@@ -0,0 +1,123 @@
+package couchdb
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteQueue(t *testing.T) {
+	queueRetryMin = 10 * time.Millisecond
+	queueRetryMax = 20 * time.Millisecond
+	defer func() {
+		queueRetryMin = 1 * time.Second
+		queueRetryMax = 30 * time.Second
+	}()
+
+	var mu sync.Mutex
+	available := false
+	var done []string
+	q := &writeQueue{exec: func(w *queuedWrite) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !available {
+			return "", newConnectionError(fmt.Errorf("connection refused"))
+		}
+		if w.id == "conflict" {
+			return "", &Error{StatusCode: 409, Name: "conflict"}
+		}
+		done = append(done, w.id+"@"+w.rev)
+		return "2-" + w.id, nil
+	}}
+
+	db := SimpleDatabasePrefix("queue")
+	writes := []*queuedWrite{
+		{db: db, doctype: "io.cozy.sessions", id: "one", rev: "1-a"},
+		{db: db, doctype: "io.cozy.sessions", id: "conflict", rev: "1-b"},
+		{db: db, doctype: "io.cozy.sessions", id: "two", rev: "1-c"},
+		{db: db, doctype: "io.cozy.triggers", id: "three", rev: "1-d"},
+	}
+	for _, w := range writes {
+		_, queued, err := q.do(w)
+		assert.NoError(t, err)
+		assert.True(t, queued)
+	}
+	assert.Equal(t, 4, q.len())
+
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, 4, q.len())
+
+	mu.Lock()
+	available = true
+	mu.Unlock()
+	for i := 0; i < 100 && q.len() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 0, q.len())
+
+	mu.Lock()
+	assert.Equal(t, []string{"one@1-a", "two@1-c", "three@1-d"}, done)
+	mu.Unlock()
+
+	rev, queued, err := q.do(&queuedWrite{db: db, doctype: "io.cozy.sessions", id: "four", rev: "1-e"})
+	assert.NoError(t, err)
+	assert.False(t, queued)
+	assert.Equal(t, "2-four", rev)
+}
+
+func TestWriteQueueOrder(t *testing.T) {
+	queueRetryMin = 10 * time.Millisecond
+	defer func() { queueRetryMin = 1 * time.Second }()
+
+	var mu sync.Mutex
+	var done []string
+	var once sync.Once
+	started := make(chan struct{})
+	q := &writeQueue{exec: func(w *queuedWrite) (string, error) {
+		failed := false
+		once.Do(func() {
+			// CouchDB becomes unavailable during the first write
+			close(started)
+			time.Sleep(20 * time.Millisecond)
+			failed = true
+		})
+		if failed {
+			return "", newConnectionError(fmt.Errorf("connection refused"))
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		done = append(done, w.id)
+		return "2-" + w.id, nil
+	}}
+
+	db := SimpleDatabasePrefix("queue")
+	ch := make(chan bool)
+	go func() {
+		_, queued, _ := q.do(&queuedWrite{db: db, doctype: "io.cozy.sessions", id: "first", rev: "1-a"})
+		ch <- queued
+	}()
+	<-started
+
+	// The second write waits for the first one, and is queued after it
+	_, queued, err := q.do(&queuedWrite{db: db, doctype: "io.cozy.sessions", id: "second", rev: "1-b"})
+	assert.NoError(t, err)
+	assert.True(t, queued)
+	assert.True(t, <-ch)
+
+	for i := 0; i < 100 && q.len() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	assert.Equal(t, []string{"first", "second"}, done)
+	mu.Unlock()
+}
+
+func TestIsUnavailableError(t *testing.T) {
+	assert.True(t, IsUnavailableError(newConnectionError(fmt.Errorf("refused"))))
+	assert.True(t, IsUnavailableError(newQueueFullError()))
+	assert.False(t, IsUnavailableError(&Error{StatusCode: 409, Name: "conflict"}))
+	assert.False(t, IsUnavailableError(fmt.Errorf("not a couchdb error")))
+}
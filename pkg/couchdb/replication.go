@@ -0,0 +1,210 @@
+package couchdb
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+)
+
+// replicatorDB is the database of the replication jobs of CouchDB
+const replicatorDB = "_replicator"
+
+// The states of a replication job, as given by GetReplicationStatus
+const (
+	ReplicationInitializing = "initializing"
+	ReplicationRunning      = "running"
+	ReplicationPending      = "pending"
+	ReplicationCompleted    = "completed"
+	ReplicationCrashing     = "crashing"
+	ReplicationError        = "error"
+	ReplicationFailed       = "failed"
+)
+
+// ReplicationEndpoint is the source or the target of a replication: the URL
+// of a database, and the headers of the requests to it, like an
+// Authorization header for a remote cozy.
+type ReplicationEndpoint struct {
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// Replication describes a replication between two databases. The
+// documents can be filtered by their ids, or by a mango selector.
+type Replication struct {
+	ID           string               `json:"_id,omitempty"`
+	Source       *ReplicationEndpoint `json:"source"`
+	Target       *ReplicationEndpoint `json:"target"`
+	Continuous   bool                 `json:"continuous,omitempty"`
+	CreateTarget bool                 `json:"create_target,omitempty"`
+	DocIDs       []string             `json:"doc_ids,omitempty"`
+	Selector     mango.Filter         `json:"selector,omitempty"`
+}
+
+// ReplicateResponse is the response of CouchDB to Replicate. For a
+// continuous replication, LocalID is the identifier to give to
+// CancelReplicate, and there are no statistics.
+type ReplicateResponse struct {
+	OK               bool   `json:"ok"`
+	LocalID          string `json:"_local_id,omitempty"`
+	NoChanges        bool   `json:"no_changes,omitempty"`
+	DocsRead         int    `json:"-"`
+	DocsWritten      int    `json:"-"`
+	DocWriteFailures int    `json:"-"`
+}
+
+// ReplicationStatus is the state of a replication job, created with
+// StartReplication. Info has the statistics of the replication, or the
+// reason of its error.
+type ReplicationStatus struct {
+	ID         string      `json:"doc_id"`
+	State      string      `json:"state"`
+	Info       interface{} `json:"info,omitempty"`
+	ErrorCount int         `json:"error_count,omitempty"`
+}
+
+// LocalEndpoint returns the endpoint of the database of a doctype, for a
+// replication from or to it. The credentials of CouchDB in the
+// configuration are kept in the URL.
+func LocalEndpoint(db Database, doctype string) *ReplicationEndpoint {
+	return &ReplicationEndpoint{URL: config.CouchURL() + makeDBName(db, doctype)}
+}
+
+// NewPushReplication returns a replication of the database of a doctype to
+// a remote endpoint.
+func NewPushReplication(db Database, doctype string, target *ReplicationEndpoint) *Replication {
+	return &Replication{Source: LocalEndpoint(db, doctype), Target: target}
+}
+
+// NewPullReplication returns a replication from a remote endpoint to the
+// database of a doctype, that is created if it does not exist.
+func NewPullReplication(db Database, doctype string, source *ReplicationEndpoint) *Replication {
+	return &Replication{
+		Source:       source,
+		Target:       LocalEndpoint(db, doctype),
+		CreateTarget: true,
+	}
+}
+
+// Replicate runs a replication with the _replicate endpoint of CouchDB. A
+// normal replication is finished when it returns, and a continuous one runs
+// until it is cancelled with CancelReplicate, or until CouchDB is restarted.
+// StartReplication should be preferred for the long replications.
+func Replicate(rep *Replication) (*ReplicateResponse, error) {
+	var res struct {
+		ReplicateResponse
+		History []struct {
+			DocsRead         int `json:"docs_read"`
+			DocsWritten      int `json:"docs_written"`
+			DocWriteFailures int `json:"doc_write_failures"`
+		} `json:"history"`
+	}
+	if err := makeLongRequest("POST", "_replicate", rep, &res); err != nil {
+		return nil, err
+	}
+	response := res.ReplicateResponse
+	if len(res.History) > 0 {
+		response.DocsRead = res.History[0].DocsRead
+		response.DocsWritten = res.History[0].DocsWritten
+		response.DocWriteFailures = res.History[0].DocWriteFailures
+	}
+	return &response, nil
+}
+
+// CancelReplicate stops a continuous replication started by Replicate
+func CancelReplicate(localID string) error {
+	req := map[string]interface{}{
+		"replication_id": localID,
+		"cancel":         true,
+	}
+	return makeRequest("POST", "_replicate", req, nil)
+}
+
+// StartReplication creates a job for a replication in the _replicator
+// database. The job is run by CouchDB, even after a restart, until it is
+// completed or cancelled with CancelReplication. Its identifier is set on the
+// replication.
+func StartReplication(rep *Replication) error {
+	var res updateResponse
+	err := makeRequest("POST", replicatorDB, rep, &res)
+	if IsNoDatabaseError(err) {
+		if err = makeRequest("PUT", replicatorDB, nil, nil); err == nil || isFileExistsError(err) {
+			err = makeRequest("POST", replicatorDB, rep, &res)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	rep.ID = res.ID
+	return nil
+}
+
+// GetReplicationStatus returns the state of a replication job. It is given
+// by the scheduler of CouchDB, or by the state written in the document of
+// the job for the versions of CouchDB without scheduler.
+func GetReplicationStatus(id string) (*ReplicationStatus, error) {
+	var status ReplicationStatus
+	path := "_scheduler/docs/" + replicatorDB + "/" + url.QueryEscape(id)
+	err := makeRequest("GET", path, nil, &status)
+	if err == nil {
+		return &status, nil
+	}
+	// CouchDB 2.0 has no scheduler
+	couchErr, ok := IsCouchError(err)
+	if !ok || (couchErr.StatusCode != http.StatusBadRequest && !IsNotFoundError(err)) {
+		return nil, err
+	}
+
+	var doc struct {
+		State  string `json:"_replication_state"`
+		Reason string `json:"_replication_state_reason"`
+	}
+	if err = makeRequest("GET", replicatorDB+"/"+url.QueryEscape(id), nil, &doc); err != nil {
+		return nil, err
+	}
+	status = ReplicationStatus{ID: id, State: doc.State}
+	switch doc.State {
+	case "":
+		status.State = ReplicationInitializing
+	case "triggered":
+		status.State = ReplicationRunning
+	}
+	if doc.Reason != "" {
+		status.Info = doc.Reason
+	}
+	return &status, nil
+}
+
+// CancelReplication stops a replication job, and removes it from the
+// _replicator database.
+func CancelReplication(id string) error {
+	path := replicatorDB + "/" + url.QueryEscape(id)
+	var doc struct {
+		Rev string `json:"_rev"`
+	}
+	if err := makeRequest("GET", path, nil, &doc); err != nil {
+		return err
+	}
+	return makeRequest("DELETE", path+"?rev="+url.QueryEscape(doc.Rev), nil, nil)
+}
+
+// makeLongRequest is like makeRequest, for the requests that can last longer
+// than the timeout of the requests to CouchDB. They are not retried.
+func makeLongRequest(method, path string, reqbody interface{}, resbody interface{}) error {
+	var reqjson []byte
+	if reqbody != nil {
+		var err error
+		if reqjson, err = json.Marshal(reqbody); err != nil {
+			return err
+		}
+	}
+	return doRequest(longHTTPClient(), method, path, reqjson, reqbody != nil, resbody)
+}
+
+// isFileExistsError returns true for the error of CouchDB when a database
+// is created twice
+func isFileExistsError(err error) bool {
+	return hasStatus(err, http.StatusPreconditionFailed)
+}
@@ -0,0 +1,64 @@
+package couchdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplication(t *testing.T) {
+	if InMemory() {
+		t.Skip("The replications are not supported by the in-memory backend")
+	}
+	source := "io.cozy.tests.replication.source"
+	target := "io.cozy.tests.replication.target"
+	defer DeleteDB(TestPrefix, source)
+	defer DeleteDB(TestPrefix, target)
+
+	docs := []Doc{
+		JSONDoc{Type: source, M: map[string]interface{}{"_id": "one", "shared": true}},
+		JSONDoc{Type: source, M: map[string]interface{}{"_id": "two", "shared": false}},
+	}
+	if !assert.NoError(t, BulkCreateDocs(TestPrefix, source, docs)) {
+		return
+	}
+
+	rep := NewPushReplication(TestPrefix, source, LocalEndpoint(TestPrefix, target))
+	rep.CreateTarget = true
+	rep.Selector = mango.Equal("shared", true)
+	res, err := Replicate(rep)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, res.OK)
+	assert.Equal(t, 1, res.DocsWritten)
+	doc := &JSONDoc{}
+	assert.NoError(t, GetDoc(TestPrefix, target, "one", doc))
+	assert.True(t, IsNotFoundError(GetDoc(TestPrefix, target, "two", doc)))
+
+	rep = NewPullReplication(TestPrefix, target, LocalEndpoint(TestPrefix, source))
+	rep.DocIDs = []string{"two"}
+	if !assert.NoError(t, StartReplication(rep)) {
+		return
+	}
+	assert.NotEmpty(t, rep.ID)
+	defer CancelReplication(rep.ID)
+	var status *ReplicationStatus
+	for i := 0; i < 50; i++ {
+		status, err = GetReplicationStatus(rep.ID)
+		if err != nil || status.State == ReplicationCompleted {
+			break
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	if assert.NoError(t, err) {
+		assert.Equal(t, ReplicationCompleted, status.State)
+	}
+	assert.NoError(t, GetDoc(TestPrefix, target, "two", doc))
+
+	assert.NoError(t, CancelReplication(rep.ID))
+	_, err = GetReplicationStatus(rep.ID)
+	assert.True(t, IsNotFoundError(err))
+}
@@ -0,0 +1,130 @@
+package couchdb
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+)
+
+// retrier decides if a failed request to CouchDB can be tried again, and
+// after which delay. The delays grow exponentially, with some jitter, and
+// their sum is limited by the budget of the configuration.
+type retrier struct {
+	cfg    config.CouchDB
+	tries  int
+	waited time.Duration
+}
+
+func newRetrier() *retrier {
+	return &retrier{cfg: config.GetConfig().CouchDB}
+}
+
+// next returns the delay before the next try of a request, and false if it
+// must not be tried again.
+func (r *retrier) next(method, path string, err error) (time.Duration, bool) {
+	if r.tries >= r.cfg.MaxRetries || !isTransientError(method, path, err) {
+		return 0, false
+	}
+	delay := r.delay()
+	if r.waited+delay > r.cfg.RetryBudget {
+		return 0, false
+	}
+	r.tries++
+	r.waited += delay
+	return delay, true
+}
+
+// delay is the exponential delay for the current try, with a jitter of +/-
+// 25% to avoid that the stacks retry all at the same time.
+func (r *retrier) delay() time.Duration {
+	delay := r.cfg.RetryDelay << uint(r.tries)
+	if delay > r.cfg.RetryMaxDelay || delay <= 0 {
+		delay = r.cfg.RetryMaxDelay
+	}
+	jitter := time.Duration(rand.Int63n(int64(delay)/2 + 1))
+	return delay*3/4 + jitter
+}
+
+// isTransientError returns true if the error of a request is transient and
+// the request can be safely sent again: the 429 and 503 responses, as the
+// request has not been processed, and the connection errors. A write is
+// retried after a connection error only if the connection could not be
+// opened, since it may have been done before the connection was lost.
+func isTransientError(method, path string, err error) bool {
+	couchErr, ok := err.(*Error)
+	if !ok {
+		return false
+	}
+	switch couchErr.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+	default:
+		return false
+	}
+	if couchErr.Name != "no_couch" {
+		return true
+	}
+	if couchErr.Reason != connectionErrorReason {
+		return false
+	}
+	return isReadRequest(method, path) || isDialError(couchErr.Original)
+}
+
+// isReadRequest returns true for the requests that don't modify the
+// documents, including the queries made with a POST.
+func isReadRequest(method, path string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		return true
+	case http.MethodPost:
+		if pos := strings.IndexByte(path, '?'); pos >= 0 {
+			path = path[:pos]
+		}
+		return strings.HasSuffix(path, "/_find") ||
+			strings.HasSuffix(path, "/_all_docs") ||
+			strings.Contains(path, "/_view/")
+	}
+	return false
+}
+
+func isDialError(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	opErr, ok := err.(*net.OpError)
+	return ok && opErr.Op == "dial"
+}
+
+// UpdateDocWithRetry applies a mutation to a document and saves it. On a
+// conflict, the document is fetched again from CouchDB, in the same struct,
+// and the mutation is applied again on it, so it must only depend on the
+// document. If the mutation returns an error, the document is not saved. The
+// document must be a pointer to a struct.
+func UpdateDocWithRetry(db Database, doc Doc, mutate func(doc Doc) error) error {
+	val := reflect.ValueOf(doc)
+	if val.Kind() != reflect.Ptr || val.Elem().Kind() != reflect.Struct {
+		return errors.New("UpdateDocWithRetry doc argument should be a pointer to a struct")
+	}
+	r := newRetrier()
+	for {
+		if err := mutate(doc); err != nil {
+			return err
+		}
+		err := UpdateDoc(db, doc)
+		if !IsConflictError(err) || r.tries >= r.cfg.MaxRetries {
+			return err
+		}
+		r.tries++
+		fresh := reflect.New(val.Elem().Type())
+		if err = GetDoc(db, doc.DocType(), doc.ID(), fresh.Interface().(Doc)); err != nil {
+			return err
+		}
+		val.Elem().Set(fresh.Elem())
+	}
+}
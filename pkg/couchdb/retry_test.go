@@ -0,0 +1,85 @@
+package couchdb
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransientErrors(t *testing.T) {
+	dialErr := &url.Error{Op: "Put", Err: &net.OpError{Op: "dial", Err: errors.New("refused")}}
+	resetErr := &url.Error{Op: "Put", Err: &net.OpError{Op: "read", Err: errors.New("reset")}}
+
+	assert.True(t, isTransientError("GET", "db/doc", newConnectionError(resetErr)))
+	assert.True(t, isTransientError("POST", "db/_find", newConnectionError(resetErr)))
+	assert.True(t, isTransientError("PUT", "db/doc", newConnectionError(dialErr)))
+	assert.False(t, isTransientError("PUT", "db/doc", newConnectionError(resetErr)))
+	assert.False(t, isTransientError("POST", "db", newConnectionError(resetErr)))
+	assert.False(t, isTransientError("GET", "db/doc", newQueueFullError()))
+
+	assert.True(t, isTransientError("PUT", "db/doc", &Error{StatusCode: 503, Name: "service_unavailable"}))
+	assert.True(t, isTransientError("POST", "db", &Error{StatusCode: 429, Name: "too_many_requests"}))
+	assert.False(t, isTransientError("PUT", "db/doc", &Error{StatusCode: 409, Name: "conflict"}))
+	assert.False(t, isTransientError("GET", "db/doc", errors.New("not a couch error")))
+}
+
+func TestRetrier(t *testing.T) {
+	r := &retrier{cfg: config.CouchDB{
+		MaxRetries:    5,
+		RetryDelay:    100 * time.Millisecond,
+		RetryMaxDelay: 300 * time.Millisecond,
+		RetryBudget:   time.Second,
+	}}
+	err := &Error{StatusCode: 503, Name: "service_unavailable"}
+	var total time.Duration
+	for {
+		delay, ok := r.next("GET", "db/doc", err)
+		if !ok {
+			break
+		}
+		assert.True(t, delay >= 75*time.Millisecond)
+		assert.True(t, delay <= 375*time.Millisecond)
+		total += delay
+	}
+	assert.True(t, r.tries >= 2)
+	assert.True(t, r.tries <= 5)
+	assert.True(t, total <= time.Second)
+
+	r = &retrier{cfg: config.CouchDB{MaxRetries: 0, RetryDelay: time.Millisecond}}
+	_, ok := r.next("GET", "db/doc", err)
+	assert.False(t, ok)
+}
+
+func TestUpdateDocWithRetry(t *testing.T) {
+	doc := &testDoc{Test: "retry"}
+	if !assert.NoError(t, CreateDoc(TestPrefix, doc)) {
+		return
+	}
+	defer DeleteDoc(TestPrefix, doc)
+
+	other := &testDoc{}
+	assert.NoError(t, GetDoc(TestPrefix, TestDoctype, doc.ID(), other))
+	other.FieldA = "concurrent"
+	assert.NoError(t, UpdateDoc(TestPrefix, other))
+
+	err := UpdateDocWithRetry(TestPrefix, doc, func(d Doc) error {
+		d.(*testDoc).FieldB++
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "concurrent", doc.FieldA)
+	assert.Equal(t, 1, doc.FieldB)
+
+	fetched := &testDoc{}
+	assert.NoError(t, GetDoc(TestPrefix, TestDoctype, doc.ID(), fetched))
+	assert.Equal(t, doc.Rev(), fetched.Rev())
+	assert.Equal(t, 1, fetched.FieldB)
+
+	err = UpdateDocWithRetry(TestPrefix, JSONDoc{Type: TestDoctype}, func(Doc) error { return nil })
+	assert.Error(t, err)
+}
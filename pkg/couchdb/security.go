@@ -0,0 +1,80 @@
+package couchdb
+
+import (
+	"github.com/cozy/cozy-stack/pkg/config"
+)
+
+// SecurityMembers are the users and roles of a section of a _security object
+type SecurityMembers struct {
+	Names []string `json:"names"`
+	Roles []string `json:"roles"`
+}
+
+// Security is the _security object of a database. Only the server admins,
+// and the admins and members given here, can access the database. It is
+// open to everyone when there is no member.
+type Security struct {
+	Admins  SecurityMembers `json:"admins"`
+	Members SecurityMembers `json:"members"`
+}
+
+// securityURL returns the path of the _security object of a database
+func securityURL(db Database, doctype string) string {
+	return makeDBName(db, doctype) + "/_security"
+}
+
+// GetSecurity returns the _security object of the database of a doctype
+func GetSecurity(db Database, doctype string) (*Security, error) {
+	var sec Security
+	if err := makeRequest("GET", securityURL(db, doctype), nil, &sec); err != nil {
+		return nil, fixErrorNoDatabaseIsWrongDoctype(err)
+	}
+	return &sec, nil
+}
+
+// SetSecurity replaces the _security object of the database of a doctype
+func SetSecurity(db Database, doctype string, sec *Security) error {
+	err := makeRequest("PUT", securityURL(db, doctype), sec, nil)
+	return fixErrorNoDatabaseIsWrongDoctype(err)
+}
+
+// DefaultSecurity returns the _security object given to the databases
+// created by the stack, that restricts them to the users and roles of the
+// configuration (couchdb.security). It is nil if there is none, and the
+// databases are left open.
+func DefaultSecurity() *Security {
+	cfg := config.GetConfig().CouchDB
+	if len(cfg.SecurityNames) == 0 && len(cfg.SecurityRoles) == 0 {
+		return nil
+	}
+	members := SecurityMembers{
+		Names: cfg.SecurityNames,
+		Roles: cfg.SecurityRoles,
+	}
+	if members.Names == nil {
+		members.Names = []string{}
+	}
+	if members.Roles == nil {
+		members.Roles = []string{}
+	}
+	return &Security{Admins: members, Members: members}
+}
+
+// UpdateSecurity sets the default _security object on all the databases of
+// db, for the databases created before it was configured.
+func UpdateSecurity(db Database) error {
+	sec := DefaultSecurity()
+	if sec == nil {
+		return nil
+	}
+	doctypes, err := AllDoctypes(db)
+	if err != nil {
+		return err
+	}
+	for _, doctype := range doctypes {
+		if err = SetSecurity(db, doctype, sec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+// Package devcerts generates the TLS certificates for the local development
+// domains, like cozy.tools, so that the stack can be tested with https
+// without any manual work with openssl. The certificates are signed by a
+// local certificate authority, that the developer can add to the trusted ones
+// of the browser.
+package devcerts
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// CAFilename is the name of the file with the certificate of the local
+	// certificate authority, in PEM format
+	CAFilename = "ca.crt"
+	// CAKeyFilename is the name of the file with the private key of the local
+	// certificate authority
+	CAKeyFilename = "ca.key"
+
+	caValidity   = 10 * 365 * 24 * time.Hour
+	certValidity = 365 * 24 * time.Hour
+)
+
+var (
+	// ErrMissingServerName is used when the TLS client has not sent the name
+	// of the server it wants to reach
+	ErrMissingServerName = errors.New("The TLS client has not sent a server name")
+	// ErrDomainNotAllowed is used when a certificate is asked for a domain
+	// that is not a development domain
+	ErrDomainNotAllowed = errors.New("No certificate can be generated for this domain")
+	// ErrInvalidCA is used when the files of the certificate authority can't
+	// be parsed
+	ErrInvalidCA = errors.New("Invalid certificate authority")
+)
+
+// Manager issues the certificates for the development domains and their
+// subdomains. The certificates are kept in memory, only the certificate
+// authority is saved on disk.
+type Manager struct {
+	dir     string
+	domains []string
+	ca      *x509.Certificate
+	caKey   *ecdsa.PrivateKey
+
+	mu    sync.Mutex
+	certs map[string]*tls.Certificate
+}
+
+// New returns a manager for the given domains, with the certificate authority
+// of the dir directory. The certificate authority is created if it does not
+// exist yet.
+func New(dir string, domains []string) (*Manager, error) {
+	m := &Manager{
+		dir:     dir,
+		domains: make([]string, len(domains)),
+		certs:   make(map[string]*tls.Certificate),
+	}
+	for i, domain := range domains {
+		m.domains[i] = strings.ToLower(strings.TrimPrefix(domain, "."))
+	}
+	err := m.loadCA()
+	if os.IsNotExist(err) {
+		err = m.createCA()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// CAFile returns the path of the certificate of the local certificate
+// authority, that can be imported in the browsers.
+func (m *Manager) CAFile() string {
+	return filepath.Join(m.dir, CAFilename)
+}
+
+// TLSConfig returns a TLS configuration that uses the certificates of the
+// manager.
+func (m *Manager) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: m.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// GetCertificate returns the certificate for the server name of the TLS
+// handshake, and generates it on the first call.
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name == "" {
+		return nil, ErrMissingServerName
+	}
+	if !m.isAllowed(name) {
+		return nil, ErrDomainNotAllowed
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cert, ok := m.certs[name]; ok {
+		return cert, nil
+	}
+	cert, err := m.issue(name)
+	if err != nil {
+		return nil, err
+	}
+	m.certs[name] = cert
+	return cert, nil
+}
+
+func (m *Manager) isAllowed(name string) bool {
+	for _, domain := range m.domains {
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Manager) loadCA() error {
+	certPEM, err := ioutil.ReadFile(filepath.Join(m.dir, CAFilename))
+	if err != nil {
+		return err
+	}
+	keyPEM, err := ioutil.ReadFile(filepath.Join(m.dir, CAKeyFilename))
+	if err != nil {
+		return err
+	}
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+	if certBlock == nil || keyBlock == nil {
+		return ErrInvalidCA
+	}
+	if m.ca, err = x509.ParseCertificate(certBlock.Bytes); err != nil {
+		return ErrInvalidCA
+	}
+	if m.caKey, err = x509.ParseECPrivateKey(keyBlock.Bytes); err != nil {
+		return ErrInvalidCA
+	}
+	return nil
+}
+
+func (m *Manager) createCA() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"Cozy development"},
+			CommonName:   "Cozy development CA",
+		},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(m.dir, 0700); err != nil {
+		return err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err = ioutil.WriteFile(filepath.Join(m.dir, CAFilename), certPEM, 0644); err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err = ioutil.WriteFile(filepath.Join(m.dir, CAKeyFilename), keyPEM, 0600); err != nil {
+		return err
+	}
+
+	m.ca, err = x509.ParseCertificate(der)
+	m.caKey = key
+	return err
+}
+
+// issue generates a certificate for the given name and its direct
+// subdomains, signed by the local certificate authority.
+func (m *Manager) issue(name string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"Cozy development"},
+			CommonName:   name,
+		},
+		DNSNames:    []string{name, "*." + name},
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.Add(certValidity),
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, m.ca, &key.PublicKey, m.caKey)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der, m.ca.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+func randomSerial() (*big.Int, error) {
+	limit := new(big.Int).Lsh(big.NewInt(1), 128)
+	return rand.Int(rand.Reader, limit)
+}
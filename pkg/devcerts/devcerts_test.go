@@ -0,0 +1,106 @@
+package devcerts
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cozy-devcerts")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	m, err := New(filepath.Join(dir, "certs"), []string{"cozy.tools", ".cozy.local"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, filepath.Join(dir, "certs", CAFilename), m.CAFile())
+	info, err := os.Stat(filepath.Join(dir, "certs", CAKeyFilename))
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(m.ca)
+	for _, name := range []string{"alice.cozy.tools", "drive.alice.cozy.tools", "cozy.local"} {
+		cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+		if !assert.NoError(t, err) {
+			continue
+		}
+		_, err = cert.Leaf.Verify(x509.VerifyOptions{
+			DNSName: name,
+			Roots:   roots,
+		})
+		assert.NoError(t, err, name)
+	}
+
+	cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "Alice.cozy.tools."})
+	assert.NoError(t, err)
+	again, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "alice.cozy.tools"})
+	assert.NoError(t, err)
+	assert.True(t, cert == again, "the certificate should be cached")
+
+	_, err = m.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+	assert.Equal(t, ErrDomainNotAllowed, err)
+	_, err = m.GetCertificate(&tls.ClientHelloInfo{ServerName: "evilcozy.tools"})
+	assert.Equal(t, ErrDomainNotAllowed, err)
+	_, err = m.GetCertificate(&tls.ClientHelloInfo{})
+	assert.Equal(t, ErrMissingServerName, err)
+
+	// The certificate authority is reused by the next managers
+	m2, err := New(filepath.Join(dir, "certs"), []string{"cozy.tools"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, m.ca.Raw, m2.ca.Raw)
+	}
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "certs", CAFilename), []byte("foo"), 0644))
+	_, err = New(filepath.Join(dir, "certs"), []string{"cozy.tools"})
+	assert.Equal(t, ErrInvalidCA, err)
+}
+
+func TestServeTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cozy-devcerts")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	m, err := New(dir, []string{"cozy.tools"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", m.TLSConfig())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			conn.Write([]byte("hello"))
+			conn.Close()
+		}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(m.ca)
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+		ServerName: "alice.cozy.tools",
+		RootCAs:    roots,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	body, err := ioutil.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+}
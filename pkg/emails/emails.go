@@ -0,0 +1,234 @@
+// Package emails is for the emails of the user, imported from their mail
+// accounts in the io.cozy.emails doctype.
+package emails
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+)
+
+// Address is a sender or a recipient of an email.
+type Address struct {
+	Name  string `json:"name,omitempty"`
+	Email string `json:"email"`
+}
+
+// Attachment is a file attached to an email. Its content is saved in the VFS.
+type Attachment struct {
+	Name   string `json:"name"`
+	Mime   string `json:"mime"`
+	Size   int64  `json:"size,string"`
+	FileID string `json:"file_id"`
+}
+
+// Email is a document for an email imported from a folder of a mail account.
+type Email struct {
+	DocID       string        `json:"_id,omitempty"`
+	DocRev      string        `json:"_rev,omitempty"`
+	Account     string        `json:"account"`
+	Folder      string        `json:"folder"`
+	UIDValidity uint32        `json:"uidvalidity"`
+	UID         uint32        `json:"uid"`
+	MessageID   string        `json:"message_id,omitempty"`
+	InReplyTo   string        `json:"in_reply_to,omitempty"`
+	Subject     string        `json:"subject"`
+	From        []*Address    `json:"from"`
+	To          []*Address    `json:"to"`
+	Cc          []*Address    `json:"cc,omitempty"`
+	Date        time.Time     `json:"date"`
+	Text        string        `json:"text,omitempty"`
+	HTML        string        `json:"html,omitempty"`
+	Calendar    string        `json:"calendar,omitempty"`
+	Attachments []*Attachment `json:"attachments,omitempty"`
+}
+
+// ID is used to implement the couchdb.Doc interface
+func (e *Email) ID() string { return e.DocID }
+
+// Rev is used to implement the couchdb.Doc interface
+func (e *Email) Rev() string { return e.DocRev }
+
+// DocType is used to implement the couchdb.Doc interface
+func (e *Email) DocType() string { return consts.Emails }
+
+// SetID is used to implement the couchdb.Doc interface
+func (e *Email) SetID(id string) { e.DocID = id }
+
+// SetRev is used to implement the couchdb.Doc interface
+func (e *Email) SetRev(rev string) { e.DocRev = rev }
+
+// SaveAttachment is called by Parse for each attachment of an email. It
+// should save the content and return the identifier of the io.cozy.files
+// document, and the size of the file.
+type SaveAttachment func(name, mime string, r io.Reader) (fileID string, size int64, err error)
+
+var wordDecoder = new(mime.WordDecoder)
+
+// Parse reads a raw message (RFC 5322) and returns the email for it. The
+// attachments are given to the save function.
+func Parse(r io.Reader, save SaveAttachment) (*Email, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	h := msg.Header
+	e := &Email{
+		MessageID: strings.Trim(h.Get("Message-Id"), "<>"),
+		InReplyTo: strings.Trim(h.Get("In-Reply-To"), "<>"),
+		Subject:   decodeHeader(h.Get("Subject")),
+		From:      parseAddresses(h.Get("From")),
+		To:        parseAddresses(h.Get("To")),
+		Cc:        parseAddresses(h.Get("Cc")),
+	}
+	if date, err := h.Date(); err == nil {
+		e.Date = date.UTC()
+	}
+	if err = e.walkPart(textproto.MIMEHeader(h), msg.Body, save); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *Email) walkPart(h textproto.MIMEHeader, body io.Reader, save SaveAttachment) error {
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+	body = decodeTransfer(h.Get("Content-Transfer-Encoding"), body)
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err = e.walkPart(part.Header, part, save); err != nil {
+				return err
+			}
+		}
+	}
+
+	disposition, dparams, _ := mime.ParseMediaType(h.Get("Content-Disposition"))
+	filename := decodeHeader(dparams["filename"])
+	if filename == "" {
+		filename = decodeHeader(params["name"])
+	}
+
+	if disposition != "attachment" && filename == "" {
+		switch {
+		case mediaType == "text/plain" && e.Text == "":
+			e.Text, err = readText(body, params["charset"])
+			return err
+		case mediaType == "text/html" && e.HTML == "":
+			e.HTML, err = readText(body, params["charset"])
+			return err
+		case mediaType == "text/calendar" && e.Calendar == "":
+			// An invitation or a reply to an invitation (iMIP)
+			e.Calendar, err = readText(body, params["charset"])
+			return err
+		}
+	}
+
+	if filename == "" {
+		filename = "attachment"
+	}
+	fileID, size, err := save(filename, mediaType, body)
+	if err != nil {
+		return err
+	}
+	e.Attachments = append(e.Attachments, &Attachment{
+		Name:   filename,
+		Mime:   mediaType,
+		Size:   size,
+		FileID: fileID,
+	})
+	return nil
+}
+
+func decodeTransfer(encoding string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, &newlineStripper{r})
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	}
+	return r
+}
+
+// newlineStripper removes the line breaks of a base64 content, since the
+// decoder of the standard library doesn't accept them.
+type newlineStripper struct {
+	r io.Reader
+}
+
+func (n *newlineStripper) Read(p []byte) (int, error) {
+	for {
+		count, err := n.r.Read(p)
+		j := 0
+		for _, b := range p[:count] {
+			if b != '\r' && b != '\n' {
+				p[j] = b
+				j++
+			}
+		}
+		if j > 0 || err != nil {
+			return j, err
+		}
+	}
+}
+
+// readText reads a text part and converts it to UTF-8. Only the charsets
+// known by the standard library are supported: the other ones are kept as is.
+func readText(r io.Reader, charset string) (string, error) {
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "latin1":
+		buf := new(bytes.Buffer)
+		for _, b := range raw {
+			buf.WriteRune(rune(b))
+		}
+		return buf.String(), nil
+	}
+	return string(raw), nil
+}
+
+func decodeHeader(value string) string {
+	decoded, err := wordDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+func parseAddresses(value string) []*Address {
+	if value == "" {
+		return nil
+	}
+	list, err := mail.ParseAddressList(value)
+	if err != nil {
+		return nil
+	}
+	addrs := make([]*Address, len(list))
+	for i, a := range list {
+		addrs[i] = &Address{Name: decodeHeader(a.Name), Email: a.Address}
+	}
+	return addrs
+}
@@ -0,0 +1,92 @@
+package emails
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const multipartMessage = "From: =?UTF-8?Q?Jos=C3=A9?= <jose@example.com>\r\n" +
+	"To: Alice <alice@example.com>, bob@example.com\r\n" +
+	"Subject: =?UTF-8?B?UsOpdW5pb24=?=\r\n" +
+	"Date: Tue, 21 Mar 2017 10:00:00 +0100\r\n" +
+	"Message-ID: <1234@example.com>\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"outer\"\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=\"inner\"\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Caf=C3=A9 at 10?\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"\r\n" +
+	"<p>Caf\xc3\xa9 at 10?</p>\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: text/plain; name=\"notes.txt\"\r\n" +
+	"Content-Disposition: attachment; filename=\"notes.txt\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"SGVsbG8g\r\n" +
+	"d29ybGQ=\r\n" +
+	"--outer--\r\n"
+
+func TestParse(t *testing.T) {
+	var saved string
+	save := func(name, mime string, r io.Reader) (string, int64, error) {
+		assert.Equal(t, "notes.txt", name)
+		assert.Equal(t, "text/plain", mime)
+		content, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		saved = string(content)
+		return "file-id", int64(len(content)), nil
+	}
+
+	email, err := Parse(strings.NewReader(multipartMessage), save)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "1234@example.com", email.MessageID)
+	assert.Equal(t, "Réunion", email.Subject)
+	if assert.Len(t, email.From, 1) {
+		assert.Equal(t, "José", email.From[0].Name)
+		assert.Equal(t, "jose@example.com", email.From[0].Email)
+	}
+	assert.Len(t, email.To, 2)
+	assert.Equal(t, 2017, email.Date.Year())
+	assert.Equal(t, 9, email.Date.Hour())
+	assert.Equal(t, "Café at 10?", strings.TrimSpace(email.Text))
+	assert.Equal(t, "<p>Café at 10?</p>", strings.TrimSpace(email.HTML))
+	assert.Equal(t, "Hello world", saved)
+	if assert.Len(t, email.Attachments, 1) {
+		assert.Equal(t, "file-id", email.Attachments[0].FileID)
+		assert.Equal(t, int64(11), email.Attachments[0].Size)
+	}
+}
+
+func TestParseSinglePart(t *testing.T) {
+	raw := "From: jose@example.com\r\n" +
+		"Subject: Hello\r\n" +
+		"\r\n" +
+		"Just text\r\n"
+	email, err := Parse(strings.NewReader(raw), nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "Hello", email.Subject)
+	assert.Equal(t, "Just text\r\n", email.Text)
+	assert.Empty(t, email.Attachments)
+}
+
+func TestHashID(t *testing.T) {
+	assert.Equal(t, hashID("account", "INBOX"), hashID("account", "INBOX"))
+	assert.NotEqual(t, hashID("account", "INBOX"), hashID("accountI", "NBOX"))
+}
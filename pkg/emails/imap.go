@@ -0,0 +1,485 @@
+package emails
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cozy/cozy-stack/pkg/calendar"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	imap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+func init() {
+	jobs.AddWorker("imap", &jobs.WorkerConfig{
+		Concurrency:  2,
+		MaxExecCount: 3,
+		Timeout:      10 * time.Minute,
+		WorkerFunc:   SyncIMAP,
+	})
+}
+
+// AttachmentsDir is the directory of the VFS where the attachments of the
+// emails are saved.
+const AttachmentsDir = "/Emails"
+
+// fetchBatchSize is the number of messages fetched in one IMAP command. The
+// state of the folder is saved after each batch.
+const fetchBatchSize = 20
+
+// removeBatchSize is the number of emails deleted at once when the
+// UIDVALIDITY of a folder has changed.
+const removeBatchSize = 100
+
+var (
+	// ErrInvalidAccount is used when the account for the IMAP import is not
+	// an IMAP account
+	ErrInvalidAccount = errors.New("Invalid IMAP account")
+)
+
+// IMAPOptions are the options of the "imap" worker.
+type IMAPOptions struct {
+	Account string   `json:"account"`
+	Folders []string `json:"folders"`
+}
+
+// imapAccount is the "auth" part of an io.cozy.accounts document for a mail
+// account.
+type imapAccount struct {
+	Host       string `json:"host"`
+	Port       int    `json:"port"`
+	Login      string `json:"login"`
+	Password   string `json:"password"`
+	DisableTLS bool   `json:"disable_tls"`
+}
+
+// Folder is the synchronization state of a mail folder. The messages with an
+// UID lower or equal to LastUID have already been imported, as long as the
+// UIDValidity of the folder has not changed, except the messages listed in
+// FailedUIDs that could not be read or parsed.
+type Folder struct {
+	DocID       string   `json:"_id,omitempty"`
+	DocRev      string   `json:"_rev,omitempty"`
+	Account     string   `json:"account"`
+	Name        string   `json:"name"`
+	UIDValidity uint32   `json:"uidvalidity"`
+	LastUID     uint32   `json:"last_uid"`
+	FailedUIDs  []uint32 `json:"failed_uids,omitempty"`
+}
+
+// ID is used to implement the couchdb.Doc interface
+func (f *Folder) ID() string { return f.DocID }
+
+// Rev is used to implement the couchdb.Doc interface
+func (f *Folder) Rev() string { return f.DocRev }
+
+// DocType is used to implement the couchdb.Doc interface
+func (f *Folder) DocType() string { return consts.EmailsFolders }
+
+// SetID is used to implement the couchdb.Doc interface
+func (f *Folder) SetID(id string) { f.DocID = id }
+
+// SetRev is used to implement the couchdb.Doc interface
+func (f *Folder) SetRev(rev string) { f.DocRev = rev }
+
+// hashID returns a document identifier made from the given parts, as the
+// names of the mail folders can contain characters that are not welcome in
+// an identifier.
+func hashID(parts ...string) string {
+	h := sha256.New()
+	for _, p := range parts {
+		io.WriteString(h, p)
+		h.Write([]byte{0})
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// SyncIMAP is the "imap" worker function. It imports the new messages of the
+// selected folders of a mail account.
+func SyncIMAP(ctx context.Context, m *jobs.Message) error {
+	opts := &IMAPOptions{}
+	if err := m.Unmarshal(&opts); err != nil {
+		return err
+	}
+	if opts.Account == "" {
+		return ErrInvalidAccount
+	}
+	if len(opts.Folders) == 0 {
+		opts.Folders = []string{"INBOX"}
+	}
+	domain := ctx.Value(jobs.ContextDomainKey).(string)
+	i, err := instance.Get(domain)
+	if err != nil {
+		return err
+	}
+
+	account, err := getAccount(i, opts.Account)
+	if err != nil {
+		return err
+	}
+	c, err := dial(account)
+	if err != nil {
+		return err
+	}
+	defer c.Logout()
+	if err = c.Login(account.Login, account.Password); err != nil {
+		return err
+	}
+
+	for _, name := range opts.Folders {
+		s := &syncer{ctx: ctx, i: i, c: c, accountID: opts.Account, account: account}
+		if err = s.syncFolder(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getAccount(db couchdb.Database, id string) (*imapAccount, error) {
+	doc := &couchdb.JSONDoc{}
+	if err := couchdb.GetDoc(db, consts.Accounts, id, doc); err != nil {
+		return nil, err
+	}
+	auth, ok := doc.M["auth"].(map[string]interface{})
+	if !ok {
+		return nil, ErrInvalidAccount
+	}
+	account := &imapAccount{}
+	account.Host, _ = auth["host"].(string)
+	account.Login, _ = auth["login"].(string)
+	account.Password, _ = auth["password"].(string)
+	account.DisableTLS, _ = auth["disable_tls"].(bool)
+	if port, ok := auth["port"].(float64); ok {
+		account.Port = int(port)
+	}
+	if account.Host == "" || account.Login == "" {
+		return nil, ErrInvalidAccount
+	}
+	if account.Port == 0 {
+		if account.DisableTLS {
+			account.Port = 143
+		} else {
+			account.Port = 993
+		}
+	}
+	return account, nil
+}
+
+func dial(account *imapAccount) (*client.Client, error) {
+	addr := net.JoinHostPort(account.Host, strconv.Itoa(account.Port))
+	if account.DisableTLS {
+		return client.Dial(addr)
+	}
+	return client.DialTLS(addr, nil)
+}
+
+type syncer struct {
+	ctx       context.Context
+	i         *instance.Instance
+	c         *client.Client
+	accountID string
+	account   *imapAccount
+	folder    *Folder
+}
+
+func (s *syncer) loadFolder(name string) error {
+	id := hashID(s.accountID, name)
+	s.folder = &Folder{}
+	err := couchdb.GetDoc(s.i, consts.EmailsFolders, id, s.folder)
+	if couchdb.IsNotFoundError(err) {
+		s.folder = &Folder{DocID: id, Account: s.accountID, Name: name}
+		return nil
+	}
+	return err
+}
+
+func (s *syncer) saveFolder() error {
+	if s.folder.Rev() == "" {
+		return couchdb.CreateNamedDocWithDB(s.i, s.folder)
+	}
+	return couchdb.UpdateDoc(s.i, s.folder)
+}
+
+func (s *syncer) syncFolder(name string) error {
+	if err := s.loadFolder(name); err != nil {
+		return err
+	}
+	status, err := s.c.Select(name, true)
+	if err != nil {
+		return err
+	}
+	if status.UidValidity != s.folder.UIDValidity {
+		// The UIDs of the previous messages are no longer valid: the emails
+		// imported with them are removed, and the folder is imported again.
+		if err = s.removeEmails(s.folder.UIDValidity); err != nil {
+			return err
+		}
+		s.folder.UIDValidity = status.UidValidity
+		s.folder.LastUID = 0
+		s.folder.FailedUIDs = nil
+		if err = s.saveFolder(); err != nil {
+			return err
+		}
+	}
+
+	criteria := imap.NewSearchCriteria()
+	criteria.Uid = new(imap.SeqSet)
+	criteria.Uid.AddRange(s.folder.LastUID+1, 0)
+	found, err := s.c.UidSearch(criteria)
+	if err != nil {
+		return err
+	}
+	// With the range n:*, the server always returns the last message of the
+	// folder, even if its UID is lower than n.
+	var uids []uint32
+	for _, uid := range found {
+		if uid > s.folder.LastUID {
+			uids = append(uids, uid)
+		}
+	}
+	sort.Sort(uidSlice(uids))
+	log.Debugf("[imap] %d new messages in %s for %s", len(uids), name, s.i.Domain)
+
+	for len(uids) > 0 {
+		if err = s.ctx.Err(); err != nil {
+			return err
+		}
+		n := fetchBatchSize
+		if n > len(uids) {
+			n = len(uids)
+		}
+		if err = s.fetchBatch(uids[:n]); err != nil {
+			return err
+		}
+		uids = uids[n:]
+	}
+
+	return s.saveFolder()
+}
+
+// unreadableError is used for a message that cannot be read or parsed.
+// Fetching it again would give the same result, so it is skipped.
+type unreadableError struct {
+	err error
+}
+
+func (e *unreadableError) Error() string { return e.err.Error() }
+
+// fetchBatch imports the messages with the given UIDs, in order, and saves
+// the state of the folder after that.
+func (s *syncer) fetchBatch(uids []uint32) error {
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uids...)
+	section := &imap.BodySectionName{Peek: true}
+	items := []imap.FetchItem{imap.FetchUid, section.FetchItem()}
+
+	messages := make(chan *imap.Message, len(uids))
+	done := make(chan error, 1)
+	go func() {
+		done <- s.c.UidFetch(seqset, items, messages)
+	}()
+	bodies := make(map[uint32][]byte, len(uids))
+	unreadables := make(map[uint32]error)
+	for msg := range messages {
+		r := msg.GetBody(section)
+		if r == nil {
+			unreadables[msg.Uid] = fmt.Errorf("No body for the message %d", msg.Uid)
+			continue
+		}
+		buf := new(bytes.Buffer)
+		if _, err := buf.ReadFrom(r); err != nil {
+			unreadables[msg.Uid] = err
+			continue
+		}
+		bodies[msg.Uid] = buf.Bytes()
+	}
+	if err := <-done; err != nil {
+		return err
+	}
+
+	// The messages are imported in order. A message that cannot be read or
+	// parsed is recorded in the folder and skipped, but the import stops at
+	// the first message that cannot be saved, so that LastUID never goes past
+	// a message that may be imported by the next job.
+	var err error
+	for _, uid := range uids {
+		if uerr, ok := unreadables[uid]; ok {
+			s.skipMessage(uid, uerr)
+			continue
+		}
+		body, ok := bodies[uid]
+		if !ok {
+			// The message has been expunged in the meantime
+			s.folder.LastUID = uid
+			continue
+		}
+		err = s.importMessage(uid, body)
+		if uerr, ok := err.(*unreadableError); ok {
+			s.skipMessage(uid, uerr.err)
+			err = nil
+			continue
+		}
+		if err != nil {
+			break
+		}
+		s.folder.LastUID = uid
+	}
+	if serr := s.saveFolder(); err == nil {
+		err = serr
+	}
+	return err
+}
+
+// skipMessage records the UID of a message that cannot be imported in the
+// folder, and goes past it.
+func (s *syncer) skipMessage(uid uint32, err error) {
+	log.Errorf("[imap] Cannot import message %d of %s for %s: %s",
+		uid, s.folder.Name, s.i.Domain, err)
+	s.folder.FailedUIDs = append(s.folder.FailedUIDs, uid)
+	s.folder.LastUID = uid
+}
+
+func (s *syncer) importMessage(uid uint32, body []byte) error {
+	validity := strconv.FormatUint(uint64(s.folder.UIDValidity), 10)
+	id := hashID(s.accountID, s.folder.Name, validity, strconv.FormatUint(uint64(uid), 10))
+	dir := path.Join(AttachmentsDir, s.account.Login, s.folder.Name, validity, strconv.FormatUint(uint64(uid), 10))
+
+	var saveErr error
+	email, err := Parse(bytes.NewReader(body), func(name, mime string, r io.Reader) (string, int64, error) {
+		id, size, err := s.saveAttachment(dir, name, mime, r)
+		if err != nil {
+			saveErr = err
+		}
+		return id, size, err
+	})
+	if saveErr != nil {
+		return saveErr
+	}
+	if err != nil {
+		return &unreadableError{err}
+	}
+	email.SetID(id)
+	email.Account = s.accountID
+	email.Folder = s.folder.Name
+	email.UIDValidity = s.folder.UIDValidity
+	email.UID = uid
+
+	err = couchdb.CreateNamedDocWithDB(s.i, email)
+	if couchdb.IsConflictError(err) {
+		// The message was already imported by a previous job
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if email.Calendar != "" && len(email.From) > 0 {
+		from := email.From[0].Email
+		err = calendar.ProcessReply(s.i, s.i.Domain, from, strings.NewReader(email.Calendar))
+		if err != nil && err != calendar.ErrNotAReply &&
+			err != calendar.ErrUnknownEvent && err != calendar.ErrUnknownAttendee &&
+			err != calendar.ErrInvalidPartStat {
+			log.Warnf("[imap] Cannot process the calendar reply of message %d: %s", uid, err)
+		}
+	}
+	return nil
+}
+
+// removeEmails deletes the emails of the folder that have been imported with
+// the given UIDVALIDITY, and their attachments.
+func (s *syncer) removeEmails(validity uint32) error {
+	if validity == 0 {
+		return nil
+	}
+	req := &couchdb.FindRequest{
+		Selector: mango.And(
+			mango.Equal("account", s.accountID),
+			mango.Equal("folder", s.folder.Name),
+			mango.Equal("uidvalidity", validity),
+		),
+		Limit: removeBatchSize,
+	}
+	for {
+		var emails []*Email
+		err := couchdb.FindDocs(s.i, consts.Emails, req, &emails)
+		if couchdb.IsNoDatabaseError(err) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if len(emails) == 0 {
+			break
+		}
+		docs := make([]couchdb.Doc, len(emails))
+		for i, email := range emails {
+			docs[i] = email
+		}
+		if err = couchdb.BulkDeleteDocs(s.i, consts.Emails, docs); err != nil {
+			return err
+		}
+	}
+
+	name := strconv.FormatUint(uint64(validity), 10)
+	dir, err := vfs.GetDirDocFromPath(s.i, path.Join(AttachmentsDir, s.account.Login, s.folder.Name, name), false)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return vfs.DestroyDirAndContent(s.i, dir)
+}
+
+func (s *syncer) saveAttachment(dir, name, mime string, r io.Reader) (string, int64, error) {
+	name = strings.Replace(name, "/", "_", -1)
+	filepath := path.Join(dir, name)
+	if doc, err := vfs.GetFileDocFromPath(s.i, filepath); err == nil {
+		return doc.ID(), doc.Size, nil
+	}
+
+	parent, err := vfs.MkdirAll(s.i, dir, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	_, class := vfs.ExtractMimeAndClass(mime)
+	doc, err := vfs.NewFileDoc(name, parent.ID(), -1, nil, mime, class, time.Now(), false, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	file, err := vfs.CreateFile(s.i, doc, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	if _, err = io.Copy(file, r); err != nil {
+		file.Close()
+		return "", 0, err
+	}
+	if err = file.Close(); err != nil {
+		return "", 0, err
+	}
+	return doc.ID(), doc.Size, nil
+}
+
+type uidSlice []uint32
+
+func (u uidSlice) Len() int           { return len(u) }
+func (u uidSlice) Less(i, j int) bool { return u[i] < u[j] }
+func (u uidSlice) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
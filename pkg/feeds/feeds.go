@@ -0,0 +1,161 @@
+// Package feeds is for the read-only feeds of calendars and contacts that can
+// be subscribed by external clients (webcal/ICS for events, vCard for
+// contacts), without a full CalDAV/CardDAV support.
+package feeds
+
+import (
+	"encoding/hex"
+	"errors"
+	"io"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+)
+
+// CodeName is the name of the code used for a feed in the codes of its
+// permission document.
+const CodeName = "feed"
+
+// codeLen is the number of random bytes in a feed code
+const codeLen = 24
+
+// MaxItems is the maximal number of documents served in a feed
+var MaxItems = 1000
+
+var (
+	// ErrUnsupportedDoctype is used when asking a feed for a doctype that has
+	// no feed format.
+	ErrUnsupportedDoctype = errors.New("No feed for this doctype")
+	// ErrInvalidCode is used when the code of a feed is not valid (revoked,
+	// unknown or for another doctype).
+	ErrInvalidCode = errors.New("Invalid feed code")
+)
+
+// Format describes how the documents of a doctype are serialized in a feed.
+type Format struct {
+	Filename    string
+	ContentType string
+	Write       func(w io.Writer, domain string, docs []couchdb.JSONDoc) error
+}
+
+// Formats is the list of the doctypes that can be exposed as a feed, with
+// their format.
+var Formats = map[string]*Format{
+	consts.Events: {
+		Filename:    "events.ics",
+		ContentType: "text/calendar; charset=utf-8",
+		Write:       WriteICS,
+	},
+	consts.Contacts: {
+		Filename:    "contacts.vcf",
+		ContentType: "text/vcard; charset=utf-8",
+		Write:       WriteVCard,
+	},
+}
+
+// FormatFor returns the feed format for the given doctype
+func FormatFor(doctype string) (*Format, error) {
+	format, ok := Formats[doctype]
+	if !ok {
+		return nil, ErrUnsupportedDoctype
+	}
+	return format, nil
+}
+
+// Path returns the path of the feed identified by the given permission doc.
+func Path(pdoc *permissions.Permission) string {
+	doctype := feedDoctype(pdoc)
+	format, ok := Formats[doctype]
+	if !ok {
+		return ""
+	}
+	return "/feeds/" + pdoc.Codes[CodeName] + "/" + format.Filename
+}
+
+func feedDoctype(pdoc *permissions.Permission) string {
+	if len(pdoc.Permissions) != 1 {
+		return ""
+	}
+	return pdoc.Permissions[0].Type
+}
+
+// Find returns the permission doc of the feed of the given doctype, created
+// by the parent permission. The share sets of the doctype are read page by
+// page, as an instance can have a lot of them.
+func Find(db couchdb.Database, parent *permissions.Permission, doctype string) (*permissions.Permission, error) {
+	cursor := ""
+	for {
+		docs, next, err := permissions.ListShareSetsByDoctype(db, doctype, cursor, permissions.MaxShareSetsLimit)
+		if err != nil {
+			return nil, err
+		}
+		for _, pdoc := range docs {
+			if pdoc.SourceID == parent.SourceID && pdoc.Codes[CodeName] != "" &&
+				feedDoctype(pdoc) == doctype {
+				return pdoc, nil
+			}
+		}
+		if next == "" {
+			return nil, nil
+		}
+		cursor = next
+	}
+}
+
+// Create creates a new feed for the given doctype. The feed is a share
+// permission doc, with a read-only rule on the whole doctype and a single
+// random code.
+func Create(db couchdb.Database, parent *permissions.Permission, doctype string) (*permissions.Permission, error) {
+	if _, err := FormatFor(doctype); err != nil {
+		return nil, err
+	}
+	codes := map[string]string{
+		CodeName: hex.EncodeToString(crypto.GenerateRandomBytes(codeLen)),
+	}
+	set := permissions.Set{
+		permissions.Rule{
+			Type:  doctype,
+			Verbs: permissions.Verbs(permissions.GET),
+		},
+	}
+	return permissions.CreateShareSet(db, parent, codes, set, 0, nil)
+}
+
+// Regenerate revokes the current feed for the doctype (if any) and creates a
+// new one, with a new code. The old URL is no longer valid after that.
+func Regenerate(db couchdb.Database, parent *permissions.Permission, doctype string) (*permissions.Permission, error) {
+	existing, err := Find(db, parent, doctype)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		if err = existing.Revoke(db); err != nil {
+			return nil, err
+		}
+	}
+	return Create(db, parent, doctype)
+}
+
+// Open checks that the code is valid for a feed on the given doctype and
+// returns the documents to serialize.
+func Open(db couchdb.Database, code, doctype string) ([]couchdb.JSONDoc, error) {
+	pdoc, err := permissions.GetForShareCode(db, code)
+	if err != nil {
+		return nil, ErrInvalidCode
+	}
+	if pdoc.Codes[CodeName] != code || feedDoctype(pdoc) != doctype {
+		return nil, ErrInvalidCode
+	}
+	if !pdoc.Permissions.AllowWholeType(permissions.GET, doctype) {
+		return nil, ErrInvalidCode
+	}
+	var docs []couchdb.JSONDoc
+	req := &couchdb.AllDocsRequest{Limit: MaxItems}
+	err = couchdb.GetAllDocs(db, doctype, req, &docs)
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return nil, err
+	}
+	return docs, nil
+}
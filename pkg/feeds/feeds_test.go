@@ -0,0 +1,73 @@
+package feeds
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/ical"
+	"github.com/stretchr/testify/assert"
+)
+
+func makeDocs(t *testing.T, raw string) []couchdb.JSONDoc {
+	var docs []couchdb.JSONDoc
+	err := json.Unmarshal([]byte(raw), &docs)
+	assert.NoError(t, err)
+	return docs
+}
+
+func TestWriteICS(t *testing.T) {
+	docs := makeDocs(t, `[{
+		"_id": "event1",
+		"start": "2017-03-21T10:00:00+01:00",
+		"end": "2017-03-21T11:00:00+01:00",
+		"summary": "Meeting, with Bob; and Alice",
+		"location": "Paris"
+	}, {
+		"_id": "event2",
+		"start": "2017-03-22T00:00:00Z",
+		"allday": true,
+		"summary": "Holidays"
+	}, {
+		"_id": "no-start"
+	}]`)
+	buf := new(bytes.Buffer)
+	err := WriteICS(buf, "alice.cozy.tools", docs)
+	assert.NoError(t, err)
+	out := buf.String()
+	assert.True(t, strings.HasPrefix(out, "BEGIN:VCALENDAR\r\nVERSION:2.0\r\n"))
+	assert.True(t, strings.HasSuffix(out, "END:VCALENDAR\r\n"))
+	assert.Equal(t, 2, strings.Count(out, "BEGIN:VEVENT"))
+	assert.Contains(t, out, "UID:event1@alice.cozy.tools\r\n")
+	assert.Contains(t, out, "DTSTART:20170321T090000Z\r\n")
+	assert.Contains(t, out, "DTEND:20170321T100000Z\r\n")
+	assert.Contains(t, out, `SUMMARY:Meeting\, with Bob\; and Alice`+"\r\n")
+	assert.Contains(t, out, "DTSTART;VALUE=DATE:20170322\r\n")
+	assert.NotContains(t, out, "no-start")
+}
+
+func TestWriteVCard(t *testing.T) {
+	docs := makeDocs(t, `[{
+		"_id": "contact1",
+		"name": { "givenName": "Jane", "familyName": "Doe" },
+		"email": [{ "address": "jane@example.com", "type": "work" }],
+		"phone": [{ "number": "+33 6 12 34 56 78" }],
+		"note": "A very long note that should be folded because it is longer than seventy-five octets"
+	}, {
+		"_id": "anonymous"
+	}]`)
+	buf := new(bytes.Buffer)
+	err := WriteVCard(buf, "alice.cozy.tools", docs)
+	assert.NoError(t, err)
+	out := buf.String()
+	assert.Equal(t, 1, strings.Count(out, "BEGIN:VCARD"))
+	assert.Contains(t, out, "FN:Jane Doe\r\n")
+	assert.Contains(t, out, "N:Doe;Jane;;;\r\n")
+	assert.Contains(t, out, "EMAIL;TYPE=WORK:jane@example.com\r\n")
+	assert.Contains(t, out, "TEL:+33 6 12 34 56 78\r\n")
+	for _, line := range strings.Split(out, "\r\n") {
+		assert.True(t, len(line) <= ical.MaxLineLen)
+	}
+}
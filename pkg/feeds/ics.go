@@ -0,0 +1,29 @@
+package feeds
+
+import (
+	"io"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/ical"
+)
+
+// WriteICS writes the given io.cozy.events documents as an iCalendar
+// (RFC 5545) feed.
+func WriteICS(w io.Writer, domain string, docs []couchdb.JSONDoc) error {
+	lw := ical.NewWriter(w)
+	lw.Line("BEGIN", "VCALENDAR")
+	lw.Line("VERSION", "2.0")
+	lw.Line("PRODID", ical.ProdID)
+	lw.Line("CALSCALE", "GREGORIAN")
+	lw.Line("METHOD", "PUBLISH")
+	for _, doc := range docs {
+		if _, ok := ical.ParseTime(ical.GetString(doc, "start")); !ok {
+			continue
+		}
+		lw.Line("BEGIN", "VEVENT")
+		lw.EventProperties(domain, doc)
+		lw.Line("END", "VEVENT")
+	}
+	lw.Line("END", "VCALENDAR")
+	return lw.Flush()
+}
@@ -0,0 +1,86 @@
+package feeds
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/ical"
+)
+
+// WriteVCard writes the given io.cozy.contacts documents as a collection of
+// vCards (RFC 2426, version 3.0).
+func WriteVCard(w io.Writer, domain string, docs []couchdb.JSONDoc) error {
+	lw := ical.NewWriter(w)
+	for _, doc := range docs {
+		name, _ := doc.Get("name").(map[string]interface{})
+		fullname := ical.GetString(doc, "fullname")
+		if fullname == "" {
+			fullname = strings.TrimSpace(fmt.Sprintf("%s %s",
+				mapString(name, "givenName"), mapString(name, "familyName")))
+		}
+		if fullname == "" {
+			continue
+		}
+		lw.Line("BEGIN", "VCARD")
+		lw.Line("VERSION", "3.0")
+		lw.Line("UID", fmt.Sprintf("%s@%s", doc.ID(), domain))
+		lw.Text("FN", fullname)
+		lw.Line("N", strings.Join([]string{
+			ical.Escape(mapString(name, "familyName")),
+			ical.Escape(mapString(name, "givenName")),
+			ical.Escape(mapString(name, "additionalName")),
+			ical.Escape(mapString(name, "namePrefix")),
+			ical.Escape(mapString(name, "nameSuffix")),
+		}, ";"))
+		for _, email := range getList(doc, "email") {
+			lw.Text(withType("EMAIL", email), mapString(email, "address"))
+		}
+		for _, phone := range getList(doc, "phone") {
+			lw.Text(withType("TEL", phone), mapString(phone, "number"))
+		}
+		for _, addr := range getList(doc, "address") {
+			lw.Line(withType("ADR", addr), strings.Join([]string{
+				ical.Escape(mapString(addr, "pobox")),
+				"",
+				ical.Escape(mapString(addr, "street")),
+				ical.Escape(mapString(addr, "city")),
+				ical.Escape(mapString(addr, "region")),
+				ical.Escape(mapString(addr, "postcode")),
+				ical.Escape(mapString(addr, "country")),
+			}, ";"))
+		}
+		lw.Text("ORG", ical.GetString(doc, "company"))
+		lw.Text("NOTE", ical.GetString(doc, "note"))
+		lw.Line("END", "VCARD")
+	}
+	return lw.Flush()
+}
+
+func mapString(m map[string]interface{}, key string) string {
+	if m == nil {
+		return ""
+	}
+	s, _ := m[key].(string)
+	return s
+}
+
+func getList(doc couchdb.JSONDoc, key string) []map[string]interface{} {
+	list, _ := doc.Get(key).([]interface{})
+	var out []map[string]interface{}
+	for _, item := range list {
+		if m, ok := item.(map[string]interface{}); ok {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+func withType(name string, item map[string]interface{}) string {
+	typ := mapString(item, "type")
+	if typ == "" || strings.ContainsAny(typ, ";:,\"") {
+		return name
+	}
+	return name + ";TYPE=" + strings.ToUpper(typ)
+}
@@ -0,0 +1,170 @@
+// Package i18n has the metadata of the locales supported by the stack, like
+// the direction of the text and the formats of the dates and numbers, with
+// some helpers to format the values for a locale.
+package i18n
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// LeftToRight is the direction of the text for most locales
+	LeftToRight = "ltr"
+	// RightToLeft is the direction of the text for locales like Arabic or
+	// Hebrew
+	RightToLeft = "rtl"
+)
+
+// DefaultLocale is the code of the locale used when the requested one is not
+// known
+const DefaultLocale = "en"
+
+// Locale is the metadata of a locale. The formats of the dates and times are
+// patterns with the YYYY, MM, DD, HH, h, mm and A tokens, that can be used by
+// the client-side applications.
+type Locale struct {
+	Code               string `json:"code"`
+	Direction          string `json:"direction"`
+	DateFormat         string `json:"date_format"`
+	TimeFormat         string `json:"time_format"`
+	DecimalSeparator   string `json:"decimal_separator"`
+	ThousandsSeparator string `json:"thousands_separator"`
+}
+
+var locales = map[string]*Locale{
+	"en": {"en", LeftToRight, "MM/DD/YYYY", "h:mm A", ".", ","},
+	"fr": {"fr", LeftToRight, "DD/MM/YYYY", "HH:mm", ",", "\u00a0"},
+	"de": {"de", LeftToRight, "DD.MM.YYYY", "HH:mm", ",", "."},
+	"es": {"es", LeftToRight, "DD/MM/YYYY", "HH:mm", ",", "."},
+	"it": {"it", LeftToRight, "DD/MM/YYYY", "HH:mm", ",", "."},
+	"nl": {"nl", LeftToRight, "DD-MM-YYYY", "HH:mm", ",", "."},
+	"pt": {"pt", LeftToRight, "DD/MM/YYYY", "HH:mm", ",", "."},
+	"ja": {"ja", LeftToRight, "YYYY/MM/DD", "HH:mm", ".", ","},
+	"zh": {"zh", LeftToRight, "YYYY/MM/DD", "HH:mm", ".", ","},
+	"ar": {"ar", RightToLeft, "DD/MM/YYYY", "HH:mm", "٫", "٬"},
+	"fa": {"fa", RightToLeft, "YYYY/MM/DD", "HH:mm", "٫", "٬"},
+	"he": {"he", RightToLeft, "DD.MM.YYYY", "HH:mm", ".", ","},
+}
+
+// Get returns the metadata of the locale with the given code. A regional
+// variant, like fr-CA, uses the metadata of its language, and an unknown
+// locale the ones of the default locale.
+func Get(code string) *Locale {
+	code = strings.ToLower(code)
+	if l, ok := locales[code]; ok {
+		return l
+	}
+	if i := strings.IndexAny(code, "-_"); i > 0 {
+		if l, ok := locales[code[:i]]; ok {
+			return l
+		}
+	}
+	return locales[DefaultLocale]
+}
+
+// List returns the metadata of all the known locales.
+func List() []*Locale {
+	list := make([]*Locale, 0, len(locales))
+	for _, l := range locales {
+		list = append(list, l)
+	}
+	return list
+}
+
+// IsRTL returns true if the text of the locale is written from right to left
+func (l *Locale) IsRTL() bool {
+	return l.Direction == RightToLeft
+}
+
+var layoutReplacer = strings.NewReplacer(
+	"YYYY", "2006",
+	"MM", "01",
+	"DD", "02",
+	"HH", "15",
+	"mm", "04",
+	"h", "3",
+	"A", "PM",
+)
+
+// FormatDate formats the date part of t for the locale
+func (l *Locale) FormatDate(t time.Time) string {
+	return t.Format(layoutReplacer.Replace(l.DateFormat))
+}
+
+// FormatTime formats the time part of t for the locale
+func (l *Locale) FormatTime(t time.Time) string {
+	return t.Format(layoutReplacer.Replace(l.TimeFormat))
+}
+
+// FormatNumber formats a number for the locale, with the given number of
+// decimals, and the digits grouped by thousands.
+func (l *Locale) FormatNumber(value interface{}, decimals int) string {
+	var f float64
+	switch v := value.(type) {
+	case int:
+		f = float64(v)
+	case int32:
+		f = float64(v)
+	case int64:
+		f = float64(v)
+	case uint:
+		f = float64(v)
+	case uint32:
+		f = float64(v)
+	case uint64:
+		f = float64(v)
+	case float32:
+		f = float64(v)
+	case float64:
+		f = v
+	default:
+		return fmt.Sprint(value)
+	}
+
+	sign := ""
+	if f < 0 {
+		sign = "-"
+		f = -f
+	}
+	if decimals < 0 {
+		decimals = 0
+	}
+	s := strconv.FormatFloat(f, 'f', decimals, 64)
+	intPart, fracPart := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		intPart, fracPart = s[:i], s[i+1:]
+	}
+
+	var buf []byte
+	for i := range intPart {
+		if i > 0 && (len(intPart)-i)%3 == 0 {
+			buf = append(buf, l.ThousandsSeparator...)
+		}
+		buf = append(buf, intPart[i])
+	}
+	if fracPart != "" {
+		buf = append(buf, l.DecimalSeparator...)
+		buf = append(buf, fracPart...)
+	}
+	return sign + string(buf)
+}
+
+// TemplateFuncs returns the functions that can be used in the HTML and text
+// templates rendered for this locale: dir, date, time and number.
+func (l *Locale) TemplateFuncs() map[string]interface{} {
+	return map[string]interface{}{
+		"dir":  func() string { return l.Direction },
+		"date": l.FormatDate,
+		"time": l.FormatTime,
+		"number": func(value interface{}, decimals ...int) string {
+			d := 0
+			if len(decimals) > 0 {
+				d = decimals[0]
+			}
+			return l.FormatNumber(value, d)
+		},
+	}
+}
@@ -0,0 +1,44 @@
+package i18n
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGet(t *testing.T) {
+	assert.Equal(t, "fr", Get("fr").Code)
+	assert.Equal(t, "fr", Get("fr-CA").Code)
+	assert.Equal(t, "pt", Get("pt_BR").Code)
+	assert.Equal(t, DefaultLocale, Get("xx").Code)
+	assert.Equal(t, DefaultLocale, Get("").Code)
+
+	assert.True(t, Get("ar").IsRTL())
+	assert.True(t, Get("he-IL").IsRTL())
+	assert.False(t, Get("en").IsRTL())
+	assert.Len(t, List(), len(locales))
+}
+
+func TestFormatDate(t *testing.T) {
+	d := time.Date(2017, time.March, 9, 14, 5, 0, 0, time.UTC)
+	assert.Equal(t, "03/09/2017", Get("en").FormatDate(d))
+	assert.Equal(t, "2:05 PM", Get("en").FormatTime(d))
+	assert.Equal(t, "09/03/2017", Get("fr").FormatDate(d))
+	assert.Equal(t, "14:05", Get("fr").FormatTime(d))
+	assert.Equal(t, "09.03.2017", Get("de").FormatDate(d))
+	assert.Equal(t, "2017/03/09", Get("ja").FormatDate(d))
+}
+
+func TestFormatNumber(t *testing.T) {
+	en := Get("en")
+	assert.Equal(t, "0", en.FormatNumber(0, 0))
+	assert.Equal(t, "999", en.FormatNumber(999, 0))
+	assert.Equal(t, "1,000", en.FormatNumber(1000, 0))
+	assert.Equal(t, "1,234,567.89", en.FormatNumber(1234567.891, 2))
+	assert.Equal(t, "-12,345", en.FormatNumber(int64(-12345), 0))
+	assert.Equal(t, "1\u00a0234,5", Get("fr").FormatNumber(1234.5, 1))
+	assert.Equal(t, "1.234", Get("de").FormatNumber(uint(1234), 0))
+	assert.Equal(t, "1٬234٫50", Get("ar").FormatNumber(float32(1234.5), 2))
+	assert.Equal(t, "foo", en.FormatNumber("foo", 0))
+}
@@ -0,0 +1,46 @@
+package ical
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriterFoldsLongLines(t *testing.T) {
+	buf := new(bytes.Buffer)
+	lw := NewWriter(buf)
+	long := strings.Repeat("é", 100)
+	lw.Text("DESCRIPTION", long)
+	assert.NoError(t, lw.Flush())
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\r\n"), "\r\n")
+	assert.True(t, len(lines) > 1)
+	for i, line := range lines {
+		assert.True(t, len(line) <= MaxLineLen)
+		if i > 0 {
+			assert.True(t, strings.HasPrefix(line, " "))
+		}
+	}
+}
+
+func TestParseRoundTrip(t *testing.T) {
+	buf := new(bytes.Buffer)
+	lw := NewWriter(buf)
+	lw.Line("BEGIN", "VCALENDAR")
+	lw.Line(`ATTENDEE;CN="Doe; Jane";PARTSTAT=ACCEPTED`, "mailto:jane@example.com")
+	lw.Text("SUMMARY", "Lunch, with "+strings.Repeat("friends ", 20))
+	lw.Line("END", "VCALENDAR")
+	assert.NoError(t, lw.Flush())
+
+	props, err := Parse(buf)
+	assert.NoError(t, err)
+	if !assert.Len(t, props, 4) {
+		return
+	}
+	assert.Equal(t, "ATTENDEE", props[1].Name)
+	assert.Equal(t, "Doe; Jane", props[1].Params["CN"])
+	assert.Equal(t, "ACCEPTED", props[1].Params["PARTSTAT"])
+	assert.Equal(t, "mailto:jane@example.com", props[1].Value)
+	assert.Equal(t, "Lunch, with "+strings.Repeat("friends ", 20), Unescape(props[2].Value))
+}
@@ -0,0 +1,110 @@
+package ical
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// Property is a parsed content line.
+type Property struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+var textUnescaper = strings.NewReplacer(
+	`\\`, `\`,
+	`\;`, ";",
+	`\,`, ",",
+	`\n`, "\n",
+	`\N`, "\n",
+)
+
+// Unescape unescapes a TEXT value.
+func Unescape(value string) string {
+	return textUnescaper.Replace(value)
+}
+
+// Parse reads the content lines of an iCalendar or vCard stream. The folded
+// lines are unfolded, the names of the properties and of the parameters are
+// upper-cased, and the values are kept escaped.
+func Parse(r io.Reader) ([]*Property, error) {
+	var props []*Property
+	var current string
+	flush := func() {
+		if current == "" {
+			return
+		}
+		if p := parseLine(current); p != nil {
+			props = append(props, p)
+		}
+		current = ""
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			current += line[1:]
+			continue
+		}
+		flush()
+		current = line
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	flush()
+	return props, nil
+}
+
+func parseLine(line string) *Property {
+	// The value starts at the first colon that is not in a quoted parameter
+	// value
+	quoted := false
+	sep := -1
+	for i, c := range line {
+		if c == '"' {
+			quoted = !quoted
+		} else if c == ':' && !quoted {
+			sep = i
+			break
+		}
+	}
+	if sep < 0 {
+		return nil
+	}
+	parts := splitParams(line[:sep])
+	p := &Property{
+		Name:   strings.ToUpper(parts[0]),
+		Params: make(map[string]string),
+		Value:  line[sep+1:],
+	}
+	for _, param := range parts[1:] {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		p.Params[strings.ToUpper(kv[0])] = strings.Trim(kv[1], `"`)
+	}
+	return p
+}
+
+// splitParams splits the name and the parameters of a content line, on the
+// semicolons that are not in a quoted value.
+func splitParams(s string) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for i, c := range s {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == ';' && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
@@ -0,0 +1,142 @@
+// Package ical is a small toolbox for the iCalendar (RFC 5545) and vCard
+// (RFC 2426) formats: both use the same content lines.
+package ical
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+const (
+	// DateFormat is the format of a DATE value
+	DateFormat = "20060102"
+	// DateTimeFormat is the format of a DATE-TIME value, in UTC
+	DateTimeFormat = "20060102T150405Z"
+)
+
+// ProdID is the identifier of the product that created the calendars
+const ProdID = "-//Cozy Cloud//cozy-stack//EN"
+
+// MaxLineLen is the maximal length of a content line (see RFC 5545 section
+// 3.1)
+const MaxLineLen = 75
+
+var textEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	";", `\;`,
+	",", `\,`,
+	"\r\n", `\n`,
+	"\n", `\n`,
+)
+
+// Escape escapes a TEXT value.
+func Escape(value string) string {
+	return textEscaper.Replace(value)
+}
+
+// Writer writes content lines, folded and terminated by CRLF. The first
+// error is kept and returned by Flush.
+type Writer struct {
+	w   *bufio.Writer
+	err error
+}
+
+// NewWriter returns a writer of content lines.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// Line writes a content line, with a value that is already escaped.
+func (lw *Writer) Line(name, value string) {
+	if lw.err != nil {
+		return
+	}
+	l := name + ":" + value
+	limit := MaxLineLen
+	for len(l) > limit {
+		cut := limit
+		// do not split an UTF-8 sequence
+		for cut > 0 && l[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		if _, lw.err = lw.w.WriteString(l[:cut] + "\r\n "); lw.err != nil {
+			return
+		}
+		l = l[cut:]
+		// the continuation lines start with a space
+		limit = MaxLineLen - 1
+	}
+	_, lw.err = lw.w.WriteString(l + "\r\n")
+}
+
+// Text writes a content line for a TEXT value, if it is not empty.
+func (lw *Writer) Text(name, value string) {
+	if value != "" {
+		lw.Line(name, Escape(value))
+	}
+}
+
+// Flush writes the buffered data and returns the first error.
+func (lw *Writer) Flush() error {
+	if lw.err != nil {
+		return lw.err
+	}
+	return lw.w.Flush()
+}
+
+// EventProperties writes the properties of a VEVENT for an io.cozy.events
+// document: UID, dates, summary, description and location. It returns false,
+// without writing anything, if the event has no valid start date.
+func (lw *Writer) EventProperties(domain string, doc couchdb.JSONDoc) bool {
+	start, ok := ParseTime(GetString(doc, "start"))
+	if !ok {
+		return false
+	}
+	allday, _ := doc.Get("allday").(bool)
+	lw.Line("UID", EventUID(doc.ID(), domain))
+	lw.Line("DTSTAMP", time.Now().UTC().Format(DateTimeFormat))
+	if allday {
+		lw.Line("DTSTART;VALUE=DATE", start.Format(DateFormat))
+	} else {
+		lw.Line("DTSTART", start.UTC().Format(DateTimeFormat))
+	}
+	if end, ok := ParseTime(GetString(doc, "end")); ok {
+		if allday {
+			lw.Line("DTEND;VALUE=DATE", end.Format(DateFormat))
+		} else {
+			lw.Line("DTEND", end.UTC().Format(DateTimeFormat))
+		}
+	}
+	lw.Text("SUMMARY", GetString(doc, "summary"))
+	lw.Text("DESCRIPTION", GetString(doc, "description"))
+	lw.Text("LOCATION", GetString(doc, "location"))
+	return true
+}
+
+// EventUID returns the UID of the event with the given identifier.
+func EventUID(id, domain string) string {
+	return fmt.Sprintf("%s@%s", id, domain)
+}
+
+// GetString returns the string value for the given key of a document.
+func GetString(doc couchdb.JSONDoc, key string) string {
+	s, _ := doc.Get(key).(string)
+	return s
+}
+
+// ParseTime parses a date in the RFC 3339 format, as used in the documents.
+func ParseTime(value string) (time.Time, bool) {
+	if value == "" {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
@@ -0,0 +1,55 @@
+package instance
+
+import (
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/apps"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// SlugCollision is an application installed on an instance with a slug that
+// is reserved, or whose subdomain is the domain of another instance.
+type SlugCollision struct {
+	Domain string `json:"domain"`
+	Slug   string `json:"slug"`
+	Reason string `json:"reason"`
+}
+
+// AuditSlugs looks for the applications installed before the reserved slugs
+// and the collisions were checked, and which now shadow the routes of the
+// stack or another instance.
+func AuditSlugs() ([]*SlugCollision, error) {
+	list, err := List()
+	if err != nil {
+		return nil, err
+	}
+	domains := make(map[string]bool, len(list))
+	for _, i := range list {
+		domains[strings.ToLower(i.Domain)] = true
+	}
+
+	var collisions []*SlugCollision
+	for _, i := range list {
+		mans, err := apps.List(i)
+		if err != nil && !couchdb.IsNoDatabaseError(err) {
+			return nil, err
+		}
+		for _, man := range mans {
+			var reason string
+			host := strings.ToLower(i.SubDomain(man.Slug).Host)
+			if apps.IsReservedSlug(man.Slug) {
+				reason = apps.ErrReservedSlug.Error()
+			} else if domains[host] {
+				reason = apps.ErrSlugCollision.Error() + " (" + host + ")"
+			} else {
+				continue
+			}
+			collisions = append(collisions, &SlugCollision{
+				Domain: i.Domain,
+				Slug:   man.Slug,
+				Reason: reason,
+			})
+		}
+	}
+	return collisions, nil
+}
@@ -0,0 +1,139 @@
+package instance
+
+import (
+	"context"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+)
+
+// CompactionWorkerType is the type of the worker that compacts the
+// databases of an instance
+const CompactionWorkerType = "compaction"
+
+func init() {
+	jobs.AddWorker(CompactionWorkerType, &jobs.WorkerConfig{
+		Concurrency:  1,
+		MaxExecCount: 1,
+		Timeout:      1 * time.Hour,
+		WorkerFunc:   compactionWorker,
+	})
+	couchdb.OnHeavyDeletes(func(db couchdb.Database, doctype string) {
+		i, ok := db.(*Instance)
+		if !ok {
+			return
+		}
+		if err := i.PushCompactionJob([]string{doctype}, true); err != nil {
+			log.Errorf("[compaction] Could not push the job for %s: %s", i.Domain, err)
+		}
+	})
+}
+
+// CompactionOptions are the options of the compaction worker: the doctypes
+// of the databases to check (all of them if empty), and if they must be
+// compacted whatever their fragmentation.
+type CompactionOptions struct {
+	Doctypes []string `json:"doctypes,omitempty"`
+	Force    bool     `json:"force,omitempty"`
+}
+
+func compactionWorker(ctx context.Context, m *jobs.Message) error {
+	opts := &CompactionOptions{}
+	if err := m.Unmarshal(&opts); err != nil {
+		return err
+	}
+	domain := ctx.Value(jobs.ContextDomainKey).(string)
+	i, err := Get(domain)
+	if err != nil {
+		return err
+	}
+	ratio := config.GetConfig().CouchDB.CompactionRatio
+	if opts.Force {
+		ratio = 0
+	}
+	compacted, err := i.Compact(opts.Doctypes, ratio)
+	if len(compacted) > 0 {
+		log.Infof("[compaction] %s: %v", domain, compacted)
+	}
+	return err
+}
+
+// Compact starts the compaction of the databases of the instance for the
+// given doctypes (all of them if empty) whose unused part of the file is at
+// least ratio, and returns their doctypes. With a ratio of 0, they are all
+// compacted.
+func (i *Instance) Compact(doctypes []string, ratio float64) ([]string, error) {
+	if len(doctypes) == 0 {
+		var err error
+		if doctypes, err = couchdb.AllDoctypes(i); err != nil {
+			return nil, err
+		}
+	}
+	var compacted []string
+	for _, doctype := range doctypes {
+		if ratio > 0 {
+			status, err := couchdb.DBStatus(i, doctype)
+			if couchdb.IsNoDatabaseError(err) {
+				continue
+			}
+			if err != nil {
+				return compacted, err
+			}
+			if status.CompactRunning || status.Fragmentation() < ratio {
+				continue
+			}
+		}
+		if err := couchdb.CompactDB(i, doctype); err != nil {
+			if couchdb.IsNoDatabaseError(err) {
+				continue
+			}
+			return compacted, err
+		}
+		compacted = append(compacted, doctype)
+	}
+	return compacted, nil
+}
+
+// PushCompactionJob pushes a job to compact the databases of the instance
+// for the given doctypes (all of them if empty).
+func (i *Instance) PushCompactionJob(doctypes []string, force bool) error {
+	opts := &CompactionOptions{Doctypes: doctypes, Force: force}
+	msg, err := jobs.NewMessage(jobs.JSONEncoding, opts)
+	if err != nil {
+		return err
+	}
+	_, _, err = i.JobsBroker().PushJob(&jobs.JobRequest{
+		WorkerType: CompactionWorkerType,
+		Message:    msg,
+	})
+	return err
+}
+
+// StartCompaction regularly pushes a compaction job for each instance, with
+// the interval of the configuration. The databases are only compacted if
+// their unused part is more than couchdb.compaction.ratio.
+//
+// TODO: on distributed stacks, only one stack should do it
+func StartCompaction() {
+	interval := config.GetConfig().CouchDB.CompactionInterval
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(interval) {
+			instances, err := List()
+			if err != nil && !couchdb.IsNoDatabaseError(err) {
+				log.Errorf("[compaction] Could not list the instances: %s", err)
+				continue
+			}
+			for _, i := range instances {
+				if err = i.PushCompactionJob(nil, false); err != nil {
+					log.Errorf("[compaction] Could not push the job for %s: %s", i.Domain, err)
+				}
+			}
+		}
+	}()
+}
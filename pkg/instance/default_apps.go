@@ -0,0 +1,149 @@
+package instance
+
+import (
+	"context"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cozy/cozy-stack/pkg/apps"
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+)
+
+// DefaultAppsWorkerType is the type of the worker that installs the default
+// applications of the context of an instance
+const DefaultAppsWorkerType = "default-apps"
+
+const (
+	// DefaultAppPending is the state of a default application before the
+	// first login of the user
+	DefaultAppPending = "pending"
+	// DefaultAppQueued is the state of a default application whose
+	// installation is waiting for its turn
+	DefaultAppQueued = "queued"
+)
+
+func init() {
+	jobs.AddWorker(DefaultAppsWorkerType, &jobs.WorkerConfig{
+		Concurrency:  1,
+		MaxExecCount: 1,
+		Timeout:      30 * time.Minute,
+		WorkerFunc:   defaultAppsWorker,
+	})
+}
+
+// DefaultAppStatus is the state of the installation of a default application,
+// as shown to the onboarding application. The state is the one of the
+// application once its installation has started.
+type DefaultAppStatus struct {
+	Slug  string `json:"slug"`
+	State string `json:"state"`
+}
+
+// contextDefaultApps returns the default applications of the given context,
+// without the ones that are installed when the instance is created.
+func contextDefaultApps(name string, installed []string) []string {
+	if name == "" {
+		name = config.DefaultContext
+	}
+	ctx, ok := config.GetConfig().Contexts[name]
+	if !ok {
+		return nil
+	}
+	var slugs []string
+	for _, slug := range ctx.DefaultApps {
+		found := false
+		for _, app := range installed {
+			if app == slug {
+				found = true
+				break
+			}
+		}
+		if !found {
+			slugs = append(slugs, slug)
+		}
+	}
+	return slugs
+}
+
+// InstallDefaultApps pushes a job to install the default applications of the
+// context of the instance. It is called on each login of the user, but the
+// job is pushed only the first time, so that the installations of a mass
+// provisioning are spread over time.
+func (i *Instance) InstallDefaultApps() error {
+	if len(i.DefaultApps) == 0 || i.DefaultAppsQueued {
+		return nil
+	}
+	// Two logins at the same time can't both update the instance, so the job
+	// is pushed only once
+	i.DefaultAppsQueued = true
+	if err := couchdb.UpdateDoc(couchdb.GlobalDB, i); err != nil {
+		i.DefaultAppsQueued = false
+		return err
+	}
+	msg, err := jobs.NewMessage(jobs.JSONEncoding, i.DefaultApps)
+	if err == nil {
+		_, _, err = i.JobsBroker().PushJob(&jobs.JobRequest{
+			WorkerType: DefaultAppsWorkerType,
+			Message:    msg,
+		})
+	}
+	if err != nil {
+		// The job has not been pushed, it will be on the next login
+		errReset := couchdb.UpdateDocWithRetry(couchdb.GlobalDB, i, func(couchdb.Doc) error {
+			i.DefaultAppsQueued = false
+			return nil
+		})
+		if errReset != nil {
+			log.Errorf("[instance] Failed to reset the default apps of %s: %s",
+				i.Domain, errReset)
+		}
+	}
+	return err
+}
+
+// DefaultAppsStatus returns the state of the installation of each default
+// application of the instance.
+func (i *Instance) DefaultAppsStatus() ([]*DefaultAppStatus, error) {
+	statuses := make([]*DefaultAppStatus, len(i.DefaultApps))
+	for idx, slug := range i.DefaultApps {
+		status := &DefaultAppStatus{Slug: slug, State: DefaultAppPending}
+		if i.DefaultAppsQueued {
+			status.State = DefaultAppQueued
+			man, err := apps.GetBySlug(i, slug)
+			if err == nil {
+				status.State = string(man.State)
+			} else if !couchdb.IsNotFoundError(err) {
+				return nil, err
+			}
+		}
+		statuses[idx] = status
+	}
+	return statuses, nil
+}
+
+func defaultAppsWorker(ctx context.Context, m *jobs.Message) error {
+	var slugs []string
+	if err := m.Unmarshal(&slugs); err != nil {
+		return err
+	}
+	domain := ctx.Value(jobs.ContextDomainKey).(string)
+	i, err := Get(domain)
+	if err != nil {
+		return err
+	}
+	for _, slug := range slugs {
+		// The user may have installed it before the job has started, and the
+		// job may be executed again: only the installations that have not
+		// been made, or that have been interrupted, are started
+		if man, errGet := apps.GetBySlug(i, slug); errGet == nil && !man.Retriable {
+			continue
+		}
+		if err = i.installApp(slug); err != nil {
+			log.Errorf("[instance] Failed to install the default app %s on %s: %s",
+				slug, domain, err)
+		}
+	}
+	return nil
+}
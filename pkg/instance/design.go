@@ -0,0 +1,70 @@
+package instance
+
+import (
+	"errors"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// globalDesignDocID is the id of the _local document, in the database of the
+// instances, where the version of the global indexes is recorded.
+const globalDesignDocID = "design-docs"
+
+// errDesignUpToDate is used by MigrateDesignDocs to not save the instance
+// when a concurrent migration has already recorded the version
+var errDesignUpToDate = errors.New("design docs are up-to-date")
+
+// MigrateDesignDocs defines the indexes and the views of the instance that
+// are missing or outdated, after an upgrade of the stack, and records the
+// applied version in the document of the instance. It is called when the
+// instance is loaded, and does nothing if the instance is up-to-date.
+func (i *Instance) MigrateDesignDocs() error {
+	if i.DesignVersion >= consts.DesignMigrations.Version() {
+		return nil
+	}
+	version, err := consts.DesignMigrations.Apply(i, i.DesignVersion)
+	if version == i.DesignVersion {
+		return err
+	}
+	uerr := couchdb.UpdateDocWithRetry(couchdb.GlobalDB, i, func(couchdb.Doc) error {
+		if i.DesignVersion >= version {
+			return errDesignUpToDate
+		}
+		i.DesignVersion = version
+		return nil
+	})
+	if err == nil && uerr != errDesignUpToDate {
+		err = uerr
+	}
+	return err
+}
+
+// MigrateGlobalDesignDocs defines the indexes of the global databases that
+// are missing or outdated. The applied version is recorded in a _local
+// document of the database of the instances. It is called on the startup of
+// the stack, and does nothing if there is no instance yet.
+func MigrateGlobalDesignDocs() error {
+	doc, err := couchdb.GetLocal(couchdb.GlobalDB, consts.Instances, globalDesignDocID)
+	if couchdb.IsNoDatabaseError(err) {
+		return nil
+	}
+	if couchdb.IsNotFoundError(err) {
+		doc, err = make(map[string]interface{}), nil
+	}
+	if err != nil {
+		return err
+	}
+	from, _ := doc["version"].(float64)
+	if int(from) >= consts.GlobalDesignMigrations.Version() {
+		return nil
+	}
+	version, err := consts.GlobalDesignMigrations.Apply(couchdb.GlobalDB, int(from))
+	if version > int(from) {
+		doc["version"] = version
+		if perr := couchdb.PutLocal(couchdb.GlobalDB, consts.Instances, globalDesignDocID, doc); err == nil {
+			err = perr
+		}
+	}
+	return err
+}
@@ -0,0 +1,130 @@
+package instance
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// ErrUnknownDevOption is used when a development toggle is not known
+var ErrUnknownDevOption = errors.New("Unknown development option")
+
+// Names of the development toggles, as used by the admin API and the CLI
+const (
+	DevAllowHTTP         = "allow_http"
+	DevRelaxCSP          = "relax_csp"
+	DevAllowUnsignedApps = "allow_unsigned_apps"
+	DevVerboseErrors     = "verbose_errors"
+	DevProxyApps         = "proxy_apps"
+)
+
+// DevOptions are the toggles that relax the security of an instance for
+// development. They can be enabled one by one, to test an instance with
+// settings close to the production ones.
+type DevOptions struct {
+	// AllowHTTP makes the instance use http instead of https for its URLs,
+	// and disables HSTS and the secure flag of the session cookies.
+	AllowHTTP bool `json:"allow_http,omitempty"`
+	// RelaxCSP sends the Content-Security-Policy in report-only mode: the
+	// violations are reported in the console of the browser, but not blocked.
+	RelaxCSP bool `json:"relax_csp,omitempty"`
+	// AllowUnsignedApps accepts the installation of applications from sources
+	// that are not listed in the installs.allowed_sources of the config.
+	AllowUnsignedApps bool `json:"allow_unsigned_apps,omitempty"`
+	// VerboseErrors logs the errors of the HTTP requests on the instance, even
+	// with a production release of the stack.
+	VerboseErrors bool `json:"verbose_errors,omitempty"`
+	// ProxyApps accepts the applications with a dev:// source, whose files
+	// are served by proxying the requests to a development server.
+	ProxyApps bool `json:"proxy_apps,omitempty"`
+}
+
+// AllDevOptions returns the development options with all the toggles
+// enabled, like the old dev flag of the instances.
+func AllDevOptions() DevOptions {
+	return DevOptions{
+		AllowHTTP:         true,
+		RelaxCSP:          true,
+		AllowUnsignedApps: true,
+		VerboseErrors:     true,
+		ProxyApps:         true,
+	}
+}
+
+// ParseDevOptions returns the development options with the toggles of the
+// given list enabled.
+func ParseDevOptions(names []string) (DevOptions, error) {
+	var opts DevOptions
+	for _, name := range names {
+		switch strings.TrimSpace(name) {
+		case DevAllowHTTP:
+			opts.AllowHTTP = true
+		case DevRelaxCSP:
+			opts.RelaxCSP = true
+		case DevAllowUnsignedApps:
+			opts.AllowUnsignedApps = true
+		case DevVerboseErrors:
+			opts.VerboseErrors = true
+		case DevProxyApps:
+			opts.ProxyApps = true
+		case "":
+		default:
+			return opts, ErrUnknownDevOption
+		}
+	}
+	return opts, nil
+}
+
+// Names returns the list of the enabled toggles
+func (d DevOptions) Names() []string {
+	names := []string{}
+	if d.AllowHTTP {
+		names = append(names, DevAllowHTTP)
+	}
+	if d.RelaxCSP {
+		names = append(names, DevRelaxCSP)
+	}
+	if d.AllowUnsignedApps {
+		names = append(names, DevAllowUnsignedApps)
+	}
+	if d.VerboseErrors {
+		names = append(names, DevVerboseErrors)
+	}
+	if d.ProxyApps {
+		names = append(names, DevProxyApps)
+	}
+	return names
+}
+
+// Any returns true if at least one toggle is enabled
+func (d DevOptions) Any() bool {
+	return len(d.Names()) > 0
+}
+
+// AllowUnsignedApps is used by the apps installer to know if the applications
+// can be installed from any source.
+func (i *Instance) AllowUnsignedApps() bool {
+	return i.Dev.AllowUnsignedApps
+}
+
+// AllowProxyApps is used by the apps installer to know if the applications
+// can be installed with a dev:// source.
+func (i *Instance) AllowProxyApps() bool {
+	return i.Dev.ProxyApps
+}
+
+// SetDevOptions changes the development toggles of the instance
+func (i *Instance) SetDevOptions(opts DevOptions) error {
+	i.Dev = opts
+	i.LegacyDev = false
+	return couchdb.UpdateDoc(couchdb.GlobalDB, i)
+}
+
+// migrateLegacyDev converts the old dev flag of an instance to the
+// development options with all the toggles enabled.
+func (i *Instance) migrateLegacyDev() {
+	if i.LegacyDev {
+		i.Dev = AllDevOptions()
+	}
+}
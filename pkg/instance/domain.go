@@ -0,0 +1,119 @@
+package instance
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"golang.org/x/net/idna"
+)
+
+const (
+	// maxDomainLen is the maximal length of a domain name, in its ASCII form
+	maxDomainLen = 253
+	// maxLabelLen is the maximal length of a label of a domain name
+	maxLabelLen = 63
+)
+
+var (
+	// ErrDomainTooLong is used when the domain name or one of its labels is
+	// too long
+	ErrDomainTooLong = errors.New("Domain name is too long")
+	// ErrReservedDomain is used when the domain name starts with a label that
+	// would collide with the subdomain of an application
+	ErrReservedDomain = errors.New("Domain name starts with a reserved label")
+)
+
+// ReservedLabels are the labels that can't be used as the first label of the
+// domain of an instance with nested subdomains: `files.example.com` would
+// collide with the files application of the `example.com` instance.
+var ReservedLabels = []string{
+	consts.FilesSlug,
+	consts.OnboardingSlug,
+	consts.StoreSlug,
+	"settings",
+	"collect",
+}
+
+// ValidateDomain checks that a domain can be used for an instance, and returns
+// it in its normalized form: lower-cased, with the internationalized labels
+// converted to punycode (`café.example.com` gives
+// `xn--caf-dma.example.com`). A port can be given, for development.
+//
+// It should be used for every domain that will route requests to an instance,
+// not just for the creation of instances.
+func ValidateDomain(domain string) (string, error) {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	if domain == "" {
+		return "", ErrIllegalDomain
+	}
+
+	host, port := domain, ""
+	if i := strings.LastIndex(domain, ":"); i >= 0 {
+		host, port = domain[:i], domain[i+1:]
+		if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 || port[0] == '0' {
+			return "", ErrIllegalDomain
+		}
+	}
+
+	host, err := idna.ToASCII(host)
+	if err != nil {
+		return "", ErrIllegalDomain
+	}
+	if len(host) > maxDomainLen {
+		return "", ErrDomainTooLong
+	}
+
+	labels := strings.Split(host, ".")
+	for _, label := range labels {
+		if err = validateLabel(label); err != nil {
+			return "", err
+		}
+	}
+
+	switch config.GetConfig().Subdomains {
+	case config.FlatSubdomains:
+		// The dash is the separator between the instance and the application
+		// in https://<user>-<app>.<domain>/
+		if strings.Contains(labels[0], "-") {
+			return "", ErrIllegalDomain
+		}
+	case config.NestedSubdomains:
+		for _, reserved := range ReservedLabels {
+			if labels[0] == reserved {
+				return "", ErrReservedDomain
+			}
+		}
+	}
+
+	if port != "" {
+		host += ":" + port
+	}
+	return host, nil
+}
+
+// validateLabel checks a label of a domain, in its ASCII form: letters,
+// digits, hyphens, and underscores, but no hyphen at the start or at the end.
+func validateLabel(label string) error {
+	if label == "" {
+		return ErrIllegalDomain
+	}
+	if len(label) > maxLabelLen {
+		return ErrDomainTooLong
+	}
+	if label[0] == '-' || label[len(label)-1] == '-' {
+		return ErrIllegalDomain
+	}
+	for _, c := range label {
+		switch {
+		case 'a' <= c && c <= 'z':
+		case '0' <= c && c <= '9':
+		case c == '-', c == '_':
+		default:
+			return ErrIllegalDomain
+		}
+	}
+	return nil
+}
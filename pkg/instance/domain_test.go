@@ -0,0 +1,63 @@
+package instance
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateDomain(t *testing.T) {
+	cfg := config.GetConfig()
+	was := cfg.Subdomains
+	defer func() { cfg.Subdomains = was }()
+	cfg.Subdomains = config.NestedSubdomains
+
+	valid := map[string]string{
+		"alice.example.com":        "alice.example.com",
+		"  Alice.Example.COM ":     "alice.example.com",
+		"cozy.local:8080":          "cozy.local:8080",
+		"test.cozycloud.cc.a_b":    "test.cozycloud.cc.a_b",
+		"café.example.com":         "xn--caf-dma.example.com",
+		"bücher.example.com:8443":  "xn--bcher-kva.example.com:8443",
+		"xn--caf-dma.example.com":  "xn--caf-dma.example.com",
+		"alice-bob.example.com":    "alice-bob.example.com",
+		strings.Repeat("a", 63):    strings.Repeat("a", 63),
+		"files-backup.example.com": "files-backup.example.com",
+	}
+	for domain, expected := range valid {
+		normalized, err := ValidateDomain(domain)
+		assert.NoError(t, err, domain)
+		assert.Equal(t, expected, normalized)
+	}
+
+	invalid := map[string]error{
+		"":                                 ErrIllegalDomain,
+		".":                                ErrIllegalDomain,
+		"..":                               ErrIllegalDomain,
+		"foo/bar":                          ErrIllegalDomain,
+		"foo bar.example.com":              ErrIllegalDomain,
+		"alice@example.com":                ErrIllegalDomain,
+		"alice.example.com.":               ErrIllegalDomain,
+		"-alice.example.com":               ErrIllegalDomain,
+		"alice-.example.com":               ErrIllegalDomain,
+		"alice.example.com:":               ErrIllegalDomain,
+		"alice.example.com:http":           ErrIllegalDomain,
+		"alice.example.com:99999":          ErrIllegalDomain,
+		strings.Repeat("a", 64) + ".com":   ErrDomainTooLong,
+		strings.Repeat("abcd.", 51) + "fr": ErrDomainTooLong,
+		"files.example.com":                ErrReservedDomain,
+		"store.alice.example.com":          ErrReservedDomain,
+	}
+	for domain, expected := range invalid {
+		_, err := ValidateDomain(domain)
+		assert.Equal(t, expected, err, domain)
+	}
+
+	cfg.Subdomains = config.FlatSubdomains
+	_, err := ValidateDomain("alice-bob.example.com")
+	assert.Equal(t, ErrIllegalDomain, err)
+	_, err = ValidateDomain("files.example.com")
+	assert.NoError(t, err)
+}
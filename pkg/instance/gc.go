@@ -0,0 +1,98 @@
+package instance
+
+import (
+	"context"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// GCWorkerType is the type of the worker that collects the garbage of the
+// VFS of an instance
+const GCWorkerType = "gc"
+
+func init() {
+	jobs.AddWorker(GCWorkerType, &jobs.WorkerConfig{
+		Concurrency:  1,
+		MaxExecCount: 1,
+		Timeout:      1 * time.Hour,
+		WorkerFunc:   gcWorker,
+	})
+}
+
+// GCOptions are the options of the gc worker
+type GCOptions struct {
+	Policy vfs.GCPolicy `json:"policy"`
+}
+
+func gcWorker(ctx context.Context, m *jobs.Message) error {
+	opts := &GCOptions{}
+	if err := m.Unmarshal(&opts); err != nil {
+		return err
+	}
+	if !vfs.IsValidGCPolicy(string(opts.Policy)) {
+		opts.Policy = vfs.GCReport
+	}
+	domain := ctx.Value(jobs.ContextDomainKey).(string)
+	i, err := Get(domain)
+	if err != nil {
+		return err
+	}
+	stats, err := vfs.CollectGarbage(i, opts.Policy)
+	if err != nil {
+		return err
+	}
+	if len(stats.OrphanBlobs) > 0 || len(stats.MissingBlobs) > 0 {
+		log.Warnf("[gc] %s: %d blobs without file and %d files without blob (%s)",
+			domain, len(stats.OrphanBlobs), len(stats.MissingBlobs), opts.Policy)
+	}
+	return nil
+}
+
+// PushGCJob pushes a job to collect the garbage of the VFS of the instance
+// with the given policy.
+func (i *Instance) PushGCJob(policy vfs.GCPolicy) error {
+	msg, err := jobs.NewMessage(jobs.JSONEncoding, &GCOptions{Policy: policy})
+	if err != nil {
+		return err
+	}
+	_, _, err = i.JobsBroker().PushJob(&jobs.JobRequest{
+		WorkerType: GCWorkerType,
+		Message:    msg,
+	})
+	return err
+}
+
+// StartGC regularly pushes a gc job for each instance, with the interval and
+// the policy of the configuration.
+//
+// TODO: on distributed stacks, only one stack should do it
+func StartGC() {
+	conf := config.GetConfig().Fs
+	if conf.GCInterval <= 0 {
+		return
+	}
+	policy := vfs.GCPolicy(conf.GCPolicy)
+	if !vfs.IsValidGCPolicy(conf.GCPolicy) {
+		log.Warnf("[gc] Invalid policy %s, the garbage is only reported", conf.GCPolicy)
+		policy = vfs.GCReport
+	}
+	go func() {
+		for range time.Tick(conf.GCInterval) {
+			instances, err := List()
+			if err != nil && !couchdb.IsNoDatabaseError(err) {
+				log.Errorf("[gc] Could not list the instances: %s", err)
+				continue
+			}
+			for _, i := range instances {
+				if err = i.PushGCJob(policy); err != nil {
+					log.Errorf("[gc] Could not push the job for %s: %s", i.Domain, err)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,71 @@
+package instance
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/search"
+)
+
+// IndexWorkerType is the type of the worker that updates the full-text index
+// of the files of an instance
+const IndexWorkerType = "index"
+
+// indexJobTimeout is the delay after which a pushed index job that has not
+// started is considered lost, and another one can be pushed
+const indexJobTimeout = 5 * time.Minute
+
+// indexQueued is the time of the last index job pushed for each instance
+// that has not started yet, so that a single job is waiting for an instance
+// even when its files are modified a lot.
+var indexQueued = struct {
+	sync.Mutex
+	domains map[string]time.Time
+}{domains: make(map[string]time.Time)}
+
+func init() {
+	jobs.AddWorker(IndexWorkerType, &jobs.WorkerConfig{
+		Concurrency:  2,
+		MaxExecCount: 1,
+		Timeout:      30 * time.Minute,
+		WorkerFunc:   indexWorker,
+	})
+}
+
+func indexWorker(ctx context.Context, m *jobs.Message) error {
+	domain := ctx.Value(jobs.ContextDomainKey).(string)
+	indexQueued.Lock()
+	delete(indexQueued.domains, domain)
+	indexQueued.Unlock()
+	i, err := Get(domain)
+	if err != nil {
+		return err
+	}
+	return search.Update(i)
+}
+
+// PushIndexJob pushes a job to update the full-text index of the instance
+// with the last changes of its files. It does nothing if a job is already
+// waiting for the instance.
+func (i *Instance) PushIndexJob() error {
+	now := time.Now()
+	indexQueued.Lock()
+	if at, ok := indexQueued.domains[i.Domain]; ok && now.Sub(at) < indexJobTimeout {
+		indexQueued.Unlock()
+		return nil
+	}
+	indexQueued.domains[i.Domain] = now
+	indexQueued.Unlock()
+
+	_, _, err := i.JobsBroker().PushJob(&jobs.JobRequest{
+		WorkerType: IndexWorkerType,
+	})
+	if err != nil {
+		indexQueued.Lock()
+		delete(indexQueued.domains, i.Domain)
+		indexQueued.Unlock()
+	}
+	return err
+}
@@ -1,12 +1,15 @@
 package instance
 
 import (
+	"bytes"
 	"crypto/subtle"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -19,6 +22,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/jobs"
 	"github.com/cozy/cozy-stack/pkg/jobs/workers"
 	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/search"
 	"github.com/cozy/cozy-stack/pkg/settings"
 	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/cozy/cozy-stack/web/jsonapi"
@@ -35,6 +39,10 @@ const (
 	oauthSecretLen        = 128
 )
 
+// maxUpdateTries is the number of times an update of the instance is tried
+// when it fails with a conflict.
+const maxUpdateTries = 3
+
 // passwordResetValidityDuration is the validity duration of the passphrase
 // reset token.
 var passwordResetValidityDuration = 15 * time.Minute
@@ -57,6 +65,10 @@ var (
 	ErrMissingPassphrase = errors.New("Missing new passphrase")
 	// ErrInvalidPassphrase is returned when the passphrase is invalid
 	ErrInvalidPassphrase = errors.New("Invalid passphrase")
+
+	// errPassphraseChanged is used when the hash of the passphrase is not
+	// updated, as the passphrase has been changed concurrently
+	errPassphraseChanged = errors.New("Passphrase changed")
 )
 
 // An Instance has the informations relatives to the logical cozy instance,
@@ -68,7 +80,36 @@ type Instance struct {
 	Domain     string `json:"domain"`         // The main DNS domain, like example.cozycloud.cc
 	Locale     string `json:"locale"`         // The locale used on the server
 	StorageURL string `json:"storage"`        // Where the binaries are persisted
-	Dev        bool   `json:"dev"`            // Whether or not the instance is for development
+
+	// DBPrefixName is the CouchDB-safe prefix of the names of the databases
+	// of the instance (see couchdb.EncodeDBPrefix). It is empty for the
+	// instances created before it, whose databases have the legacy names
+	// until MigrateDBPrefix is called.
+	DBPrefixName string `json:"db_prefix,omitempty"`
+	// DesignVersion is the version of the indexes and the views defined in
+	// the databases of the instance (see consts.DesignMigrations).
+	DesignVersion int `json:"design_version,omitempty"`
+
+	// Dev are the toggles to relax the security of the instance for
+	// development. LegacyDev is the old flag that enabled all of them, and is
+	// converted when the instance is loaded.
+	Dev       DevOptions `json:"dev_options"`
+	LegacyDev bool       `json:"dev,omitempty"`
+
+	// ContextName is the name of the context of the instance, from the
+	// configuration. The default context is used when it is empty.
+	ContextName string `json:"context,omitempty"`
+	// DefaultApps are the slugs of the applications of the context that are
+	// installed on the first login of the user, and DefaultAppsQueued is true
+	// once their installation has been pushed.
+	DefaultApps       []string `json:"default_apps,omitempty"`
+	DefaultAppsQueued bool     `json:"default_apps_queued,omitempty"`
+
+	// EmailDomain is the domain of the email of the owner, and Apps are the
+	// slugs of the installed applications. They are copies kept in the
+	// document of the instance for Search.
+	EmailDomain string   `json:"email_domain,omitempty"`
+	Apps        []string `json:"apps,omitempty"`
 
 	// PassphraseHash is a hash of the user's passphrase. For more informations,
 	// see crypto.GenerateFromPassphrase.
@@ -89,6 +130,21 @@ type Instance struct {
 	// CLISecret is used to authenticate request from the CLI
 	CLISecret []byte `json:"cli_secret,omitempty"`
 
+	// PreviousSessionSecret and PreviousOAuthSecret are the secrets before
+	// the last rotation, still accepted during a grace period after
+	// SecretsRotatedAt (see RotateSecrets).
+	PreviousSessionSecret []byte     `json:"previous_session_secret,omitempty"`
+	PreviousOAuthSecret   []byte     `json:"previous_oauth_secret,omitempty"`
+	SecretsRotatedAt      *time.Time `json:"secrets_rotated_at,omitempty"`
+	// RevokedTokens is the list of the jti of the revoked tokens, with the
+	// unix time when they expire, or 0 if they don't expire before the next
+	// rotation of the secrets (see RevokeToken).
+	RevokedTokens map[string]int64 `json:"revoked_tokens,omitempty"`
+	// KeyGeneration is incremented each time the secrets that sign the
+	// tokens are changed, so that the permissions cached for the tokens
+	// signed with the previous secrets are not used anymore.
+	KeyGeneration int `json:"key_generation,omitempty"`
+
 	storage afero.Fs
 }
 
@@ -99,7 +155,8 @@ type Options struct {
 	Timezone string
 	Email    string
 	Apps     []string
-	Dev      bool
+	Context  string
+	Dev      DevOptions
 }
 
 // DocType implements couchdb.Doc
@@ -150,6 +207,26 @@ func (i *Instance) Prefix() string {
 	return i.Domain + "/"
 }
 
+// DBPrefix implements couchdb.DBPrefixer
+func (i *Instance) DBPrefix() string {
+	return i.DBPrefixName
+}
+
+// MigrateDBPrefix moves the databases of an instance created before the
+// CouchDB-safe names of the databases to these names. The instance must not
+// be used during the migration.
+func (i *Instance) MigrateDBPrefix() error {
+	if i.DBPrefixName != "" {
+		return nil
+	}
+	dbPrefix := couchdb.EncodeDBPrefix(i.Domain)
+	if err := couchdb.MoveDBs(i, couchdb.NewDatabase(i.Prefix(), dbPrefix)); err != nil {
+		return err
+	}
+	i.DBPrefixName = dbPrefix
+	return couchdb.UpdateDoc(couchdb.GlobalDB, i)
+}
+
 // FS returns the afero storage provider where the binaries for
 // the current instance are persisted
 func (i *Instance) FS() afero.Fs {
@@ -178,6 +255,27 @@ func StartJobs() error {
 	return nil
 }
 
+// RecoverInstallers looks, on all the instances, for the applications whose
+// installation or update was interrupted by a stop of the stack, and resets
+// or resumes them (see apps.RecoverInterrupted).
+func RecoverInstallers() error {
+	instances, err := List()
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return err
+	}
+	resume := config.GetConfig().Installs.ResumeInterrupted
+	for _, in := range instances {
+		recovered, err := apps.RecoverInterrupted(in, resume)
+		if err != nil {
+			log.Errorf("[instance] Could not recover the installers of %s: %s", in.Domain, err)
+		}
+		for _, man := range recovered {
+			log.Warnf("[instance] Installation of %s on %s was interrupted", man.Slug, in.Domain)
+		}
+	}
+	return nil
+}
+
 // StartJobSystem creates all the resources necessary for the instance's job
 // system to work properly.
 func (i *Instance) StartJobSystem() error {
@@ -204,9 +302,9 @@ func (i *Instance) JobsScheduler() jobs.Scheduler {
 }
 
 // Scheme returns the scheme used for URLs. It is https by default and http
-// for development instances.
+// for development instances that allow it.
 func (i *Instance) Scheme() string {
-	if i.Dev {
+	if i.Dev.AllowHTTP {
 		return "http"
 	}
 	return "https"
@@ -269,7 +367,7 @@ func (i *Instance) createInCouchdb() error {
 	if err != nil {
 		return err
 	}
-	return couchdb.DefineIndexes(couchdb.GlobalDB, consts.GlobalIndexes)
+	return MigrateGlobalDesignDocs()
 }
 
 // createRootDir creates the root directory for this instance
@@ -306,12 +404,8 @@ func (i *Instance) createRootDir() error {
 }
 
 func (i *Instance) installApp(slug string) error {
-	source, ok := consts.AppsRegistry[slug]
-	if !ok {
-		return errors.New("Unknown app")
-	}
 	inst, err := apps.NewInstaller(i, &apps.InstallerOptions{
-		SourceURL: source,
+		SourceURL: "registry://" + slug,
 		Slug:      slug,
 	})
 	if err != nil {
@@ -332,21 +426,9 @@ func (i *Instance) installApp(slug string) error {
 
 // Create builds an instance and initializes it
 func Create(opts *Options) (*Instance, error) {
-	domain := strings.TrimSpace(opts.Domain)
-	if domain == "" {
-		return nil, ErrIllegalDomain
-	}
-	if strings.ContainsAny(domain, vfs.ForbiddenFilenameChars) || domain == ".." || domain == "." {
-		return nil, ErrIllegalDomain
-	}
-	if strings.ContainsAny(domain, " /?#@\t\r\n\x00") {
-		return nil, ErrIllegalDomain
-	}
-	if config.GetConfig().Subdomains == config.FlatSubdomains {
-		parts := strings.SplitN(domain, ".", 2)
-		if strings.Contains(parts[0], "-") {
-			return nil, ErrIllegalDomain
-		}
+	domain, err := ValidateDomain(opts.Domain)
+	if err != nil {
+		return nil, err
 	}
 
 	locale := opts.Locale
@@ -358,9 +440,14 @@ func Create(opts *Options) (*Instance, error) {
 
 	i.Locale = locale
 	i.Domain = domain
+	i.DBPrefixName = couchdb.EncodeDBPrefix(domain)
+	i.DesignVersion = consts.DesignMigrations.Version()
 	i.StorageURL = config.BuildRelFsURL(domain).String()
 
 	i.Dev = opts.Dev
+	i.ContextName = opts.Context
+	i.DefaultApps = contextDefaultApps(opts.Context, opts.Apps)
+	i.SetEmail(opts.Email)
 
 	i.PassphraseHash = nil
 	i.PassphraseResetToken = nil
@@ -404,10 +491,7 @@ func Create(opts *Options) (*Instance, error) {
 	if err := couchdb.CreateNamedDoc(i, settingsDoc); err != nil {
 		return nil, err
 	}
-	if err := couchdb.DefineIndexes(i, consts.Indexes); err != nil {
-		return nil, err
-	}
-	if err := couchdb.DefineViews(i, consts.Views); err != nil {
+	if _, err := consts.DesignMigrations.Apply(i, 0); err != nil {
 		return nil, err
 	}
 	if err := i.StartJobSystem(); err != nil {
@@ -418,6 +502,7 @@ func Create(opts *Options) (*Instance, error) {
 			log.Error("[instance] Failed to install "+app, err)
 		}
 	}
+	triggerLifecycleHooks(config.LifecycleCreated, i)
 	// TODO atomicity with defer
 	return i, nil
 }
@@ -455,20 +540,33 @@ func Get(domain string) (*Instance, error) {
 		return nil, err
 	}
 
+	instances[0].migrateLegacyDev()
+	if err = instances[0].MigrateDesignDocs(); err != nil {
+		log.Errorf("[instance] Could not migrate the design docs of %s: %s", domain, err)
+	}
 	return instances[0], nil
 }
 
-var translations = make(map[string]*gotext.Po)
+// The translations can be updated at runtime by the download of the .po files
+// from the translations service, hence the lock
+var (
+	translations   = make(map[string]*gotext.Po)
+	translationsMu sync.RWMutex
+)
 
 // LoadLocale creates the translation object for a locale from the content of a .po file
 func LoadLocale(identifier, rawPO string) {
 	po := &gotext.Po{Language: identifier}
 	po.Parse(rawPO)
+	translationsMu.Lock()
 	translations[identifier] = po
+	translationsMu.Unlock()
 }
 
 // Translate is used to translate a string to the locale used on this instance
 func (i *Instance) Translate(key string, vars ...interface{}) string {
+	translationsMu.RLock()
+	defer translationsMu.RUnlock()
 	if po, ok := translations[i.Locale]; ok {
 		return po.Get(key, vars...)
 	}
@@ -479,13 +577,17 @@ func (i *Instance) Translate(key string, vars ...interface{}) string {
 }
 
 // List returns the list of declared instances.
-//
-// TODO: pagination
-// TODO: don't return the design docs
 func List() ([]*Instance, error) {
 	var docs []*Instance
-	req := &couchdb.AllDocsRequest{Limit: 100}
-	err := couchdb.GetAllDocs(couchdb.GlobalDB, consts.Instances, req, &docs)
+	err := couchdb.ForeachDoc(couchdb.GlobalDB, consts.Instances, func(data json.RawMessage) error {
+		doc := &Instance{}
+		if err := json.Unmarshal(data, doc); err != nil {
+			return err
+		}
+		doc.migrateLegacyDev()
+		docs = append(docs, doc)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -503,11 +605,16 @@ func Destroy(domain string) (*Instance, error) {
 	if err = couchdb.DeleteDoc(couchdb.GlobalDB, i); err != nil {
 		return nil, err
 	}
+	permissions.InvalidateCache(i.Domain)
 
 	if err = couchdb.DeleteAllDBs(i); err != nil {
 		return nil, err
 	}
 
+	if err = search.Drop(i); err != nil {
+		return nil, err
+	}
+
 	if err = i.StopJobSystem(); err != nil {
 		return nil, err
 	}
@@ -524,27 +631,60 @@ func Destroy(domain string) (*Instance, error) {
 		return nil, err
 	}
 
+	triggerLifecycleHooks(config.LifecycleDestroyed, i)
 	return i, nil
 }
 
-// RegisterPassphrase replace the instance registerToken by a passphrase
+// RegisterPassphrase replace the instance registerToken by a passphrase.
+//
+// The token is single-use: it is removed in the same update of the document
+// as the passphrase is set. If two registrations are made concurrently, the
+// update of the second one will fail with a conflict on the revision of the
+// document. In this case, the token is checked again on the fresh document,
+// so that only one registration can ever succeed.
 func (i *Instance) RegisterPassphrase(pass, tok []byte) error {
 	if len(pass) == 0 {
 		return ErrMissingPassphrase
 	}
+	if err := i.checkRegisterToken(tok); err != nil {
+		return err
+	}
+	hash, err := crypto.GenerateFromPassphrase(pass)
+	if err != nil {
+		return err
+	}
+	return couchdb.UpdateDocWithRetry(couchdb.GlobalDB, i, func(couchdb.Doc) error {
+		if err := i.checkRegisterToken(tok); err != nil {
+			return err
+		}
+		i.RegisterToken = nil
+		i.setPassphraseAndSecret(hash)
+		return nil
+	})
+}
+
+func (i *Instance) checkRegisterToken(tok []byte) error {
 	if len(i.RegisterToken) == 0 {
 		return ErrMissingToken
 	}
 	if subtle.ConstantTimeCompare(i.RegisterToken, tok) != 1 {
 		return ErrInvalidToken
 	}
-	hash, err := crypto.GenerateFromPassphrase(pass)
+	return nil
+}
+
+// reload fetches again the document of the instance from CouchDB, for
+// example after a conflict.
+func (i *Instance) reload() error {
+	doc := &Instance{}
+	err := couchdb.GetDoc(couchdb.GlobalDB, consts.Instances, i.ID(), doc)
 	if err != nil {
 		return err
 	}
-	i.RegisterToken = nil
-	i.setPassphraseAndSecret(hash)
-	return couchdb.UpdateDoc(couchdb.GlobalDB, i)
+	doc.storage = i.storage
+	doc.migrateLegacyDev()
+	*i = *doc
+	return nil
 }
 
 // RequestPassphraseReset generates a new registration token for the user to
@@ -578,6 +718,7 @@ func (i *Instance) RequestPassphraseReset() error {
 		TemplateValues: struct{ PassphraseResetLink string }{
 			PassphraseResetLink: resetURL,
 		},
+		Locale: i.Locale,
 	})
 	if err != nil {
 		return err
@@ -633,6 +774,11 @@ func (i *Instance) UpdatePassphrase(pass, current []byte) error {
 func (i *Instance) setPassphraseAndSecret(hash []byte) {
 	i.PassphraseHash = hash
 	i.SessionSecret = crypto.GenerateRandomBytes(sessionSecretLen)
+	// The sessions opened before must be closed, even with the secret of a
+	// previous rotation
+	i.PreviousSessionSecret = nil
+	i.KeyGeneration++
+	permissions.InvalidateCache(i.Domain)
 }
 
 // CheckPassphrase confirm an instance passport
@@ -655,9 +801,18 @@ func (i *Instance) CheckPassphrase(pass []byte) error {
 		return err
 	}
 
-	i.PassphraseHash = newHash
-	err = couchdb.UpdateDoc(couchdb.GlobalDB, i)
-	if err != nil {
+	// The instance is updated with a retry, as it is often modified by the
+	// concurrent requests, but not if the passphrase has been changed since
+	// it was checked.
+	oldHash := i.PassphraseHash
+	err = couchdb.UpdateDocWithRetry(couchdb.GlobalDB, i, func(couchdb.Doc) error {
+		if !bytes.Equal(i.PassphraseHash, oldHash) {
+			return errPassphraseChanged
+		}
+		i.PassphraseHash = newHash
+		return nil
+	})
+	if err != nil && err != errPassphraseChanged {
 		log.Error("[instance] Failed to update hash in db", err)
 	}
 
@@ -667,9 +822,11 @@ func (i *Instance) CheckPassphrase(pass []byte) error {
 // PickKey choose wich of the Instance keys to use depending on token audience
 func (i *Instance) PickKey(audience string) ([]byte, error) {
 	switch audience {
-	case permissions.AppAudience:
+	case permissions.AppAudience, permissions.DownloadAudience,
+		permissions.UnlockedShareAudience:
 		return i.SessionSecret, nil
-	case permissions.RefreshTokenAudience, permissions.AccessTokenAudience, permissions.ShareAudience:
+	case permissions.RefreshTokenAudience, permissions.AccessTokenAudience,
+		permissions.ShareAudience, permissions.RegistrationTokenAudience:
 		return i.OAuthSecret, nil
 	case permissions.CLIAudience:
 		return i.CLISecret, nil
@@ -689,6 +846,7 @@ func (i *Instance) MakeJWT(audience, subject, scope string, issuedAt time.Time)
 			Issuer:   i.Domain,
 			IssuedAt: issuedAt.Unix(),
 			Subject:  subject,
+			Id:       NewTokenID(),
 		},
 		Scope: scope,
 	})
@@ -708,7 +866,7 @@ func (i *Instance) BuildAppToken(m *apps.Manifest) string {
 func createFs(u *url.URL) (fs afero.Fs, err error) {
 	switch u.Scheme {
 	case "file":
-		fs = afero.NewBasePathFs(afero.NewOsFs(), u.Path)
+		fs = vfs.NewLocalFs(u.Path)
 	case "mem":
 		fs = afero.NewMemMapFs()
 	default:
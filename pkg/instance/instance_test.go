@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"os"
+	"sort"
 	"testing"
 	"time"
 
@@ -14,6 +15,8 @@ import (
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
 	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/permissions"
 	"github.com/cozy/cozy-stack/pkg/vfs"
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/spf13/afero"
@@ -72,6 +75,97 @@ func TestCreateInstanceWithSettings(t *testing.T) {
 	assert.Equal(t, "alice@example.com", doc.M["email"].(string))
 }
 
+func TestCreateInstanceWithDefaultApps(t *testing.T) {
+	cfg := config.GetConfig()
+	was := cfg.Contexts
+	defer func() { cfg.Contexts = was }()
+	cfg.Contexts = map[string]config.Context{
+		"partner": {DefaultApps: []string{"drive", "photos"}},
+	}
+
+	instance, err := Create(&Options{
+		Domain:  "test3.cozycloud.cc",
+		Locale:  "en",
+		Context: "partner",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "partner", instance.ContextName)
+	assert.Equal(t, []string{"drive", "photos"}, instance.DefaultApps)
+	assert.False(t, instance.DefaultAppsQueued)
+
+	statuses, err := instance.DefaultAppsStatus()
+	assert.NoError(t, err)
+	if assert.Len(t, statuses, 2) {
+		assert.Equal(t, "drive", statuses[0].Slug)
+		assert.Equal(t, DefaultAppPending, statuses[0].State)
+	}
+
+	// The apps installed on creation are not installed again
+	assert.Equal(t, []string{"drive"}, contextDefaultApps("partner", []string{"photos"}))
+	assert.Empty(t, contextDefaultApps("", nil))
+}
+
+func TestInstallDefaultAppsPushError(t *testing.T) {
+	instance := &Instance{
+		Domain:      "test-default-apps.cozycloud.cc",
+		DefaultApps: []string{"drive"},
+	}
+	if !assert.NoError(t, couchdb.CreateDoc(couchdb.GlobalDB, instance)) {
+		return
+	}
+	defer couchdb.DeleteDoc(couchdb.GlobalDB, instance)
+
+	// The job can't be pushed without the worker, and it will be pushed again
+	// on the next login
+	jobs.NewMemBroker(instance.Domain, jobs.WorkersList{})
+	assert.Equal(t, jobs.ErrUnknownWorker, instance.InstallDefaultApps())
+	assert.False(t, instance.DefaultAppsQueued)
+	fetched := &Instance{}
+	err := couchdb.GetDoc(couchdb.GlobalDB, consts.Instances, instance.ID(), fetched)
+	if assert.NoError(t, err) {
+		assert.False(t, fetched.DefaultAppsQueued)
+	}
+}
+
+func TestDevOptions(t *testing.T) {
+	dev, err := ParseDevOptions([]string{"allow_http", " verbose_errors", ""})
+	assert.NoError(t, err)
+	assert.Equal(t, DevOptions{AllowHTTP: true, VerboseErrors: true}, dev)
+	assert.Equal(t, []string{"allow_http", "verbose_errors"}, dev.Names())
+	assert.True(t, dev.Any())
+
+	_, err = ParseDevOptions([]string{"allow_http", "foo"})
+	assert.Equal(t, ErrUnknownDevOption, err)
+
+	dev, err = ParseDevOptions(nil)
+	assert.NoError(t, err)
+	assert.False(t, dev.Any())
+
+	i := &Instance{Domain: "example.com", LegacyDev: true}
+	i.migrateLegacyDev()
+	assert.Equal(t, AllDevOptions(), i.Dev)
+	assert.Equal(t, "http", i.Scheme())
+	assert.True(t, i.AllowUnsignedApps())
+	assert.True(t, i.AllowProxyApps())
+
+	i = &Instance{Domain: "example.com", Dev: DevOptions{RelaxCSP: true}}
+	assert.Equal(t, "https", i.Scheme())
+	assert.False(t, i.AllowUnsignedApps())
+	assert.False(t, i.AllowProxyApps())
+
+	// The old flag is converted when the instance is reloaded too
+	i = &Instance{Domain: "legacy-dev.cozycloud.cc", LegacyDev: true}
+	if !assert.NoError(t, couchdb.CreateDoc(couchdb.GlobalDB, i)) {
+		return
+	}
+	defer couchdb.DeleteDoc(couchdb.GlobalDB, i)
+	if assert.NoError(t, i.reload()) {
+		assert.Equal(t, AllDevOptions(), i.Dev)
+	}
+}
+
 func TestCreateInstanceBadDomain(t *testing.T) {
 	_, err := Create(&Options{
 		Domain: "..",
@@ -160,6 +254,110 @@ func TestBuildAppToken(t *testing.T) {
 	assert.Equal(t, "my-app", claims["sub"])
 }
 
+func TestRotateSecrets(t *testing.T) {
+	i, err := Get("test.cozycloud.cc")
+	if !assert.NoError(t, err) {
+		return
+	}
+	appToken := i.BuildAppToken(&apps.Manifest{Slug: "my-app"})
+	oauthToken, err := i.MakeJWT(permissions.AccessTokenAudience, "my-client", "io.cozy.files", time.Now())
+	assert.NoError(t, err)
+	oldSessionSecret := i.SessionSecret
+	generation := i.KeyGeneration
+	permissions.PutCached(i.Domain, appToken, generation, &permissions.Permission{}, &permissions.Claims{})
+
+	err = i.RotateSecrets()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotEqual(t, oldSessionSecret, i.SessionSecret)
+	assert.Equal(t, generation+1, i.KeyGeneration)
+	_, ok := permissions.GetCached(i.Domain, appToken, generation)
+	assert.False(t, ok)
+	assert.Equal(t, oldSessionSecret, i.PreviousSessionKey())
+
+	var claims permissions.Claims
+	assert.NoError(t, i.ParseJWT(appToken, &claims))
+	assert.Equal(t, "my-app", claims.Subject)
+	assert.NoError(t, i.ParseJWT(oauthToken, &claims))
+	assert.Equal(t, "my-client", claims.Subject)
+	newToken := i.BuildAppToken(&apps.Manifest{Slug: "my-app"})
+	assert.NoError(t, i.ParseJWT(newToken, &claims))
+
+	past := time.Now().Add(-SecretsGracePeriod - time.Hour)
+	i.SecretsRotatedAt = &past
+	assert.Nil(t, i.PreviousSessionKey())
+	assert.Error(t, i.ParseJWT(appToken, &claims))
+	assert.Error(t, i.ParseJWT(oauthToken, &claims))
+	assert.NoError(t, i.ParseJWT(newToken, &claims))
+}
+
+func TestRotateSecretsAfterConflict(t *testing.T) {
+	stale, err := Get("test.cozycloud.cc")
+	if !assert.NoError(t, err) {
+		return
+	}
+	fresh, err := Get("test.cozycloud.cc")
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, couchdb.UpdateDoc(couchdb.GlobalDB, fresh)) {
+		return
+	}
+	assert.NoError(t, stale.RotateSecrets())
+	assert.Equal(t, fresh.SessionSecret, stale.PreviousSessionSecret)
+	assert.NotEqual(t, fresh.Rev(), stale.Rev())
+}
+
+func TestRevokeToken(t *testing.T) {
+	i, err := Get("test.cozycloud.cc")
+	if !assert.NoError(t, err) {
+		return
+	}
+	revoked := i.BuildAppToken(&apps.Manifest{Slug: "my-app"})
+	other := i.BuildAppToken(&apps.Manifest{Slug: "my-app"})
+	assert.NotEqual(t, revoked, other)
+
+	var claims permissions.Claims
+	assert.NoError(t, i.ParseJWT(revoked, &claims))
+	assert.NotEmpty(t, claims.Id)
+	assert.NoError(t, i.RevokeToken(revoked))
+	assert.Equal(t, permissions.ErrRevokedToken, i.ParseJWT(revoked, &claims))
+	assert.NoError(t, i.ParseJWT(other, &claims))
+
+	i, err = Get("test.cozycloud.cc")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, permissions.ErrRevokedToken, i.ParseJWT(revoked, &claims))
+
+	var old permissions.Claims
+	old.Audience = permissions.AppAudience
+	old.Issuer = i.Domain
+	old.IssuedAt = crypto.Timestamp()
+	old.Subject = "my-app"
+	withoutID, err := crypto.NewJWT(i.SessionSecret, old)
+	assert.NoError(t, err)
+	assert.Equal(t, ErrTokenWithoutID, i.RevokeToken(withoutID))
+	assert.Error(t, i.RevokeToken("not-a-token"))
+}
+
+func TestRevokedUntil(t *testing.T) {
+	i := &Instance{}
+	var claims permissions.Claims
+	claims.Audience = permissions.RefreshTokenAudience
+	claims.IssuedAt = crypto.Timestamp()
+	assert.Equal(t, int64(0), i.revokedUntil(&claims))
+
+	rotatedAt := time.Now().Add(time.Hour).UTC()
+	i.SecretsRotatedAt = &rotatedAt
+	assert.Equal(t, rotatedAt.Add(SecretsGracePeriod).Unix(), i.revokedUntil(&claims))
+
+	claims.Audience = permissions.AppAudience
+	expected := claims.IssuedAtUTC().Add(permissions.TokenValidityDuration).Unix()
+	assert.Equal(t, expected, i.revokedUntil(&claims))
+}
+
 func TestRegisterPassphrase(t *testing.T) {
 	instance, err := Get("test.cozycloud.cc")
 	if !assert.NoError(t, err, "cant fetch instance") {
@@ -194,6 +392,56 @@ func TestRegisterPassphrase(t *testing.T) {
 	assert.Error(t, err, "RegisterPassphrase works only once")
 }
 
+func TestRegisterPassphraseConcurrently(t *testing.T) {
+	Destroy("test.cozycloud.cc.register_race")
+	in, err := Create(&Options{
+		Domain: "test.cozycloud.cc.register_race",
+		Locale: "en",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() {
+		Destroy("test.cozycloud.cc.register_race")
+	}()
+
+	// Two requests have loaded the instance before any registration
+	in1, err := Get(in.Domain)
+	assert.NoError(t, err)
+	in2, err := Get(in.Domain)
+	assert.NoError(t, err)
+	token := in.RegisterToken
+
+	errs := make(chan error, 2)
+	go func() { errs <- in1.RegisterPassphrase([]byte("first"), token) }()
+	go func() { errs <- in2.RegisterPassphrase([]byte("second"), token) }()
+	err1, err2 := <-errs, <-errs
+	if err1 == nil {
+		assert.Equal(t, ErrMissingToken, err2)
+	} else {
+		assert.Equal(t, ErrMissingToken, err1)
+		assert.NoError(t, err2)
+	}
+
+	// A registration after an unrelated update of the instance still works
+	Destroy("test.cozycloud.cc.register_race")
+	in, err = Create(&Options{
+		Domain: "test.cozycloud.cc.register_race",
+		Locale: "en",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	stale, err := Get(in.Domain)
+	assert.NoError(t, err)
+	in.Locale = "fr"
+	assert.NoError(t, couchdb.UpdateDoc(couchdb.GlobalDB, in))
+	err = stale.RegisterPassphrase([]byte("passphrase"), in.RegisterToken)
+	assert.NoError(t, err)
+	assert.Equal(t, "fr", stale.Locale)
+	assert.Empty(t, stale.RegisterToken)
+}
+
 func TestUpdatePassphrase(t *testing.T) {
 	instance, err := Get("test.cozycloud.cc")
 	if !assert.NoError(t, err, "cant fetch instance") {
@@ -384,6 +632,197 @@ func TestGetFs(t *testing.T) {
 	assert.Equal(t, content, buf, "the storage should have persist the content of the foo file")
 }
 
+func TestSnapshotAndRestore(t *testing.T) {
+	domain := "test.cozycloud.cc.snapshot"
+	Destroy(domain)
+	defer Destroy(domain)
+	in, err := Create(&Options{Domain: domain, Locale: "en"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	doctype := "io.cozy.tests"
+	doc := couchdb.JSONDoc{Type: doctype, M: map[string]interface{}{"test": "before"}}
+	assert.NoError(t, couchdb.CreateDoc(in, doc))
+	assert.NoError(t, afero.WriteFile(in.FS(), "/foo", []byte("before"), 0644))
+
+	id, err := in.Snapshot()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, id)
+
+	doc.M["test"] = "after"
+	assert.NoError(t, couchdb.UpdateDoc(in, doc))
+	other := couchdb.JSONDoc{Type: "io.cozy.tests.other", M: map[string]interface{}{}}
+	assert.NoError(t, couchdb.CreateDoc(in, other))
+	assert.NoError(t, afero.WriteFile(in.FS(), "/foo", []byte("after"), 0644))
+	assert.NoError(t, afero.WriteFile(in.FS(), "/bar", []byte("after"), 0644))
+	in.Locale = "fr"
+	assert.NoError(t, couchdb.UpdateDoc(couchdb.GlobalDB, in))
+
+	assert.Equal(t, ErrSnapshotNotFound, in.Restore("unknown"))
+	assert.NoError(t, in.Restore(id))
+
+	var restored couchdb.JSONDoc
+	assert.NoError(t, couchdb.GetDoc(in, doctype, doc.ID(), &restored))
+	assert.Equal(t, "before", restored.M["test"])
+	doctypes, err := couchdb.AllDoctypes(in)
+	assert.NoError(t, err)
+	assert.NotContains(t, doctypes, "io.cozy.tests.other")
+	var root vfs.DirDoc
+	assert.NoError(t, couchdb.GetDoc(in, consts.Files, consts.RootDirID, &root))
+
+	content, err := afero.ReadFile(in.FS(), "/foo")
+	assert.NoError(t, err)
+	assert.Equal(t, "before", string(content))
+	exists, err := afero.Exists(in.FS(), "/bar")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	assert.Equal(t, "en", in.Locale)
+	stored, err := Get(domain)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "en", stored.Locale)
+	}
+
+	assert.Equal(t, ErrSnapshotNotFound, DeleteSnapshot("other.cozycloud.cc", id))
+	assert.NoError(t, DeleteSnapshot(domain, id))
+	assert.Equal(t, ErrSnapshotNotFound, DeleteSnapshot(domain, id))
+	assert.Equal(t, ErrSnapshotNotFound, in.Restore(id))
+	assert.Zero(t, snapshotsSize)
+
+	// The snapshots kept in memory are limited in size
+	maxSize := SnapshotsMaxSize
+	defer func() { SnapshotsMaxSize = maxSize }()
+	id, err = in.Snapshot()
+	if assert.NoError(t, err) {
+		SnapshotsMaxSize = snapshotsSize + 1
+		_, err = in.Snapshot()
+		assert.Equal(t, ErrSnapshotTooLarge, err)
+		assert.NoError(t, DeleteSnapshot(domain, id))
+	}
+
+	// and are not available on a production release
+	buildMode := config.BuildMode
+	defer func() { config.BuildMode = buildMode }()
+	config.BuildMode = config.Production
+	_, err = in.Snapshot()
+	assert.Equal(t, ErrSnapshotsDisabled, err)
+}
+
+func TestMigrateDBPrefix(t *testing.T) {
+	i, err := Create(&Options{
+		Domain: "test.cozycloud.cc.migrate",
+		Locale: "en",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer Destroy(i.Domain)
+	assert.Equal(t, "test-cozycloud-cc-migrate", i.DBPrefix())
+	assert.NoError(t, i.MigrateDBPrefix())
+
+	// Move the databases back to the legacy names
+	legacy := couchdb.NewDatabase(i.Prefix(), "")
+	if !assert.NoError(t, couchdb.MoveDBs(i, legacy)) {
+		return
+	}
+	i.DBPrefixName = ""
+	if !assert.NoError(t, couchdb.UpdateDoc(couchdb.GlobalDB, i)) {
+		return
+	}
+	_, err = couchdb.DBStatus(legacy, consts.Settings)
+	assert.NoError(t, err)
+
+	assert.NoError(t, i.MigrateDBPrefix())
+	assert.Equal(t, "test-cozycloud-cc-migrate", i.DBPrefix())
+	_, err = couchdb.DBStatus(legacy, consts.Settings)
+	assert.True(t, couchdb.IsNoDatabaseError(err))
+	doc := &couchdb.JSONDoc{}
+	err = couchdb.GetDoc(i, consts.Settings, consts.InstanceSettingsID, doc)
+	assert.NoError(t, err)
+
+	fetched, err := Get(i.Domain)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "test-cozycloud-cc-migrate", fetched.DBPrefix())
+	}
+}
+
+func TestMigrateDesignDocs(t *testing.T) {
+	i, err := Create(&Options{
+		Domain: "test.cozycloud.cc.design",
+		Locale: "en",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer Destroy(i.Domain)
+	assert.Equal(t, consts.DesignMigrations.Version(), i.DesignVersion)
+
+	i.DesignVersion = 0
+	if !assert.NoError(t, couchdb.UpdateDoc(couchdb.GlobalDB, i)) {
+		return
+	}
+	fetched, err := Get(i.Domain)
+	if assert.NoError(t, err) {
+		assert.Equal(t, consts.DesignMigrations.Version(), fetched.DesignVersion)
+	}
+	_, err = couchdb.ReduceViewQuery(fetched, consts.DiskUsageView, nil)
+	assert.NoError(t, err)
+
+	assert.NoError(t, MigrateGlobalDesignDocs())
+}
+
+func TestSearch(t *testing.T) {
+	fr := "test.cozycloud.cc.search-fr"
+	en := "test.cozycloud.cc.search-en"
+	Destroy(fr)
+	Destroy(en)
+	defer Destroy(fr)
+	defer Destroy(en)
+	in1, err := Create(&Options{
+		Domain:  fr,
+		Locale:  "eo",
+		Email:   "alice@Search.Example",
+		Context: "search-test",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = Create(&Options{
+		Domain: en,
+		Locale: "eo-en",
+		Email:  "bob@search.example",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "search.example", in1.EmailDomain)
+
+	domains := func(opts *SearchOptions) []string {
+		list, err := Search(opts)
+		assert.NoError(t, err)
+		var res []string
+		for _, i := range list {
+			if i.Domain == fr || i.Domain == en {
+				res = append(res, i.Domain)
+			}
+		}
+		sort.Strings(res)
+		return res
+	}
+	assert.Equal(t, []string{fr}, domains(&SearchOptions{Locale: "eo"}))
+	assert.Equal(t, []string{en, fr}, domains(&SearchOptions{EmailDomain: "SEARCH.example"}))
+	assert.Equal(t, []string{fr}, domains(&SearchOptions{Context: "search-test"}))
+	assert.Equal(t, []string{en}, domains(&SearchOptions{Context: config.DefaultContext, EmailDomain: "search.example"}))
+	assert.Empty(t, domains(&SearchOptions{Locale: "eo", Context: config.DefaultContext}))
+
+	man := &apps.Manifest{Slug: "cozy-search", State: apps.Ready}
+	assert.NoError(t, couchdb.CreateNamedDoc(in1, man))
+	assert.Empty(t, domains(&SearchOptions{App: "cozy-search"}))
+	assert.NoError(t, in1.UpdateSearchAttributes())
+	assert.Equal(t, []string{"cozy-search"}, in1.Apps)
+	assert.Equal(t, []string{fr}, domains(&SearchOptions{App: "cozy-search", EmailDomain: "search.example"}))
+}
+
 func TestTranslate(t *testing.T) {
 	LoadLocale("fr", `
 msgid "english"
@@ -416,6 +855,7 @@ func TestMain(m *testing.M) {
 	}
 	Destroy("test.cozycloud.cc")
 	Destroy("test2.cozycloud.cc")
+	Destroy("test3.cozycloud.cc")
 	Destroy("test.cozycloud.cc.duplicate")
 
 	os.RemoveAll("/usr/local/var/cozy2/")
@@ -424,6 +864,7 @@ func TestMain(m *testing.M) {
 
 	Destroy("test.cozycloud.cc")
 	Destroy("test2.cozycloud.cc")
+	Destroy("test3.cozycloud.cc")
 	Destroy("test.cozycloud.cc.duplicate")
 
 	os.Exit(res)
@@ -0,0 +1,159 @@
+package instance
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cozy/cozy-stack/pkg/config"
+)
+
+// lifecycleClient has no timeout: the requests are stopped by the context,
+// after the timeout of the configuration.
+var lifecycleClient = &http.Client{}
+
+// deadLettersMu serializes the writes in the dead-letter log
+var deadLettersMu sync.Mutex
+
+// LifecycleEvent is sent to the lifecycle hooks: as JSON in the body of the
+// POST requests, and on the standard input of the commands.
+type LifecycleEvent struct {
+	Event   string    `json:"event"`
+	Domain  string    `json:"domain"`
+	Context string    `json:"context,omitempty"`
+	Locale  string    `json:"locale,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// deadLetter is a line of the dead-letter log, for a hook that has failed
+// after all its retries.
+type deadLetter struct {
+	*LifecycleEvent
+	Command string `json:"command,omitempty"`
+	URL     string `json:"url,omitempty"`
+	Tries   int    `json:"tries"`
+	Error   string `json:"error"`
+}
+
+// triggerLifecycleHooks runs in background the hooks configured for the given
+// event of the lifecycle of the instance.
+func triggerLifecycleHooks(event string, i *Instance) {
+	cfg := config.GetConfig().Lifecycle
+	hooks := cfg.Hooks[event]
+	if len(hooks) == 0 {
+		return
+	}
+	ev := &LifecycleEvent{
+		Event:   event,
+		Domain:  i.Domain,
+		Context: i.ContextName,
+		Locale:  i.Locale,
+		Time:    time.Now().UTC(),
+	}
+	for _, hook := range hooks {
+		go runLifecycleHook(cfg, hook, ev)
+	}
+}
+
+// runLifecycleHook runs a hook, and tries it again when it fails, with a
+// delay doubled for each retry. The failure is appended to the dead-letter
+// log after the last retry.
+func runLifecycleHook(cfg config.Lifecycle, hook config.LifecycleHook, ev *LifecycleEvent) {
+	delay := cfg.RetryDelay
+	var err error
+	tries := 0
+	for {
+		tries++
+		if err = callLifecycleHook(hook, ev, cfg.Timeout); err == nil {
+			return
+		}
+		log.Warnf("[lifecycle] Hook for %s of %s failed: %s", ev.Event, ev.Domain, err)
+		if tries > cfg.Retries {
+			break
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+	writeDeadLetter(cfg.DeadLetters, &deadLetter{
+		LifecycleEvent: ev,
+		Command:        hook.Command,
+		URL:            hook.URL,
+		Tries:          tries,
+		Error:          err.Error(),
+	})
+}
+
+// callLifecycleHook runs the command or makes the request of a hook, and
+// stops it after the timeout.
+func callLifecycleHook(hook config.LifecycleHook, ev *LifecycleEvent, timeout time.Duration) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	if timeout <= 0 {
+		timeout = config.DefaultLifecycleTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if hook.Command != "" {
+		cmd := exec.CommandContext(ctx, hook.Command, ev.Event, ev.Domain) // #nosec
+		cmd.Stdin = bytes.NewReader(body)
+		cmd.Env = append(os.Environ(),
+			"COZY_EVENT="+ev.Event,
+			"COZY_DOMAIN="+ev.Domain,
+		)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			if ctx.Err() == context.DeadlineExceeded {
+				return fmt.Errorf("Killed after %s", timeout)
+			}
+			return fmt.Errorf("%s: %s", err, bytes.TrimSpace(out))
+		}
+		return nil
+	}
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := lifecycleClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("Unexpected response status: %s", res.Status)
+	}
+	return nil
+}
+
+// writeDeadLetter appends a failed hook to the dead-letter log, one JSON
+// object per line, so that the hoster can replay it.
+func writeDeadLetter(filename string, letter *deadLetter) {
+	log.Errorf("[lifecycle] Hook for %s of %s failed after %d tries: %s",
+		letter.Event, letter.Domain, letter.Tries, letter.Error)
+	if filename == "" {
+		return
+	}
+	line, err := json.Marshal(letter)
+	if err != nil {
+		return
+	}
+	deadLettersMu.Lock()
+	defer deadLettersMu.Unlock()
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		log.Errorf("[lifecycle] Could not open the dead-letter log: %s", err)
+		return
+	}
+	defer f.Close()
+	if _, err = f.Write(append(line, '\n')); err != nil {
+		log.Errorf("[lifecycle] Could not write in the dead-letter log: %s", err)
+	}
+}
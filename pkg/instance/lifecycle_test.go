@@ -0,0 +1,77 @@
+package instance
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLifecycleHooks(t *testing.T) {
+	var events []*LifecycleEvent
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ev := &LifecycleEvent{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(ev))
+		events = append(events, ev)
+		if len(events) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "cozy-lifecycle")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	cfg := config.Lifecycle{
+		Retries:     1,
+		RetryDelay:  time.Millisecond,
+		DeadLetters: filepath.Join(dir, "dead-letters.log"),
+	}
+	ev := &LifecycleEvent{
+		Event:  config.LifecycleCreated,
+		Domain: "alice.cozy.example",
+		Time:   time.Now(),
+	}
+
+	runLifecycleHook(cfg, config.LifecycleHook{URL: ts.URL}, ev)
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, "alice.cozy.example", events[1].Domain)
+		assert.Equal(t, config.LifecycleCreated, events[1].Event)
+	}
+	_, err = os.Stat(cfg.DeadLetters)
+	assert.True(t, os.IsNotExist(err))
+
+	runLifecycleHook(cfg, config.LifecycleHook{Command: "false"}, ev)
+	content, err := ioutil.ReadFile(cfg.DeadLetters)
+	if !assert.NoError(t, err) {
+		return
+	}
+	letter := make(map[string]interface{})
+	assert.NoError(t, json.Unmarshal(content, &letter))
+	assert.Equal(t, "false", letter["command"])
+	assert.Equal(t, "alice.cozy.example", letter["domain"])
+	assert.EqualValues(t, 2, letter["tries"])
+	assert.NotEmpty(t, letter["error"])
+
+	// A command that takes too long is killed
+	script := filepath.Join(dir, "slow-hook")
+	err = ioutil.WriteFile(script, []byte("#!/bin/sh\nexec sleep 10\n"), 0755)
+	if !assert.NoError(t, err) {
+		return
+	}
+	start := time.Now()
+	err = callLifecycleHook(config.LifecycleHook{Command: script}, ev, 50*time.Millisecond)
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
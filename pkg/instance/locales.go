@@ -0,0 +1,140 @@
+package instance
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cozy/cozy-stack/pkg/config"
+)
+
+// maxPOSize is the maximal size of a .po file downloaded from the
+// translations service
+const maxPOSize = 2 << 20
+
+var localesClient = &http.Client{
+	Timeout: 30 * time.Second,
+}
+
+// LoadCachedLocales loads the .po files that have been downloaded from the
+// translations service, and cached on the disk, for the given locales. They
+// override the ones embedded in the binary. The locales without cached .po
+// file are skipped.
+func LoadCachedLocales(locales []string) {
+	conf := config.GetConfig().I18n
+	if conf.URL == "" || conf.CacheDir == "" {
+		return
+	}
+	for _, locale := range locales {
+		po, err := ioutil.ReadFile(cachedPOPath(conf, locale))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Warnf("[i18n] Could not read the cached po file for %s: %s", locale, err)
+			}
+			continue
+		}
+		LoadLocale(locale, string(po))
+	}
+}
+
+// DownloadLocales downloads the .po files of the given locales from the
+// translations service, caches them on the disk, and loads them. When the
+// service is not reachable, the translations already loaded are kept.
+func DownloadLocales(locales []string) error {
+	conf := config.GetConfig().I18n
+	if conf.URL == "" {
+		return nil
+	}
+	var errm error
+	for _, locale := range locales {
+		po, err := downloadPO(conf, locale)
+		if err != nil {
+			errm = fmt.Errorf("Could not download the po file for %s: %s", locale, err)
+			continue
+		}
+		if conf.CacheDir != "" {
+			if err = cachePO(conf, locale, po); err != nil {
+				log.Warnf("[i18n] Could not cache the po file for %s: %s", locale, err)
+			}
+		}
+		LoadLocale(locale, string(po))
+	}
+	return errm
+}
+
+// StartLocalesDownload regularly downloads the .po files of the given locales
+// from the translations service, with the interval of the configuration.
+func StartLocalesDownload(locales []string) {
+	conf := config.GetConfig().I18n
+	if conf.URL == "" || conf.Interval <= 0 {
+		return
+	}
+	go func() {
+		if err := DownloadLocales(locales); err != nil {
+			log.Warnf("[i18n] %s", err)
+		}
+		for range time.Tick(conf.Interval) {
+			if err := DownloadLocales(locales); err != nil {
+				log.Warnf("[i18n] %s", err)
+			}
+		}
+	}()
+}
+
+// downloadPO fetches a .po file with the Transifex API:
+// GET <project>/resource/<resource>/translation/<locale>/?file
+func downloadPO(conf config.I18n, locale string) ([]byte, error) {
+	u := conf.URL + "/resource/" + conf.Resource + "/translation/" + locale + "/?file"
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Token != "" {
+		req.SetBasicAuth("api", conf.Token)
+	}
+	res, err := localesClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Bad status code %d", res.StatusCode)
+	}
+	po, err := ioutil.ReadAll(&io.LimitedReader{R: res.Body, N: maxPOSize + 1})
+	if err != nil {
+		return nil, err
+	}
+	if len(po) > maxPOSize {
+		return nil, errors.New("The po file is too large")
+	}
+	// An empty response or an HTML error page are not valid po files
+	if !bytes.Contains(po, []byte("msgid")) {
+		return nil, errors.New("Invalid po file")
+	}
+	return po, nil
+}
+
+// cachePO writes the .po file in the cache directory. It is written in a
+// temporary file first, so that a crash can't leave a truncated file.
+func cachePO(conf config.I18n, locale string, po []byte) error {
+	if err := os.MkdirAll(conf.CacheDir, 0755); err != nil {
+		return err
+	}
+	filename := cachedPOPath(conf, locale)
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, po, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+func cachedPOPath(conf config.I18n, locale string) string {
+	return path.Join(conf.CacheDir, conf.Resource+"-"+locale+".po")
+}
@@ -0,0 +1,67 @@
+package instance
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadLocales(t *testing.T) {
+	var po string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ := r.BasicAuth()
+		if r.URL.Path != "/project/resource/stack/translation/eo/" || r.URL.RawQuery != "file" ||
+			user != "api" || pass != "secret" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if po == "" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(po))
+	}))
+	defer ts.Close()
+
+	tempdir, err := ioutil.TempDir("", "cozy-locales")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tempdir)
+
+	cfg := config.GetConfig()
+	was := cfg.I18n
+	defer func() { cfg.I18n = was }()
+	cfg.I18n = config.I18n{
+		URL:      ts.URL + "/project",
+		Token:    "secret",
+		Resource: "stack",
+		CacheDir: tempdir,
+	}
+
+	eo := Instance{Locale: "eo"}
+	po = `
+msgid "hello %s"
+msgstr "saluton %s"
+`
+	assert.NoError(t, DownloadLocales([]string{"eo"}))
+	assert.Equal(t, "saluton toto", eo.Translate("hello %s", "toto"))
+	cached, err := ioutil.ReadFile(tempdir + "/stack-eo.po")
+	assert.NoError(t, err)
+	assert.Equal(t, po, string(cached))
+
+	// The translations are kept when the service is not reachable
+	po = ""
+	assert.Error(t, DownloadLocales([]string{"eo"}))
+	assert.Equal(t, "saluton toto", eo.Translate("hello %s", "toto"))
+
+	LoadLocale("eo", "")
+	assert.Equal(t, "hello toto", eo.Translate("hello %s", "toto"))
+	LoadCachedLocales([]string{"eo"})
+	assert.Equal(t, "saluton toto", eo.Translate("hello %s", "toto"))
+}
@@ -0,0 +1,91 @@
+package instance
+
+import (
+	"errors"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+)
+
+// ErrTokenWithoutID is returned by RevokeToken for the tokens issued before
+// they had a jti: they can only be revoked by rotating the secrets.
+var ErrTokenWithoutID = errors.New("Token without id, it can't be revoked")
+
+// ErrTooManyRevokedTokens is returned by RevokeToken when the revocation list
+// is full: the secrets must be rotated instead.
+var ErrTooManyRevokedTokens = errors.New("Too many revoked tokens, the secrets must be rotated")
+
+// MaxRevokedTokens is the maximal number of tokens in the revocation list of
+// an instance
+const MaxRevokedTokens = 1000
+
+// NewTokenID returns a random id for the jti claim of a new token
+func NewTokenID() string {
+	return string(crypto.Base64Encode(crypto.GenerateRandomBytes(8)))
+}
+
+// revokedUntil returns the unix time after which a revoked token would be
+// refused anyway, as it has expired. The tokens that don't expire are refused
+// after the grace period of the rotation of the secrets used to sign them: if
+// the secrets have not been rotated since the token was issued, it returns 0,
+// and the time is set by the next rotation.
+func (i *Instance) revokedUntil(claims *permissions.Claims) int64 {
+	var validity time.Duration
+	switch claims.Audience {
+	case permissions.ShareAudience, permissions.RefreshTokenAudience,
+		permissions.RegistrationTokenAudience:
+		if i.SecretsRotatedAt != nil && claims.IssuedAtUTC().Before(*i.SecretsRotatedAt) {
+			return i.SecretsRotatedAt.Add(SecretsGracePeriod).Unix()
+		}
+		return 0
+	case permissions.DownloadAudience:
+		validity = permissions.DownloadTokenValidityDuration
+	case permissions.UnlockedShareAudience:
+		validity = permissions.UnlockedShareTokenValidityDuration
+	default:
+		validity = permissions.TokenValidityDuration
+	}
+	return claims.IssuedAtUTC().Add(validity).Unix()
+}
+
+// IsRevoked returns true if the token with the given jti has been revoked
+func (i *Instance) IsRevoked(jti string) bool {
+	if jti == "" {
+		return false
+	}
+	_, ok := i.RevokedTokens[jti]
+	return ok
+}
+
+// RevokeToken adds the jti of a token to the revocation list of the
+// instance, so that it is refused even if its signature is still valid. The
+// tokens of the list that have expired since their revocation are removed
+// from it, to keep it small, and the list can't have more than
+// MaxRevokedTokens tokens.
+func (i *Instance) RevokeToken(token string) error {
+	var claims permissions.Claims
+	if err := i.ParseJWT(token, &claims); err != nil {
+		return err
+	}
+	if claims.Id == "" {
+		return ErrTokenWithoutID
+	}
+	return couchdb.UpdateDocWithRetry(couchdb.GlobalDB, i, func(couchdb.Doc) error {
+		now := time.Now().Unix()
+		for jti, u := range i.RevokedTokens {
+			if u != 0 && u < now {
+				delete(i.RevokedTokens, jti)
+			}
+		}
+		if i.RevokedTokens == nil {
+			i.RevokedTokens = make(map[string]int64)
+		}
+		if _, ok := i.RevokedTokens[claims.Id]; !ok && len(i.RevokedTokens) >= MaxRevokedTokens {
+			return ErrTooManyRevokedTokens
+		}
+		i.RevokedTokens[claims.Id] = i.revokedUntil(&claims)
+		return nil
+	})
+}
@@ -0,0 +1,196 @@
+package instance
+
+import (
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cozy/cozy-stack/pkg/apps"
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	"github.com/cozy/cozy-stack/pkg/realtime"
+)
+
+const (
+	// DefaultSearchLimit is the number of instances returned by a search
+	DefaultSearchLimit = 100
+	// MaxSearchLimit is the maximal number of instances returned by a search
+	MaxSearchLimit = 1000
+)
+
+// SearchOptions are the criteria of a search of instances. The empty criteria
+// are ignored, and the instances must match all the others.
+type SearchOptions struct {
+	// EmailDomain is the domain of the email of the owner, like example.com
+	EmailDomain string
+	Locale      string
+	// Context is the name of the context of the instances. The default
+	// context also matches the instances created without context.
+	Context string
+	// App is the slug of an application installed on the instances
+	App   string
+	Limit int
+	Skip  int
+}
+
+// Search returns the instances matching the given criteria. It is a query on
+// the documents of the instances, in the global database, so that the
+// hosters can find the instances without looking in their databases.
+func Search(opts *SearchOptions) ([]*Instance, error) {
+	var filters []mango.Filter
+	if opts.EmailDomain != "" {
+		filters = append(filters, mango.Equal("email_domain", strings.ToLower(opts.EmailDomain)))
+	}
+	if opts.Locale != "" {
+		filters = append(filters, mango.Equal("locale", opts.Locale))
+	}
+	if opts.Context == config.DefaultContext {
+		filters = append(filters, mango.Or(
+			mango.Equal("context", opts.Context),
+			mango.Map{"context": mango.Map{"$exists": false}},
+		))
+	} else if opts.Context != "" {
+		filters = append(filters, mango.Equal("context", opts.Context))
+	}
+	if opts.App != "" {
+		filters = append(filters, mango.Map{"apps": mango.Map{"$elemMatch": mango.Map{"$eq": opts.App}}})
+	}
+
+	var selector mango.Filter
+	switch len(filters) {
+	case 0:
+		selector = mango.Gt("domain", "")
+	case 1:
+		selector = filters[0]
+	default:
+		selector = mango.And(filters...)
+	}
+	limit := opts.Limit
+	if limit <= 0 || limit > MaxSearchLimit {
+		limit = DefaultSearchLimit
+	}
+
+	var instances []*Instance
+	req := &couchdb.FindRequest{
+		Selector: selector,
+		Limit:    limit,
+		Skip:     opts.Skip,
+	}
+	err := couchdb.FindDocs(couchdb.GlobalDB, consts.Instances, req, &instances)
+	if couchdb.IsNoDatabaseError(err) {
+		return []*Instance{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range instances {
+		i.migrateLegacyDev()
+	}
+	return instances, nil
+}
+
+// SetEmail updates the domain of the email of the owner, kept in the document
+// of the instance for Search. It returns true if the domain has changed, and
+// the document must be saved.
+func (i *Instance) SetEmail(email string) bool {
+	domain := emailDomain(email)
+	if i.EmailDomain == domain {
+		return false
+	}
+	i.EmailDomain = domain
+	return true
+}
+
+// UpdateSearchAttributes copies the domain of the email of the owner, from
+// the settings, and the slugs of the installed applications in the document
+// of the instance, for Search. They are updated by the stack when they
+// change, so it is only needed for the instances created before.
+func (i *Instance) UpdateSearchAttributes() error {
+	settings := &instanceSettings{}
+	err := couchdb.GetDoc(i, consts.Settings, consts.InstanceSettingsID, settings)
+	if err != nil && !couchdb.IsNotFoundError(err) {
+		return err
+	}
+	slugs, err := installedApps(i)
+	if err != nil {
+		return err
+	}
+	for try := 0; try < maxUpdateTries; try++ {
+		changed := i.SetEmail(settings.Email)
+		if !equalStrings(i.Apps, slugs) {
+			i.Apps = slugs
+			changed = true
+		}
+		if !changed {
+			return nil
+		}
+		err = couchdb.UpdateDoc(couchdb.GlobalDB, i)
+		if !couchdb.IsConflictError(err) {
+			return err
+		}
+		if rerr := i.reload(); rerr != nil {
+			return rerr
+		}
+	}
+	return err
+}
+
+// WatchApps keeps the slugs of the installed applications up-to-date in the
+// documents of the instances, for Search. It listens to the installations and
+// uninstallations of the applications on all the instances, and is meant to
+// be started once by the server.
+func WatchApps() {
+	sub := realtime.MainHub().Subscribe(consts.Apps)
+	go func() {
+		for e := range sub.Read() {
+			if e.Type != realtime.EventCreate && e.Type != realtime.EventDelete {
+				continue
+			}
+			i, err := Get(e.Instance)
+			if err != nil {
+				continue
+			}
+			if err = i.UpdateSearchAttributes(); err != nil {
+				log.Warnf("[instance] Could not update the search attributes of %s: %s", i.Domain, err)
+			}
+		}
+	}()
+}
+
+func installedApps(i *Instance) ([]string, error) {
+	mans, err := apps.List(i)
+	if couchdb.IsNoDatabaseError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var slugs []string
+	for _, man := range mans {
+		slugs = append(slugs, man.Slug)
+	}
+	sort.Strings(slugs)
+	return slugs, nil
+}
+
+func emailDomain(email string) string {
+	idx := strings.LastIndex(email, "@")
+	if idx < 0 {
+		return ""
+	}
+	return strings.ToLower(email[idx+1:])
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k := range a {
+		if a[k] != b[k] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,111 @@
+package instance
+
+import (
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	jwt "gopkg.in/dgrijalva/jwt-go.v3"
+)
+
+// SecretsGracePeriod is the duration after a rotation of the secrets where
+// the tokens and the session cookies signed with the previous secrets are
+// still accepted. It is the validity of the tokens of the applications, so
+// that they can expire normally.
+var SecretsGracePeriod = 7 * 24 * time.Hour
+
+// RotateSecrets generates new session and OAuth secrets for the instance. The
+// new tokens are signed with them, but the previous secrets are kept to
+// validate the tokens and the cookies during SecretsGracePeriod. A new
+// rotation during this period discards the secrets of the previous one.
+func (i *Instance) RotateSecrets() error {
+	err := couchdb.UpdateDocWithRetry(couchdb.GlobalDB, i, func(couchdb.Doc) error {
+		i.PreviousSessionSecret = i.SessionSecret
+		i.PreviousOAuthSecret = i.OAuthSecret
+		i.SessionSecret = crypto.GenerateRandomBytes(sessionSecretLen)
+		i.OAuthSecret = crypto.GenerateRandomBytes(oauthSecretLen)
+		i.KeyGeneration++
+		now := time.Now().UTC()
+		i.SecretsRotatedAt = &now
+		// The revoked tokens that don't expire will be refused anyway
+		// after the grace period, as they are signed by the old secrets
+		until := now.Add(SecretsGracePeriod).Unix()
+		for jti, u := range i.RevokedTokens {
+			if u == 0 {
+				i.RevokedTokens[jti] = until
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		permissions.InvalidateCache(i.Domain)
+	}
+	return err
+}
+
+// inSecretsGracePeriod returns true if the previous secrets can still be used
+func (i *Instance) inSecretsGracePeriod() bool {
+	return i.SecretsRotatedAt != nil && time.Since(*i.SecretsRotatedAt) < SecretsGracePeriod
+}
+
+// PreviousSessionKey returns the session secret used before the last rotation,
+// or nil if there is none or if its grace period is over.
+func (i *Instance) PreviousSessionKey() []byte {
+	if !i.inSecretsGracePeriod() {
+		return nil
+	}
+	return i.PreviousSessionSecret
+}
+
+// pickPreviousKey is like PickKey, for the secrets used before the last
+// rotation. It returns nil if there is no such secret.
+func (i *Instance) pickPreviousKey(audience string) []byte {
+	if !i.inSecretsGracePeriod() {
+		return nil
+	}
+	switch audience {
+	case permissions.AppAudience, permissions.DownloadAudience,
+		permissions.UnlockedShareAudience:
+		return i.PreviousSessionSecret
+	case permissions.RefreshTokenAudience, permissions.AccessTokenAudience,
+		permissions.ShareAudience, permissions.RegistrationTokenAudience:
+		return i.PreviousOAuthSecret
+	}
+	return nil
+}
+
+// ParseJWT checks the signature of a token with the key of its audience, or
+// with the previous key during the grace period after a rotation of the
+// secrets, and fills the claims. The revoked tokens are refused, but the
+// other claims must still be checked by the caller (issuer, audience,
+// expiration, etc.)
+func (i *Instance) ParseJWT(token string, claims *permissions.Claims) error {
+	if err := i.checkJWTSignature(token, claims); err != nil {
+		return err
+	}
+	if i.IsRevoked(claims.Id) {
+		return permissions.ErrRevokedToken
+	}
+	return nil
+}
+
+func (i *Instance) checkJWTSignature(token string, claims *permissions.Claims) error {
+	err := crypto.ParseJWT(token, func(t *jwt.Token) (interface{}, error) {
+		return i.PickKey(t.Claims.(*permissions.Claims).Audience)
+	}, claims)
+	if err == nil || !i.inSecretsGracePeriod() {
+		return err
+	}
+	errPrevious := crypto.ParseJWT(token, func(t *jwt.Token) (interface{}, error) {
+		key := i.pickPreviousKey(t.Claims.(*permissions.Claims).Audience)
+		if key == nil {
+			return nil, permissions.ErrInvalidAudience
+		}
+		return key, nil
+	}, claims)
+	if errPrevious != nil {
+		return err
+	}
+	return nil
+}
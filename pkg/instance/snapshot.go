@@ -0,0 +1,228 @@
+package instance
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/spf13/afero"
+)
+
+var (
+	// ErrSnapshotNotFound is used when no snapshot of the instance has the
+	// given identifier
+	ErrSnapshotNotFound = errors.New("Snapshot not found")
+	// ErrSnapshotsDisabled is used when a snapshot is taken on a production
+	// release of the stack
+	ErrSnapshotsDisabled = errors.New("Snapshots are only available on a development release")
+	// ErrSnapshotTooLarge is used when a snapshot would make the snapshots
+	// kept in memory larger than SnapshotsMaxSize
+	ErrSnapshotTooLarge = errors.New("The snapshot is too large")
+)
+
+// snapshotIDLen is the length of the identifiers of the snapshots
+const snapshotIDLen = 16
+
+// SnapshotsMaxSize is the maximal size, in bytes, of the documents and files
+// of all the snapshots kept in memory.
+var SnapshotsMaxSize int64 = 512 << 20
+
+// A snapshot is a copy of the document, the databases and the files of an
+// instance at a given time. The snapshots are kept in memory, and are meant
+// to reset an instance between the test cases of an integration test suite,
+// without recreating it, and are only available on a development release.
+type snapshot struct {
+	domain string
+	doc    Instance
+	dbs    map[string][]json.RawMessage
+	files  []*snapshotFile
+	size   int64
+}
+
+type snapshotFile struct {
+	name    string
+	mode    os.FileMode
+	modTime time.Time
+	content []byte
+}
+
+var (
+	snapshotsMu   sync.Mutex
+	snapshots     = make(map[string]*snapshot)
+	snapshotsSize int64
+)
+
+// Snapshot copies the document, the databases and the files of the instance,
+// and returns the identifier of the snapshot, to be used with Restore.
+func (i *Instance) Snapshot() (string, error) {
+	if !config.IsDevRelease() {
+		return "", ErrSnapshotsDisabled
+	}
+	s := &snapshot{
+		domain: i.Domain,
+		doc:    *i,
+		dbs:    make(map[string][]json.RawMessage),
+	}
+	s.doc.storage = nil
+
+	doctypes, err := couchdb.AllDoctypes(i)
+	if err != nil {
+		return "", err
+	}
+	for _, doctype := range doctypes {
+		docs, err := couchdb.DumpDB(i, doctype)
+		if err != nil {
+			return "", err
+		}
+		s.dbs[doctype] = docs
+		for _, doc := range docs {
+			s.size += int64(len(doc))
+		}
+		if s.size > SnapshotsMaxSize {
+			return "", ErrSnapshotTooLarge
+		}
+	}
+
+	if s.files, err = snapshotFs(i.FS(), SnapshotsMaxSize-s.size); err != nil {
+		return "", err
+	}
+	for _, file := range s.files {
+		s.size += int64(len(file.content))
+	}
+
+	id := utils.RandomString(snapshotIDLen)
+	snapshotsMu.Lock()
+	defer snapshotsMu.Unlock()
+	if snapshotsSize+s.size > SnapshotsMaxSize {
+		return "", ErrSnapshotTooLarge
+	}
+	snapshots[id] = s
+	snapshotsSize += s.size
+	return id, nil
+}
+
+// Restore puts the instance back in the state of the snapshot with the given
+// identifier: the databases and the files created since the snapshot are
+// removed, and the others are reverted to their content of the snapshot. The
+// snapshot is kept and can be restored again.
+func (i *Instance) Restore(id string) error {
+	snapshotsMu.Lock()
+	s, ok := snapshots[id]
+	snapshotsMu.Unlock()
+	if !ok || s.domain != i.Domain {
+		return ErrSnapshotNotFound
+	}
+
+	if err := couchdb.DeleteAllDBs(i); err != nil {
+		return err
+	}
+	for doctype, docs := range s.dbs {
+		if err := couchdb.LoadDB(i, doctype, docs); err != nil {
+			return err
+		}
+	}
+
+	if err := restoreFs(i.FS(), s.files); err != nil {
+		return err
+	}
+
+	storage := i.storage
+	*i = s.doc
+	i.storage = storage
+	rev, err := currentRev(i.Domain)
+	if err != nil {
+		return err
+	}
+	i.SetRev(rev)
+	return couchdb.UpdateDoc(couchdb.GlobalDB, i)
+}
+
+// DeleteSnapshot removes the snapshot of the instance with the given domain
+// and identifier, to free the memory used by its copy of the instance.
+func DeleteSnapshot(domain, id string) error {
+	snapshotsMu.Lock()
+	defer snapshotsMu.Unlock()
+	s, ok := snapshots[id]
+	if !ok || s.domain != domain {
+		return ErrSnapshotNotFound
+	}
+	delete(snapshots, id)
+	snapshotsSize -= s.size
+	return nil
+}
+
+// currentRev returns the current revision of the document of an instance
+func currentRev(domain string) (string, error) {
+	i, err := Get(domain)
+	if err != nil {
+		return "", err
+	}
+	return i.Rev(), nil
+}
+
+// snapshotFs copies all the directories and files of the storage in memory,
+// up to maxSize bytes of content.
+func snapshotFs(fs afero.Fs, maxSize int64) ([]*snapshotFile, error) {
+	var files []*snapshotFile
+	var size int64
+	err := afero.Walk(fs, "/", func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && name == "/" {
+				return nil
+			}
+			return err
+		}
+		file := &snapshotFile{
+			name:    name,
+			mode:    info.Mode(),
+			modTime: info.ModTime(),
+		}
+		if !info.IsDir() {
+			if size += info.Size(); size > maxSize {
+				return ErrSnapshotTooLarge
+			}
+			if file.content, err = afero.ReadFile(fs, name); err != nil {
+				return err
+			}
+		}
+		files = append(files, file)
+		return nil
+	})
+	return files, err
+}
+
+// restoreFs removes the content of the storage, and recreates the directories
+// and files of the snapshot. afero.Walk is in lexical order, so a directory
+// is always recreated before its content.
+func restoreFs(fs afero.Fs, files []*snapshotFile) error {
+	entries, err := afero.ReadDir(fs, "/")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, entry := range entries {
+		if err = fs.RemoveAll(path.Join("/", entry.Name())); err != nil {
+			return err
+		}
+	}
+	for _, file := range files {
+		if file.mode.IsDir() {
+			if err = fs.MkdirAll(file.name, file.mode.Perm()); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = afero.WriteFile(fs, file.name, file.content, file.mode.Perm()); err != nil {
+			return err
+		}
+		if err = fs.Chtimes(file.name, file.modTime, file.modTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
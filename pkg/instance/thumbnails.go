@@ -0,0 +1,67 @@
+package instance
+
+import (
+	"context"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// ThumbnailsWorkerType is the type of the worker that generates the
+// thumbnails of the images
+const ThumbnailsWorkerType = "thumbnails"
+
+func init() {
+	jobs.AddWorker(ThumbnailsWorkerType, &jobs.WorkerConfig{
+		Concurrency:  2,
+		MaxExecCount: 1,
+		Timeout:      5 * time.Minute,
+		WorkerFunc:   thumbnailsWorker,
+	})
+}
+
+// ThumbnailsOptions are the options of the thumbnails worker: the file of
+// the image
+type ThumbnailsOptions struct {
+	FileID string `json:"file_id"`
+}
+
+func thumbnailsWorker(ctx context.Context, m *jobs.Message) error {
+	opts := &ThumbnailsOptions{}
+	if err := m.Unmarshal(&opts); err != nil {
+		return err
+	}
+	domain := ctx.Value(jobs.ContextDomainKey).(string)
+	i, err := Get(domain)
+	if err != nil {
+		return err
+	}
+	doc, err := vfs.GetFileDoc(i, opts.FileID)
+	if err != nil {
+		return err
+	}
+	// the file may have been replaced by another kind of file since the job
+	// has been pushed
+	if !vfs.CanHaveThumbnails(doc) {
+		return nil
+	}
+	return vfs.GenerateThumbnails(i, doc)
+}
+
+// PushThumbnailsJob pushes a job to generate the thumbnails of an image. It
+// does nothing for the other files.
+func (i *Instance) PushThumbnailsJob(doc *vfs.FileDoc) error {
+	if !vfs.CanHaveThumbnails(doc) {
+		return nil
+	}
+	msg, err := jobs.NewMessage(jobs.JSONEncoding, &ThumbnailsOptions{FileID: doc.ID()})
+	if err != nil {
+		return err
+	}
+	_, _, err = i.JobsBroker().PushJob(&jobs.JobRequest{
+		WorkerType: ThumbnailsWorkerType,
+		Message:    msg,
+	})
+	return err
+}
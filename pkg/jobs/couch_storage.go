@@ -35,9 +35,15 @@ func NewTriggerCouchStorage(db couchdb.Database) *CouchStorage {
 // GetAll implements the GetAll method of the TriggerStorage.
 func (s *CouchStorage) GetAll() ([]*TriggerInfos, error) {
 	var infos []*TriggerInfos
-	// TODO(pagination): use a sort of couchdb.WalkDocs function when available.
-	req := &couchdb.AllDocsRequest{Limit: 100}
-	if err := couchdb.GetAllDocs(s.db, consts.Triggers, req, &infos); err != nil {
+	err := couchdb.ForeachDoc(s.db, consts.Triggers, func(doc json.RawMessage) error {
+		var info TriggerInfos
+		if err := json.Unmarshal(doc, &info); err != nil {
+			return err
+		}
+		infos = append(infos, &info)
+		return nil
+	})
+	if err != nil {
 		if couchdb.IsNoDatabaseError(err) {
 			return infos, nil
 		}
@@ -51,7 +57,9 @@ func (s *CouchStorage) Add(trigger Trigger) error {
 	return couchdb.CreateDoc(s.db, &triggerDoc{trigger})
 }
 
-// Delete implements the Delete method of the TriggerStorage.
+// Delete implements the Delete method of the TriggerStorage. The deletion is
+// queued if CouchDB is unavailable, so that a trigger that has fired is not
+// scheduled again.
 func (s *CouchStorage) Delete(trigger Trigger) error {
-	return couchdb.DeleteDoc(s.db, &triggerDoc{trigger})
+	return couchdb.DeleteDocOrQueue(s.db, &triggerDoc{trigger})
 }
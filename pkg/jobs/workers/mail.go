@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"mime"
 	"time"
 
 	"github.com/cozy/cozy-stack/pkg/config"
@@ -55,6 +56,7 @@ type MailOptions struct {
 	Parts          []*MailPart           `json:"parts"`
 	TemplateName   string                `json:"template_name"`
 	TemplateValues interface{}           `json:"template_values"`
+	Locale         string                `json:"locale,omitempty"`
 }
 
 // MailPart represent a part of the content of the mail. It has a type
@@ -94,9 +96,12 @@ func SendMail(ctx context.Context, m *jobs.Message) error {
 
 func addressFromDomain(domain string) (*MailAddress, error) {
 	// TODO: cleanup this settings fetching
-	db := couchdb.SimpleDatabasePrefix(domain)
+	db, err := couchdb.DatabaseOf(domain)
+	if err != nil {
+		return nil, err
+	}
 	doc := &couchdb.JSONDoc{}
-	err := couchdb.GetDoc(db, consts.Settings, consts.InstanceSettingsID, doc)
+	err = couchdb.GetDoc(db, consts.Settings, consts.InstanceSettingsID, doc)
 	if err != nil {
 		return nil, err
 	}
@@ -146,7 +151,7 @@ func doSendMail(ctx context.Context, opts *MailOptions) error {
 	var parts []*MailPart
 	var err error
 	if opts.TemplateName != "" {
-		parts, err = mailTemplater.Execute(opts.TemplateName, opts.TemplateValues)
+		parts, err = mailTemplater.Execute(opts.TemplateName, opts.Locale, opts.TemplateValues)
 		if err != nil {
 			return err
 		}
@@ -167,9 +172,17 @@ func doSendMail(ctx context.Context, opts *MailOptions) error {
 
 func addPart(mail *gomail.Message, part *MailPart) error {
 	contentType := part.Type
-	if contentType != "text/plain" && contentType != "text/html" {
+	if contentType != "text/plain" && contentType != "text/html" && !isCalendarPart(contentType) {
 		return fmt.Errorf("Unknown body content-type %s", contentType)
 	}
 	mail.AddAlternative(contentType, part.Body)
 	return nil
 }
+
+// isCalendarPart returns true for the text/calendar parts, used for the
+// invitations (iMIP). The content-type can have a method parameter, like
+// "text/calendar; method=REQUEST".
+func isCalendarPart(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == "text/calendar"
+}
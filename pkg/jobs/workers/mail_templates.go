@@ -4,6 +4,8 @@ import (
 	"bytes"
 	htmlTemplate "html/template"
 	textTemplate "text/template"
+
+	"github.com/cozy/cozy-stack/pkg/i18n"
 )
 
 const (
@@ -66,8 +68,9 @@ func newMailTemplater(tmpls []*MailTemplate) *MailTemplater {
 	for i, t := range tmpls {
 		name := t.Name
 		if i == 0 {
-			tmpthtml = htmlTemplate.New(name)
-			tmpttext = textTemplate.New(name)
+			funcs := i18n.Get(i18n.DefaultLocale).TemplateFuncs()
+			tmpthtml = htmlTemplate.New(name).Funcs(funcs)
+			tmpttext = textTemplate.New(name).Funcs(funcs)
 			thtml = tmpthtml
 			ttext = tmpttext
 		} else {
@@ -84,15 +87,33 @@ func newMailTemplater(tmpls []*MailTemplate) *MailTemplater {
 }
 
 // Execute will execute the HTML and text temlates for the template with the
-// specified name. It returns the mail parts that should be added to the sent
-// mail.
-func (m *MailTemplater) Execute(name string, data interface{}) ([]*MailPart, error) {
+// specified name. The dates and numbers are formatted for the given locale,
+// and the HTML part is written from right to left for the RTL locales. It
+// returns the mail parts that should be added to the sent mail.
+func (m *MailTemplater) Execute(name, locale string, data interface{}) ([]*MailPart, error) {
+	l := i18n.Get(locale)
+	funcs := l.TemplateFuncs()
+	thtml, err := m.thtml.Clone()
+	if err != nil {
+		return nil, err
+	}
+	ttext, err := m.ttext.Clone()
+	if err != nil {
+		return nil, err
+	}
+
 	bhtml := new(bytes.Buffer)
 	btext := new(bytes.Buffer)
-	if err := m.thtml.ExecuteTemplate(bhtml, name, data); err != nil {
+	if l.IsRTL() {
+		bhtml.WriteString(`<div dir="rtl">`)
+	}
+	if err = thtml.Funcs(funcs).ExecuteTemplate(bhtml, name, data); err != nil {
 		return nil, err
 	}
-	if err := m.ttext.ExecuteTemplate(btext, name, data); err != nil {
+	if l.IsRTL() {
+		bhtml.WriteString(`</div>`)
+	}
+	if err = ttext.Funcs(funcs).ExecuteTemplate(btext, name, data); err != nil {
 		return nil, err
 	}
 	return []*MailPart{
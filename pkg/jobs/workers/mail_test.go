@@ -168,6 +168,13 @@ func TestMailBadBodyType(t *testing.T) {
 	}
 }
 
+func TestMailCalendarPart(t *testing.T) {
+	assert.True(t, isCalendarPart("text/calendar"))
+	assert.True(t, isCalendarPart("text/calendar; method=REQUEST"))
+	assert.False(t, isCalendarPart("text/plain"))
+	assert.False(t, isCalendarPart("text/calendar; method"))
+}
+
 func TestMailMultiParts(t *testing.T) {
 	clientString := `EHLO localhost
 HELO localhost
@@ -358,6 +365,38 @@ func mailServer(t *testing.T, serverString, clientString string, expectedHeader
 	assert.EqualValues(t, expectedHeader, headers)
 }
 
+func TestMailTemplaterLocale(t *testing.T) {
+	templater := newMailTemplater([]*MailTemplate{
+		{
+			Name:     "locale",
+			BodyHTML: `<p>{{date .Date}} {{number .Size 1}}</p>`,
+			BodyText: `{{date .Date}} {{number .Size 1}}`,
+		},
+	})
+	data := struct {
+		Date time.Time
+		Size float64
+	}{
+		Date: time.Date(2017, time.March, 9, 14, 5, 0, 0, time.UTC),
+		Size: 1234.5,
+	}
+
+	parts, err := templater.Execute("locale", "fr", data)
+	assert.NoError(t, err)
+	assert.Len(t, parts, 2)
+	assert.Equal(t, "09/03/2017 1\u00a0234,5", parts[0].Body)
+	assert.Equal(t, "<p>09/03/2017 1\u00a0234,5</p>", parts[1].Body)
+
+	parts, err = templater.Execute("locale", "he", data)
+	assert.NoError(t, err)
+	assert.Equal(t, "09.03.2017 1,234.5", parts[0].Body)
+	assert.Equal(t, `<div dir="rtl"><p>09.03.2017 1,234.5</p></div>`, parts[1].Body)
+
+	parts, err = templater.Execute("locale", "", data)
+	assert.NoError(t, err)
+	assert.Equal(t, "03/09/2017 1,234.5", parts[0].Body)
+}
+
 func TestSendMailNoReply(t *testing.T) {
 	sendMail = func(ctx context.Context, opts *MailOptions) error {
 		assert.NotNil(t, opts.From)
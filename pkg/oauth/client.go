@@ -88,17 +88,38 @@ func (c *Client) TransformIDAndRev() {
 	c.CouchRev = ""
 }
 
-// GetAll loads all the clients from the database, without the secrets
+const (
+	// DefaultListLimit is the number of clients in a page of the list
+	DefaultListLimit = 100
+	// MaxListLimit is the maximal number of clients in a page of the list
+	MaxListLimit = 1000
+)
+
+// GetAll loads the first clients from the database, without the secrets.
+// GetAllPage can be used to paginate them.
 func GetAll(i *instance.Instance) ([]*Client, error) {
+	clients, _, err := GetAllPage(i, "", DefaultListLimit)
+	return clients, err
+}
+
+// GetAllPage loads a page of the clients from the database, sorted by their
+// identifiers, without the secrets. The cursor is the identifier of the first
+// client of the page, and the cursor of the next page is returned, or an
+// empty string for the last page.
+func GetAllPage(i *instance.Instance, cursor string, limit int) ([]*Client, string, error) {
+	if limit <= 0 || limit > MaxListLimit {
+		limit = DefaultListLimit
+	}
 	var clients []*Client
-	req := &couchdb.AllDocsRequest{Limit: 100}
-	if err := couchdb.GetAllDocs(i, consts.OAuthClients, req, &clients); err != nil {
-		return nil, err
+	req := &couchdb.AllDocsRequest{StartKey: cursor, Limit: limit}
+	next, err := couchdb.GetAllDocsPage(i, consts.OAuthClients, req, &clients)
+	if err != nil {
+		return nil, "", err
 	}
 	for _, client := range clients {
 		client.ClientSecret = ""
 	}
-	return clients, nil
+	return clients, next, nil
 }
 
 // FindClient loads a client from the database
@@ -255,6 +276,8 @@ func (c *Client) Delete(i *instance.Instance) *ClientRegistrationError {
 			Error: "internal_server_error",
 		}
 	}
+	// the tokens of the client must no longer be accepted
+	permissions.InvalidateCache(i.Domain)
 	return nil
 }
 
@@ -277,6 +300,7 @@ func (c *Client) CreateJWT(i *instance.Instance, audience, scope string) (string
 			Issuer:   i.Domain,
 			IssuedAt: crypto.Timestamp(),
 			Subject:  c.CouchID,
+			Id:       instance.NewTokenID(),
 		},
 		Scope: scope,
 	})
@@ -294,10 +318,7 @@ func (c *Client) ValidToken(i *instance.Instance, audience, token string) (permi
 	if token == "" {
 		return claims, false
 	}
-	keyFunc := func(token *jwt.Token) (interface{}, error) {
-		return i.OAuthSecret, nil
-	}
-	if err := crypto.ParseJWT(token, keyFunc, &claims); err != nil {
+	if err := i.ParseJWT(token, &claims); err != nil {
 		log.Errorf("[oauth] Failed to verify the %s token: %s", audience, err)
 		return claims, false
 	}
@@ -0,0 +1,129 @@
+package permissions
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// The permission docs are also kept in the cache of the couchdb package, if
+// it is enabled, for the requests with a token that is not in this cache.
+func init() {
+	couchdb.CacheDoctypes(consts.Permissions)
+}
+
+// CacheTTL is the duration for which the permission doc of a token is kept
+// in memory. The cache is local to the process: the changes made by another
+// stack are only seen when the entry expires.
+var CacheTTL = time.Minute
+
+// cacheMaxEntries is the maximal number of tokens cached for an instance
+const cacheMaxEntries = 1000
+
+type cacheEntry struct {
+	pdoc       *Permission
+	generation int
+	expiresAt  time.Time
+}
+
+// The permission docs of the tokens are cached by instance, and the key is
+// the signature of the token, to avoid parsing the scope and fetching the
+// doc from CouchDB on every request.
+var (
+	cacheMu      sync.Mutex
+	cacheEntries = make(map[string]map[string]*cacheEntry)
+)
+
+// tokenSignature returns the signature part of a JWT
+func tokenSignature(token string) string {
+	if pos := strings.LastIndexByte(token, '.'); pos >= 0 {
+		return token[pos+1:]
+	}
+	return token
+}
+
+// GetCached returns the permission doc cached for a token of the given
+// instance, if any, and if it has been cached with the same generation of the
+// signing keys of the instance. The caller must not modify it, and must still
+// check the signature and the claims of the token.
+func GetCached(domain, token string, generation int) (*Permission, bool) {
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	entries, ok := cacheEntries[domain]
+	if !ok {
+		return nil, false
+	}
+	key := tokenSignature(token)
+	entry, ok := entries[key]
+	if !ok {
+		return nil, false
+	}
+	if entry.generation != generation || time.Now().After(entry.expiresAt) {
+		delete(entries, key)
+		return nil, false
+	}
+	return entry.pdoc, true
+}
+
+// PutCached keeps the permission doc of a token in the cache of the given
+// instance, for CacheTTL at most, and never after the expiration of the
+// token or of the codes of the permission doc. The generation is the one of
+// the keys that have signed the token.
+func PutCached(domain, token string, generation int, pdoc *Permission, claims *Claims) {
+	now := time.Now()
+	expiresAt := now.Add(CacheTTL)
+	if claims.ExpiresAt != 0 {
+		if exp := time.Unix(claims.ExpiresAt, 0); exp.Before(expiresAt) {
+			expiresAt = exp
+		}
+	}
+	if pdoc.ExpiresAt != 0 {
+		if exp := time.Unix(int64(pdoc.ExpiresAt), 0); exp.Before(expiresAt) {
+			expiresAt = exp
+		}
+	}
+	if !expiresAt.After(now) {
+		return
+	}
+
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	entries, ok := cacheEntries[domain]
+	if !ok {
+		entries = make(map[string]*cacheEntry)
+		cacheEntries[domain] = entries
+	}
+	if len(entries) >= cacheMaxEntries {
+		for key, entry := range entries {
+			if now.After(entry.expiresAt) {
+				delete(entries, key)
+			}
+		}
+		if len(entries) >= cacheMaxEntries {
+			entries = make(map[string]*cacheEntry)
+			cacheEntries[domain] = entries
+		}
+	}
+	entries[tokenSignature(token)] = &cacheEntry{
+		pdoc:       pdoc,
+		generation: generation,
+		expiresAt:  expiresAt,
+	}
+}
+
+// InvalidateCache removes the cached permission docs of an instance. It is
+// called when a permission set, an OAuth client or the instance itself has
+// changed.
+func InvalidateCache(domain string) {
+	cacheMu.Lock()
+	delete(cacheEntries, domain)
+	cacheMu.Unlock()
+}
+
+// invalidateCacheOf is InvalidateCache for the instance of a database
+func invalidateCacheOf(db couchdb.Database) {
+	InvalidateCache(strings.TrimSuffix(db.Prefix(), "/"))
+}
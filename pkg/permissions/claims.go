@@ -25,11 +25,27 @@ const (
 
 	// RefreshTokenAudience is the audience field of JWT for refresh tokens
 	RefreshTokenAudience = "refresh"
+
+	// DownloadAudience is the audience field of JWT for the signed links to
+	// download a single file
+	DownloadAudience = "download"
+
+	// UnlockedShareAudience is the audience field of JWT for the tokens
+	// given in exchange of a share code and its password
+	UnlockedShareAudience = "unlocked-share"
 )
 
 // TokenValidityDuration is the duration where a token is valid in seconds (1 week)
 var TokenValidityDuration = 7 * 24 * time.Hour
 
+// DownloadTokenValidityDuration is the duration where a token for downloading
+// a file is valid (10 minutes)
+var DownloadTokenValidityDuration = 10 * time.Minute
+
+// UnlockedShareTokenValidityDuration is the duration where a token given in
+// exchange of a share code and its password is valid (1 day)
+var UnlockedShareTokenValidityDuration = 24 * time.Hour
+
 // Claims is used for JWT used in OAuth2 flow and applications token
 type Claims struct {
 	jwt.StandardClaims
@@ -42,8 +58,20 @@ func (claims *Claims) IssuedAtUTC() time.Time {
 	return time.Unix(claims.IssuedAt, 0).UTC()
 }
 
-// Expired returns true if a Claim is expired
+// Expired returns true if a Claim is expired. The share codes are not
+// concerned, their expiry depends on their permission doc (see
+// Permission.ExpiredForCode).
 func (claims *Claims) Expired() bool {
-	validUntil := claims.IssuedAtUTC().Add(TokenValidityDuration)
+	if claims.Audience == ShareAudience {
+		return false
+	}
+	validity := TokenValidityDuration
+	switch claims.Audience {
+	case DownloadAudience:
+		validity = DownloadTokenValidityDuration
+	case UnlockedShareAudience:
+		validity = UnlockedShareTokenValidityDuration
+	}
+	validUntil := claims.IssuedAtUTC().Add(validity)
 	return validUntil.Before(time.Now().UTC())
 }
@@ -0,0 +1,72 @@
+package permissions
+
+import "strings"
+
+// Translator translates a key of the locales with some variables, like the
+// Translate method of an instance.
+type Translator func(key string, vars ...interface{}) string
+
+// Sentence is the human-readable description of a rule, for the consent
+// screens (the authorize page, the share dialog, etc.)
+type Sentence struct {
+	Title    string `json:"title,omitempty"`
+	Type     string `json:"type"`
+	Sentence string `json:"sentence"`
+}
+
+// doctypeName returns the translated name of a doctype, like "your contacts"
+// for io.cozy.contacts. The doctype itself is used when it has no name in the
+// locales.
+func doctypeName(t Translator, doctype string) string {
+	key := "Doctype " + doctype
+	if name := t(key); name != "" && name != key {
+		return name
+	}
+	return doctype
+}
+
+// canWrite returns true if the verbs allow to modify some documents
+func canWrite(verbs VerbSet) bool {
+	return verbs.Contains(POST) || verbs.Contains(PUT) ||
+		verbs.Contains(PATCH) || verbs.Contains(DELETE)
+}
+
+// Describe returns a human-readable sentence for the rule, like "Read your
+// contacts" or "Modify your files in /Photos", in the language of the
+// translator.
+func (r Rule) Describe(t Translator) string {
+	name := doctypeName(t, r.Type)
+	if r.Selector == PathSelector && len(r.Values) > 0 {
+		paths := make([]string, len(r.Values))
+		for i, v := range r.Values {
+			paths[i] = cleanPath(v)
+		}
+		name = t("Permissions In paths", name, strings.Join(paths, ", "))
+	} else if len(r.Values) > 0 {
+		name = t("Permissions Some of", name)
+	}
+	read, write := r.Verbs.Contains(GET), canWrite(r.Verbs)
+	switch {
+	case read && write:
+		return t("Permissions Read and write", name)
+	case write:
+		return t("Permissions Write", name)
+	case read:
+		return t("Permissions Read", name)
+	default:
+		return t("Permissions No access", name)
+	}
+}
+
+// Describe returns the human-readable sentences for the rules of a set
+func Describe(set Set, t Translator) []Sentence {
+	sentences := make([]Sentence, len(set))
+	for i, r := range set {
+		sentences[i] = Sentence{
+			Title:    r.Title,
+			Type:     r.Type,
+			Sentence: r.Describe(t),
+		}
+	}
+	return sentences
+}
@@ -20,4 +20,19 @@ var (
 	// refresh it
 	ErrExpiredToken = echo.NewHTTPError(http.StatusBadRequest,
 		"Expired token")
+
+	// ErrRevokedToken is used when the token is in the revocation list of
+	// the instance
+	ErrRevokedToken = echo.NewHTTPError(http.StatusBadRequest,
+		"Revoked token")
+
+	// ErrPasswordRequired is used when a share code protected by a password
+	// is used without being exchanged for a token
+	ErrPasswordRequired = echo.NewHTTPError(http.StatusUnauthorized,
+		"A password is required for this share code")
+
+	// ErrInvalidPassword is used when the password of a share code is not
+	// the good one
+	ErrInvalidPassword = echo.NewHTTPError(http.StatusUnauthorized,
+		"Invalid password")
 )
@@ -0,0 +1,104 @@
+package permissions
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/realtime"
+)
+
+var webhookClient = &http.Client{
+	Timeout: 30 * time.Second,
+}
+
+// ChangeEvent is sent when a permission set is created, updated or revoked:
+// on the realtime hub of the instance, and as JSON in the body of a POST
+// request to the webhooks of the configuration. It carries the doctypes of
+// the rules of the set, so that the sharing applications and the audit tools
+// know what is affected without fetching it.
+type ChangeEvent struct {
+	Event        string    `json:"event"`
+	Domain       string    `json:"domain"`
+	PermissionID string    `json:"permission_id"`
+	Type         string    `json:"type"`
+	SourceID     string    `json:"source_id,omitempty"`
+	Doctypes     []string  `json:"doctypes"`
+	Time         time.Time `json:"time"`
+}
+
+// doctypesOf returns the sorted list of the doctypes of the rules of a set
+func doctypesOf(set Set) []string {
+	seen := make(map[string]bool)
+	doctypes := []string{}
+	for _, r := range set {
+		if !seen[r.Type] {
+			seen[r.Type] = true
+			doctypes = append(doctypes, r.Type)
+		}
+	}
+	sort.Strings(doctypes)
+	return doctypes
+}
+
+// publishChange sends the change of a permission set on the realtime hub of
+// its instance, and to the webhooks in background. The cached permission
+// docs of the instance are invalidated.
+func publishChange(db couchdb.Database, eventType string, p *Permission) {
+	invalidateCacheOf(db)
+	domain := strings.TrimSuffix(db.Prefix(), "/")
+	ev := &ChangeEvent{
+		Event:        eventType,
+		Domain:       domain,
+		PermissionID: p.ID(),
+		Type:         p.Type,
+		SourceID:     p.SourceID,
+		Doctypes:     doctypesOf(p.Permissions),
+		Time:         time.Now().UTC(),
+	}
+	realtime.InstanceHub(domain).Publish(&realtime.Event{
+		Type:    eventType,
+		DocType: consts.Permissions,
+		DocID:   p.ID(),
+		DocRev:  p.Rev(),
+		Doc:     ev,
+	})
+	if cfg := config.GetConfig(); cfg != nil {
+		for _, url := range cfg.PermissionsWebhooks {
+			go callWebhook(url, ev)
+		}
+	}
+}
+
+// callWebhook posts a change to a webhook. A failure is only logged: the
+// webhooks are notifications, and the change has already been made.
+func callWebhook(url string, ev *ChangeEvent) {
+	err := postChange(url, ev)
+	if err != nil {
+		log.Warnf("[permissions] Webhook for %s of %s failed: %s", ev.Event, ev.Domain, err)
+	}
+}
+
+func postChange(url string, ev *ChangeEvent) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	res, err := webhookClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("Unexpected response status: %s", res.Status)
+	}
+	return nil
+}
@@ -2,25 +2,32 @@ package permissions
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	"github.com/cozy/cozy-stack/pkg/realtime"
 	"github.com/cozy/cozy-stack/web/jsonapi"
 	"github.com/labstack/echo"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // Permission is a storable object containing a set of rules and
 // several codes
 type Permission struct {
-	PID         string            `json:"_id,omitempty"`
-	PRev        string            `json:"_rev,omitempty"`
-	Type        string            `json:"type,omitempty"`
-	SourceID    string            `json:"source_id,omitempty"`
-	Permissions Set               `json:"permissions,omitempty"`
-	ExpiresAt   int               `json:"expires_at,omitempty"`
-	Codes       map[string]string `json:"codes,omitempty"`
+	PID              string            `json:"_id,omitempty"`
+	PRev             string            `json:"_rev,omitempty"`
+	Type             string            `json:"type,omitempty"`
+	SourceID         string            `json:"source_id,omitempty"`
+	Permissions      Set               `json:"permissions,omitempty"`
+	ExpiresAt        int               `json:"expires_at,omitempty"`
+	Codes            map[string]string `json:"codes,omitempty"`
+	Password         string            `json:"password,omitempty"`
+	PasswordFailures int               `json:"password_failures,omitempty"`
+	PasswordLockedAt int               `json:"password_locked_at,omitempty"`
 }
 
 const (
@@ -49,8 +56,36 @@ var (
 	// ErrOnlyAppCanCreateSubSet is returned if a non-app attempts to create
 	// sharing permissions.
 	ErrOnlyAppCanCreateSubSet = echo.NewHTTPError(403, "only apps can create sharing permissions")
+
+	// ErrUnknownCode is returned when a code is refreshed with a name that
+	// is not in the permission doc.
+	ErrUnknownCode = echo.NewHTTPError(404, "no code with this name")
+
+	// ErrLockedShareSet is returned when a share set has been locked after
+	// too many wrong passwords
+	ErrLockedShareSet = echo.NewHTTPError(403, "this share set has been locked after too many wrong passwords")
+
+	// ErrTooManyIDs is returned when the permissions are asked for more
+	// than MaxIDsForPermissions documents at once
+	ErrTooManyIDs = echo.NewHTTPError(413, "too many documents in the request")
 )
 
+// errNoFailuresToReset is used by VerifyPassword to not save the permission
+// doc when the password is good and there is no failure to reset
+var errNoFailuresToReset = errors.New("no failures to reset")
+
+// MaxPasswordFailures is the number of wrong passwords after which a share
+// set is locked, as its password is probably being brute-forced
+var MaxPasswordFailures = 10
+
+// ShareSetLockDuration is the duration of the lock of a share set after
+// MaxPasswordFailures wrong passwords. It doubles on each wrong password
+// given after the lock has expired, up to MaxShareSetLockDuration.
+var ShareSetLockDuration = 1 * time.Minute
+
+// MaxShareSetLockDuration is the maximal duration of the lock of a share set
+var MaxShareSetLockDuration = 24 * time.Hour
+
 // ID implements jsonapi.Doc
 func (p *Permission) ID() string { return p.PID }
 
@@ -88,9 +123,142 @@ func (p *Permission) PatchCodes(codes map[string]string) {
 	p.Codes = codes
 }
 
+// RefreshCode replaces the code with the given name by a new one, keeps the
+// other codes, and removes the lock of the set. On a conflict, the permission doc is fetched again and the
+// code is replaced in its last revision, so that a concurrent change of the
+// other codes is not lost.
+func (p *Permission) RefreshCode(db couchdb.Database, name, code string) error {
+	err := couchdb.UpdateDocWithRetry(db, p, func(couchdb.Doc) error {
+		if _, ok := p.Codes[name]; !ok {
+			return ErrUnknownCode
+		}
+		p.Codes[name] = code
+		p.ResetPasswordFailures()
+		return nil
+	})
+	if err == nil {
+		publishChange(db, realtime.EventUpdate, p)
+	}
+	return err
+}
+
+// CheckPassword returns an error if the password is not the one of the share
+// set. The password is hashed with bcrypt, and the hashes are compared in
+// constant time.
+func (p *Permission) CheckPassword(password []byte) error {
+	if p.Password == "" {
+		return ErrInvalidPassword
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(p.Password), password); err != nil {
+		return ErrInvalidPassword
+	}
+	return nil
+}
+
+// Locked returns true if the share set has been locked after too many wrong
+// passwords, and the lock has not expired. Its codes and the tokens given in
+// exchange of them are refused.
+func (p *Permission) Locked() bool {
+	if p.Password == "" || p.PasswordFailures < MaxPasswordFailures {
+		return false
+	}
+	lockedAt := time.Unix(int64(p.PasswordLockedAt), 0)
+	return time.Now().Before(lockedAt.Add(p.lockDuration()))
+}
+
+// lockDuration returns the duration of the lock of the share set, that
+// doubles for each wrong password after MaxPasswordFailures.
+func (p *Permission) lockDuration() time.Duration {
+	d := ShareSetLockDuration
+	for i := MaxPasswordFailures; i < p.PasswordFailures; i++ {
+		d *= 2
+		if d >= MaxShareSetLockDuration {
+			return MaxShareSetLockDuration
+		}
+	}
+	return d
+}
+
+// ResetPasswordFailures forgets the wrong passwords given for the share set,
+// and removes its lock.
+func (p *Permission) ResetPasswordFailures() {
+	p.PasswordFailures = 0
+	p.PasswordLockedAt = 0
+}
+
+// VerifyPassword is like CheckPassword, but the wrong passwords are counted
+// in the permission doc, and the share set is locked for
+// ShareSetLockDuration after MaxPasswordFailures of them. The counter is
+// reset by a good password once the lock has expired, or by the owner of the
+// set when it is patched or a code is refreshed.
+func (p *Permission) VerifyPassword(db couchdb.Database, password []byte) error {
+	if p.Password == "" {
+		return ErrInvalidPassword
+	}
+	var checkErr error
+	err := couchdb.UpdateDocWithRetry(db, p, func(couchdb.Doc) error {
+		if p.Locked() {
+			return ErrLockedShareSet
+		}
+		checkErr = p.CheckPassword(password)
+		if checkErr == nil && p.PasswordFailures == 0 {
+			return errNoFailuresToReset
+		}
+		if checkErr == nil {
+			p.ResetPasswordFailures()
+		} else {
+			p.PasswordFailures++
+			if p.PasswordFailures >= MaxPasswordFailures {
+				p.PasswordLockedAt = int(time.Now().Unix())
+			}
+		}
+		return nil
+	})
+	if err == errNoFailuresToReset {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if p.Locked() {
+		invalidateCacheOf(db)
+	}
+	return checkErr
+}
+
+// Expired returns true if the codes of the permission doc have expired.
+// ExpiresAt is a unix timestamp, and zero means that they never expire.
+func (p *Permission) Expired() bool {
+	return p.ExpiresAt != 0 && time.Now().Unix() >= int64(p.ExpiresAt)
+}
+
+// ExpiredForCode returns true if a share code of the permission doc has
+// expired: at ExpiresAt if the codes have been created with a ttl, or like
+// the other tokens, TokenValidityDuration after the code has been issued.
+func (p *Permission) ExpiredForCode(claims *Claims) bool {
+	if p.ExpiresAt != 0 {
+		return p.Expired()
+	}
+	validUntil := claims.IssuedAtUTC().Add(TokenValidityDuration)
+	return validUntil.Before(time.Now().UTC())
+}
+
+// Update saves the changes of a Permission doc
+func (p *Permission) Update(db couchdb.Database) error {
+	if err := couchdb.UpdateDoc(db, p); err != nil {
+		return err
+	}
+	publishChange(db, realtime.EventUpdate, p)
+	return nil
+}
+
 // Revoke destroy a Permission
 func (p *Permission) Revoke(db couchdb.Database) error {
-	return couchdb.DeleteDoc(db, p)
+	if err := couchdb.DeleteDoc(db, p); err != nil {
+		return err
+	}
+	publishChange(db, realtime.EventDelete, p)
+	return nil
 }
 
 // ParentOf check if child has been created by p
@@ -132,6 +300,7 @@ func GetForOauth(claims *Claims) (*Permission, error) {
 	}
 	pdoc := &Permission{
 		Type:        TypeOauth,
+		SourceID:    consts.OAuthClients + "/" + claims.Subject,
 		Permissions: set,
 	}
 	return pdoc, nil
@@ -193,6 +362,10 @@ func GetForShareCode(db couchdb.Database, tokenCode string) (*Permission, error)
 		return nil, err
 	}
 
+	if pdoc.Expired() {
+		return nil, ErrExpiredToken
+	}
+
 	return &pdoc, nil
 }
 
@@ -213,12 +386,15 @@ func CreateAppSet(db couchdb.Database, slug string, set Set) (*Permission, error
 	if err != nil {
 		return nil, err
 	}
+	publishChange(db, realtime.EventCreate, doc)
 
 	return doc, nil
 }
 
-// CreateShareSet creates a Permission doc for sharing
-func CreateShareSet(db couchdb.Database, parent *Permission, codes map[string]string, set Set) (*Permission, error) {
+// CreateShareSet creates a Permission doc for sharing. If ttl is positive,
+// the codes expire after this delay. If a password is given, its hash is
+// stored in the doc, and the codes must be exchanged for a token with it.
+func CreateShareSet(db couchdb.Database, parent *Permission, codes map[string]string, set Set, ttl time.Duration, password []byte) (*Permission, error) {
 
 	if parent.Type == TypeRegister || parent.Type == TypeSharing {
 		return nil, ErrOnlyAppCanCreateSubSet
@@ -235,11 +411,22 @@ func CreateShareSet(db couchdb.Database, parent *Permission, codes map[string]st
 		Permissions: set, // @TODO some validation?
 		Codes:       codes,
 	}
+	if ttl > 0 {
+		doc.ExpiresAt = int(time.Now().Add(ttl).Unix())
+	}
+	if len(password) > 0 {
+		hash, err := bcrypt.GenerateFromPassword(password, bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+		doc.Password = string(hash)
+	}
 
 	err := couchdb.CreateDoc(db, doc)
 	if err != nil {
 		return nil, err
 	}
+	publishChange(db, realtime.EventCreate, doc)
 
 	return doc, nil
 }
@@ -253,7 +440,7 @@ func DeleteShareSet(db couchdb.Database, permID string) error {
 		return err
 	}
 
-	return couchdb.DeleteDoc(db, doc)
+	return doc.Revoke(db)
 }
 
 // Force creates or updates a Permission doc for a given app
@@ -265,12 +452,16 @@ func Force(db couchdb.Database, slug string, set Set) error {
 		Permissions: set, // @TODO some validation?
 	}
 	if existing == nil {
-		return couchdb.CreateDoc(db, doc)
+		if err := couchdb.CreateDoc(db, doc); err != nil {
+			return err
+		}
+		publishChange(db, realtime.EventCreate, doc)
+		return nil
 	}
 
 	doc.SetID(existing.ID())
 	doc.SetRev(existing.Rev())
-	return couchdb.UpdateDoc(db, doc)
+	return doc.Update(db)
 }
 
 // DestroyApp remove all Permission docs for a given app
@@ -283,7 +474,7 @@ func DestroyApp(db couchdb.Database, slug string) error {
 		return err
 	}
 	for _, p := range res {
-		err := couchdb.DeleteDoc(db, &p)
+		err := p.Revoke(db)
 		if err != nil {
 			return err
 		}
@@ -291,36 +482,173 @@ func DestroyApp(db couchdb.Database, slug string) error {
 	return nil
 }
 
-// GetPermissionsForIDs gets permissions for several IDs
-// returns for every id the combined allowed verbset
-func GetPermissionsForIDs(db couchdb.Database, doctype string, ids []string) (map[string]*VerbSet, error) {
-
-	var res struct {
-		Rows []struct {
-			ID    string   `json:"id"`
-			Key   []string `json:"key"`
-			Value *VerbSet `json:"value"`
-		} `json:"rows"`
+// GetBySource returns the permission docs with the given source, like
+// io.cozy.apps/<slug> or io.cozy.oauth.clients/<client-id>: the doc of an
+// application, and the share sets created by the application or the client.
+func GetBySource(db couchdb.Database, sourceID string) ([]*Permission, error) {
+	var docs []*Permission
+	for skip := 0; ; skip += usedDoctypesPageSize {
+		var res []*Permission
+		err := couchdb.FindDocs(db, consts.Permissions, &couchdb.FindRequest{
+			Selector: mango.Equal("source_id", sourceID),
+			Limit:    usedDoctypesPageSize,
+			Skip:     skip,
+		}, &res)
+		if couchdb.IsNoDatabaseError(err) {
+			return docs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, res...)
+		if len(res) < usedDoctypesPageSize {
+			return docs, nil
+		}
 	}
+}
 
-	keys := make([]interface{}, len(ids))
-	for i, id := range ids {
-		keys[i] = []string{doctype, "_id", id}
+// usedDoctypesPageSize is the number of permission documents fetched at once
+// by UsedDoctypes
+const usedDoctypesPageSize = 100
+
+// UsedDoctypes returns the doctypes on which an application or a sharing has
+// a permission. The permissions of the application with the given slug are
+// not counted.
+func UsedDoctypes(db couchdb.Database, slug string) (map[string]bool, error) {
+	used := make(map[string]bool)
+	source := consts.Apps + "/" + slug
+	for skip := 0; ; skip += usedDoctypesPageSize {
+		var res []Permission
+		err := couchdb.FindDocs(db, consts.Permissions, &couchdb.FindRequest{
+			Selector: mango.Gt("source_id", ""),
+			Limit:    usedDoctypesPageSize,
+			Skip:     skip,
+		}, &res)
+		if couchdb.IsNoDatabaseError(err) {
+			return used, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range res {
+			if p.SourceID == source {
+				continue
+			}
+			for _, rule := range p.Permissions {
+				used[rule.Type] = true
+			}
+		}
+		if len(res) < usedDoctypesPageSize {
+			return used, nil
+		}
 	}
+}
 
-	err := couchdb.ExecView(db, consts.PermissionsShareByDocView, &couchdb.ViewRequest{
-		Keys: keys,
-	}, &res)
+const (
+	// DefaultShareSetsLimit is the number of share permission docs in a page
+	DefaultShareSetsLimit = 100
+	// MaxShareSetsLimit is the maximal number of share permission docs in a
+	// page
+	MaxShareSetsLimit = 1000
+)
+
+// ListShareSetsByDoctype returns a page of the share permission docs with a
+// rule on the given doctype, sorted by id. The cursor is the id of the last
+// permission doc of the previous page. It also returns the cursor of the next
+// page, or an empty string for the last page.
+func ListShareSetsByDoctype(db couchdb.Database, doctype, cursor string, limit int) ([]*Permission, string, error) {
+	if limit <= 0 || limit > MaxShareSetsLimit {
+		limit = DefaultShareSetsLimit
+	}
+	req := &couchdb.ViewRequest{
+		StartKey:    []string{doctype, cursor},
+		EndKey:      []interface{}{doctype, map[string]interface{}{}},
+		IncludeDocs: true,
+		// One more row for the next page, and one for the cursor
+		Limit: limit + 2,
+	}
+	var res couchdb.ViewResponse
+	err := couchdb.ExecView(db, consts.PermissionsShareByDoctypeView, req, &res)
+	if couchdb.IsNotFoundError(err) {
+		// The view is missing on the instances created before it
+		if err = couchdb.DefineViews(db, consts.ViewsByDoctype(consts.Permissions)); err == nil {
+			err = couchdb.ExecView(db, consts.PermissionsShareByDoctypeView, req, &res)
+		}
+	}
+	if couchdb.IsNoDatabaseError(err) {
+		return []*Permission{}, "", nil
+	}
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
-	result := make(map[string]*VerbSet)
+	docs := make([]*Permission, 0, len(res.Rows))
 	for _, row := range res.Rows {
-		if _, ok := result[row.Key[2]]; ok {
-			result[row.Key[2]].Merge(row.Value)
-		} else {
-			result[row.Key[2]] = row.Value
+		if row.ID == cursor || row.Doc == nil {
+			continue
+		}
+		var pdoc Permission
+		if err = json.Unmarshal(*row.Doc, &pdoc); err != nil {
+			return nil, "", err
+		}
+		docs = append(docs, &pdoc)
+	}
+	var next string
+	if len(docs) > limit {
+		docs = docs[:limit]
+		next = docs[limit-1].PID
+	}
+	return docs, next, nil
+}
+
+// MaxIDsForPermissions is the maximal number of ids for which the
+// permissions can be asked in one call to GetPermissionsForIDs
+const MaxIDsForPermissions = 1000
+
+// keysPerViewRequest is the number of keys sent in one request to the view
+// of the share permissions by document
+const keysPerViewRequest = 100
+
+// GetPermissionsForIDs gets permissions for several IDs
+// returns for every id the combined allowed verbset
+func GetPermissionsForIDs(db couchdb.Database, doctype string, ids []string) (map[string]*VerbSet, error) {
+	if len(ids) > MaxIDsForPermissions {
+		return nil, ErrTooManyIDs
+	}
+
+	result := make(map[string]*VerbSet)
+	for start := 0; start < len(ids); start += keysPerViewRequest {
+		end := start + keysPerViewRequest
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		var res struct {
+			Rows []struct {
+				ID    string   `json:"id"`
+				Key   []string `json:"key"`
+				Value *VerbSet `json:"value"`
+			} `json:"rows"`
+		}
+
+		keys := make([]interface{}, end-start)
+		for i, id := range ids[start:end] {
+			keys[i] = []string{doctype, "_id", id}
+		}
+
+		err := couchdb.ExecView(db, consts.PermissionsShareByDocView, &couchdb.ViewRequest{
+			Keys: keys,
+		}, &res)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, row := range res.Rows {
+			if _, ok := result[row.Key[2]]; ok {
+				result[row.Key[2]].Merge(row.Value)
+			} else {
+				result[row.Key[2]] = row.Value
+			}
 		}
 	}
 
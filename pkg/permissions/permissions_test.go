@@ -3,9 +3,14 @@ package permissions
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -19,6 +24,41 @@ func TestVerbToString(t *testing.T) {
 	vs4 := VerbSplit("ALL")
 	assert.Equal(t, "ALL", vs4.String())
 
+	vs5 := Verbs(GET, POST, PUT, PATCH)
+	assert.Equal(t, "ALL,-DELETE", vs5.String())
+
+	vs6 := Verbs(GET, POST, PUT)
+	assert.Equal(t, "ALL,-PATCH,-DELETE", vs6.String())
+}
+
+func TestVerbExclusion(t *testing.T) {
+	assert.Equal(t, Verbs(GET, POST, PUT, PATCH), VerbSplit("-DELETE"))
+	assert.Equal(t, Verbs(GET, POST, PUT, PATCH), VerbSplit("ALL,-DELETE"))
+	assert.Equal(t, Verbs(GET), VerbSplit("GET,POST,-POST"))
+	assert.Equal(t, VerbSplit("ALL,-DELETE"), VerbSplit(VerbSplit("-DELETE").String()))
+
+	none := VerbSplit("-GET,-POST,-PUT,-PATCH,-DELETE")
+	assert.False(t, none.Contains(GET))
+	assert.False(t, none.Contains(DELETE))
+	assert.Equal(t, none, VerbSplit(none.String()))
+
+	var r Rule
+	err := json.Unmarshal([]byte(`{"type":"io.cozy.files","verbs":["ALL"]}`), &r)
+	assert.NoError(t, err)
+	assert.True(t, r.Verbs.Contains(DELETE))
+	assert.Equal(t, "ALL", r.Verbs.String())
+
+	err = json.Unmarshal([]byte(`{"type":"io.cozy.files","verbs":["-DELETE"]}`), &r)
+	assert.NoError(t, err)
+	assert.True(t, r.Verbs.Contains(PATCH))
+	assert.False(t, r.Verbs.Contains(DELETE))
+
+	r, err = UnmarshalRuleString("io.cozy.files:ALL,-DELETE:io.cozy.files.music-dir")
+	assert.NoError(t, err)
+	assert.Equal(t, Verbs(GET, POST, PUT, PATCH), r.Verbs)
+	out, err := r.MarshalScopeString()
+	assert.NoError(t, err)
+	assert.Equal(t, "io.cozy.files:ALL,-DELETE:io.cozy.files.music-dir", out)
 }
 
 func TestRuleToJSON(t *testing.T) {
@@ -251,6 +291,264 @@ func TestSubset(t *testing.T) {
 	s6 := Set{Rule{Type: "io.cozy.events", Selector: "calendar", Values: []string{"foo"}}}
 	assert.True(t, s6.IsSubSetOf(s5))
 	assert.False(t, s5.IsSubSetOf(s6))
+
+	s7 := Set{Rule{Type: "io.cozy.events", Verbs: Verbs(GET)}}
+	assert.True(t, s7.IsSubSetOf(s))
+	assert.False(t, s.IsSubSetOf(s7))
+	s8 := Set{Rule{Type: "io.cozy.events", Verbs: ALL}}
+	assert.True(t, s.IsSubSetOf(s8))
+}
+
+func TestRestrict(t *testing.T) {
+	parent := Set{
+		Rule{Type: "io.cozy.contacts", Verbs: Verbs(GET)},
+		Rule{Type: "io.cozy.events", Values: []string{"foo"}},
+	}
+	s := Set{
+		Rule{Type: "io.cozy.contacts", Verbs: Verbs(GET)},
+		Rule{Type: "io.cozy.contacts", Verbs: Verbs(DELETE)},
+		Rule{Type: "io.cozy.events", Values: []string{"foo"}},
+		Rule{Type: "io.cozy.events", Values: []string{"bar"}},
+		Rule{Type: "io.cozy.files"},
+	}
+	restricted := s.Restrict(parent)
+	if assert.Len(t, restricted, 2) {
+		assert.Equal(t, s[0], restricted[0])
+		assert.Equal(t, s[2], restricted[1])
+	}
+	assert.Empty(t, s.Restrict(Set{}))
+}
+
+func TestPathSelector(t *testing.T) {
+	r := Rule{
+		Type:     "io.cozy.files",
+		Verbs:    Verbs(POST),
+		Selector: PathSelector,
+		Values:   []string{"/Photos/Shared/"},
+	}
+	assert.True(t, r.MatchPath("/Photos/Shared"))
+	assert.True(t, r.MatchPath("/Photos/Shared/2017/beach.jpg"))
+	assert.False(t, r.MatchPath("/Photos/SharedWithBob"))
+	assert.False(t, r.MatchPath("/Photos"))
+	assert.False(t, r.MatchPath("/Photos/Shared/../Private"))
+
+	parent := Set{r}
+	sub := Set{Rule{
+		Type:     "io.cozy.files",
+		Verbs:    Verbs(POST),
+		Selector: PathSelector,
+		Values:   []string{"/Photos/Shared/2017"},
+	}}
+	assert.True(t, sub.IsSubSetOf(parent))
+	sub[0].Values = []string{"/Photos"}
+	assert.False(t, sub.IsSubSetOf(parent))
+	sub[0].Values = nil
+	assert.False(t, sub.IsSubSetOf(parent))
+}
+
+func TestDescribe(t *testing.T) {
+	locale := map[string]string{
+		"Permissions Read":           "Read %s",
+		"Permissions Write":          "Modify %s",
+		"Permissions Read and write": "Read and modify %s",
+		"Permissions Some of":        "some of %s",
+		"Permissions In paths":       "%s in %s",
+		"Doctype io.cozy.contacts":   "your contacts",
+		"Doctype io.cozy.files":      "your files",
+	}
+	translate := func(key string, vars ...interface{}) string {
+		if format, ok := locale[key]; ok {
+			return fmt.Sprintf(format, vars...)
+		}
+		return key
+	}
+
+	set, err := UnmarshalScopeString("io.cozy.contacts:GET io.cozy.events io.cozy.contacts:PUT:foo,bar")
+	if !assert.NoError(t, err) {
+		return
+	}
+	sentences := Describe(set, translate)
+	if assert.Len(t, sentences, 3) {
+		assert.Equal(t, "Read your contacts", sentences[0].Sentence)
+		assert.Equal(t, "io.cozy.contacts", sentences[0].Type)
+		assert.Equal(t, "Read and modify io.cozy.events", sentences[1].Sentence)
+		assert.Equal(t, "Modify some of your contacts", sentences[2].Sentence)
+	}
+
+	r := Rule{
+		Type:     "io.cozy.files",
+		Verbs:    Verbs(POST),
+		Selector: PathSelector,
+		Values:   []string{"/Photos/"},
+	}
+	assert.Equal(t, "Modify your files in /Photos", r.Describe(translate))
+}
+
+func TestWildcardType(t *testing.T) {
+	assert.NoError(t, ValidateType("io.cozy.bank.*"))
+	assert.NoError(t, ValidateType("io.cozy.contacts"))
+	assert.Error(t, ValidateType(""))
+	assert.Error(t, ValidateType("io.cozy.*"))
+	assert.Error(t, ValidateType("io.cozy.*.accounts"))
+	assert.Error(t, ValidateType("io.cozy.bank*"))
+	_, err := UnmarshalRuleString("io.*:GET")
+	assert.Error(t, err)
+
+	r, err := UnmarshalRuleString("io.cozy.bank.*:GET")
+	assert.NoError(t, err)
+	assert.True(t, r.MatchType("io.cozy.bank.accounts"))
+	assert.True(t, r.MatchType("io.cozy.bank.operations"))
+	assert.True(t, r.MatchType("io.cozy.bank.accounts.*"))
+	assert.False(t, r.MatchType("io.cozy.bank"))
+	assert.False(t, r.MatchType("io.cozy.banking"))
+	assert.False(t, r.MatchType("io.cozy.files"))
+
+	s := Set{r}
+	assert.True(t, s.AllowWholeType(GET, "io.cozy.bank.accounts"))
+	assert.False(t, s.AllowWholeType(POST, "io.cozy.bank.accounts"))
+	assert.True(t, s.AllowID(GET, "io.cozy.bank.operations", "id1"))
+	assert.False(t, s.AllowID(GET, "io.cozy.contacts", "id1"))
+
+	s2 := Set{Rule{Type: "io.cozy.bank.accounts", Verbs: Verbs(GET)}}
+	assert.True(t, s2.IsSubSetOf(s))
+	s3 := Set{Rule{Type: "io.cozy.bank.accounts.*", Verbs: Verbs(GET)}}
+	assert.True(t, s3.IsSubSetOf(s))
+	assert.False(t, s.IsSubSetOf(s2))
+	assert.False(t, s.IsSubSetOf(s3))
+}
+
+func TestExpandTemplate(t *testing.T) {
+	tmpl := Set{
+		Rule{Title: "album", Type: "io.cozy.photos.albums", Verbs: Verbs(GET)},
+		Rule{Title: "files", Type: "io.cozy.files", Verbs: Verbs(GET), Selector: "referenced_by"},
+	}
+	given := Set{
+		Rule{Title: "album", Type: "io.cozy.contacts", Verbs: ALL, Values: []string{"123"}},
+		Rule{Title: "files", Values: []string{"io.cozy.photos.albums/123"}},
+	}
+	set, err := ExpandTemplate(tmpl, given)
+	if assert.NoError(t, err) && assert.Len(t, set, 2) {
+		assert.Equal(t, "io.cozy.photos.albums", set[0].Type)
+		assert.Equal(t, Verbs(GET), set[0].Verbs)
+		assert.Equal(t, []string{"123"}, set[0].Values)
+		assert.Equal(t, "referenced_by", set[1].Selector)
+		assert.Equal(t, []string{"io.cozy.photos.albums/123"}, set[1].Values)
+	}
+	assert.Empty(t, tmpl[0].Values)
+
+	_, err = ExpandTemplate(tmpl, Set{given[0]})
+	assert.Error(t, err)
+	_, err = ExpandTemplate(tmpl, append(given, Rule{Title: "contacts", Type: "io.cozy.contacts"}))
+	assert.Error(t, err)
+}
+
+func TestDoctypesPolicy(t *testing.T) {
+	assert.NoError(t, CheckReadable("", consts.Files))
+	assert.Error(t, CheckWritable("", consts.Files))
+	assert.Error(t, CheckReadable("", consts.Sessions))
+	assert.NoError(t, CheckWritable("", consts.Settings))
+	assert.Error(t, CheckReadable(TypeApplication, consts.OAuthClients))
+
+	assert.NoError(t, CheckReadable(TypeApplication, consts.Settings))
+	assert.Error(t, CheckReadable(TypeSharing, consts.Settings))
+	assert.Error(t, CheckWritable(TypeSharing, consts.Settings))
+	assert.NoError(t, CheckReadable(TypeSharing, "io.cozy.contacts"))
+
+	cfg := viper.New()
+	cfg.SetConfigType("yaml")
+	err := cfg.ReadConfig(strings.NewReader(`
+permissions:
+  forbidden_doctypes:
+    share:
+      write: [io.cozy.contacts]
+    cli:
+      read: [io.cozy.emails]
+`))
+	assert.NoError(t, err)
+	assert.NoError(t, config.UseViper(cfg))
+	defer config.UseViper(viper.New())
+
+	assert.NoError(t, CheckReadable(TypeSharing, consts.Settings))
+	assert.NoError(t, CheckReadable(TypeSharing, "io.cozy.contacts"))
+	assert.Error(t, CheckWritable(TypeSharing, "io.cozy.contacts"))
+	assert.Error(t, CheckReadable(TypeCLI, "io.cozy.emails"))
+	assert.Error(t, CheckWritable(TypeCLI, "io.cozy.emails"))
+	assert.Error(t, CheckReadable(TypeSharing, consts.Sessions))
+}
+
+func TestCache(t *testing.T) {
+	pdoc := &Permission{PID: "cached", Type: TypeOauth}
+	claims := &Claims{}
+	claims.Subject = "client"
+	token := "header.payload.signature"
+
+	_, ok := GetCached("cache.example.net", token, 1)
+	assert.False(t, ok)
+	PutCached("cache.example.net", token, 1, pdoc, claims)
+	cached, ok := GetCached("cache.example.net", "other.payload.signature", 1)
+	if assert.True(t, ok) {
+		assert.Equal(t, "cached", cached.ID())
+	}
+	_, ok = GetCached("other.example.net", token, 1)
+	assert.False(t, ok)
+
+	// The keys of the instance have changed
+	_, ok = GetCached("cache.example.net", token, 2)
+	assert.False(t, ok)
+	_, ok = GetCached("cache.example.net", token, 1)
+	assert.False(t, ok)
+
+	PutCached("cache.example.net", token, 1, pdoc, claims)
+	InvalidateCache("cache.example.net")
+	_, ok = GetCached("cache.example.net", token, 1)
+	assert.False(t, ok)
+
+	claims.ExpiresAt = time.Now().Add(-time.Second).Unix()
+	PutCached("cache.example.net", token, 1, pdoc, claims)
+	_, ok = GetCached("cache.example.net", token, 1)
+	assert.False(t, ok)
+}
+
+func TestExpiredForCode(t *testing.T) {
+	claims := &Claims{}
+	claims.Audience = ShareAudience
+	claims.IssuedAt = time.Now().Add(-8 * 24 * time.Hour).Unix()
+	assert.False(t, claims.Expired())
+
+	pdoc := &Permission{Type: TypeSharing}
+	assert.True(t, pdoc.ExpiredForCode(claims))
+	pdoc.ExpiresAt = int(time.Now().Add(time.Hour).Unix())
+	assert.False(t, pdoc.ExpiredForCode(claims))
+
+	claims.IssuedAt = time.Now().Unix()
+	pdoc.ExpiresAt = 0
+	assert.False(t, pdoc.ExpiredForCode(claims))
+	pdoc.ExpiresAt = int(time.Now().Add(-time.Hour).Unix())
+	assert.True(t, pdoc.ExpiredForCode(claims))
+}
+
+func TestLockedShareSet(t *testing.T) {
+	pdoc := &Permission{Type: TypeSharing, Password: "hash"}
+	pdoc.PasswordFailures = MaxPasswordFailures - 1
+	assert.False(t, pdoc.Locked())
+
+	now := time.Now()
+	pdoc.PasswordFailures = MaxPasswordFailures
+	pdoc.PasswordLockedAt = int(now.Unix())
+	assert.True(t, pdoc.Locked())
+	assert.Equal(t, ShareSetLockDuration, pdoc.lockDuration())
+	pdoc.PasswordLockedAt = int(now.Add(-ShareSetLockDuration).Unix())
+	assert.False(t, pdoc.Locked())
+
+	pdoc.PasswordFailures = MaxPasswordFailures + 2
+	assert.Equal(t, 4*ShareSetLockDuration, pdoc.lockDuration())
+	assert.True(t, pdoc.Locked())
+	pdoc.PasswordFailures = MaxPasswordFailures + 100
+	assert.Equal(t, MaxShareSetLockDuration, pdoc.lockDuration())
+
+	pdoc.ResetPasswordFailures()
+	assert.False(t, pdoc.Locked())
+	assert.Equal(t, 0, pdoc.PasswordLockedAt)
 }
 
 func assertEqualJSON(t *testing.T, value []byte, expected string) {
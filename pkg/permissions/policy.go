@@ -0,0 +1,96 @@
+package permissions
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/labstack/echo"
+)
+
+var readable = true
+var none = false
+
+// reservedDoctypes are the doctypes used by the stack that can't be written
+// with the data API, whatever the token. Only the readable ones can be read.
+var reservedDoctypes = map[string]bool{
+	consts.Sessions:         none,
+	consts.Permissions:      none,
+	consts.OAuthClients:     none,
+	consts.OAuthAccessCodes: none,
+	consts.Files:            readable,
+	consts.Instances:        readable,
+}
+
+// defaultDoctypesPolicies are the doctypes forbidden to the tokens of a type,
+// in addition to the reserved ones, when the type is not in the
+// configuration. The share codes are given to other people, so they can't
+// read the settings and the applications of the owner.
+var defaultDoctypesPolicies = map[string]config.DoctypesPolicy{
+	TypeSharing: {
+		Read: []string{consts.Settings, consts.Apps},
+	},
+}
+
+// doctypesPolicy returns the doctypes forbidden to the tokens of the given
+// type, from the configuration or else from the defaults.
+func doctypesPolicy(permType string) config.DoctypesPolicy {
+	if cfg := config.GetConfig(); cfg != nil {
+		if policy, ok := cfg.Doctypes[permType]; ok {
+			return policy
+		}
+	}
+	return defaultDoctypesPolicies[permType]
+}
+
+func containsDoctype(doctypes []string, doctype string) bool {
+	for _, d := range doctypes {
+		if d == doctype {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckReadable returns an error if the doctype can't be read with the data
+// API by a token of the given permission type (app, share, oauth or cli). An
+// empty type only checks the doctypes reserved by the stack.
+func CheckReadable(permType, doctype string) error {
+	if readable, ok := reservedDoctypes[doctype]; ok && !readable {
+		return &echo.HTTPError{
+			Code:    http.StatusForbidden,
+			Message: fmt.Sprintf("reserved doctype %s unreadable", doctype),
+		}
+	}
+	if permType != "" && containsDoctype(doctypesPolicy(permType).Read, doctype) {
+		return &echo.HTTPError{
+			Code:    http.StatusForbidden,
+			Message: fmt.Sprintf("doctype %s unreadable with a %s token", doctype, permType),
+		}
+	}
+	return nil
+}
+
+// CheckWritable returns an error if the doctype can't be written with the
+// data API by a token of the given permission type. An empty type only checks
+// the doctypes reserved by the stack.
+func CheckWritable(permType, doctype string) error {
+	if _, ok := reservedDoctypes[doctype]; ok {
+		return &echo.HTTPError{
+			Code:    http.StatusForbidden,
+			Message: fmt.Sprintf("reserved doctype %s unwritable", doctype),
+		}
+	}
+	if permType == "" {
+		return nil
+	}
+	policy := doctypesPolicy(permType)
+	if containsDoctype(policy.Read, doctype) || containsDoctype(policy.Write, doctype) {
+		return &echo.HTTPError{
+			Code:    http.StatusForbidden,
+			Message: fmt.Sprintf("doctype %s unwritable with a %s token", doctype, permType),
+		}
+	}
+	return nil
+}
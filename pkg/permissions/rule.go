@@ -3,6 +3,7 @@ package permissions
 import (
 	"errors"
 	"fmt"
+	"path"
 	"strings"
 )
 
@@ -11,6 +12,55 @@ const ruleSep = " "
 const valueSep = ","
 const partSep = ":"
 
+// typeWildcard is the suffix of a type that matches a family of doctypes,
+// like io.cozy.bank.* for io.cozy.bank.accounts and io.cozy.bank.operations
+const typeWildcard = ".*"
+
+// minWildcardSegments is the number of segments required before a wildcard,
+// so that a rule can't match all the doctypes of an organization (io.cozy.*)
+const minWildcardSegments = 3
+
+// PathSelector is the selector of the rules on io.cozy.files that allow the
+// files and directories under some paths, like /Photos/Shared
+const PathSelector = "path"
+
+// IsWildcardType returns true if the type of a rule is a wildcard, like
+// io.cozy.bank.*
+func IsWildcardType(doctype string) bool {
+	return strings.HasSuffix(doctype, typeWildcard)
+}
+
+// ValidateType returns an error if the type of a rule is empty, or if it is
+// a wildcard that is not at the end or is too broad.
+func ValidateType(doctype string) error {
+	if doctype == "" {
+		return errors.New("the type is mandatory for a permissions rule")
+	}
+	if !strings.Contains(doctype, "*") {
+		return nil
+	}
+	prefix := strings.TrimSuffix(doctype, typeWildcard)
+	if !IsWildcardType(doctype) || strings.Contains(prefix, "*") {
+		return fmt.Errorf("the wildcard must be the last segment of the type %s", doctype)
+	}
+	if len(strings.Split(prefix, ".")) < minWildcardSegments {
+		return fmt.Errorf("the wildcard type %s is too broad", doctype)
+	}
+	return nil
+}
+
+// MatchDoctype returns true if the doctype is matched by the type of a rule:
+// it is the same doctype, or the type is a wildcard and the doctype is in its
+// family. io.cozy.bank.* matches io.cozy.bank.operations and the narrower
+// wildcards like io.cozy.bank.accounts.*, but not io.cozy.bank itself.
+func MatchDoctype(ruleType, doctype string) bool {
+	if !IsWildcardType(ruleType) {
+		return ruleType == doctype
+	}
+	prefix := strings.TrimSuffix(ruleType, "*")
+	return strings.HasPrefix(doctype, prefix) && len(doctype) > len(prefix)
+}
+
 // Rule represent a single permissions rule, ie a Verb and a type
 type Rule struct {
 	// Type is the JSON-API type or couchdb Doctype
@@ -68,8 +118,8 @@ func UnmarshalRuleString(in string) (Rule, error) {
 		out.Verbs = VerbSplit(parts[1])
 		fallthrough
 	case 1:
-		if parts[0] == "" {
-			return out, errors.New("the type is mandatory for a permissions rule")
+		if err := ValidateType(parts[0]); err != nil {
+			return out, err
 		}
 		out.Type = parts[0]
 	default:
@@ -79,6 +129,12 @@ func UnmarshalRuleString(in string) (Rule, error) {
 	return out, nil
 }
 
+// MatchType returns true if the rule is for the given doctype, directly or
+// with a wildcard.
+func (r Rule) MatchType(doctype string) bool {
+	return MatchDoctype(r.Type, doctype)
+}
+
 // SomeValue returns true if any value statisfy the predicate
 func (r Rule) SomeValue(predicate func(v string) bool) bool {
 	for _, v := range r.Values {
@@ -99,6 +155,42 @@ func (r Rule) ValuesValid(o Validable) bool {
 	return false
 }
 
+// cleanPath returns the absolute and clean form of a path used as the value
+// of a rule, so that /Photos/Shared/ and Photos/Shared are the same path
+func cleanPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+// isPathUnder returns true if the path is the directory dir or is inside it
+func isPathUnder(p, dir string) bool {
+	p, dir = cleanPath(p), cleanPath(dir)
+	return p == dir || dir == "/" || strings.HasPrefix(p, dir+"/")
+}
+
+// MatchPath returns true if the rule has the path selector, and the given
+// path is one of its values or is inside one of them.
+func (r Rule) MatchPath(p string) bool {
+	if r.Selector != PathSelector {
+		return false
+	}
+	return r.SomeValue(func(v string) bool { return isPathUnder(p, v) })
+}
+
+// MatchAllPaths returns true if the rule has the path selector, and all the
+// given paths are matched by it. An empty list of paths is not matched, as it
+// would mean all the files.
+func (r Rule) MatchAllPaths(paths []string) bool {
+	if len(paths) == 0 {
+		return false
+	}
+	for _, p := range paths {
+		if !r.MatchPath(p) {
+			return false
+		}
+	}
+	return true
+}
+
 // ValuesContain returns true if all the values are in r.Values
 func (r Rule) ValuesContain(values ...string) bool {
 	for _, value := range values {
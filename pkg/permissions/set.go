@@ -105,7 +105,7 @@ func (ps Set) Some(predicate func(Rule) bool) bool {
 // is allowed by the set.
 func (ps *Set) RuleInSubset(r2 Rule) bool {
 	for _, r := range *ps {
-		if r.Type != r2.Type {
+		if !r.MatchType(r2.Type) {
 			continue
 		}
 
@@ -121,6 +121,15 @@ func (ps *Set) RuleInSubset(r2 Rule) bool {
 			continue
 		}
 
+		// a path rule contains the rules on the same paths or on their
+		// subdirectories
+		if r.Selector == PathSelector {
+			if r.MatchAllPaths(r2.Values) {
+				return true
+			}
+			continue
+		}
+
 		if r.ValuesContain(r2.Values...) {
 			return true
 		}
@@ -129,6 +138,18 @@ func (ps *Set) RuleInSubset(r2 Rule) bool {
 	return false
 }
 
+// Restrict returns the rules of the set that are allowed by the parent set,
+// without the ones that would give more permissions than the parent.
+func (ps Set) Restrict(parent Set) Set {
+	out := Set{}
+	for _, r := range ps {
+		if parent.RuleInSubset(r) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
 // IsSubSetOf returns true if any document allowed by the set
 // would have been allowed by parent.
 func (ps *Set) IsSubSetOf(parent Set) bool {
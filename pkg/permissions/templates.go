@@ -0,0 +1,65 @@
+package permissions
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/labstack/echo"
+)
+
+// ErrUnknownTemplate is used when a share set is created with a template
+// that is not defined for the context of the instance
+var ErrUnknownTemplate = echo.NewHTTPError(http.StatusBadRequest,
+	"Unknown permissions template")
+
+// GetTemplate returns the rules of the permissions template with the given
+// name, from the configuration of the context.
+func GetTemplate(contextName, name string) (Set, error) {
+	if contextName == "" {
+		contextName = config.DefaultContext
+	}
+	ctx, ok := config.GetConfig().Contexts[contextName]
+	if !ok {
+		return nil, ErrUnknownTemplate
+	}
+	raw, ok := ctx.PermissionTemplates[name]
+	if !ok {
+		return nil, ErrUnknownTemplate
+	}
+	var set Set
+	if err := json.Unmarshal(raw, &set); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// ExpandTemplate returns the rules of a template, with the values given for
+// them in the request. The rules are matched by their title, and only their
+// values are taken: the type, the verbs and the selector come from the
+// template. A rule of the template with a selector must be given values, else
+// it would allow all the documents of its type.
+func ExpandTemplate(tmpl Set, given Set) (Set, error) {
+	values := make(map[string][]string, len(given))
+	for _, r := range given {
+		values[r.Title] = r.Values
+	}
+	out := make(Set, len(tmpl))
+	for i, r := range tmpl {
+		if v, ok := values[r.Title]; ok {
+			r.Values = v
+			delete(values, r.Title)
+		}
+		if r.Selector != "" && len(r.Values) == 0 {
+			return nil, echo.NewHTTPError(http.StatusBadRequest,
+				fmt.Sprintf("The rule %s of the template requires values", r.Title))
+		}
+		out[i] = r
+	}
+	for title := range values {
+		return nil, echo.NewHTTPError(http.StatusBadRequest,
+			fmt.Sprintf("The rule %s is not in the template", title))
+	}
+	return out, nil
+}
@@ -21,7 +21,7 @@ func validValues(r Rule, o Validable) bool {
 }
 
 func validVerbAndType(r Rule, v Verb, doctype string) bool {
-	return r.Verbs.Contains(v) && r.Type == doctype
+	return r.Verbs.Contains(v) && r.MatchType(doctype)
 }
 
 func validWholeType(r Rule) bool {
@@ -9,6 +9,10 @@ const verbSep = ","
 const allVerbs = "ALL"
 const allVerbsLength = 5
 
+// verbExclusion is the prefix of an excluded verb, like -DELETE. A list with
+// only exclusions starts from all the verbs.
+const verbExclusion = "-"
+
 // Verb is one of GET,POST,PUT,PATCH,DELETE
 type Verb string
 
@@ -40,6 +44,9 @@ func (vs VerbSet) ContainsAll(verbs VerbSet) bool {
 	if len(vs) == 0 {
 		return true // empty set = ALL
 	}
+	if len(verbs) == 0 {
+		return len(vs) == allVerbsLength
+	}
 
 	for v := range verbs {
 		_, has := vs[v]
@@ -50,17 +57,25 @@ func (vs VerbSet) ContainsAll(verbs VerbSet) bool {
 	return true
 }
 
+// String returns the canonical form of the VerbSet: ALL for all the verbs,
+// the excluded verbs (like ALL,-DELETE) when there are less excluded verbs
+// than allowed ones, and else the list of the allowed verbs.
 func (vs VerbSet) String() string {
-	out := ""
 	if len(vs) == 0 || len(vs) == allVerbsLength {
 		return allVerbs
 	}
+	var allowed, excluded []string
 	for _, v := range allVerbsOrder {
 		if _, has := vs[v]; has {
-			out += verbSep + string(v)
+			allowed = append(allowed, string(v))
+		} else {
+			excluded = append(excluded, verbExclusion+string(v))
 		}
 	}
-	return out[1:]
+	if len(excluded) < len(allowed) {
+		return allVerbs + verbSep + strings.Join(excluded, verbSep)
+	}
+	return strings.Join(allowed, verbSep)
 }
 
 // MarshalJSON implements json.Marshaller on VerbSet
@@ -91,8 +106,8 @@ func (vs *VerbSet) UnmarshalJSON(b []byte) error {
 	for v := range ALL {
 		delete(*vs, v)
 	}
-	for _, v := range s {
-		(*vs)[Verb(v)] = struct{}{}
+	for v := range parseVerbs(s) {
+		(*vs)[v] = struct{}{}
 	}
 	return nil
 }
@@ -106,13 +121,41 @@ func (vs *VerbSet) Merge(verbs *VerbSet) {
 
 // VerbSplit parse a string into a VerbSet
 func VerbSplit(in string) VerbSet {
-	if in == allVerbs {
-		return ALL
-	}
-	verbs := strings.Split(in, verbSep)
+	return parseVerbs(strings.Split(in, verbSep))
+}
+
+// parseVerbs builds a VerbSet from a list of verbs, where ALL is a shortcut
+// for all the verbs, and a verb prefixed by - is excluded, like in
+// ["ALL", "-DELETE"] or ["-DELETE"].
+func parseVerbs(verbs []string) VerbSet {
 	out := make(VerbSet, len(verbs))
+	var excluded []Verb
 	for _, v := range verbs {
-		out[Verb(v)] = struct{}{}
+		switch {
+		case v == allVerbs:
+			for a := range ALL {
+				out[a] = struct{}{}
+			}
+		case strings.HasPrefix(v, verbExclusion):
+			excluded = append(excluded, Verb(strings.TrimPrefix(v, verbExclusion)))
+		default:
+			out[Verb(v)] = struct{}{}
+		}
+	}
+	if len(excluded) > 0 {
+		if len(out) == 0 {
+			for a := range ALL {
+				out[a] = struct{}{}
+			}
+		}
+		for _, v := range excluded {
+			delete(out, v)
+		}
+		if len(out) == 0 {
+			// An empty set means all the verbs: the empty verb is kept in
+			// the set so that no verb is allowed.
+			out[Verb("")] = struct{}{}
+		}
 	}
 	return out
 }
@@ -14,6 +14,9 @@ type Event struct {
 	DocType  string
 	DocID    string
 	DocRev   string
+	// Doc is the document, when the publisher has it, so that the
+	// subscribers do not need to fetch it
+	Doc interface{}
 }
 
 // The following API is inspired by https://github.com/gocontrib/pubsub
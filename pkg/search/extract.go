@@ -0,0 +1,135 @@
+package search
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"html"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+// MaxContentSize is the maximal size of the text extracted from a file for
+// the index. The rest of the file is not indexed.
+const MaxContentSize = 1 << 20
+
+// maxArchiveSize is the size of the largest office document whose text is
+// extracted, as it is an archive that must be opened as a whole.
+const maxArchiveSize = 50 << 20
+
+// xmlEntries are the entries, in the archives of the office documents, with
+// their text
+var xmlEntries = map[string]string{
+	".docx": "word/document.xml",
+	".xlsx": "xl/sharedStrings.xml",
+	".odt":  "content.xml",
+	".ods":  "content.xml",
+	".odp":  "content.xml",
+}
+
+// CanExtractText returns true if the text of a file with this mime type and
+// name can be extracted for the index.
+func CanExtractText(mime, name string) bool {
+	return isPlainText(mime) || isMarkup(mime) || xmlEntries[strings.ToLower(path.Ext(name))] != ""
+}
+
+func isPlainText(mime string) bool {
+	return mime == "application/json" ||
+		(strings.HasPrefix(mime, "text/") && !isMarkup(mime))
+}
+
+func isMarkup(mime string) bool {
+	switch mime {
+	case "text/html", "text/xml", "application/xml", "application/xhtml+xml":
+		return true
+	}
+	return false
+}
+
+// ExtractText returns the text of a file, for the plain text files, the
+// markup files without their tags, and the text documents, spreadsheets and
+// presentations of the office suites. It returns an empty string for the
+// other formats.
+func ExtractText(r io.ReaderAt, size int64, mime, name string) (string, error) {
+	if isPlainText(mime) {
+		data, err := ioutil.ReadAll(io.NewSectionReader(r, 0, MaxContentSize))
+		return string(data), err
+	}
+	if isMarkup(mime) {
+		data, err := ioutil.ReadAll(io.NewSectionReader(r, 0, MaxContentSize))
+		return stripTags(string(data)), err
+	}
+	entry := xmlEntries[strings.ToLower(path.Ext(name))]
+	if entry == "" || size > maxArchiveSize {
+		return "", nil
+	}
+	z, err := zip.NewReader(r, size)
+	if err != nil {
+		return "", err
+	}
+	for _, f := range z.File {
+		if f.Name != entry {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return "", err
+		}
+		defer rc.Close()
+		return xmlText(rc)
+	}
+	return "", nil
+}
+
+// xmlText returns the character data of an XML document, with a space
+// between the elements
+func xmlText(r io.Reader) (string, error) {
+	var buf bytes.Buffer
+	dec := xml.NewDecoder(r)
+	for buf.Len() < MaxContentSize {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return buf.String(), err
+		}
+		switch t := tok.(type) {
+		case xml.CharData:
+			buf.Write(t)
+		case xml.EndElement:
+			buf.WriteByte(' ')
+		}
+	}
+	return buf.String(), nil
+}
+
+// stripTags removes the tags, and the content of the script and style
+// elements, from a markup text. It does not need the markup to be valid.
+func stripTags(text string) string {
+	var buf bytes.Buffer
+	lower := strings.ToLower(text)
+	for i := 0; i < len(text); {
+		if text[i] != '<' {
+			buf.WriteByte(text[i])
+			i++
+			continue
+		}
+		end := strings.IndexByte(text[i:], '>')
+		if end < 0 {
+			break
+		}
+		for _, skipped := range []string{"script", "style"} {
+			if strings.HasPrefix(lower[i+1:], skipped) {
+				if pos := strings.Index(lower[i:], "</"+skipped); pos > 0 {
+					end = pos + strings.IndexByte(text[i+pos:]+">", '>')
+				}
+			}
+		}
+		buf.WriteByte(' ')
+		i += end + 1
+	}
+	return html.UnescapeString(buf.String())
+}
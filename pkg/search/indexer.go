@@ -0,0 +1,161 @@
+package search
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// changesBatchSize is the number of changes of the files read at once from
+// the changes feed
+const changesBatchSize = 100
+
+// updating serializes the updates of the index of each instance
+var updating = struct {
+	sync.Mutex
+	prefixes map[string]*sync.Mutex
+}{prefixes: make(map[string]*sync.Mutex)}
+
+func lockPrefix(prefix string) *sync.Mutex {
+	updating.Lock()
+	mu, ok := updating.prefixes[prefix]
+	if !ok {
+		mu = &sync.Mutex{}
+		updating.prefixes[prefix] = mu
+	}
+	updating.Unlock()
+	mu.Lock()
+	return mu
+}
+
+// Update reads the changes of the files and directories of an instance since
+// the last update of its index, and indexes them. The first update of an
+// index reads all the files, and extracts their text, so it is called from
+// the index worker, not in the requests.
+func Update(c vfs.Context) error {
+	prefix := c.Prefix()
+	mu := lockPrefix(prefix)
+	defer mu.Unlock()
+
+	e := GetEngine()
+	since, err := e.Seq(prefix)
+	if err != nil {
+		return err
+	}
+	for {
+		res, err := couchdb.GetChanges(c, &couchdb.ChangesRequest{
+			DocType:     consts.Files,
+			IncludeDocs: true,
+			Since:       since,
+			Limit:       changesBatchSize,
+		})
+		if couchdb.IsNoDatabaseError(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for i := range res.Results {
+			if err = indexChange(c, e, &res.Results[i]); err != nil {
+				return err
+			}
+		}
+		if res.LastSeq == "" || res.LastSeq == since {
+			return nil
+		}
+		since = res.LastSeq
+		if err = e.SetSeq(prefix, since); err != nil {
+			return err
+		}
+		if len(res.Results) < changesBatchSize {
+			return nil
+		}
+	}
+}
+
+// Search returns the identifiers of the files and directories of an
+// instance that match the query, the most relevant first, and MaxHits of them
+// at most. The index may be late on the last changes of the files, and the
+// permissions are not checked.
+func Search(c vfs.Context, query string) ([]*Hit, error) {
+	hits, err := GetEngine().Search(c.Prefix(), query)
+	if len(hits) > MaxHits {
+		hits = hits[:MaxHits]
+	}
+	return hits, err
+}
+
+// Drop removes the index of an instance, when it is destroyed
+func Drop(c vfs.Context) error {
+	return GetEngine().Drop(c.Prefix())
+}
+
+func indexChange(c vfs.Context, e Engine, change *couchdb.Change) error {
+	id := change.DocID
+	prefix := c.Prefix()
+	if strings.HasPrefix(id, "_design") || id == consts.RootDirID || id == consts.TrashDirID {
+		return nil
+	}
+	if change.Deleted {
+		return e.Remove(prefix, id)
+	}
+
+	data, err := json.Marshal(change.Doc)
+	if err != nil {
+		return err
+	}
+	var fd vfs.DirOrFileDoc
+	if err = json.Unmarshal(data, &fd); err != nil {
+		return err
+	}
+	dir, file := fd.Refine()
+	switch {
+	case dir != nil:
+		if dir.RestorePath != "" || strings.HasPrefix(dir.Fullpath, vfs.TrashDirName+"/") {
+			return e.Remove(prefix, id)
+		}
+		return e.Index(prefix, &Document{
+			ID:   id,
+			Type: consts.DirType,
+			Name: dir.Name,
+			Tags: dir.Tags,
+		})
+	case file != nil:
+		if file.RestorePath != "" {
+			return e.Remove(prefix, id)
+		}
+		return e.Index(prefix, fileDocument(c, file))
+	}
+	return nil
+}
+
+// fileDocument returns the document to index for a file. The errors on the
+// extraction of its text are ignored: the file is still indexed by its name
+// and tags.
+func fileDocument(c vfs.Context, file *vfs.FileDoc) *Document {
+	doc := &Document{
+		ID:   file.ID(),
+		Type: consts.FileType,
+		Name: file.Name,
+		Tags: file.Tags,
+		Mime: file.Mime,
+	}
+	if file.Size <= 0 || !CanExtractText(file.Mime, file.Name) {
+		return doc
+	}
+	name, err := file.Path(c)
+	if err != nil {
+		return doc
+	}
+	f, err := c.FS().Open(name)
+	if err != nil {
+		return doc
+	}
+	defer f.Close()
+	doc.Content, _ = ExtractText(f, file.Size, file.Mime, file.Name)
+	return doc
+}
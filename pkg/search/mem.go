@@ -0,0 +1,229 @@
+package search
+
+import (
+	"container/list"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The weights of the fields of the documents in the score of a hit
+const (
+	nameWeight    = 4
+	tagsWeight    = 3
+	contentWeight = 1
+)
+
+// maxMemIndexes is the maximal number of indexes kept in memory. When it is
+// reached, the least recently updated index is dropped, and it will be
+// rebuilt on the next update.
+const maxMemIndexes = 100
+
+// memIndex is the inverted index of an instance: for each word, the weight
+// of the word in each document
+type memIndex struct {
+	prefix string
+	seq    string
+	words  map[string]map[string]float64
+	docs   map[string][]string // the words of each document
+}
+
+// memEngine is an Engine that keeps the indexes in memory. They are rebuilt
+// from the changes of the files when the stack is restarted. The indexes are
+// kept in a list sorted by their last update, the most recent first.
+type memEngine struct {
+	mu      sync.RWMutex
+	max     int
+	indexes map[string]*list.Element
+	order   *list.List
+}
+
+// NewMemEngine returns an Engine that keeps the indexes in memory
+func NewMemEngine() Engine {
+	return newMemEngine(maxMemIndexes)
+}
+
+func newMemEngine(max int) *memEngine {
+	return &memEngine{
+		max:     max,
+		indexes: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// lookup returns the index of an instance, or nil if it is not in memory
+func (e *memEngine) lookup(prefix string) *memIndex {
+	if el, ok := e.indexes[prefix]; ok {
+		return el.Value.(*memIndex)
+	}
+	return nil
+}
+
+// getIndex returns the index of an instance, created if needed, and marks it
+// as the most recently updated. The least recently updated indexes are
+// dropped when there are too many of them.
+func (e *memEngine) getIndex(prefix string) *memIndex {
+	if el, ok := e.indexes[prefix]; ok {
+		e.order.MoveToFront(el)
+		return el.Value.(*memIndex)
+	}
+	for e.order.Len() >= e.max {
+		el := e.order.Back()
+		e.order.Remove(el)
+		delete(e.indexes, el.Value.(*memIndex).prefix)
+	}
+	idx := &memIndex{
+		prefix: prefix,
+		words:  make(map[string]map[string]float64),
+		docs:   make(map[string][]string),
+	}
+	e.indexes[prefix] = e.order.PushFront(idx)
+	return idx
+}
+
+func (e *memEngine) Index(prefix string, doc *Document) error {
+	weights := make(map[string]float64)
+	for _, word := range Tokenize(doc.Name) {
+		weights[word] += nameWeight
+	}
+	for _, tag := range doc.Tags {
+		for _, word := range Tokenize(tag) {
+			weights[word] += tagsWeight
+		}
+	}
+	for _, word := range Tokenize(doc.Content) {
+		weights[word] += contentWeight
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	idx := e.getIndex(prefix)
+	idx.remove(doc.ID)
+	words := make([]string, 0, len(weights))
+	for word, weight := range weights {
+		docs, ok := idx.words[word]
+		if !ok {
+			docs = make(map[string]float64)
+			idx.words[word] = docs
+		}
+		docs[doc.ID] = weight
+		words = append(words, word)
+	}
+	idx.docs[doc.ID] = words
+	return nil
+}
+
+func (e *memEngine) Remove(prefix, id string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if idx := e.lookup(prefix); idx != nil {
+		idx.remove(id)
+	}
+	return nil
+}
+
+func (idx *memIndex) remove(id string) {
+	for _, word := range idx.docs[id] {
+		docs := idx.words[word]
+		delete(docs, id)
+		if len(docs) == 0 {
+			delete(idx.words, word)
+		}
+	}
+	delete(idx.docs, id)
+}
+
+// Search looks for the documents that have all the words of the query. The
+// last word of the query also matches the longer words that start with it,
+// so that the results can be shown while the user is typing.
+func (e *memEngine) Search(prefix, query string) ([]*Hit, error) {
+	terms := Tokenize(query)
+	if len(terms) == 0 {
+		return []*Hit{}, nil
+	}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	idx := e.lookup(prefix)
+	if idx == nil {
+		return []*Hit{}, nil
+	}
+
+	var scores map[string]float64
+	for i, term := range terms {
+		matches := make(map[string]float64)
+		for id, weight := range idx.words[term] {
+			matches[id] += weight
+		}
+		if i == len(terms)-1 {
+			for word, docs := range idx.words {
+				if word == term || !strings.HasPrefix(word, term) {
+					continue
+				}
+				for id, weight := range docs {
+					matches[id] += weight / 2
+				}
+			}
+		}
+		if scores == nil {
+			scores = matches
+			continue
+		}
+		for id, score := range scores {
+			if weight, ok := matches[id]; ok {
+				scores[id] = score + weight
+			} else {
+				delete(scores, id)
+			}
+		}
+	}
+
+	hits := make(hitsByScore, 0, len(scores))
+	for id, score := range scores {
+		hits = append(hits, &Hit{ID: id, Score: score})
+	}
+	sort.Sort(hits)
+	return hits, nil
+}
+
+// Seq is called at the beginning of each update of an index, so it marks the
+// index as recently updated, even if there is no change to index.
+func (e *memEngine) Seq(prefix string) (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if el, ok := e.indexes[prefix]; ok {
+		e.order.MoveToFront(el)
+		return el.Value.(*memIndex).seq, nil
+	}
+	return "", nil
+}
+
+func (e *memEngine) SetSeq(prefix, seq string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.getIndex(prefix).seq = seq
+	return nil
+}
+
+func (e *memEngine) Drop(prefix string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if el, ok := e.indexes[prefix]; ok {
+		e.order.Remove(el)
+		delete(e.indexes, prefix)
+	}
+	return nil
+}
+
+// hitsByScore sorts the hits by decreasing score, and by id for the same
+// score, so that the results are stable
+type hitsByScore []*Hit
+
+func (h hitsByScore) Len() int      { return len(h) }
+func (h hitsByScore) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h hitsByScore) Less(i, j int) bool {
+	if h[i].Score != h[j].Score {
+		return h[i].Score > h[j].Score
+	}
+	return h[i].ID < h[j].ID
+}
@@ -0,0 +1,87 @@
+// Package search is the full-text indexing of the virtual file system of
+// the instances: the names, tags and extracted text of the files, and the
+// names and tags of the directories. The indexes are kept by an Engine, and
+// fed by the changes feed of the io.cozy.files database.
+package search
+
+import (
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const (
+	// DefaultLimit is the number of results of a search by default
+	DefaultLimit = 30
+	// MaxLimit is the maximal number of results of a search
+	MaxLimit = 100
+	// MaxHits is the maximal number of hits returned by Search. Each hit is
+	// read again and checked against the permissions of the request, so they
+	// must be bounded, even if most of them are not readable.
+	MaxHits = 1000
+)
+
+// Document is what is indexed for a file or a directory
+type Document struct {
+	ID   string
+	Type string
+	Name string
+	Tags []string
+	Mime string
+	// Content is the text extracted from the content of a file
+	Content string
+}
+
+// Hit is a document that matches a query, with its relevance
+type Hit struct {
+	ID    string  `json:"id"`
+	Score float64 `json:"score"`
+}
+
+// Engine is the interface of the full-text indexes. There is one index for
+// each instance, identified by the prefix of its databases. The engine also
+// keeps, with the index, the sequence of the last change of the
+// io.cozy.files database that has been indexed.
+type Engine interface {
+	// Index adds or replaces a document in the index of an instance
+	Index(prefix string, doc *Document) error
+	// Remove removes a document from the index of an instance
+	Remove(prefix, id string) error
+	// Search returns the documents of the index of an instance that match all
+	// the words of the query, the most relevant first
+	Search(prefix, query string) ([]*Hit, error)
+	// Seq returns the sequence of the last indexed change of an instance
+	Seq(prefix string) (string, error)
+	// SetSeq saves the sequence of the last indexed change of an instance
+	SetSeq(prefix, seq string) error
+	// Drop removes the index of an instance
+	Drop(prefix string) error
+}
+
+var (
+	engineMu sync.RWMutex
+	engine   Engine = NewMemEngine()
+)
+
+// GetEngine returns the engine used for the indexes
+func GetEngine() Engine {
+	engineMu.RLock()
+	defer engineMu.RUnlock()
+	return engine
+}
+
+// SetEngine replaces the engine used for the indexes, for example by one
+// backed by an external search server. The indexes are rebuilt from the
+// changes of the files.
+func SetEngine(e Engine) {
+	engineMu.Lock()
+	engine = e
+	engineMu.Unlock()
+}
+
+// Tokenize splits a text in the lowercased words used by the indexes
+func Tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
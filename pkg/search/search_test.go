@@ -0,0 +1,132 @@
+package search
+
+import (
+	"archive/zip"
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenize(t *testing.T) {
+	assert.Equal(t, []string{"hello", "world", "2017", "été"}, Tokenize("Hello, World! 2017 - Été"))
+	assert.Len(t, Tokenize(" -- "), 0)
+}
+
+func TestMemEngine(t *testing.T) {
+	e := NewMemEngine()
+	assert.NoError(t, e.Index("test/", &Document{ID: "1", Name: "Report 2017.txt", Content: "quarterly figures"}))
+	assert.NoError(t, e.Index("test/", &Document{ID: "2", Name: "notes.md", Tags: []string{"report"}}))
+	assert.NoError(t, e.Index("test/", &Document{ID: "3", Name: "photo.jpg"}))
+	assert.NoError(t, e.Index("other/", &Document{ID: "4", Name: "report.odt"}))
+
+	hits, err := e.Search("test/", "report")
+	assert.NoError(t, err)
+	if assert.Len(t, hits, 2) {
+		assert.Equal(t, "1", hits[0].ID)
+		assert.Equal(t, "2", hits[1].ID)
+	}
+
+	hits, err = e.Search("test/", "report quart")
+	assert.NoError(t, err)
+	if assert.Len(t, hits, 1) {
+		assert.Equal(t, "1", hits[0].ID)
+	}
+
+	assert.NoError(t, e.Index("test/", &Document{ID: "1", Name: "Budget.txt"}))
+	hits, err = e.Search("test/", "report")
+	assert.NoError(t, err)
+	if assert.Len(t, hits, 1) {
+		assert.Equal(t, "2", hits[0].ID)
+	}
+
+	assert.NoError(t, e.Remove("test/", "2"))
+	hits, err = e.Search("test/", "report")
+	assert.NoError(t, err)
+	assert.Len(t, hits, 0)
+
+	assert.NoError(t, e.SetSeq("test/", "42-abc"))
+	seq, err := e.Seq("test/")
+	assert.NoError(t, err)
+	assert.Equal(t, "42-abc", seq)
+	assert.NoError(t, e.Drop("test/"))
+	seq, err = e.Seq("test/")
+	assert.NoError(t, err)
+	assert.Equal(t, "", seq)
+}
+
+func TestMemEngineEviction(t *testing.T) {
+	e := newMemEngine(2)
+	assert.NoError(t, e.Index("a/", &Document{ID: "1", Name: "report"}))
+	assert.NoError(t, e.SetSeq("a/", "1-a"))
+	assert.NoError(t, e.Index("b/", &Document{ID: "2", Name: "report"}))
+	_, err := e.Seq("a/")
+	assert.NoError(t, err)
+	assert.NoError(t, e.Index("c/", &Document{ID: "3", Name: "report"}))
+
+	hits, err := e.Search("b/", "report")
+	assert.NoError(t, err)
+	assert.Len(t, hits, 0)
+	hits, err = e.Search("a/", "report")
+	assert.NoError(t, err)
+	assert.Len(t, hits, 1)
+	hits, err = e.Search("c/", "report")
+	assert.NoError(t, err)
+	assert.Len(t, hits, 1)
+	seq, err := e.Seq("a/")
+	assert.NoError(t, err)
+	assert.Equal(t, "1-a", seq)
+}
+
+type testContext struct {
+	couchdb.Database
+}
+
+func (c testContext) FS() afero.Fs { return nil }
+
+func TestSearchMaxHits(t *testing.T) {
+	e := NewMemEngine()
+	previous := GetEngine()
+	SetEngine(e)
+	defer SetEngine(previous)
+
+	for i := 0; i <= MaxHits; i++ {
+		doc := &Document{ID: strconv.Itoa(i), Name: "report"}
+		assert.NoError(t, e.Index("max/", doc))
+	}
+	hits, err := Search(testContext{couchdb.NewDatabase("max/", "")}, "report")
+	assert.NoError(t, err)
+	assert.Len(t, hits, MaxHits)
+}
+
+func TestExtractText(t *testing.T) {
+	assert.True(t, CanExtractText("text/plain", "foo.txt"))
+	assert.True(t, CanExtractText("application/octet-stream", "foo.docx"))
+	assert.False(t, CanExtractText("image/png", "foo.png"))
+
+	plain := "some plain text"
+	text, err := ExtractText(strings.NewReader(plain), int64(len(plain)), "text/plain", "foo.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, plain, text)
+
+	page := `<html><head><style>body { color: red }</style></head><body><p>Tom &amp; Jerry</p><script>var x = 1;</script></body></html>`
+	text, err = ExtractText(strings.NewReader(page), int64(len(page)), "text/html", "foo.html")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"tom", "jerry"}, Tokenize(text))
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("word/document.xml")
+	assert.NoError(t, err)
+	_, err = w.Write([]byte(`<w:document><w:body><w:p><w:r><w:t>Hello</w:t></w:r></w:p><w:p><w:r><w:t>docx</w:t></w:r></w:p></w:body></w:document>`))
+	assert.NoError(t, err)
+	assert.NoError(t, zw.Close())
+	data := buf.Bytes()
+	text, err = ExtractText(bytes.NewReader(data), int64(len(data)), "application/octet-stream", "foo.docx")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"hello", "docx"}, Tokenize(text))
+}
@@ -91,9 +91,20 @@ func GetSession(c echo.Context, i *instance.Instance) (*Session, error) {
 		return nil, ErrNoCookie
 	}
 
+	resign := false
 	sessionID, err := crypto.DecodeAuthMessage(cookieMACConfig(i), []byte(cookie.Value))
 	if err != nil {
-		return nil, err
+		// The cookie may have been signed before a rotation of the secrets
+		resign = true
+		previous := i.PreviousSessionKey()
+		if previous == nil {
+			return nil, err
+		}
+		config := cookieMACConfig(i)
+		config.Key = previous
+		if sessionID, err = crypto.DecodeAuthMessage(config, []byte(cookie.Value)); err != nil {
+			return nil, err
+		}
 	}
 
 	err = couchdb.GetDoc(i, consts.Sessions, string(sessionID), &s)
@@ -115,14 +126,25 @@ func GetSession(c echo.Context, i *instance.Instance) (*Session, error) {
 		}
 	}
 
+	// a cookie signed with the previous secret is replaced by a new one, to
+	// keep the session after the grace period
+	if resign {
+		s.Instance = i
+		if cookie, err := s.ToCookie(); err == nil {
+			c.SetCookie(cookie)
+		}
+	}
+
 	c.Set(SessionContextKey, &s)
 	return &s, nil
 }
 
 // Delete is a function to delete the session in couchdb,
-// and returns a cookie with a negative MaxAge to clear it
+// and returns a cookie with a negative MaxAge to clear it. If CouchDB is
+// unavailable, the deletion is queued to be sure that the session won't be
+// usable again when CouchDB is back.
 func (s *Session) Delete(i *instance.Instance) *http.Cookie {
-	err := couchdb.DeleteDoc(i, s)
+	err := couchdb.DeleteDocOrQueue(i, s)
 	if err != nil {
 		log.Error("[session] Failed to delete session:", err)
 	}
@@ -148,7 +170,7 @@ func (s *Session) ToCookie() (*http.Cookie, error) {
 		MaxAge:   SessionMaxAge,
 		Path:     "/",
 		Domain:   utils.StripPort("." + s.Instance.Domain),
-		Secure:   !s.Instance.Dev,
+		Secure:   !s.Instance.Dev.AllowHTTP,
 		HttpOnly: true,
 	}, nil
 }
@@ -166,7 +188,7 @@ func (s *Session) ToAppCookie(domain string) (*http.Cookie, error) {
 		MaxAge:   86400, // 1 day
 		Path:     "/",
 		Domain:   utils.StripPort(domain),
-		Secure:   !s.Instance.Dev,
+		Secure:   !s.Instance.Dev.AllowHTTP,
 		HttpOnly: true,
 	}, nil
 }
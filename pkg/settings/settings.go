@@ -11,6 +11,11 @@ import (
 // default theme
 const DefaultThemeID = consts.Settings + "-theme"
 
+// The settings of the instance and the theme are read on most requests
+func init() {
+	couchdb.CacheDoctypes(consts.Settings)
+}
+
 // Theme is a struct that contains all the values for the CSS variables used
 // in the CSS called "theme.css". This stylesheet is ued by the client-side
 // apps for having a common look that can be customized by the user.
@@ -0,0 +1,46 @@
+package sharings
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/oauth"
+)
+
+// SendAnswer sends the answer of the recipient to a sharing request to the
+// cozy of the sharer, on the redirect_uri of its OAuth client. The sharing is
+// refused if the scope or the access code is empty. The request is signed with
+// the secret of the OAuth client, so that the sharer can check it.
+func SendAnswer(i *instance.Instance, state, clientID, redirectURI, scope, accessCode string) error {
+	if state == "" {
+		return ErrMissingState
+	}
+	client, err := oauth.FindClient(i, clientID)
+	if err != nil {
+		return ErrNoOAuthClient
+	}
+	if !client.AcceptRedirectURI(redirectURI) {
+		return ErrBadRedirectURI
+	}
+
+	form := url.Values{
+		"state":     {state},
+		"client_id": {clientID},
+	}
+	if scope != "" && accessCode != "" {
+		form.Set("scope", scope)
+		form.Set("access_code", accessCode)
+	}
+	res, err := SendSignedRequest(http.MethodPost, redirectURI,
+		"application/x-www-form-urlencoded", []byte(form.Encode()), client.ClientSecret)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("The answer to the sharing has been rejected: %s", res.Status)
+	}
+	return nil
+}
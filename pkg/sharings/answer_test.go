@@ -0,0 +1,94 @@
+package sharings
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/oauth"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendAnswerRefusal(t *testing.T) {
+	state := "sharing-answered"
+
+	// The sharer side receives the answer like the /sharings/answer route
+	var received *http.Request
+	var receivedBody []byte
+	sharer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if !assert.NoError(t, err) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received, receivedBody = r, body
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		st := r.FormValue("state")
+		id := r.FormValue("client_id")
+		if err = VerifyAnswer(TestPrefix, r, body, st, id); err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if err = SharingRefused(TestPrefix, st, id); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer sharer.Close()
+	answerURI := sharer.URL + "/sharings/answer"
+
+	// The sharer has registered an OAuth client on the cozy of the recipient
+	client := &oauth.Client{
+		ClientSecret: "the-secret-of-the-client",
+		RedirectURIs: []string{answerURI},
+		ClientName:   "sharer",
+	}
+	assert.NoError(t, couchdb.CreateDoc(in, client))
+	clientID := client.CouchID
+
+	recipient := &Recipient{
+		URL: "https://" + in.Domain,
+		Client: &oauth.Client{
+			ClientID:     clientID,
+			ClientSecret: client.ClientSecret,
+			RedirectURIs: []string{answerURI},
+		},
+	}
+	assert.NoError(t, couchdb.CreateDoc(TestPrefix, recipient))
+	sharing := &Sharing{
+		Owner:       true,
+		SharingID:   state,
+		SharingType: consts.OneShotSharing,
+		RecipientsStatus: []*RecipientStatus{{
+			Status:       consts.PendingSharingStatus,
+			RefRecipient: jsonapi.ResourceIdentifier{ID: recipient.RID},
+		}},
+	}
+	assert.NoError(t, couchdb.CreateDoc(TestPrefix, sharing))
+
+	err := SendAnswer(in, state, clientID, "https://evil.example.net/", "", "")
+	assert.Equal(t, ErrBadRedirectURI, err)
+	err = SendAnswer(in, state, "unknown-client", answerURI, "", "")
+	assert.Equal(t, ErrNoOAuthClient, err)
+
+	err = SendAnswer(in, state, clientID, answerURI, "", "")
+	assert.NoError(t, err)
+
+	var updated Sharing
+	assert.NoError(t, couchdb.GetDoc(TestPrefix, consts.Sharings, sharing.SID, &updated))
+	if assert.Len(t, updated.RecipientsStatus, 1) {
+		assert.Equal(t, consts.RefusedSharingStatus, updated.RecipientsStatus[0].Status)
+	}
+
+	// The same answer can't be sent again
+	if assert.NotNil(t, received) {
+		err = VerifyAnswer(TestPrefix, received, receivedBody, state, clientID)
+		assert.Equal(t, ErrReplayedRequest, err)
+	}
+}
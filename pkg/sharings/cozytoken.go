@@ -0,0 +1,65 @@
+package sharings
+
+import (
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/oauth"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	jwt "gopkg.in/dgrijalva/jwt-go.v3"
+)
+
+// CozyTokenAudience is the audience of the tokens made by a cozy for another
+// cozy in a sharing
+const CozyTokenAudience = "cozy"
+
+// CozyTokenValidityDuration is the duration during which a token made for
+// another cozy is valid
+var CozyTokenValidityDuration = 5 * time.Minute
+
+// MakeCozyToken makes a token that the cozy of the sharer can send to the
+// cozy of a recipient to authenticate itself. It is signed with the secret of
+// the OAuth client that the sharer has registered on the cozy of the
+// recipient, and the scope is the identifier of the sharing.
+func MakeCozyToken(i *instance.Instance, rec *Recipient, sharingID string) (string, error) {
+	client := rec.Client
+	if client == nil || client.ClientID == "" || client.ClientSecret == "" {
+		return "", ErrNoOAuthClient
+	}
+	return crypto.NewJWT([]byte(client.ClientSecret), permissions.Claims{
+		StandardClaims: jwt.StandardClaims{
+			Audience: CozyTokenAudience,
+			Issuer:   i.Domain,
+			Subject:  client.ClientID,
+			IssuedAt: crypto.Timestamp(),
+		},
+		Scope: sharingID,
+	})
+}
+
+// VerifyCozyToken checks a token made by the cozy of a sharer with
+// MakeCozyToken: its subject must be an OAuth client registered on this
+// instance, and it must be signed with the secret of this client.
+func VerifyCozyToken(i *instance.Instance, token string) (*permissions.Claims, error) {
+	claims := &permissions.Claims{}
+	keyFunc := func(t *jwt.Token) (interface{}, error) {
+		c, ok := t.Claims.(*permissions.Claims)
+		if !ok || c.Audience != CozyTokenAudience || c.Subject == "" {
+			return nil, ErrInvalidCozyToken
+		}
+		client, err := oauth.FindClient(i, c.Subject)
+		if err != nil || client.ClientSecret == "" {
+			return nil, ErrInvalidCozyToken
+		}
+		return []byte(client.ClientSecret), nil
+	}
+	if err := crypto.ParseJWT(token, keyFunc, claims); err != nil {
+		return nil, ErrInvalidCozyToken
+	}
+	issuedAt := time.Unix(claims.IssuedAt, 0)
+	if issuedAt.Add(CozyTokenValidityDuration).Before(time.Now()) {
+		return nil, ErrExpiredCozyToken
+	}
+	return claims, nil
+}
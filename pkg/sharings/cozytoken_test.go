@@ -0,0 +1,72 @@
+package sharings
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/oauth"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyCozyToken(t *testing.T) {
+	// The sharer has registered an OAuth client on the cozy of the recipient
+	client := &oauth.Client{
+		ClientSecret: "the-secret-of-the-sharer",
+		RedirectURIs: []string{"https://alice.cozy.example.net/sharings/answer"},
+		ClientName:   "alice",
+	}
+	if !assert.NoError(t, couchdb.CreateDoc(in, client)) {
+		return
+	}
+
+	// The sharer keeps the credentials of this client in the recipient
+	sharer := &instance.Instance{Domain: "alice.cozy.example.net"}
+	recipient := &Recipient{
+		URL: "https://" + in.Domain,
+		Client: &oauth.Client{
+			ClientID:     client.CouchID,
+			ClientSecret: client.ClientSecret,
+		},
+	}
+	token, err := MakeCozyToken(sharer, recipient, "sharing-id")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// The recipient verifies the token with the client registered on its cozy
+	claims, err := VerifyCozyToken(in, token)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "alice.cozy.example.net", claims.Issuer)
+		assert.Equal(t, "sharing-id", claims.Scope)
+	}
+
+	// A token signed with another secret is refused
+	forger := &Recipient{Client: &oauth.Client{
+		ClientID:     client.CouchID,
+		ClientSecret: "not-the-secret",
+	}}
+	forged, _ := MakeCozyToken(sharer, forger, "sharing-id")
+	_, err = VerifyCozyToken(in, forged)
+	assert.Equal(t, ErrInvalidCozyToken, err)
+
+	// A token for a client unknown to the recipient is refused
+	unknown := &Recipient{Client: &oauth.Client{
+		ClientID:     "unknown-client",
+		ClientSecret: client.ClientSecret,
+	}}
+	forged, _ = MakeCozyToken(sharer, unknown, "sharing-id")
+	_, err = VerifyCozyToken(in, forged)
+	assert.Equal(t, ErrInvalidCozyToken, err)
+
+	// A token made long ago is expired
+	validity := CozyTokenValidityDuration
+	CozyTokenValidityDuration = -time.Minute
+	defer func() { CozyTokenValidityDuration = validity }()
+	_, err = VerifyCozyToken(in, token)
+	assert.Equal(t, ErrExpiredCozyToken, err)
+
+	_, err = MakeCozyToken(sharer, &Recipient{}, "sharing-id")
+	assert.Equal(t, ErrNoOAuthClient, err)
+}
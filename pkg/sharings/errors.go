@@ -23,6 +23,30 @@ var (
 	// ErrNoOAuthClient is used when the owner of the Cozy has not yet
 	// registered to the recipient as an OAuth client.
 	ErrNoOAuthClient = errors.New("No OAuth client was found")
+	// ErrBadRedirectURI is used when the redirect_uri of an answer is not
+	// one of the redirect URIs of the OAuth client
+	ErrBadRedirectURI = errors.New("Incorrect redirect_uri")
 	//ErrSharingIDNotUnique is used when several occurences of the same sharing id are found
 	ErrSharingIDNotUnique = errors.New("Several sharings with this id found")
+	// ErrMissingSignature is used when a request from another cozy is not
+	// signed
+	ErrMissingSignature = errors.New("The request is not signed")
+	// ErrInvalidSignature is used when the signature of a request from
+	// another cozy is not valid
+	ErrInvalidSignature = errors.New("Invalid signature")
+	// ErrExpiredSignature is used when a signed request is too old (or too
+	// far in the future)
+	ErrExpiredSignature = errors.New("The signature has expired")
+	// ErrReplayedRequest is used when a signed request has already been
+	// received
+	ErrReplayedRequest = errors.New("The request has already been received")
+	// ErrBodyTooLarge is used when the body of a signed request is larger
+	// than MaxSignedBodySize
+	ErrBodyTooLarge = errors.New("The body of the request is too large")
+	// ErrInvalidCozyToken is used when a token made by another cozy is not
+	// valid
+	ErrInvalidCozyToken = errors.New("Invalid token from another cozy")
+	// ErrExpiredCozyToken is used when a token made by another cozy is too
+	// old
+	ErrExpiredCozyToken = errors.New("The token from another cozy has expired")
 )
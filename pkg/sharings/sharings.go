@@ -1,6 +1,8 @@
 package sharings
 
 import (
+	"net/http"
+
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
@@ -177,6 +179,21 @@ func findSharingRecipient(db couchdb.Database, sharingID, clientID string) (*Sha
 	return sharing, sRec, nil
 }
 
+// VerifyAnswer checks the signature of an answer sent by the cozy of a
+// recipient, with the secret of the OAuth client of the sharer for this
+// recipient.
+func VerifyAnswer(db couchdb.Database, req *http.Request, body []byte, state, clientID string) error {
+	_, recStatus, err := findSharingRecipient(db, state, clientID)
+	if err != nil {
+		return err
+	}
+	var secret string
+	if client := recStatus.recipient.Client; client != nil {
+		secret = client.ClientSecret
+	}
+	return VerifyRequest(req, body, secret)
+}
+
 // SharingRefused handles a rejectedsharing on the sharer side
 func SharingRefused(db couchdb.Database, state, clientID string) error {
 	sharing, recStatus, err := findSharingRecipient(db, state, clientID)
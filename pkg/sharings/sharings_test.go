@@ -271,6 +271,12 @@ func TestMain(m *testing.M) {
 		os.Exit(1)
 	}
 
+	err = couchdb.ResetDB(in, consts.OAuthClients)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
 	settingsDoc := &couchdb.JSONDoc{
 		Type: consts.Settings,
 		M:    make(map[string]interface{}),
@@ -291,5 +297,6 @@ func TestMain(m *testing.M) {
 	res := m.Run()
 	couchdb.DeleteDB(TestPrefix, consts.Sharings)
 	couchdb.DeleteDB(in, consts.Settings)
+	couchdb.DeleteDB(in, consts.OAuthClients)
 	os.Exit(res)
 }
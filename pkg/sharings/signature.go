@@ -0,0 +1,159 @@
+package sharings
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/utils"
+)
+
+const (
+	// TimestampHeader is the header with the unix time of the signature
+	TimestampHeader = "X-Cozy-Timestamp"
+	// NonceHeader is the header with the random nonce of a signed request
+	NonceHeader = "X-Cozy-Nonce"
+	// SignatureHeader is the header with the HMAC of a signed request
+	SignatureHeader = "X-Cozy-Signature"
+
+	// MaxClockSkew is the maximal difference between the timestamp of a
+	// signed request and the clock of the stack that receives it
+	MaxClockSkew = 5 * time.Minute
+
+	// MaxSignedBodySize is the maximal size of the body of a signed request
+	// that the stack reads to check its signature
+	MaxSignedBodySize = 1 << 20
+
+	nonceLength = 32
+)
+
+var cozyClient = &http.Client{
+	Timeout: 30 * time.Second,
+}
+
+// SendSignedRequest sends a request to the stack of another cozy, signed with
+// the given secret. All the requests between the stacks for a sharing are sent
+// with it, so that they can be checked with VerifyRequest.
+func SendSignedRequest(method, u, contentType string, body []byte, secret string) (*http.Response, error) {
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	SignRequest(req, body, secret)
+	return cozyClient.Do(req)
+}
+
+// ReadSignedBody reads the body of a request sent by the stack of another
+// cozy, for the check of its signature, and puts it back on the request so
+// that its form can still be parsed. A body larger than MaxSignedBodySize is
+// refused.
+func ReadSignedBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, MaxSignedBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > MaxSignedBodySize {
+		return nil, ErrBodyTooLarge
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// SignRequest adds the headers for the signature of a request sent to the
+// stack of another cozy: a timestamp, a random nonce and a HMAC-SHA256 of the
+// request made with the given secret. The body is the body of the request.
+func SignRequest(req *http.Request, body []byte, secret string) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := utils.RandomString(nonceLength)
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(NonceHeader, nonce)
+	req.Header.Set(SignatureHeader, signature(req, body, timestamp, nonce, secret))
+}
+
+// VerifyRequest checks the signature of a request sent by the stack of
+// another cozy. The request is rejected if its timestamp is too far from the
+// current time, or if its nonce has already been seen, so that a captured
+// request can't be sent again.
+func VerifyRequest(req *http.Request, body []byte, secret string) error {
+	timestamp := req.Header.Get(TimestampHeader)
+	nonce := req.Header.Get(NonceHeader)
+	sig := req.Header.Get(SignatureHeader)
+	if timestamp == "" || nonce == "" || sig == "" {
+		return ErrMissingSignature
+	}
+	if secret == "" {
+		return ErrInvalidSignature
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	signedAt := time.Unix(ts, 0)
+	now := time.Now()
+	if signedAt.Before(now.Add(-MaxClockSkew)) || signedAt.After(now.Add(MaxClockSkew)) {
+		return ErrExpiredSignature
+	}
+	expected := signature(req, body, timestamp, nonce, secret)
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		return ErrInvalidSignature
+	}
+	if !nonces.add(nonce, signedAt.Add(MaxClockSkew), now) {
+		return ErrReplayedRequest
+	}
+	return nil
+}
+
+// signature computes the HMAC of the method, the path and query-string, the
+// timestamp, the nonce and the body of a request.
+func signature(req *http.Request, body []byte, timestamp, nonce, secret string) string {
+	bodyHash := sha256.Sum256(body)
+	msg := strings.Join([]string{
+		req.Method,
+		req.URL.RequestURI(),
+		timestamp,
+		nonce,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(msg))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// replayCache keeps the nonces of the signed requests until their timestamp
+// is too old for the request to be accepted anyway.
+type replayCache struct {
+	mu     sync.Mutex
+	nonces map[string]time.Time
+}
+
+var nonces = &replayCache{nonces: make(map[string]time.Time)}
+
+// add records a nonce, and returns false if it was already known
+func (c *replayCache) add(nonce string, expiresAt, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for n, exp := range c.nonces {
+		if exp.Before(now) {
+			delete(c.nonces, n)
+		}
+	}
+	if _, ok := c.nonces[nonce]; ok {
+		return false
+	}
+	c.nonces[nonce] = expiresAt
+	return true
+}
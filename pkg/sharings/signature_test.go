@@ -0,0 +1,93 @@
+package sharings
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func signedRequest(body []byte, secret string) *http.Request {
+	req, _ := http.NewRequest("POST", "https://alice.cozy.example.net/sharings/answer?foo=bar", bytes.NewReader(body))
+	SignRequest(req, body, secret)
+	return req
+}
+
+func TestVerifyRequest(t *testing.T) {
+	body := []byte("state=foo&client_id=bar")
+	req := signedRequest(body, "secret")
+	assert.NoError(t, VerifyRequest(req, body, "secret"))
+	assert.Equal(t, ErrReplayedRequest, VerifyRequest(req, body, "secret"))
+
+	req = signedRequest(body, "secret")
+	assert.Equal(t, ErrInvalidSignature, VerifyRequest(req, body, "other"))
+	assert.Equal(t, ErrInvalidSignature, VerifyRequest(req, []byte("state=foo"), "secret"))
+	assert.Equal(t, ErrInvalidSignature, VerifyRequest(req, body, ""))
+
+	req = signedRequest(body, "secret")
+	req.Header.Del(NonceHeader)
+	assert.Equal(t, ErrMissingSignature, VerifyRequest(req, body, "secret"))
+
+	req = signedRequest(body, "secret")
+	old := time.Now().Add(-2 * MaxClockSkew).Unix()
+	req.Header.Set(TimestampHeader, strconv.FormatInt(old, 10))
+	assert.Equal(t, ErrExpiredSignature, VerifyRequest(req, body, "secret"))
+}
+
+func TestReplayCache(t *testing.T) {
+	cache := &replayCache{nonces: make(map[string]time.Time)}
+	now := time.Now()
+	assert.True(t, cache.add("foo", now.Add(time.Minute), now))
+	assert.False(t, cache.add("foo", now.Add(time.Minute), now))
+	assert.True(t, cache.add("bar", now.Add(time.Minute), now))
+
+	later := now.Add(2 * time.Minute)
+	assert.True(t, cache.add("foo", later.Add(time.Minute), later))
+	assert.Len(t, cache.nonces, 1)
+}
+
+func TestSendSignedRequest(t *testing.T) {
+	body := []byte("state=foo&client_id=bar")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, err := ReadSignedBody(r)
+		if err == nil {
+			err = VerifyRequest(r, received, "secret")
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		assert.Equal(t, "foo", r.FormValue("state"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	res, err := SendSignedRequest("POST", ts.URL+"/sharings/answer",
+		"application/x-www-form-urlencoded", body, "secret")
+	if assert.NoError(t, err) {
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	}
+	res, err = SendSignedRequest("POST", ts.URL+"/sharings/answer",
+		"application/x-www-form-urlencoded", body, "other")
+	if assert.NoError(t, err) {
+		res.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	}
+}
+
+func TestReadSignedBody(t *testing.T) {
+	req := signedRequest(bytes.Repeat([]byte("a"), MaxSignedBodySize), "secret")
+	body, err := ReadSignedBody(req)
+	if assert.NoError(t, err) {
+		assert.Len(t, body, MaxSignedBodySize)
+	}
+
+	req = signedRequest(bytes.Repeat([]byte("a"), MaxSignedBodySize+1), "secret")
+	_, err = ReadSignedBody(req)
+	assert.Equal(t, ErrBodyTooLarge, err)
+}
@@ -0,0 +1,172 @@
+// Package testutils can be used in the tests of the stack, or of tools built
+// on it, to create an instance with temporary databases, to make tokens, and
+// to run the echo handlers on a test server.
+package testutils
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cozy/checkup"
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/oauth"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/cozy/cozy-stack/web/errors"
+	"github.com/labstack/echo"
+)
+
+// NeedCouchdb kills the process if there is no CouchDB running. The in-memory
+// backend, configured with a mem:// URL for CouchDB, is always available.
+func NeedCouchdb() {
+	if couchdb.InMemory() {
+		return
+	}
+	db, err := checkup.HTTPChecker{URL: config.CouchURL()}.Check()
+	if err != nil || db.Status() != checkup.Healthy {
+		fmt.Println("This test need couchdb to run.")
+		os.Exit(1)
+	}
+}
+
+// TestSetup is a wrapper around a testing.M, to create an instance, a client
+// and a test server, and to clean up after the tests.
+//
+// It is meant to be used in a TestMain function:
+//
+//	func TestMain(m *testing.M) {
+//	    config.UseTestFile()
+//	    testutils.NeedCouchdb()
+//	    setup := testutils.NewSetup(m, "permissions_test")
+//	    testInstance = setup.GetTestInstance()
+//	    _, token = setup.GetTestClient("io.cozy.contacts")
+//	    ts = setup.GetTestServer("/permissions", Routes)
+//	    os.Exit(setup.Run())
+//	}
+type TestSetup struct {
+	testM    *testing.M
+	name     string
+	inst     *instance.Instance
+	cleanups []func()
+}
+
+// NewSetup returns a new TestSetup. The name is used to build the domain of
+// the instance, and should be unique for each package.
+func NewSetup(testM *testing.M, name string) *TestSetup {
+	return &TestSetup{testM: testM, name: name}
+}
+
+// AddCleanup adds a function to call when the tests are finished. The
+// functions are called in the reverse order of their addition.
+func (c *TestSetup) AddCleanup(f func()) {
+	c.cleanups = append(c.cleanups, f)
+}
+
+// Cleanup removes the instance, with its databases, and closes the test
+// server.
+func (c *TestSetup) Cleanup() {
+	for j := len(c.cleanups) - 1; j >= 0; j-- {
+		c.cleanups[j]()
+	}
+	c.cleanups = nil
+}
+
+// CleanupAndDie cleans up and exits the process with the given message. It
+// can be used when the setup has failed.
+func (c *TestSetup) CleanupAndDie(msg ...interface{}) {
+	c.Cleanup()
+	fmt.Println(msg...)
+	os.Exit(1)
+}
+
+// Run runs the tests and cleans up after them. It returns the exit code for
+// os.Exit.
+func (c *TestSetup) Run() int {
+	res := c.testM.Run()
+	c.Cleanup()
+	return res
+}
+
+// GetTestInstance creates an instance, with a random domain. Its databases
+// and files are removed by Cleanup. The files are kept in memory with the
+// mem:// storage of the test configuration.
+func (c *TestSetup) GetTestInstance(opts ...*instance.Options) *instance.Instance {
+	if c.inst != nil {
+		return c.inst
+	}
+	o := &instance.Options{}
+	if len(opts) > 0 && opts[0] != nil {
+		o = opts[0]
+	}
+	if o.Domain == "" {
+		name := strings.ToLower(strings.Replace(c.name, "_", "-", -1))
+		o.Domain = name + "-" + strings.ToLower(utils.RandomString(10)) + ".cozy.tools"
+	}
+	if o.Locale == "" {
+		o.Locale = instance.DefaultLocale
+	}
+	instance.Destroy(o.Domain)
+	inst, err := instance.Create(o)
+	if err != nil {
+		c.CleanupAndDie("Could not create the test instance:", err)
+	}
+	c.inst = inst
+	c.AddCleanup(func() { instance.Destroy(inst.Domain) })
+	return inst
+}
+
+// GetTestClient registers an OAuth client on the test instance, and returns
+// it with an access token for the given scope.
+func (c *TestSetup) GetTestClient(scope string) (*oauth.Client, string) {
+	inst := c.GetTestInstance()
+	client := &oauth.Client{
+		RedirectURIs: []string{"http://localhost/oauth/callback"},
+		ClientName:   "test-" + c.name,
+		SoftwareID:   "github.com/cozy/cozy-stack/pkg/testutils",
+	}
+	if regErr := client.Create(inst); regErr != nil {
+		c.CleanupAndDie("Could not register the test client:", regErr.Description)
+	}
+	token, err := c.GetTestToken(permissions.AccessTokenAudience, client.ClientID, scope)
+	if err != nil {
+		c.CleanupAndDie("Could not make the test token:", err)
+	}
+	return client, token
+}
+
+// GetTestToken makes a token for the test instance, with any audience,
+// subject and scope.
+func (c *TestSetup) GetTestToken(audience, subject, scope string) (string, error) {
+	return c.GetTestInstance().MakeJWT(audience, subject, scope, time.Now())
+}
+
+// GetTestServer starts a test server with the routes given by the routes
+// function mounted on prefix. The test instance is injected in the echo
+// context of the requests, and the errors are rendered like on the stack.
+func (c *TestSetup) GetTestServer(prefix string, routes func(*echo.Group)) *httptest.Server {
+	inst := c.GetTestInstance()
+	handler := echo.New()
+	handler.HTTPErrorHandler = errors.ErrorHandler
+	routes(handler.Group(prefix, InjectInstance(inst)))
+	ts := httptest.NewServer(handler)
+	c.AddCleanup(ts.Close)
+	return ts
+}
+
+// InjectInstance returns an echo middleware that puts the given instance in
+// the context of the requests, like the middleware of the stack does with the
+// instance of the Host header.
+func InjectInstance(i *instance.Instance) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set("instance", i)
+			return next(c)
+		}
+	}
+}
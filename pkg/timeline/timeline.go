@@ -0,0 +1,205 @@
+// Package timeline merges the recent documents of several doctypes in a
+// single feed, ordered by date, like the one displayed by the home app.
+package timeline
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+)
+
+// MaxLimit is the maximal number of items in a page of the timeline
+const MaxLimit = 100
+
+var (
+	// ErrUnknownDoctype is used when a doctype is not available in the
+	// timeline
+	ErrUnknownDoctype = errors.New("This doctype is not available in the timeline")
+	// ErrInvalidCursor is used when the cursor for the pagination is invalid
+	ErrInvalidCursor = errors.New("Invalid cursor")
+)
+
+// Source describes how the documents of a doctype are put in the timeline.
+// The dates are compared as strings, like CouchDB does: they should be in
+// the same RFC 3339 format.
+type Source struct {
+	Doctype   string
+	DateField string
+	// Selector is an optional filter on the documents
+	Selector mango.Filter
+}
+
+// Sources is the list of the doctypes that can be put in the timeline. The
+// photos are files, with the image class.
+var Sources = []*Source{
+	{
+		Doctype:   consts.Files,
+		DateField: "updated_at",
+		Selector: mango.And(
+			mango.Equal("type", consts.FileType),
+			mango.Not(mango.Equal("dir_id", consts.TrashDirID)),
+		),
+	},
+	{Doctype: consts.BankOperations, DateField: "date"},
+	{Doctype: consts.Bills, DateField: "date"},
+}
+
+// SourceFor returns the source for the given doctype.
+func SourceFor(doctype string) (*Source, error) {
+	for _, src := range Sources {
+		if src.Doctype == doctype {
+			return src, nil
+		}
+	}
+	return nil, ErrUnknownDoctype
+}
+
+// Item is a document in the timeline.
+type Item struct {
+	couchdb.JSONDoc
+	Date string `json:"-"`
+}
+
+// Cursor is the position in the timeline to fetch the next page. As several
+// documents can have the same date, it also keeps for each doctype the
+// number of documents with this date that have already been returned.
+type Cursor struct {
+	Date string         `json:"d"`
+	Skip map[string]int `json:"s,omitempty"`
+}
+
+// String returns the cursor in a format suitable for a query-string
+func (c *Cursor) String() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// ParseCursor parses a cursor returned by String.
+func ParseCursor(s string) (*Cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	c := &Cursor{}
+	if err = json.Unmarshal(b, c); err != nil || c.Date == "" {
+		return nil, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// Get returns a page of the timeline for the given sources, starting after
+// the cursor (nil for the first page). It also returns the cursor for the
+// next page, or nil if there are no more items.
+func Get(db couchdb.Database, sources []*Source, cursor *Cursor, limit int) ([]*Item, *Cursor, error) {
+	if limit <= 0 || limit > MaxLimit {
+		limit = MaxLimit
+	}
+	results := make([][]*Item, len(sources))
+	for i, src := range sources {
+		items, err := query(db, src, cursor, limit)
+		if err != nil {
+			return nil, nil, err
+		}
+		results[i] = items
+	}
+	page, next := merge(sources, results, cursor, limit)
+	return page, next, nil
+}
+
+func query(db couchdb.Database, src *Source, cursor *Cursor, limit int) ([]*Item, error) {
+	var filter mango.Filter
+	skip := 0
+	if cursor != nil {
+		filter = mango.Lte(src.DateField, cursor.Date)
+		skip = cursor.Skip[src.Doctype]
+	} else {
+		filter = mango.Gt(src.DateField, nil)
+	}
+	if src.Selector != nil {
+		filter = mango.And(filter, src.Selector)
+	}
+	req := map[string]interface{}{
+		"selector": filter,
+		"sort":     []map[string]string{{src.DateField: "desc"}},
+		"limit":    limit,
+		"skip":     skip,
+	}
+
+	var docs []couchdb.JSONDoc
+	err := couchdb.FindDocsRaw(db, src.Doctype, req, &docs)
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		// The index for sorting on the date may not exist yet
+		index := mango.IndexOnFields(src.Doctype, src.DateField)
+		if err = couchdb.DefineIndex(db, index); err != nil {
+			return nil, err
+		}
+		err = couchdb.FindDocsRaw(db, src.Doctype, req, &docs)
+	}
+	if couchdb.IsNoDatabaseError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]*Item, 0, len(docs))
+	for _, doc := range docs {
+		doc.Type = src.Doctype
+		date, _ := doc.Get(src.DateField).(string)
+		items = append(items, &Item{JSONDoc: doc, Date: date})
+	}
+	return items, nil
+}
+
+type byDateDesc []*Item
+
+func (s byDateDesc) Len() int           { return len(s) }
+func (s byDateDesc) Less(i, j int) bool { return s[i].Date > s[j].Date }
+func (s byDateDesc) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// merge takes the results of the queries, one list per source ordered by
+// date, and returns the page and the cursor for the next page.
+func merge(sources []*Source, results [][]*Item, cursor *Cursor, limit int) ([]*Item, *Cursor) {
+	var all []*Item
+	hasMore := false
+	for _, items := range results {
+		all = append(all, items...)
+		if len(items) >= limit {
+			hasMore = true
+		}
+	}
+	// The sort is stable to keep the order of CouchDB between the documents
+	// of a doctype with the same date, as the cursor relies on it.
+	sort.Stable(byDateDesc(all))
+	if len(all) > limit {
+		all = all[:limit]
+		hasMore = true
+	}
+	if !hasMore || len(all) == 0 {
+		return all, nil
+	}
+
+	last := all[len(all)-1].Date
+	next := &Cursor{Date: last, Skip: make(map[string]int)}
+	for _, src := range sources {
+		if cursor != nil && cursor.Date == last {
+			next.Skip[src.Doctype] = cursor.Skip[src.Doctype]
+		}
+	}
+	for _, item := range all {
+		if item.Date == last {
+			next.Skip[item.DocType()]++
+		}
+	}
+	for doctype, n := range next.Skip {
+		if n == 0 {
+			delete(next.Skip, doctype)
+		}
+	}
+	return all, next
+}
@@ -0,0 +1,77 @@
+package timeline
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/stretchr/testify/assert"
+)
+
+var testSources = []*Source{
+	{Doctype: "io.cozy.tests.a", DateField: "date"},
+	{Doctype: "io.cozy.tests.b", DateField: "date"},
+}
+
+func makeItems(doctype string, dates ...string) []*Item {
+	items := make([]*Item, len(dates))
+	for i, date := range dates {
+		doc := couchdb.JSONDoc{
+			Type: doctype,
+			M:    map[string]interface{}{"date": date},
+		}
+		items[i] = &Item{JSONDoc: doc, Date: date}
+	}
+	return items
+}
+
+func TestCursor(t *testing.T) {
+	c := &Cursor{Date: "2017-03-21T10:00:00Z", Skip: map[string]int{"io.cozy.files": 2}}
+	parsed, err := ParseCursor(c.String())
+	assert.NoError(t, err)
+	assert.Equal(t, c, parsed)
+
+	_, err = ParseCursor("not a cursor")
+	assert.Equal(t, ErrInvalidCursor, err)
+	_, err = ParseCursor(base64.RawURLEncoding.EncodeToString([]byte("{}")))
+	assert.Equal(t, ErrInvalidCursor, err)
+}
+
+func TestMergeLastPage(t *testing.T) {
+	results := [][]*Item{
+		makeItems("io.cozy.tests.a", "2017-03-03", "2017-03-01"),
+		makeItems("io.cozy.tests.b", "2017-03-02"),
+	}
+	page, next := merge(testSources, results, nil, 5)
+	assert.Nil(t, next)
+	if assert.Len(t, page, 3) {
+		assert.Equal(t, "2017-03-03", page[0].Date)
+		assert.Equal(t, "io.cozy.tests.b", page[1].DocType())
+		assert.Equal(t, "2017-03-01", page[2].Date)
+	}
+}
+
+func TestMergeWithSameDates(t *testing.T) {
+	results := [][]*Item{
+		makeItems("io.cozy.tests.a", "2017-03-03", "2017-03-02", "2017-03-02"),
+		makeItems("io.cozy.tests.b", "2017-03-02", "2017-03-02", "2017-03-01"),
+	}
+	page, next := merge(testSources, results, nil, 3)
+	assert.Len(t, page, 3)
+	if assert.NotNil(t, next) {
+		assert.Equal(t, "2017-03-02", next.Date)
+		assert.Equal(t, map[string]int{"io.cozy.tests.a": 2}, next.Skip)
+	}
+
+	// The next page starts at the same date: the skips are cumulated
+	results = [][]*Item{
+		makeItems("io.cozy.tests.a"),
+		makeItems("io.cozy.tests.b", "2017-03-02", "2017-03-02", "2017-03-01"),
+	}
+	page, next = merge(testSources, results, next, 1)
+	assert.Len(t, page, 1)
+	if assert.NotNil(t, next) {
+		assert.Equal(t, "2017-03-02", next.Date)
+		assert.Equal(t, map[string]int{"io.cozy.tests.a": 2, "io.cozy.tests.b": 1}, next.Skip)
+	}
+}
@@ -2,10 +2,12 @@ package vfs
 
 import (
 	"archive/zip"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"path"
 	"path/filepath"
 	"strings"
 	"time"
@@ -135,6 +137,112 @@ func (a *Archive) Serve(c Context, w http.ResponseWriter) error {
 	return nil
 }
 
+// ArchiveFilter tells if a directory or a file must be put in a zip archive.
+// When it returns true for a directory, the whole tree under it is put in
+// the archive without checking its entries.
+type ArchiveFilter func(dir *DirDoc, file *FileDoc) bool
+
+// errArchiveAllowed is used to stop the walk on the first entry accepted by
+// the filter of an archive
+var errArchiveAllowed = errors.New("archive allowed")
+
+// ServeDirArchive creates on the fly a zip archive of the tree of a
+// directory, with the directories and files accepted by the filter, and
+// streams it in a http response. The content of the files is copied entry by
+// entry from the storage, so the archive is never kept whole in memory.
+//
+// ErrForbiddenArchive is returned, before anything is written, if the filter
+// accepts neither the directory nor any of its entries.
+func ServeDirArchive(c Context, dir *DirDoc, filter ArchiveFilter, w http.ResponseWriter) error {
+	root, err := dir.Path(c)
+	if err != nil {
+		return err
+	}
+	if !filter(dir, nil) {
+		err = walk(c, root, dir, nil, func(_ string, d *DirDoc, f *FileDoc, err error) error {
+			if err != nil {
+				return err
+			}
+			if d != nil && d.ID() == consts.TrashDirID {
+				return ErrSkipDir
+			}
+			if filter(d, f) {
+				return errArchiveAllowed
+			}
+			return nil
+		})
+		if err == nil {
+			return ErrForbiddenArchive
+		}
+		if err != errArchiveAllowed {
+			return err
+		}
+	}
+	name := dir.Name
+	if name == "" {
+		name = "files"
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", ZipMime)
+	header.Set("Content-Disposition", ContentDisposition("attachment", name+".zip"))
+
+	fs := c.FS()
+	zw := zip.NewWriter(w)
+
+	// allowed is the path, with a trailing slash, of the last directory
+	// accepted by the filter: as the tree is walked depth-first, its entries
+	// are the following ones that have this path as prefix.
+	allowed := ""
+	err = walk(c, root, dir, nil, func(fullpath string, d *DirDoc, f *FileDoc, err error) error {
+		if err != nil {
+			return err
+		}
+		if d != nil && d.ID() == consts.TrashDirID {
+			return ErrSkipDir
+		}
+		ok := allowed != "" && strings.HasPrefix(fullpath, allowed)
+		if !ok {
+			ok = filter(d, f)
+			if ok && d != nil {
+				allowed = strings.TrimSuffix(fullpath, "/") + "/"
+			}
+		}
+		if !ok {
+			return nil
+		}
+		rel, err := filepath.Rel(root, fullpath)
+		if err != nil {
+			return fmt.Errorf("Invalid filepath <%s>: %s", fullpath, err)
+		}
+		zh := &zip.FileHeader{Name: path.Join(name, rel), Method: zip.Deflate}
+		if d != nil {
+			zh.Name += "/"
+			zh.SetModTime(d.UpdatedAt)
+			_, err = zw.CreateHeader(zh)
+			return err
+		}
+		zh.SetModTime(f.UpdatedAt)
+		ze, err := zw.CreateHeader(zh)
+		if err != nil {
+			return fmt.Errorf("Can't create zip entry <%s>: %s", rel, err)
+		}
+		content, err := fs.Open(fullpath)
+		if err != nil {
+			return fmt.Errorf("Can't open file <%s>: %s", rel, err)
+		}
+		defer content.Close()
+		_, err = io.Copy(ze, content)
+		return err
+	})
+	// the central directory is not written on error, so that the client sees
+	// a broken archive and not an archive with missing files
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
 // ID makes Archive a jsonapi.Object
 func (a *Archive) ID() string { return a.Secret }
 
@@ -0,0 +1,67 @@
+package vfs
+
+import (
+	"crypto/md5"  // #nosec
+	"crypto/sha1" // #nosec
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// Checksum is a hash of the content of a file, computed by the client with
+// one of the supported algorithms (md5, sha1, sha256 or sha512). It is
+// checked when the file is written, before the document is committed.
+type Checksum struct {
+	Algorithm string
+	Sum       []byte
+}
+
+// ChecksumError is used when the checksum given by the client does not match
+// the one of the written content.
+type ChecksumError struct {
+	Algorithm string
+	Expected  []byte
+	Actual    []byte
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("Invalid %s checksum: expected %s, got %s", e.Algorithm,
+		base64.StdEncoding.EncodeToString(e.Expected),
+		base64.StdEncoding.EncodeToString(e.Actual))
+}
+
+// ParseChecksum parses a checksum in the format <algorithm>=<base64 sum>, as
+// sent in the X-Cozy-Checksum header, like sha256=47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=
+func ParseChecksum(value string) (*Checksum, error) {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return nil, ErrInvalidChecksum
+	}
+	algo := strings.ToLower(strings.TrimSpace(parts[0]))
+	h := newChecksumHash(algo)
+	if h == nil {
+		return nil, ErrUnsupportedChecksum
+	}
+	sum, err := base64.StdEncoding.DecodeString(strings.TrimSpace(parts[1]))
+	if err != nil || len(sum) != h.Size() {
+		return nil, ErrInvalidChecksum
+	}
+	return &Checksum{Algorithm: algo, Sum: sum}, nil
+}
+
+func newChecksumHash(algo string) hash.Hash {
+	switch algo {
+	case "md5":
+		return md5.New() // #nosec
+	case "sha1":
+		return sha1.New() // #nosec
+	case "sha256":
+		return sha256.New()
+	case "sha512":
+		return sha512.New()
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package vfs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseChecksum(t *testing.T) {
+	sum, err := ParseChecksum("SHA256=LCa0a2j/xo/5m0U8HTBBNBNCLXBkg7+g+YpeiGJm564=")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "sha256", sum.Algorithm)
+		assert.Len(t, sum.Sum, 32)
+	}
+
+	sum, err = ParseChecksum("md5=rL0Y20zC+Fzt72VPzMSk2A==")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "md5", sum.Algorithm)
+	}
+
+	_, err = ParseChecksum("crc32=jHNlIQ==")
+	assert.Equal(t, ErrUnsupportedChecksum, err)
+	_, err = ParseChecksum("sha256")
+	assert.Equal(t, ErrInvalidChecksum, err)
+	_, err = ParseChecksum("sha256=not base64")
+	assert.Equal(t, ErrInvalidChecksum, err)
+	_, err = ParseChecksum("sha1=rL0Y20zC+Fzt72VPzMSk2A==")
+	assert.Equal(t, ErrInvalidChecksum, err)
+}
@@ -0,0 +1,174 @@
+package vfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	"github.com/spf13/afero"
+)
+
+// Linker is implemented by the storages that can make hard links. They are
+// used to deduplicate the files with the same content: the storage keeps the
+// number of links to a content, and frees it when the last one is removed.
+type Linker interface {
+	Link(oldname, newname string) error
+}
+
+// LocalFs is the storage of the files of an instance in a directory of the
+// local file system. It can make hard links between its files.
+type LocalFs struct {
+	afero.Fs
+	root string
+}
+
+// NewLocalFs returns the storage for the directory root
+func NewLocalFs(root string) *LocalFs {
+	return &LocalFs{
+		Fs:   afero.NewBasePathFs(afero.NewOsFs(), root),
+		root: root,
+	}
+}
+
+// Link creates newname as a hard link to oldname
+func (fs *LocalFs) Link(oldname, newname string) error {
+	return os.Link(fs.realPath(oldname), fs.realPath(newname))
+}
+
+func (fs *LocalFs) realPath(name string) string {
+	return filepath.Join(fs.root, filepath.Clean("/"+name))
+}
+
+// dedupGracePeriod is the time during which a content that has just been
+// written is not used for the deduplication, as it may still be written.
+var dedupGracePeriod = 1 * time.Minute
+
+// dedupCandidates is the maximal number of files with the same content that
+// are tried for the deduplication of a file
+const dedupCandidates = 5
+
+var errDedupMismatch = errors.New("Content does not match for the deduplication")
+
+// deduplicate replaces the content of a file that has just been written by a
+// hard link to the content of another file with the same sha256 sum, when
+// fs.dedup is enabled and the storage can make hard links. It is only an
+// optimization: the file is left as is if it can't be done.
+func deduplicate(c Context, doc *FileDoc, name string) {
+	if !config.GetConfig().Fs.Dedup || doc.Executable || doc.Size == 0 || len(doc.SHA256Sum) == 0 {
+		return
+	}
+	linker, ok := c.FS().(Linker)
+	if !ok {
+		return
+	}
+
+	var docs []*FileDoc
+	req := &couchdb.FindRequest{
+		Selector: mango.And(
+			mango.Equal("sha256sum", base64.StdEncoding.EncodeToString(doc.SHA256Sum)),
+			mango.Equal("type", consts.FileType),
+			mango.Equal("executable", false),
+		),
+		Limit: dedupCandidates,
+	}
+	if err := couchdb.FindDocs(c, consts.Files, req, &docs); err != nil {
+		return
+	}
+	for _, other := range docs {
+		otherpath, err := other.Path(c)
+		if err != nil || otherpath == name {
+			continue
+		}
+		if err = linkContent(c, linker, doc, otherpath, name); err == nil {
+			return
+		}
+	}
+}
+
+// linkContent replaces the content at name by a hard link to the content at
+// otherpath. The content of the other file is hashed again once linked, as
+// it may have been overwritten since its document was read.
+func linkContent(c Context, linker Linker, doc *FileDoc, otherpath, name string) error {
+	fs := c.FS()
+	info, err := fs.Stat(otherpath)
+	if err != nil {
+		return err
+	}
+	if info.Size() != doc.Size || time.Since(info.ModTime()) < dedupGracePeriod {
+		return errDedupMismatch
+	}
+
+	tmpname := "/" + dedupTmpPrefix + hex.EncodeToString(doc.SHA256Sum)
+	if err = linker.Link(otherpath, tmpname); err != nil {
+		return err
+	}
+	sum, err := contentSHA256(fs, tmpname)
+	if err == nil && !bytes.Equal(sum, doc.SHA256Sum) {
+		err = errDedupMismatch
+	}
+	if err == nil {
+		err = fs.Rename(tmpname, name)
+	}
+	if err != nil {
+		fs.Remove(tmpname)
+	}
+	return err
+}
+
+// unshareBlob replaces the content of a file by a copy of it, so that it is
+// no longer shared with other files by the deduplication, before it becomes
+// executable. Only the non-executable files are deduplicated.
+func unshareBlob(c Context, doc *FileDoc, name string) error {
+	if _, ok := c.FS().(Linker); !ok || !doc.Executable {
+		return nil
+	}
+	fs := c.FS()
+	src, err := fs.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmpname := "/.unshare_" + doc.ID()
+	fs.Remove(tmpname)
+	dst, err := safeCreateFile(tmpname, false, fs)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if cerr := dst.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = fs.Rename(tmpname, name)
+	}
+	if err != nil {
+		fs.Remove(tmpname)
+	}
+	return err
+}
+
+func contentSHA256(fs afero.Fs, name string) ([]byte, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+var _ Linker = &LocalFs{}
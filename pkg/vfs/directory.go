@@ -158,6 +158,9 @@ func NewDirDoc(name, dirID string, tags []string, parent *DirDoc) (*DirDoc, erro
 	if dirID == "" {
 		dirID = consts.RootDirID
 	}
+	if err := checkReservedName(name, dirID); err != nil {
+		return nil, err
+	}
 
 	tags = uniqueTags(tags)
 
@@ -11,12 +11,24 @@ var (
 	ErrForbiddenDocMove = errors.New("Forbidden document move")
 	// ErrIllegalFilename is used when the given filename is not allowed
 	ErrIllegalFilename = errors.New("Invalid filename: empty or contains an illegal character")
+	// ErrReservedFilename is used when the given filename is reserved for
+	// the storage of the stack in the root directory
+	ErrReservedFilename = errors.New("Invalid filename: reserved in the root directory")
+	// ErrForbiddenArchive is used when no directory or file of the tree to
+	// put in an archive can be read
+	ErrForbiddenArchive = errors.New("Forbidden archive")
 	// ErrIllegalTime is used when a time given (creation or
 	// modification) is not allowed
 	ErrIllegalTime = errors.New("Invalid time given")
 	// ErrInvalidHash is used when the given hash does not match the
 	// calculated one
 	ErrInvalidHash = errors.New("Invalid hash")
+	// ErrInvalidChecksum is used when the checksum given by the client is
+	// malformed
+	ErrInvalidChecksum = errors.New("Invalid checksum")
+	// ErrUnsupportedChecksum is used when the algorithm of the checksum
+	// given by the client is not supported
+	ErrUnsupportedChecksum = errors.New("Unsupported checksum algorithm")
 	// ErrContentLengthMismatch is used when the content-length does not
 	// match the calculated one
 	ErrContentLengthMismatch = errors.New("Content length does not match")
@@ -35,4 +47,13 @@ var (
 	ErrDirNotEmpty = errors.New("Directory is not empty")
 	// ErrWrongCouchdbState is given when couchdb gives us an unexpected value
 	ErrWrongCouchdbState = errors.New("Wrong couchdb reduce value")
+	// ErrThumbnailNotFound is used when the thumbnail of a file has not been
+	// generated, or it is not an image
+	ErrThumbnailNotFound = errors.New("Thumbnail not found")
+	// ErrInvalidThumbnailSize is used when the size asked for a thumbnail is
+	// not one of the ThumbnailSizes
+	ErrInvalidThumbnailSize = errors.New("Invalid size of thumbnail")
+	// ErrImageTooLarge is used when an image has too many pixels to be
+	// decoded for its thumbnails
+	ErrImageTooLarge = errors.New("Image is too large to make thumbnails")
 )
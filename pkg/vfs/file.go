@@ -3,6 +3,7 @@ package vfs
 import (
 	"bytes"
 	"crypto/md5" // #nosec
+	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
 	"hash"
@@ -40,6 +41,7 @@ type FileDoc struct {
 
 	Size       int64    `json:"size,string"` // Serialized in JSON as a string, because JS has some issues with big numbers
 	MD5Sum     []byte   `json:"md5sum"`
+	SHA256Sum  []byte   `json:"sha256sum,omitempty"`
 	Mime       string   `json:"mime"`
 	Class      string   `json:"class"`
 	Executable bool     `json:"executable"`
@@ -98,7 +100,11 @@ func (f *FileDoc) Parent(c Context) (*DirDoc, error) {
 // Links is used to generate a JSON-API link for the file (part of
 // jsonapi.Object interface)
 func (f *FileDoc) Links() *jsonapi.LinksList {
-	return &jsonapi.LinksList{Self: "/files/" + f.DocID}
+	links := &jsonapi.LinksList{Self: "/files/" + f.DocID}
+	if CanHaveThumbnails(f) {
+		links.Thumbnail = "/files/" + f.DocID + "/thumbnail"
+	}
+	return links
 }
 
 func (f *FileDoc) parentRelationShip() jsonapi.Relationship {
@@ -183,6 +189,9 @@ func NewFileDoc(name, dirID string, size int64, md5Sum []byte, mime, class strin
 	if dirID == "" {
 		dirID = consts.RootDirID
 	}
+	if err := checkReservedName(name, dirID); err != nil {
+		return nil, err
+	}
 
 	tags = uniqueTags(tags)
 
@@ -264,21 +273,26 @@ func GetFileDocFromPath(c Context, name string) (*FileDoc, error) {
 // file given its FileDoc.
 //
 // It uses internally http.ServeContent and benefits from it by
-// offering support to Range, If-Modified-Since and If-None-Match
-// requests. It uses the revision of the file as the Etag value for
-// non-ranged requests
+// offering support to Range (with multiple ranges and suffix ranges, as
+// described in RFC 7233), If-Range, If-Modified-Since and If-None-Match
+// requests. It uses the md5sum of the file as the Etag value, for the ranged
+// requests too, so that a download can be resumed with If-Range.
 //
 // The content disposition is inlined.
 func ServeFileContent(c Context, doc *FileDoc, disposition string, req *http.Request, w http.ResponseWriter) error {
 	header := w.Header()
-	header.Set("Content-Type", doc.Mime)
+	if doc.Mime != "" {
+		header.Set("Content-Type", doc.Mime)
+	}
 	if disposition != "" {
 		header.Set("Content-Disposition", ContentDisposition(disposition, doc.Name))
 	}
 
-	if header.Get("Range") == "" {
+	// The Etag must be a quoted string to be compared with the If-Range and
+	// If-None-Match headers
+	if len(doc.MD5Sum) > 0 {
 		eTag := base64.StdEncoding.EncodeToString(doc.MD5Sum)
-		header.Set("Etag", eTag)
+		header.Set("Etag", `"`+eTag+`"`)
 	}
 
 	name, err := doc.Path(c)
@@ -309,14 +323,17 @@ type File struct {
 //
 // fileCreation implements io.WriteCloser.
 type fileCreation struct {
-	w       int64          // total size written
-	newdoc  *FileDoc       // new document
-	olddoc  *FileDoc       // old document if any
-	newpath string         // file new path
-	bakpath string         // backup file path in case of modifying an existing file
-	hash    hash.Hash      // hash we build up along the file
-	meta    *MetaExtractor // extracts metadata from the content
-	err     error          // write error
+	w            int64          // total size written
+	newdoc       *FileDoc       // new document
+	olddoc       *FileDoc       // old document if any
+	newpath      string         // file new path
+	bakpath      string         // backup file path in case of modifying an existing file
+	hash         hash.Hash      // hash we build up along the file
+	sha256       hash.Hash      // sha256 hash we build up along the file
+	checksum     *Checksum      // checksum given by the client, if any
+	checksumHash hash.Hash      // hash to verify the checksum given by the client
+	meta         *MetaExtractor // extracts metadata from the content
+	err          error          // write error
 }
 
 // Open returns a file handle that can be used to read form the file
@@ -386,8 +403,9 @@ func CreateFile(c Context, newdoc, olddoc *FileDoc) (*File, error) {
 		bakpath: bakpath,
 		newpath: newpath,
 
-		hash: hash,
-		meta: extractor,
+		hash:   hash,
+		sha256: sha256.New(),
+		meta:   extractor,
 	}
 
 	return &File{c, f, fc}, nil
@@ -430,10 +448,32 @@ func (f *File) Write(p []byte) (int, error) {
 		(*f.fc.meta).Write(p)
 	}
 
+	if f.fc.checksum != nil {
+		f.fc.checksumHash.Write(p)
+	}
+
+	f.fc.sha256.Write(p)
+
 	_, err = f.fc.hash.Write(p)
 	return n, err
 }
 
+// ExpectChecksum sets the checksum given by the client for the content of
+// the file. It is verified by the Close() method, before the document is
+// committed. It must be called before writing the content.
+func (f *File) ExpectChecksum(sum *Checksum) error {
+	if f.fc == nil || f.fc.w > 0 {
+		return os.ErrInvalid
+	}
+	h := newChecksumHash(sum.Algorithm)
+	if h == nil {
+		return ErrUnsupportedChecksum
+	}
+	f.fc.checksum = sum
+	f.fc.checksumHash = h
+	return nil
+}
+
 // Close the handle and commit the document in database if all checks
 // are OK. It is important to check errors returned by this method.
 func (f *File) Close() error {
@@ -448,10 +488,11 @@ func (f *File) Close() error {
 		werr := fc.err
 		if fc.olddoc != nil {
 			// put back backup file revision in case on error occurred while
-			// modifying file content or remove the backup file otherwise
+			// modifying file content, or keep it as a previous version of the
+			// file (see fs.versions) or remove the backup file otherwise
 			if err != nil || werr != nil {
 				c.FS().Rename(fc.bakpath, fc.newpath)
-			} else {
+			} else if !versioningEnabled() || keepVersion(c, fc.olddoc, fc.bakpath) != nil {
 				c.FS().Remove(fc.bakpath)
 			}
 		} else if err != nil || werr != nil {
@@ -485,6 +526,18 @@ func (f *File) Close() error {
 		return err
 	}
 
+	if sum := fc.checksum; sum != nil {
+		actual := fc.checksumHash.Sum(nil)
+		if !bytes.Equal(sum.Sum, actual) {
+			err = &ChecksumError{
+				Algorithm: sum.Algorithm,
+				Expected:  sum.Sum,
+				Actual:    actual,
+			}
+			return err
+		}
+	}
+
 	if newdoc.Size < 0 {
 		newdoc.Size = written
 	}
@@ -494,8 +547,17 @@ func (f *File) Close() error {
 		return err
 	}
 
+	newdoc.SHA256Sum = fc.sha256.Sum(nil)
+	// the content is deduplicated before the document is committed, while
+	// no other request can write this file
+	deduplicate(c, newdoc, fc.newpath)
+
 	if olddoc != nil {
 		err = couchdb.UpdateDoc(c, newdoc)
+		if err == nil {
+			// the thumbnails of the previous content are no longer valid
+			RemoveThumbnails(c, newdoc.ID())
+		}
 	} else {
 		err = couchdb.CreateDoc(c, newdoc)
 	}
@@ -549,6 +611,7 @@ func ModifyFileMetadata(c Context, olddoc *FileDoc, patch *DocPatch) (*FileDoc,
 	}
 
 	newdoc.RestorePath = *patch.RestorePath
+	newdoc.SHA256Sum = olddoc.SHA256Sum
 
 	var parent *DirDoc
 	if newdoc.DirID != olddoc.DirID {
@@ -583,6 +646,10 @@ func ModifyFileMetadata(c Context, olddoc *FileDoc, patch *DocPatch) (*FileDoc,
 	}
 
 	if newdoc.Executable != olddoc.Executable {
+		// the mode of a deduplicated content is shared by all its files
+		if err = unshareBlob(c, newdoc, newpath); err != nil {
+			return nil, err
+		}
 		err = c.FS().Chmod(newpath, getFileMode(newdoc.Executable))
 		if err != nil {
 			return nil, err
@@ -654,6 +721,14 @@ func DestroyFile(c Context, doc *FileDoc) error {
 		return err
 	}
 
+	if err = destroyVersions(c, doc.ID()); err != nil {
+		return err
+	}
+
+	if err = RemoveThumbnails(c, doc.ID()); err != nil {
+		return err
+	}
+
 	return couchdb.DeleteDoc(c, doc)
 }
 
@@ -0,0 +1,213 @@
+package vfs
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/spf13/afero"
+)
+
+// GCPolicy is what the garbage collector does with the inconsistencies
+// between the storage and the file documents.
+type GCPolicy string
+
+const (
+	// GCReport only reports the inconsistencies
+	GCReport GCPolicy = "report"
+	// GCQuarantine moves the blobs without file document to the quarantine
+	// directory, where they can be inspected and restored by an admin
+	GCQuarantine GCPolicy = "quarantine"
+	// GCClean removes the blobs without file document, and the file
+	// documents without blob
+	GCClean GCPolicy = "clean"
+)
+
+// QuarantineDirName is the path of the directory, in the storage, where the
+// blobs without file document are moved by the garbage collector. It has no
+// document, and is not visible with the API.
+const QuarantineDirName = "/.cozy_quarantine"
+
+// GCGracePeriod is the minimal age of a blob without file document to be
+// collected: the document of a file being uploaded is only created when the
+// upload is finished.
+var GCGracePeriod = 1 * time.Hour
+
+// IsValidGCPolicy returns true if the given string is a garbage collector
+// policy.
+func IsValidGCPolicy(policy string) bool {
+	switch GCPolicy(policy) {
+	case GCReport, GCQuarantine, GCClean:
+		return true
+	}
+	return false
+}
+
+// GCStats are the statistics of a run of the garbage collector. The last
+// ones are saved in CouchDB.
+type GCStats struct {
+	StatsRev string `json:"_rev,omitempty"`
+
+	Policy     GCPolicy  `json:"policy"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+
+	ScannedFiles int `json:"scanned_files"`
+	ScannedBlobs int `json:"scanned_blobs"`
+	// OrphanBlobs are the paths in the storage of the blobs with no file
+	// document, like the leftovers of failed uploads
+	OrphanBlobs []string `json:"orphan_blobs"`
+	// MissingBlobs are the identifiers of the file documents whose blob is
+	// not in the storage
+	MissingBlobs []string `json:"missing_blobs"`
+	Quarantined  int      `json:"quarantined"`
+	Cleaned      int      `json:"cleaned"`
+}
+
+// ID returns the statistics qualified identifier - see couchdb.Doc interface
+func (s *GCStats) ID() string { return consts.VFSGCStatsID }
+
+// Rev returns the statistics revision - see couchdb.Doc interface
+func (s *GCStats) Rev() string { return s.StatsRev }
+
+// DocType returns the statistics document type - see couchdb.Doc interface
+func (s *GCStats) DocType() string { return consts.Settings }
+
+// SetID changes the statistics qualified identifier - see couchdb.Doc
+// interface
+func (s *GCStats) SetID(id string) {}
+
+// SetRev changes the statistics revision - see couchdb.Doc interface
+func (s *GCStats) SetRev(rev string) { s.StatsRev = rev }
+
+// GetGCStats returns the statistics of the last run of the garbage collector
+func GetGCStats(c Context) (*GCStats, error) {
+	stats := &GCStats{}
+	err := couchdb.GetDoc(c, consts.Settings, consts.VFSGCStatsID, stats)
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// CollectGarbage looks for the blobs of the storage with no file document,
+// and for the file documents whose blob is missing, after failed uploads or
+// crashes. They are handled according to the policy, and the statistics are
+// saved in CouchDB.
+func CollectGarbage(c Context, policy GCPolicy) (*GCStats, error) {
+	stats := &GCStats{
+		Policy:       policy,
+		StartedAt:    time.Now(),
+		OrphanBlobs:  []string{},
+		MissingBlobs: []string{},
+	}
+	fs := c.FS()
+
+	// The paths of the files known by CouchDB
+	known := make(map[string]bool)
+	var missing []*FileDoc
+	err := Walk(c, "/", func(name string, dir *DirDoc, file *FileDoc, err error) error {
+		if err != nil {
+			return err
+		}
+		if file == nil {
+			return nil
+		}
+		stats.ScannedFiles++
+		known[name] = true
+		if _, err = fs.Stat(name); os.IsNotExist(err) {
+			stats.MissingBlobs = append(stats.MissingBlobs, file.ID())
+			missing = append(missing, file)
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var orphans []string
+	limit := time.Now().Add(-GCGracePeriod)
+	err = afero.Walk(fs, "/", func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			switch name {
+			case QuarantineDirName, VersionsDirName, ThumbsDirName:
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		stats.ScannedBlobs++
+		if known[name] || info.ModTime().After(limit) {
+			return nil
+		}
+		stats.OrphanBlobs = append(stats.OrphanBlobs, name)
+		orphans = append(orphans, name)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	switch policy {
+	case GCQuarantine:
+		for _, name := range orphans {
+			if err = quarantineBlob(fs, name); err != nil {
+				return nil, err
+			}
+			stats.Quarantined++
+		}
+	case GCClean:
+		for _, name := range orphans {
+			if err = fs.Remove(name); err != nil {
+				return nil, err
+			}
+			stats.Cleaned++
+		}
+		for _, file := range missing {
+			if err = couchdb.DeleteDoc(c, file); err != nil {
+				return nil, err
+			}
+			stats.Cleaned++
+		}
+	}
+
+	stats.FinishedAt = time.Now()
+	if err = saveGCStats(c, stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// quarantineBlob moves a blob to the quarantine directory, with the same
+// path, and a suffix if a blob with this path has already been quarantined.
+func quarantineBlob(fs afero.Fs, name string) error {
+	dst := path.Join(QuarantineDirName, name)
+	if err := fs.MkdirAll(path.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if _, err := fs.Stat(dst); err == nil {
+		dst = dst + "." + strings.Replace(time.Now().UTC().Format(time.RFC3339), ":", "-", -1)
+	}
+	return fs.Rename(name, dst)
+}
+
+func saveGCStats(c Context, stats *GCStats) error {
+	old, err := GetGCStats(c)
+	if couchdb.IsNotFoundError(err) {
+		return couchdb.CreateNamedDocWithDB(c, stats)
+	}
+	if err != nil {
+		return err
+	}
+	stats.SetRev(old.Rev())
+	return couchdb.UpdateDoc(c, stats)
+}
+
+var _ couchdb.Doc = &GCStats{}
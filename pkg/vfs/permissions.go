@@ -26,6 +26,7 @@ var _ Validable = (*DirDoc)(nil)
 func Allows(c Context, pset permissions.Set, v permissions.Verb, fd Validable) error {
 
 	allowedIDs := []string{}
+	pathRules := []permissions.Rule{}
 	otherRules := []permissions.Rule{}
 
 	// First pass, we iterate over the rules, check if we have an easy match
@@ -40,6 +41,13 @@ func Allows(c Context, pset permissions.Set, v permissions.Verb, fd Validable) e
 			return nil
 		}
 
+		// permission by path, on self or an ancestor: it is checked after the
+		// easy matches, as it needs the path of the current object
+		if r.Selector == permissions.PathSelector {
+			pathRules = append(pathRules, r)
+			continue
+		}
+
 		// permission by ID directly on self, parent or root
 		if r.Selector == "" {
 			for _, v := range r.Values {
@@ -82,6 +90,21 @@ func Allows(c Context, pset permissions.Set, v permissions.Verb, fd Validable) e
 
 	}
 
+	// We have some rules on paths, let's check if the current object is under
+	// one of them
+	if len(pathRules) > 0 {
+		var selfPath, err = fd.Path(c)
+		if err != nil {
+			return err
+		}
+
+		for _, r := range pathRules {
+			if r.MatchPath(selfPath) {
+				return nil
+			}
+		}
+	}
+
 	// We have some rules on attributes, let's iterate over the current object
 	// ancestors and check if any match the rules
 	if len(otherRules) > 0 {
@@ -162,6 +162,29 @@ func TestPermissions(t *testing.T) {
 	}
 	assert.NoError(t, Allows(vfsC, psetSelfParentTag, permissions.GET, f))
 
+	psetPath := permissions.Set{
+		permissions.Rule{
+			Type:     consts.Files,
+			Verbs:    permissions.Verbs(permissions.POST),
+			Selector: permissions.PathSelector,
+			Values:   []string{"/O/"},
+		},
+	}
+	assert.NoError(t, Allows(vfsC, psetPath, permissions.POST, f))
+	assert.NoError(t, Allows(vfsC, psetPath, permissions.POST, B))
+	assert.Error(t, Allows(vfsC, psetPath, permissions.GET, f))
+
+	psetSubPath := permissions.Set{
+		permissions.Rule{
+			Type:     consts.Files,
+			Verbs:    permissions.ALL,
+			Selector: permissions.PathSelector,
+			Values:   []string{"/O/B"},
+		},
+	}
+	assert.NoError(t, Allows(vfsC, psetSubPath, permissions.GET, f))
+	assert.Error(t, Allows(vfsC, psetSubPath, permissions.GET, B2))
+
 	psetWrongType := permissions.Set{
 		permissions.Rule{
 			Type:   "io.cozy.not-files",
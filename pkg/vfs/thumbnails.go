@@ -0,0 +1,197 @@
+package vfs
+
+import (
+	"image"
+	"image/jpeg"
+	"net/http"
+	"os"
+	"path"
+
+	"golang.org/x/image/draw"
+)
+
+// ThumbsDirName is the path of the directory, in the storage, where the
+// thumbnails of the images are kept. It has no document, and is not visible
+// with the API.
+const ThumbsDirName = "/.cozy_thumbs"
+
+// ThumbnailMime is the mime type of the thumbnails
+const ThumbnailMime = "image/jpeg"
+
+// ThumbnailSize is the name of a size of thumbnails
+type ThumbnailSize string
+
+const (
+	// ThumbnailSmall is for the grids of images
+	ThumbnailSmall ThumbnailSize = "small"
+	// ThumbnailMedium is for the previews
+	ThumbnailMedium ThumbnailSize = "medium"
+	// ThumbnailLarge is for the viewers
+	ThumbnailLarge ThumbnailSize = "large"
+)
+
+// ThumbnailSizes are the sizes of the thumbnails generated for an image,
+// with the maximal width and height in pixels of each of them.
+var ThumbnailSizes = map[ThumbnailSize]int{
+	ThumbnailSmall:  128,
+	ThumbnailMedium: 640,
+	ThumbnailLarge:  1280,
+}
+
+// thumbnailsOrder is the order in which the sizes are generated
+var thumbnailsOrder = []ThumbnailSize{ThumbnailLarge, ThumbnailMedium, ThumbnailSmall}
+
+// thumbnailMaxPixels is the number of pixels of the largest image for which
+// thumbnails are generated, to limit the memory used to decode it.
+const thumbnailMaxPixels = 50 * 1000 * 1000
+
+// thumbnailQuality is the quality of the JPEG encoding of the thumbnails
+const thumbnailQuality = 85
+
+// IsValidThumbnailSize returns true if the size is one of the ThumbnailSizes
+func IsValidThumbnailSize(size string) bool {
+	_, ok := ThumbnailSizes[ThumbnailSize(size)]
+	return ok
+}
+
+// CanHaveThumbnails returns true if thumbnails can be generated for a file,
+// ie if it is an image in a format that can be decoded.
+func CanHaveThumbnails(doc *FileDoc) bool {
+	switch doc.Mime {
+	case "image/jpeg", "image/jpg", "image/png", "image/gif", "image/webp":
+		return true
+	}
+	return false
+}
+
+// thumbnailPath returns the path of a thumbnail of a file in the storage
+func thumbnailPath(fileID string, size ThumbnailSize) string {
+	return path.Join(ThumbsDirName, fileID+"-"+string(size)+".jpg")
+}
+
+// GenerateThumbnails decodes the content of an image and writes its
+// thumbnails for all the ThumbnailSizes. An image smaller than a size is not
+// enlarged. The previous thumbnails of the file are replaced.
+func GenerateThumbnails(c Context, doc *FileDoc) error {
+	if !CanHaveThumbnails(doc) {
+		return ErrThumbnailNotFound
+	}
+	f, err := Open(c, doc)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return err
+	}
+	if cfg.Width*cfg.Height > thumbnailMaxPixels {
+		return ErrImageTooLarge
+	}
+	if _, err = f.Seek(0, os.SEEK_SET); err != nil {
+		return err
+	}
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return err
+	}
+
+	fs := c.FS()
+	if err = fs.MkdirAll(ThumbsDirName, 0755); err != nil {
+		return err
+	}
+	// each size is made from the previous one, which is much faster than from
+	// the original image, and good enough for thumbnails
+	for _, size := range thumbnailsOrder {
+		img = resizeImage(img, ThumbnailSizes[size])
+		if err = writeThumbnail(c, thumbnailPath(doc.ID(), size), img); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resizeImage returns the image scaled down to fit in a square of max
+// pixels, on a white background for the transparent images.
+func resizeImage(img image.Image, max int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > max || height > max {
+		if width > height {
+			height = height * max / width
+			width = max
+		} else {
+			width = width * max / height
+			height = max
+		}
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	rect := image.Rect(0, 0, width, height)
+	dst := image.NewRGBA(rect)
+	draw.Draw(dst, rect, image.White, image.ZP, draw.Src)
+	draw.CatmullRom.Scale(dst, rect, img, bounds, draw.Over, nil)
+	return dst
+}
+
+// writeThumbnail encodes a thumbnail in a temporary file of the storage, and
+// renames it, so that a thumbnail is never served half written.
+func writeThumbnail(c Context, name string, img image.Image) error {
+	fs := c.FS()
+	tmpname := name + ".tmp"
+	f, err := fs.Create(tmpname)
+	if err != nil {
+		return err
+	}
+	err = jpeg.Encode(f, img, &jpeg.Options{Quality: thumbnailQuality})
+	if cerr := f.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fs.Remove(tmpname)
+		return err
+	}
+	return fs.Rename(tmpname, name)
+}
+
+// RemoveThumbnails removes the thumbnails of a file, when its content has
+// changed or when it is destroyed.
+func RemoveThumbnails(c Context, fileID string) error {
+	for size := range ThumbnailSizes {
+		err := c.FS().Remove(thumbnailPath(fileID, size))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// ServeThumbnailContent replies to a http request with a thumbnail of an
+// image, like ServeFileContent. It returns ErrThumbnailNotFound if the
+// thumbnail has not been generated yet.
+func ServeThumbnailContent(c Context, doc *FileDoc, size string, req *http.Request, w http.ResponseWriter) error {
+	if !IsValidThumbnailSize(size) {
+		return ErrInvalidThumbnailSize
+	}
+	content, err := c.FS().Open(thumbnailPath(doc.ID(), ThumbnailSize(size)))
+	if os.IsNotExist(err) {
+		return ErrThumbnailNotFound
+	}
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	info, err := content.Stat()
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", ThumbnailMime)
+	http.ServeContent(w, req, doc.Name, info.ModTime(), content)
+	return nil
+}
@@ -0,0 +1,308 @@
+package vfs
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+)
+
+// VersionsDirName is the path of the directory, in the storage, where the
+// previous versions of the files are kept. It has no document, and is not
+// visible with the API.
+const VersionsDirName = "/.cozy_versions"
+
+// versionIDSeparator separates the identifier of the file and the revision
+// of the file for the version in the identifier of a version
+const versionIDSeparator = "/"
+
+// ErrVersionNotFound is used when a file has no version with the given
+// identifier
+var ErrVersionNotFound = errors.New("Version not found")
+
+// Version is a previous content of a file, kept when the file has been
+// overwritten. Its identifier is made of the identifier of the file and of
+// the revision of the file when it had this content.
+type Version struct {
+	DocID  string `json:"_id,omitempty"`
+	DocRev string `json:"_rev,omitempty"`
+
+	FileID string `json:"file_id"`
+	// FileRev is the revision of the file when it had this content
+	FileRev string `json:"file_rev"`
+
+	Size   int64  `json:"size,string"`
+	MD5Sum []byte `json:"md5sum"`
+	Mime   string `json:"mime"`
+	Class  string `json:"class"`
+
+	// UpdatedAt is the modification date of the content of the version, and
+	// ReplacedAt the date when it has been overwritten
+	UpdatedAt  time.Time `json:"updated_at"`
+	ReplacedAt time.Time `json:"replaced_at"`
+}
+
+// ID returns the version qualified identifier
+func (v *Version) ID() string { return v.DocID }
+
+// Rev returns the version revision
+func (v *Version) Rev() string { return v.DocRev }
+
+// DocType returns the version document type
+func (v *Version) DocType() string { return consts.FilesVersions }
+
+// SetID changes the version qualified identifier
+func (v *Version) SetID(id string) { v.DocID = id }
+
+// SetRev changes the version revision
+func (v *Version) SetRev(rev string) { v.DocRev = rev }
+
+// Links is used to generate a JSON-API link for the version (part of
+// jsonapi.Object interface)
+func (v *Version) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{
+		Self:    "/files/" + v.FileID + "/versions/" + v.FileRev,
+		Related: "/files/" + v.FileID + "/versions/" + v.FileRev + "/download",
+	}
+}
+
+// Relationships is used to generate the file relationship in JSON-API
+// format (part of the jsonapi.Object interface)
+func (v *Version) Relationships() jsonapi.RelationshipMap {
+	return jsonapi.RelationshipMap{
+		"file": jsonapi.Relationship{
+			Links: &jsonapi.LinksList{Related: "/files/" + v.FileID},
+			Data:  jsonapi.ResourceIdentifier{ID: v.FileID, Type: consts.Files},
+		},
+	}
+}
+
+// Included is part of the jsonapi.Object interface
+func (v *Version) Included() []jsonapi.Object {
+	return []jsonapi.Object{}
+}
+
+// blobPath returns the path of the content of the version in the storage
+func (v *Version) blobPath() string {
+	return path.Join(VersionsDirName, v.FileID, v.FileRev)
+}
+
+func versionID(fileID, fileRev string) string {
+	return fileID + versionIDSeparator + fileRev
+}
+
+// newVersion returns the version for the current content of a file
+func newVersion(doc *FileDoc) *Version {
+	return &Version{
+		DocID:      versionID(doc.ID(), doc.Rev()),
+		FileID:     doc.ID(),
+		FileRev:    doc.Rev(),
+		Size:       doc.Size,
+		MD5Sum:     doc.MD5Sum,
+		Mime:       doc.Mime,
+		Class:      doc.Class,
+		UpdatedAt:  doc.UpdatedAt,
+		ReplacedAt: time.Now(),
+	}
+}
+
+// versioningEnabled returns true if the previous versions of the files are
+// kept (see fs.versions.max)
+func versioningEnabled() bool {
+	return config.GetConfig().Fs.VersionsMax > 0
+}
+
+// GetVersions returns the previous versions of a file, from the oldest to
+// the most recent.
+func GetVersions(c Context, fileID string) ([]*Version, error) {
+	var versions []*Version
+	req := &couchdb.AllDocsRequest{
+		StartKey: fileID + versionIDSeparator,
+		EndKey:   fileID + versionIDSeparator + "\uffff",
+	}
+	err := couchdb.GetAllDocs(c, consts.FilesVersions, req, &versions)
+	if couchdb.IsNoDatabaseError(err) {
+		return []*Version{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// the revisions are sorted by their generation, not as strings
+	for i := 1; i < len(versions); i++ {
+		for j := i; j > 0 && revGeneration(versions[j].FileRev) < revGeneration(versions[j-1].FileRev); j-- {
+			versions[j], versions[j-1] = versions[j-1], versions[j]
+		}
+	}
+	return versions, nil
+}
+
+// GetVersion returns a previous version of a file, from the revision of the
+// file when it had this content.
+func GetVersion(c Context, fileID, fileRev string) (*Version, error) {
+	v := &Version{}
+	err := couchdb.GetDoc(c, consts.FilesVersions, versionID(fileID, fileRev), v)
+	if couchdb.IsNotFoundError(err) {
+		return nil, ErrVersionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// keepVersion moves the previous content of a file, at bakpath, to the
+// versions directory, and creates its document. The oldest versions are
+// then removed, according to the configuration.
+func keepVersion(c Context, olddoc *FileDoc, bakpath string) error {
+	v := newVersion(olddoc)
+	fs := c.FS()
+	if err := fs.MkdirAll(path.Dir(v.blobPath()), 0755); err != nil {
+		return err
+	}
+	if err := fs.Rename(bakpath, v.blobPath()); err != nil {
+		return err
+	}
+	if err := couchdb.CreateNamedDocWithDB(c, v); err != nil {
+		fs.Remove(v.blobPath())
+		return err
+	}
+	return pruneVersions(c, olddoc.ID())
+}
+
+// pruneVersions removes the versions of a file that are older than the
+// retention, or that are in excess of the maximal number of versions.
+func pruneVersions(c Context, fileID string) error {
+	versions, err := GetVersions(c, fileID)
+	if err != nil {
+		return err
+	}
+	cfg := config.GetConfig().Fs
+	excess := len(versions) - cfg.VersionsMax
+	for i, v := range versions {
+		expired := cfg.VersionsRetention > 0 && time.Since(v.ReplacedAt) > cfg.VersionsRetention
+		if i >= excess && !expired {
+			continue
+		}
+		if err = destroyVersion(c, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// destroyVersion removes the content and the document of a version
+func destroyVersion(c Context, v *Version) error {
+	if err := c.FS().Remove(v.blobPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return couchdb.DeleteDoc(c, v)
+}
+
+// destroyVersions removes all the versions of a file, when it is destroyed
+func destroyVersions(c Context, fileID string) error {
+	versions, err := GetVersions(c, fileID)
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		if err = destroyVersion(c, v); err != nil {
+			return err
+		}
+	}
+	c.FS().Remove(path.Join(VersionsDirName, fileID))
+	return nil
+}
+
+// ServeVersionContent replies to a http request with the content of a
+// previous version of a file, like ServeFileContent.
+func ServeVersionContent(c Context, doc *FileDoc, v *Version, disposition string, req *http.Request, w http.ResponseWriter) error {
+	header := w.Header()
+	if v.Mime != "" {
+		header.Set("Content-Type", v.Mime)
+	}
+	if disposition != "" {
+		header.Set("Content-Disposition", ContentDisposition(disposition, doc.Name))
+	}
+	if len(v.MD5Sum) > 0 {
+		eTag := base64.StdEncoding.EncodeToString(v.MD5Sum)
+		header.Set("Etag", `"`+eTag+`"`)
+	}
+
+	content, err := c.FS().Open(v.blobPath())
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	http.ServeContent(w, req, doc.Name, v.UpdatedAt, content)
+	return nil
+}
+
+// RestoreVersion puts back the content of a previous version as the current
+// content of a file. The current content is kept as a new version, so that
+// the restoration can be undone, and the restored version is removed.
+func RestoreVersion(c Context, olddoc *FileDoc, v *Version) (*FileDoc, error) {
+	content, err := c.FS().Open(v.blobPath())
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	newdoc, err := NewFileDoc(olddoc.Name, olddoc.DirID, v.Size, v.MD5Sum,
+		v.Mime, v.Class, olddoc.CreatedAt, olddoc.Executable, olddoc.Tags)
+	if err != nil {
+		return nil, err
+	}
+	newdoc.UpdatedAt = time.Now()
+	newdoc.ReferencedBy = olddoc.ReferencedBy
+
+	file, err := CreateFile(c, newdoc, olddoc)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(file, content)
+	if cerr := file.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	// the restored version may have already been pruned when the replaced
+	// content was kept as a new version
+	v, err = GetVersion(c, v.FileID, v.FileRev)
+	if err == ErrVersionNotFound {
+		return newdoc, nil
+	}
+	if err == nil {
+		err = destroyVersion(c, v)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newdoc, nil
+}
+
+func revGeneration(rev string) int {
+	n := 0
+	for _, c := range strings.SplitN(rev, "-", 2)[0] {
+		if c < '0' || c > '9' {
+			return 0
+		}
+		n = n*10 + int(c-'0')
+	}
+	return n
+}
+
+var (
+	_ couchdb.Doc    = &Version{}
+	_ jsonapi.Object = &Version{}
+)
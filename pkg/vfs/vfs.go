@@ -66,6 +66,7 @@ type DirOrFileDoc struct {
 	// fields from FileDoc not contained in DirDoc
 	Size       int64  `json:"size,string"`
 	MD5Sum     []byte `json:"md5sum"`
+	SHA256Sum  []byte `json:"sha256sum,omitempty"`
 	Mime       string `json:"mime"`
 	Class      string `json:"class"`
 	Executable bool   `json:"executable"`
@@ -89,6 +90,7 @@ func (fd *DirOrFileDoc) Refine() (*DirDoc, *FileDoc) {
 			UpdatedAt:   fd.UpdatedAt,
 			Size:        fd.Size,
 			MD5Sum:      fd.MD5Sum,
+			SHA256Sum:   fd.SHA256Sum,
 			Mime:        fd.Mime,
 			Class:       fd.Class,
 			Executable:  fd.Executable,
@@ -342,19 +344,16 @@ func RemoveAll(c Context, name string) error {
 
 // DiskUsage computes the total size of the files
 func DiskUsage(c Context) (int64, error) {
-	var doc couchdb.ViewResponse
-	err := couchdb.ExecView(c, consts.DiskUsageView, &couchdb.ViewRequest{
-		Reduce: true,
-	}, &doc)
+	rows, err := couchdb.ReduceViewQuery(c, consts.DiskUsageView, nil)
 	if err != nil {
 		return 0, err
 	}
-	if len(doc.Rows) == 0 {
+	if len(rows) == 0 {
 		return 0, nil
 	}
 
-	// Reduce of _count should give us a number value
-	f64, ok := doc.Rows[0].Value.(float64)
+	// Reduce of _sum should give us a number value
+	f64, ok := rows[0].Value.(float64)
 	if !ok {
 		return 0, ErrWrongCouchdbState
 	}
@@ -362,6 +361,36 @@ func DiskUsage(c Context) (int64, error) {
 	return int64(f64), nil
 }
 
+// DirsSize computes the size of the files directly in each directory, by
+// directory id. If no ids are given, it is computed for all the directories
+// with files.
+func DirsSize(c Context, dirIDs ...string) (map[string]int64, error) {
+	req := &couchdb.ViewRequest{Group: true}
+	for _, id := range dirIDs {
+		req.Keys = append(req.Keys, id)
+	}
+	rows, err := couchdb.ReduceViewQuery(c, consts.DirSizesView, req)
+	if couchdb.IsNotFoundError(err) {
+		// The view is missing on the instances created before it
+		if err = couchdb.DefineViews(c, consts.ViewsByDoctype(consts.Files)); err == nil {
+			rows, err = couchdb.ReduceViewQuery(c, consts.DirSizesView, req)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	sizes := make(map[string]int64, len(rows))
+	for _, row := range rows {
+		id, ok := row.Key.(string)
+		f64, ok2 := row.Value.(float64)
+		if !ok || !ok2 {
+			return nil, ErrWrongCouchdbState
+		}
+		sizes[id] = int64(f64)
+	}
+	return sizes, nil
+}
+
 // WalkFn type works like filepath.WalkFn type function. It receives
 // as argument the complete name of the file or directory, the type of
 // the document, the actual directory or file document and a possible
@@ -546,6 +575,28 @@ func checkFileName(str string) error {
 	return nil
 }
 
+// dedupTmpPrefix is the prefix of the temporary links made in the root
+// directory of the storage by the deduplication
+const dedupTmpPrefix = ".dedup_"
+
+// checkReservedName returns an error if the name is used in the root
+// directory of the storage for the blobs that have no document (previous
+// versions, thumbnails, quarantine), so that they can't be read or deleted
+// with the API.
+func checkReservedName(name, dirID string) error {
+	if dirID != consts.RootDirID {
+		return nil
+	}
+	switch "/" + name {
+	case QuarantineDirName, VersionsDirName, ThumbsDirName:
+		return ErrReservedFilename
+	}
+	if strings.HasPrefix(name, dedupTmpPrefix) {
+		return ErrReservedFilename
+	}
+	return nil
+}
+
 func uniqueTags(tags []string) []string {
 	m := make(map[string]struct{})
 	clone := make([]string, 0)
@@ -3,13 +3,17 @@ package vfs
 import (
 	"archive/zip"
 	"bytes"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
+	"image"
+	"image/png"
 	"io"
 	"io/ioutil"
 	"net/http/httptest"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -204,6 +208,14 @@ func TestDiskUsage(t *testing.T) {
 	used, err := DiskUsage(vfsC)
 	assert.NoError(t, err)
 	assert.Equal(t, len("hello !"), int(used))
+
+	sizes, err := DirsSize(vfsC)
+	assert.NoError(t, err)
+	var total int64
+	for _, size := range sizes {
+		total += size
+	}
+	assert.Equal(t, used, total)
 }
 
 func TestGetFileDocFromPath(t *testing.T) {
@@ -435,6 +447,17 @@ func TestContentDisposition(t *testing.T) {
 	assert.Equal(t, `inline; filename="download"; filename*=UTF-8''%F0%9F%90%A7`, emoji)
 }
 
+func TestReservedNames(t *testing.T) {
+	for _, name := range []string{".cozy_versions", ".cozy_thumbs", ".cozy_quarantine", ".dedup_0a1b"} {
+		_, err := NewDirDoc(name, "", nil, nil)
+		assert.Equal(t, ErrReservedFilename, err)
+		_, err = NewFileDoc(name, consts.RootDirID, -1, nil, "", "", time.Now(), false, nil)
+		assert.Equal(t, ErrReservedFilename, err)
+		_, err = NewDirDoc(name, "another-dir-id", nil, nil)
+		assert.NoError(t, err)
+	}
+}
+
 func TestArchive(t *testing.T) {
 	tree := H{
 		"archive/": H{
@@ -483,6 +506,62 @@ func TestArchive(t *testing.T) {
 	assert.Equal(t, "test/bar/z.gif", z.File[3].Name)
 }
 
+func TestDirArchive(t *testing.T) {
+	tree := H{
+		"dirarchive/": H{
+			"a.txt": nil,
+			"sub/": H{
+				"b.png": nil,
+				"c.txt": nil,
+			},
+			"secret/": H{
+				"d.txt": nil,
+			},
+		},
+	}
+	dir, err := createTree(tree, consts.RootDirID)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	filter := func(d *DirDoc, f *FileDoc) bool {
+		if d != nil {
+			return d.Name == "sub"
+		}
+		return f.Name == "a.txt"
+	}
+	w := httptest.NewRecorder()
+	err = ServeDirArchive(vfsC, dir, filter, w)
+	assert.NoError(t, err)
+
+	res := w.Result()
+	disposition := res.Header.Get("Content-Disposition")
+	assert.Equal(t, `attachment; filename=dirarchive.zip`, disposition)
+	assert.Equal(t, "application/zip", res.Header.Get("Content-Type"))
+
+	b, err := ioutil.ReadAll(res.Body)
+	assert.NoError(t, err)
+	z, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if !assert.NoError(t, err) {
+		return
+	}
+	var names []string
+	for _, f := range z.File {
+		names = append(names, f.Name)
+	}
+	assert.Len(t, names, 4)
+	assert.Contains(t, names, "dirarchive/a.txt")
+	assert.Contains(t, names, "dirarchive/sub/")
+	assert.Contains(t, names, "dirarchive/sub/b.png")
+	assert.Contains(t, names, "dirarchive/sub/c.txt")
+
+	nothing := func(d *DirDoc, f *FileDoc) bool { return false }
+	w = httptest.NewRecorder()
+	err = ServeDirArchive(vfsC, dir, nothing, w)
+	assert.Equal(t, ErrForbiddenArchive, err)
+	assert.Empty(t, w.Result().Header.Get("Content-Disposition"))
+}
+
 func TestDonwloadStore(t *testing.T) {
 	domainA := "alice.cozycloud.local"
 	domainB := "bob.cozycloud.local"
@@ -552,6 +631,260 @@ func TestFileSerialization(t *testing.T) {
 	assert.Contains(t, string(b3), "foorefid")
 }
 
+func TestCollectGarbage(t *testing.T) {
+	grace := GCGracePeriod
+	GCGracePeriod = 0
+	defer func() { GCGracePeriod = grace }()
+
+	// A blob without document, like after a failed upload
+	fs := vfsC.FS()
+	err := afero.WriteFile(fs, "/gc-orphan", []byte("orphan"), 0644)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// A document without blob
+	doc, err := NewFileDoc("gc-missing", consts.RootDirID, -1, nil, "text/plain", "text", time.Now(), false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	file, err := CreateFile(vfsC, doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = file.Write([]byte("missing"))
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+	assert.NoError(t, fs.Remove("/gc-missing"))
+
+	stats, err := CollectGarbage(vfsC, GCReport)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Contains(t, stats.OrphanBlobs, "/gc-orphan")
+	assert.Contains(t, stats.MissingBlobs, doc.ID())
+	assert.Equal(t, 0, stats.Quarantined)
+	assert.Equal(t, 0, stats.Cleaned)
+	exists, _ := afero.Exists(fs, "/gc-orphan")
+	assert.True(t, exists)
+
+	stats, err = CollectGarbage(vfsC, GCQuarantine)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, stats.Quarantined > 0)
+	exists, _ = afero.Exists(fs, "/gc-orphan")
+	assert.False(t, exists)
+	exists, _ = afero.Exists(fs, QuarantineDirName+"/gc-orphan")
+	assert.True(t, exists)
+	_, err = GetFileDoc(vfsC, doc.ID())
+	assert.NoError(t, err)
+
+	stats, err = CollectGarbage(vfsC, GCClean)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotContains(t, stats.OrphanBlobs, "/gc-orphan")
+	assert.Contains(t, stats.MissingBlobs, doc.ID())
+	assert.True(t, stats.Cleaned > 0)
+	_, err = GetFileDoc(vfsC, doc.ID())
+	assert.Error(t, err)
+
+	last, err := GetGCStats(vfsC)
+	if assert.NoError(t, err) {
+		assert.Equal(t, GCClean, last.Policy)
+		assert.Equal(t, stats.ScannedFiles, last.ScannedFiles)
+	}
+}
+
+func TestVersions(t *testing.T) {
+	cfg := config.GetConfig()
+	max := cfg.Fs.VersionsMax
+	cfg.Fs.VersionsMax = 2
+	defer func() { cfg.Fs.VersionsMax = max }()
+
+	doc, err := NewFileDoc("versioned", consts.RootDirID, -1, nil, "text/plain", "text", time.Now(), false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	file, err := CreateFile(vfsC, doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = file.Write([]byte("v1"))
+	assert.NoError(t, err)
+	if !assert.NoError(t, file.Close()) {
+		return
+	}
+
+	for _, content := range []string{"v2", "v3", "v4"} {
+		olddoc := doc
+		doc, err = NewFileDoc("versioned", consts.RootDirID, -1, nil, "text/plain", "text", time.Now(), false, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		file, err = CreateFile(vfsC, doc, olddoc)
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = file.Write([]byte(content))
+		assert.NoError(t, err)
+		if !assert.NoError(t, file.Close()) {
+			return
+		}
+	}
+
+	versions, err := GetVersions(vfsC, doc.ID())
+	if !assert.NoError(t, err) || !assert.Len(t, versions, 2) {
+		return
+	}
+	assert.Equal(t, int64(2), versions[0].Size)
+	oldest, err := afero.ReadFile(vfsC.FS(), versions[0].blobPath())
+	assert.NoError(t, err)
+	assert.Equal(t, "v2", string(oldest))
+
+	_, err = GetVersion(vfsC, doc.ID(), "1-unknown")
+	assert.Equal(t, ErrVersionNotFound, err)
+
+	restored, err := RestoreVersion(vfsC, doc, versions[0])
+	if !assert.NoError(t, err) {
+		return
+	}
+	content, err := afero.ReadFile(vfsC.FS(), "/versioned")
+	assert.NoError(t, err)
+	assert.Equal(t, "v2", string(content))
+
+	versions, err = GetVersions(vfsC, doc.ID())
+	if assert.NoError(t, err) && assert.Len(t, versions, 2) {
+		assert.Equal(t, doc.Rev(), versions[1].FileRev)
+	}
+
+	assert.NoError(t, DestroyFile(vfsC, restored))
+	versions, err = GetVersions(vfsC, doc.ID())
+	assert.NoError(t, err)
+	assert.Len(t, versions, 0)
+	exists, _ := afero.Exists(vfsC.FS(), VersionsDirName+"/"+doc.ID())
+	assert.False(t, exists)
+}
+
+func TestThumbnails(t *testing.T) {
+	var buf bytes.Buffer
+	err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 300, 200)))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	doc, err := NewFileDoc("thumbs.png", consts.RootDirID, -1, nil, "image/png", "image", time.Now(), false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, CanHaveThumbnails(doc))
+	file, err := CreateFile(vfsC, doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = io.Copy(file, &buf)
+	assert.NoError(t, err)
+	if !assert.NoError(t, file.Close()) {
+		return
+	}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/files/"+doc.ID()+"/thumbnail", nil)
+	err = ServeThumbnailContent(vfsC, doc, "small", req, w)
+	assert.Equal(t, ErrThumbnailNotFound, err)
+	err = ServeThumbnailContent(vfsC, doc, "huge", req, w)
+	assert.Equal(t, ErrInvalidThumbnailSize, err)
+
+	if !assert.NoError(t, GenerateThumbnails(vfsC, doc)) {
+		return
+	}
+	expected := map[ThumbnailSize][2]int{
+		ThumbnailSmall:  {128, 85},
+		ThumbnailMedium: {300, 200},
+		ThumbnailLarge:  {300, 200},
+	}
+	for size, dims := range expected {
+		f, err := vfsC.FS().Open(thumbnailPath(doc.ID(), size))
+		if !assert.NoError(t, err) {
+			return
+		}
+		cfg, format, err := image.DecodeConfig(f)
+		f.Close()
+		assert.NoError(t, err)
+		assert.Equal(t, "jpeg", format)
+		assert.Equal(t, dims[0], cfg.Width)
+		assert.Equal(t, dims[1], cfg.Height)
+	}
+
+	w = httptest.NewRecorder()
+	err = ServeThumbnailContent(vfsC, doc, "small", req, w)
+	assert.NoError(t, err)
+	assert.Equal(t, ThumbnailMime, w.Header().Get("Content-Type"))
+
+	assert.NoError(t, DestroyFile(vfsC, doc))
+	exists, _ := afero.Exists(vfsC.FS(), thumbnailPath(doc.ID(), ThumbnailSmall))
+	assert.False(t, exists)
+}
+
+func TestDedup(t *testing.T) {
+	cfg := config.GetConfig()
+	dedup := cfg.Fs.Dedup
+	cfg.Fs.Dedup = true
+	grace := dedupGracePeriod
+	dedupGracePeriod = 0
+	defer func() {
+		cfg.Fs.Dedup = dedup
+		dedupGracePeriod = grace
+	}()
+
+	tempdir, err := ioutil.TempDir("", "cozy-stack-dedup")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tempdir)
+	localC := TestContext{prefix: vfsC.prefix, fs: NewLocalFs(tempdir)}
+
+	content := []byte("the same content")
+	expected := sha256.Sum256(content)
+	var docs []*FileDoc
+	for _, name := range []string{"dedup1", "dedup2"} {
+		doc, err := NewFileDoc(name, consts.RootDirID, -1, nil, "text/plain", "text", time.Now(), false, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		file, err := CreateFile(localC, doc, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = file.Write(content)
+		assert.NoError(t, err)
+		if !assert.NoError(t, file.Close()) {
+			return
+		}
+		assert.Equal(t, expected[:], doc.SHA256Sum)
+		docs = append(docs, doc)
+	}
+
+	info1, err := os.Stat(filepath.Join(tempdir, "dedup1"))
+	assert.NoError(t, err)
+	info2, err := os.Stat(filepath.Join(tempdir, "dedup2"))
+	assert.NoError(t, err)
+	assert.True(t, os.SameFile(info1, info2))
+
+	exec := true
+	_, err = ModifyFileMetadata(localC, docs[1], &DocPatch{Executable: &exec})
+	assert.NoError(t, err)
+	info2, err = os.Stat(filepath.Join(tempdir, "dedup2"))
+	assert.NoError(t, err)
+	assert.False(t, os.SameFile(info1, info2))
+	assert.Equal(t, os.FileMode(0644), info1.Mode().Perm())
+
+	for _, doc := range docs {
+		assert.NoError(t, couchdb.DeleteDoc(vfsC, doc))
+	}
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 
@@ -598,6 +931,7 @@ func TestMain(m *testing.M) {
 
 	os.RemoveAll(tempdir)
 	couchdb.DeleteDB(vfsC, consts.Files)
+	couchdb.DeleteDB(vfsC, consts.FilesVersions)
 
 	os.Exit(res)
 }
@@ -0,0 +1,32 @@
+#!/usr/bin/env bash
+set -e
+
+# Generate the Go and JS client SDKs from the OpenAPI description of the HTTP
+# API of the stack.
+#
+# Usage: ./scripts/generate-clients.sh <go-client-dir> <js-client-dir>
+
+GENERATOR_IMAGE="openapitools/openapi-generator-cli"
+
+if [ $# -ne 2 ]; then
+	>&2 echo "Usage: $0 <go-client-dir> <js-client-dir>"
+	exit 1
+fi
+
+GO_DIR=$(cd "${1}" && pwd)
+JS_DIR=$(cd "${2}" && pwd)
+
+pushd `dirname $0` > /dev/null
+WORK_DIR=$(dirname "`pwd`")
+popd > /dev/null
+
+SPEC_DIR=$(mktemp -d)
+trap "rm -rf ${SPEC_DIR}" EXIT
+
+go run "${WORK_DIR}/main.go" doc openapi "${SPEC_DIR}/openapi.json"
+
+docker run --rm -v "${SPEC_DIR}:/spec" -v "${GO_DIR}:/out" \
+	"${GENERATOR_IMAGE}" generate -i /spec/openapi.json -g go -o /out \
+	--additional-properties=packageName=cozy
+docker run --rm -v "${SPEC_DIR}:/spec" -v "${JS_DIR}:/out" \
+	"${GENERATOR_IMAGE}" generate -i /spec/openapi.json -g javascript -o /out
@@ -4,19 +4,27 @@ package apps
 
 import (
 	"bytes"
+	"crypto/md5" // #nosec
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"path"
+	"strconv"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/cozy/cozy-stack/pkg/apps"
 	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/cozy/cozy-stack/web/jsonapi"
 	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/openapi"
 	"github.com/cozy/cozy-stack/web/permissions"
 	"github.com/labstack/echo"
 )
@@ -31,13 +39,7 @@ const typeTextEventStream = "text/event-stream"
 func installHandler(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
 	slug := c.Param("slug")
-	if err := permissions.AllowInstallApp(c, permissions.POST); err != nil {
-		return err
-	}
-	inst, err := apps.NewInstaller(instance, &apps.InstallerOptions{
-		SourceURL: c.QueryParam("Source"),
-		Slug:      slug,
-	})
+	inst, err := apps.NewInstaller(instance, installerOptions(c, slug))
 	if err != nil {
 		return wrapAppsError(err)
 	}
@@ -50,26 +52,166 @@ func installHandler(c echo.Context) error {
 func updateHandler(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
 	slug := c.Param("slug")
-	if err := permissions.AllowInstallApp(c, permissions.POST); err != nil {
+	inst, err := apps.NewInstaller(instance, installerOptions(c, slug))
+	if err != nil {
+		return wrapAppsError(err)
+	}
+	go inst.Update()
+	return pollInstaller(c, slug, inst)
+}
+
+// installerOptions returns the options of the installer for the request. The
+// credentials of a private repository are sent in the Username and Password
+// fields of the form, and the ones in the Source URL are removed from the
+// request URI, as it can be logged.
+func installerOptions(c echo.Context, slug string) *apps.InstallerOptions {
+	req := c.Request()
+	source := c.QueryParam("Source")
+	if src, err := url.Parse(source); err == nil && src.User != nil {
+		src.User = nil
+		query := req.URL.Query()
+		query.Set("Source", src.String())
+		req.URL.RawQuery = query.Encode()
+		req.RequestURI = req.URL.RequestURI()
+	}
+	return &apps.InstallerOptions{
+		Slug:      slug,
+		SourceURL: source,
+		Username:  req.PostFormValue("Username"),
+		Password:  req.PostFormValue("Password"),
+	}
+}
+
+// updateAllHandler handles POST /update requests, used to update all the
+// installed applications, one after the other, with their current source.
+func updateAllHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	docs, err := apps.List(instance)
+	if err != nil {
+		return wrapAppsError(err)
+	}
+
+	accept := c.Request().Header.Get("Accept")
+	if accept != typeTextEventStream {
+		go func() {
+			for _, man := range docs {
+				if err := updateApp(instance, man.Slug, nil); err != nil {
+					log.Errorf("[apps] %s could not be updated: %v", man.Slug, err)
+				}
+			}
+		}()
+		objs := make([]jsonapi.Object, len(docs))
+		for i, d := range docs {
+			d.Instance = instance
+			d.Localize(instance.Locale)
+			objs[i] = jsonapi.Object(d)
+		}
+		return jsonapi.DataList(c, http.StatusAccepted, objs, nil)
+	}
+
+	w := c.Response().Writer
+	w.Header().Set("Content-Type", typeTextEventStream)
+	w.WriteHeader(200)
+	for _, man := range docs {
+		err := updateApp(instance, man.Slug, func(state *apps.Manifest) {
+			buf := new(bytes.Buffer)
+			if err := jsonapi.WriteData(buf, state, nil); err == nil {
+				writeStream(w, "state", buf.String())
+			}
+		})
+		if err != nil {
+			b, err := json.Marshal(map[string]string{
+				"slug":  man.Slug,
+				"error": err.Error(),
+			})
+			if err == nil {
+				writeStream(w, "error", string(b))
+			}
+		}
+	}
+	return nil
+}
+
+// updateApp updates an application, and calls progress, if not nil, for each
+// state of the update.
+func updateApp(instance *instance.Instance, slug string, progress func(*apps.Manifest)) error {
+	inst, err := apps.NewInstaller(instance, &apps.InstallerOptions{Slug: slug})
+	if err != nil {
 		return err
 	}
+	go inst.Update()
+	for {
+		man, done, err := inst.Poll()
+		if err != nil {
+			return err
+		}
+		if progress != nil {
+			progress(man)
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+// rollbackHandler handles all POST /:slug/rollback requests, used to
+// reinstall the previous version of an application.
+func rollbackHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	slug := c.Param("slug")
 	inst, err := apps.NewInstaller(instance, &apps.InstallerOptions{
 		Slug: slug,
 	})
 	if err != nil {
 		return wrapAppsError(err)
 	}
-	go inst.Update()
+	go inst.Rollback()
+	return pollInstaller(c, slug, inst)
+}
+
+// acceptConsentHandler handles all POST /:slug/consent requests, used to
+// accept the new permissions of an update and perform it.
+func acceptConsentHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	slug := c.Param("slug")
+	inst, err := apps.NewInstaller(instance, &apps.InstallerOptions{
+		Slug: slug,
+	})
+	if err != nil {
+		return wrapAppsError(err)
+	}
+	go inst.AcceptUpdate()
 	return pollInstaller(c, slug, inst)
 }
 
+// refuseConsentHandler handles all DELETE /:slug/consent requests, used to
+// refuse the new permissions of an update. The installed version is kept.
+func refuseConsentHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	slug := c.Param("slug")
+	inst, err := apps.NewInstaller(instance, &apps.InstallerOptions{Slug: slug})
+	if err != nil {
+		return wrapAppsError(err)
+	}
+	man, err := inst.RefuseUpdate()
+	if err != nil {
+		return wrapAppsError(err)
+	}
+	return jsonapi.Data(c, http.StatusOK, man, nil)
+}
+
 // deleteHandler handles all DELETE /:slug used to delete an application with
 // the specified slug.
 func deleteHandler(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
 	slug := c.Param("slug")
-	if err := permissions.AllowInstallApp(c, permissions.DELETE); err != nil {
-		return err
+	removeData := false
+	switch c.QueryParam("Data") {
+	case "", "keep":
+	case "remove":
+		removeData = true
+	default:
+		return jsonapi.InvalidParameter("Data", errors.New("Data must be keep or remove"))
 	}
 	inst, err := apps.NewInstaller(instance, &apps.InstallerOptions{Slug: slug})
 	if err != nil {
@@ -79,6 +221,16 @@ func deleteHandler(c echo.Context) error {
 	if err != nil {
 		return wrapAppsError(err)
 	}
+	if removeData {
+		doctypes, err := apps.UnusedDoctypes(instance, man)
+		if err != nil {
+			return err
+		}
+		man.DataRemoval, err = apps.ScheduleDataRemoval(instance.JobsScheduler(), slug, doctypes)
+		if err != nil {
+			return err
+		}
+	}
 	return jsonapi.Data(c, http.StatusOK, man, nil)
 }
 
@@ -142,12 +294,21 @@ func writeStream(w http.ResponseWriter, event string, b string) {
 // installed applications.
 func listHandler(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
-
-	if err := permissions.AllowWholeType(c, permissions.GET, consts.Apps); err != nil {
-		return err
+	limit := apps.DefaultListLimit
+	if param := c.QueryParam("page[limit]"); param != "" {
+		l, err := strconv.Atoi(param)
+		if err != nil || l <= 0 || l > apps.MaxListLimit {
+			return jsonapi.InvalidParameter("page[limit]", errors.New("Invalid limit value"))
+		}
+		limit = l
 	}
+	state := c.QueryParam("state")
+	if state != "" && !apps.IsValidState(state) {
+		return jsonapi.InvalidParameter("state", errors.New("Invalid state"))
+	}
+	cursor := c.QueryParam("page[cursor]")
 
-	docs, err := apps.List(instance)
+	docs, next, err := apps.ListPage(instance, apps.State(state), cursor, limit)
 	if err != nil {
 		return wrapAppsError(err)
 	}
@@ -155,9 +316,81 @@ func listHandler(c echo.Context) error {
 	objs := make([]jsonapi.Object, len(docs))
 	for i, d := range docs {
 		d.Instance = instance
+		d.Localize(instance.Locale)
 		objs[i] = jsonapi.Object(d)
 	}
 
+	var links *jsonapi.LinksList
+	if next != "" {
+		query := url.Values{}
+		query.Set("page[cursor]", next)
+		query.Set("page[limit]", strconv.Itoa(limit))
+		if state != "" {
+			query.Set("state", state)
+		}
+		links = &jsonapi.LinksList{Next: "/apps/?" + query.Encode()}
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, links)
+}
+
+// getHandler handles all GET /:slug requests and returns the manifest of a
+// single installed application.
+func getHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	slug := c.Param("slug")
+	man, err := apps.GetBySlug(instance, slug)
+	if err != nil {
+		if couchdb.IsNotFoundError(err) {
+			return wrapAppsError(apps.ErrNotFound)
+		}
+		return err
+	}
+
+	if err = permissions.Allow(c, permissions.GET, man); err != nil {
+		return err
+	}
+
+	man.Instance = instance
+	man.Localize(instance.Locale)
+	return jsonapi.Data(c, http.StatusOK, man, nil)
+}
+
+type apiIntentService struct {
+	*apps.IntentService
+}
+
+func (s *apiIntentService) ID() string                             { return s.Slug }
+func (s *apiIntentService) Rev() string                            { return "" }
+func (s *apiIntentService) DocType() string                        { return consts.AppsIntents }
+func (s *apiIntentService) SetID(_ string)                         {}
+func (s *apiIntentService) SetRev(_ string)                        {}
+func (s *apiIntentService) Relationships() jsonapi.RelationshipMap { return nil }
+func (s *apiIntentService) Included() []jsonapi.Object             { return nil }
+func (s *apiIntentService) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Related: s.Href}
+}
+
+// intentsHandler lists the applications that can handle the intent with the
+// given action and doctype.
+func intentsHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	action := c.QueryParam("action")
+	if action == "" {
+		return jsonapi.InvalidParameter("action", errors.New("Missing action"))
+	}
+	doctype := c.QueryParam("type")
+	if doctype == "" {
+		return jsonapi.InvalidParameter("type", errors.New("Missing type"))
+	}
+
+	services, err := apps.FindIntentServices(instance, instance, action, doctype)
+	if err != nil {
+		return wrapAppsError(err)
+	}
+	objs := make([]jsonapi.Object, len(services))
+	for i, s := range services {
+		objs[i] = &apiIntentService{s}
+	}
 	return jsonapi.DataList(c, http.StatusOK, objs, nil)
 }
 
@@ -180,38 +413,140 @@ func iconHandler(c echo.Context) error {
 		return err
 	}
 	defer r.Close()
-	http.ServeContent(c.Response(), c.Request(), filepath, time.Time{}, r)
+	// The icons are small enough to be read in memory for computing their
+	// checksum
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	// The Etag is used by http.ServeContent for the If-None-Match requests
+	sum := md5.Sum(content) // #nosec
+	header := c.Response().Header()
+	header.Set("Etag", `"`+base64.StdEncoding.EncodeToString(sum[:])+`"`)
+	if v := c.QueryParam("v"); v != "" && v == app.Version {
+		header.Set("Cache-Control", "private, max-age="+iconMaxAge+", immutable")
+	} else {
+		header.Set("Cache-Control", "private, no-cache")
+	}
+	http.ServeContent(c.Response(), c.Request(), filepath, time.Time{}, bytes.NewReader(content))
 	return nil
 }
 
-// Routes sets the routing for the apps service
-func Routes(router *echo.Group) {
-	router.GET("/", listHandler)
-	router.POST("/:slug", installHandler)
-	router.PUT("/:slug", updateHandler)
-	router.DELETE("/:slug", deleteHandler)
-	router.GET("/:slug/icon", iconHandler)
+// iconMaxAge is the max-age, in seconds, of the icons requested with the
+// version of the application: a new URL is used after an update.
+const iconMaxAge = "31536000"
+
+// Routes sets the routing for the apps service, with the permission required
+// by each route
+func Routes(router *permissions.Router) {
+	install := permissions.InstallApp(permissions.POST)
+	router.GET("/", listHandler, permissions.WholeType(permissions.GET, consts.Apps))
+	router.POST("/update", updateAllHandler, install)
+	router.GET("/intents", intentsHandler, permissions.ResolveIntent)
+	router.GET("/:slug", getHandler, permissions.Document(permissions.GET, consts.Apps))
+	router.POST("/:slug", installHandler, install)
+	router.PUT("/:slug", updateHandler, install)
+	router.DELETE("/:slug", deleteHandler, permissions.InstallApp(permissions.DELETE))
+	router.POST("/:slug/rollback", rollbackHandler, install)
+	router.POST("/:slug/consent", acceptConsentHandler, install)
+	router.DELETE("/:slug/consent", refuseConsentHandler, install)
+	router.GET("/:slug/icon", iconHandler, permissions.Document(permissions.GET, consts.Apps))
+}
+
+var sourceParam = openapi.Param{
+	Name:        "Source",
+	Description: "the URL of the source of the application, with an optional branch or tag in the fragment",
+}
+
+// Endpoints is the description of the routes of the apps service, for the
+// OpenAPI document
+var Endpoints = []*openapi.Endpoint{
+	{Method: "GET", Path: "/", Summary: "List the installed applications",
+		Query: []openapi.Param{
+			{Name: "page[limit]", Description: "the number of applications in the page (100 by default)"},
+			{Name: "page[cursor]", Description: "the slug of the last application of the previous page"},
+			{Name: "state", Description: "only list the applications in this state"},
+		},
+		Response: []*apps.Manifest{}, JSONAPI: true},
+	{Method: "GET", Path: "/:slug", Summary: "Get the manifest of an installed application",
+		Response: &apps.Manifest{}, JSONAPI: true},
+	{Method: "POST", Path: "/:slug", Summary: "Install an application",
+		Query: []openapi.Param{sourceParam}, Response: &apps.Manifest{}, JSONAPI: true,
+		Status: http.StatusAccepted},
+	{Method: "PUT", Path: "/:slug", Summary: "Update an application",
+		Query: []openapi.Param{sourceParam}, Response: &apps.Manifest{}, JSONAPI: true,
+		Status: http.StatusAccepted},
+	{Method: "GET", Path: "/intents", Summary: "List the applications that can handle an intent",
+		Query: []openapi.Param{
+			{Name: "action", Description: "the action of the intent, like PICK"},
+			{Name: "type", Description: "the doctype of the intent, like io.cozy.files"},
+		},
+		Response: []*apps.IntentService{}, JSONAPI: true},
+	{Method: "POST", Path: "/update", Summary: "Update all the installed applications",
+		Response: []*apps.Manifest{}, JSONAPI: true, Status: http.StatusAccepted},
+	{Method: "DELETE", Path: "/:slug", Summary: "Uninstall an application",
+		Query: []openapi.Param{
+			{Name: "Data", Description: "keep (default) or remove the data used only by the application"},
+		},
+		Response: &apps.Manifest{}, JSONAPI: true},
+	{Method: "POST", Path: "/:slug/rollback", Summary: "Reinstall the previous version of an application",
+		Response: &apps.Manifest{}, JSONAPI: true, Status: http.StatusAccepted},
+	{Method: "POST", Path: "/:slug/consent", Summary: "Accept the new permissions of a pending update",
+		Response: &apps.Manifest{}, JSONAPI: true, Status: http.StatusAccepted},
+	{Method: "DELETE", Path: "/:slug/consent", Summary: "Refuse the new permissions of a pending update",
+		Response: &apps.Manifest{}, JSONAPI: true},
+	{Method: "GET", Path: "/:slug/icon", Summary: "Get the icon of an application",
+		Query: []openapi.Param{
+			{Name: "v", Description: "the version of the application, for a long-lived cache"},
+		}},
 }
 
 func wrapAppsError(err error) error {
 	switch err {
 	case apps.ErrInvalidSlugName:
 		return jsonapi.InvalidParameter("slug", err)
+	case apps.ErrReservedSlug:
+		return jsonapi.InvalidParameter("slug", err)
+	case apps.ErrSlugCollision:
+		return jsonapi.Conflict(err)
 	case apps.ErrAlreadyExists:
 		return jsonapi.Conflict(err)
 	case apps.ErrNotFound:
 		return jsonapi.NotFound(err)
 	case apps.ErrNotSupportedSource:
 		return jsonapi.InvalidParameter("Source", err)
-	case apps.ErrManifestNotReachable:
+	case apps.ErrSourceNotAllowed, apps.ErrDevServerNotLocal:
+		return jsonapi.NewError(http.StatusForbidden, err)
+	case apps.ErrManifestNotReachable, apps.ErrCommitNotFound:
+		return jsonapi.NotFound(err)
+	case apps.ErrNotFoundInRegistry:
 		return jsonapi.NotFound(err)
 	case apps.ErrSourceNotReachable:
 		return jsonapi.BadRequest(err)
 	case apps.ErrBadManifest:
 		return jsonapi.BadRequest(err)
+	case apps.ErrBadTarball:
+		return jsonapi.BadRequest(err)
+	case apps.ErrNoPreviousVersion:
+		return jsonapi.NotFound(err)
+	case apps.ErrBadState:
+		return jsonapi.Conflict(err)
 	}
 	if _, ok := err.(*url.Error); ok {
 		return jsonapi.InvalidParameter("Source", err)
 	}
+	if errs, ok := err.(apps.ManifestErrors); ok {
+		list := make(jsonapi.ErrorList, len(errs))
+		for i, e := range errs {
+			list[i] = &jsonapi.Error{
+				Status: http.StatusUnprocessableEntity,
+				Title:  "Invalid Manifest",
+				Detail: e.Message,
+				Source: jsonapi.SourceError{Pointer: e.Field},
+			}
+		}
+		return list
+	}
 	return err
 }
@@ -5,6 +5,7 @@ package apps_test
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -15,6 +16,7 @@ import (
 	"os"
 	"path"
 	"testing"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/apps"
 	"github.com/cozy/cozy-stack/pkg/config"
@@ -28,6 +30,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/cozy/cozy-stack/web"
 	webApps "github.com/cozy/cozy-stack/web/apps"
+	webpermissions "github.com/cozy/cozy-stack/web/permissions"
 	"github.com/labstack/echo"
 	"github.com/stretchr/testify/assert"
 	jwt "gopkg.in/dgrijalva/jwt-go.v3"
@@ -94,6 +97,13 @@ func installMiniApp() error {
 				Index:  "index.html",
 				Public: true,
 			},
+			"/assets": apps.Route{
+				Folder: "/bar",
+				Public: true,
+			},
+		},
+		Assets: map[string]*apps.Asset{
+			"/bar/app.3f2a9b1c.js": {Hash: "0123456789abcdef", Gzip: true},
 		},
 	}
 
@@ -130,6 +140,18 @@ func installMiniApp() error {
 	if err != nil {
 		return err
 	}
+	err = createFile(bardir, "app.3f2a9b1c.js", assetContent)
+	if err != nil {
+		return err
+	}
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte(assetContent))
+	w.Close()
+	err = createFile(bardir, "app.3f2a9b1c.js.gz", gz.String())
+	if err != nil {
+		return err
+	}
 	err = createFile(appdir, "hello.html", "world {{.Token}}")
 	if err != nil {
 		return err
@@ -198,6 +220,86 @@ func TestServe(t *testing.T) {
 	assertNotFound(t, "/")
 	assertNotFound(t, "/index.html")
 	assertNotFound(t, "/public/hello.html")
+	assertAnonGet(t, "/assets/index.html", "text/html; charset=utf-8", "{{.CozyBar}}")
+	assertNotFound(t, "/assets")
+	assertNotFound(t, "/assets/")
+}
+
+const assetContent = "console.log('hello world');"
+
+func TestServeAsset(t *testing.T) {
+	get := func(encoding, etag string) *http.Response {
+		req, _ := http.NewRequest("GET", ts.URL+"/bar/app.3f2a9b1c.js", nil)
+		req.Host = slug + "." + domain
+		req.Header.Set("Accept-Encoding", encoding)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		res, err := client.Do(req)
+		assert.NoError(t, err)
+		return res
+	}
+
+	res := get("gzip, deflate", "")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, `"0123456789abcdef-gzip"`, res.Header.Get("Etag"))
+	assert.Equal(t, "Accept-Encoding", res.Header.Get("Vary"))
+	assert.Contains(t, res.Header.Get("Cache-Control"), "immutable")
+	r, err := gzip.NewReader(res.Body)
+	if assert.NoError(t, err) {
+		body, _ := ioutil.ReadAll(r)
+		assert.Equal(t, assetContent, string(body))
+	}
+	res.Body.Close()
+
+	res = get("deflate, gzip;q=0", "")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Empty(t, res.Header.Get("Content-Encoding"))
+	assert.Equal(t, `"0123456789abcdef"`, res.Header.Get("Etag"))
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Equal(t, assetContent, string(body))
+	res.Body.Close()
+
+	res = get("identity", `"0123456789abcdef"`)
+	assert.Equal(t, 304, res.StatusCode)
+	res.Body.Close()
+
+	// The files without a fingerprint in their name must be revalidated
+	res, err = doGet("/foo/hello.html", true)
+	assert.NoError(t, err)
+	assert.Empty(t, res.Header.Get("Cache-Control"))
+	res.Body.Close()
+}
+
+func TestProxyServer(t *testing.T) {
+	dev := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/app/main.js" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/javascript")
+		w.Write([]byte(assetContent))
+	}))
+	defer dev.Close()
+	base, _ := url.Parse(dev.URL + "/app")
+	fs := webApps.NewProxyServer(base)
+
+	infos, err := fs.Stat(slug, "/", "main.js")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "main.js", infos.Name())
+		assert.EqualValues(t, len(assetContent), infos.Size())
+	}
+	_, err = fs.Stat(slug, "/", "missing.js")
+	assert.True(t, os.IsNotExist(err))
+
+	req, _ := http.NewRequest("GET", "/main.js", nil)
+	w := httptest.NewRecorder()
+	assert.NoError(t, fs.ServeFileContent(w, req, time.Now(), slug, "/", "main.js"))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "application/javascript", w.Header().Get("Content-Type"))
+	assert.Equal(t, "no-cache, no-store", w.Header().Get("Cache-Control"))
+	assert.Equal(t, assetContent, w.Body.String())
 }
 
 func TestCozyBar(t *testing.T) {
@@ -273,6 +375,15 @@ func TestOauthAppCantUpdateApp(t *testing.T) {
 	assert.Equal(t, 403, res.StatusCode)
 }
 
+func TestOauthAppCantUpdateAllApps(t *testing.T) {
+	req, _ := http.NewRequest("POST", ts.URL+"/apps/update", nil)
+	req.Header.Add("Authorization", "Bearer "+testToken(testInstance))
+	req.Host = domain
+	res, err := client.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 403, res.StatusCode)
+}
+
 func TestListApps(t *testing.T) {
 	req, _ := http.NewRequest("GET", ts.URL+"/apps/", nil)
 	req.Header.Add("Authorization", "Bearer "+testToken(testInstance))
@@ -307,6 +418,132 @@ func TestListApps(t *testing.T) {
 	assert.Equal(t, "/apps/mini/icon", icon)
 }
 
+func TestGetApp(t *testing.T) {
+	req, _ := http.NewRequest("GET", ts.URL+"/apps/mini", nil)
+	req.Header.Add("Authorization", "Bearer "+testToken(testInstance))
+	req.Host = domain
+	res, err := client.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+
+	var result map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	data := result["data"].(map[string]interface{})
+	assert.Equal(t, "io.cozy.apps", data["type"])
+	attrs := data["attributes"].(map[string]interface{})
+	assert.Equal(t, "mini", attrs["slug"])
+	assert.Equal(t, "ready", attrs["state"])
+	links := data["links"].(map[string]interface{})
+	assert.Equal(t, "/apps/mini", links["self"])
+
+	req, _ = http.NewRequest("GET", ts.URL+"/apps/unknown", nil)
+	req.Header.Add("Authorization", "Bearer "+testToken(testInstance))
+	req.Host = domain
+	res, err = client.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 404, res.StatusCode)
+}
+
+func TestListAppsPagination(t *testing.T) {
+	alpha := &apps.Manifest{Name: "Alpha", Slug: "alpha", State: apps.Errored}
+	zeta := &apps.Manifest{Name: "Zeta", Slug: "zeta", State: apps.Ready}
+	for _, man := range []*apps.Manifest{alpha, zeta} {
+		assert.NoError(t, couchdb.CreateNamedDoc(testInstance, man))
+		defer couchdb.DeleteDoc(testInstance, man)
+	}
+
+	list := func(query string) (int, []string, string) {
+		req, _ := http.NewRequest("GET", ts.URL+"/apps/?"+query, nil)
+		req.Header.Add("Authorization", "Bearer "+testToken(testInstance))
+		req.Host = domain
+		res, err := client.Do(req)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		var results struct {
+			Data []struct {
+				Attributes struct {
+					Slug string `json:"slug"`
+				} `json:"attributes"`
+			} `json:"data"`
+			Links struct {
+				Next string `json:"next"`
+			} `json:"links"`
+		}
+		json.NewDecoder(res.Body).Decode(&results)
+		var slugs []string
+		for _, d := range results.Data {
+			slugs = append(slugs, d.Attributes.Slug)
+		}
+		return res.StatusCode, slugs, results.Links.Next
+	}
+
+	status, slugs, next := list("page[limit]=2")
+	assert.Equal(t, 200, status)
+	assert.Equal(t, []string{"alpha", "mini"}, slugs)
+	assert.Equal(t, "/apps/?page%5Bcursor%5D=mini&page%5Blimit%5D=2", next)
+
+	status, slugs, next = list("page[limit]=2&page[cursor]=mini")
+	assert.Equal(t, 200, status)
+	assert.Equal(t, []string{"zeta"}, slugs)
+	assert.Empty(t, next)
+
+	status, slugs, _ = list("state=errored")
+	assert.Equal(t, 200, status)
+	assert.Equal(t, []string{"alpha"}, slugs)
+
+	status, _, _ = list("state=unknown")
+	assert.Equal(t, 422, status)
+	status, _, _ = list("page[limit]=0")
+	assert.Equal(t, 422, status)
+}
+
+func TestIntents(t *testing.T) {
+	pick := apps.Intent{Action: "PICK", Types: []string{"io.cozy.files"}, Href: "/pick"}
+	picker := &apps.Manifest{Name: "Picker", Slug: "picker", State: apps.Ready,
+		Intents: []apps.Intent{pick}}
+	broken := &apps.Manifest{Name: "Broken", Slug: "broken", State: apps.Errored,
+		Intents: []apps.Intent{pick}}
+	for _, man := range []*apps.Manifest{picker, broken} {
+		assert.NoError(t, couchdb.CreateNamedDoc(testInstance, man))
+		defer couchdb.DeleteDoc(testInstance, man)
+	}
+
+	find := func(query string) (int, []map[string]interface{}) {
+		req, _ := http.NewRequest("GET", ts.URL+"/apps/intents?"+query, nil)
+		req.Header.Add("Authorization", "Bearer "+testToken(testInstance))
+		req.Host = domain
+		res, err := client.Do(req)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		var results struct {
+			Data []map[string]interface{} `json:"data"`
+		}
+		json.NewDecoder(res.Body).Decode(&results)
+		return res.StatusCode, results.Data
+	}
+
+	status, data := find("action=pick&type=io.cozy.files")
+	assert.Equal(t, 200, status)
+	if assert.Len(t, data, 1) {
+		assert.Equal(t, "io.cozy.apps.intents", data[0]["type"])
+		assert.Equal(t, "picker", data[0]["id"])
+		attrs := data[0]["attributes"].(map[string]interface{})
+		assert.Equal(t, "PICK", attrs["action"])
+		assert.Equal(t, "io.cozy.files", attrs["type"])
+		href := testInstance.SubDomain("picker")
+		href.Path = "/pick"
+		assert.Equal(t, href.String(), attrs["href"])
+	}
+
+	status, data = find("action=PICK&type=io.cozy.contacts")
+	assert.Equal(t, 200, status)
+	assert.Len(t, data, 0)
+
+	status, _ = find("action=PICK")
+	assert.Equal(t, 422, status)
+}
+
 func TestIconForApp(t *testing.T) {
 	req, _ := http.NewRequest("GET", ts.URL+"/apps/mini/icon", nil)
 	req.Header.Add("Authorization", "Bearer "+testToken(testInstance))
@@ -316,6 +553,17 @@ func TestIconForApp(t *testing.T) {
 	assert.Equal(t, 200, res.StatusCode)
 	body, _ := ioutil.ReadAll(res.Body)
 	assert.Equal(t, "<svg>...</svg>", string(body))
+	assert.Equal(t, "private, no-cache", res.Header.Get("Cache-Control"))
+	etag := res.Header.Get("Etag")
+	assert.NotEmpty(t, etag)
+
+	req, _ = http.NewRequest("GET", ts.URL+"/apps/mini/icon", nil)
+	req.Header.Add("Authorization", "Bearer "+testToken(testInstance))
+	req.Header.Add("If-None-Match", etag)
+	req.Host = domain
+	res, err = client.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 304, res.StatusCode)
 }
 
 func TestMain(m *testing.M) {
@@ -362,7 +610,7 @@ func TestMain(m *testing.M) {
 		c.SetCookie(cookie)
 		return c.HTML(http.StatusOK, "OK")
 	})
-	webApps.Routes(r.Group("/apps"))
+	webApps.Routes(webpermissions.Group(r, "/apps"))
 	router, err := web.CreateSubdomainProxy(r, webApps.Serve)
 	if err != nil {
 		fmt.Println(err)
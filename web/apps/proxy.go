@@ -0,0 +1,136 @@
+package apps
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/apps"
+)
+
+var proxyClient = &http.Client{
+	Timeout:   60 * time.Second,
+	Transport: apps.DevTransport,
+}
+
+// proxiedHeaders are the headers of the responses of the development server
+// that are forwarded to the browser.
+var proxiedHeaders = []string{
+	"Content-Type",
+	"Content-Length",
+	"Content-Encoding",
+	"Etag",
+	"Last-Modified",
+}
+
+// NewProxyServer returns an AppFileServer that fetches the files of the
+// applications from a development server, like the one of webpack, at the
+// given URL.
+func NewProxyServer(base *url.URL) *ProxyServer {
+	return &ProxyServer{base: base}
+}
+
+// ProxyServer provides the AppFileServer interface by proxying the requests
+// to a development server. It is used for the applications installed with a
+// dev:// source, so that the developers can use the hot-reload of their
+// development server with a real stack.
+type ProxyServer struct {
+	base *url.URL
+}
+
+// Stat sends a HEAD request to the development server.
+func (p *ProxyServer) Stat(slug, folder, file string) (os.FileInfo, error) {
+	res, err := p.request("HEAD", folder, file, nil)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	modtime, err := http.ParseTime(res.Header.Get("Last-Modified"))
+	if err != nil {
+		modtime = time.Now()
+	}
+	return &proxyFileInfo{
+		name:    path.Base(file),
+		size:    res.ContentLength,
+		modtime: modtime,
+	}, nil
+}
+
+// Open sends a GET request to the development server and returns the body
+// of its response.
+func (p *ProxyServer) Open(slug, folder, file string) (io.ReadCloser, error) {
+	res, err := p.request("GET", folder, file, nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// ServeFileContent forwards the request to the development server, and
+// copies its response. The files are never cached by the browser, as they
+// change on each build.
+func (p *ProxyServer) ServeFileContent(w http.ResponseWriter, req *http.Request, modtime time.Time, slug, folder, file string) error {
+	header := http.Header{}
+	if accept := req.Header.Get("Accept-Encoding"); accept != "" {
+		header.Set("Accept-Encoding", accept)
+	}
+	res, err := p.request(req.Method, folder, file, header)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	for _, name := range proxiedHeaders {
+		if value := res.Header.Get(name); value != "" {
+			w.Header().Set(name, value)
+		}
+	}
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	w.WriteHeader(res.StatusCode)
+	_, err = io.Copy(w, res.Body)
+	return err
+}
+
+// request sends a request for the given file to the development server. A
+// 404 response is returned as an os.ErrNotExist error.
+func (p *ProxyServer) request(method, folder, file string, header http.Header) (*http.Response, error) {
+	u := *p.base
+	u.Path = path.Join("/", u.Path, folder, file)
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	res, err := proxyClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, os.ErrNotExist
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		res.Body.Close()
+		return nil, fmt.Errorf("Unexpected response status from the development server: %s", res.Status)
+	}
+	return res, nil
+}
+
+// proxyFileInfo is the os.FileInfo of a file on the development server
+type proxyFileInfo struct {
+	name    string
+	size    int64
+	modtime time.Time
+}
+
+func (f *proxyFileInfo) Name() string       { return f.name }
+func (f *proxyFileInfo) Size() int64        { return f.size }
+func (f *proxyFileInfo) Mode() os.FileMode  { return 0444 }
+func (f *proxyFileInfo) ModTime() time.Time { return f.modtime }
+func (f *proxyFileInfo) IsDir() bool        { return false }
+func (f *proxyFileInfo) Sys() interface{}   { return nil }
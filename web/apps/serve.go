@@ -5,10 +5,13 @@ import (
 	"html/template"
 	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
+	"regexp"
+	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -24,7 +27,9 @@ import (
 	"github.com/spf13/afero"
 )
 
-// Serve is an handler for serving files from the VFS for a client-side app
+// Serve is an handler for serving files from the VFS for a client-side app.
+// The applications with a dev:// source are proxied to their development
+// server instead.
 func Serve(c echo.Context) error {
 	method := c.Request().Method
 	if method != "GET" && method != "HEAD" {
@@ -44,9 +49,19 @@ func Serve(c echo.Context) error {
 		}
 		return err
 	}
-	if app.State != apps.Ready {
+	if !app.IsServable() {
 		return echo.NewHTTPError(http.StatusServiceUnavailable, "Application is not ready")
 	}
+	if apps.IsDevSource(app.Source) {
+		if !i.AllowProxyApps() {
+			return echo.NewHTTPError(http.StatusForbidden, "Proxied applications are not allowed")
+		}
+		base, err := apps.DevServerURL(app.Source)
+		if err != nil {
+			return err
+		}
+		return ServeAppFile(c, i, NewProxyServer(base), app)
+	}
 	return ServeAppFile(c, i, NewAferoServer(i.FS(), nil), app)
 }
 
@@ -75,6 +90,11 @@ func ServeAppFile(c echo.Context, i *instance.Instance, fs AppFileServer, app *a
 		return c.Redirect(http.StatusFound, i.PageURL("/auth/login", redirect))
 	}
 	if file == "" {
+		// A route without index, like the one of the assets, only serves the
+		// files of its folder
+		if route.Index == "" {
+			return echo.NewHTTPError(http.StatusNotFound, "Page not found")
+		}
 		file = route.Index
 	}
 	infos, err := fs.Stat(app.Slug, route.Folder, file)
@@ -86,6 +106,9 @@ func ServeAppFile(c echo.Context, i *instance.Instance, fs AppFileServer, app *a
 	}
 	modtime := infos.ModTime()
 	if file != route.Index {
+		if asset, ok := app.Assets[path.Join("/", route.Folder, file)]; ok {
+			return serveAsset(c, fs, modtime, app.Slug, route.Folder, file, asset)
+		}
 		return fs.ServeFileContent(c.Response(), c.Request(), modtime, app.Slug, route.Folder, file)
 	}
 	// For index file, we inject the locale, the stack domain, and a token if the
@@ -107,6 +130,7 @@ func ServeAppFile(c echo.Context, i *instance.Instance, fs AppFileServer, app *a
 	token := "" // #nosec
 	if middlewares.IsLoggedIn(c) {
 		token = i.BuildAppToken(app)
+		apps.RecordOpen(i, app.Slug)
 	}
 	res := c.Response()
 	res.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -122,6 +146,61 @@ func ServeAppFile(c echo.Context, i *instance.Instance, fs AppFileServer, app *a
 	})
 }
 
+// fingerprintReg matches the names of the files with a hash added by the
+// bundlers, like app.3f2a9b1c.js: their content never changes.
+var fingerprintReg = regexp.MustCompile(`[.\-_][0-9a-fA-F]{8,}\.[^/]+$`)
+
+// assetMaxAge is the max-age, in seconds, of the fingerprinted assets
+const assetMaxAge = "31536000"
+
+// serveAsset serves a file of an application with the informations recorded
+// when the application was fetched: its Etag, a long-lived cache if its name
+// is fingerprinted, and its gzip version if the client accepts it.
+func serveAsset(c echo.Context, fs AppFileServer, modtime time.Time, slug, folder, file string, asset *apps.Asset) error {
+	req := c.Request()
+	res := c.Response()
+	header := res.Header()
+	if fingerprintReg.MatchString(file) {
+		header.Set("Cache-Control", "private, max-age="+assetMaxAge+", immutable")
+	} else {
+		header.Set("Cache-Control", "private, no-cache")
+	}
+	if asset.Gzip {
+		header.Add("Vary", "Accept-Encoding")
+		if _, err := fs.Stat(slug, folder, file+".gz"); err == nil && acceptsGzip(req) {
+			// The Etag of the compressed version must be different, as the
+			// content is not the same
+			header.Set("Etag", `"`+asset.Hash+`-gzip"`)
+			header.Set("Content-Encoding", "gzip")
+			if typ := mime.TypeByExtension(path.Ext(file)); typ != "" {
+				header.Set("Content-Type", typ)
+			}
+			return fs.ServeFileContent(res, req, modtime, slug, folder, file+".gz")
+		}
+	}
+	header.Set("Etag", `"`+asset.Hash+`"`)
+	return fs.ServeFileContent(res, req, modtime, slug, folder, file)
+}
+
+// acceptsGzip returns true if the Accept-Encoding header of the request
+// allows a gzip-compressed response.
+func acceptsGzip(req *http.Request) bool {
+	for _, part := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(part, ";")
+		if strings.TrimSpace(parts[0]) != "gzip" {
+			continue
+		}
+		for _, param := range parts[1:] {
+			param = strings.Replace(param, " ", "", -1)
+			if param == "q=0" || param == "q=0.0" || param == "q=0.00" || param == "q=0.000" {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
 // AppFileServer interface defines a way to access and serve the application's
 // data files.
 type AppFileServer interface {
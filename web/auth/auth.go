@@ -86,6 +86,10 @@ func SetCookieForNewSession(c echo.Context) (string, error) {
 		return "", err
 	}
 	c.SetCookie(cookie)
+	if err = instance.InstallDefaultApps(); err != nil {
+		log.Errorf("[auth] Could not install the default apps of %s: %s",
+			instance.Domain, err)
+	}
 	return session.ID(), nil
 }
 
@@ -357,7 +361,16 @@ func authorizeForm(c echo.Context) error {
 		return c.Redirect(http.StatusSeeOther, u)
 	}
 
-	permissions := strings.Split(params.scope, " ")
+	// the permissions are described with sentences in the locale of the
+	// instance, or shown as they are if the scope can't be parsed
+	var perms []string
+	if set, err := permissions.UnmarshalScopeString(params.scope); err == nil {
+		for _, sentence := range permissions.Describe(set, instance.Translate) {
+			perms = append(perms, sentence.Sentence)
+		}
+	} else {
+		perms = strings.Split(params.scope, " ")
+	}
 	params.client.ClientID = params.client.CouchID
 	return c.Render(http.StatusOK, "authorize.html", echo.Map{
 		"Locale":      instance.Locale,
@@ -365,7 +378,7 @@ func authorizeForm(c echo.Context) error {
 		"State":       params.state,
 		"RedirectURI": params.redirectURI,
 		"Scope":       params.scope,
-		"Permissions": permissions,
+		"Permissions": perms,
 		"CSRF":        c.Get("csrf"),
 	})
 }
@@ -490,6 +503,16 @@ func accessToken(c echo.Context) error {
 			})
 		}
 		out.Scope = claims.Scope
+		// A refresh token signed before a rotation of the secrets would be
+		// refused after the grace period: a new one is sent to the client
+		if rotated := instance.SecretsRotatedAt; rotated != nil && claims.IssuedAt <= rotated.Unix() {
+			out.Refresh, err = client.CreateJWT(instance, permissions.RefreshTokenAudience, out.Scope)
+			if err != nil {
+				return c.JSON(http.StatusInternalServerError, echo.Map{
+					"error": "Can't generate refresh token",
+				})
+			}
+		}
 
 	default:
 		return c.JSON(http.StatusBadRequest, echo.Map{
@@ -1022,6 +1022,8 @@ func TestLogoutNoToken(t *testing.T) {
 func TestLogoutSuccess(t *testing.T) {
 	a := app.Manifest{Slug: "home"}
 	token := testInstance.BuildAppToken(&a)
+	couchdb.CreateNamedDocWithDB(testInstance, &a)
+	defer couchdb.DeleteDoc(testInstance, &a)
 	permissions.CreateAppSet(testInstance, a.Slug, permissions.Set{})
 	req, _ := http.NewRequest("DELETE", ts.URL+"/auth/login", nil)
 	req.Host = domain
@@ -38,7 +38,7 @@ func allDoctypes(c echo.Context) error {
 	}
 	var doctypes []string
 	for _, typ := range types {
-		if CheckReadable(typ) == nil {
+		if CheckReadable(c, typ) == nil {
 			doctypes = append(doctypes, typ)
 		}
 	}
@@ -51,7 +51,7 @@ func getDoc(c echo.Context) error {
 	doctype := c.Get("doctype").(string)
 	docid := c.Param("docid")
 
-	if err := CheckReadable(doctype); err != nil {
+	if err := CheckReadable(c, doctype); err != nil {
 		return err
 	}
 
@@ -89,7 +89,7 @@ func createDoc(c echo.Context) error {
 		return jsonapi.NewError(http.StatusBadRequest, err)
 	}
 
-	if err := CheckWritable(doctype); err != nil {
+	if err := CheckWritable(c, doctype); err != nil {
 		return err
 	}
 
@@ -142,7 +142,7 @@ func updateDoc(c echo.Context) error {
 
 	doc.Type = c.Param("doctype")
 
-	if err := CheckWritable(doc.Type); err != nil {
+	if err := CheckWritable(c, doc.Type); err != nil {
 		return err
 	}
 
@@ -208,7 +208,7 @@ func deleteDoc(c echo.Context) error {
 		return jsonapi.NewError(http.StatusBadRequest, "delete without revision")
 	}
 
-	if err := CheckWritable(doctype); err != nil {
+	if err := CheckWritable(c, doctype); err != nil {
 		return err
 	}
 
@@ -244,7 +244,7 @@ func defineIndex(c echo.Context) error {
 		return jsonapi.NewError(http.StatusBadRequest, err)
 	}
 
-	if err := CheckReadable(doctype); err != nil {
+	if err := CheckReadable(c, doctype); err != nil {
 		return err
 	}
 
@@ -274,7 +274,7 @@ func findDocuments(c echo.Context) error {
 		return jsonapi.NewError(http.StatusBadRequest, err)
 	}
 
-	if err := CheckReadable(doctype); err != nil {
+	if err := CheckReadable(c, doctype); err != nil {
 		return err
 	}
 
@@ -351,7 +351,7 @@ func changesFeed(c echo.Context) error {
 func allDocs(c echo.Context) error {
 	doctype := c.Get("doctype").(string)
 
-	if err := CheckReadable(doctype); err != nil {
+	if err := CheckReadable(c, doctype); err != nil {
 		return err
 	}
 
@@ -1,10 +1,6 @@
 package data
 
 import (
-	"fmt"
-	"net/http"
-
-	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	permpkg "github.com/cozy/cozy-stack/pkg/permissions"
 	"github.com/cozy/cozy-stack/web/middlewares"
@@ -12,18 +8,6 @@ import (
 	"github.com/labstack/echo"
 )
 
-var readable = true
-var none = false
-
-var blackList = map[string]bool{
-	consts.Sessions:         none,
-	consts.Permissions:      none,
-	consts.OAuthClients:     none,
-	consts.OAuthAccessCodes: none,
-	consts.Files:            readable,
-	consts.Instances:        readable,
-}
-
 func fetchOldAndCheckPerm(c echo.Context, verb permpkg.Verb, doctype, id string) error {
 	instance := middlewares.GetInstance(c)
 
@@ -38,30 +22,25 @@ func fetchOldAndCheckPerm(c echo.Context, verb permpkg.Verb, doctype, id string)
 	return permissions.Allow(c, verb, &old)
 }
 
-// CheckReadable will abort the context and returns false if the doctype
-// is unreadable
-func CheckReadable(doctype string) error {
-	readable, inblacklist := blackList[doctype]
-	if !inblacklist || readable {
-		return nil
-	}
-
-	return &echo.HTTPError{
-		Code:    http.StatusForbidden,
-		Message: fmt.Sprintf("reserved doctype %s unreadable", doctype),
-	}
+// CheckReadable returns an error if the doctype can't be read with the data
+// API by the token of the request
+func CheckReadable(c echo.Context, doctype string) error {
+	return permpkg.CheckReadable(permissionType(c), doctype)
 }
 
-// CheckWritable will abort the echo context if the doctype
-// is unwritable
-func CheckWritable(doctype string) error {
-	_, inblacklist := blackList[doctype]
-	if !inblacklist {
-		return nil
-	}
+// CheckWritable returns an error if the doctype can't be written with the
+// data API by the token of the request
+func CheckWritable(c echo.Context, doctype string) error {
+	return permpkg.CheckWritable(permissionType(c), doctype)
+}
 
-	return &echo.HTTPError{
-		Code:    http.StatusForbidden,
-		Message: fmt.Sprintf("reserved doctype %s unwritable", doctype),
+// permissionType returns the type of the permission of the request (app,
+// share, oauth or cli), or an empty string if it has no valid token: the
+// request will be refused by the check of the permissions.
+func permissionType(c echo.Context) string {
+	pdoc, err := permissions.GetPermission(c)
+	if err != nil {
+		return ""
 	}
+	return pdoc.Type
 }
@@ -43,7 +43,7 @@ func getLocalDoc(c echo.Context) error {
 		return err
 	}
 
-	if err := CheckReadable(doctype); err != nil {
+	if err := CheckReadable(c, doctype); err != nil {
 		return err
 	}
 
@@ -59,7 +59,7 @@ func setLocalDoc(c echo.Context) error {
 		return err
 	}
 
-	if err := CheckReadable(doctype); err != nil {
+	if err := CheckReadable(c, doctype); err != nil {
 		return err
 	}
 
@@ -73,7 +73,7 @@ func bulkGet(c echo.Context) error {
 		return err
 	}
 
-	if err := CheckReadable(doctype); err != nil {
+	if err := CheckReadable(c, doctype); err != nil {
 		return err
 	}
 
@@ -87,7 +87,7 @@ func fullCommit(c echo.Context) error {
 		return err
 	}
 
-	if err := CheckReadable(doctype); err != nil {
+	if err := CheckReadable(c, doctype); err != nil {
 		return err
 	}
 
@@ -102,7 +102,7 @@ func dbStatus(c echo.Context) error {
 		return err
 	}
 
-	if err := CheckReadable(doctype); err != nil {
+	if err := CheckReadable(c, doctype); err != nil {
 		return err
 	}
 
@@ -8,6 +8,7 @@ import (
 	log "github.com/Sirupsen/logrus"
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/web/jsonapi"
 	"github.com/labstack/echo"
 )
@@ -23,6 +24,21 @@ func ErrorHandler(err error, c echo.Context) {
 	res := c.Response()
 	req := c.Request()
 
+	if el, ok := err.(jsonapi.ErrorList); ok && len(el) > 0 {
+		// #nosec
+		if !res.Committed {
+			if c.Request().Method == http.MethodHead {
+				c.NoContent(el[0].Status)
+			} else {
+				jsonapi.DataErrorList(c, el...)
+			}
+		}
+		if isVerbose(c) {
+			log.Errorf("[http] %s %s %s", req.Method, req.URL.Path, err)
+		}
+		return
+	}
+
 	if he, ok = err.(*echo.HTTPError); ok {
 		// #nosec
 		if !res.Committed {
@@ -32,7 +48,7 @@ func ErrorHandler(err error, c echo.Context) {
 				c.String(he.Code, fmt.Sprintf("%v", he.Message))
 			}
 		}
-		if config.IsDevRelease() {
+		if isVerbose(c) {
 			log.Errorf("[http] %s %s %s", req.Method, req.URL.Path, err)
 		}
 		return
@@ -65,7 +81,17 @@ func ErrorHandler(err error, c echo.Context) {
 		}
 	}
 
-	if config.IsDevRelease() {
+	if isVerbose(c) {
 		log.Errorf("[http] %s %s %s", req.Method, req.URL.Path, err)
 	}
 }
+
+// isVerbose returns true if the errors should be logged: on a development
+// release of the stack, or for an instance with the verbose errors toggle.
+func isVerbose(c echo.Context) bool {
+	if config.IsDevRelease() {
+		return true
+	}
+	i, ok := c.Get("instance").(*instance.Instance)
+	return ok && i.Dev.VerboseErrors
+}
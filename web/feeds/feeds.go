@@ -0,0 +1,126 @@
+// Package feeds exposes the read-only feeds of calendars and contacts, that
+// external clients can subscribe to, and the routes to manage them.
+package feeds
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/feeds"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/labstack/echo"
+)
+
+type feedResponse struct {
+	Doctype string `json:"doctype"`
+	URL     string `json:"url"`
+	Webcal  string `json:"webcal,omitempty"`
+}
+
+func makeResponse(i *instance.Instance, doctype, feedPath string) *feedResponse {
+	u, err := url.Parse(i.PageURL(feedPath, nil))
+	if err != nil {
+		return nil
+	}
+	res := &feedResponse{Doctype: doctype, URL: u.String()}
+	if u.Scheme == "https" && strings.HasSuffix(u.Path, ".ics") {
+		u.Scheme = "webcal"
+		res.Webcal = u.String()
+	}
+	return res
+}
+
+// getFeed returns the URL of the feed for the given doctype, and creates it
+// if it does not exist yet.
+func getFeed(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	doctype := c.Param("doctype")
+	if _, err := feeds.FormatFor(doctype); err != nil {
+		return wrapFeedsError(err)
+	}
+	if err := permissions.AllowWholeType(c, permissions.GET, doctype); err != nil {
+		return err
+	}
+	parent, err := permissions.GetPermission(c)
+	if err != nil {
+		return err
+	}
+	pdoc, err := feeds.Find(instance, parent, doctype)
+	if err != nil {
+		return err
+	}
+	status := http.StatusOK
+	if pdoc == nil {
+		if pdoc, err = feeds.Create(instance, parent, doctype); err != nil {
+			return wrapFeedsError(err)
+		}
+		status = http.StatusCreated
+	}
+	return c.JSON(status, makeResponse(instance, doctype, feeds.Path(pdoc)))
+}
+
+// regenerateFeed revokes the current feed of a doctype and gives a new URL
+// for it.
+func regenerateFeed(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	doctype := c.Param("doctype")
+	if _, err := feeds.FormatFor(doctype); err != nil {
+		return wrapFeedsError(err)
+	}
+	if err := permissions.AllowWholeType(c, permissions.GET, doctype); err != nil {
+		return err
+	}
+	parent, err := permissions.GetPermission(c)
+	if err != nil {
+		return err
+	}
+	pdoc, err := feeds.Regenerate(instance, parent, doctype)
+	if err != nil {
+		return wrapFeedsError(err)
+	}
+	return c.JSON(http.StatusCreated, makeResponse(instance, doctype, feeds.Path(pdoc)))
+}
+
+// serveFeed is the public route used by the external clients to fetch the
+// content of a feed. The code in the URL is the only credential.
+func serveFeed(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	code := c.Param("code")
+	filename := c.Param("filename")
+	for doctype, format := range feeds.Formats {
+		if format.Filename != filename {
+			continue
+		}
+		docs, err := feeds.Open(instance, code, doctype)
+		if err != nil {
+			return wrapFeedsError(err)
+		}
+		res := c.Response()
+		res.Header().Set("Content-Type", format.ContentType)
+		res.Header().Set("Cache-Control", "private, no-cache")
+		res.WriteHeader(http.StatusOK)
+		return format.Write(res, instance.Domain, docs)
+	}
+	return jsonapi.NotFound(feeds.ErrUnsupportedDoctype)
+}
+
+func wrapFeedsError(err error) error {
+	switch err {
+	case feeds.ErrUnsupportedDoctype:
+		return jsonapi.InvalidParameter("doctype", err)
+	case feeds.ErrInvalidCode:
+		return jsonapi.NotFound(err)
+	}
+	return err
+}
+
+// Routes sets the routing for the feeds service
+func Routes(router *echo.Group) {
+	router.POST("/:doctype", getFeed)
+	router.DELETE("/:doctype", regenerateFeed)
+	router.GET("/:code/:filename", serveFeed)
+}
@@ -24,8 +24,13 @@ import (
 	"github.com/labstack/echo"
 )
 
-// TagSeparator is the character separating tags
-const TagSeparator = ","
+const (
+	// TagSeparator is the character separating tags
+	TagSeparator = ","
+	// ChecksumHeader is the header with the checksum of the content of an
+	// uploaded file, like sha256=<base64 sum>
+	ChecksumHeader = "X-Cozy-Checksum"
+)
 
 // ErrDocTypeInvalid is used when the document type sent is not
 // recognized
@@ -59,6 +64,10 @@ func CreationHandler(c echo.Context) error {
 		return wrapVfsError(err)
 	}
 
+	if file, ok := doc.(*vfs.FileDoc); ok {
+		pushThumbnailsJob(instance, file)
+	}
+
 	hideFields(doc)
 	return jsonapi.Data(c, http.StatusCreated, doc, nil)
 }
@@ -78,6 +87,11 @@ func createFileHandler(c echo.Context, vfsC vfs.Context) (doc *vfs.FileDoc, err
 		return
 	}
 
+	sum, err := checksumFromReq(c)
+	if err != nil {
+		return
+	}
+
 	file, err := vfs.CreateFile(vfsC, doc, nil)
 	if err != nil {
 		return
@@ -89,6 +103,12 @@ func createFileHandler(c echo.Context, vfsC vfs.Context) (doc *vfs.FileDoc, err
 		}
 	}()
 
+	if sum != nil {
+		if err = file.ExpectChecksum(sum); err != nil {
+			return
+		}
+	}
+
 	_, err = io.Copy(file, c.Request().Body)
 	return
 }
@@ -167,6 +187,11 @@ func OverwriteFileContentHandler(c echo.Context) (err error) {
 		return
 	}
 
+	sum, err := checksumFromReq(c)
+	if err != nil {
+		return
+	}
+
 	file, err := vfs.CreateFile(instance, newdoc, olddoc)
 	if err != nil {
 		return wrapVfsError(err)
@@ -180,9 +205,16 @@ func OverwriteFileContentHandler(c echo.Context) (err error) {
 			err = wrapVfsError(err)
 			return
 		}
+		pushThumbnailsJob(instance, newdoc)
 		err = jsonapi.Data(c, http.StatusOK, hideFields(newdoc), nil)
 	}()
 
+	if sum != nil {
+		if err = file.ExpectChecksum(sum); err != nil {
+			return
+		}
+	}
+
 	_, err = io.Copy(file, c.Request().Body)
 	return
 }
@@ -260,6 +292,24 @@ func applyPatch(c echo.Context, instance *instance.Instance, patch *vfs.DocPatch
 		return err
 	}
 
+	// a move must also be allowed in the destination directory, or a
+	// document could be taken out of the scope of a rule on a path
+	var parentID string
+	if dir != nil {
+		parentID = dir.DirID
+	} else {
+		parentID = file.DirID
+	}
+	if patch.DirID != nil && *patch.DirID != parentID {
+		parent, err := vfs.GetDirDoc(instance, *patch.DirID, false)
+		if err != nil {
+			return wrapVfsError(err)
+		}
+		if err = checkPerm(c, permissions.PATCH, parent, nil); err != nil {
+			return err
+		}
+	}
+
 	var data jsonapi.Object
 	var err error
 	if file != nil {
@@ -480,6 +530,77 @@ func FileDownloadCreateHandler(c echo.Context) error {
 	return jsonapi.Data(c, http.StatusOK, doc, links)
 }
 
+// DownloadTokenHandler creates a short-lived signed link to download a single
+// file. Unlike the token of the application, the token in this link can only
+// be used to download this file, so it can be put in the URLs, like in the
+// src of an <img>.
+func DownloadTokenHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	doc, err := vfs.GetFileDoc(instance, c.Param("file-id"))
+	if err != nil {
+		return wrapVfsError(err)
+	}
+
+	if err = permissions.Allow(c, permissions.GET, doc); err != nil {
+		return err
+	}
+
+	token, err := instance.MakeJWT(pkgperm.DownloadAudience, doc.ID(), "", time.Now())
+	if err != nil {
+		return err
+	}
+
+	// The name is escaped like with url.PathEscape, which is not available
+	// in Go 1.7
+	name := (&url.URL{Path: doc.Name}).EscapedPath()
+	links := &jsonapi.LinksList{
+		Related: "/files/signed/" + token + "/" + name,
+	}
+
+	return jsonapi.Data(c, http.StatusOK, doc, links)
+}
+
+// SignedDownloadHandler sends a file with a signed link created by
+// DownloadTokenHandler.
+func SignedDownloadHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	fileID, err := checkDownloadToken(instance, c.Param("token"))
+	if err != nil {
+		return err
+	}
+
+	doc, err := vfs.GetFileDoc(instance, fileID)
+	if err != nil {
+		return wrapVfsError(err)
+	}
+
+	disposition := "inline"
+	if c.QueryParam("Dl") == "1" {
+		disposition = "attachment"
+	}
+	err = vfs.ServeFileContent(instance, doc, disposition, c.Request(), c.Response())
+	if err != nil {
+		return wrapVfsError(err)
+	}
+
+	return nil
+}
+
+// checkDownloadToken returns the id of the file of a valid download token
+func checkDownloadToken(i *instance.Instance, token string) (string, error) {
+	var claims pkgperm.Claims
+	if err := i.ParseJWT(token, &claims); err != nil {
+		return "", pkgperm.ErrInvalidToken
+	}
+	if claims.Audience != pkgperm.DownloadAudience || claims.Issuer != i.Domain {
+		return "", pkgperm.ErrInvalidToken
+	}
+	if claims.Expired() {
+		return "", pkgperm.ErrExpiredToken
+	}
+	return claims.Subject, nil
+}
+
 // ArchiveDownloadHandler handles requests to /files/archive/:secret/whatever.zip
 // and creates on the fly zip archive from the parameters linked to secret.
 func ArchiveDownloadHandler(c echo.Context) error {
@@ -495,6 +616,42 @@ func ArchiveDownloadHandler(c echo.Context) error {
 	return archive.Serve(instance, c.Response())
 }
 
+// DirDownloadHandler handles GET requests on /files/:dir-id/download and
+// streams a zip archive of the tree of the directory. Each directory and file
+// is checked against the permissions of the request, and the ones that can't
+// be read are left out of the archive. The request is forbidden if nothing can
+// be read, so that the name of the directory is not leaked.
+func DirDownloadHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+
+	if format := c.QueryParam("format"); format != "" && format != "zip" {
+		return jsonapi.InvalidParameter("format", errors.New("Only the zip format is supported"))
+	}
+
+	dir, err := vfs.GetDirDoc(instance, c.Param("dir-id"), false)
+	if err != nil {
+		return wrapVfsError(err)
+	}
+
+	pdoc, err := permissions.GetPermission(c)
+	if err != nil {
+		return err
+	}
+
+	allowed := func(d *vfs.DirDoc, f *vfs.FileDoc) bool {
+		var v vfs.Validable = f
+		if d != nil {
+			v = d
+		}
+		return vfs.Allows(instance, pdoc.Permissions, permissions.GET, v) == nil
+	}
+	err = vfs.ServeDirArchive(instance, dir, allowed, c.Response())
+	if err == vfs.ErrForbiddenArchive {
+		return wrapVfsError(err)
+	}
+	return err
+}
+
 // FileDownloadHandler send a file that have previously be defined
 // through FileDownloadCreateHandler
 func FileDownloadHandler(c echo.Context) error {
@@ -645,11 +802,15 @@ func DestroyFileHandler(c echo.Context) error {
 
 // Routes sets the routing for the files service
 func Routes(router *echo.Group) {
+	router.Use(updateIndex)
+
 	router.HEAD("/download", ReadFileContentFromPathHandler)
 	router.GET("/download", ReadFileContentFromPathHandler)
 	router.HEAD("/download/:file-id", ReadFileContentFromIDHandler)
 	router.GET("/download/:file-id", ReadFileContentFromIDHandler)
 
+	router.GET("/search", SearchHandler)
+
 	router.GET("/metadata", ReadMetadataFromPathHandler)
 	router.GET("/:file-id", ReadMetadataFromIDHandler)
 
@@ -666,6 +827,20 @@ func Routes(router *echo.Group) {
 	router.POST("/downloads", FileDownloadCreateHandler)
 	router.GET("/downloads/:secret/:fake-name", FileDownloadHandler)
 
+	router.POST("/:file-id/download_token", DownloadTokenHandler)
+	router.HEAD("/signed/:token/:fake-name", SignedDownloadHandler)
+	router.GET("/signed/:token/:fake-name", SignedDownloadHandler)
+
+	router.GET("/:dir-id/download", DirDownloadHandler)
+
+	router.HEAD("/:file-id/thumbnail", ThumbnailHandler)
+	router.GET("/:file-id/thumbnail", ThumbnailHandler)
+
+	router.GET("/:file-id/versions", ListVersionsHandler)
+	router.HEAD("/:file-id/versions/:version-id/download", ReadVersionContentHandler)
+	router.GET("/:file-id/versions/:version-id/download", ReadVersionContentHandler)
+	router.POST("/:file-id/versions/:version-id/restore", RestoreVersionHandler)
+
 	router.POST("/:file-id/relationships/referenced_by", AddReferencedHandler)
 	router.DELETE("/:file-id/relationships/referenced_by", RemoveReferencedHandler)
 
@@ -680,19 +855,26 @@ func Routes(router *echo.Group) {
 
 // wrapVfsError returns a formatted error from a golang error emitted by the vfs
 func wrapVfsError(err error) error {
+	if _, ok := err.(*vfs.ChecksumError); ok {
+		return jsonapi.PreconditionFailed(ChecksumHeader, err)
+	}
 	switch err {
 	case ErrDocTypeInvalid:
 		return jsonapi.InvalidAttribute("type", err)
 	case vfs.ErrParentDoesNotExist:
 		return jsonapi.NotFound(err)
+	case vfs.ErrForbiddenArchive:
+		return echo.NewHTTPError(http.StatusForbidden)
 	case vfs.ErrForbiddenDocMove:
 		return jsonapi.PreconditionFailed("dir-id", err)
-	case vfs.ErrIllegalFilename:
+	case vfs.ErrIllegalFilename, vfs.ErrReservedFilename:
 		return jsonapi.InvalidParameter("name", err)
 	case vfs.ErrIllegalTime:
 		return jsonapi.InvalidParameter("UpdatedAt", err)
 	case vfs.ErrInvalidHash:
 		return jsonapi.PreconditionFailed("Content-MD5", err)
+	case vfs.ErrInvalidChecksum, vfs.ErrUnsupportedChecksum:
+		return jsonapi.InvalidParameter(ChecksumHeader, err)
 	case vfs.ErrContentLengthMismatch:
 		return jsonapi.PreconditionFailed("Content-Length", err)
 	case vfs.ErrConflict:
@@ -703,6 +885,10 @@ func wrapVfsError(err error) error {
 		return jsonapi.BadRequest(err)
 	case vfs.ErrDirNotEmpty:
 		return jsonapi.BadRequest(err)
+	case vfs.ErrVersionNotFound, vfs.ErrThumbnailNotFound:
+		return jsonapi.NotFound(err)
+	case vfs.ErrInvalidThumbnailSize:
+		return jsonapi.InvalidParameter("Size", err)
 	}
 	return err
 }
@@ -754,6 +940,20 @@ func fileDocFromReq(c echo.Context, name, dirID string, tags []string) (*vfs.Fil
 	)
 }
 
+// checksumFromReq returns the checksum of the content given by the client in
+// the X-Cozy-Checksum header, or nil if there is none.
+func checksumFromReq(c echo.Context) (*vfs.Checksum, error) {
+	value := c.Request().Header.Get(ChecksumHeader)
+	if value == "" {
+		return nil, nil
+	}
+	sum, err := vfs.ParseChecksum(value)
+	if err != nil {
+		return nil, jsonapi.InvalidParameter(ChecksumHeader, err)
+	}
+	return sum, nil
+}
+
 func checkIfMatch(c echo.Context, rev string) error {
 	ifMatch := c.Request().Header.Get("If-Match")
 	revQuery := c.QueryParam("rev")
@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -13,6 +15,7 @@ import (
 	"strings"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/cozy/checkup"
 	"github.com/cozy/cozy-stack/pkg/config"
@@ -370,6 +373,42 @@ func TestUploadBadHash(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestUploadWithChecksum(t *testing.T) {
+	send := func(name, checksum string) *http.Response {
+		buf := strings.NewReader("foo")
+		req, err := http.NewRequest("POST", ts.URL+"/files/?Type=file&Name="+name, buf)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		req.Header.Add(echo.HeaderAuthorization, "Bearer "+testToken(testInstance))
+		req.Header.Add("Content-Type", "text/plain")
+		req.Header.Add("X-Cozy-Checksum", checksum)
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		res.Body.Close()
+		return res
+	}
+	storage := testInstance.FS()
+
+	res := send("badchecksum", "sha256=/N4rLtula/QIYB+3If6bXDONEO5CnqBPrlURto+/j7k=")
+	assert.Equal(t, 412, res.StatusCode)
+	_, err := afero.ReadFile(storage, "/badchecksum")
+	assert.Error(t, err)
+
+	res = send("unknownchecksum", "crc32=jHNlIQ==")
+	assert.Equal(t, 422, res.StatusCode)
+	res = send("invalidchecksum", "sha256=LCa0a2j")
+	assert.Equal(t, 422, res.StatusCode)
+
+	res = send("goodchecksum", "sha256=LCa0a2j/xo/5m0U8HTBBNBNCLXBkg7+g+YpeiGJm564=")
+	assert.Equal(t, 201, res.StatusCode)
+	buf, err := afero.ReadFile(storage, "/goodchecksum")
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", string(buf))
+}
+
 func TestUploadAtRootSuccess(t *testing.T) {
 	body := "foo"
 	res, _ := upload(t, "/files/?Type=file&Name=goodhash", "text/plain", body, "rL0Y20zC+Fzt72VPzMSk2A==")
@@ -922,6 +961,66 @@ func TestDownloadRangeSuccess(t *testing.T) {
 	assert.Equal(t, "bar", string(res4body))
 }
 
+func TestDownloadMultiRangeSuccess(t *testing.T) {
+	body := "foo,bar"
+	res1, _ := upload(t, "/files/?Type=file&Name=downloadmebyranges", "text/plain", body, "UmfjCVWct/albVkURcJJfg==")
+	assert.Equal(t, 201, res1.StatusCode)
+	path := "/files/download?Path=" + url.QueryEscape("/downloadmebyranges")
+
+	res2, res2body := download(t, path, "bytes=-3")
+	assert.Equal(t, 206, res2.StatusCode)
+	assert.Equal(t, "bytes 4-6/7", res2.Header.Get("Content-Range"))
+	assert.Equal(t, "bar", string(res2body))
+
+	res3, _ := download(t, path, "bytes=10-20")
+	assert.Equal(t, 416, res3.StatusCode)
+
+	res4, res4body := download(t, path, "bytes=0-2,4-6")
+	assert.Equal(t, 206, res4.StatusCode)
+	mediatype, params, err := mime.ParseMediaType(res4.Header.Get("Content-Type"))
+	assert.NoError(t, err)
+	assert.Equal(t, "multipart/byteranges", mediatype)
+	reader := multipart.NewReader(bytes.NewReader(res4body), params["boundary"])
+	for _, expected := range []string{"foo", "bar"} {
+		part, err := reader.NextPart()
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.True(t, strings.HasPrefix(part.Header.Get("Content-Type"), "text/plain"))
+		content, err := ioutil.ReadAll(part)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(content))
+	}
+
+	// Resume a download with If-Range
+	res5, _ := download(t, path, "")
+	eTag := res5.Header.Get("Etag")
+	assert.True(t, strings.HasPrefix(eTag, `"`))
+	req, _ := http.NewRequest("GET", ts.URL+path, nil)
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+testToken(testInstance))
+	req.Header.Add("Range", "bytes=4-")
+	req.Header.Add("If-Range", eTag)
+	res6, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer res6.Body.Close()
+	assert.Equal(t, 206, res6.StatusCode)
+	assert.Equal(t, eTag, res6.Header.Get("Etag"))
+
+	req.Header.Set("If-Range", `"outdated"`)
+	res7, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer res7.Body.Close()
+	assert.Equal(t, 200, res7.StatusCode)
+
+	req.Header.Del("Range")
+	req.Header.Del("If-Range")
+	req.Header.Add("If-None-Match", eTag)
+	res8, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer res8.Body.Close()
+	assert.Equal(t, 304, res8.StatusCode)
+}
+
 func TestGetFileMetadataFromPath(t *testing.T) {
 	res1, _ := httpGet(ts.URL + "/files/metadata?Path=/noooooop")
 	assert.Equal(t, 404, res1.StatusCode)
@@ -1160,6 +1259,97 @@ func TestFileCreateAndDownloadByID(t *testing.T) {
 	assert.Equal(t, `inline; filename=todownload2stepsbis`, disposition)
 }
 
+func TestSignedDownload(t *testing.T) {
+	body := "foo,bar"
+	res1, v := upload(t, "/files/?Type=file&Name=signeddownload", "text/plain", body, "UmfjCVWct/albVkURcJJfg==")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	id := v["data"].(map[string]interface{})["id"].(string)
+
+	req, err := http.NewRequest("POST", ts.URL+"/files/"+id+"/download_token", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+testToken(testInstance))
+	res, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 200, res.StatusCode)
+	var data map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&data)
+	res.Body.Close()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	related := data["links"].(map[string]interface{})["related"].(string)
+	assert.True(t, strings.HasPrefix(related, "/files/signed/"))
+	res2, err := http.Get(ts.URL + related)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 200, res2.StatusCode)
+		content, _ := ioutil.ReadAll(res2.Body)
+		res2.Body.Close()
+		assert.Equal(t, body, string(content))
+	}
+
+	// A token for another audience is refused
+	res3, err := http.Get(ts.URL + "/files/signed/" + testToken(testInstance) + "/signeddownload")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 400, res3.StatusCode)
+		res3.Body.Close()
+	}
+
+	// An expired token is refused
+	old := time.Now().Add(-2 * permissions.DownloadTokenValidityDuration)
+	expired, err := testInstance.MakeJWT(permissions.DownloadAudience, id, "", old)
+	if assert.NoError(t, err) {
+		res4, err := http.Get(ts.URL + "/files/signed/" + expired + "/signeddownload")
+		if assert.NoError(t, err) {
+			assert.Equal(t, 400, res4.StatusCode)
+			res4.Body.Close()
+		}
+	}
+
+	// The token can't be used as a bearer token
+	req, _ = http.NewRequest("GET", ts.URL+"/files/download/"+id, nil)
+	token := strings.Split(related, "/")[3]
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	res5, err := http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		assert.NotEqual(t, 200, res5.StatusCode)
+		res5.Body.Close()
+	}
+
+	// The name of the file is escaped in the link
+	res6, v := upload(t, "/files/?Type=file&Name=signed%20%231%3F.txt", "text/plain", body, "UmfjCVWct/albVkURcJJfg==")
+	if !assert.Equal(t, 201, res6.StatusCode) {
+		return
+	}
+	id = v["data"].(map[string]interface{})["id"].(string)
+	req, _ = http.NewRequest("POST", ts.URL+"/files/"+id+"/download_token", nil)
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+testToken(testInstance))
+	res7, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	err = json.NewDecoder(res7.Body).Decode(&data)
+	res7.Body.Close()
+	if !assert.NoError(t, err) {
+		return
+	}
+	related = data["links"].(map[string]interface{})["related"].(string)
+	assert.True(t, strings.HasSuffix(related, "/signed%20%231%3F.txt"))
+	res8, err := http.Get(ts.URL + related)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 200, res8.StatusCode)
+		content, _ := ioutil.ReadAll(res8.Body)
+		res8.Body.Close()
+		assert.Equal(t, body, string(content))
+	}
+}
+
 func TestArchiveNotFound(t *testing.T) {
 	body := bytes.NewBufferString(`{
 		"data": {
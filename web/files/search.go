@@ -0,0 +1,105 @@
+package files
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/search"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/labstack/echo"
+)
+
+// SearchHandler is the echo.handler for the full-text search of the files
+// and directories, by their names, tags and text. The results are the ones
+// that can be read with the permissions of the request, the most relevant
+// first. The index is updated in the background: the files modified by the
+// other routes (sharings, applications, etc.) are indexed after the search.
+// GET /files/search
+func SearchHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+
+	query := c.QueryParam("Q")
+	if strings.TrimSpace(query) == "" {
+		return jsonapi.InvalidParameter("Q", errors.New("Missing query"))
+	}
+
+	limit := search.DefaultLimit
+	if param := c.QueryParam("page[limit]"); param != "" {
+		l, err := strconv.Atoi(param)
+		if err != nil || l <= 0 || l > search.MaxLimit {
+			return jsonapi.InvalidParameter("page[limit]", errors.New("Invalid limit value"))
+		}
+		limit = l
+	}
+
+	pdoc, err := permissions.GetPermission(c)
+	if err != nil {
+		return err
+	}
+
+	pushIndexJob(instance)
+	hits, err := search.Search(instance, query)
+	if err != nil {
+		return err
+	}
+
+	objs := make([]jsonapi.Object, 0, limit)
+	for _, hit := range hits {
+		if len(objs) >= limit {
+			break
+		}
+		// the index can be late on the documents, so they are read again
+		dir, file, err := vfs.GetDirOrFileDoc(instance, hit.ID, false)
+		if err != nil {
+			continue
+		}
+		var v vfs.Validable
+		var obj jsonapi.Object
+		if dir != nil {
+			v, obj = dir, dir
+		} else {
+			v, obj = file, hideFields(file)
+		}
+		name, err := v.Path(instance)
+		if err != nil || strings.HasPrefix(name, vfs.TrashDirName+"/") {
+			continue
+		}
+		if vfs.Allows(instance, pdoc.Permissions, permissions.GET, v) != nil {
+			continue
+		}
+		objs = append(objs, obj)
+	}
+
+	return jsonapi.DataList(c, http.StatusOK, objs, nil)
+}
+
+// updateIndex is a middleware that pushes a job to update the full-text index
+// of the instance after a request that may have modified its files.
+func updateIndex(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		err := next(c)
+		switch c.Request().Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			return err
+		}
+		if err == nil && c.Response().Status < http.StatusMultipleChoices {
+			pushIndexJob(middlewares.GetInstance(c))
+		}
+		return err
+	}
+}
+
+// pushIndexJob pushes a job to update the full-text index of the instance.
+// An error is only logged, as the index is updated again later.
+func pushIndexJob(i *instance.Instance) {
+	if err := i.PushIndexJob(); err != nil {
+		log.Errorf("[search] Could not push the job for %s: %s", i.Domain, err)
+	}
+}
@@ -0,0 +1,45 @@
+package files
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/labstack/echo"
+)
+
+// ThumbnailHandler is the echo.handler for getting a thumbnail of an image,
+// in the size given by the Size parameter (small by default)
+// GET /files/:file-id/thumbnail
+func ThumbnailHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+
+	doc, err := vfs.GetFileDoc(instance, c.Param("file-id"))
+	if err != nil {
+		return wrapVfsError(err)
+	}
+
+	if err = checkPerm(c, permissions.GET, nil, doc); err != nil {
+		return err
+	}
+
+	size := c.QueryParam("Size")
+	if size == "" {
+		size = string(vfs.ThumbnailSmall)
+	}
+	err = vfs.ServeThumbnailContent(instance, doc, size, c.Request(), c.Response())
+	if err != nil {
+		return wrapVfsError(err)
+	}
+
+	return nil
+}
+
+// pushThumbnailsJob pushes a job to generate the thumbnails of an uploaded
+// image. An error is only logged, as the upload has succeeded.
+func pushThumbnailsJob(i *instance.Instance, doc *vfs.FileDoc) {
+	if err := i.PushThumbnailsJob(doc); err != nil {
+		log.Errorf("[thumbnails] Could not push the job for %s: %s", doc.ID(), err)
+	}
+}
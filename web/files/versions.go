@@ -0,0 +1,104 @@
+package files
+
+import (
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/labstack/echo"
+)
+
+// ListVersionsHandler is the echo.handler for listing the previous versions
+// of a file
+// GET /files/:file-id/versions
+func ListVersionsHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+
+	file, err := vfs.GetFileDoc(instance, c.Param("file-id"))
+	if err != nil {
+		return wrapVfsError(err)
+	}
+
+	if err = checkPerm(c, permissions.GET, nil, file); err != nil {
+		return err
+	}
+
+	versions, err := vfs.GetVersions(instance, file.ID())
+	if err != nil {
+		return wrapVfsError(err)
+	}
+
+	objs := make([]jsonapi.Object, len(versions))
+	for i, v := range versions {
+		objs[i] = v
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, nil)
+}
+
+// ReadVersionContentHandler is the echo.handler for downloading a previous
+// version of a file. It serves the content in inline mode, unless Dl=1 is
+// given.
+// GET /files/:file-id/versions/:version-id/download
+func ReadVersionContentHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+
+	file, err := vfs.GetFileDoc(instance, c.Param("file-id"))
+	if err != nil {
+		return wrapVfsError(err)
+	}
+
+	if err = checkPerm(c, permissions.GET, nil, file); err != nil {
+		return err
+	}
+
+	version, err := vfs.GetVersion(instance, file.ID(), c.Param("version-id"))
+	if err != nil {
+		return wrapVfsError(err)
+	}
+
+	disposition := "inline"
+	if c.QueryParam("Dl") == "1" {
+		disposition = "attachment"
+	}
+	err = vfs.ServeVersionContent(instance, file, version, disposition, c.Request(), c.Response())
+	if err != nil {
+		return wrapVfsError(err)
+	}
+
+	return nil
+}
+
+// RestoreVersionHandler is the echo.handler for putting back a previous
+// version of a file as its current content
+// POST /files/:file-id/versions/:version-id/restore
+func RestoreVersionHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+
+	file, err := vfs.GetFileDoc(instance, c.Param("file-id"))
+	if err != nil {
+		return wrapVfsError(err)
+	}
+
+	if err = checkPerm(c, permissions.PUT, nil, file); err != nil {
+		return err
+	}
+
+	if err = checkIfMatch(c, file.Rev()); err != nil {
+		return err
+	}
+
+	version, err := vfs.GetVersion(instance, file.ID(), c.Param("version-id"))
+	if err != nil {
+		return wrapVfsError(err)
+	}
+
+	newdoc, err := vfs.RestoreVersion(instance, file, version)
+	if err != nil {
+		return wrapVfsError(err)
+	}
+	pushThumbnailsJob(instance, newdoc)
+
+	return jsonapi.Data(c, http.StatusOK, hideFields(newdoc), nil)
+}
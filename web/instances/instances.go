@@ -1,25 +1,35 @@
 package instances
 
 import (
+	"errors"
 	"net/http"
+	"strconv"
 	"time"
 
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/oauth"
 	"github.com/cozy/cozy-stack/pkg/permissions"
 	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/cozy/cozy-stack/web/jsonapi"
 	"github.com/labstack/echo"
 )
 
 func createHandler(c echo.Context) error {
+	dev, err := devOptionsParam(c)
+	if err != nil {
+		return err
+	}
 	in, err := instance.Create(&instance.Options{
 		Domain:   c.QueryParam("Domain"),
 		Locale:   c.QueryParam("Locale"),
 		Timezone: c.QueryParam("Timezone"),
 		Email:    c.QueryParam("Email"),
 		Apps:     utils.SplitTrimString(c.QueryParam("Apps"), ","),
-		Dev:      (c.QueryParam("Dev") == "true"),
+		Context:  c.QueryParam("Context"),
+		Dev:      dev,
 	})
 	if err != nil {
 		return wrapError(err)
@@ -27,6 +37,8 @@ func createHandler(c echo.Context) error {
 	in.OAuthSecret = nil
 	in.SessionSecret = nil
 	in.PassphraseHash = nil
+	in.PreviousOAuthSecret = nil
+	in.PreviousSessionSecret = nil
 	pass := c.QueryParam("Passphrase")
 	if pass != "" {
 		if err = in.RegisterPassphrase([]byte(pass), in.RegisterToken); err != nil {
@@ -42,18 +54,267 @@ func listHandler(c echo.Context) error {
 		return wrapError(err)
 	}
 
+	return instancesList(c, is)
+}
+
+// searchHandler lists the instances matching the criteria given in the
+// query-string. See instance.Search.
+func searchHandler(c echo.Context) error {
+	opts := &instance.SearchOptions{
+		EmailDomain: c.QueryParam("EmailDomain"),
+		Locale:      c.QueryParam("Locale"),
+		Context:     c.QueryParam("Context"),
+		App:         c.QueryParam("App"),
+	}
+	var err error
+	if limit := c.QueryParam("Limit"); limit != "" {
+		if opts.Limit, err = strconv.Atoi(limit); err != nil {
+			return jsonapi.InvalidParameter("Limit", err)
+		}
+	}
+	if skip := c.QueryParam("Skip"); skip != "" {
+		if opts.Skip, err = strconv.Atoi(skip); err != nil {
+			return jsonapi.InvalidParameter("Skip", err)
+		}
+	}
+	is, err := instance.Search(opts)
+	if err != nil {
+		return wrapError(err)
+	}
+	return instancesList(c, is)
+}
+
+// rotateSecretsHandler generates new secrets for an instance. The tokens and
+// the cookies signed with the previous ones are accepted during a grace
+// period.
+func rotateSecretsHandler(c echo.Context) error {
+	i, err := instance.Get(c.Param("domain"))
+	if err != nil {
+		return wrapError(err)
+	}
+	if err = i.RotateSecrets(); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// migrateDBPrefixHandler moves the databases of an instance to their
+// CouchDB-safe names, for the instances created before them.
+func migrateDBPrefixHandler(c echo.Context) error {
+	i, err := instance.Get(c.Param("domain"))
+	if err != nil {
+		return wrapError(err)
+	}
+	if err = i.MigrateDBPrefix(); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// securityHandler sets the _security object of the configuration on the
+// databases of an instance, for the databases created before it.
+func securityHandler(c echo.Context) error {
+	i, err := instance.Get(c.Param("domain"))
+	if err != nil {
+		return wrapError(err)
+	}
+	if err = couchdb.UpdateSecurity(i); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// revokeTokenHandler adds a token to the revocation list of an instance
+func revokeTokenHandler(c echo.Context) error {
+	i, err := instance.Get(c.Param("domain"))
+	if err != nil {
+		return wrapError(err)
+	}
+	if err = i.RevokeToken(c.FormValue("token")); err != nil {
+		return wrapError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// reindexHandler updates the attributes used by the search of an instance,
+// for the instances created before they were kept in its document.
+func reindexHandler(c echo.Context) error {
+	i, err := instance.Get(c.Param("domain"))
+	if err != nil {
+		return wrapError(err)
+	}
+	if err = i.UpdateSearchAttributes(); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func instancesList(c echo.Context, is []*instance.Instance) error {
 	objs := make([]jsonapi.Object, len(is))
 	for i, in := range is {
 		in.OAuthSecret = nil
 		in.SessionSecret = nil
 		in.RegisterToken = nil
 		in.PassphraseHash = nil
+		in.PreviousOAuthSecret = nil
+		in.PreviousSessionSecret = nil
 		objs[i] = in
 	}
 
 	return jsonapi.DataList(c, http.StatusOK, objs, nil)
 }
 
+// slugCollisionsHandler lists the applications whose slug is reserved, or
+// collides with the domain of another instance.
+func slugCollisionsHandler(c echo.Context) error {
+	collisions, err := instance.AuditSlugs()
+	if err != nil {
+		return wrapError(err)
+	}
+	if collisions == nil {
+		collisions = []*instance.SlugCollision{}
+	}
+	return c.JSON(http.StatusOK, collisions)
+}
+
+// gcStatsHandler returns the statistics of the last run of the garbage
+// collector of the VFS of an instance.
+func gcStatsHandler(c echo.Context) error {
+	i, err := instance.Get(c.Param("domain"))
+	if err != nil {
+		return wrapError(err)
+	}
+	stats, err := vfs.GetGCStats(i)
+	if couchdb.IsNotFoundError(err) {
+		return jsonapi.NotFound(errors.New("The garbage collector has not run yet"))
+	}
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, stats)
+}
+
+// gcHandler runs the garbage collector of the VFS of an instance, and
+// returns its statistics.
+func gcHandler(c echo.Context) error {
+	policy := vfs.GCReport
+	if p := c.QueryParam("Policy"); p != "" {
+		if !vfs.IsValidGCPolicy(p) {
+			return jsonapi.InvalidParameter("Policy", errors.New("Unknown policy"))
+		}
+		policy = vfs.GCPolicy(p)
+	}
+	i, err := instance.Get(c.Param("domain"))
+	if err != nil {
+		return wrapError(err)
+	}
+	stats, err := vfs.CollectGarbage(i, policy)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, stats)
+}
+
+// missingIndexesHandler lists the mango queries made on the databases of an
+// instance that have needed a full scan, when couchdb.explain_queries is
+// enabled.
+func missingIndexesHandler(c echo.Context) error {
+	i, err := instance.Get(c.Param("domain"))
+	if err != nil {
+		return wrapError(err)
+	}
+	return c.JSON(http.StatusOK, couchdb.MissingIndexes(i))
+}
+
+// compactHandler starts the compaction of the databases of an instance, and
+// returns their doctypes. Only the databases whose unused part is more than
+// couchdb.compaction.ratio are compacted, except with Force=true.
+func compactHandler(c echo.Context) error {
+	i, err := instance.Get(c.Param("domain"))
+	if err != nil {
+		return wrapError(err)
+	}
+	ratio := config.GetConfig().CouchDB.CompactionRatio
+	if c.QueryParam("Force") == "true" {
+		ratio = 0
+	}
+	doctypes := utils.SplitTrimString(c.QueryParam("Doctypes"), ",")
+	compacted, err := i.Compact(doctypes, ratio)
+	if err != nil {
+		return err
+	}
+	if compacted == nil {
+		compacted = []string{}
+	}
+	return c.JSON(http.StatusOK, compacted)
+}
+
+// devOptionsParam returns the development toggles given in the query-string:
+// Dev=true enables all of them, and DevOptions is a comma-separated list of
+// the toggles to enable.
+func devOptionsParam(c echo.Context) (instance.DevOptions, error) {
+	if c.QueryParam("Dev") == "true" {
+		return instance.AllDevOptions(), nil
+	}
+	dev, err := instance.ParseDevOptions(utils.SplitTrimString(c.QueryParam("DevOptions"), ","))
+	if err != nil {
+		return dev, jsonapi.InvalidParameter("DevOptions", err)
+	}
+	return dev, nil
+}
+
+// devOptionsHandler replaces the development toggles of an instance, and
+// returns them.
+func devOptionsHandler(c echo.Context) error {
+	dev, err := devOptionsParam(c)
+	if err != nil {
+		return err
+	}
+	i, err := instance.Get(c.Param("domain"))
+	if err != nil {
+		return wrapError(err)
+	}
+	if err = i.SetDevOptions(dev); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, i.Dev)
+}
+
+// snapshotHandler takes a snapshot of the databases and files of an
+// instance, and returns its identifier.
+func snapshotHandler(c echo.Context) error {
+	i, err := instance.Get(c.Param("domain"))
+	if err != nil {
+		return wrapError(err)
+	}
+	id, err := i.Snapshot()
+	if err != nil {
+		return wrapError(err)
+	}
+	return c.JSON(http.StatusCreated, echo.Map{"id": id})
+}
+
+// restoreSnapshotHandler puts an instance back in the state of one of its
+// snapshots.
+func restoreSnapshotHandler(c echo.Context) error {
+	i, err := instance.Get(c.Param("domain"))
+	if err != nil {
+		return wrapError(err)
+	}
+	if err = i.Restore(c.Param("snapshot")); err != nil {
+		return wrapError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// deleteSnapshotHandler removes a snapshot of an instance.
+func deleteSnapshotHandler(c echo.Context) error {
+	if err := instance.DeleteSnapshot(c.Param("domain"), c.Param("snapshot")); err != nil {
+		return wrapError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
 func deleteHandler(c echo.Context) error {
 	domain := c.Param("domain")
 	i, err := instance.Destroy(domain)
@@ -115,11 +376,11 @@ func registerClient(c echo.Context) error {
 
 func wrapError(err error) error {
 	switch err {
-	case instance.ErrNotFound:
+	case instance.ErrNotFound, instance.ErrSnapshotNotFound:
 		return jsonapi.NotFound(err)
 	case instance.ErrExists:
 		return jsonapi.Conflict(err)
-	case instance.ErrIllegalDomain:
+	case instance.ErrIllegalDomain, instance.ErrDomainTooLong, instance.ErrReservedDomain:
 		return jsonapi.InvalidParameter("domain", err)
 	case instance.ErrMissingToken:
 		return jsonapi.BadRequest(err)
@@ -129,6 +390,14 @@ func wrapError(err error) error {
 		return jsonapi.BadRequest(err)
 	case instance.ErrInvalidPassphrase:
 		return jsonapi.BadRequest(err)
+	case instance.ErrTokenWithoutID:
+		return jsonapi.BadRequest(err)
+	case instance.ErrTooManyRevokedTokens:
+		return jsonapi.Conflict(err)
+	case instance.ErrSnapshotsDisabled:
+		return jsonapi.NewError(http.StatusForbidden, err)
+	case instance.ErrSnapshotTooLarge:
+		return jsonapi.NewError(http.StatusRequestEntityTooLarge, err)
 	}
 	return err
 }
@@ -137,7 +406,22 @@ func wrapError(err error) error {
 func Routes(router *echo.Group) {
 	router.GET("", listHandler)
 	router.POST("", createHandler)
+	router.GET("/search", searchHandler)
+	router.GET("/slug_collisions", slugCollisionsHandler)
 	router.DELETE("/:domain", deleteHandler)
+	router.POST("/:domain/reindex", reindexHandler)
+	router.POST("/:domain/rotate_secrets", rotateSecretsHandler)
+	router.POST("/:domain/revoke_token", revokeTokenHandler)
+	router.POST("/:domain/migrate_dbs", migrateDBPrefixHandler)
+	router.POST("/:domain/security", securityHandler)
+	router.GET("/:domain/gc", gcStatsHandler)
+	router.POST("/:domain/gc", gcHandler)
+	router.GET("/:domain/missing_indexes", missingIndexesHandler)
+	router.POST("/:domain/compact", compactHandler)
+	router.PUT("/:domain/dev_options", devOptionsHandler)
+	router.POST("/:domain/snapshots", snapshotHandler)
+	router.POST("/:domain/snapshots/:snapshot/restore", restoreSnapshotHandler)
+	router.DELETE("/:domain/snapshots/:snapshot", deleteSnapshotHandler)
 	router.POST("/token", createToken)
 	router.POST("/oauth_client", registerClient)
 }
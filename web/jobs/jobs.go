@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"net/http"
 
+	_ "github.com/cozy/cozy-stack/pkg/calendar" // import the imip worker
 	"github.com/cozy/cozy-stack/pkg/consts"
+	_ "github.com/cozy/cozy-stack/pkg/emails" // import the imap worker
 	"github.com/cozy/cozy-stack/pkg/jobs"
 	_ "github.com/cozy/cozy-stack/pkg/jobs/workers" // import all workers
 	"github.com/cozy/cozy-stack/web/jsonapi"
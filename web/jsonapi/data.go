@@ -23,11 +23,12 @@ type Meta struct {
 // resource object
 // See http://jsonapi.org/format/#document-links
 type LinksList struct {
-	Self    string `json:"self,omitempty"`
-	Related string `json:"related,omitempty"`
-	Prev    string `json:"prev,omitempty"`
-	Next    string `json:"next,omitempty"`
-	Icon    string `json:"icon,omitempty"`
+	Self      string `json:"self,omitempty"`
+	Related   string `json:"related,omitempty"`
+	Prev      string `json:"prev,omitempty"`
+	Next      string `json:"next,omitempty"`
+	Icon      string `json:"icon,omitempty"`
+	Thumbnail string `json:"thumbnail,omitempty"`
 }
 
 // ResourceIdentifier is an object, used in relationships, to identify an
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 )
 
 // SourceError contains references to the source of the error
@@ -29,6 +30,17 @@ func (e *Error) Error() string {
 	return e.Title + "(" + strconv.Itoa(e.Status) + ")" + ": " + e.Detail
 }
 
+// Error implements the error interface, to be able to return several errors
+// from an echo handler. The status of the response is the one of the first
+// error.
+func (el ErrorList) Error() string {
+	msgs := make([]string, len(el))
+	for i, e := range el {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, ", ")
+}
+
 // NewError creates a new generic Error
 func NewError(status int, msg ...interface{}) *Error {
 	je := &Error{
@@ -21,6 +21,19 @@ func NeedInstance(next echo.HandlerFunc) echo.HandlerFunc {
 	}
 }
 
+// LoadInstance is an echo middleware which will load the instance of the
+// request, if there is one, but won't fail if there is none.
+func LoadInstance(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if c.Get("instance") == nil {
+			if i, err := instance.Get(c.Request().Host); err == nil {
+				c.Set("instance", i)
+			}
+		}
+		return next(c)
+	}
+}
+
 // GetInstance will return the instance linked to the given echo
 // context or panic if none exists
 func GetInstance(c echo.Context) *instance.Instance {
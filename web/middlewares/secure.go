@@ -20,6 +20,10 @@ type (
 	// SecureConfig defines the config for Secure middleware.
 	SecureConfig struct {
 		HSTSMaxAge     time.Duration
+		HSTSPreload    bool
+		ReferrerPolicy string
+		CSPReportOnly  bool
+		CSPReportURI   string
 		CSPDefaultSrc  []CSPSource
 		CSPScriptSrc   []CSPSource
 		CSPFrameSrc    []CSPSource
@@ -36,6 +40,14 @@ type (
 	}
 )
 
+const (
+	// HeaderContentSecurityPolicyReportOnly is the header used instead of
+	// Content-Security-Policy when the violations are only reported.
+	HeaderContentSecurityPolicyReportOnly = "Content-Security-Policy-Report-Only"
+	// HeaderReferrerPolicy is the Referrer-Policy header
+	HeaderReferrerPolicy = "Referrer-Policy"
+)
+
 const (
 	// XFrameDeny is the DENY option of the X-Frame-Options header.
 	XFrameDeny XFrameOption = "DENY"
@@ -67,6 +79,14 @@ func Secure(conf *SecureConfig) echo.MiddlewareFunc {
 	if conf.HSTSMaxAge > 0 {
 		hstsHeader = fmt.Sprintf("max-age=%.f; includeSubDomains",
 			conf.HSTSMaxAge.Seconds())
+		if conf.HSTSPreload {
+			hstsHeader += "; preload"
+		}
+	}
+
+	cspHeaderName := echo.HeaderContentSecurityPolicy
+	if conf.CSPReportOnly {
+		cspHeaderName = HeaderContentSecurityPolicyReportOnly
 	}
 
 	var xFrameHeader string
@@ -82,8 +102,14 @@ func Secure(conf *SecureConfig) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
 			hsts := true
-			if in := c.Get("instance"); in != nil && in.(*instance.Instance).Dev {
-				hsts = false
+			cspName := cspHeaderName
+			if in, ok := c.Get("instance").(*instance.Instance); ok {
+				if in.Dev.AllowHTTP {
+					hsts = false
+				}
+				if in.Dev.RelaxCSP {
+					cspName = HeaderContentSecurityPolicyReportOnly
+				}
 			}
 			h := c.Response().Header()
 			if hsts && hstsHeader != "" {
@@ -128,7 +154,13 @@ func Secure(conf *SecureConfig) echo.MiddlewareFunc {
 				cspHeader += makeCSPHeader(parent, "worker-src", conf.CSPWorkerSrc)
 			}
 			if cspHeader != "" {
-				h.Set(echo.HeaderContentSecurityPolicy, cspHeader)
+				if conf.CSPReportURI != "" {
+					cspHeader += "report-uri " + conf.CSPReportURI + ";"
+				}
+				h.Set(cspName, cspHeader)
+			}
+			if conf.ReferrerPolicy != "" {
+				h.Set(HeaderReferrerPolicy, conf.ReferrerPolicy)
 			}
 			h.Set(echo.HeaderXContentTypeOptions, "nosniff")
 			return next(c)
@@ -6,6 +6,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/labstack/echo"
 	"github.com/stretchr/testify/assert"
 )
@@ -94,3 +95,65 @@ func TestSecureMiddlewareXFrame(t *testing.T) {
 	assert.Equal(t, "SAMEORIGIN", rec2.Header().Get(echo.HeaderXFrameOptions))
 	assert.Equal(t, "ALLOW-FROM allowed.foobar", rec3.Header().Get(echo.HeaderXFrameOptions))
 }
+
+func TestSecureMiddlewareHSTSPreload(t *testing.T) {
+	e := echo.New()
+	req, _ := http.NewRequest(echo.GET, "http://app.cozy.local/", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	h := Secure(&SecureConfig{
+		HSTSMaxAge:  3600 * time.Second,
+		HSTSPreload: true,
+	})(echo.NotFoundHandler)
+	h(c)
+	assert.Equal(t, "max-age=3600; includeSubDomains; preload", rec.Header().Get(echo.HeaderStrictTransportSecurity))
+}
+
+func TestSecureMiddlewareReportOnly(t *testing.T) {
+	e := echo.New()
+	req, _ := http.NewRequest(echo.GET, "http://app.cozy.local/", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	h := Secure(&SecureConfig{
+		CSPScriptSrc:   []CSPSource{CSPSrcSelf},
+		CSPReportOnly:  true,
+		CSPReportURI:   "https://report.cozy.local/csp",
+		ReferrerPolicy: "same-origin",
+	})(echo.NotFoundHandler)
+	h(c)
+	assert.Equal(t, "", rec.Header().Get(echo.HeaderContentSecurityPolicy))
+	assert.Equal(t, "script-src 'self';report-uri https://report.cozy.local/csp;", rec.Header().Get(HeaderContentSecurityPolicyReportOnly))
+	assert.Equal(t, "same-origin", rec.Header().Get(HeaderReferrerPolicy))
+	assert.Equal(t, "nosniff", rec.Header().Get(echo.HeaderXContentTypeOptions))
+}
+
+func TestSecureMiddlewareDevOptions(t *testing.T) {
+	conf := &SecureConfig{
+		HSTSMaxAge:   3600 * time.Second,
+		CSPScriptSrc: []CSPSource{CSPSrcSelf},
+	}
+
+	e := echo.New()
+	req, _ := http.NewRequest(echo.GET, "http://cozy.local/", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.Set("instance", &instance.Instance{
+		Domain: "cozy.local",
+		Dev:    instance.DevOptions{RelaxCSP: true},
+	})
+	Secure(conf)(echo.NotFoundHandler)(c)
+	assert.Equal(t, "max-age=3600; includeSubDomains", rec.Header().Get(echo.HeaderStrictTransportSecurity))
+	assert.Equal(t, "", rec.Header().Get(echo.HeaderContentSecurityPolicy))
+	assert.Equal(t, "script-src 'self';", rec.Header().Get(HeaderContentSecurityPolicyReportOnly))
+
+	req, _ = http.NewRequest(echo.GET, "http://cozy.local/", nil)
+	rec = httptest.NewRecorder()
+	c = e.NewContext(req, rec)
+	c.Set("instance", &instance.Instance{
+		Domain: "cozy.local",
+		Dev:    instance.DevOptions{AllowHTTP: true},
+	})
+	Secure(conf)(echo.NotFoundHandler)(c)
+	assert.Equal(t, "", rec.Header().Get(echo.HeaderStrictTransportSecurity))
+	assert.Equal(t, "script-src 'self';", rec.Header().Get(echo.HeaderContentSecurityPolicy))
+}
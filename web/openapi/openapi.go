@@ -0,0 +1,312 @@
+// Package openapi exports a description of the HTTP API of the stack in the
+// OpenAPI 3 format. The document is built from the routes registered on the
+// echo router, completed by the endpoints declared by the web packages, so
+// that it can't drift from the routes really served. It can be used to
+// generate the client SDKs.
+package openapi
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/labstack/echo"
+)
+
+// Version is the version of the OpenAPI specification used for the document
+const Version = "3.0.0"
+
+// Endpoint is the declaration of a route of the API, with its payloads. The
+// request and response payloads are described by Go values, whose types are
+// converted to JSON schemas.
+type Endpoint struct {
+	Method  string
+	Path    string
+	Summary string
+	// Query is the list of parameters accepted in the query-string
+	Query []Param
+	// Request is a value of the type of the JSON body of the request
+	Request interface{}
+	// Response is a value of the type of the JSON body of the response
+	Response interface{}
+	// JSONAPI is true if the payloads are JSON-API documents, with the values
+	// of Request and Response used as the attributes.
+	JSONAPI bool
+	// Status is the status code of a successful response, 200 by default
+	Status int
+}
+
+// Param is a parameter of the query-string
+type Param struct {
+	Name        string
+	Description string
+	Required    bool
+}
+
+// Spec is the list of the endpoints declared for a router
+type Spec struct {
+	mu        sync.Mutex
+	endpoints map[string]*Endpoint
+	doc       *Document
+}
+
+// New returns an empty Spec
+func New() *Spec {
+	return &Spec{endpoints: make(map[string]*Endpoint)}
+}
+
+// Add declares the endpoints of a group of routes, mounted on the given
+// prefix. The paths of the endpoints are relative to this prefix.
+func (s *Spec) Add(prefix string, endpoints []*Endpoint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range endpoints {
+		full := *e
+		full.Path = prefix + e.Path
+		s.endpoints[key(full.Method, full.Path)] = &full
+	}
+	s.doc = nil
+}
+
+// Undeclared returns the endpoints that have been declared, but that are not
+// registered on the router. It is used by the contract tests.
+func (s *Spec) Undeclared(routes []*echo.Route) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	registered := make(map[string]bool, len(routes))
+	for _, r := range routes {
+		registered[key(r.Method, r.Path)] = true
+	}
+	var missing []string
+	for k := range s.endpoints {
+		if !registered[k] {
+			missing = append(missing, k)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// Build returns the OpenAPI document for the given routes
+func (s *Spec) Build(routes []*echo.Route) *Document {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	gen := newGenerator()
+	doc := &Document{
+		OpenAPI: Version,
+		Info: Info{
+			Title:   "Cozy Stack",
+			Version: config.Version,
+		},
+		Paths: make(map[string]PathItem),
+	}
+	sorted := make([]*echo.Route, len(routes))
+	copy(sorted, routes)
+	sort.Sort(byPath(sorted))
+	for _, r := range sorted {
+		method := strings.ToLower(r.Method)
+		if !isOpenAPIMethod(method) {
+			continue
+		}
+		path, params := ConvertPath(r.Path)
+		item, ok := doc.Paths[path]
+		if !ok {
+			item = make(PathItem)
+			doc.Paths[path] = item
+		}
+		if _, ok := item[method]; ok {
+			continue
+		}
+		item[method] = gen.operation(r, s.endpoints[key(r.Method, r.Path)], params)
+	}
+	doc.Components.Schemas = gen.schemas
+	return doc
+}
+
+// Handler returns an echo handler that responds with the OpenAPI document of
+// the routes of the router.
+func (s *Spec) Handler(router *echo.Echo) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		s.mu.Lock()
+		doc := s.doc
+		s.mu.Unlock()
+		if doc == nil {
+			doc = s.Build(router.Routes())
+			s.mu.Lock()
+			s.doc = doc
+			s.mu.Unlock()
+		}
+		return c.JSON(http.StatusOK, doc)
+	}
+}
+
+type byPath []*echo.Route
+
+func (r byPath) Len() int      { return len(r) }
+func (r byPath) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r byPath) Less(i, j int) bool {
+	if r[i].Path != r[j].Path {
+		return r[i].Path < r[j].Path
+	}
+	return r[i].Method < r[j].Method
+}
+
+func key(method, path string) string {
+	return strings.ToUpper(method) + " " + path
+}
+
+func isOpenAPIMethod(method string) bool {
+	switch method {
+	case "get", "put", "post", "delete", "options", "head", "patch", "trace":
+		return true
+	}
+	return false
+}
+
+// ConvertPath transforms a path with the echo syntax, like /apps/:slug, to
+// the OpenAPI syntax, like /apps/{slug}. It also returns the names of the
+// path parameters.
+func ConvertPath(path string) (string, []string) {
+	var params []string
+	parts := strings.Split(path, "/")
+	for i, part := range parts {
+		if strings.HasPrefix(part, ":") {
+			params = append(params, part[1:])
+			parts[i] = "{" + part[1:] + "}"
+		} else if part == "*" {
+			params = append(params, "path")
+			parts[i] = "{path}"
+		}
+	}
+	return strings.Join(parts, "/"), params
+}
+
+type generator struct {
+	schemas map[string]*Schema
+	ids     map[string]int
+}
+
+func newGenerator() *generator {
+	return &generator{
+		schemas: make(map[string]*Schema),
+		ids:     make(map[string]int),
+	}
+}
+
+func (g *generator) operation(r *echo.Route, e *Endpoint, params []string) *Operation {
+	id := operationID(r.Method, r.Path)
+	// The identifiers must be unique, even for /status and /status/
+	g.ids[id]++
+	if n := g.ids[id]; n > 1 {
+		id = fmt.Sprintf("%s%d", id, n)
+	}
+	op := &Operation{
+		OperationID: id,
+		Responses:   make(map[string]*Response),
+	}
+	if tag := strings.Split(strings.TrimPrefix(r.Path, "/"), "/")[0]; tag != "" {
+		op.Tags = []string{tag}
+	}
+	for _, name := range params {
+		op.Parameters = append(op.Parameters, &Parameter{
+			Name:     name,
+			In:       "path",
+			Required: true,
+			Schema:   &Schema{Type: "string"},
+		})
+	}
+	if e == nil {
+		op.Responses["default"] = &Response{Description: "Not described"}
+		return op
+	}
+
+	op.Summary = e.Summary
+	for _, q := range e.Query {
+		op.Parameters = append(op.Parameters, &Parameter{
+			Name:        q.Name,
+			In:          "query",
+			Description: q.Description,
+			Required:    q.Required,
+			Schema:      &Schema{Type: "string"},
+		})
+	}
+	contentType := echo.MIMEApplicationJSON
+	if e.JSONAPI {
+		contentType = "application/vnd.api+json"
+	}
+	if e.Request != nil {
+		op.RequestBody = &RequestBody{
+			Required: true,
+			Content: map[string]*MediaType{
+				contentType: {Schema: g.payload(e.Request, e.JSONAPI)},
+			},
+		}
+	}
+	status := e.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	res := &Response{Description: http.StatusText(status)}
+	if e.Response != nil {
+		res.Content = map[string]*MediaType{
+			contentType: {Schema: g.payload(e.Response, e.JSONAPI)},
+		}
+	}
+	op.Responses[fmt.Sprintf("%d", status)] = res
+	return op
+}
+
+// operationID makes an identifier like getAppsSlugIcon for GET /apps/:slug/icon
+func operationID(method, path string) string {
+	id := strings.ToLower(method)
+	for _, part := range strings.FieldsFunc(path, func(r rune) bool {
+		return r == '/' || r == ':' || r == '-' || r == '_' || r == '.' || r == '*'
+	}) {
+		id += strings.ToUpper(part[:1]) + part[1:]
+	}
+	return id
+}
+
+// payload returns the schema of a payload, wrapped in a JSON-API document if
+// needed.
+func (g *generator) payload(v interface{}, jsonapi bool) *Schema {
+	t := reflect.TypeOf(v)
+	if !jsonapi {
+		return g.schemaFor(t)
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+		return &Schema{
+			Type: "object",
+			Properties: map[string]*Schema{
+				"data": {Type: "array", Items: g.jsonapiObject(t.Elem())},
+			},
+		}
+	}
+	return &Schema{
+		Type: "object",
+		Properties: map[string]*Schema{
+			"data": g.jsonapiObject(t),
+		},
+	}
+}
+
+func (g *generator) jsonapiObject(attrs reflect.Type) *Schema {
+	return &Schema{
+		Type: "object",
+		Properties: map[string]*Schema{
+			"type":          {Type: "string"},
+			"id":            {Type: "string"},
+			"attributes":    g.schemaFor(attrs),
+			"meta":          {Type: "object"},
+			"links":         {Type: "object"},
+			"relationships": {Type: "object"},
+		},
+	}
+}
@@ -0,0 +1,87 @@
+package openapi
+
+import (
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+type node struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size,string"`
+	Tags      []string  `json:"tags,omitempty"`
+	Parent    *node     `json:"parent,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Ignored   string    `json:"-"`
+	secret    string
+}
+
+func TestConvertPath(t *testing.T) {
+	path, params := ConvertPath("/files/:file-id/relationships/:rel")
+	assert.Equal(t, "/files/{file-id}/relationships/{rel}", path)
+	assert.Equal(t, []string{"file-id", "rel"}, params)
+	path, params = ConvertPath("/apps/")
+	assert.Equal(t, "/apps/", path)
+	assert.Empty(t, params)
+}
+
+func TestSchemaFor(t *testing.T) {
+	gen := newGenerator()
+	s := gen.payload(&node{}, false)
+	assert.Equal(t, "#/components/schemas/openapi.node", s.Ref)
+
+	def := gen.schemas["openapi.node"]
+	if assert.NotNil(t, def) {
+		assert.Equal(t, "object", def.Type)
+		assert.Len(t, def.Properties, 5)
+		assert.Equal(t, "string", def.Properties["size"].Type)
+		assert.Equal(t, "array", def.Properties["tags"].Type)
+		assert.Equal(t, "string", def.Properties["tags"].Items.Type)
+		assert.Equal(t, s.Ref, def.Properties["parent"].Ref)
+		assert.Equal(t, "date-time", def.Properties["updated_at"].Format)
+		assert.Equal(t, []string{"name", "size", "updated_at"}, def.Required)
+	}
+
+	s = gen.payload([]*node{}, true)
+	data := s.Properties["data"]
+	assert.Equal(t, "array", data.Type)
+	assert.Equal(t, "#/components/schemas/openapi.node", data.Items.Properties["attributes"].Ref)
+}
+
+func TestBuild(t *testing.T) {
+	routes := []*echo.Route{
+		{Method: "GET", Path: "/nodes/"},
+		{Method: "GET", Path: "/nodes/:id"},
+		{Method: "PROPFIND", Path: "/nodes/:id"},
+		{Method: "GET", Path: "/status"},
+		{Method: "GET", Path: "/status/"},
+	}
+	spec := New()
+	spec.Add("/nodes", []*Endpoint{
+		{Method: "GET", Path: "/:id", Summary: "Get a node", Response: &node{}, JSONAPI: true},
+		{Method: "DELETE", Path: "/:id", Summary: "Delete a node"},
+	})
+	assert.Equal(t, []string{"DELETE /nodes/:id"}, spec.Undeclared(routes))
+
+	doc := spec.Build(routes)
+	assert.Len(t, doc.Paths, 4)
+	item := doc.Paths["/nodes/{id}"]
+	assert.Len(t, item, 1)
+	op := item["get"]
+	if assert.NotNil(t, op) {
+		assert.Equal(t, "getNodesId", op.OperationID)
+		assert.Equal(t, "Get a node", op.Summary)
+		assert.Equal(t, []string{"nodes"}, op.Tags)
+		if assert.Len(t, op.Parameters, 1) {
+			assert.Equal(t, "id", op.Parameters[0].Name)
+			assert.Equal(t, "path", op.Parameters[0].In)
+		}
+		assert.Contains(t, op.Responses["200"].Content, "application/vnd.api+json")
+	}
+	assert.Contains(t, doc.Paths["/nodes/"]["get"].Responses, "default")
+	assert.Equal(t, "getStatus", doc.Paths["/status"]["get"].OperationID)
+	assert.Equal(t, "getStatus2", doc.Paths["/status/"]["get"].OperationID)
+	assert.Contains(t, doc.Components.Schemas, "openapi.node")
+}
@@ -88,6 +88,23 @@ func AllowInstallApp(c echo.Context, v permissions.Verb) error {
 	return nil
 }
 
+// AllowResolveIntent checks if the current permission allows to find the
+// applications that can handle an intent. All the apps can do it, as it is
+// how they delegate an action to another application.
+func AllowResolveIntent(c echo.Context) error {
+	pdoc, err := getPermission(c)
+	if err != nil {
+		return err
+	}
+	if pdoc.Type == permissions.TypeApplication {
+		return nil
+	}
+	if !pdoc.Permissions.AllowWholeType(permissions.GET, consts.Apps) {
+		return echo.NewHTTPError(http.StatusForbidden)
+	}
+	return nil
+}
+
 // AllowLogout checks if the current permission allows loging out.
 // all apps can trigger a logout.
 func AllowLogout(c echo.Context) bool {
@@ -6,13 +6,12 @@ import (
 	"net/http"
 	"strings"
 
-	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/cozy/cozy-stack/pkg/apps"
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/oauth"
 	"github.com/cozy/cozy-stack/pkg/permissions"
 	"github.com/cozy/cozy-stack/web/middlewares"
 	"github.com/labstack/echo"
-	jwt "gopkg.in/dgrijalva/jwt-go.v3"
 )
 
 const bearerAuthScheme = "Bearer "
@@ -51,25 +50,54 @@ func getRequestToken(c echo.Context) string {
 	return ""
 }
 
+// parseJWT returns the permission doc of a token. It is cached for the next
+// requests with the same token, but the signature, the revocation, the issuer
+// and the expiration of the token are still checked on each request.
 func parseJWT(instance *instance.Instance, token string) (*permissions.Permission, error) {
 	var claims permissions.Claims
-	err := crypto.ParseJWT(token, func(token *jwt.Token) (interface{}, error) {
-		return instance.PickKey(token.Claims.(*permissions.Claims).Audience)
-	}, &claims)
-
+	err := instance.ParseJWT(token, &claims)
 	if err != nil {
 		return nil, permissions.ErrInvalidToken
 	}
+	if err = checkClaims(instance, &claims); err != nil {
+		return nil, err
+	}
 
-	// check if the claim is valid
-	if claims.Issuer != instance.Domain {
-		return nil, permissions.ErrInvalidToken
+	if pdoc, ok := permissions.GetCached(instance.Domain, token, instance.KeyGeneration); ok {
+		if err = checkShareSet(pdoc, &claims); err != nil {
+			return nil, err
+		}
+		if claims.Audience == permissions.AppAudience {
+			apps.RecordCall(instance, claims.Subject)
+		}
+		cached := *pdoc
+		return &cached, nil
+	}
+
+	pdoc, err := permissionsForClaims(instance, token, &claims)
+	if err != nil {
+		return nil, err
 	}
+	cached := *pdoc
+	permissions.PutCached(instance.Domain, token, instance.KeyGeneration, &cached, &claims)
+	return pdoc, nil
+}
 
+// checkClaims checks the issuer and the expiration of a token. They are
+// checked on each request, even if the permissions of the token are cached.
+func checkClaims(instance *instance.Instance, claims *permissions.Claims) error {
+	if claims.Issuer != instance.Domain {
+		return permissions.ErrInvalidToken
+	}
 	if claims.Expired() {
-		return nil, permissions.ErrExpiredToken
+		return permissions.ErrExpiredToken
 	}
+	return nil
+}
 
+// permissionsForClaims returns the permission doc of a token, whose claims
+// have been checked by checkClaims.
+func permissionsForClaims(instance *instance.Instance, token string, claims *permissions.Claims) (*permissions.Permission, error) {
 	switch claims.Audience {
 	case permissions.AccessTokenAudience:
 		// An OAuth2 token is only valid if the client has not been revoked
@@ -77,17 +105,35 @@ func parseJWT(instance *instance.Instance, token string) (*permissions.Permissio
 			return nil, permissions.ErrInvalidToken
 		}
 
-		return permissions.GetForOauth(&claims)
+		return permissions.GetForOauth(claims)
 
 	case permissions.CLIAudience:
 		// do not check client existence
-		return permissions.GetForCLI(&claims)
+		return permissions.GetForCLI(claims)
 
 	case permissions.AppAudience:
+		// An app token is only valid if the app is still installed, and if
+		// it was issued after the installation, so that the tokens of an
+		// uninstalled app can't be reused when it is installed again.
+		man, err := apps.GetBySlug(instance, claims.Subject)
+		if err != nil {
+			return nil, permissions.ErrInvalidToken
+		}
+		if man.InstalledAt != nil && claims.IssuedAt < man.InstalledAt.Unix() {
+			return nil, permissions.ErrInvalidToken
+		}
 		pdoc, err := permissions.GetForApp(instance, claims.Subject)
 		if err != nil {
-			return nil, err
+			return nil, permissions.ErrInvalidToken
 		}
+		// The token can't be used beyond the permissions declared in the
+		// installed manifest, even if the permission doc has been changed.
+		var declared permissions.Set
+		if man.Permissions != nil {
+			declared = *man.Permissions
+		}
+		pdoc.Permissions = pdoc.Permissions.Restrict(declared)
+		apps.RecordCall(instance, claims.Subject)
 		return pdoc, nil
 
 	case permissions.ShareAudience:
@@ -95,6 +141,23 @@ func parseJWT(instance *instance.Instance, token string) (*permissions.Permissio
 		if err != nil {
 			return nil, err
 		}
+		if err = checkShareSet(pdoc, claims); err != nil {
+			return nil, err
+		}
+		// a code protected by a password must be exchanged for a token
+		if pdoc.Password != "" {
+			return nil, permissions.ErrPasswordRequired
+		}
+		return pdoc, nil
+
+	case permissions.UnlockedShareAudience:
+		pdoc, err := permissions.GetByID(instance, claims.Subject)
+		if err != nil || pdoc.Type != permissions.TypeSharing {
+			return nil, permissions.ErrInvalidToken
+		}
+		if err = checkShareSet(pdoc, claims); err != nil {
+			return nil, err
+		}
 		return pdoc, nil
 
 	default:
@@ -102,6 +165,27 @@ func parseJWT(instance *instance.Instance, token string) (*permissions.Permissio
 	}
 }
 
+// checkShareSet checks that the share set of a share code, or of a token given
+// in exchange of a share code, has not expired and is not locked
+func checkShareSet(pdoc *permissions.Permission, claims *permissions.Claims) error {
+	switch claims.Audience {
+	case permissions.ShareAudience:
+		if pdoc.ExpiredForCode(claims) {
+			return permissions.ErrExpiredToken
+		}
+	case permissions.UnlockedShareAudience:
+		if pdoc.Expired() {
+			return permissions.ErrExpiredToken
+		}
+	default:
+		return nil
+	}
+	if pdoc.Locked() {
+		return permissions.ErrLockedShareSet
+	}
+	return nil
+}
+
 // extract permissions doc or set from the context
 func extract(c echo.Context) (*permissions.Permission, error) {
 	instance := middlewares.GetInstance(c)
@@ -115,7 +199,16 @@ func extract(c echo.Context) (*permissions.Permission, error) {
 		return nil, ErrNoToken
 	}
 
-	return parseJWT(instance, tok)
+	// A valid token is never blocked, even if there have been failures for
+	// the same IP address: the token can't be brute-forced, as it is signed
+	pdoc, err := parseJWT(instance, tok)
+	if err != nil {
+		if ferr := checkFailures(c); ferr != nil {
+			return nil, ferr
+		}
+		recordFailure(c, err)
+	}
+	return pdoc, err
 
 }
 
@@ -135,3 +228,10 @@ func getPermission(c echo.Context) (*permissions.Permission, error) {
 
 	return pdoc, nil
 }
+
+// GetPermission returns the permission doc attached to the request, extracted
+// from its token. It can be used by the other web packages that need to know
+// who is making the request (for example, to create a share set).
+func GetPermission(c echo.Context) (*permissions.Permission, error) {
+	return getPermission(c)
+}
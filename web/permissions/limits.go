@@ -0,0 +1,186 @@
+package permissions
+
+import (
+	"container/list"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/labstack/echo"
+)
+
+const (
+	// freeFailures is the number of failed validations of a token or a code
+	// that an IP can make before being delayed
+	freeFailures = 5
+	// failureBaseDelay is the delay after the first failure beyond the free
+	// ones. It is doubled for each new failure.
+	failureBaseDelay = time.Second
+	// failureMaxDelay is the maximal delay between two tries
+	failureMaxDelay = time.Hour
+	// failureForgetAfter is the duration without failure after which the
+	// failures of an IP are forgotten
+	failureForgetAfter = 24 * time.Hour
+	// failureMaxIPs is the maximal number of IPs for which the failures are
+	// counted. When it is reached, the IP with the oldest failure is
+	// forgotten.
+	failureMaxIPs = 10000
+)
+
+// ErrTooManyFailures is returned when an IP has made too many failed
+// validations of tokens or codes, and must wait before trying again
+var ErrTooManyFailures = echo.NewHTTPError(http.StatusTooManyRequests,
+	"Too many failures, retry later")
+
+type ipFailures struct {
+	ip    string
+	count int
+	last  time.Time
+}
+
+// failuresLimiter counts the failed validations of tokens and codes by IP,
+// so that they can't be brute-forced. After freeFailures, an IP must wait a
+// delay, doubled for each new failure, before its next try. The IPs are kept
+// in a list sorted by their last failure, the most recent first.
+type failuresLimiter struct {
+	mu    sync.Mutex
+	ips   map[string]*list.Element
+	order *list.List
+}
+
+func newFailuresLimiter() *failuresLimiter {
+	return &failuresLimiter{
+		ips:   make(map[string]*list.Element),
+		order: list.New(),
+	}
+}
+
+var failures = newFailuresLimiter()
+
+// wait returns how long the IP must still wait before its next try
+func (l *failuresLimiter) wait(ip string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.ips[ip]
+	if !ok {
+		return 0
+	}
+	f := e.Value.(*ipFailures)
+	if f.count < freeFailures {
+		return 0
+	}
+	delay := failureMaxDelay
+	if shift := uint(f.count - freeFailures); shift < 32 {
+		if d := failureBaseDelay << shift; d < failureMaxDelay {
+			delay = d
+		}
+	}
+	return f.last.Add(delay).Sub(now)
+}
+
+// add records a failure for the IP. The IPs without failure for a long time,
+// and the oldest ones when there are too many, are removed.
+func (l *failuresLimiter) add(ip string, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, known := l.ips[ip]
+	for e := l.order.Back(); e != nil; e = l.order.Back() {
+		f := e.Value.(*ipFailures)
+		full := !known && l.order.Len() >= failureMaxIPs
+		if !full && now.Sub(f.last) <= failureForgetAfter {
+			break
+		}
+		l.order.Remove(e)
+		delete(l.ips, f.ip)
+		if f.ip == ip {
+			known = false
+		}
+	}
+	var f *ipFailures
+	if e, ok := l.ips[ip]; ok {
+		f = e.Value.(*ipFailures)
+		l.order.MoveToFront(e)
+	} else {
+		f = &ipFailures{ip: ip}
+		l.ips[ip] = l.order.PushFront(f)
+	}
+	f.count++
+	f.last = now
+}
+
+// clientIP returns the IP of the client of the request: the address of the
+// connection, or the address given by the reverse proxy in the
+// X-Forwarded-For or X-Real-IP header if the connection comes from a
+// trusted proxy (see the security.trusted_proxies option).
+func clientIP(req *http.Request) string {
+	remote, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		remote = req.RemoteAddr
+	}
+	proxies := config.GetConfig().Security.TrustedProxies
+	if !isTrustedProxy(remote, proxies) {
+		return remote
+	}
+	// The proxies append the address of their client, so the first
+	// address from the right that is not a trusted proxy is the client.
+	if xff := req.Header.Get(echo.HeaderXForwardedFor); xff != "" {
+		addrs := strings.Split(xff, ",")
+		for i := len(addrs) - 1; i >= 0; i-- {
+			addr := strings.TrimSpace(addrs[i])
+			if addr != "" && !isTrustedProxy(addr, proxies) {
+				return addr
+			}
+		}
+	}
+	if ip := req.Header.Get(echo.HeaderXRealIP); ip != "" {
+		return ip
+	}
+	return remote
+}
+
+// isTrustedProxy returns true if the address is one of the proxies, given as
+// IP addresses or CIDR ranges.
+func isTrustedProxy(addr string, proxies []string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range proxies {
+		if _, ipnet, err := net.ParseCIDR(proxy); err == nil {
+			if ipnet.Contains(ip) {
+				return true
+			}
+		} else if p := net.ParseIP(proxy); p != nil && p.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkFailures returns ErrTooManyFailures if the IP of the request must wait
+// before trying again to validate a token or a code.
+func checkFailures(c echo.Context) error {
+	wait := failures.wait(clientIP(c.Request()), time.Now())
+	if wait <= 0 {
+		return nil
+	}
+	seconds := int(wait/time.Second) + 1
+	c.Response().Header().Set("Retry-After", strconv.Itoa(seconds))
+	return ErrTooManyFailures
+}
+
+// recordFailure counts the error for the IP of the request if it is an
+// invalid token, code or password. The expired tokens are not counted, as
+// the applications use them until they are refused.
+func recordFailure(c echo.Context, err error) {
+	switch err {
+	case permissions.ErrInvalidToken, permissions.ErrInvalidAudience,
+		permissions.ErrInvalidPassword:
+		failures.add(clientIP(c.Request()), time.Now())
+	}
+}
@@ -0,0 +1,75 @@
+package permissions
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFailuresLimiter(t *testing.T) {
+	l := newFailuresLimiter()
+	now := time.Now()
+	for i := 0; i < freeFailures; i++ {
+		assert.Equal(t, time.Duration(0), l.wait("10.0.0.1", now))
+		l.add("10.0.0.1", now)
+	}
+	assert.Equal(t, failureBaseDelay, l.wait("10.0.0.1", now))
+	l.add("10.0.0.1", now)
+	assert.Equal(t, 2*failureBaseDelay, l.wait("10.0.0.1", now))
+	assert.True(t, l.wait("10.0.0.1", now.Add(3*failureBaseDelay)) <= 0)
+	assert.Equal(t, time.Duration(0), l.wait("10.0.0.2", now))
+
+	for i := 0; i < 64; i++ {
+		l.add("10.0.0.1", now)
+	}
+	assert.Equal(t, failureMaxDelay, l.wait("10.0.0.1", now))
+
+	later := now.Add(failureForgetAfter + time.Hour)
+	l.add("10.0.0.2", later)
+	assert.Equal(t, time.Duration(0), l.wait("10.0.0.1", later))
+	assert.Len(t, l.ips, 1)
+}
+
+func TestFailuresLimiterMaxIPs(t *testing.T) {
+	l := newFailuresLimiter()
+	now := time.Now()
+	for i := 0; i < freeFailures+1; i++ {
+		l.add("oldest", now)
+	}
+	for i := 1; i < failureMaxIPs; i++ {
+		l.add("10.1."+strconv.Itoa(i), now.Add(time.Second))
+	}
+	assert.Len(t, l.ips, failureMaxIPs)
+	assert.True(t, l.wait("oldest", now) > 0)
+
+	l.add("newest", now.Add(time.Second))
+	assert.Len(t, l.ips, failureMaxIPs)
+	assert.Equal(t, l.order.Len(), failureMaxIPs)
+	assert.Equal(t, time.Duration(0), l.wait("oldest", now))
+}
+
+func TestClientIP(t *testing.T) {
+	proxies := config.GetConfig().Security.TrustedProxies
+	defer func() { config.GetConfig().Security.TrustedProxies = proxies }()
+
+	req, _ := http.NewRequest("GET", "/permissions/self", nil)
+	req.RemoteAddr = "10.0.0.1:54321"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4, 5.6.7.8")
+	req.Header.Set("X-Real-IP", "1.2.3.4")
+
+	config.GetConfig().Security.TrustedProxies = nil
+	assert.Equal(t, "10.0.0.1", clientIP(req))
+
+	config.GetConfig().Security.TrustedProxies = []string{"10.0.0.0/8"}
+	assert.Equal(t, "5.6.7.8", clientIP(req))
+
+	config.GetConfig().Security.TrustedProxies = []string{"10.0.0.1", "5.6.7.8"}
+	assert.Equal(t, "1.2.3.4", clientIP(req))
+
+	req.Header.Del("X-Forwarded-For")
+	assert.Equal(t, "1.2.3.4", clientIP(req))
+}
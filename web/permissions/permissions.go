@@ -2,11 +2,16 @@ package permissions
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/permissions"
 	"github.com/cozy/cozy-stack/web/jsonapi"
 	"github.com/cozy/cozy-stack/web/middlewares"
@@ -32,6 +37,10 @@ var ErrPatchCodeOrSet = echo.NewHTTPError(http.StatusBadRequest,
 // ErrForbidden is returned when a bad operation is attempted on permissions
 var ErrForbidden = echo.NewHTTPError(http.StatusForbidden)
 
+// ErrInvalidTTL is returned when the ttl parameter is not a positive duration
+var ErrInvalidTTL = echo.NewHTTPError(http.StatusBadRequest,
+	"The ttl parameter should be a positive duration, like 72h or 3d")
+
 // ContextPermissionSet is the key used in echo context to store permissions set
 const ContextPermissionSet = "permissions_set"
 
@@ -51,6 +60,10 @@ func displayPermissions(c echo.Context) error {
 func createPermission(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
 	names := strings.Split(c.QueryParam("codes"), ",")
+	ttl, err := parseTTL(c.QueryParam("ttl"))
+	if err != nil {
+		return err
+	}
 	parent, err := getPermission(c)
 	if err != nil {
 		return err
@@ -61,19 +74,22 @@ func createPermission(c echo.Context) error {
 		return err
 	}
 
+	if name := c.QueryParam("template"); name != "" {
+		tmpl, err := permissions.GetTemplate(instance.ContextName, name)
+		if err != nil {
+			return err
+		}
+		subdoc.Permissions, err = permissions.ExpandTemplate(tmpl, subdoc.Permissions)
+		if err != nil {
+			return err
+		}
+	}
+
 	var codes map[string]string
 	if names != nil {
 		codes = make(map[string]string, len(names))
 		for _, name := range names {
-			codes[name], err = crypto.NewJWT(instance.OAuthSecret, &permissions.Claims{
-				StandardClaims: jwt.StandardClaims{
-					Audience: permissions.ShareAudience,
-					Issuer:   instance.Domain,
-					IssuedAt: crypto.Timestamp(),
-					Subject:  name,
-				},
-				Scope: "",
-			})
+			codes[name], err = newShareCode(instance, name)
 			if err != nil {
 				return err
 			}
@@ -84,14 +100,156 @@ func createPermission(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusUnauthorized, "no parent")
 	}
 
-	pdoc, err := permissions.CreateShareSet(instance, parent, codes, subdoc.Permissions)
+	// the password is given in clear in the request, and only its hash is
+	// stored in the permission doc
+	var password []byte
+	if subdoc.Password != "" {
+		password = []byte(subdoc.Password)
+	}
+
+	pdoc, err := permissions.CreateShareSet(instance, parent, codes, subdoc.Permissions, ttl, password)
 	if err != nil {
 		return err
 	}
 
+	pdoc.Password = ""
 	return jsonapi.Data(c, http.StatusOK, pdoc, nil)
 }
 
+// shareSetFromCode returns the share set of the code given in the form of
+// the request.
+func shareSetFromCode(c echo.Context) (*permissions.Permission, error) {
+	instance := middlewares.GetInstance(c)
+	if err := checkFailures(c); err != nil {
+		return nil, err
+	}
+	pdoc, err := permissions.GetForShareCode(instance, c.FormValue("code"))
+	if err != nil {
+		if err == permissions.ErrExpiredToken {
+			return nil, err
+		}
+		recordFailure(c, permissions.ErrInvalidToken)
+		return nil, permissions.ErrInvalidToken
+	}
+	return pdoc, nil
+}
+
+// exchangeShareCode swaps a share code for a short-lived token, so that the
+// applications don't use the code itself as a bearer token. The password is
+// required for a code protected by a password.
+func exchangeShareCode(c echo.Context) error {
+	return shareCodeToToken(c, false)
+}
+
+// unlockShareCode exchanges a share code protected by a password, and this
+// password, for a token that gives the permissions of the share set.
+func unlockShareCode(c echo.Context) error {
+	return shareCodeToToken(c, true)
+}
+
+// shareCodeToToken responds with a short-lived token that gives the
+// permissions of the share set of the code given in the form, its expiry and
+// the rules of the set. The token is not valid after the expiry of the codes.
+// The password in the form is checked if the set is protected by a password,
+// or if it is required by the route, and the failures are counted for the IP
+// and the set.
+func shareCodeToToken(c echo.Context, passwordRequired bool) error {
+	instance := middlewares.GetInstance(c)
+	pdoc, err := shareSetFromCode(c)
+	if err != nil {
+		return err
+	}
+	if pdoc.Password != "" || passwordRequired {
+		password := c.FormValue("password")
+		if pdoc.Password != "" && password == "" {
+			return permissions.ErrPasswordRequired
+		}
+		if err = pdoc.VerifyPassword(instance, []byte(password)); err != nil {
+			recordFailure(c, err)
+			return err
+		}
+	}
+
+	now := time.Now()
+	token, err := instance.MakeJWT(permissions.UnlockedShareAudience, pdoc.ID(), "", now)
+	if err != nil {
+		return err
+	}
+	expiresAt := now.Add(permissions.UnlockedShareTokenValidityDuration).UTC()
+	if pdoc.ExpiresAt != 0 {
+		if codesExpiry := time.Unix(int64(pdoc.ExpiresAt), 0).UTC(); codesExpiry.Before(expiresAt) {
+			expiresAt = codesExpiry
+		}
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"token":       token,
+		"expires_at":  expiresAt,
+		"permissions": pdoc.Permissions,
+	})
+}
+
+// describePermissions returns the human-readable sentences for the rules of
+// a scope string, given in the query string, or of a permission set, given
+// in the body, in the locale of the instance. They are used by the consent
+// screens, so that they don't have to know the names of the doctypes.
+func describePermissions(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	var set permissions.Set
+	if scope := c.QueryParam("scope"); scope != "" {
+		var err error
+		if set, err = permissions.UnmarshalScopeString(scope); err != nil {
+			return jsonapi.InvalidParameter("scope", err)
+		}
+	} else if c.Request().Method == http.MethodPost {
+		var doc permissions.Permission
+		if _, err := jsonapi.Bind(c.Request(), &doc); err != nil {
+			return err
+		}
+		set = doc.Permissions
+	} else {
+		return jsonapi.InvalidParameter("scope", errors.New("The scope is mandatory"))
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"sentences": permissions.Describe(set, instance.Translate),
+	})
+}
+
+// newShareCode returns a new code for a share set, for the given name. A
+// random id is put in the token, so that a refreshed code is never the same
+// as the previous one.
+func newShareCode(i *instance.Instance, name string) (string, error) {
+	return crypto.NewJWT(i.OAuthSecret, &permissions.Claims{
+		StandardClaims: jwt.StandardClaims{
+			Audience: permissions.ShareAudience,
+			Issuer:   i.Domain,
+			IssuedAt: crypto.Timestamp(),
+			Subject:  name,
+			Id:       string(crypto.Base64Encode(crypto.GenerateRandomBytes(8))),
+		},
+		Scope: "",
+	})
+}
+
+// parseTTL parses the ttl parameter of the query string, as a duration (like
+// 72h) or a number of days (like 3d). An empty ttl means no expiry.
+func parseTTL(ttl string) (time.Duration, error) {
+	if ttl == "" {
+		return 0, nil
+	}
+	if strings.HasSuffix(ttl, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(ttl, "d"))
+		if err != nil || days <= 0 {
+			return 0, ErrInvalidTTL
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(ttl)
+	if err != nil || d <= 0 {
+		return 0, ErrInvalidTTL
+	}
+	return d, nil
+}
+
 type refAndVerb struct {
 	ID      string               `json:"id"`
 	DocType string               `json:"type"`
@@ -105,6 +263,9 @@ func listPermissions(c echo.Context) error {
 	if err != nil {
 		return err
 	}
+	if len(references) > permissions.MaxIDsForPermissions {
+		return permissions.ErrTooManyIDs
+	}
 	ids := make(map[string][]string)
 	for _, ref := range references {
 		idSlice, ok := ids[ref.Type]
@@ -138,6 +299,105 @@ func listPermissions(c echo.Context) error {
 	return json.NewEncoder(resp).Encode(doc)
 }
 
+func showPermission(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	current, err := getPermission(c)
+	if err != nil {
+		return err
+	}
+
+	doc, err := permissions.GetByID(instance, c.Param("permdocid"))
+	if err != nil {
+		return err
+	}
+
+	// a permission can be read by its parent, or with one of its codes. The
+	// codes given to the other people are only visible to the parent.
+	if !current.ParentOf(doc) {
+		if current.ID() == "" || current.ID() != doc.ID() {
+			return ErrForbidden
+		}
+		doc.Codes = nil
+	}
+
+	doc.Password = ""
+	return jsonapi.Data(c, http.StatusOK, doc, nil)
+}
+
+func listPermissionsByDoctype(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	doctype := c.Param("doctype")
+	if err := AllowWholeType(c, permissions.GET, doctype); err != nil {
+		return err
+	}
+	current, err := getPermission(c)
+	if err != nil {
+		return err
+	}
+
+	limit := permissions.DefaultShareSetsLimit
+	if param := c.QueryParam("page[limit]"); param != "" {
+		l, err := strconv.Atoi(param)
+		if err != nil || l <= 0 || l > permissions.MaxShareSetsLimit {
+			return jsonapi.InvalidParameter("page[limit]", errors.New("Invalid limit value"))
+		}
+		limit = l
+	}
+	cursor := c.QueryParam("page[cursor]")
+
+	docs, next, err := permissions.ListShareSetsByDoctype(instance, doctype, cursor, limit)
+	if err != nil {
+		return err
+	}
+
+	objs := make([]jsonapi.Object, len(docs))
+	for i, doc := range docs {
+		// the codes are only visible to the parent of the permission
+		if !current.ParentOf(doc) {
+			doc.Codes = nil
+		}
+		doc.Password = ""
+		objs[i] = doc
+	}
+
+	var links *jsonapi.LinksList
+	if next != "" {
+		query := url.Values{}
+		query.Set("page[cursor]", next)
+		query.Set("page[limit]", strconv.Itoa(limit))
+		links = &jsonapi.LinksList{Next: "/permissions/doctype/" + doctype + "?" + query.Encode()}
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, links)
+}
+
+// listPermissionsBySubject returns the permission docs of an application (by
+// its slug) or of an OAuth client (by its id), with the share sets they have
+// created, so that the user can see what they can access.
+func listPermissionsBySubject(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	subject := c.QueryParam("subject")
+	if subject == "" {
+		return jsonapi.InvalidParameter("subject", errors.New("The subject is required"))
+	}
+	if err := AllowWholeType(c, permissions.GET, consts.Permissions); err != nil {
+		return err
+	}
+
+	var objs []jsonapi.Object
+	for _, source := range []string{consts.Apps + "/" + subject, consts.OAuthClients + "/" + subject} {
+		docs, err := permissions.GetBySource(instance, source)
+		if err != nil {
+			return err
+		}
+		for _, doc := range docs {
+			doc.Codes = nil
+			doc.Password = ""
+			objs = append(objs, doc)
+		}
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, nil)
+}
+
 func patchPermission(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
 	current, err := getPermission(c)
@@ -178,13 +438,46 @@ func patchPermission(c echo.Context) error {
 		toPatch.AddRules(patch.Permissions...)
 	}
 
-	if err = couchdb.UpdateDoc(instance, toPatch); err != nil {
+	// the owner of the set can remove its lock by patching it
+	toPatch.ResetPasswordFailures()
+	if err = toPatch.Update(instance); err != nil {
 		return err
 	}
 
+	toPatch.Password = ""
 	return jsonapi.Data(c, http.StatusOK, toPatch, nil)
 }
 
+func refreshCode(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	current, err := getPermission(c)
+	if err != nil {
+		return err
+	}
+
+	toRefresh, err := permissions.GetByID(instance, c.Param("permdocid"))
+	if err != nil {
+		return err
+	}
+
+	// a code can be refreshed only by the parent of the permission
+	if !current.ParentOf(toRefresh) {
+		return ErrForbidden
+	}
+
+	name := c.Param("name")
+	code, err := newShareCode(instance, name)
+	if err != nil {
+		return err
+	}
+	if err = toRefresh.RefreshCode(instance, name, code); err != nil {
+		return err
+	}
+
+	toRefresh.Password = ""
+	return jsonapi.Data(c, http.StatusOK, toRefresh, nil)
+}
+
 func revokePermission(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
 
@@ -216,8 +509,16 @@ func revokePermission(c echo.Context) error {
 func Routes(router *echo.Group) {
 	// API Routes
 	router.POST("", createPermission)
+	router.GET("", listPermissionsBySubject)
 	router.GET("/self", displayPermissions)
+	router.POST("/unlock", unlockShareCode)
+	router.POST("/exchange", exchangeShareCode)
 	router.POST("/exists", listPermissions)
+	router.GET("/describe", describePermissions)
+	router.POST("/describe", describePermissions)
+	router.GET("/doctype/:doctype", listPermissionsByDoctype)
+	router.GET("/:permdocid", showPermission)
 	router.PATCH("/:permdocid", patchPermission)
+	router.POST("/:permdocid/codes/:name/refresh", refreshCode)
 	router.DELETE("/:permdocid", revokePermission)
 }
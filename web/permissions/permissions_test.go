@@ -6,10 +6,14 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/cozy/cozy-stack/pkg/apps"
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
@@ -17,8 +21,9 @@ import (
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/oauth"
 	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/realtime"
+	"github.com/cozy/cozy-stack/pkg/testutils"
 	"github.com/cozy/cozy-stack/web/jsonapi"
-	"github.com/labstack/echo"
 	"github.com/stretchr/testify/assert"
 	jwt "gopkg.in/dgrijalva/jwt-go.v3"
 )
@@ -30,62 +35,16 @@ var clientID string
 
 func TestMain(m *testing.M) {
 	config.UseTestFile()
+	testutils.NeedCouchdb()
+	setup := testutils.NewSetup(m, "permissions_test")
+	testInstance = setup.GetTestInstance()
 
-	testInstance = &instance.Instance{
-		OAuthSecret: []byte("topsecret"),
-		Domain:      "example.com",
-	}
-
-	err := couchdb.ResetDB(testInstance, "io.cozy.events")
-	if err != nil {
-		fmt.Println("Cant reset db", err)
-		os.Exit(1)
-	}
-
-	err = couchdb.ResetDB(testInstance, consts.Permissions)
-	if err != nil {
-		fmt.Println("Cant reset db", err)
-		os.Exit(1)
-	}
-	err = couchdb.DefineIndexes(testInstance, consts.IndexesByDoctype(consts.Permissions))
-	if err != nil {
-		fmt.Println("Cant define index", err)
-		os.Exit(1)
-	}
-	err = couchdb.DefineViews(testInstance, consts.ViewsByDoctype(consts.Permissions))
-	if err != nil {
-		fmt.Println("cant define views", err)
-		os.Exit(1)
-	}
-
-	client := oauth.Client{
-		RedirectURIs: []string{"http://localhost/oauth/callback"},
-		ClientName:   "test-permissions",
-		SoftwareID:   "github.com/cozy/cozy-stack/web/permissions",
-	}
-	client.Create(testInstance)
+	var client *oauth.Client
+	client, token = setup.GetTestClient("io.cozy.contacts io.cozy.files:GET")
 	clientID = client.ClientID
 
-	token, _ = crypto.NewJWT(testInstance.OAuthSecret, permissions.Claims{
-		StandardClaims: jwt.StandardClaims{
-			Audience: permissions.AccessTokenAudience,
-			Issuer:   testInstance.Domain,
-			IssuedAt: crypto.Timestamp(),
-			Subject:  clientID,
-		},
-		Scope: "io.cozy.contacts io.cozy.files:GET",
-	})
-
-	handler := echo.New()
-
-	group := handler.Group("/permissions")
-	group.Use(injectInstance(testInstance))
-	Routes(group)
-
-	ts = httptest.NewServer(handler)
-	res := m.Run()
-	ts.Close()
-	os.Exit(res)
+	ts = setup.GetTestServer("/permissions", Routes)
+	os.Exit(setup.Run())
 }
 
 func TestGetPermissions(t *testing.T) {
@@ -116,6 +75,37 @@ func TestGetPermissions(t *testing.T) {
 	}
 }
 
+func TestAppTokenLimitedToManifest(t *testing.T) {
+	declared := permissions.Set{
+		permissions.Rule{Title: "contacts", Type: "io.cozy.contacts", Verbs: permissions.Verbs(permissions.GET)},
+	}
+	man := &apps.Manifest{Slug: "limited", State: apps.Ready, Permissions: &declared}
+	if !assert.NoError(t, couchdb.CreateNamedDoc(testInstance, man)) {
+		return
+	}
+	defer couchdb.DeleteDoc(testInstance, man)
+	_, err := permissions.CreateAppSet(testInstance, "limited", permissions.Set{
+		permissions.Rule{Title: "contacts", Type: "io.cozy.contacts", Verbs: permissions.Verbs(permissions.GET)},
+		permissions.Rule{Title: "files", Type: "io.cozy.files"},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer permissions.DestroyApp(testInstance, "limited")
+
+	appToken := testInstance.BuildAppToken(man)
+	out, err := doRequest("GET", ts.URL+"/permissions/self", appToken, "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, out, 1)
+	if assert.Contains(t, out, "contacts") {
+		rule := out["contacts"].(map[string]interface{})
+		assert.Equal(t, "io.cozy.contacts", rule["type"])
+		assert.Equal(t, []interface{}{"GET"}, rule["verbs"])
+	}
+}
+
 func TestGetPermissionsForRevokedClient(t *testing.T) {
 	tok, err := crypto.NewJWT(testInstance.OAuthSecret, permissions.Claims{
 		StandardClaims: jwt.StandardClaims{
@@ -134,7 +124,7 @@ func TestGetPermissionsForRevokedClient(t *testing.T) {
 	assert.Equal(t, 400, res.StatusCode)
 	body, err := ioutil.ReadAll(res.Body)
 	assert.NoError(t, err)
-	assert.Equal(t, `{"message":"Invalid JWT token"}`, string(body))
+	assert.Equal(t, "Invalid JWT token", string(body))
 }
 
 func TestGetPermissionsForExpiredToken(t *testing.T) {
@@ -156,7 +146,7 @@ func TestGetPermissionsForExpiredToken(t *testing.T) {
 	assert.Equal(t, 400, res.StatusCode)
 	body, err := ioutil.ReadAll(res.Body)
 	assert.NoError(t, err)
-	assert.Equal(t, `{"message":"Expired token"}`, string(body))
+	assert.Equal(t, "Expired token", string(body))
 }
 
 func TestBadPermissionsBearer(t *testing.T) {
@@ -204,6 +194,264 @@ func TestCreateSubPermission(t *testing.T) {
 
 }
 
+func TestCreateSubPermissionWithTTL(t *testing.T) {
+	_, _, err := createTestSubPermissionsWithTTL(token, "frank", "forever")
+	assert.Error(t, err)
+
+	before := time.Now().Add(72 * time.Hour).Unix()
+	id, codes, err := createTestSubPermissionsWithTTL(token, "frank", "3d")
+	if !assert.NoError(t, err) {
+		return
+	}
+	pdoc, err := permissions.GetByID(testInstance, id)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, int64(pdoc.ExpiresAt) >= before)
+	assert.True(t, int64(pdoc.ExpiresAt) <= time.Now().Add(72*time.Hour).Unix())
+	frankCode := codes["frank"].(string)
+	_, err = doRequest("GET", ts.URL+"/permissions/self", frankCode, "")
+	assert.NoError(t, err)
+
+	pdoc.ExpiresAt = int(time.Now().Add(-time.Minute).Unix())
+	if !assert.NoError(t, pdoc.Update(testInstance)) {
+		return
+	}
+	_, err = doRequest("GET", ts.URL+"/permissions/self", frankCode, "")
+	if assert.Error(t, err) {
+		assert.Equal(t, "400: Expired token", err.Error())
+	}
+}
+
+func TestCreateSubPermissionWithTemplate(t *testing.T) {
+	cfg := config.GetConfig()
+	contexts := cfg.Contexts
+	defer func() { cfg.Contexts = contexts }()
+	cfg.Contexts = map[string]config.Context{
+		config.DefaultContext: {
+			PermissionTemplates: map[string]json.RawMessage{
+				"photo-album": json.RawMessage(`{
+					"files": {"type": "io.cozy.files", "verbs": ["GET"], "selector": "referenced_by"}
+				}`),
+			},
+		},
+	}
+
+	body := `{"data": {"type": "io.cozy.permissions", "attributes": {"permissions": {
+		"files": {"values": ["io.cozy.photos.albums/123"]}
+	}}}}`
+	_, err := doRequest("POST", ts.URL+"/permissions?codes=gina&template=unknown", token, body)
+	if assert.Error(t, err) {
+		assert.Equal(t, "400: Unknown permissions template", err.Error())
+	}
+	_, err = doRequest("POST", ts.URL+"/permissions?codes=gina&template=photo-album", token,
+		`{"data": {"type": "io.cozy.permissions", "attributes": {}}}`)
+	assert.Error(t, err)
+
+	out, err := doRequest("POST", ts.URL+"/permissions?codes=gina&template=photo-album", token, body)
+	if !assert.NoError(t, err) {
+		return
+	}
+	id := out["data"].(map[string]interface{})["id"].(string)
+	pdoc, err := permissions.GetByID(testInstance, id)
+	if !assert.NoError(t, err) || !assert.Len(t, pdoc.Permissions, 1) {
+		return
+	}
+	rule := pdoc.Permissions[0]
+	assert.Equal(t, "files", rule.Title)
+	assert.Equal(t, "io.cozy.files", rule.Type)
+	assert.Equal(t, "referenced_by", rule.Selector)
+	assert.Equal(t, []string{"io.cozy.photos.albums/123"}, rule.Values)
+	assert.True(t, rule.Verbs.Contains(permissions.GET))
+	assert.False(t, rule.Verbs.Contains(permissions.DELETE))
+}
+
+func TestPasswordProtectedShareCode(t *testing.T) {
+	out, err := doRequest("POST", ts.URL+"/permissions?codes=pat", token, `{
+"data": {
+	"type": "io.cozy.permissions",
+	"attributes": {
+		"password": "s3cret",
+		"permissions": {
+			"whatever": {"type": "io.cozy.files", "verbs": ["GET"], "values": ["io.cozy.music"]}
+		}
+	}
+}
+}`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	attrs := out["data"].(map[string]interface{})["attributes"].(map[string]interface{})
+	assert.NotContains(t, attrs, "password")
+	patCode := attrs["codes"].(map[string]interface{})["pat"].(string)
+
+	_, err = doRequest("GET", ts.URL+"/permissions/self", patCode, "")
+	if assert.Error(t, err) {
+		assert.Equal(t, "401: A password is required for this share code", err.Error())
+	}
+
+	res, err := http.PostForm(ts.URL+"/permissions/unlock", url.Values{
+		"code":     {patCode},
+		"password": {"wrong"},
+	})
+	if assert.NoError(t, err) {
+		res.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	}
+
+	res, err = http.PostForm(ts.URL+"/permissions/unlock", url.Values{
+		"code":     {patCode},
+		"password": {"s3cret"},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	var unlocked struct {
+		Token string `json:"token"`
+	}
+	if !assert.NoError(t, json.NewDecoder(res.Body).Decode(&unlocked)) {
+		return
+	}
+	out, err = doRequest("GET", ts.URL+"/permissions/self", unlocked.Token, "")
+	if assert.NoError(t, err) {
+		assert.Contains(t, out, "whatever")
+	}
+}
+
+func TestLockedShareSet(t *testing.T) {
+	max := permissions.MaxPasswordFailures
+	lock := permissions.ShareSetLockDuration
+	permissions.MaxPasswordFailures = 2
+	failures = newFailuresLimiter()
+	defer func() {
+		permissions.MaxPasswordFailures = max
+		permissions.ShareSetLockDuration = lock
+		failures = newFailuresLimiter()
+	}()
+
+	out, err := doRequest("POST", ts.URL+"/permissions?codes=mallory", token, `{
+"data": {
+	"type": "io.cozy.permissions",
+	"attributes": {
+		"password": "s3cret",
+		"permissions": {
+			"whatever": {"type": "io.cozy.files", "verbs": ["GET"], "values": ["io.cozy.music"]}
+		}
+	}
+}
+}`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	id := out["data"].(map[string]interface{})["id"].(string)
+	attrs := out["data"].(map[string]interface{})["attributes"].(map[string]interface{})
+	code := attrs["codes"].(map[string]interface{})["mallory"].(string)
+
+	unlock := func(password string) int {
+		// the failures of the IP are not tested here
+		failures = newFailuresLimiter()
+		res, err := http.PostForm(ts.URL+"/permissions/unlock", url.Values{
+			"code":     {code},
+			"password": {password},
+		})
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	assert.Equal(t, http.StatusUnauthorized, unlock("wrong"))
+	assert.Equal(t, http.StatusUnauthorized, unlock("wrong"))
+	assert.Equal(t, http.StatusForbidden, unlock("s3cret"))
+
+	// The lock expires, and the right password resets the failures
+	permissions.ShareSetLockDuration = 0
+	assert.Equal(t, http.StatusOK, unlock("s3cret"))
+	permissions.ShareSetLockDuration = lock
+	assert.Equal(t, http.StatusUnauthorized, unlock("wrong"))
+	assert.Equal(t, http.StatusUnauthorized, unlock("wrong"))
+	assert.Equal(t, http.StatusForbidden, unlock("s3cret"))
+
+	// The owner removes the lock by refreshing the code
+	out, err = doRequest("POST", ts.URL+"/permissions/"+id+"/codes/mallory/refresh", token, "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	attrs = out["data"].(map[string]interface{})["attributes"].(map[string]interface{})
+	code = attrs["codes"].(map[string]interface{})["mallory"].(string)
+	assert.Equal(t, http.StatusOK, unlock("s3cret"))
+}
+
+func TestExchangeShareCode(t *testing.T) {
+	out, err := doRequest("POST", ts.URL+"/permissions?codes=xavier&ttl=1h", token, `{
+"data": {
+	"type": "io.cozy.permissions",
+	"attributes": {
+		"permissions": {
+			"whatever": {"type": "io.cozy.files", "verbs": ["GET"], "values": ["io.cozy.music"]}
+		}
+	}
+}
+}`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	attrs := out["data"].(map[string]interface{})["attributes"].(map[string]interface{})
+	code := attrs["codes"].(map[string]interface{})["xavier"].(string)
+
+	res, err := http.PostForm(ts.URL+"/permissions/exchange", url.Values{
+		"code": {"not-a-code"},
+	})
+	if assert.NoError(t, err) {
+		res.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	}
+
+	res, err = http.PostForm(ts.URL+"/permissions/exchange", url.Values{
+		"code": {code},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	var exchanged struct {
+		Token       string          `json:"token"`
+		ExpiresAt   time.Time       `json:"expires_at"`
+		Permissions permissions.Set `json:"permissions"`
+	}
+	if !assert.NoError(t, json.NewDecoder(res.Body).Decode(&exchanged)) {
+		return
+	}
+	assert.NotEqual(t, code, exchanged.Token)
+	assert.True(t, exchanged.ExpiresAt.Before(time.Now().Add(time.Hour+time.Minute)))
+	if assert.Len(t, exchanged.Permissions, 1) {
+		assert.Equal(t, "io.cozy.files", exchanged.Permissions[0].Type)
+	}
+	out, err = doRequest("GET", ts.URL+"/permissions/self", exchanged.Token, "")
+	if assert.NoError(t, err) {
+		assert.Contains(t, out, "whatever")
+	}
+}
+
+func TestParseTTL(t *testing.T) {
+	ttl, err := parseTTL("")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), ttl)
+	ttl, err = parseTTL("72h")
+	assert.NoError(t, err)
+	assert.Equal(t, 72*time.Hour, ttl)
+	ttl, err = parseTTL("2d")
+	assert.NoError(t, err)
+	assert.Equal(t, 48*time.Hour, ttl)
+	_, err = parseTTL("-1h")
+	assert.Equal(t, ErrInvalidTTL, err)
+	_, err = parseTTL("xd")
+	assert.Equal(t, ErrInvalidTTL, err)
+}
+
 func TestCreateSubSubFail(t *testing.T) {
 	_, codes, err := createTestSubPermissions(token, "eve")
 	if !assert.NoError(t, err) {
@@ -332,6 +580,158 @@ func TestPatchChangesCodes(t *testing.T) {
 
 }
 
+func TestRefreshCode(t *testing.T) {
+	id, codes, err := createTestSubPermissions(token, "mary,nick")
+	if !assert.NoError(t, err) {
+		return
+	}
+	maryCode := codes["mary"].(string)
+	nickCode := codes["nick"].(string)
+
+	_, err = doRequest("POST", ts.URL+"/permissions/"+id+"/codes/mary/refresh", nickCode, "")
+	assert.Error(t, err)
+	_, err = doRequest("POST", ts.URL+"/permissions/"+id+"/codes/olivia/refresh", token, "")
+	if assert.Error(t, err) {
+		assert.Equal(t, "404: no code with this name", err.Error())
+	}
+
+	out, err := doRequest("POST", ts.URL+"/permissions/"+id+"/codes/mary/refresh", token, "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	attrs := out["data"].(map[string]interface{})["attributes"].(map[string]interface{})
+	newcodes := attrs["codes"].(map[string]interface{})
+	assert.Len(t, newcodes, 2)
+	assert.Equal(t, nickCode, newcodes["nick"])
+	newMaryCode := newcodes["mary"].(string)
+	assert.NotEqual(t, maryCode, newMaryCode)
+
+	_, err = doRequest("GET", ts.URL+"/permissions/self", maryCode, "")
+	assert.Error(t, err)
+	_, err = doRequest("GET", ts.URL+"/permissions/self", newMaryCode, "")
+	assert.NoError(t, err)
+	_, err = doRequest("GET", ts.URL+"/permissions/self", nickCode, "")
+	assert.NoError(t, err)
+}
+
+func TestShowPermission(t *testing.T) {
+	id, codes, err := createTestSubPermissions(token, "kate,luke")
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, otherCodes, err := createTestSubPermissions(token, "mike")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	out, err := doRequest("GET", ts.URL+"/permissions/"+id, token, "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	data := out["data"].(map[string]interface{})
+	assert.Equal(t, id, data["id"])
+	attrs := data["attributes"].(map[string]interface{})
+	assert.Len(t, attrs["codes"], 2)
+	assert.NotNil(t, attrs["permissions"])
+
+	out, err = doRequest("GET", ts.URL+"/permissions/"+id, codes["kate"].(string), "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	attrs = out["data"].(map[string]interface{})["attributes"].(map[string]interface{})
+	assert.Nil(t, attrs["codes"])
+	assert.NotNil(t, attrs["permissions"])
+
+	_, err = doRequest("GET", ts.URL+"/permissions/"+id, otherCodes["mike"].(string), "")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "403")
+	}
+}
+
+func TestListPermissionsByDoctype(t *testing.T) {
+	created := make(map[string]bool)
+	for _, name := range []string{"nina", "oscar", "paul"} {
+		id, _, err := createTestSubPermissions(token, name)
+		if !assert.NoError(t, err) {
+			return
+		}
+		created[id] = true
+	}
+
+	seen := make(map[string]bool)
+	next := "/permissions/doctype/io.cozy.files?page[limit]=2"
+	for next != "" {
+		out, err := doRequest("GET", ts.URL+next, token, "")
+		if !assert.NoError(t, err) {
+			return
+		}
+		data := out["data"].([]interface{})
+		assert.True(t, len(data) <= 2)
+		for _, d := range data {
+			doc := d.(map[string]interface{})
+			id := doc["id"].(string)
+			assert.False(t, seen[id], "%s is listed twice", id)
+			seen[id] = true
+			attrs := doc["attributes"].(map[string]interface{})
+			assert.NotNil(t, attrs["codes"])
+		}
+		next = ""
+		if links, ok := out["links"].(map[string]interface{}); ok {
+			next, _ = links["next"].(string)
+		}
+	}
+	for id := range created {
+		assert.True(t, seen[id], "%s is not listed", id)
+	}
+
+	_, err := doRequest("GET", ts.URL+"/permissions/doctype/io.cozy.events", token, "")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "403")
+	}
+	_, err = doRequest("GET", ts.URL+"/permissions/doctype/io.cozy.files?page[limit]=-1", token, "")
+	assert.Error(t, err)
+}
+
+func TestListPermissionsBySubject(t *testing.T) {
+	id, _, err := createTestSubPermissions(token, "quinn")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	_, err = doRequest("GET", ts.URL+"/permissions?subject="+clientID, token, "")
+	assert.Error(t, err)
+
+	settingsToken, err := testInstance.MakeJWT(permissions.AccessTokenAudience,
+		clientID, "io.cozy.permissions:GET", time.Now())
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = doRequest("GET", ts.URL+"/permissions", settingsToken, "")
+	assert.Error(t, err)
+
+	out, err := doRequest("GET", ts.URL+"/permissions?subject="+clientID, settingsToken, "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	data := out["data"].([]interface{})
+	found := false
+	for _, item := range data {
+		doc := item.(map[string]interface{})
+		attrs := doc["attributes"].(map[string]interface{})
+		assert.Equal(t, "io.cozy.oauth.clients/"+clientID, attrs["source_id"])
+		assert.NotContains(t, attrs, "codes")
+		if doc["id"] == id {
+			found = true
+		}
+	}
+	assert.True(t, found)
+
+	out, err = doRequest("GET", ts.URL+"/permissions?subject=no-such-app", settingsToken, "")
+	if assert.NoError(t, err) {
+		assert.Len(t, out["data"], 0)
+	}
+}
+
 func TestRevoke(t *testing.T) {
 	id, codes, err := createTestSubPermissions(token, "igor")
 	if !assert.NoError(t, err) {
@@ -350,8 +750,96 @@ func TestRevoke(t *testing.T) {
 
 }
 
+func TestPermissionsEvents(t *testing.T) {
+	hooks := make(chan permissions.ChangeEvent, 2)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev permissions.ChangeEvent
+		if err := json.NewDecoder(r.Body).Decode(&ev); err == nil {
+			hooks <- ev
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer hook.Close()
+	cfg := config.GetConfig()
+	cfg.PermissionsWebhooks = []string{hook.URL}
+	defer func() { cfg.PermissionsWebhooks = nil }()
+
+	sub := realtime.InstanceHub(testInstance.Domain).Subscribe(consts.Permissions)
+	defer sub.Close()
+
+	id, _, err := createTestSubPermissions(token, "olga")
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = doRequest("DELETE", ts.URL+"/permissions/"+id, token, "")
+	assert.NoError(t, err)
+
+	for _, expected := range []string{realtime.EventCreate, realtime.EventDelete} {
+		select {
+		case e := <-sub.Read():
+			assert.Equal(t, expected, e.Type)
+			assert.Equal(t, id, e.DocID)
+			ev := e.Doc.(*permissions.ChangeEvent)
+			assert.Equal(t, []string{"io.cozy.files"}, ev.Doctypes)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("No realtime event for %s", expected)
+		}
+	}
+
+	events := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case ev := <-hooks:
+			assert.Equal(t, id, ev.PermissionID)
+			assert.Equal(t, permissions.TypeSharing, ev.Type)
+			events[ev.Event] = true
+		case <-time.After(5 * time.Second):
+			t.Fatal("The webhook was not called")
+		}
+	}
+	assert.True(t, events[realtime.EventCreate])
+	assert.True(t, events[realtime.EventDelete])
+}
+
+func TestDescribePermissions(t *testing.T) {
+	out, err := doRequest("GET", ts.URL+"/permissions/describe?scope=io.cozy.contacts:GET+io.cozy.files", "", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	sentences := out["sentences"].([]interface{})
+	if assert.Len(t, sentences, 2) {
+		first := sentences[0].(map[string]interface{})
+		assert.Equal(t, "io.cozy.contacts", first["type"])
+		assert.NotEmpty(t, first["sentence"])
+	}
+
+	out, err = doRequest("POST", ts.URL+"/permissions/describe", "", `{
+"data": {
+	"type": "io.cozy.permissions",
+	"attributes": {
+		"permissions": {
+			"photos": {"type": "io.cozy.files", "verbs": ["POST"], "selector": "path", "values": ["/Photos"]}
+		}
+	}
+}
+}`)
+	if assert.NoError(t, err) {
+		sentences = out["sentences"].([]interface{})
+		if assert.Len(t, sentences, 1) {
+			assert.Equal(t, "photos", sentences[0].(map[string]interface{})["title"])
+		}
+	}
+
+	_, err = doRequest("GET", ts.URL+"/permissions/describe", "", "")
+	assert.Error(t, err)
+}
+
 func createTestSubPermissions(tok string, codes string) (string, map[string]interface{}, error) {
-	out, err := doRequest("POST", ts.URL+"/permissions?codes="+codes, tok, `{
+	return createTestSubPermissionsWithTTL(tok, codes, "")
+}
+
+func createTestSubPermissionsWithTTL(tok string, codes, ttl string) (string, map[string]interface{}, error) {
+	out, err := doRequest("POST", ts.URL+"/permissions?codes="+codes+"&ttl="+ttl, tok, `{
 "data": {
 	"type": "io.cozy.permissions",
 	"attributes": {
@@ -391,6 +879,9 @@ func doRequest(method, url, tok, body string) (map[string]interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
+	if res.StatusCode >= 400 {
+		return nil, fmt.Errorf("%d: %s", res.StatusCode, resbody)
+	}
 	if len(resbody) == 0 {
 		return nil, nil
 	}
@@ -400,10 +891,6 @@ func doRequest(method, url, tok, body string) (map[string]interface{}, error) {
 		return nil, err
 	}
 
-	if errstr := out["message"]; errstr != nil {
-		return nil, fmt.Errorf("%s", errstr)
-	}
-
 	return out, nil
 }
 
@@ -436,8 +923,8 @@ func TestListPermission(t *testing.T) {
 		}}
 
 	codes := map[string]string{"bob": "secret"}
-	permissions.CreateShareSet(testInstance, parent, codes, p1)
-	permissions.CreateShareSet(testInstance, parent, codes, p2)
+	permissions.CreateShareSet(testInstance, parent, codes, p1, 0, nil)
+	permissions.CreateShareSet(testInstance, parent, codes, p2, 0, nil)
 
 	reqbody := strings.NewReader(`{
 "data": [
@@ -484,13 +971,22 @@ func TestListPermission(t *testing.T) {
 
 }
 
-func injectInstance(i *instance.Instance) echo.MiddlewareFunc {
-	return func(next echo.HandlerFunc) echo.HandlerFunc {
-		return func(c echo.Context) error {
-			c.Set("instance", i)
-			return next(c)
-		}
+func TestGetPermissionsForTooManyIDs(t *testing.T) {
+	refs := make([]string, permissions.MaxIDsForPermissions+1)
+	for i := range refs {
+		refs[i] = `{ "type": "io.cozy.events", "id": "event-` + strconv.Itoa(i) + `" }`
+	}
+	reqbody := strings.NewReader(`{ "data": [` + strings.Join(refs, ",") + `] }`)
+
+	req, _ := http.NewRequest("POST", ts.URL+"/permissions/exists", reqbody)
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Header.Add("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
 	}
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode)
 }
 
 func createTestEvent(i *instance.Instance) (*couchdb.JSONDoc, error) {
@@ -0,0 +1,207 @@
+package permissions
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/labstack/echo"
+)
+
+// Rule is the permission required to use a route. It is declared with the
+// route, and enforced by the Require middleware, so that a handler can't
+// forget to check it.
+type Rule struct {
+	// Name is a short description of the rule, used by the audit of the
+	// routes
+	Name string
+	// check returns an error if the request is not allowed. It is nil for the
+	// rules checked by the handler.
+	check func(c echo.Context) error
+}
+
+// Public is the rule for the routes that can be used without permission
+var Public = Rule{Name: "public"}
+
+// Owner is the rule for the routes that can only be used by the owner of the
+// instance, with a session or from the command-line.
+var Owner = Rule{
+	Name: "owner",
+	check: func(c echo.Context) error {
+		if middlewares.IsLoggedIn(c) {
+			return nil
+		}
+		pdoc, err := getPermission(c)
+		if err != nil {
+			return err
+		}
+		if pdoc.Type != permissions.TypeCLI {
+			return echo.NewHTTPError(http.StatusForbidden)
+		}
+		return nil
+	},
+}
+
+// ResolveIntent is the rule for the routes used to find the applications that
+// can handle an intent.
+var ResolveIntent = Rule{Name: "resolve intent", check: AllowResolveIntent}
+
+// WholeType is the rule for the routes that require the verb on the whole
+// doctype.
+func WholeType(v permissions.Verb, doctype string) Rule {
+	return Rule{
+		Name: string(v) + " " + doctype,
+		check: func(c echo.Context) error {
+			return AllowWholeType(c, v, doctype)
+		},
+	}
+}
+
+// Document is the rule for the routes that require the verb on a document of
+// the doctype. The document is known only by the handler, so it is the
+// handler that must check the permission, with Allow.
+func Document(v permissions.Verb, doctype string) Rule {
+	return Rule{Name: string(v) + " " + doctype + " (document, checked by the handler)"}
+}
+
+// InstallApp is the rule for the routes that install, update or uninstall
+// applications. See AllowInstallApp.
+func InstallApp(v permissions.Verb) Rule {
+	return Rule{
+		Name: string(v) + " " + consts.Apps + " (store or CLI)",
+		check: func(c echo.Context) error {
+			return AllowInstallApp(c, v)
+		},
+	}
+}
+
+// Require returns a middleware that enforces the rule before calling the
+// handler.
+func Require(rule Rule) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		if rule.check == nil {
+			return next
+		}
+		return func(c echo.Context) error {
+			if err := rule.check(c); err != nil {
+				return err
+			}
+			return next(c)
+		}
+	}
+}
+
+var (
+	rulesMu sync.Mutex
+	rules   = make(map[string]Rule)
+)
+
+// Router registers the routes of a group with the rule required to use them.
+type Router struct {
+	group  *echo.Group
+	prefix string
+}
+
+// Group creates a group of routes on the given prefix, whose routes are
+// registered with their rules.
+func Group(e *echo.Echo, prefix string, m ...echo.MiddlewareFunc) *Router {
+	return &Router{group: e.Group(prefix, m...), prefix: prefix}
+}
+
+// Add registers a route with the rule required to use it
+func (r *Router) Add(method, path string, h echo.HandlerFunc, rule Rule) {
+	rulesMu.Lock()
+	rules[ruleKey(method, r.prefix+path)] = rule
+	rulesMu.Unlock()
+	r.group.Match([]string{method}, path, h, Require(rule))
+}
+
+// GET registers a route for the GET method
+func (r *Router) GET(path string, h echo.HandlerFunc, rule Rule) {
+	r.Add(echo.GET, path, h, rule)
+}
+
+// HEAD registers a route for the HEAD method
+func (r *Router) HEAD(path string, h echo.HandlerFunc, rule Rule) {
+	r.Add(echo.HEAD, path, h, rule)
+}
+
+// POST registers a route for the POST method
+func (r *Router) POST(path string, h echo.HandlerFunc, rule Rule) {
+	r.Add(echo.POST, path, h, rule)
+}
+
+// PUT registers a route for the PUT method
+func (r *Router) PUT(path string, h echo.HandlerFunc, rule Rule) {
+	r.Add(echo.PUT, path, h, rule)
+}
+
+// PATCH registers a route for the PATCH method
+func (r *Router) PATCH(path string, h echo.HandlerFunc, rule Rule) {
+	r.Add(echo.PATCH, path, h, rule)
+}
+
+// DELETE registers a route for the DELETE method
+func (r *Router) DELETE(path string, h echo.HandlerFunc, rule Rule) {
+	r.Add(echo.DELETE, path, h, rule)
+}
+
+// RouteRule is a route with the rule declared for it. Rule is nil for the
+// routes registered without a Router, whose permissions, if any, are checked
+// by their handlers.
+type RouteRule struct {
+	Method string
+	Path   string
+	Rule   *Rule
+}
+
+// Audit returns the routes with their declared rules, sorted by path.
+func Audit(routes []*echo.Route) []RouteRule {
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+	list := make([]RouteRule, 0, len(routes))
+	seen := make(map[string]bool, len(routes))
+	for _, route := range routes {
+		k := ruleKey(route.Method, route.Path)
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		rr := RouteRule{Method: route.Method, Path: route.Path}
+		if rule, ok := rules[k]; ok {
+			rr.Rule = &rule
+		}
+		list = append(list, rr)
+	}
+	sort.Sort(byPathAndMethod(list))
+	return list
+}
+
+// Unprotected returns the routes registered without a declared rule
+func Unprotected(routes []*echo.Route) []RouteRule {
+	var list []RouteRule
+	for _, rr := range Audit(routes) {
+		if rr.Rule == nil {
+			list = append(list, rr)
+		}
+	}
+	return list
+}
+
+func ruleKey(method, path string) string {
+	return method + " " + path
+}
+
+type byPathAndMethod []RouteRule
+
+func (r byPathAndMethod) Len() int      { return len(r) }
+func (r byPathAndMethod) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r byPathAndMethod) Less(i, j int) bool {
+	if r[i].Path != r[j].Path {
+		return r[i].Path < r[j].Path
+	}
+	return r[i].Method < r[j].Method
+}
@@ -0,0 +1,63 @@
+package permissions
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/testutils"
+	"github.com/cozy/cozy-stack/web/errors"
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouteRules(t *testing.T) {
+	e := echo.New()
+	e.HTTPErrorHandler = errors.ErrorHandler
+	ok := func(c echo.Context) error { return c.NoContent(http.StatusOK) }
+	router := Group(e, "/rules", testutils.InjectInstance(testInstance))
+	router.GET("/public", ok, Public)
+	router.GET("/owner", ok, Owner)
+	router.GET("/contacts", ok, WholeType(permissions.GET, consts.Contacts))
+	router.POST("/files", ok, WholeType(permissions.POST, consts.Files))
+	e.GET("/unprotected", ok)
+
+	ts := httptest.NewServer(e)
+	defer ts.Close()
+
+	status := func(method, path, tok string) int {
+		req, _ := http.NewRequest(method, ts.URL+path, nil)
+		if tok != "" {
+			req.Header.Add("Authorization", "Bearer "+tok)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	assert.Equal(t, http.StatusOK, status("GET", "/rules/public", ""))
+	assert.Equal(t, http.StatusUnauthorized, status("GET", "/rules/contacts", ""))
+	assert.Equal(t, http.StatusOK, status("GET", "/rules/contacts", token))
+	assert.Equal(t, http.StatusForbidden, status("POST", "/rules/files", token))
+	assert.Equal(t, http.StatusForbidden, status("GET", "/rules/owner", token))
+
+	var audited []RouteRule
+	for _, rr := range Audit(e.Routes()) {
+		if rr.Method == "GET" && rr.Path == "/rules/contacts" {
+			audited = append(audited, rr)
+		}
+	}
+	if assert.Len(t, audited, 1) && assert.NotNil(t, audited[0].Rule) {
+		assert.Equal(t, "GET io.cozy.contacts", audited[0].Rule.Name)
+	}
+
+	unprotected := Unprotected(e.Routes())
+	assert.Contains(t, unprotected, RouteRule{Method: "GET", Path: "/unprotected"})
+	for _, rr := range unprotected {
+		assert.NotEqual(t, "/rules/public", rr.Path)
+	}
+}
@@ -9,40 +9,39 @@ import (
 	"io/ioutil"
 	"net/http"
 	"path"
-	"time"
 
 	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/i18n"
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/web/apps"
 	"github.com/cozy/cozy-stack/web/auth"
 	"github.com/cozy/cozy-stack/web/data"
 	"github.com/cozy/cozy-stack/web/errors"
+	"github.com/cozy/cozy-stack/web/feeds"
 	"github.com/cozy/cozy-stack/web/files"
 	"github.com/cozy/cozy-stack/web/instances"
 	"github.com/cozy/cozy-stack/web/jobs"
 	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/openapi"
 	"github.com/cozy/cozy-stack/web/permissions"
 	"github.com/cozy/cozy-stack/web/settings"
 	"github.com/cozy/cozy-stack/web/sharings"
 	_ "github.com/cozy/cozy-stack/web/statik" // Generated file with the packed assets
 	"github.com/cozy/cozy-stack/web/status"
+	"github.com/cozy/cozy-stack/web/timeline"
 	"github.com/cozy/cozy-stack/web/version"
 	"github.com/labstack/echo"
 	"github.com/labstack/echo/middleware"
 	"github.com/rakyll/statik/fs"
 )
 
-var (
-	hstsMaxAge = 365 * 24 * time.Hour // 1 year
-
-	templatesList = []string{
-		"authorize.html",
-		"error.html",
-		"login.html",
-		"passphrase_reset.html",
-		"passphrase_renew.html",
-	}
-)
+var templatesList = []string{
+	"authorize.html",
+	"error.html",
+	"login.html",
+	"passphrase_reset.html",
+	"passphrase_renew.html",
+}
 
 type renderer struct {
 	t *template.Template
@@ -55,7 +54,17 @@ func (r *renderer) Render(w io.Writer, name string, data interface{}, c echo.Con
 	if err != nil {
 		return err
 	}
-	return t.Funcs(template.FuncMap{"t": i.Translate}).ExecuteTemplate(w, name, data)
+	funcs := template.FuncMap(i18n.Get(i.Locale).TemplateFuncs())
+	funcs["t"] = i.Translate
+	return t.Funcs(funcs).ExecuteTemplate(w, name, data)
+}
+
+// stubFuncs returns the functions used to parse the templates. They are
+// replaced by the ones for the locale of the instance when rendering.
+func stubFuncs() template.FuncMap {
+	funcs := template.FuncMap(i18n.Get(i18n.DefaultLocale).TemplateFuncs())
+	funcs["t"] = fmt.Sprintf
+	return funcs
 }
 
 func newRenderer(assetsPath string) (*renderer, error) {
@@ -66,7 +75,7 @@ func newRenderer(assetsPath string) (*renderer, error) {
 			list[i] = path.Join(assetsPath, "templates", name)
 		}
 		var err error
-		t := template.New("stub").Funcs(template.FuncMap{"t": fmt.Sprintf})
+		t := template.New("stub").Funcs(stubFuncs())
 		if t, err = t.ParseFiles(list...); err != nil {
 			return nil, fmt.Errorf("Can't load the assets from %s", assetsPath)
 		}
@@ -88,7 +97,7 @@ func newRenderer(assetsPath string) (*renderer, error) {
 		} else {
 			tmpl = t.New(name)
 		}
-		tmpl = tmpl.Funcs(template.FuncMap{"t": fmt.Sprintf})
+		tmpl = tmpl.Funcs(stubFuncs())
 		f, err := statikFS.Open("/templates/" + name)
 		if err != nil {
 			return nil, fmt.Errorf("Can't load asset %s", name)
@@ -107,11 +116,27 @@ func newRenderer(assetsPath string) (*renderer, error) {
 	return r, nil
 }
 
+// secureMiddleware returns the middleware for the security headers of a class
+// of routes. The CSP is given by conf, and the other headers come from the
+// security section of the configuration file.
+func secureMiddleware(context string, conf *middlewares.SecureConfig) echo.MiddlewareFunc {
+	sec := config.GetConfig().Security
+	conf.HSTSMaxAge = sec.HSTSMaxAge
+	conf.HSTSPreload = sec.HSTSPreload
+	conf.ReferrerPolicy = sec.ReferrerPolicy
+	conf.CSPReportOnly = sec.CSPReportOnly
+	conf.CSPReportURI = sec.CSPReportURI
+	if opts := sec.Contexts[context]; opts.FrameOptions != "" {
+		conf.XFrameOptions = middlewares.XFrameOption(opts.FrameOptions)
+		conf.XFrameAllowed = opts.FrameAllowed
+	}
+	return middlewares.Secure(conf)
+}
+
 // SetupAppsHandler adds all the necessary middlewares for the application
 // handler.
 func SetupAppsHandler(appsHandler echo.HandlerFunc) echo.HandlerFunc {
-	secure := middlewares.Secure(&middlewares.SecureConfig{
-		HSTSMaxAge:    hstsMaxAge,
+	secure := secureMiddleware(config.SecurityApps, &middlewares.SecureConfig{
 		CSPDefaultSrc: []middlewares.CSPSource{middlewares.CSPSrcSelf, middlewares.CSPSrcParent},
 		CSPFontSrc:    []middlewares.CSPSource{middlewares.CSPSrcSelf, middlewares.CSPSrcData, middlewares.CSPSrcParent},
 		CSPImgSrc:     []middlewares.CSPSource{middlewares.CSPSrcSelf, middlewares.CSPSrcData, middlewares.CSPSrcBlob, middlewares.CSPSrcParent},
@@ -139,8 +164,7 @@ func SetupAssets(router *echo.Echo, assetsPath string) error {
 
 // SetupRoutes sets the routing for HTTP endpoints
 func SetupRoutes(router *echo.Echo) error {
-	secure := middlewares.Secure(&middlewares.SecureConfig{
-		HSTSMaxAge:    hstsMaxAge,
+	secure := secureMiddleware(config.SecurityAPI, &middlewares.SecureConfig{
 		CSPDefaultSrc: []middlewares.CSPSource{middlewares.CSPSrcSelf},
 		// Display logos of OAuth clients on the authorize page
 		CSPImgSrc:     []middlewares.CSPSource{middlewares.CSPSrcAny},
@@ -155,15 +179,18 @@ func SetupRoutes(router *echo.Echo) error {
 	}
 	router.GET("/", auth.Home, mws...)
 	auth.Routes(router.Group("/auth", mws...))
-	apps.Routes(router.Group("/apps", mws...))
+	apps.Routes(permissions.Group(router, "/apps", mws...))
 	data.Routes(router.Group("/data", mws...))
+	feeds.Routes(router.Group("/feeds", mws...))
 	files.Routes(router.Group("/files", mws...))
 	jobs.Routes(router.Group("/jobs", mws...))
 	permissions.Routes(router.Group("/permissions", mws...))
 	settings.Routes(router.Group("/settings", mws...))
 	sharings.Routes(router.Group("/sharings", mws...))
-	status.Routes(router.Group("/status"))
-	version.Routes(router.Group("/version"))
+	timeline.Routes(router.Group("/timeline", mws...))
+	status.Routes(permissions.Group(router, "/status", middlewares.LoadInstance))
+	version.Routes(permissions.Group(router, "/version"))
+	router.GET("/openapi.json", APISpec().Handler(router))
 
 	setupRecover(router)
 
@@ -171,6 +198,16 @@ func SetupRoutes(router *echo.Echo) error {
 	return nil
 }
 
+// APISpec returns the declarations of the endpoints of the HTTP API, used to
+// build the OpenAPI document of the routes set by SetupRoutes.
+func APISpec() *openapi.Spec {
+	spec := openapi.New()
+	spec.Add("/apps", apps.Endpoints)
+	spec.Add("/status", status.Endpoints)
+	spec.Add("/version", version.Endpoints)
+	return spec
+}
+
 // SetupAdminRoutes sets the routing for the administration HTTP endpoints
 func SetupAdminRoutes(router *echo.Echo) error {
 	if !config.IsDevRelease() {
@@ -1,14 +1,18 @@
 package web
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/openapi"
+	"github.com/cozy/cozy-stack/web/permissions"
 	"github.com/labstack/echo"
 	"github.com/stretchr/testify/assert"
 )
@@ -65,6 +69,54 @@ func TestSetupRoutes(t *testing.T) {
 	assert.Equal(t, 200, res.StatusCode)
 }
 
+func TestOpenAPI(t *testing.T) {
+	e := echo.New()
+	err := SetupRoutes(e)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// The declared endpoints must match the routes really served
+	assert.Empty(t, APISpec().Undeclared(e.Routes()))
+
+	ts := httptest.NewServer(e)
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/openapi.json")
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, 200, res.StatusCode)
+	var doc openapi.Document
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&doc))
+	assert.Equal(t, openapi.Version, doc.OpenAPI)
+	for _, r := range e.Routes() {
+		if r.Method == "GET" {
+			path, _ := openapi.ConvertPath(r.Path)
+			assert.Contains(t, doc.Paths, path)
+		}
+	}
+	if assert.Contains(t, doc.Paths, "/apps/{slug}") {
+		op := doc.Paths["/apps/{slug}"]["post"]
+		assert.Equal(t, "Install an application", op.Summary)
+		assert.Contains(t, op.Responses, "202")
+	}
+}
+
+func TestRoutesPermissions(t *testing.T) {
+	e := echo.New()
+	err := SetupRoutes(e)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// The routes of the apps must all declare their permissions
+	for _, r := range permissions.Unprotected(e.Routes()) {
+		if strings.HasPrefix(r.Path, "/apps/") && !strings.HasSuffix(r.Path, "*") {
+			t.Errorf("%s %s has no declared permission", r.Method, r.Path)
+		}
+	}
+}
+
 func TestParseHost(t *testing.T) {
 	apis := echo.New()
 
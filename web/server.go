@@ -10,9 +10,12 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"strings"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/cozy/cozy-stack/pkg/apps"
 	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/devcerts"
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/permissions"
 	"github.com/cozy/cozy-stack/pkg/utils"
@@ -154,6 +157,9 @@ func listenAndServe(noAdmin bool, appsHandler echo.HandlerFunc) error {
 	if err = LoadSupportedLocales(); err != nil {
 		return err
 	}
+	// The .po files from the translations service override the embedded ones
+	instance.LoadCachedLocales(supportedLocales)
+	instance.StartLocalesDownload(supportedLocales)
 
 	if config.IsDevRelease() {
 		fmt.Println(`                           !! DEVELOPMENT RELEASE !!
@@ -175,6 +181,21 @@ security features. Please do not use this binary as your production server.
 		go func() { errs <- admin.Start(config.AdminServerAddr()) }()
 	}
 
-	go func() { errs <- main.Start(config.ServerAddr()) }()
+	if conf := config.GetConfig().DevCerts; conf.Enabled {
+		certs, err := devcerts.New(conf.Dir, conf.Domains)
+		if err != nil {
+			return err
+		}
+		log.Infof("Serving HTTPS with certificates for %s, signed by the local CA %s",
+			strings.Join(conf.Domains, ", "), certs.CAFile())
+		srv := &http.Server{
+			Addr:      config.ServerAddr(),
+			Handler:   main,
+			TLSConfig: certs.TLSConfig(),
+		}
+		go func() { errs <- srv.ListenAndServeTLS("", "") }()
+	} else {
+		go func() { errs <- main.Start(config.ServerAddr()) }()
+	}
 	return <-errs
 }
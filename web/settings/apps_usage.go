@@ -0,0 +1,62 @@
+package settings
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/cozy/cozy-stack/pkg/apps"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/labstack/echo"
+)
+
+const (
+	defaultUsageDays = 30
+	maxUsageDays     = 90
+)
+
+type apiAppUsage struct {
+	*apps.AppUsage
+}
+
+func (u *apiAppUsage) ID() string                             { return u.Slug }
+func (u *apiAppUsage) Rev() string                            { return "" }
+func (u *apiAppUsage) DocType() string                        { return consts.AppsUsage }
+func (u *apiAppUsage) SetID(_ string)                         {}
+func (u *apiAppUsage) SetRev(_ string)                        {}
+func (u *apiAppUsage) Relationships() jsonapi.RelationshipMap { return nil }
+func (u *apiAppUsage) Included() []jsonapi.Object             { return nil }
+func (u *apiAppUsage) Links() *jsonapi.LinksList              { return nil }
+
+func appsUsage(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+
+	// The usage is only shown to the user, in the settings app, or to an
+	// application with a permission on the whole doctype
+	if err := permissions.AllowWholeType(c, permissions.GET, consts.AppsUsage); err != nil {
+		if !middlewares.IsLoggedIn(c) {
+			return err
+		}
+	}
+
+	days := defaultUsageDays
+	if param := c.QueryParam("days"); param != "" {
+		d, err := strconv.Atoi(param)
+		if err != nil || d <= 0 || d > maxUsageDays {
+			return jsonapi.NewError(http.StatusBadRequest, "Invalid days value")
+		}
+		days = d
+	}
+
+	usages, err := apps.GetUsages(instance, days)
+	if err != nil {
+		return err
+	}
+	objs := make([]jsonapi.Object, len(usages))
+	for i, u := range usages {
+		objs[i] = &apiAppUsage{u}
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, nil)
+}
@@ -3,6 +3,8 @@ package settings
 import (
 	"errors"
 	"net/http"
+	"net/url"
+	"strconv"
 
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/oauth"
@@ -19,7 +21,17 @@ func listClients(c echo.Context) error {
 		return err
 	}
 
-	clients, err := oauth.GetAll(instance)
+	limit := oauth.DefaultListLimit
+	if param := c.QueryParam("page[limit]"); param != "" {
+		l, err := strconv.Atoi(param)
+		if err != nil || l <= 0 || l > oauth.MaxListLimit {
+			return jsonapi.InvalidParameter("page[limit]", errors.New("Invalid limit value"))
+		}
+		limit = l
+	}
+	cursor := c.QueryParam("page[cursor]")
+
+	clients, next, err := oauth.GetAllPage(instance, cursor, limit)
 	if err != nil {
 		return err
 	}
@@ -28,7 +40,15 @@ func listClients(c echo.Context) error {
 	for i, d := range clients {
 		objs[i] = jsonapi.Object(d)
 	}
-	return jsonapi.DataList(c, http.StatusOK, objs, nil)
+
+	var links *jsonapi.LinksList
+	if next != "" {
+		query := url.Values{}
+		query.Set("page[cursor]", next)
+		query.Set("page[limit]", strconv.Itoa(limit))
+		links = &jsonapi.LinksList{Next: "/settings/clients?" + query.Encode()}
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, links)
 }
 
 func revokeClient(c echo.Context) error {
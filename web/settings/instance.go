@@ -43,6 +43,13 @@ func getInstance(c echo.Context) error {
 	}
 	doc.Type = consts.Settings
 	doc.M["locale"] = instance.Locale
+	if len(instance.DefaultApps) > 0 {
+		statuses, err := instance.DefaultAppsStatus()
+		if err != nil {
+			return err
+		}
+		doc.M["default_apps"] = statuses
+	}
 
 	if err = permissions.Allow(c, permissions.GET, doc); err != nil {
 		return err
@@ -68,9 +75,17 @@ func updateInstance(c echo.Context) error {
 		return err
 	}
 
+	delete(doc.M, "default_apps")
+	changed := false
 	if locale, ok := doc.M["locale"].(string); ok {
 		delete(doc.M, "locale")
 		instance.Locale = locale
+		changed = true
+	}
+	if email, ok := doc.M["email"].(string); ok && instance.SetEmail(email) {
+		changed = true
+	}
+	if changed {
 		if err := couchdb.UpdateDoc(couchdb.GlobalDB, instance); err != nil {
 			return err
 		}
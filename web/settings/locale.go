@@ -0,0 +1,53 @@
+package settings
+
+import (
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/i18n"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/labstack/echo"
+)
+
+type apiLocale struct {
+	*i18n.Locale
+}
+
+func (j *apiLocale) ID() string                             { return consts.LocaleID }
+func (j *apiLocale) Rev() string                            { return "" }
+func (j *apiLocale) DocType() string                        { return consts.Settings }
+func (j *apiLocale) SetID(_ string)                         {}
+func (j *apiLocale) SetRev(_ string)                        {}
+func (j *apiLocale) Relationships() jsonapi.RelationshipMap { return nil }
+func (j *apiLocale) Included() []jsonapi.Object             { return nil }
+func (j *apiLocale) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/settings/locale"}
+}
+
+// Settings objects permissions are only on ID
+func (j *apiLocale) Valid(k, f string) bool { return false }
+
+// getLocale returns the metadata of the locale of the instance, or of the
+// locale given in the query-string, like the direction of the text and the
+// formats of the dates and numbers.
+func getLocale(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	result := &apiLocale{}
+
+	// Check permissions, but also allow every request from the logged-in user
+	// as this route is used by the cozy-bar from all the client-side apps
+	if err := permissions.Allow(c, permissions.GET, result); err != nil {
+		if !middlewares.IsLoggedIn(c) {
+			return err
+		}
+	}
+
+	code := c.QueryParam("locale")
+	if code == "" {
+		code = instance.Locale
+	}
+	result.Locale = i18n.Get(code)
+	return jsonapi.Data(c, http.StatusOK, result, nil)
+}
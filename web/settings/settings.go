@@ -9,6 +9,8 @@ import "github.com/labstack/echo"
 func Routes(router *echo.Group) {
 	router.GET("/theme.css", ThemeCSS)
 	router.GET("/disk-usage", diskUsage)
+	router.GET("/apps-usage", appsUsage)
+	router.GET("/locale", getLocale)
 
 	router.POST("/passphrase", registerPassphrase)
 	router.PUT("/passphrase", updatePassphrase)
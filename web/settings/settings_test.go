@@ -64,6 +64,45 @@ func TestDiskUsage(t *testing.T) {
 	assert.Equal(t, "0", used)
 }
 
+func TestGetLocale(t *testing.T) {
+	res, err := http.Get(ts.URL + "/settings/locale")
+	assert.NoError(t, err)
+	assert.Equal(t, 401, res.StatusCode)
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/settings/locale", nil)
+	assert.NoError(t, err)
+	req.Header.Add("Authorization", "Bearer "+testToken(testInstance))
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	var result map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	data, ok := result["data"].(map[string]interface{})
+	assert.True(t, ok)
+	assert.Equal(t, "io.cozy.settings", data["type"].(string))
+	assert.Equal(t, "io.cozy.settings.locale", data["id"].(string))
+	attrs, ok := data["attributes"].(map[string]interface{})
+	assert.True(t, ok)
+	assert.Equal(t, "en", attrs["code"])
+	assert.Equal(t, "ltr", attrs["direction"])
+	assert.Equal(t, "MM/DD/YYYY", attrs["date_format"])
+
+	req, err = http.NewRequest(http.MethodGet, ts.URL+"/settings/locale?locale=ar", nil)
+	assert.NoError(t, err)
+	req.Header.Add("Authorization", "Bearer "+testToken(testInstance))
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	result = nil
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	data, _ = result["data"].(map[string]interface{})
+	attrs, _ = data["attributes"].(map[string]interface{})
+	assert.Equal(t, "ar", attrs["code"])
+	assert.Equal(t, "rtl", attrs["direction"])
+}
+
 func TestRegisterPassphraseWrongToken(t *testing.T) {
 	args, _ := json.Marshal(&echo.Map{
 		"passphrase":     "MyFirstPassphrase",
@@ -276,6 +315,33 @@ func TestListClients(t *testing.T) {
 	assert.Equal(t, client.SoftwareID, attrs["software_id"].(string))
 	assert.Equal(t, client.SoftwareVersion, attrs["software_version"].(string))
 	assert.Nil(t, attrs["client_secret"])
+
+	listPage := func(path string) ([]interface{}, string) {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+		req.Header.Add("Authorization", "Bearer "+testClientsToken(testInstance))
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return nil, ""
+		}
+		defer res.Body.Close()
+		assert.Equal(t, 200, res.StatusCode)
+		var page struct {
+			Data  []interface{} `json:"data"`
+			Links struct {
+				Next string `json:"next"`
+			} `json:"links"`
+		}
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&page))
+		return page.Data, page.Links.Next
+	}
+	first, next := listPage("/settings/clients?page[limit]=1")
+	assert.Len(t, first, 1)
+	if assert.NotEmpty(t, next) {
+		second, next := listPage(next)
+		assert.Len(t, second, 1)
+		assert.Empty(t, next)
+		assert.NotEqual(t, first[0], second[0])
+	}
 }
 
 func TestRevokeClient(t *testing.T) {
@@ -16,6 +16,13 @@ func SharingAnswer(c echo.Context) error {
 
 	var err error
 
+	// The body is kept for the signature, as reading the form consumes it
+	req := c.Request()
+	body, err := sharings.ReadSignedBody(req)
+	if err != nil {
+		return wrapErrors(err)
+	}
+
 	state := c.FormValue("state")
 	clientID := c.FormValue("client_id")
 	scope := c.FormValue("scope")
@@ -26,6 +33,17 @@ func SharingAnswer(c echo.Context) error {
 	// The sharing is refused if there is no access code or scope
 	sharingAccepted := scope != "" && accessCode != ""
 
+	// An acceptance comes with the redirection of the browser of the
+	// recipient, after the authorize page of its cozy, and can't be signed.
+	// It is not a risk: the access code can be used only once, and only
+	// with the secret of the OAuth client, that the recipient doesn't send.
+	if !sharingAccepted {
+		err = sharings.VerifyAnswer(instance, req, body, state, clientID)
+		if err != nil {
+			return wrapErrors(err)
+		}
+	}
+
 	if sharingAccepted {
 		//TODO: handle the acceptation
 	} else {
@@ -40,6 +58,28 @@ func SharingAnswer(c echo.Context) error {
 	})
 }
 
+// RefuseSharing handles the refusal of a sharing request on the recipient
+// side: the answer is sent to the cozy of the sharer
+func RefuseSharing(c echo.Context) error {
+	if !middlewares.IsLoggedIn(c) {
+		return echo.NewHTTPError(http.StatusUnauthorized, "Error Must be authenticated")
+	}
+
+	state := c.FormValue("state")
+	clientID := c.FormValue("client_id")
+	redirectURI := c.FormValue("redirect_uri")
+
+	instance := middlewares.GetInstance(c)
+
+	err := sharings.SendAnswer(instance, state, clientID, redirectURI, "", "")
+	if err != nil {
+		return wrapErrors(err)
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"message": "Sharing refused",
+	})
+}
+
 // SharingRequest handles a sharing request from the recipient side
 // It creates a tempory sharing document and redirect to the authorize page
 func SharingRequest(c echo.Context) error {
@@ -113,7 +153,9 @@ func Routes(router *echo.Group) {
 	router.POST("/", CreateSharing)
 	router.PUT("/:id/sendMails", SendSharingMails)
 	router.GET("/request", SharingRequest)
+	router.GET("/answer", SharingAnswer)
 	router.POST("/answer", SharingAnswer)
+	router.POST("/refuse", RefuseSharing)
 }
 
 // wrapErrors returns a formatted error
@@ -127,10 +169,19 @@ func wrapErrors(err error) error {
 		return jsonapi.BadRequest(err)
 	case sharings.ErrMissingState:
 		return jsonapi.BadRequest(err)
+	case sharings.ErrBadRedirectURI:
+		return jsonapi.BadRequest(err)
+	case sharings.ErrNoOAuthClient:
+		return jsonapi.NotFound(err)
 	case sharings.ErrSharingDoesNotExist:
 		return jsonapi.NotFound(err)
 	case sharings.ErrMailCouldNotBeSent:
 		return jsonapi.InternalServerError(err)
+	case sharings.ErrBodyTooLarge:
+		return jsonapi.NewError(http.StatusRequestEntityTooLarge, err)
+	case sharings.ErrMissingSignature, sharings.ErrInvalidSignature,
+		sharings.ErrExpiredSignature, sharings.ErrReplayedRequest:
+		return jsonapi.NewError(http.StatusUnauthorized, err)
 	}
 	return err
 }
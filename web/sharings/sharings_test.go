@@ -65,6 +65,19 @@ func TestSharingAnswerBadClientID(t *testing.T) {
 	assert.Equal(t, 404, res.StatusCode)
 }
 
+func TestSharingAnswerAcceptanceByRedirect(t *testing.T) {
+	// The browser of the recipient is redirected with a GET, without signature
+	urlVal := url.Values{
+		"state":       {"stateoftheart"},
+		"client_id":   {"myclient"},
+		"scope":       {"io.cozy.events"},
+		"access_code": {"myaccesscode"},
+	}
+	res, err := requestGET("/sharings/answer", urlVal)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+}
+
 func TestSharingRequestNoScope(t *testing.T) {
 	urlVal := url.Values{}
 	res, err := requestGET("/sharings/request", urlVal)
@@ -7,6 +7,10 @@ import (
 
 	"github.com/cozy/checkup"
 	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/web/openapi"
+	"github.com/cozy/cozy-stack/web/permissions"
 	"github.com/labstack/echo"
 )
 
@@ -19,23 +23,45 @@ func Status(c echo.Context) error {
 	}
 
 	var message string
-	couchdb, err := checker.Check()
-	if err != nil || couchdb.Status() != checkup.Healthy {
+	result, err := checker.Check()
+	if err != nil || result.Status() != checkup.Healthy {
 		message = "KO"
 	} else {
 		message = "OK"
 	}
 
-	return c.JSON(http.StatusOK, echo.Map{
+	status := echo.Map{
 		"message": message,
-		"couchdb": couchdb.Status(),
-	})
+		"couchdb": result.Status(),
+	}
+	// The writes waiting for CouchDB to be available again
+	if n := couchdb.QueuedWrites(); n > 0 {
+		status["queued_writes"] = n
+	}
+	// The development toggles of the instance are shown to make it obvious
+	// that it is not configured like in production
+	if i, ok := c.Get("instance").(*instance.Instance); ok && i.Dev.Any() {
+		status["dev_options"] = i.Dev.Names()
+	}
+	return c.JSON(http.StatusOK, status)
 }
 
 // Routes sets the routing for the status service
-func Routes(router *echo.Group) {
-	router.GET("", Status)
-	router.HEAD("", Status)
-	router.GET("/", Status)
-	router.HEAD("/", Status)
+func Routes(router *permissions.Router) {
+	router.GET("", Status, permissions.Public)
+	router.HEAD("", Status, permissions.Public)
+	router.GET("/", Status, permissions.Public)
+	router.HEAD("/", Status, permissions.Public)
+}
+
+// Endpoints is the description of the routes of the status service, for the
+// OpenAPI document
+var Endpoints = []*openapi.Endpoint{
+	{Method: "GET", Path: "", Summary: "Check that the stack and CouchDB are up",
+		Response: struct {
+			CouchDB      string   `json:"couchdb"`
+			Message      string   `json:"message"`
+			QueuedWrites int      `json:"queued_writes,omitempty"`
+			DevOptions   []string `json:"dev_options,omitempty"`
+		}{}},
 }
@@ -8,7 +8,9 @@ import (
 	"testing"
 
 	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/web/errors"
+	"github.com/cozy/cozy-stack/web/permissions"
 	"github.com/labstack/echo"
 	"github.com/stretchr/testify/assert"
 )
@@ -27,7 +29,7 @@ func testRequest(t *testing.T, url string) {
 func TestRoutes(t *testing.T) {
 	handler := echo.New()
 	handler.HTTPErrorHandler = errors.ErrorHandler
-	Routes(handler.Group("/status"))
+	Routes(permissions.Group(handler, "/status"))
 
 	ts := httptest.NewServer(handler)
 	defer ts.Close()
@@ -35,6 +37,31 @@ func TestRoutes(t *testing.T) {
 	testRequest(t, ts.URL+"/status")
 }
 
+func TestDevOptions(t *testing.T) {
+	in := &instance.Instance{
+		Domain: "cozy.local",
+		Dev:    instance.DevOptions{AllowHTTP: true, VerboseErrors: true},
+	}
+	handler := echo.New()
+	handler.HTTPErrorHandler = errors.ErrorHandler
+	Routes(permissions.Group(handler, "/status", func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set("instance", in)
+			return next(c)
+		}
+	}))
+
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/status")
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"couchdb\":\"healthy\",\"dev_options\":[\"allow_http\",\"verbose_errors\"],\"message\":\"OK\"}", string(body))
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 	os.Exit(m.Run())
@@ -0,0 +1,101 @@
+// Package timeline exposes the timeline of the recent documents, merged from
+// several doctypes.
+package timeline
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/timeline"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/labstack/echo"
+)
+
+const defaultLimit = 20
+
+type apiItem struct {
+	*timeline.Item
+}
+
+func (i *apiItem) Relationships() jsonapi.RelationshipMap { return nil }
+func (i *apiItem) Included() []jsonapi.Object             { return nil }
+func (i *apiItem) Links() *jsonapi.LinksList              { return nil }
+
+// getTimeline returns a page of the timeline. The doctypes that the
+// application is not allowed to read are left out.
+func getTimeline(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+
+	var sources []*timeline.Source
+	if param := c.QueryParam("doctypes"); param != "" {
+		for _, doctype := range strings.Split(param, ",") {
+			src, err := timeline.SourceFor(doctype)
+			if err != nil {
+				return jsonapi.InvalidParameter("doctypes", err)
+			}
+			sources = append(sources, src)
+		}
+	} else {
+		sources = timeline.Sources
+	}
+
+	var allowed []*timeline.Source
+	var errPerm error
+	for _, src := range sources {
+		if err := permissions.AllowWholeType(c, permissions.GET, src.Doctype); err != nil {
+			errPerm = err
+			continue
+		}
+		allowed = append(allowed, src)
+	}
+	if len(allowed) == 0 {
+		return errPerm
+	}
+
+	limit := defaultLimit
+	if param := c.QueryParam("limit"); param != "" {
+		l, err := strconv.Atoi(param)
+		if err != nil || l <= 0 || l > timeline.MaxLimit {
+			return jsonapi.NewError(http.StatusBadRequest, "Invalid limit value")
+		}
+		limit = l
+	}
+
+	var cursor *timeline.Cursor
+	if param := c.QueryParam("cursor"); param != "" {
+		var err error
+		if cursor, err = timeline.ParseCursor(param); err != nil {
+			return jsonapi.InvalidParameter("cursor", err)
+		}
+	}
+
+	items, next, err := timeline.Get(instance, allowed, cursor, limit)
+	if err != nil {
+		return err
+	}
+
+	objs := make([]jsonapi.Object, len(items))
+	for i, item := range items {
+		objs[i] = &apiItem{item}
+	}
+	var links *jsonapi.LinksList
+	if next != nil {
+		query := url.Values{}
+		query.Set("cursor", next.String())
+		query.Set("limit", strconv.Itoa(limit))
+		if param := c.QueryParam("doctypes"); param != "" {
+			query.Set("doctypes", param)
+		}
+		links = &jsonapi.LinksList{Next: "/timeline?" + query.Encode()}
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, links)
+}
+
+// Routes sets the routing for the timeline service
+func Routes(router *echo.Group) {
+	router.GET("", getTimeline)
+}
@@ -6,6 +6,8 @@ import (
 	"runtime"
 
 	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/web/openapi"
+	"github.com/cozy/cozy-stack/web/permissions"
 	"github.com/labstack/echo"
 )
 
@@ -20,9 +22,21 @@ func Version(c echo.Context) error {
 }
 
 // Routes sets the routing for the version service
-func Routes(router *echo.Group) {
-	router.GET("", Version)
-	router.HEAD("", Version)
-	router.GET("/", Version)
-	router.HEAD("/", Version)
+func Routes(router *permissions.Router) {
+	router.GET("", Version, permissions.Public)
+	router.HEAD("", Version, permissions.Public)
+	router.GET("/", Version, permissions.Public)
+	router.HEAD("/", Version, permissions.Public)
+}
+
+// Endpoints is the description of the routes of the version service, for the
+// OpenAPI document
+var Endpoints = []*openapi.Endpoint{
+	{Method: "GET", Path: "", Summary: "Get the version of the stack",
+		Response: struct {
+			Version        string `json:"version"`
+			BuildMode      string `json:"build_mode"`
+			BuildTime      string `json:"build_time"`
+			RuntimeVersion string `json:"runtime_version"`
+		}{}},
 }